@@ -32,19 +32,46 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/networknext/udpx/modules/analytics"
 	"github.com/networknext/udpx/modules/core"
 	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/health"
+	"github.com/networknext/udpx/modules/jwt"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/metrics"
+	"github.com/networknext/udpx/modules/policy"
+	"github.com/networknext/udpx/modules/redis"
+	"github.com/networknext/udpx/modules/router"
+	"github.com/networknext/udpx/modules/status"
+	"github.com/networknext/udpx/modules/systemd"
+	"github.com/networknext/udpx/modules/tracing"
 
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Allows us to return an exit code and allows log flushes and deferred functions
@@ -54,34 +81,95 @@ func main() {
 }
 
 var GatewayAddress *net.UDPAddr
+var FallbackGatewayAddresses []*net.UDPAddr
 var GatewayPublicKey [core.PublicKeyBytes_Box]byte
-var GatewayPrivateKey [core.PrivateKeyBytes_Box]byte
 var AuthPublicKey [core.PublicKeyBytes_Box]byte
 var AuthPrivateKey [core.PrivateKeyBytes_Box]byte
+var AuthSignPublicKey [core.PublicKeyBytes_Sign]byte
+var AuthSignPrivateKey [core.PrivateKeyBytes_Sign]byte
+var TenantId uint16
+var ConnectTokenTTL time.Duration
+var FECDataShards uint8
+var FECParityShards uint8
+var JWTVerifier *jwt.Verifier
+var BindClientIP bool
+var ClientIPHeader string
+var TrustedProxies []*net.IPNet
+var AdminToken string
+var GatewayToken string
+var RouterURL string
+var RouterToken string
+var RouterClient *http.Client
+var Policy policy.UserPolicy
+var PolicyFailOpen bool
+var IPLimiter RequestLimiter
+var UserLimiter RequestLimiter
+var HealthChecks *health.Checks
+
+// DrainStartTime is when auth started draining on SIGTERM or /admin/prestop, in unix nanoseconds, or zero.
+// Draining fails readiness for DRAIN_DELAY before auth stops taking requests, so load balancers can catch up
+var DrainStartTime atomic.Int64
+var DrainDelay time.Duration
+
+// AuditRecords publishes a token event for each token issued or refused when AUDIT_SINK is set
+var AuditRecords *analytics.Publisher
+
+var Revocations = core.CreateRevocationList()
+
+var Metrics = metrics.CreateRegistry()
+
+var Status = status.CreateReporter("udpx auth", Metrics, time.Now())
+
+var ConnectTokensIssued = Metrics.Counter("udpx_auth_connect_tokens_issued_total", "Connect tokens issued.")
+var SessionTokensIssued = Metrics.Counter("udpx_auth_session_tokens_issued_total", "Session tokens refreshed.")
+var RoutedTokensIssued = Metrics.Counter("udpx_auth_routed_tokens_issued_total", "Connect tokens issued with a route through relay gateways.")
+var RouterFailures = Metrics.Counter("udpx_auth_router_failures_total", "Route requests to the router that failed, falling back to GATEWAY_ADDRESS.")
+var RevokedTokenRequests = Metrics.Counter("udpx_auth_revoked_requests_total", "Token requests refused for a revoked session or user.")
+var PolicyDeniedRequests = Metrics.Counter("udpx_auth_policy_denied_total", "Connect token requests denied by the user policy.")
+var PolicyFailures = Metrics.Counter("udpx_auth_policy_failures_total", "Connect token requests where the user policy could not be consulted.")
+var IPRateLimitedRequests = Metrics.Counter(`udpx_auth_rate_limited_total{limit="ip"}`, "Token requests refused with 429 by the rate limits.")
+var UserRateLimitedRequests = Metrics.Counter(`udpx_auth_rate_limited_total{limit="user"}`, "Token requests refused with 429 by the rate limits.")
+var RateLimitFailures = Metrics.Counter("udpx_auth_rate_limit_failures_total", "Token requests let through because the rate limits could not be checked.")
+var ConnectTokenRequestsRejected = Metrics.Counter(`udpx_auth_requests_rejected_total{handler="connect_token"}`, "Token requests rejected as unauthorized or invalid.")
+var SessionTokenRequestsRejected = Metrics.Counter(`udpx_auth_requests_rejected_total{handler="session_token"}`, "Token requests rejected as unauthorized or invalid.")
+var ConnectTokenLatency = Metrics.Histogram(`udpx_auth_request_seconds{handler="connect_token"}`, "Time taken to handle token requests.", metrics.LatencyBuckets)
+var SessionTokenLatency = Metrics.Histogram(`udpx_auth_request_seconds{handler="session_token"}`, "Time taken to handle token requests.", metrics.LatencyBuckets)
+
+const ConnectTokenRequestBytes = core.UserIdBytes
+const ConnectTokenRequestWithEnvelopeBytes = core.UserIdBytes + core.EnvelopeBytes + core.PacketsPerSecondBytes
+
+// RouteHeader carries the base64 route through relay gateways alongside a connect token, when the router picked one
+const RouteHeader = "X-UDPX-Route"
 
 func mainReturnWithCode() int {
 
 	serviceName := "udpx auth"
 
-	core.Info("%s", serviceName)
+	log.SetService(serviceName)
+
+	core.Info("%s %s", serviceName, status.VersionString())
 
 	// configure
 
-	gatewayAddress, err := envvar.GetAddress("GATEWAY_ADDRESS", core.ParseAddress("127.0.0.1:40000"))
+	gatewayAddressConfig := envvar.Get("GATEWAY_ADDRESS", "127.0.0.1:40000")
+
+	gatewayAddress, err := core.ResolveAddress(gatewayAddressConfig)
 	if err != nil {
 		core.Error("invalid GATEWAY_ADDRESS: %v", err)
 		return 1
 	}
 
-	gatewayPublicKey, err := envvar.GetBase64("GATEWAY_PUBLIC_KEY", nil)
-	if err != nil || len(gatewayPublicKey) != core.PublicKeyBytes_Box {
-		core.Error("missing or invalid GATEWAY_PUBLIC_KEY: %v", err)
+	// clients fail over to the fallback gateways in order when they stop hearing from their gateway
+
+	fallbackGatewayAddresses, err := envvar.GetAddressList("FALLBACK_GATEWAY_ADDRESSES", nil)
+	if err != nil || len(fallbackGatewayAddresses) > core.MaxFallbackGateways {
+		core.Error("invalid FALLBACK_GATEWAY_ADDRESSES: %v", err)
 		return 1
 	}
 
-	gatewayPrivateKey, err := envvar.GetBase64("GATEWAY_PRIVATE_KEY", nil)
-	if err != nil || len(gatewayPrivateKey) != core.PrivateKeyBytes_Box {
-		core.Error("missing or invalid GATEWAY_PRIVATE_KEY: %v", err)
+	gatewayPublicKey, err := envvar.GetBase64("GATEWAY_PUBLIC_KEY", nil)
+	if err != nil || len(gatewayPublicKey) != core.PublicKeyBytes_Box {
+		core.Error("missing or invalid GATEWAY_PUBLIC_KEY: %v", err)
 		return 1
 	}
 
@@ -97,35 +185,479 @@ func mainReturnWithCode() int {
 		return 1
 	}
 
+	// session tokens are signed, so gateways only need the auth public signing key to trust them
+
+	authSignPublicKey, err := envvar.GetBase64("AUTH_SIGN_PUBLIC_KEY", nil)
+	if err != nil || len(authSignPublicKey) != core.PublicKeyBytes_Sign {
+		core.Error("missing or invalid AUTH_SIGN_PUBLIC_KEY: %v", err)
+		return 1
+	}
+
+	authSignPrivateKey, err := envvar.GetBase64("AUTH_SIGN_PRIVATE_KEY", nil)
+	if err != nil || len(authSignPrivateKey) != core.PrivateKeyBytes_Sign {
+		core.Error("missing or invalid AUTH_SIGN_PRIVATE_KEY: %v", err)
+		return 1
+	}
+
+	// gateways shared between games check each tenant's session tokens with that tenant's keys. a dedicated
+	// fleet leaves TENANT_ID at 0, the gateway's default tenant
+
+	tenantId, err := envvar.GetIntRange("TENANT_ID", 0, 0, math.MaxUint16)
+	if err != nil {
+		core.Error("invalid TENANT_ID: %v", err)
+		return 1
+	}
+
+	connectTokenTTL, err := envvar.GetDurationRange("CONNECT_TOKEN_TTL", time.Second*core.ConnectTokenExpireSeconds, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid CONNECT_TOKEN_TTL: %v", err)
+		return 1
+	}
+
+	fecDataShards, err := envvar.GetInt("FEC_DATA_SHARDS", 0)
+	if err != nil {
+		core.Error("invalid FEC_DATA_SHARDS: %v", err)
+		return 1
+	}
+
+	fecParityShards, err := envvar.GetInt("FEC_PARITY_SHARDS", 0)
+	if err != nil {
+		core.Error("invalid FEC_PARITY_SHARDS: %v", err)
+		return 1
+	}
+
+	if err := core.ValidateFECConfig(fecDataShards, fecParityShards); err != nil {
+		core.Error("invalid FEC_DATA_SHARDS and FEC_PARITY_SHARDS: %v", err)
+		return 1
+	}
+
+	// strict mode binds connect tokens to the ip that requested them, so they can't be shared between machines.
+	// behind a load balancer, the client ip comes from a header it sets instead of the connection
+
+	bindClientIP, err := envvar.GetBool("BIND_CLIENT_IP", false)
+	if err != nil {
+		core.Error("invalid BIND_CLIENT_IP: %v", err)
+		return 1
+	}
+
+	clientIPHeader := envvar.Get("CLIENT_IP_HEADER", "")
+
+	// proxies append the address they got the request from to the header, so only entries added by proxies we
+	// trust can be believed. without TRUSTED_PROXIES, the load balancer in front of auth is the only one
+
+	trustedProxies, err := core.ParseBlocklist(envvar.Get("TRUSTED_PROXIES", ""))
+	if err != nil {
+		core.Error("invalid TRUSTED_PROXIES: %v", err)
+		return 1
+	}
+
+	jwtSecret := envvar.Get("AUTH_JWT_SECRET", "")
+	jwksURL := envvar.Get("AUTH_JWKS_URL", "")
+
+	jwksRefresh, err := envvar.GetDuration("AUTH_JWKS_REFRESH", time.Hour)
+	if err != nil {
+		core.Error("invalid AUTH_JWKS_REFRESH: %v", err)
+		return 1
+	}
+
+	if jwtSecret != "" && jwksURL != "" {
+		core.Error("set only one of AUTH_JWT_SECRET and AUTH_JWKS_URL")
+		return 1
+	}
+
+	if jwtSecret != "" {
+		JWTVerifier = jwt.CreateSecretVerifier([]byte(jwtSecret))
+		core.Info("requiring HS256 bearer tokens")
+	} else if jwksURL != "" {
+		JWTVerifier = jwt.CreateJWKSVerifier(jwksURL, jwksRefresh)
+		core.Info("requiring RS256 bearer tokens from %s", jwksURL)
+	} else {
+		core.Info("bearer tokens are not required. anybody can request connect tokens")
+	}
+
+	httpsCertFile := envvar.Get("HTTPS_CERT_FILE", "")
+	httpsKeyFile := envvar.Get("HTTPS_KEY_FILE", "")
+
+	if (httpsCertFile == "") != (httpsKeyFile == "") {
+		core.Error("HTTPS_CERT_FILE and HTTPS_KEY_FILE must be set together")
+		return 1
+	}
+
+	tlsMinVersion, err := parseTLSVersion(envvar.Get("TLS_MIN_VERSION", "1.2"))
+	if err != nil {
+		core.Error("invalid TLS_MIN_VERSION: %v", err)
+		return 1
+	}
+
+	httpsRedirectPort := envvar.Get("HTTPS_REDIRECT_PORT", "")
+	if httpsRedirectPort != "" && httpsCertFile == "" {
+		core.Error("HTTPS_REDIRECT_PORT requires HTTPS_CERT_FILE and HTTPS_KEY_FILE")
+		return 1
+	}
+
+	// the admin api revokes sessions and users. gateways poll the revocation list and drop their packets
+
+	adminToken := envvar.Get("ADMIN_TOKEN", "")
+
+	// the revocation list has every revoked session and user id, so only gateways get it. they fetch it with
+	// GATEWAY_TOKEN, or the admin token
+
+	gatewayToken := envvar.Get("GATEWAY_TOKEN", "")
+
+	shutdownTimeout, err := envvar.GetDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		core.Error("invalid SHUTDOWN_TIMEOUT: %v", err)
+		return 1
+	}
+
+	DrainDelay, err = envvar.GetDurationRange("DRAIN_DELAY", 0, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid DRAIN_DELAY: %v", err)
+		return 1
+	}
+
+	// with ROUTER_URL, connect token requests that name the client region get the gateway the router picks for
+	// that region, and a route through relay gateways when it is faster. all gateways share the gateway keypair
+
+	routerURL := strings.TrimSuffix(envvar.Get("ROUTER_URL", ""), "/")
+	routerToken := envvar.Get("ROUTER_TOKEN", "")
+
+	routerTimeout, err := envvar.GetDuration("ROUTER_TIMEOUT", time.Second)
+	if err != nil {
+		core.Error("invalid ROUTER_TIMEOUT: %v", err)
+		return 1
+	}
+
+	// with USER_POLICY, every connect token request is checked against a ban list (or with USER_POLICY_MODE=allow,
+	// an allow list) in a file, a redis set, or by asking an http service. denied users get a 403, and a refused
+	// token record in AUDIT_SINK
+
+	var userPolicy policy.UserPolicy
+	policyFailOpen := false
+	if policyURL := envvar.Get("USER_POLICY", ""); policyURL != "" {
+		policyTimeout, err := envvar.GetDuration("USER_POLICY_TIMEOUT", time.Second)
+		if err != nil {
+			core.Error("invalid USER_POLICY_TIMEOUT: %v", err)
+			return 1
+		}
+		userPolicy, err = policy.ParseUserPolicy(policyURL, envvar.Get("USER_POLICY_MODE", "ban"), policyTimeout)
+		if err != nil {
+			core.Error("invalid USER_POLICY: %v", err)
+			return 1
+		}
+		policyFailOpen, err = envvar.GetBool("USER_POLICY_FAIL_OPEN", false)
+		if err != nil {
+			core.Error("invalid USER_POLICY_FAIL_OPEN: %v", err)
+			return 1
+		}
+	}
+
+	// with AUDIT_SINK, a record of every token issued or refused, with the user, client ip, gateway, session
+	// and expiry, goes to a file, pub/sub topic or kafka topic for abuse investigations
+
+	auditSink := envvar.Get("AUDIT_SINK", "")
+
+	auditQueueSize, err := envvar.GetIntRange("AUDIT_QUEUE_SIZE", 10000, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid AUDIT_QUEUE_SIZE: %v", err)
+		return 1
+	}
+
+	if auditSink != "" {
+		sink, err := analytics.ParseSink(auditSink)
+		if err != nil {
+			core.Error("invalid AUDIT_SINK: %v", err)
+			return 1
+		}
+		AuditRecords = analytics.CreatePublisher(sink, auditQueueSize, 100, time.Second)
+		defer func() {
+			if err := AuditRecords.Close(); err != nil {
+				core.Error("could not close audit sink: %v", err)
+			}
+			published, dropped, failed := AuditRecords.GetStats()
+			core.Info("published %d audit records, %d dropped, %d failed", published, dropped, failed)
+		}()
+		core.Info("publishing audit records to %s", strings.SplitN(auditSink, "?", 2)[0])
+	}
+
+	// token requests, and the sessions they start, are traced when OTEL_EXPORTER_OTLP_ENDPOINT is set
+
+	stopTracing, err := tracing.Start(serviceName)
+	if err != nil {
+		core.Error("invalid tracing config: %v", err)
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := stopTracing(ctx); err != nil {
+			core.Error("could not flush traces: %v", err)
+		}
+	}()
+
+	for i, result := range []string{"published", "dropped", "failed"} {
+		resultIndex := i
+		Metrics.CounterFunc(fmt.Sprintf(`udpx_auth_audit_records_total{result="%s"}`, result), "Audit records published, dropped because the queue was full, or lost because the sink failed.", func() uint64 {
+			if AuditRecords == nil {
+				return 0
+			}
+			published, dropped, failed := AuditRecords.GetStats()
+			return [...]uint64{published, dropped, failed}[resultIndex]
+		})
+	}
+
+	// token requests are limited per client ip and per user with RATE_LIMIT_IP_RPS and RATE_LIMIT_USER_RPS, since
+	// minting tokens is expensive crypto. limits are per auth instance, or shared by every instance through
+	// redis with RATE_LIMIT_REDIS_URL. refused requests get a 429 with Retry-After
+
+	ipRateLimit, err := envvar.GetFloat("RATE_LIMIT_IP_RPS", 0)
+	if err != nil {
+		core.Error("invalid RATE_LIMIT_IP_RPS: %v", err)
+		return 1
+	}
+
+	ipRateLimitBurst, err := envvar.GetIntRange("RATE_LIMIT_IP_BURST", 10, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid RATE_LIMIT_IP_BURST: %v", err)
+		return 1
+	}
+
+	userRateLimit, err := envvar.GetFloat("RATE_LIMIT_USER_RPS", 0)
+	if err != nil {
+		core.Error("invalid RATE_LIMIT_USER_RPS: %v", err)
+		return 1
+	}
+
+	userRateLimitBurst, err := envvar.GetIntRange("RATE_LIMIT_USER_BURST", 5, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid RATE_LIMIT_USER_BURST: %v", err)
+		return 1
+	}
+
+	rateLimitEntries, err := envvar.GetIntRange("RATE_LIMIT_ENTRIES", 100000, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid RATE_LIMIT_ENTRIES: %v", err)
+		return 1
+	}
+
+	var rateLimitClient *redis.Client
+	if rateLimitRedisURL := envvar.Get("RATE_LIMIT_REDIS_URL", ""); rateLimitRedisURL != "" && (ipRateLimit > 0 || userRateLimit > 0) {
+		rateLimitTimeout, err := envvar.GetDuration("RATE_LIMIT_REDIS_TIMEOUT", 100*time.Millisecond)
+		if err != nil {
+			core.Error("invalid RATE_LIMIT_REDIS_TIMEOUT: %v", err)
+			return 1
+		}
+		rateLimitClient, err = redis.CreateClient(rateLimitRedisURL, 32, rateLimitTimeout)
+		if err != nil {
+			core.Error("invalid RATE_LIMIT_REDIS_URL: %v", err)
+			return 1
+		}
+		defer rateLimitClient.Close()
+	}
+
+	createRequestLimiter := func(name string, requestsPerSecond float64, burst int) RequestLimiter {
+		if requestsPerSecond <= 0 {
+			return nil
+		}
+		if rateLimitClient != nil {
+			core.Info("limiting token requests to %.1f per second per %s, burst %d, shared through redis", requestsPerSecond, name, burst)
+			return CreateRedisRequestLimiter(rateLimitClient, "udpx:ratelimit:"+name+":", requestsPerSecond, float64(burst))
+		}
+		core.Info("limiting token requests to %.1f per second per %s, burst %d", requestsPerSecond, name, burst)
+		return CreateLocalRequestLimiter(requestsPerSecond, float64(burst), rateLimitEntries)
+	}
+
+	IPLimiter = createRequestLimiter("ip", ipRateLimit, ipRateLimitBurst)
+	UserLimiter = createRequestLimiter("user", userRateLimit, userRateLimitBurst)
+
 	GatewayAddress = gatewayAddress
+	FallbackGatewayAddresses = fallbackGatewayAddresses
 	copy(GatewayPublicKey[:], gatewayPublicKey[:])
-	copy(GatewayPrivateKey[:], gatewayPrivateKey[:])
 	copy(AuthPublicKey[:], authPublicKey[:])
 	copy(AuthPrivateKey[:], authPrivateKey[:])
+	copy(AuthSignPublicKey[:], authSignPublicKey[:])
+	copy(AuthSignPrivateKey[:], authSignPrivateKey[:])
+	TenantId = uint16(tenantId)
+	ConnectTokenTTL = connectTokenTTL
+	FECDataShards = uint8(fecDataShards)
+	FECParityShards = uint8(fecParityShards)
+	BindClientIP = bindClientIP
+	ClientIPHeader = clientIPHeader
+	TrustedProxies = trustedProxies
+	AdminToken = adminToken
+	GatewayToken = gatewayToken
+	RouterURL = routerURL
+	RouterToken = routerToken
+	RouterClient = &http.Client{Timeout: routerTimeout, Transport: tracing.Transport(nil)}
+	Policy = userPolicy
+	PolicyFailOpen = policyFailOpen
+
+	if RouterURL != "" {
+		core.Info("picking gateways with the router at %s", RouterURL)
+	}
+
+	if BindClientIP {
+		core.Info("binding connect tokens to client ip")
+	}
+
+	if TenantId != 0 {
+		core.Info("issuing tokens for tenant %d", TenantId)
+	}
+
+	if Policy != nil {
+		core.Info("checking users against the %s user policy", Policy.Name())
+	}
+
+	if len(FallbackGatewayAddresses) > 0 {
+		core.Info("clients fail over to %d fallback gateways", len(FallbackGatewayAddresses))
+	}
+
+	// /ready fails while draining or when a check fails, so kubernetes stops sending requests here. /health is
+	// the same as /ready, and /live only checks auth is answering
+
+	healthTimeout, err := envvar.GetDuration("HEALTH_CHECK_TIMEOUT", 500*time.Millisecond)
+	if err != nil {
+		core.Error("invalid HEALTH_CHECK_TIMEOUT: %v", err)
+		return 1
+	}
+
+	HealthChecks = health.CreateChecks(healthTimeout)
+	HealthChecks.Add("draining", func() error {
+		if DrainStartTime.Load() != 0 {
+			return fmt.Errorf("draining")
+		}
+		return nil
+	})
+	HealthChecks.Add("keys", func() error {
+		for _, key := range []struct {
+			name  string
+			value []byte
+		}{
+			{"GATEWAY_PUBLIC_KEY", GatewayPublicKey[:]},
+			{"AUTH_PRIVATE_KEY", AuthPrivateKey[:]},
+			{"AUTH_SIGN_PRIVATE_KEY", AuthSignPrivateKey[:]},
+		} {
+			if bytes.Equal(key.value, make([]byte, len(key.value))) {
+				return fmt.Errorf("%s is not loaded", key.name)
+			}
+		}
+		return nil
+	})
+	HealthChecks.Add("gateway_address", func() error {
+		_, err := core.ResolveAddress(gatewayAddressConfig)
+		return err
+	})
+	if Policy != nil {
+		HealthChecks.Add("user_policy", Policy.Ping)
+	}
+	if rateLimitClient != nil {
+		HealthChecks.Add("rate_limit_store", func() error {
+			_, err := rateLimitClient.Do("PING")
+			return err
+		})
+	}
+
+	Status.SetConfig(envvar.Values())
+
+	// with systemd socket activation, the sockets named http and redirect in the socket unit are passed in and
+	// stay open across restarts, so connections queue in the kernel while auth restarts
+
+	activatedSockets, err := systemd.ListenSockets()
+	if err != nil {
+		core.Error("could not take socket activated sockets: %v", err)
+		return 1
+	}
+
+	httpListener, err := activatedSockets.Listener("http")
+	if err != nil {
+		core.Error("could not take socket activated http socket: %v", err)
+		return 1
+	}
+
+	redirectListener, err := activatedSockets.Listener("redirect")
+	if err != nil {
+		core.Error("could not take socket activated redirect socket: %v", err)
+		return 1
+	}
+
+	for _, name := range activatedSockets.Names() {
+		core.Warn("ignoring socket activated socket %q", name)
+	}
+	activatedSockets.Close()
 
 	// start web server
+
+	var srv *http.Server
+	var redirect *http.Server
 	{
-		router := mux.NewRouter()
-		router.HandleFunc("/health", healthHandler).Methods("GET")
-		router.HandleFunc("/status", statusHandler).Methods("GET")
-		router.HandleFunc("/connect_token", connectTokenHandler).Methods("GET")
-		router.HandleFunc("/session_token", sessionTokenHandler).Methods("POST")
+		router := createRouter()
 
 		httpPort := envvar.Get("HTTP_PORT", "60000")
 
-		srv := &http.Server{
+		srv = &http.Server{
 			Addr:    ":" + httpPort,
 			Handler: router,
 		}
 
-		go func() {
-			core.Info("started http server on port %s", httpPort)
-			err := srv.ListenAndServe()
-			if err != nil {
-				core.Error("failed to start http server: %v", err)
-				return
+		if httpsCertFile != "" {
+
+			srv.TLSConfig = &tls.Config{MinVersion: tlsMinVersion}
+
+			go func() {
+				var err error
+				if httpListener != nil {
+					core.Info("started https server on socket activated %s", httpListener.Addr())
+					err = srv.ServeTLS(httpListener, httpsCertFile, httpsKeyFile)
+				} else {
+					core.Info("started https server on port %s", httpPort)
+					err = srv.ListenAndServeTLS(httpsCertFile, httpsKeyFile)
+				}
+				if err != nil && err != http.ErrServerClosed {
+					core.Error("failed to start https server: %v", err)
+					return
+				}
+			}()
+
+			if httpsRedirectPort != "" {
+				redirect = &http.Server{
+					Addr:    ":" + httpsRedirectPort,
+					Handler: httpsRedirectHandler(httpPort),
+				}
+				go func() {
+					var err error
+					if redirectListener != nil {
+						core.Info("redirecting http on socket activated %s to https", redirectListener.Addr())
+						err = redirect.Serve(redirectListener)
+					} else {
+						core.Info("redirecting http on port %s to https", httpsRedirectPort)
+						err = redirect.ListenAndServe()
+					}
+					if err != nil && err != http.ErrServerClosed {
+						core.Error("failed to start http redirect server: %v", err)
+						return
+					}
+				}()
 			}
-		}()
+
+		} else {
+
+			core.Info("HTTPS_CERT_FILE is not set. tokens will be sent over plaintext http")
+
+			go func() {
+				var err error
+				if httpListener != nil {
+					core.Info("started http server on socket activated %s", httpListener.Addr())
+					err = srv.Serve(httpListener)
+				} else {
+					core.Info("started http server on port %s", httpPort)
+					err = srv.ListenAndServe()
+				}
+				if err != nil && err != http.ErrServerClosed {
+					core.Error("failed to start http server: %v", err)
+					return
+				}
+			}()
+		}
 	}
 
 	// wait for shutdown
@@ -134,88 +666,742 @@ func mainReturnWithCode() int {
 	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
 	<-termChan
 
+	// keep answering while unready for what is left of DRAIN_DELAY. another signal skips the wait
+
+	startDrain()
+
+	if delay := drainDelayLeft(); delay > 0 {
+		core.Info("draining. waiting %s for load balancers to stop sending requests", delay.Round(time.Millisecond))
+		select {
+		case <-termChan:
+		case <-time.After(delay):
+		}
+	}
+
+	// stop accepting new token requests and drain the ones in flight
+
+	core.Info("shutting down. draining http requests for up to %s", shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		core.Error("failed to drain http requests: %v", err)
+		return 1
+	}
+
 	fmt.Println("shutdown completed")
 
 	return 0
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := ioutil.ReadAll(r.Body)
+func createRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/health", HealthChecks.ReadyHandler).Methods("GET")
+	router.HandleFunc("/ready", HealthChecks.ReadyHandler).Methods("GET")
+	router.HandleFunc("/live", health.LiveHandler).Methods("GET")
+	router.Handle("/status", Status).Methods("GET")
+	router.Handle("/metrics", Metrics).Methods("GET")
+	router.Handle("/connect_token", tracing.Handler("auth.connect_token", measureRequest(ConnectTokenLatency, ConnectTokenRequestsRejected, limitClientIP(requireBearerToken(http.HandlerFunc(connectTokenHandler)))))).Methods("POST")
+	router.Handle("/session_token", tracing.Handler("auth.session_token", measureRequest(SessionTokenLatency, SessionTokenRequestsRejected, limitClientIP(requireBearerToken(http.HandlerFunc(sessionTokenHandler)))))).Methods("POST")
+	if GatewayToken != "" || AdminToken != "" {
+		router.Handle("/revocations", requireGatewayToken(http.HandlerFunc(revocationsHandler))).Methods("GET")
+	} else {
+		core.Info("GATEWAY_TOKEN and ADMIN_TOKEN are not set. revocation list is disabled")
+	}
+	if AdminToken != "" {
+		router.Handle("/admin/revocations/sessions/{session_id}", requireAdminToken(http.HandlerFunc(revokeSessionHandler))).Methods("POST")
+		router.Handle("/admin/revocations/users/{user_id}", requireAdminToken(http.HandlerFunc(revokeUserHandler))).Methods("POST")
+		router.Handle("/admin/revocations/users/{user_id}", requireAdminToken(http.HandlerFunc(restoreUserHandler))).Methods("DELETE")
+		router.Handle("/admin/prestop", requireAdminToken(http.HandlerFunc(prestopHandler))).Methods("GET", "POST")
+	} else {
+		core.Info("ADMIN_TOKEN is not set. admin api is disabled")
+	}
+	return router
+}
+
+func startDrain() {
+	DrainStartTime.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+func drainDelayLeft() time.Duration {
+	return DrainDelay - time.Since(time.Unix(0, DrainStartTime.Load()))
+}
+
+// prestopHandler fails readiness and answers after DRAIN_DELAY, so it can be the preStop hook of a kubernetes pod.
+// kubernetes sends SIGTERM once it returns, and auth then stops without waiting again
+
+func prestopHandler(w http.ResponseWriter, r *http.Request) {
+	startDrain()
+	select {
+	case <-time.After(drainDelayLeft()):
+	case <-r.Context().Done():
+	}
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version %q", version)
+}
+
+func httpsRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := "https://" + net.JoinHostPort(host, httpsPort) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func measureRequest(latency *metrics.Histogram, rejected *metrics.Counter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		latency.ObserveSince(start)
+		if recorder.status != http.StatusOK {
+			rejected.Inc()
+		}
+	})
+}
+
+// limitClientIP refuses requests from client ips over RATE_LIMIT_IP_RPS, before anything expensive is done
+func limitClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IPLimiter != nil {
+			if key := rateLimitKey(r); !allowRequest(w, IPLimiter, key, IPRateLimitedRequests) {
+				core.Debug("client ip %s is rate limited", key)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitKey is the client ip a request is limited by. when there is no client ip, because the header has an
+// entry that doesn't parse, requests are limited by the address they came from instead of not at all, so a bad
+// header can't get around the limit
+func rateLimitKey(r *http.Request) string {
+	if clientIP := requestClientIP(r); clientIP != nil {
+		return clientIP.String()
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// limitUser refuses requests from users over RATE_LIMIT_USER_RPS, and returns false if it did
+func limitUser(w http.ResponseWriter, userId []byte) bool {
+	if UserLimiter == nil {
+		return true
+	}
+	if !allowRequest(w, UserLimiter, core.IdString(userId), UserRateLimitedRequests) {
+		core.Debug("user %s is rate limited", core.IdString(userId))
+		return false
+	}
+	return true
+}
+
+// allowRequest checks a request against a limiter, and writes a 429 with Retry-After if it is over the limit.
+// requests are let through when the limiter fails, so an outage of the shared limits doesn't take auth down
+func allowRequest(w http.ResponseWriter, limiter RequestLimiter, key string, limited *metrics.Counter) bool {
+	wait, err := limiter.Allow(key, time.Now())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		core.Debug("could not check rate limit: %v", err)
+		RateLimitFailures.Inc()
+		return true
 	}
-	defer r.Body.Close()
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		limited.Inc()
+		return false
+	}
+	return true
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "hello world\n")
+type claimsKey struct{}
+
+func requireBearerToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if JWTVerifier == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			core.Debug("missing bearer token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims, err := JWTVerifier.Verify(strings.TrimPrefix(authorization, "Bearer "), time.Now())
+		if err != nil {
+			core.Debug("invalid bearer token: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
 }
 
 func connectTokenHandler(w http.ResponseWriter, r *http.Request) {
-	// todo: potentially may want to read in user id from POST binary request data
+
+	// request data is the user id, optionally followed by envelope up kbps, envelope down kbps and packets per second
+
+	requestData, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ConnectTokenRequestWithEnvelopeBytes))
+	if err != nil {
+		core.Debug("could not read request data: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(requestData) != ConnectTokenRequestBytes && len(requestData) != ConnectTokenRequestWithEnvelopeBytes {
+		core.Debug("bad request length (%d)", len(requestData))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	var userId [core.UserIdBytes]byte
 	envelopeUpKbps := uint32(2500)
 	envelopeDownKbps := uint32(10000)
 	packetsPerSecond := uint8(100)
-	connectToken := core.GenerateConnectToken(userId[:], envelopeUpKbps, envelopeDownKbps, packetsPerSecond, GatewayAddress, GatewayPublicKey[:], AuthPrivateKey[:], GatewayPublicKey[:])
+
+	index := 0
+	core.ReadBytes(requestData, &index, userId[:], core.UserIdBytes)
+
+	// when bearer tokens are required, the user id comes from the token subject
+
+	if claims, ok := r.Context().Value(claimsKey{}).(*jwt.Claims); ok {
+		userId = sha256.Sum256([]byte(claims.Subject))
+	}
+
+	if len(requestData) == ConnectTokenRequestWithEnvelopeBytes {
+		core.ReadUint32(requestData, &index, &envelopeUpKbps)
+		core.ReadUint32(requestData, &index, &envelopeDownKbps)
+		core.ReadUint8(requestData, &index, &packetsPerSecond)
+		if envelopeUpKbps == 0 || envelopeDownKbps == 0 || packetsPerSecond == 0 {
+			core.Debug("invalid envelope: up %d kbps, down %d kbps, %d packets per second", envelopeUpKbps, envelopeDownKbps, packetsPerSecond)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !limitUser(w, userId[:]) {
+		return
+	}
+
+	if Revocations.IsRevoked(nil, userId[:], uint64(time.Now().Unix())) {
+		core.Debug("user %s is revoked", core.IdString(userId[:]))
+		RevokedTokenRequests.Inc()
+		publishAuditRecord(analytics.TokenRefusedEvent, r, nil, userId[:], nil, 0, "revoked")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if Policy != nil {
+		_, span := tracing.StartSpan(r.Context(), "auth.user_policy", trace.WithAttributes(attribute.String("udpx.user_policy", Policy.Name())))
+		allowed, err := Policy.Allow(userId[:], requestClientIP(r))
+		span.SetAttributes(attribute.Bool("udpx.allowed", allowed))
+		span.End()
+		if err != nil {
+			core.Warn("could not check user %s against the %s user policy: %v", core.IdString(userId[:]), Policy.Name(), err)
+			PolicyFailures.Inc()
+			if !PolicyFailOpen {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			allowed = true
+		}
+		if !allowed {
+			PolicyDeniedRequests.Inc()
+			publishAuditRecord(analytics.TokenRefusedEvent, r, nil, userId[:], nil, 0, "policy")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	var clientIP net.IP
+	if BindClientIP {
+		clientIP = requestClientIP(r)
+		if clientIP == nil {
+			core.Debug("could not determine client ip")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	gatewayAddress := GatewayAddress
+	var relayAddresses []*net.UDPAddr
+	if region := r.URL.Query().Get("region"); RouterURL != "" && region != "" {
+		gatewayAddress, relayAddresses, err = fetchRoute(r.Context(), region)
+		if err != nil {
+			core.Debug("could not get route for region %s: %v", region, err)
+			RouterFailures.Inc()
+			gatewayAddress, relayAddresses = GatewayAddress, nil
+		}
+	}
+
+	connectToken := core.GenerateBoundConnectToken(userId[:], envelopeUpKbps, envelopeDownKbps, packetsPerSecond, FECDataShards, FECParityShards, uint64(ConnectTokenTTL.Seconds()), gatewayAddress, GatewayPublicKey[:], AuthSignPrivateKey[:], TenantId, clientIP)
+
+	if len(relayAddresses) > 0 {
+		index := 0
+		var connectData core.ConnectData
+		core.ReadConnectData(connectToken, &index, &connectData)
+		route, err := core.GenerateRoute(connectData.ClientPublicKey[:], uint64(ConnectTokenTTL.Seconds()), relayAddresses, gatewayAddress, AuthPrivateKey[:], GatewayPublicKey[:])
+		if err != nil {
+			core.Error("could not generate route: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(RouteHeader, base64.StdEncoding.EncodeToString(route))
+		RoutedTokensIssued.Inc()
+	}
+
+	var fallbackGatewayAddresses []*net.UDPAddr
+	for _, fallbackGatewayAddress := range FallbackGatewayAddresses {
+		if !core.AddressEqual(fallbackGatewayAddress, gatewayAddress) {
+			fallbackGatewayAddresses = append(fallbackGatewayAddresses, fallbackGatewayAddress)
+		}
+	}
+	connectToken = core.AppendFallbackGateways(connectToken, fallbackGatewayAddresses)
+
+	if AuditRecords != nil || tracing.Enabled() {
+		index := 0
+		var connectData core.ConnectData
+		core.ReadConnectData(connectToken, &index, &connectData)
+		publishAuditRecord(analytics.ConnectTokenEvent, r, gatewayAddress, userId[:], connectData.ClientPublicKey[:], connectData.ExpireTimestamp, "")
+
+		// the session's trace starts here. gateways add their spans for it under this root
+
+		_, span := tracing.StartSession(r.Context(), connectData.ClientPublicKey[:], trace.WithAttributes(
+			attribute.String("udpx.user_id", core.IdString(userId[:])),
+			attribute.String("udpx.gateway_address", gatewayAddress.String()),
+			attribute.Int("udpx.relays", len(relayAddresses)),
+		))
+		span.End()
+	}
+
+	core.Debug("issued connect token for user %s via %s", core.IdString(userId[:]), gatewayAddress)
+
+	ConnectTokensIssued.Inc()
+
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.WriteHeader(http.StatusOK)
 	w.Write(connectToken)
 }
 
+// fetchRoute asks the router which gateway clients in the region should connect to, and through which relays
+func fetchRoute(ctx context.Context, region string) (*net.UDPAddr, []*net.UDPAddr, error) {
+
+	ctx, span := tracing.StartSpan(ctx, "auth.fetch_route", trace.WithAttributes(attribute.String("udpx.region", region)))
+	defer span.End()
+
+	r, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/route?region=%s", RouterURL, url.QueryEscape(region)), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if RouterToken != "" {
+		r.Header.Set("Authorization", "Bearer "+RouterToken)
+	}
+
+	response, err := RouterClient.Do(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	var route router.Route
+	if err := json.NewDecoder(response.Body).Decode(&route); err != nil {
+		return nil, nil, err
+	}
+
+	if len(route.RelayAddresses) > core.MaxRouteHops {
+		return nil, nil, fmt.Errorf("route has %d relays, at most %d are supported", len(route.RelayAddresses), core.MaxRouteHops)
+	}
+
+	gatewayAddress, err := core.ResolveAddress(route.GatewayAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	relayAddresses := make([]*net.UDPAddr, len(route.RelayAddresses))
+	for i := range route.RelayAddresses {
+		if relayAddresses[i], err = core.ResolveAddress(route.RelayAddresses[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return gatewayAddress, relayAddresses, nil
+}
+
+// publishAuditRecord publishes a token event to AUDIT_SINK, if it is set. the session id and expiry are left
+// out when the request was refused
+func publishAuditRecord(eventType string, r *http.Request, gatewayAddress *net.UDPAddr, userId []byte, sessionId []byte, expireTimestamp uint64, reason string) {
+	if AuditRecords == nil {
+		return
+	}
+	event := analytics.Event{
+		Type:      eventType,
+		Timestamp: time.Now(),
+		UserId:    core.IdString(userId),
+		Reason:    reason,
+	}
+	if gatewayAddress != nil {
+		event.GatewayAddress = gatewayAddress.String()
+	}
+	if sessionId != nil {
+		event.SessionId = core.IdString(sessionId)
+	}
+	if clientIP := requestClientIP(r); clientIP != nil {
+		event.ClientAddress = clientIP.String()
+	}
+	if expireTimestamp != 0 {
+		event.ExpireTime = time.Unix(int64(expireTimestamp), 0).UTC()
+	}
+	AuditRecords.Publish(event)
+}
+
+// requestClientIP returns the ip of the client making the request. with CLIENT_IP_HEADER set, the header is read
+// from the right, skipping the addresses of trusted proxies. entries left of those were written by the client, so
+// can't be used
+func requestClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	remoteIP := net.ParseIP(host)
+	if ClientIPHeader == "" || remoteIP == nil || (len(TrustedProxies) > 0 && !trustedProxy(remoteIP)) {
+		return remoteIP
+	}
+	entries := strings.Split(strings.Join(r.Header.Values(ClientIPHeader), ","), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil || i == 0 || !trustedProxy(ip) {
+			return ip
+		}
+	}
+	return remoteIP
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func sessionTokenHandler(w http.ResponseWriter, r *http.Request) {
 
 	requestData, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		// todo: core debug
-		fmt.Printf("could not read request data: %v\n", err)
+		core.Debug("could not read request data: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if len(requestData) != core.EncryptedSessionTokenBytes {
-		// todo: core debug
-		fmt.Printf("bad request length (%d)\n", len(requestData))
+	if len(requestData) != core.SignedSessionTokenBytes {
+		core.Debug("bad request length (%d)", len(requestData))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	index := 0
 	var sessionToken core.SessionToken
-	result := core.ReadEncryptedSessionToken(requestData, &index, &sessionToken, AuthPublicKey[:], GatewayPrivateKey[:])
+	result := core.ReadSignedSessionToken(requestData, &index, &sessionToken, AuthSignPublicKey[:])
 	if !result {
-		// todo: core debug
-		fmt.Printf("invalid session token\n")
+		core.Debug("invalid session token")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if sessionToken.ExpireTimestamp > uint64(time.Now().Unix())+core.SessionTokenExtensionSeconds {
-		// todo: core debug
-		fmt.Printf("too soon\n")
-		w.WriteHeader(http.StatusBadRequest)
+	if !limitUser(w, sessionToken.UserId[:]) {
 		return
 	}
 
-	if sessionToken.ExpireTimestamp < uint64(time.Now().Unix()) {
-		// todo: core debug
-		fmt.Printf("session token has expired\n")
-		w.WriteHeader(http.StatusBadRequest)
+	if Revocations.IsRevoked(sessionToken.SessionId[:], sessionToken.UserId[:], uint64(time.Now().Unix())) {
+		core.Debug("session %s is revoked", core.IdString(sessionToken.SessionId[:]))
+		RevokedTokenRequests.Inc()
+		publishAuditRecord(analytics.TokenRefusedEvent, r, nil, sessionToken.UserId[:], sessionToken.SessionId[:], 0, "revoked")
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	sessionToken.ExpireTimestamp += core.SessionTokenExtensionSeconds
+	if err := core.ExtendSessionToken(&sessionToken, uint64(time.Now().Unix())); err != nil {
+		core.Debug("%v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	index = 0
-	responseData := [core.EncryptedSessionTokenBytes]byte{}
-	core.WriteEncryptedSessionToken(responseData[:], &index, &sessionToken, AuthPrivateKey[:], GatewayPublicKey[:])
+	responseData := [core.SignedSessionTokenBytes]byte{}
+	core.WriteSignedSessionToken(responseData[:], &index, &sessionToken, AuthSignPrivateKey[:])
 
 	core.Info("updated session token %s", core.IdString(sessionToken.SessionId[:]))
 
+	publishAuditRecord(analytics.SessionTokenEvent, r, nil, sessionToken.UserId[:], sessionToken.SessionId[:], sessionToken.ExpireTimestamp, "")
+
+	SessionTokensIssued.Inc()
+
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.WriteHeader(http.StatusOK)
 	w.Write(responseData[:])
 }
+
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+AdminToken)) != 1 {
+			core.Debug("invalid admin token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requireGatewayToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := []byte(r.Header.Get("Authorization"))
+		gateway := GatewayToken != "" && subtle.ConstantTimeCompare(authorization, []byte("Bearer "+GatewayToken)) == 1
+		admin := AdminToken != "" && subtle.ConstantTimeCompare(authorization, []byte("Bearer "+AdminToken)) == 1
+		if !gateway && !admin {
+			core.Debug("invalid gateway token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// revocationsHandler serves the revocation list to gateways. gateways pass the version they have, and get
+// nothing back until it changes
+
+func revocationsHandler(w http.ResponseWriter, r *http.Request) {
+	if version := r.URL.Query().Get("version"); version != "" && version == strconv.FormatUint(Revocations.GetVersion(), 10) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Revocations.Get(uint64(time.Now().Unix()))); err != nil {
+		core.Debug("failed to write revocations: %v", err)
+	}
+}
+
+// revokeSessionHandler revokes a session. the auth service stops refreshing its session token, so the
+// revocation only has to outlast the longest a session token it issued stays valid
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var sessionId [core.SessionIdBytes]byte
+	if err := core.ParseId(strings.ToLower(mux.Vars(r)["session_id"]), sessionId[:]); err != nil {
+		core.Debug("invalid session id: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	currentTimestamp := uint64(time.Now().Unix())
+	expireTimestamp := currentTimestamp + uint64(ConnectTokenTTL.Seconds()) + 2*core.SessionTokenExtensionSeconds + core.TimestampToleranceSeconds
+	Revocations.RevokeSession(sessionId, expireTimestamp, currentTimestamp)
+	core.Info("revoked session %s", core.IdString(sessionId[:]))
+	w.WriteHeader(http.StatusOK)
+}
+
+// revokeUserHandler revokes a user, for the duration given as a query parameter or until they are restored
+
+func revokeUserHandler(w http.ResponseWriter, r *http.Request) {
+	var userId [core.UserIdBytes]byte
+	if err := core.ParseId(strings.ToLower(mux.Vars(r)["user_id"]), userId[:]); err != nil {
+		core.Debug("invalid user id: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	currentTimestamp := uint64(time.Now().Unix())
+	expireTimestamp := uint64(0)
+	if durationParam := r.URL.Query().Get("duration"); durationParam != "" {
+		duration, err := time.ParseDuration(durationParam)
+		if err != nil || duration < time.Second {
+			core.Debug("invalid revocation duration: %s", durationParam)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		expireTimestamp = currentTimestamp + uint64(duration.Seconds())
+	}
+	Revocations.RevokeUser(userId, expireTimestamp, currentTimestamp)
+	core.Info("revoked user %s", core.IdString(userId[:]))
+	w.WriteHeader(http.StatusOK)
+}
+
+func restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	var userId [core.UserIdBytes]byte
+	if err := core.ParseId(strings.ToLower(mux.Vars(r)["user_id"]), userId[:]); err != nil {
+		core.Debug("invalid user id: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	Revocations.RestoreUser(userId, uint64(time.Now().Unix()))
+	core.Info("restored user %s", core.IdString(userId[:]))
+	w.WriteHeader(http.StatusOK)
+}
+
+// RequestLimiter limits requests per key, where a key is a client ip or a user. Allow returns zero if the
+// request is allowed, or how long to wait before trying again if it isn't.
+type RequestLimiter interface {
+	Allow(key string, currentTime time.Time) (time.Duration, error)
+}
+
+type requestBucket struct {
+	key        string
+	tokens     float64
+	lastUpdate time.Time
+}
+
+// LocalRequestLimiter is a token bucket per key, kept in memory, so each auth instance has limits of its own.
+// The number of buckets is bounded, with the least recently used bucket recycled once the limit is reached.
+type LocalRequestLimiter struct {
+	mutex             sync.Mutex
+	requestsPerSecond float64
+	burst             float64
+	maxEntries        int
+	entries           map[string]*list.Element
+	lru               *list.List
+}
+
+func CreateLocalRequestLimiter(requestsPerSecond float64, burst float64, maxEntries int) *LocalRequestLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &LocalRequestLimiter{
+		requestsPerSecond: requestsPerSecond,
+		burst:             burst,
+		maxEntries:        maxEntries,
+		entries:           make(map[string]*list.Element, maxEntries),
+		lru:               list.New(),
+	}
+}
+
+func (limiter *LocalRequestLimiter) Allow(key string, currentTime time.Time) (time.Duration, error) {
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	var bucket *requestBucket
+
+	if element, exists := limiter.entries[key]; exists {
+		limiter.lru.MoveToFront(element)
+		bucket = element.Value.(*requestBucket)
+		elapsed := currentTime.Sub(bucket.lastUpdate).Seconds()
+		if elapsed > 0 {
+			bucket.tokens = math.Min(bucket.tokens+elapsed*limiter.requestsPerSecond, limiter.burst)
+			bucket.lastUpdate = currentTime
+		}
+	} else {
+		if limiter.lru.Len() >= limiter.maxEntries {
+			oldest := limiter.lru.Back()
+			bucket = oldest.Value.(*requestBucket)
+			delete(limiter.entries, bucket.key)
+			limiter.lru.MoveToFront(oldest)
+			limiter.entries[key] = oldest
+		} else {
+			bucket = &requestBucket{}
+			limiter.entries[key] = limiter.lru.PushFront(bucket)
+		}
+		bucket.key = key
+		bucket.tokens = limiter.burst
+		bucket.lastUpdate = currentTime
+	}
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / limiter.requestsPerSecond * float64(time.Second)), nil
+	}
+
+	bucket.tokens--
+
+	return 0, nil
+}
+
+// gcraScript is the generic cell rate algorithm. The key holds the time, in microseconds by the redis clock,
+// at which the bucket would be full again. It needs redis 5 or later, for TIME before a write.
+const gcraScript = `
+local now = redis.call('TIME')
+now = tonumber(now[1]) * 1000000 + tonumber(now[2])
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+tat = tat + interval
+local wait = tat - now - burst * interval
+if wait > 0 then
+	return wait
+end
+redis.call('SET', KEYS[1], string.format('%d', tat), 'PX', math.ceil((tat - now) / 1000))
+return 0
+`
+
+// RedisClient sends a command to redis. *redis.Client is one.
+type RedisClient interface {
+	Do(args ...string) (interface{}, error)
+}
+
+// RedisRequestLimiter keeps its limits in redis, so they hold across a fleet of auth instances.
+type RedisRequestLimiter struct {
+	client   RedisClient
+	prefix   string
+	interval int64
+	burst    int64
+}
+
+func CreateRedisRequestLimiter(client RedisClient, prefix string, requestsPerSecond float64, burst float64) *RedisRequestLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	interval := int64(math.Ceil(float64(time.Second/time.Microsecond) / requestsPerSecond))
+	return &RedisRequestLimiter{client: client, prefix: prefix, interval: interval, burst: int64(burst)}
+}
+
+func (limiter *RedisRequestLimiter) Allow(key string, currentTime time.Time) (time.Duration, error) {
+	reply, err := limiter.client.Do("EVAL", gcraScript, "1", limiter.prefix+key, strconv.FormatInt(limiter.interval, 10), strconv.FormatInt(limiter.burst, 10))
+	if err != nil {
+		return 0, err
+	}
+	wait, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply to EVAL: %v", reply)
+	}
+	return time.Duration(wait) * time.Microsecond, nil
+}
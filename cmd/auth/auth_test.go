@@ -0,0 +1,508 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/analytics"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/jwt"
+	"github.com/networknext/udpx/modules/policy"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestClientIP(t *testing.T) {
+	defer func() {
+		ClientIPHeader = ""
+		TrustedProxies = nil
+	}()
+
+	tests := []struct {
+		name           string
+		header         string
+		trustedProxies string
+		remoteAddr     string
+		headers        []string
+		clientIP       string
+	}{
+		{name: "no header configured", remoteAddr: "203.0.113.7:5000", headers: []string{"198.51.100.1"}, clientIP: "203.0.113.7"},
+		{name: "load balancer", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:5000", headers: []string{"203.0.113.7"}, clientIP: "203.0.113.7"},
+		{name: "forged left hand entry", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:5000", headers: []string{"198.51.100.1, 203.0.113.7"}, clientIP: "203.0.113.7"},
+		{name: "forged header line", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:5000", headers: []string{"198.51.100.1", "203.0.113.7"}, clientIP: "203.0.113.7"},
+		{name: "missing header", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:5000", clientIP: "10.0.0.1"},
+		{name: "malformed entry", header: "X-Forwarded-For", remoteAddr: "10.0.0.1:5000", headers: []string{"203.0.113.7, bogus"}, clientIP: ""},
+		{name: "trusted proxy chain", header: "X-Forwarded-For", trustedProxies: "10.0.0.0/8, 192.0.2.1", remoteAddr: "10.0.0.1:5000", headers: []string{"198.51.100.1, 203.0.113.7, 192.0.2.1, 10.2.0.1"}, clientIP: "203.0.113.7"},
+		{name: "all entries trusted", header: "X-Forwarded-For", trustedProxies: "10.0.0.0/8", remoteAddr: "10.0.0.1:5000", headers: []string{"10.3.0.1, 10.2.0.1"}, clientIP: "10.3.0.1"},
+		{name: "untrusted peer", header: "X-Forwarded-For", trustedProxies: "10.0.0.0/8", remoteAddr: "203.0.113.7:5000", headers: []string{"198.51.100.1"}, clientIP: "203.0.113.7"},
+		{name: "ipv6", header: "X-Forwarded-For", remoteAddr: "[fd00::1]:5000", headers: []string{"2001:db8::1, 2001:db8::7"}, clientIP: "2001:db8::7"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trustedProxies, err := core.ParseBlocklist(test.trustedProxies)
+			require.NoError(t, err)
+			ClientIPHeader = test.header
+			TrustedProxies = trustedProxies
+
+			r := httptest.NewRequest("POST", "/connect_token", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.headers {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			clientIP := requestClientIP(r)
+			if test.clientIP == "" {
+				assert.Nil(t, clientIP)
+			} else {
+				assert.True(t, net.ParseIP(test.clientIP).Equal(clientIP), "got %v", clientIP)
+			}
+		})
+	}
+}
+
+func TestLimitClientIP(t *testing.T) {
+	defer func() {
+		IPLimiter = nil
+		ClientIPHeader = ""
+	}()
+
+	IPLimiter = CreateLocalRequestLimiter(1, 1, 100)
+	ClientIPHeader = "X-Forwarded-For"
+
+	handler := limitClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(remoteAddr string, header string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/connect_token", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-For", header)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// requests are limited by the client ip the load balancer saw, not by the load balancer
+
+	assert.Equal(t, http.StatusOK, request("10.0.0.1:5000", "203.0.113.7").Code)
+	w := request("10.0.0.1:5000", "203.0.113.7")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, request("10.0.0.1:5000", "198.51.100.1").Code)
+
+	// entries the client wrote are ignored, so a client can't get a fresh limit by forging one
+
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.1:5000", "198.51.100.9, 203.0.113.7").Code)
+
+	// without a client ip, requests are limited by the address they came from instead of not at all
+
+	assert.Equal(t, http.StatusOK, request("10.0.0.2:5000", "bogus").Code)
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.2:5000", "nonsense").Code)
+}
+
+func TestLocalRequestLimiter(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := CreateLocalRequestLimiter(10, 3, 2)
+	start := time.Now()
+
+	// a burst of requests are allowed at once, then requests are allowed at the rate
+
+	for i := 0; i < 3; i++ {
+		wait, err := limiter.Allow("a", start)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+
+	wait, _ := limiter.Allow("a", start)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(wait), float64(time.Millisecond))
+
+	wait, _ = limiter.Allow("a", start.Add(50*time.Millisecond))
+	assert.InDelta(t, float64(50*time.Millisecond), float64(wait), float64(time.Millisecond))
+
+	wait, _ = limiter.Allow("a", start.Add(100*time.Millisecond))
+	assert.Equal(t, time.Duration(0), wait)
+
+	wait, _ = limiter.Allow("a", start.Add(100*time.Millisecond))
+	assert.NotEqual(t, time.Duration(0), wait)
+
+	// a quiet key only gets its burst back, no more
+
+	later := start.Add(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		wait, _ = limiter.Allow("a", later)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+	wait, _ = limiter.Allow("a", later)
+	assert.NotEqual(t, time.Duration(0), wait)
+
+	// keys have limits of their own, and the least recently used key is forgotten once there are too many
+
+	for i := 0; i < 3; i++ {
+		wait, _ = limiter.Allow("b", later)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+	wait, _ = limiter.Allow("a", later)
+	assert.NotEqual(t, time.Duration(0), wait)
+
+	wait, _ = limiter.Allow("c", later)
+	assert.Equal(t, time.Duration(0), wait)
+
+	wait, _ = limiter.Allow("a", later)
+	assert.NotEqual(t, time.Duration(0), wait)
+
+	wait, _ = limiter.Allow("b", later)
+	assert.Equal(t, time.Duration(0), wait)
+
+	// a burst below one still allows a request
+
+	limiter = CreateLocalRequestLimiter(1, 0, 10)
+	wait, _ = limiter.Allow("a", start)
+	assert.Equal(t, time.Duration(0), wait)
+	wait, _ = limiter.Allow("a", start)
+	assert.InDelta(t, float64(time.Second), float64(wait), float64(time.Millisecond))
+}
+
+// gcraClient runs the rate limit script in go, with a clock of its own in place of the redis clock
+type gcraClient struct {
+	t      *testing.T
+	now    int64
+	values map[string]int64
+	reply  interface{}
+	err    error
+}
+
+func (client *gcraClient) Do(args ...string) (interface{}, error) {
+	if client.err != nil {
+		return nil, client.err
+	}
+	if client.reply != nil {
+		return client.reply, nil
+	}
+	require.Equal(client.t, []string{"EVAL", gcraScript, "1"}, args[:3])
+	interval, err := strconv.ParseInt(args[4], 10, 64)
+	require.NoError(client.t, err)
+	burst, err := strconv.ParseInt(args[5], 10, 64)
+	require.NoError(client.t, err)
+	tat, ok := client.values[args[3]]
+	if !ok || tat < client.now {
+		tat = client.now
+	}
+	tat += interval
+	if wait := tat - client.now - burst*interval; wait > 0 {
+		return wait, nil
+	}
+	client.values[args[3]] = tat
+	return int64(0), nil
+}
+
+func TestRedisRequestLimiter(t *testing.T) {
+
+	client := &gcraClient{t: t, now: 1000000, values: make(map[string]int64)}
+	limiter := CreateRedisRequestLimiter(client, "udpx:ratelimit:ip:", 10, 3)
+
+	// a burst of requests are allowed at once, then requests are allowed at the rate
+
+	for i := 0; i < 3; i++ {
+		wait, err := limiter.Allow("203.0.113.7", time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+	assert.Contains(t, client.values, "udpx:ratelimit:ip:203.0.113.7")
+
+	wait, err := limiter.Allow("203.0.113.7", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	wait, _ = limiter.Allow("198.51.100.1", time.Now())
+	assert.Equal(t, time.Duration(0), wait)
+
+	client.now += 100000
+
+	wait, _ = limiter.Allow("203.0.113.7", time.Now())
+	assert.Equal(t, time.Duration(0), wait)
+	wait, _ = limiter.Allow("203.0.113.7", time.Now())
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	// a quiet key only gets its burst back, no more
+
+	client.now += 10000000
+
+	for i := 0; i < 3; i++ {
+		wait, _ = limiter.Allow("203.0.113.7", time.Now())
+		assert.Equal(t, time.Duration(0), wait)
+	}
+	wait, _ = limiter.Allow("203.0.113.7", time.Now())
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	// rates that don't divide a second round the interval up, so the limit is never exceeded
+
+	assert.Equal(t, int64(333334), CreateRedisRequestLimiter(client, "", 3, 1).interval)
+
+	// failures and unexpected replies are errors, and requests are let through when the limiter fails
+
+	client.reply = "OK"
+	_, err = limiter.Allow("203.0.113.7", time.Now())
+	assert.Error(t, err)
+
+	client.err = fmt.Errorf("connection refused")
+	_, err = limiter.Allow("203.0.113.7", time.Now())
+	assert.Error(t, err)
+
+	failures := RateLimitFailures.Get()
+	w := httptest.NewRecorder()
+	assert.True(t, allowRequest(w, limiter, "203.0.113.7", IPRateLimitedRequests))
+	assert.Equal(t, failures+1, RateLimitFailures.Get())
+}
+
+func signHS256(t *testing.T, secret []byte, claims jwt.Claims) string {
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		require.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(jwt.Header{Algorithm: "HS256"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestRevocationsRequireGatewayToken(t *testing.T) {
+	defer func() {
+		JWTVerifier = nil
+		GatewayToken = ""
+		AdminToken = ""
+	}()
+
+	secret := []byte("secret")
+	JWTVerifier = jwt.CreateSecretVerifier(secret)
+	GatewayToken = "gateway token"
+	AdminToken = "admin token"
+
+	router := createRouter()
+
+	userToken := signHS256(t, secret, jwt.Claims{Subject: "user", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "end user token", authorization: "Bearer " + userToken, status: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer gateway", status: http.StatusUnauthorized},
+		{name: "gateway token", authorization: "Bearer gateway token", status: http.StatusOK},
+		{name: "admin token", authorization: "Bearer admin token", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/revocations", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			assert.Equal(t, test.status, w.Code)
+		})
+	}
+}
+
+func TestRevocationsDisabledWithoutTokens(t *testing.T) {
+	r := httptest.NewRequest("GET", "/revocations", nil)
+	w := httptest.NewRecorder()
+	createRouter().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestTokens drives the connect and session token handlers the way a game backend and a gateway do
+
+func TestTokens(t *testing.T) {
+
+	gatewayPublicKey, gatewayPrivateKey := core.Keygen_Box()
+	authSignPublicKey, authSignPrivateKey := core.Keygen_Sign()
+
+	GatewayAddress = core.ParseAddress("127.0.0.1:40000")
+	copy(GatewayPublicKey[:], gatewayPublicKey)
+	copy(AuthSignPublicKey[:], authSignPublicKey)
+	copy(AuthSignPrivateKey[:], authSignPrivateKey)
+	ConnectTokenTTL = time.Minute
+
+	server := httptest.NewServer(createRouter())
+	defer server.Close()
+
+	post := func(path string, data []byte) (int, []byte) {
+		response, err := http.Post(server.URL+path, "application/octet-stream", bytes.NewReader(data))
+		require.NoError(t, err)
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		return response.StatusCode, body
+	}
+
+	// connect tokens send the client to the gateway, and expire after CONNECT_TOKEN_TTL
+
+	issued := ConnectTokensIssued.Get()
+
+	userId := core.RandomBytes(core.UserIdBytes)
+	status, connectToken := post("/connect_token", userId)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, issued+1, ConnectTokensIssued.Get())
+
+	index := 0
+	var connectData core.ConnectData
+	require.True(t, core.ReadConnectData(connectToken, &index, &connectData))
+	assert.True(t, core.AddressEqual(GatewayAddress, &connectData.GatewayAddress))
+	assert.InDelta(t, time.Now().Add(ConnectTokenTTL).Unix(), int64(connectData.ExpireTimestamp), 1)
+
+	// the session token in it is encrypted to the gateway, so the user id is only visible to the gateway
+
+	assert.False(t, bytes.Contains(connectToken, userId))
+
+	var signedSessionTokenData [core.SignedSessionTokenBytes]byte
+	require.True(t, core.DecryptSessionToken(connectToken[index:], connectData.ClientPublicKey[:], signedSessionTokenData[:], gatewayPrivateKey))
+	index = 0
+	var connectSessionToken core.SessionToken
+	require.True(t, core.ReadSignedSessionToken(signedSessionTokenData[:], &index, &connectSessionToken, authSignPublicKey))
+	assert.Equal(t, userId, connectSessionToken.UserId[:])
+
+	status, _ = post("/connect_token", userId[:10])
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// session tokens about to expire are extended
+
+	currentTimestamp := uint64(time.Now().Unix())
+	sessionToken := core.SessionToken{IssueTimestamp: currentTimestamp, ExpireTimestamp: currentTimestamp + 2}
+	copy(sessionToken.SessionId[:], connectData.ClientPublicKey[:])
+	copy(sessionToken.UserId[:], userId)
+
+	var sessionTokenData [core.SignedSessionTokenBytes]byte
+	index = 0
+	core.WriteSignedSessionToken(sessionTokenData[:], &index, &sessionToken, authSignPrivateKey)
+
+	issued = SessionTokensIssued.Get()
+
+	status, responseData := post("/session_token", sessionTokenData[:])
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, issued+1, SessionTokensIssued.Get())
+
+	index = 0
+	var extendedToken core.SessionToken
+	require.True(t, core.ReadSignedSessionToken(responseData, &index, &extendedToken, authSignPublicKey))
+	assert.Equal(t, sessionToken.ExpireTimestamp+core.SessionTokenExtensionSeconds, extendedToken.ExpireTimestamp)
+
+	// tokens auth didn't sign are refused, and so are revoked sessions
+
+	_, otherPrivateKey := core.Keygen_Sign()
+	index = 0
+	core.WriteSignedSessionToken(sessionTokenData[:], &index, &sessionToken, otherPrivateKey)
+	status, _ = post("/session_token", sessionTokenData[:])
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	index = 0
+	core.WriteSignedSessionToken(sessionTokenData[:], &index, &sessionToken, authSignPrivateKey)
+	Revocations.RevokeSession(sessionToken.SessionId, currentTimestamp+60, currentTimestamp)
+	status, _ = post("/session_token", sessionTokenData[:])
+	assert.Equal(t, http.StatusForbidden, status)
+
+	assert.Equal(t, issued+1, SessionTokensIssued.Get())
+}
+
+// eventSink keeps the events written to it
+type eventSink struct {
+	events []analytics.Event
+}
+
+func (sink *eventSink) Write(events []analytics.Event) error {
+	sink.events = append(sink.events, events...)
+	return nil
+}
+
+func (sink *eventSink) Close() error {
+	return nil
+}
+
+func TestPolicyDenialAuditRecord(t *testing.T) {
+
+	bannedUserId := core.RandomBytes(core.UserIdBytes)
+
+	path := filepath.Join(t.TempDir(), "banned")
+	require.NoError(t, os.WriteFile(path, []byte(core.IdString(bannedUserId)+"\n"), 0644))
+	banList, err := policy.ParseUserList("ban")
+	require.NoError(t, err)
+	Policy, err = policy.CreateFileUserPolicy(path, banList)
+	require.NoError(t, err)
+	defer func() { Policy = nil }()
+
+	sink := &eventSink{}
+	AuditRecords = analytics.CreatePublisher(sink, 10, 10, time.Second)
+	defer func() { AuditRecords = nil }()
+
+	server := httptest.NewServer(createRouter())
+	defer server.Close()
+
+	// users denied by the user policy are recorded in the audit sink, like every other refused token
+
+	denied := PolicyDeniedRequests.Get()
+
+	response, err := http.Post(server.URL+"/connect_token", "application/octet-stream", bytes.NewReader(bannedUserId))
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	assert.Equal(t, denied+1, PolicyDeniedRequests.Get())
+
+	require.NoError(t, AuditRecords.Close())
+	require.Equal(t, 1, len(sink.events))
+	assert.Equal(t, analytics.TokenRefusedEvent, sink.events[0].Type)
+	assert.Equal(t, "policy", sink.events[0].Reason)
+	assert.Equal(t, core.IdString(bannedUserId), sink.events[0].UserId)
+	assert.Equal(t, "127.0.0.1", sink.events[0].ClientAddress)
+}
@@ -0,0 +1,249 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+// Result is the best of the runs of one benchmark. ns/op is the minimum over the runs, since noise only
+// ever makes a benchmark slower
+type Result struct {
+	NsPerOp     float64 `json:"ns_per_op"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+}
+
+var benchmarkLine = regexp.MustCompile(`^(Benchmark\S+?)(-\d+)?\s+\d+\s+(.*)$`)
+
+// parse reads go test -bench -benchmem output. results are keyed by package and benchmark name, eg.
+// "modules/core/BenchmarkGenerateChonkle"
+func parse(reader io.Reader, echo io.Writer) (map[string]Result, error) {
+
+	results := make(map[string]Result)
+
+	pkg := ""
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+
+		line := scanner.Text()
+
+		fmt.Fprintln(echo, line)
+
+		if strings.HasPrefix(line, "pkg: ") {
+			pkg = strings.TrimPrefix(strings.TrimPrefix(line, "pkg: "), "github.com/networknext/udpx/")
+			continue
+		}
+
+		match := benchmarkLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		result := Result{NsPerOp: -1, BytesPerOp: -1, AllocsPerOp: -1}
+
+		fields := strings.Fields(match[3])
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i+1] {
+			case "ns/op":
+				result.NsPerOp, _ = strconv.ParseFloat(fields[i], 64)
+			case "B/op":
+				result.BytesPerOp, _ = strconv.ParseInt(fields[i], 10, 64)
+			case "allocs/op":
+				result.AllocsPerOp, _ = strconv.ParseInt(fields[i], 10, 64)
+			}
+		}
+
+		if result.NsPerOp < 0 || result.AllocsPerOp < 0 {
+			return nil, fmt.Errorf("no ns/op and allocs/op in %q, benchmarks must run with -benchmem", line)
+		}
+
+		name := pkg + "/" + match[1]
+
+		if previous, ok := results[name]; ok && previous.NsPerOp < result.NsPerOp {
+			result.NsPerOp = previous.NsPerOp
+		}
+
+		results[name] = result
+	}
+
+	return results, scanner.Err()
+}
+
+// compare returns a line for each benchmark that got slower by more than the threshold, or allocates more
+func compare(baseline map[string]Result, results map[string]Result, threshold float64) []string {
+
+	var names []string
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var regressions []string
+
+	for _, name := range names {
+
+		result := results[name]
+
+		base, ok := baseline[name]
+		if !ok {
+			core.Info("%s: %.1f ns/op, %d allocs/op (new)", name, result.NsPerOp, result.AllocsPerOp)
+			continue
+		}
+
+		change := 0.0
+		if base.NsPerOp > 0 {
+			change = (result.NsPerOp - base.NsPerOp) / base.NsPerOp
+		}
+
+		core.Info("%s: %.1f ns/op (%+.1f%%), %d allocs/op (was %d)", name, result.NsPerOp, change*100, result.AllocsPerOp, base.AllocsPerOp)
+
+		if change > threshold {
+			regressions = append(regressions, fmt.Sprintf("%s is %.1f%% slower (%.1f ns/op, was %.1f ns/op)", name, change*100, result.NsPerOp, base.NsPerOp))
+		}
+
+		if result.AllocsPerOp > base.AllocsPerOp {
+			regressions = append(regressions, fmt.Sprintf("%s allocates more (%d allocs/op, was %d allocs/op)", name, result.AllocsPerOp, base.AllocsPerOp))
+		}
+	}
+
+	return regressions
+}
+
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mainReturnWithCode() int {
+
+	packages := flag.String("packages", "./modules/core", "comma separated packages to benchmark")
+	bench := flag.String("bench", ".", "only run benchmarks matching this regexp")
+	benchtime := flag.String("benchtime", "1s", "run each benchmark for this long, or Nx for N iterations")
+	count := flag.Int("count", 5, "run each benchmark this many times and keep the fastest")
+	baselineFile := flag.String("baseline", "", "compare against the results in this file, and fail on regressions")
+	threshold := flag.Float64("threshold", 0.2, "fail if a benchmark is slower than the baseline by more than this fraction")
+	output := flag.String("output", "", "write the results to this file, for use as a baseline later")
+	flag.Parse()
+
+	args := []string{"test", "-run", "^$", "-bench", *bench, "-benchmem", "-benchtime", *benchtime, "-count", strconv.Itoa(*count)}
+	args = append(args, strings.Split(*packages, ",")...)
+
+	command := exec.Command("go", args...)
+	command.Stderr = os.Stderr
+
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		core.Error("could not run benchmarks: %v", err)
+		return 1
+	}
+
+	if err := command.Start(); err != nil {
+		core.Error("could not run benchmarks: %v", err)
+		return 1
+	}
+
+	results, err := parse(stdout, os.Stdout)
+	if err != nil {
+		core.Error("could not parse benchmark output: %v", err)
+		command.Wait()
+		return 1
+	}
+
+	if err := command.Wait(); err != nil {
+		core.Error("benchmarks failed: %v", err)
+		return 1
+	}
+
+	if len(results) == 0 {
+		core.Error("no benchmarks matched %q", *bench)
+		return 1
+	}
+
+	if *output != "" {
+		data, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			core.Error("could not encode results: %v", err)
+			return 1
+		}
+		if err := os.WriteFile(*output, append(data, '\n'), 0644); err != nil {
+			core.Error("could not write %s: %v", *output, err)
+			return 1
+		}
+		core.Info("wrote %d benchmark results to %s", len(results), *output)
+	}
+
+	if *baselineFile == "" {
+		return 0
+	}
+
+	data, err := os.ReadFile(*baselineFile)
+	if errors.Is(err, os.ErrNotExist) {
+		core.Info("no baseline at %s, nothing to compare against", *baselineFile)
+		return 0
+	}
+	if err != nil {
+		core.Error("could not read baseline: %v", err)
+		return 1
+	}
+
+	var baseline map[string]Result
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		core.Error("could not parse baseline %s: %v", *baselineFile, err)
+		return 1
+	}
+
+	regressions := compare(baseline, results, *threshold)
+	if len(regressions) > 0 {
+		for _, regression := range regressions {
+			core.Error("%s", regression)
+		}
+		return 1
+	}
+
+	core.Info("no regressions against %s", *baselineFile)
+
+	return 0
+}
@@ -32,25 +32,24 @@
 package main
 
 import (
-	"context"
+	"bytes"
 	"fmt"
-	"math/rand"
-	"net"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/networknext/udpx/modules/client"
 	"github.com/networknext/udpx/modules/core"
 	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/status"
 )
 
-const MaxPacketSize = 1500
-const OldSequenceThreshold = 100
-const SequenceBufferSize = 1024
-const QueueSize = 1024
-
 func main() {
 	os.Exit(mainReturnWithCode())
 }
@@ -59,724 +58,478 @@ func mainReturnWithCode() int {
 
 	serviceName := "udpx client"
 
-	core.Info("%s", serviceName)
+	log.SetService(serviceName)
+
+	core.Info("%s %s", serviceName, status.VersionString())
 
 	// configure
 
-	readBuffer, err := envvar.GetInt("READ_BUFFER", 100000)
+	config := client.DefaultConfig()
+
+	readBuffer, err := envvar.GetInt("READ_BUFFER", config.ReadBuffer)
 	if err != nil {
 		core.Error("invalid READ_BUFFER: %v", err)
 		return 1
 	}
 
-	writeBuffer, err := envvar.GetInt("WRITE_BUFFER", 100000)
+	writeBuffer, err := envvar.GetInt("WRITE_BUFFER", config.WriteBuffer)
 	if err != nil {
 		core.Error("invalid WRITE_BUFFER: %v", err)
 		return 1
 	}
 
-	udpPort := envvar.Get("UDP_PORT", "0")
+	filterKey, err := envvar.GetBase64("FILTER_KEY", nil)
+	if err != nil || (filterKey != nil && len(filterKey) != core.SipHashKeyBytes) {
+		core.Error("invalid FILTER_KEY: %v", err)
+		return 1
+	}
 
-	clientAddress, err := envvar.GetAddress("CLIENT_ADDRESS", core.ParseAddress("127.0.0.1:30000"))
+	keepAliveInterval, err := envvar.GetDurationRange("KEEP_ALIVE_INTERVAL", config.KeepAliveInterval, time.Nanosecond, envvar.NoLimit)
 	if err != nil {
-		core.Error("invalid CLIENT_ADDRESS: %v", err)
+		core.Error("invalid KEEP_ALIVE_INTERVAL: %v", err)
 		return 1
 	}
 
-	connectToken, err := envvar.GetBase64("CONNECT_TOKEN", nil)
-	if err != nil || len(connectToken) != core.ConnectTokenBytes {
-		core.Error("missing or invalid CONNECT_TOKEN: %v", err)
+	idleTimeout, err := envvar.GetDurationRange("IDLE_TIMEOUT", config.IdleTimeout, time.Nanosecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid IDLE_TIMEOUT: %v", err)
 		return 1
 	}
 
-	index := 0
-	var connectData core.ConnectData
-	if !core.ReadConnectData(connectToken, &index, &connectData) {
-		core.Error("invalid connect data")
+	failoverTimeout, err := envvar.GetDurationRange("FAILOVER_TIMEOUT", config.FailoverTimeout, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid FAILOVER_TIMEOUT: %v", err)
 		return 1
 	}
 
-	envelopeUpKbps := connectData.EnvelopeUpKbps
-	packetsPerSecond := int(connectData.PacketsPerSecond)
+	connectRaceDelay, err := envvar.GetDurationRange("CONNECT_RACE_DELAY", config.ConnectRaceDelay, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid CONNECT_RACE_DELAY: %v", err)
+		return 1
+	}
 
-	var bandwidthMutex sync.RWMutex
-	sendBandwidthBitsAccumulator := uint64(0)
-	sendBandwidthBitsPerSecondMax := uint64(envelopeUpKbps * 1000)
-	sendBandwidthBitsResetTime := time.Now().Add(time.Second)
+	statsInterval, err := envvar.GetDurationRange("STATS_INTERVAL", config.StatsInterval, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid STATS_INTERVAL: %v", err)
+		return 1
+	}
 
-	var sessionTokenMutex sync.RWMutex
-	sessionTokenData := make([]byte, core.EncryptedSessionTokenBytes)
-	copy(sessionTokenData[:], connectToken[core.ConnectDataBytes:])
-	sessionTokenSequence := uint64(0)
-	sessionTokenExpireTime := time.Now().Add(time.Second * core.ConnectTokenExpireSeconds)
+	platform, err := core.ParsePlatform(envvar.Get("PLATFORM", core.PlatformUnknown.String()))
+	if err != nil {
+		core.Error("invalid PLATFORM: %v", err)
+		return 1
+	}
+
+	pacingKbps, err := envvar.GetFloat("PACING_KBPS", 0)
+	if err != nil || pacingKbps < 0 {
+		core.Error("invalid PACING_KBPS: %v", err)
+		return 1
+	}
 
-	gatewayAddress := &connectData.GatewayAddress
-	gatewayPublicKey := connectData.GatewayPublicKey[:]
-	clientPublicKey := connectData.ClientPublicKey[:]
-	clientPrivateKey := connectData.ClientPrivateKey[:]
-	sessionId := clientPublicKey
+	// with DSCP, payloads are sent with PAYLOAD_PRIORITY, and tagged with the dscp for that priority
 
-	var gatewayIdMutex sync.RWMutex
-	var gatewayId [core.GatewayIdBytes]byte
+	dscp, err := core.ParseDSCPConfig(envvar.Get("DSCP", ""))
+	if err != nil {
+		core.Error("invalid DSCP: %v", err)
+		return 1
+	}
 
-	var serverIdMutex sync.RWMutex
-	var serverId [core.ServerIdBytes]byte
+	payloadPriority, err := core.ParsePriority(envvar.Get("PAYLOAD_PRIORITY", "normal"))
+	if err != nil {
+		core.Error("invalid PAYLOAD_PRIORITY: %v", err)
+		return 1
+	}
 
-	core.Info("starting client on port %s", udpPort)
+	reliableMessageInterval, err := envvar.GetDurationRange("RELIABLE_MESSAGE_INTERVAL", time.Second, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid RELIABLE_MESSAGE_INTERVAL: %v", err)
+		return 1
+	}
 
-	core.Info("session id is %s", core.IdString(sessionId))
+	payloadBytes, err := envvar.GetIntRange("PAYLOAD_BYTES", core.MinPayloadBytes, core.MinPayloadBytes, client.MaxPayloadBytes)
+	if err != nil {
+		core.Error("invalid PAYLOAD_BYTES: %v", err)
+		return 1
+	}
 
-	core.Info("connecting to %s", gatewayAddress)
+	mtuProbeInterval, err := envvar.GetDurationRange("MTU_PROBE_INTERVAL", config.MTUProbeInterval, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid MTU_PROBE_INTERVAL: %v", err)
+		return 1
+	}
 
-	// setup
+	// if nothing comes back over udp within the handshake timeout, fall back to tunnelling over a websocket
 
-	connectedToServer := false
-	hasChallengeToken := false
-	challengeTokenData := [core.EncryptedChallengeTokenBytes]byte{}
-	challengeTokenSequence := uint64(0)
-	challengeTokenExpireTimestamp := uint64(0)
-	challengeTokenGatewayId := [core.GatewayIdBytes]byte{}
+	webSocketURL := envvar.Get("WEBSOCKET_URL", "")
 
-	sendSequence := uint64(10000) + uint64(rand.Intn(10000))
-	receiveSequence := uint64(0)
+	udpHandshakeTimeout, err := envvar.GetDurationRange("UDP_HANDSHAKE_TIMEOUT", config.UDPHandshakeTimeout, time.Nanosecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid UDP_HANDSHAKE_TIMEOUT: %v", err)
+		return 1
+	}
 
-	packetReceiveQueue := make(chan []byte, QueueSize)
+	// alternatively, packets to the gateway can be carried in quic datagrams or dtls records from the start
 
-	ackBuffer := make([]uint64, SequenceBufferSize)
-	ackedPackets := make([]uint64, SequenceBufferSize)
-	receivedPackets := make([]uint64, SequenceBufferSize)
+	quicGatewayAddress := envvar.Get("QUIC_GATEWAY_ADDRESS", "")
+	dtlsGatewayAddress := envvar.Get("DTLS_GATEWAY_ADDRESS", "")
+	dtlsServerName := envvar.Get("DTLS_SERVER_NAME", "")
 
-	payloadAckQueue := make(chan uint64, QueueSize)
-	payloadSendQueue := make(chan []byte, QueueSize)
-	payloadReceiveQueue := make(chan []byte, QueueSize)
+	udpPort := envvar.Get("UDP_PORT", "0")
 
-	sequenceToPayloadId := make([]uint64, SequenceBufferSize)
-	for i := range sequenceToPayloadId {
-		sequenceToPayloadId[i] = ^uint64(0)
+	clientAddress, err := envvar.GetAddress("CLIENT_ADDRESS", core.ParseAddress("127.0.0.1:30000"))
+	if err != nil {
+		core.Error("invalid CLIENT_ADDRESS: %v", err)
+		return 1
 	}
 
-	// create client socket
+	// without a CONNECT_TOKEN, the client gets one from auth for USER_ID, the way a game would, and gets a new
+	// one whenever its session token expires
 
-	lc := net.ListenConfig{}
+	authURL := strings.TrimSuffix(envvar.Get("AUTH_URL", ""), "/")
+	authBearerToken := envvar.Get("AUTH_BEARER_TOKEN", "")
 
-	ctx, ctxCancelFunc := context.WithCancel(context.Background())
+	userId, err := envvar.GetBase64("USER_ID", core.RandomBytes(core.UserIdBytes))
+	if err != nil || len(userId) != core.UserIdBytes {
+		core.Error("invalid USER_ID: %v", err)
+		return 1
+	}
 
-	go func() {
+	connectToken, err := envvar.GetBase64("CONNECT_TOKEN", nil)
+	if err != nil {
+		core.Error("invalid CONNECT_TOKEN: %v", err)
+		return 1
+	}
 
-		lp, err := lc.ListenPacket(ctx, "udp", "0.0.0.0:"+udpPort)
+	if connectToken == nil && authURL != "" {
+		connectToken, err = requestConnectToken(authURL, authBearerToken, userId)
 		if err != nil {
-			panic(fmt.Sprintf("could not bind socket: %v", err))
-		}
-
-		conn := lp.(*net.UDPConn)
-		defer conn.Close()
-
-		if err := conn.SetReadBuffer(readBuffer); err != nil {
-			panic(fmt.Sprintf("could not set connection read buffer size: %v", err))
+			core.Error("could not get connect token from %s: %v", authURL, err)
+			return 1
 		}
-
-		if err := conn.SetWriteBuffer(writeBuffer); err != nil {
-			panic(fmt.Sprintf("could not set connection write buffer size: %v", err))
+		core.Info("got connect token from %s", authURL)
+		config.FetchConnectToken = func() ([]byte, error) {
+			return requestConnectToken(authURL, authBearerToken, userId)
 		}
+	}
 
-		// send packets
-
-		go func() {
-
-			payloadId := uint64(0)
-
-			for {
-				select {
-				case payload := <-payloadSendQueue:
-
-					ack_bits := [core.AckBitsBytes]byte{}
-
-					core.GetAckBits(receiveSequence, receivedPackets[:], ack_bits[:])
-
-					packetData := make([]byte, MaxPacketSize)
-
-					version := byte(0)
-
-					index := 0
-
-					core.Debug("send packet sequence = %d", sendSequence)
-					core.Debug("send packet ack = %d", receiveSequence)
-					core.Debug("send packet ack_bits = [%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x]",
-						ack_bits[0],
-						ack_bits[1],
-						ack_bits[2],
-						ack_bits[3],
-						ack_bits[4],
-						ack_bits[5],
-						ack_bits[6],
-						ack_bits[7],
-						ack_bits[8],
-						ack_bits[9],
-						ack_bits[10],
-						ack_bits[11],
-						ack_bits[12],
-						ack_bits[13],
-						ack_bits[14],
-						ack_bits[15],
-						ack_bits[16],
-						ack_bits[17],
-						ack_bits[18],
-						ack_bits[19],
-						ack_bits[20],
-						ack_bits[21],
-						ack_bits[22],
-						ack_bits[23],
-						ack_bits[24],
-						ack_bits[25],
-						ack_bits[26],
-						ack_bits[27],
-						ack_bits[28],
-						ack_bits[29],
-						ack_bits[30],
-						ack_bits[31])
-
-					core.WriteUint8(packetData, &index, version)
-					core.WriteUint8(packetData, &index, core.PayloadPacket)
-					chonkle := packetData[index : index+core.ChonkleBytes]
-					index += core.ChonkleBytes
-					sessionTokenMutex.RLock()
-					core.WriteBytes(packetData, &index, sessionTokenData, core.EncryptedSessionTokenBytes)
-					core.WriteUint64(packetData, &index, sessionTokenSequence)
-					sessionTokenMutex.RUnlock()
-					core.WriteBytes(packetData, &index, sessionId, core.SessionIdBytes)
-					sequenceData := packetData[index : index+core.SequenceBytes]
-					core.WriteUint64(packetData, &index, sendSequence)
-					encryptStart := index
-					core.WriteUint64(packetData, &index, receiveSequence)
-					core.WriteBytes(packetData, &index, ack_bits[:], len(ack_bits))
-					if hasChallengeToken {
-						core.WriteBytes(packetData, &index, challengeTokenGatewayId[:], core.GatewayIdBytes)
-					} else {
-						gatewayIdMutex.RLock()
-						core.WriteBytes(packetData, &index, gatewayId[:], core.GatewayIdBytes)
-						gatewayIdMutex.RUnlock()
-					}
-					serverIdMutex.RLock()
-					core.WriteBytes(packetData, &index, serverId[:], core.ServerIdBytes)
-					serverIdMutex.RUnlock()
-					core.WriteUint8(packetData, &index, core.PayloadPacket)
-					if hasChallengeToken {
-						core.WriteUint8(packetData, &index, core.Flags_ChallengeToken)
-						core.WriteBytes(packetData, &index, challengeTokenData[:], core.EncryptedChallengeTokenBytes)
-					} else {
-						core.WriteUint8(packetData, &index, 0)
-					}
-					core.WriteBytes(packetData, &index, payload[:], core.MinPayloadBytes)
-					encryptFinish := index
-					index += core.HMACBytes_Box
-					pittle := packetData[index : index+core.PittleBytes]
-					index += core.PittleBytes
-
-					nonce := make([]byte, core.NonceBytes_Box)
-					for i := 0; i < core.SequenceBytes; i++ {
-						nonce[i] = sequenceData[i]
-					}
-
-					core.Encrypt_Box(clientPrivateKey, gatewayPublicKey, nonce, packetData[encryptStart:encryptFinish], encryptFinish-encryptStart)
-
-					packetBytes := index
-					packetData = packetData[:packetBytes]
-
-					var magic [core.MagicBytes]byte
-
-					var fromAddressData [4]byte
-					var fromAddressPort uint16
-
-					var toAddressData [4]byte
-					var toAddressPort uint16
-
-					core.GetAddressData(clientAddress, fromAddressData[:], &fromAddressPort)
-					core.GetAddressData(gatewayAddress, toAddressData[:], &toAddressPort)
-
-					core.GenerateChonkle(chonkle[:], magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes)
-
-					core.GeneratePittle(pittle[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes)
-
-					if !core.BasicPacketFilter(packetData, packetBytes) {
-						panic("basic packet filter failed")
-					}
-
-					if !core.AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes) {
-						panic("advanced packet filter failed")
-					}
-
-					// do we have enough bandwidth available to send this packet?
-
-					wireBits := uint64(core.WirePacketBits(len(packetData)))
-
-					canSendPacket := true
-
-					bandwidthMutex.Lock()
-					if sendBandwidthBitsAccumulator+wireBits <= sendBandwidthBitsPerSecondMax {
-						sendBandwidthBitsAccumulator += wireBits
-					} else {
-						canSendPacket = false
-					}
-					bandwidthMutex.Unlock()
-
-					if !canSendPacket {
-						core.Debug("choke")
-						continue
-					}
-
-					// send the packet
-
-					if _, err := conn.WriteToUDP(packetData, gatewayAddress); err != nil {
-						core.Error("failed to write udp packet: %v", err)
-					}
-
-					core.Debug("sent %d byte packet to %s", len(packetData), gatewayAddress)
-
-					sequenceToPayloadId[sendSequence%SequenceBufferSize] = payloadId
-					sendSequence++
-					payloadId++
-
-					// time out the challenge token if it's too old
-
-					if hasChallengeToken && challengeTokenExpireTimestamp <= uint64(time.Now().Unix()) {
-						core.Debug("timed out challenge token")
-						hasChallengeToken = false
-					}
-				}
-			}
-		}()
-
-		go func() {
+	if len(connectToken) < core.ConnectTokenBytes || len(connectToken) > core.MaxConnectTokenBytes {
+		core.Error("missing or invalid CONNECT_TOKEN. set CONNECT_TOKEN or AUTH_URL")
+		return 1
+	}
 
-			// receive packets (stateless)
+	index := 0
+	var connectData core.ConnectData
+	if !core.ReadConnectData(connectToken, &index, &connectData) {
+		core.Error("invalid connect data")
+		return 1
+	}
 
-			for {
+	// multipath sessions also connect to a second gateway with the same connect token
 
-				packetData := make([]byte, MaxPacketSize)
+	multipathGatewayAddress, err := envvar.GetAddress("MULTIPATH_GATEWAY_ADDRESS", nil)
+	if err != nil || (multipathGatewayAddress != nil && core.AddressEqual(multipathGatewayAddress, &connectData.GatewayAddress)) {
+		core.Error("invalid MULTIPATH_GATEWAY_ADDRESS: %v", err)
+		return 1
+	}
 
-				packetBytes, from, err := conn.ReadFromUDP(packetData)
-				if err != nil {
-					core.Debug("failed to read udp packet: %v", err)
-					break
-				}
+	// routed sessions send through relays, with the route printed by connect_token for RELAY_ADDRESSES
 
-				if !core.AddressEqual(from, gatewayAddress) {
-					core.Debug("packet is not from gateway")
-					continue
-				}
+	route, err := envvar.GetBase64("ROUTE", nil)
+	if err != nil {
+		core.Error("invalid ROUTE: %v", err)
+		return 1
+	}
 
-				if packetBytes < core.PrefixBytes {
-					core.Debug("packet is too small")
-					continue
-				}
+	preferIPv6, err := envvar.GetBool("PREFER_IPV6", false)
+	if err != nil {
+		core.Error("invalid PREFER_IPV6: %v", err)
+		return 1
+	}
 
-				if packetData[0] != 0 {
-					core.Debug("unknown packet version: %d", packetData[0])
-					continue
-				}
+	packetsPerSecond, err := envvar.GetIntRange("PAYLOADS_PER_SECOND", int(connectData.PacketsPerSecond), 1, 1000)
+	if err != nil {
+		core.Error("invalid PAYLOADS_PER_SECOND: %v", err)
+		return 1
+	}
 
-				if packetData[1] != core.PayloadPacket && packetData[1] != core.ChallengePacket {
-					core.Debug("unknown packet type %d", packetData[1])
-					continue
-				}
+	// for smoke tests, the client runs for DURATION and exits with a non-zero status if it doesn't connect
+	// within CONNECT_TIMEOUT, the session ends early, anything echoed back doesn't match or packet loss is
+	// over MAX_PACKET_LOSS
 
-				// packet filter
+	duration, err := envvar.GetDurationRange("DURATION", 0, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid DURATION: %v", err)
+		return 1
+	}
 
-				if !core.BasicPacketFilter(packetData, packetBytes) {
-					core.Debug("basic packet filter failed")
-					continue
-				}
+	connectTimeout, err := envvar.GetDurationRange("CONNECT_TIMEOUT", 10*time.Second, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid CONNECT_TIMEOUT: %v", err)
+		return 1
+	}
 
-				var magic [8]byte
+	maxPacketLoss, err := envvar.GetFloat("MAX_PACKET_LOSS", 1)
+	if err != nil || maxPacketLoss < 0 || maxPacketLoss > 1 {
+		core.Error("invalid MAX_PACKET_LOSS: %v", err)
+		return 1
+	}
 
-				var fromAddressData [4]byte
-				var fromAddressPort uint16
+	statsPrintInterval, err := envvar.GetDurationRange("STATS_PRINT_INTERVAL", time.Second, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid STATS_PRINT_INTERVAL: %v", err)
+		return 1
+	}
 
-				var toAddressData [4]byte
-				var toAddressPort uint16
+	// received payloads and reliable messages are checked against what the server echoes back
 
-				core.GetAddressData(from, fromAddressData[:], &fromAddressPort)
-				core.GetAddressData(clientAddress, toAddressData[:], &toAddressPort)
+	termChan := make(chan os.Signal, 1)
 
-				if !core.AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes) {
-					core.Debug("advanced packet filter failed")
-					continue
-				}
+	var connected, disconnected, failed atomic.Bool
 
-				packetData = packetData[:packetBytes]
+	fail := func(format string, params ...interface{}) {
+		core.Error(format, params...)
+		failed.Store(true)
+		select {
+		case termChan <- syscall.SIGTERM:
+		default:
+		}
+	}
 
-				packetReceiveQueue <- packetData
+	reliableReceiveId := 0
+
+	config.BindAddress = ":" + udpPort
+	config.ClientAddress = clientAddress
+	config.MultipathGatewayAddress = multipathGatewayAddress
+	config.PreferIPv6 = preferIPv6
+	config.Route = route
+	config.ReadBuffer = readBuffer
+	config.WriteBuffer = writeBuffer
+	config.FilterKey = filterKey
+	config.KeepAliveInterval = keepAliveInterval
+	config.IdleTimeout = idleTimeout
+	config.FailoverTimeout = failoverTimeout
+	config.ConnectRaceDelay = connectRaceDelay
+	config.StatsInterval = statsInterval
+	config.Platform = platform
+	config.PacingKbps = pacingKbps
+	config.DSCP = dscp
+	config.MTUProbeInterval = mtuProbeInterval
+	config.WebSocketURL = webSocketURL
+	config.UDPHandshakeTimeout = udpHandshakeTimeout
+	config.QUICGatewayAddress = quicGatewayAddress
+	config.DTLSGatewayAddress = dtlsGatewayAddress
+	config.DTLSServerName = dtlsServerName
+
+	config.ReceiveCallback = func(payload []byte) {
+		if len(payload) != core.MinPayloadBytes {
+			fail("incorrect payload bytes. expected %d, got %d", core.MinPayloadBytes, len(payload))
+			return
+		}
+		for i := 0; i < len(payload); i++ {
+			if payload[i] != byte(i) {
+				fail("payload data mismatch at index %d. expected %d, got %d", i, byte(i), payload[i])
+				return
 			}
+		}
+	}
 
-		}()
-
-		// receive packets (stateful)
-
-		for {
-
-			quit := false
-			for !quit {
-				select {
-				case packetData := <-packetReceiveQueue:
-
-					packetType := packetData[core.VersionBytes]
-
-					packetBytes := len(packetData)
-
-					switch packetType {
-
-					case core.PayloadPacket:
-
-						core.Debug("received %d byte payload packet from gateway", len(packetData))
-
-						// session id must match client public key
-
-						sessionIdIndex := core.PrefixBytes
-
-						sessionId := packetData[sessionIdIndex : sessionIdIndex+core.SessionIdBytes]
-
-						if !core.IdEqual(sessionId, clientPublicKey) {
-							core.Debug("session id mismatch")
-							continue
-						}
-
-						// decrypt packet
-
-						sequenceIndex := core.PrefixBytes + core.SessionIdBytes
-						encryptedDataIndex := sequenceIndex + core.SequenceBytes
-
-						sequenceData := packetData[sequenceIndex : sequenceIndex+core.SequenceBytes]
-						encryptedData := packetData[encryptedDataIndex : packetBytes-core.PittleBytes]
-
-						nonce := make([]byte, core.NonceBytes_Box)
-						for i := 0; i < core.SequenceBytes; i++ {
-							nonce[i] = sequenceData[i]
-						}
-						nonce[9] |= (1 << 0)
-						nonce[9] &= 1 ^ (1 << 1)
-
-						err = core.Decrypt_Box(gatewayPublicKey, clientPrivateKey, nonce, encryptedData, len(encryptedData))
-						if err != nil {
-							core.Debug("could not decrypt payload packet")
-							continue
-						}
-
-						// split decrypted packet into various pieces
-
-						headerIndex := core.PrefixBytes
-
-						payloadIndex := headerIndex + core.HeaderBytes
-						payloadBytes := packetBytes - payloadIndex - core.PostfixBytes
-
-						header := packetData[headerIndex : headerIndex+core.HeaderBytes]
-
-						payload := packetData[payloadIndex : payloadIndex+payloadBytes]
-
-						// check encrypted packet type matches
-
-						packetType := header[core.SessionIdBytes+core.SequenceBytes+core.AckBytes+core.AckBitsBytes+core.GatewayIdBytes+core.ServerIdBytes]
-						if packetType != core.PayloadPacket {
-							core.Debug("packet type mismatch: %d", packetType)
-							continue
-						}
-
-						// packet sequence must not be too old
+	config.MessageCallback = func(message []byte) {
+		expected := fmt.Sprintf("reliable message %d", reliableReceiveId)
+		if string(message) != expected {
+			fail("reliable message mismatch. expected %q, got %q", expected, message)
+			return
+		}
+		core.Debug("received %s", message)
+		reliableReceiveId++
+	}
 
-						index := 0
-						sequence := uint64(0)
-						core.ReadUint64(sequenceData, &index, &sequence)
+	config.AckCallback = func(payloadId uint64) {
+		core.Debug("ack payload %d", payloadId)
+	}
 
-						if receiveSequence > OldSequenceThreshold && sequence < receiveSequence-OldSequenceThreshold {
-							core.Debug("packet sequence is too old: %d", sequence)
-							continue
-						}
+	config.QualityCallback = func(quality core.Quality, score float64) {
+		core.Info("connection quality is %s (%.0f)", quality, score)
+	}
 
-						if sequence > receiveSequence {
-							receiveSequence = sequence
-						}
+	config.StateCallback = func(state client.State) {
+		switch state {
+		case client.StateConnected:
+			connected.Store(true)
+		case client.StateDisconnected:
+			disconnected.Store(true)
+			select {
+			case termChan <- syscall.SIGTERM:
+			default:
+			}
+		}
+	}
 
-						receivedPackets[sequence%SequenceBufferSize] = sequence
+	core.Info("starting client on port %s", udpPort)
 
-						// update session token if the gateway has a newer one
+	session, err := client.Connect(connectToken, config)
+	if err != nil {
+		core.Error("could not connect: %v", err)
+		return 1
+	}
 
-						sessionTokenDataIndex := core.VersionBytes + core.PacketTypeBytes + core.ChonkleBytes
-						sessionTokenSequenceIndex := sessionTokenDataIndex + core.EncryptedSessionTokenBytes
+	// a payload is sent each frame
 
-						packetSessionTokenData := packetData[sessionTokenDataIndex : sessionTokenDataIndex+core.EncryptedSessionTokenBytes]
+	session.SetFrameRate(float64(packetsPerSecond))
 
-						sessionTokenMutex.Lock()
+	// main loop
 
-						index = sessionTokenSequenceIndex
-						var packetSessionTokenSequence uint64
-						core.ReadUint64(packetData, &index, &packetSessionTokenSequence)
+	go func() {
 
-						if packetSessionTokenSequence > sessionTokenSequence {
-							core.Info("updated session token %d", packetSessionTokenSequence)
-							copy(sessionTokenData[:], packetSessionTokenData[:])
-							sessionTokenSequence = packetSessionTokenSequence
-							sessionTokenExpireTime = time.Now().Add(time.Second * core.ConnectTokenExpireSeconds)
-						}
+		reliableSendId := 0
+		reliableSendTime := time.Now()
 
-						sessionTokenMutex.Unlock()
+		for {
 
-						// process payload packet
+			// send payload. payloads larger than the regular payload size are fragmented
 
-						core.Debug("payload is %d bytes", len(payload))
+			payload := make([]byte, payloadBytes)
+			for i := 0; i < payloadBytes; i++ {
+				payload[i] = byte(i)
+			}
 
-						payloadReceiveQueue <- payload
+			if err := session.SendWithPriority(payload, payloadPriority); err != nil {
+				core.Debug("could not send payload: %v", err)
+			}
 
-						// update reliability
+			// send a reliable message, the server echoes them back in order
 
-						packet_sequence := uint64(0)
-						packet_ack := uint64(0)
-						packet_ack_bits := [core.AckBitsBytes]byte{}
+			if reliableMessageInterval > 0 && time.Since(reliableSendTime) >= reliableMessageInterval {
+				if err := session.SendMessage([]byte(fmt.Sprintf("reliable message %d", reliableSendId))); err != nil {
+					core.Debug("could not send reliable message: %v", err)
+				} else {
+					reliableSendId++
+				}
+				reliableSendTime = time.Now()
+			}
 
-						index = core.SessionIdBytes
-						core.ReadUint64(header, &index, &packet_sequence)
-						core.ReadUint64(header, &index, &packet_ack)
-						core.ReadBytes(header, &index, packet_ack_bits[:], core.AckBitsBytes)
+			// sleep till next frame
 
-						core.Debug("recv packet sequence = %d", packet_sequence)
-						core.Debug("recv packet ack = %d", packet_ack)
-						core.Debug("recv packet ack_bits = [%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x,%x]",
-							packet_ack_bits[0],
-							packet_ack_bits[1],
-							packet_ack_bits[2],
-							packet_ack_bits[3],
-							packet_ack_bits[4],
-							packet_ack_bits[5],
-							packet_ack_bits[6],
-							packet_ack_bits[7],
-							packet_ack_bits[8],
-							packet_ack_bits[9],
-							packet_ack_bits[10],
-							packet_ack_bits[11],
-							packet_ack_bits[12],
-							packet_ack_bits[13],
-							packet_ack_bits[14],
-							packet_ack_bits[15],
-							packet_ack_bits[16],
-							packet_ack_bits[17],
-							packet_ack_bits[18],
-							packet_ack_bits[19],
-							packet_ack_bits[20],
-							packet_ack_bits[21],
-							packet_ack_bits[22],
-							packet_ack_bits[23],
-							packet_ack_bits[24],
-							packet_ack_bits[25],
-							packet_ack_bits[26],
-							packet_ack_bits[27],
-							packet_ack_bits[28],
-							packet_ack_bits[29],
-							packet_ack_bits[30],
-							packet_ack_bits[31])
-
-						// process acks
-
-						acks := core.ProcessAcks(packet_ack, packet_ack_bits[:], ackedPackets[:], ackBuffer[:])
-
-						for i := range acks {
-							core.Debug("ack packet %d", acks[i])
-							ackedPackets[acks[i]%SequenceBufferSize] = acks[i]
-							payloadAck := sequenceToPayloadId[acks[i]%SequenceBufferSize]
-							if payloadAck != ^uint64(0) {
-								payloadAckQueue <- payloadAck
-							}
-						}
-
-						// check if we have a new gateway
-
-						gatewayIdIndex := sessionIdIndex + core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes
-
-						packetGatewayId := packetData[gatewayIdIndex : gatewayIdIndex+core.GatewayIdBytes]
-
-						gatewayIdMutex.Lock()
-						if !core.IdEqual(packetGatewayId, gatewayId[:]) {
-							core.Info("connected to gateway %s", core.IdString(packetGatewayId))
-							copy(gatewayId[:], packetGatewayId[:])
-						}
-						gatewayIdMutex.Unlock()
-
-						// check if we have a new server
-
-						serverIdIndex := gatewayIdIndex + core.GatewayIdBytes
-
-						packetServerId := packetData[serverIdIndex : serverIdIndex+core.ServerIdBytes]
-
-						serverIdMutex.Lock()
-						newServer := !core.IdEqual(packetServerId, serverId[:])
-						if newServer {
-							core.Info("connected to server %s", core.IdString(packetServerId))
-							copy(serverId[:], packetServerId[:])
-						}
-						serverIdMutex.Unlock()
-
-						// clear challenge token
-
-						if hasChallengeToken {
-							core.Debug("cleared challenge token")
-							hasChallengeToken = false
-							connectedToServer = true
-						}
-
-					case core.ChallengePacket:
-
-						core.Debug("received %d byte challenge packet from gateway", len(packetData))
-
-						if len(packetData) != core.ChallengePacketBytes {
-							core.Debug("bad challenge packet size: got %d, expected %d", len(packetData), core.ChallengePacketBytes)
-							continue
-						}
-
-						nonceIndex := core.VersionBytes + core.PacketTypeBytes + core.ChonkleBytes + core.EncryptedSessionTokenBytes + core.SequenceBytes
-
-						encryptedDataIndex := nonceIndex + core.NonceBytes_Box
-
-						encryptedData := packetData[encryptedDataIndex:]
-
-						nonce := packetData[nonceIndex : nonceIndex+core.NonceBytes_Box]
-
-						err = core.Decrypt_Box(gatewayPublicKey, clientPrivateKey, nonce, encryptedData, len(encryptedData)-core.PittleBytes)
-						if err != nil {
-							core.Debug("could not decrypt challenge packet")
-							continue
-						}
-
-						packetChallengeTokenData := packetData[encryptedDataIndex : encryptedDataIndex+core.EncryptedChallengeTokenBytes]
-
-						packetChallengeSequence := uint64(0)
-						index := encryptedDataIndex + core.EncryptedChallengeTokenBytes
-						core.ReadUint64(packetData, &index, &packetChallengeSequence)
-
-						var packetGatewayId [core.GatewayIdBytes]byte
-						core.ReadBytes(packetData, &index, packetGatewayId[:], core.GatewayIdBytes)
-
-						if !hasChallengeToken || challengeTokenSequence < packetChallengeSequence {
-							if connectedToServer {
-								core.Info("reconnecting...")
-								connectedToServer = false
-							}
-							hasChallengeToken = true
-							copy(challengeTokenData[:], packetChallengeTokenData)
-							challengeTokenSequence = packetChallengeSequence
-							challengeTokenExpireTimestamp = uint64(time.Now().Unix()) + 2
-							copy(challengeTokenGatewayId[:], packetGatewayId[:])
-							core.Debug("updated challenge token: %d", packetChallengeSequence)
-						}
-					}
+			frameTime := time.Duration(1000000000 / packetsPerSecond)
 
-				default:
-					quit = true
-				}
-			}
+			time.Sleep(frameTime)
 		}
 	}()
 
-	// main loop
-
-	termChan := make(chan os.Signal, 1)
-
-	go func() {
+	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
 
-		ackBuffer := [QueueSize]uint64{}
+	var durationChan <-chan time.Time
+	if duration > 0 {
+		durationChan = time.After(duration)
+	}
 
-		for {
+	var connectTimeoutChan <-chan time.Time
+	if connectTimeout > 0 {
+		connectTimeoutChan = time.After(connectTimeout)
+	}
 
-			// send payload
+	var statsChan <-chan time.Time
+	if statsPrintInterval > 0 {
+		statsTicker := time.NewTicker(statsPrintInterval)
+		defer statsTicker.Stop()
+		statsChan = statsTicker.C
+	}
 
-			payload := make([]byte, core.MinPayloadBytes)
-			for i := 0; i < core.MinPayloadBytes; i++ {
-				payload[i] = byte(i)
+	// print live stats until we are done
+
+	running := true
+	for running {
+		select {
+		case <-termChan:
+			running = false
+		case <-durationChan:
+			core.Info("ran for %s", duration)
+			running = false
+		case <-connectTimeoutChan:
+			if !connected.Load() {
+				fail("did not connect within %s", connectTimeout)
 			}
+		case <-statsChan:
+			if connected.Load() {
+				printStats(session.GetStats())
+			}
+		}
+	}
 
-			payloadSendQueue <- payload
+	core.Info("shutting down")
 
-			// process payload acks
+	stats := session.GetStats()
+	printStats(stats)
 
-			acks := GetPayloadAcks(payloadAckQueue, ackBuffer[:])
-			for i := 0; i < len(acks); i++ {
-				core.Debug("ack payload %d", acks[i])
-			}
+	if !connected.Load() && !failed.Load() {
+		fail("never connected")
+	}
 
-			// receive payloads
+	if disconnected.Load() {
+		if err := session.GetError(); err != nil {
+			fail("session ended: %v", err)
+		} else {
+			fail("session ended")
+		}
+	}
 
-			for {
-				payload := ReceivePayload(payloadReceiveQueue)
-				if payload == nil {
-					break
-				}
-				if len(payload) != core.MinPayloadBytes {
-					panic("incorrect payload bytes")
-				}
-				for i := 0; i < len(payload); i++ {
-					if payload[i] != byte(i) {
-						panic(fmt.Sprintf("payload data mismatch at index %d. expected %d, got %d\n", i, byte(i), payload[i]))
-					}
-				}
-			}
+	if connected.Load() && stats.PacketLoss > maxPacketLoss {
+		fail("packet loss %.1f%% is over %.1f%%", stats.PacketLoss*100, maxPacketLoss*100)
+	}
 
-			// have we timed out?
+	if session.GetNumPaths() > 1 {
+		core.Info("received %d duplicate packets over %d paths", session.GetDuplicatePackets(), session.GetNumPaths())
+	}
 
-			timedOut := false
-			sessionTokenMutex.RLock()
-			if sessionTokenExpireTime.Before(time.Now()) {
-				timedOut = true
-			}
-			sessionTokenMutex.RUnlock()
+	if connected.Load() {
+		core.Info("payload was encrypted with %s", core.CipherSuiteName(session.GetCipherSuite()))
+	}
 
-			if timedOut {
-				core.Info("disconnected")
-				termChan <- syscall.SIGTERM
-			}
+	// tell the gateway and server we are leaving, so the session ends now instead of timing out
 
-			// update bandwidth usage
+	session.Close()
 
-			bandwidthMutex.Lock()
-			if sendBandwidthBitsResetTime.Before(time.Now()) {
-				sendBandwidthMbps := float64(sendBandwidthBitsAccumulator) / 1000000.0
-				sendBandwidthBitsResetTime = time.Now().Add(time.Second)
-				sendBandwidthBitsAccumulator = 0
-				core.Debug("%.2f mbps", sendBandwidthMbps)
-			}
-			bandwidthMutex.Unlock()
-
-			// sleep till next frame
+	core.Info("shutdown completed")
 
-			frameTime := time.Duration(1000000000 / packetsPerSecond)
+	if failed.Load() {
+		return 1
+	}
 
-			time.Sleep(frameTime)
-		}
-	}()
+	return 0
+}
 
-	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
-	<-termChan
+func printStats(stats core.PathStatsSnapshot) {
+	core.Info("rtt %.1fms, jitter %.1fms, packet loss %.1f%% (%d sent, %d acked, %d lost)",
+		float64(stats.RTT)/float64(time.Millisecond), float64(stats.Jitter)/float64(time.Millisecond), stats.PacketLoss*100,
+		stats.PacketsSent, stats.PacketsAcked, stats.PacketsLost)
+}
 
-	core.Info("shutting down")
+// requestConnectToken asks auth for a connect token for the user, with the default envelope
+func requestConnectToken(authURL string, authBearerToken string, userId []byte) ([]byte, error) {
 
-	ctxCancelFunc()
+	request, err := http.NewRequest("POST", authURL+"/connect_token", bytes.NewReader(userId))
+	if err != nil {
+		return nil, err
+	}
+	if authBearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+authBearerToken)
+	}
 
-	core.Info("shutdown completed")
+	httpClient := &http.Client{Timeout: 10 * time.Second}
 
-	return 0
-}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
 
-func ReceivePayload(queue chan []byte) []byte {
-	select {
-	case payload := <-queue:
-		return payload
-	default:
-		return nil
+	connectToken, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func GetPayloadAcks(queue chan uint64, buffer []uint64) []uint64 {
-	index := 0
-	select {
-	case ack := <-queue:
-		buffer[index] = ack
-		index++
-	default:
+	if response.StatusCode != http.StatusOK || (len(connectToken) < core.ConnectTokenBytes || len(connectToken) > core.MaxConnectTokenBytes) {
+		return nil, fmt.Errorf("auth returned %d with %d bytes", response.StatusCode, len(connectToken))
 	}
-	return buffer[:index]
+
+	return connectToken, nil
 }
@@ -34,6 +34,10 @@ package main
 import (
 	"encoding/base64"
 	"fmt"
+	"math"
+	"net"
+	"time"
+
 	"github.com/networknext/udpx/modules/core"
 	"github.com/networknext/udpx/modules/envvar"
 )
@@ -60,13 +64,92 @@ func main() {
 		return
 	}
 
+	authSignPrivateKey, err := envvar.GetBase64("AUTH_SIGN_PRIVATE_KEY", nil)
+	if err != nil || len(authSignPrivateKey) != core.PrivateKeyBytes_Sign {
+		core.Error("missing or invalid AUTH_SIGN_PRIVATE_KEY: %v", err)
+		return
+	}
+
+	connectTokenTTL, err := envvar.GetDurationRange("CONNECT_TOKEN_TTL", time.Second*core.ConnectTokenExpireSeconds, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid CONNECT_TOKEN_TTL: %v", err)
+		return
+	}
+
+	fecDataShards, err := envvar.GetInt("FEC_DATA_SHARDS", 0)
+	if err != nil {
+		core.Error("invalid FEC_DATA_SHARDS: %v", err)
+		return
+	}
+
+	fecParityShards, err := envvar.GetInt("FEC_PARITY_SHARDS", 0)
+	if err != nil {
+		core.Error("invalid FEC_PARITY_SHARDS: %v", err)
+		return
+	}
+
+	if err := core.ValidateFECConfig(fecDataShards, fecParityShards); err != nil {
+		core.Error("invalid FEC_DATA_SHARDS and FEC_PARITY_SHARDS: %v", err)
+		return
+	}
+
+	tenantId, err := envvar.GetIntRange("TENANT_ID", 0, 0, math.MaxUint16)
+	if err != nil {
+		core.Error("invalid TENANT_ID: %v", err)
+		return
+	}
+
+	// optionally bind the token to the client's ip, like the auth service does with BIND_CLIENT_IP
+
+	var clientIP net.IP
+	if value := envvar.Get("CLIENT_IP", ""); value != "" {
+		clientIP = net.ParseIP(value)
+		if clientIP == nil {
+			core.Error("invalid CLIENT_IP: %s", value)
+			return
+		}
+	}
+
+	// with RELAY_ADDRESSES, a route through those gateways to the gateway is printed on a second line
+
+	relayAddresses, err := envvar.GetAddressList("RELAY_ADDRESSES", nil)
+	if err != nil || len(relayAddresses) > core.MaxRouteHops {
+		core.Error("invalid RELAY_ADDRESSES: %v", err)
+		return
+	}
+
+	// with FALLBACK_GATEWAY_ADDRESSES, the client fails over to those gateways in order
+
+	fallbackGatewayAddresses, err := envvar.GetAddressList("FALLBACK_GATEWAY_ADDRESSES", nil)
+	if err != nil || len(fallbackGatewayAddresses) > core.MaxFallbackGateways {
+		core.Error("invalid FALLBACK_GATEWAY_ADDRESSES: %v", err)
+		return
+	}
+
 	envelopeUpKbps := uint32(2500)
 	envelopeDownKbps := uint32(10000)
 	packetsPerSecond := uint8(100)
 
-	connect_token := core.GenerateConnectToken(userId[:], envelopeUpKbps, envelopeDownKbps, packetsPerSecond, gatewayAddress, gatewayPublicKey[:], authPrivateKey, gatewayPublicKey)
+	connect_token := core.GenerateBoundConnectToken(userId[:], envelopeUpKbps, envelopeDownKbps, packetsPerSecond, uint8(fecDataShards), uint8(fecParityShards), uint64(connectTokenTTL.Seconds()), gatewayAddress, gatewayPublicKey[:], authSignPrivateKey, uint16(tenantId), clientIP)
+
+	connect_token = core.AppendFallbackGateways(connect_token, fallbackGatewayAddresses)
 
 	connect_token_base64 := base64.StdEncoding.EncodeToString(connect_token)
 
 	fmt.Printf("%s\n", connect_token_base64)
+
+	if len(relayAddresses) > 0 {
+
+		index := 0
+		var connectData core.ConnectData
+		core.ReadConnectData(connect_token, &index, &connectData)
+
+		route, err := core.GenerateRoute(connectData.ClientPublicKey[:], uint64(connectTokenTTL.Seconds()), relayAddresses, gatewayAddress, authPrivateKey, gatewayPublicKey)
+		if err != nil {
+			core.Error("could not generate route: %v", err)
+			return
+		}
+
+		fmt.Printf("%s\n", base64.StdEncoding.EncodeToString(route))
+	}
 }
@@ -0,0 +1,307 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// dev runs the whole system locally for development: auth, two gateways and a server as child processes, with
+// a simulated lossy network between the gateways and the server. keys are generated fresh on each run and
+// wired into every service, so there is nothing to configure. point cmd/client at the auth service to connect.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/simulator"
+	"github.com/networknext/udpx/modules/status"
+)
+
+// clients reach the first gateway and fall back to the second. both gateways send to the server through the
+// simulator proxy, which creates a route for each gateway as its first packet arrives
+
+const (
+	authPort                = 60000
+	gatewayAddress          = "127.0.0.1:40000"
+	gatewayInternalAddress  = "127.0.0.1:40001"
+	fallbackGatewayAddress  = "127.0.0.1:41000"
+	fallbackInternalAddress = "127.0.0.1:41001"
+	simulatorAddress        = "127.0.0.1:45000"
+	serverAddress           = "127.0.0.1:50000"
+)
+
+type service struct {
+	name    string
+	logFile string
+	cmd     *exec.Cmd
+	done    chan struct{}
+	err     error
+}
+
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mainReturnWithCode() int {
+
+	serviceName := "udpx dev"
+
+	log.SetService(serviceName)
+
+	core.Info("%s %s", serviceName, status.VersionString())
+
+	// configure
+
+	binaryDir := envvar.Get("BINARY_DIR", "./dist")
+	logDir := envvar.Get("LOG_DIR", "./dist")
+
+	serverMode := envvar.Get("SERVER_MODE", "echo")
+
+	var err error
+	var simulatorConfig simulator.Config
+
+	simulatorConfig.Latency, err = envvar.GetDurationRange("LATENCY", 20*time.Millisecond, 0, time.Second)
+	if err != nil {
+		core.Error("invalid LATENCY: %v", err)
+		return 1
+	}
+
+	simulatorConfig.Jitter, err = envvar.GetDurationRange("JITTER", 5*time.Millisecond, 0, time.Second)
+	if err != nil {
+		core.Error("invalid JITTER: %v", err)
+		return 1
+	}
+
+	simulatorConfig.ReorderDelay, err = envvar.GetDurationRange("REORDER_DELAY", 50*time.Millisecond, 0, time.Second)
+	if err != nil {
+		core.Error("invalid REORDER_DELAY: %v", err)
+		return 1
+	}
+
+	simulatorConfig.Loss = 0.01
+
+	for name, value := range map[string]*float64{"PACKET_LOSS": &simulatorConfig.Loss, "PACKET_DUPLICATION": &simulatorConfig.Duplication, "PACKET_REORDER": &simulatorConfig.Reorder} {
+		*value, err = envvar.GetFloat(name, *value)
+		if err != nil || *value < 0 || *value > 1 {
+			core.Error("invalid %s: %v", name, err)
+			return 1
+		}
+	}
+
+	seed, err := envvar.GetInt("SEED", int(time.Now().UnixNano()))
+	if err != nil {
+		core.Error("invalid SEED: %v", err)
+		return 1
+	}
+	simulatorConfig.Seed = int64(seed)
+
+	statusInterval, err := envvar.GetDurationRange("STATUS_INTERVAL", 10*time.Second, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid STATUS_INTERVAL: %v", err)
+		return 1
+	}
+
+	// generate keys. both gateways share a keypair, since auth encrypts connect tokens for one gateway key
+
+	gatewayPublicKey, gatewayPrivateKey := core.Keygen_Box()
+	authPublicKey, authPrivateKey := core.Keygen_Box()
+	authSignPublicKey, authSignPrivateKey := core.Keygen_Sign()
+
+	encode := base64.StdEncoding.EncodeToString
+
+	gatewayToken := encode(core.RandomBytes(32))
+
+	// start the simulator in process, between the gateways and the server
+
+	networkSimulator := simulator.Create(simulatorConfig)
+	defer networkSimulator.Close()
+
+	proxy, err := simulator.Listen(simulatorAddress, core.ParseAddress(serverAddress), nil, networkSimulator)
+	if err != nil {
+		core.Error("could not start simulator: %v", err)
+		return 1
+	}
+	defer proxy.Close()
+
+	core.Info("simulating %v latency, %v jitter, %.1f%% loss, %.1f%% duplication, %.1f%% reordering between gateways and server (seed %d)",
+		simulatorConfig.Latency, simulatorConfig.Jitter, simulatorConfig.Loss*100, simulatorConfig.Duplication*100, simulatorConfig.Reorder*100, simulatorConfig.Seed)
+
+	// start the services. they are stopped in reverse order, so the server outlives the gateways sending to it
+
+	var services []*service
+	defer func() {
+		for i := len(services) - 1; i >= 0; i-- {
+			stopService(services[i])
+		}
+	}()
+
+	start := func(name string, binary string, url string, env ...string) error {
+		s, err := startService(name, filepath.Join(binaryDir, binary), filepath.Join(logDir, "dev_"+name+".log"), env...)
+		if err != nil {
+			return fmt.Errorf("could not start %s: %v", name, err)
+		}
+		services = append(services, s)
+		if err := waitForHealth(url, 10*time.Second); err != nil {
+			return fmt.Errorf("%v. see %s", err, s.logFile)
+		}
+		core.Info("started %s. logging to %s", name, s.logFile)
+		return nil
+	}
+
+	err = start("server", "server", "http://"+serverAddress,
+		"UDP_PORT=50000",
+		"HTTP_PORT=50000",
+		"MODE="+serverMode,
+	)
+	if err != nil {
+		core.Error("%v", err)
+		return 1
+	}
+
+	err = start("auth", "auth", fmt.Sprintf("http://127.0.0.1:%d", authPort),
+		fmt.Sprintf("HTTP_PORT=%d", authPort),
+		"GATEWAY_ADDRESS="+gatewayAddress,
+		"FALLBACK_GATEWAY_ADDRESSES="+fallbackGatewayAddress,
+		"GATEWAY_PUBLIC_KEY="+encode(gatewayPublicKey),
+		"AUTH_PUBLIC_KEY="+encode(authPublicKey),
+		"AUTH_PRIVATE_KEY="+encode(authPrivateKey),
+		"AUTH_SIGN_PUBLIC_KEY="+encode(authSignPublicKey),
+		"AUTH_SIGN_PRIVATE_KEY="+encode(authSignPrivateKey),
+		"GATEWAY_TOKEN="+gatewayToken,
+	)
+	if err != nil {
+		core.Error("%v", err)
+		return 1
+	}
+
+	for i, addresses := range [][2]string{{gatewayAddress, gatewayInternalAddress}, {fallbackGatewayAddress, fallbackInternalAddress}} {
+		port := core.ParseAddress(addresses[0]).Port
+		err = start(fmt.Sprintf("gateway_%d", i+1), "gateway", "http://"+addresses[0],
+			fmt.Sprintf("UDP_PORT=%d", port),
+			fmt.Sprintf("HTTP_PORT=%d", port),
+			"GATEWAY_ADDRESS="+addresses[0],
+			"GATEWAY_INTERNAL_ADDRESS="+addresses[1],
+			"GATEWAY_PRIVATE_KEY="+encode(gatewayPrivateKey),
+			"AUTH_PUBLIC_KEY="+encode(authPublicKey),
+			"AUTH_SIGN_PUBLIC_KEY="+encode(authSignPublicKey),
+			fmt.Sprintf("AUTH_URL=http://127.0.0.1:%d", authPort),
+			"AUTH_GATEWAY_TOKEN="+gatewayToken,
+			"SERVER_ADDRESS="+simulatorAddress,
+		)
+		if err != nil {
+			core.Error("%v", err)
+			return 1
+		}
+	}
+
+	core.Info("ready. to connect a client, run:")
+	core.Info("    UDP_PORT=30000 CLIENT_ADDRESS=127.0.0.1:30000 AUTH_URL=http://127.0.0.1:%d %s", authPort, filepath.Join(binaryDir, "client"))
+
+	// run until interrupted, or until one of the services falls over
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
+
+	exitChan := make(chan *service, len(services))
+	for _, s := range services {
+		go func(s *service) {
+			<-s.done
+			exitChan <- s
+		}(s)
+	}
+
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-termChan:
+			core.Info("shutting down")
+			return 0
+		case s := <-exitChan:
+			core.Error("%s exited unexpectedly: %v. see %s", s.name, s.err, s.logFile)
+			return 1
+		case <-ticker.C:
+			stats := networkSimulator.GetStats()
+			core.Info("%d gateway routes. %d packets, %d dropped, %d duplicated, %d reordered", proxy.GetNumRoutes(), stats.Packets, stats.Dropped, stats.Duplicated, stats.Reordered)
+		}
+	}
+}
+
+func startService(name string, binary string, logFile string, env ...string) (*service, error) {
+	output, err := os.Create(logFile)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		output.Close()
+		return nil, err
+	}
+	s := &service{name: name, logFile: logFile, cmd: cmd, done: make(chan struct{})}
+	go func() {
+		s.err = cmd.Wait()
+		output.Close()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+func stopService(s *service) {
+	s.cmd.Process.Signal(os.Interrupt)
+	<-s.done
+}
+
+func waitForHealth(url string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		response, err := http.Get(url + "/health")
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("%s is not healthy after %v", url, timeout)
+}
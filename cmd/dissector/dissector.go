@@ -0,0 +1,323 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+// Field is a field in the cleartext parts of a packet between a client and the gateway. Everything else is
+// encrypted, so the dissector shows it as one block.
+type Field struct {
+	Name   string
+	Abbrev string
+	Bytes  int
+	Type   string
+	Values string
+}
+
+var prefixFields = []Field{
+	{Name: "Version", Abbrev: "version", Bytes: core.VersionBytes, Type: "uint8", Values: "versions"},
+	{Name: "Packet Type", Abbrev: "type", Bytes: core.PacketTypeBytes, Type: "uint8", Values: "packet_types"},
+	{Name: "Chonkle", Abbrev: "chonkle", Bytes: core.ChonkleBytes, Type: "bytes"},
+	{Name: "Session Token", Abbrev: "session_token", Bytes: core.EncryptedSessionTokenBytes, Type: "bytes"},
+	{Name: "Session Token Sequence", Abbrev: "session_token_sequence", Bytes: core.SequenceBytes, Type: "uint64"},
+}
+
+// packets from clients have their cipher suite where packets from the gateway have their packet type
+
+var cipherSuiteField = Field{Name: "Cipher Suite", Abbrev: "cipher_suite", Bytes: core.CipherSuiteBytes, Type: "uint8", Values: "cipher_suites"}
+
+func clientPrefixFields() []Field {
+	fields := append([]Field{}, prefixFields...)
+	fields[1] = cipherSuiteField
+	return fields
+}
+
+// payload packets carry the real packet type in the encrypted part of the header, so keep alives,
+// disconnects and mtu probes show as payload packets
+
+var payloadFields = []Field{
+	{Name: "Session Id", Abbrev: "session_id", Bytes: core.SessionIdBytes, Type: "bytes"},
+	{Name: "Sequence", Abbrev: "sequence", Bytes: core.SequenceBytes, Type: "uint64"},
+}
+
+var challengeFields = []Field{
+	{Name: "Nonce", Abbrev: "nonce", Bytes: core.NonceBytes_Box, Type: "bytes"},
+}
+
+var postfixFields = []Field{
+	{Name: "Encrypted", Abbrev: "encrypted", Type: "bytes"},
+	{Name: "Pittle", Abbrev: "pittle", Bytes: core.PittleBytes, Type: "bytes"},
+}
+
+type Value struct {
+	Value byte
+	Name  string
+}
+
+// versions has every packet version byte of the protocol versions still read
+func versions() []Value {
+	values := []Value{}
+	for _, version := range core.ProtocolVersions {
+		values = append(values, Value{core.PacketVersion(version.Version, core.PacketFilter_FNV1a), fmt.Sprintf("v%d FNV-1a filter", version.Version)})
+		values = append(values, Value{core.PacketVersion(version.Version, core.PacketFilter_SipHash), fmt.Sprintf("v%d SipHash filter", version.Version)})
+	}
+	return values
+}
+
+func cipherSuites() []Value {
+	values := []Value{}
+	for _, cipherSuite := range core.CipherSuites {
+		values = append(values, Value{cipherSuite, core.CipherSuiteName(cipherSuite)})
+	}
+	return values
+}
+
+var packetTypes = []Value{
+	{core.PayloadPacket, "Payload"},
+	{core.ChallengePacket, "Challenge"},
+	{core.ServerPingPacket, "Server Ping"},
+	{core.ServerPongPacket, "Server Pong"},
+	{core.KeepAlivePacket, "Keep Alive"},
+	{core.DisconnectPacket, "Disconnect"},
+	{core.MTUProbePacket, "MTU Probe"},
+	{core.RelayPacket, "Relay"},
+	{core.GatewayPingPacket, "Gateway Ping"},
+	{core.GatewayPongPacket, "Gateway Pong"},
+	{core.ClientStatsPacket, "Client Stats"},
+	{core.VersionRejectPacket, "Version Reject"},
+	{core.CipherSuiteRejectPacket, "Cipher Suite Reject"},
+	{core.CookiePacket, "Cookie"},
+	{core.CookieEchoPacket, "Cookie Echo"},
+}
+
+const dissectorTemplate = `-- udpx wireshark dissector, generated by cmd/dissector. regenerate it instead of editing it.
+--
+-- copy to your wireshark plugins directory, or run "wireshark -X lua_script:udpx.lua". packets on other
+-- ports can be dissected with "decode as... udpx"
+
+local udpx = Proto("udpx", "udpx")
+
+local versions = {
+{{- range .Versions}}
+	[{{.Value}}] = "{{.Name}}",
+{{- end}}
+}
+
+local packet_types = {
+{{- range .PacketTypes}}
+	[{{.Value}}] = "{{.Name}}",
+{{- end}}
+}
+
+local cipher_suites = {
+{{- range .CipherSuites}}
+	[{{.Value}}] = "{{.Name}}",
+{{- end}}
+}
+
+local gateway_ports = {
+{{- range .Ports}}
+	[{{.}}] = true,
+{{- end}}
+}
+
+local fields = {
+{{- range .Fields}}
+	{{.Abbrev}} = ProtoField.{{.Type}}("udpx.{{.Abbrev}}", "{{.Name}}"{{if .Values}}, base.DEC, {{.Values}}{{end}}),
+{{- end}}
+}
+
+udpx.fields = {
+{{- range .Fields}}
+	fields.{{.Abbrev}},
+{{- end}}
+}
+
+local function add_fields(tree, buffer, offset, fields_to_add)
+	for _, field in ipairs(fields_to_add) do
+		if field.little_endian then
+			tree:add_le(field.field, buffer(offset, field.bytes))
+		else
+			tree:add(field.field, buffer(offset, field.bytes))
+		end
+		offset = offset + field.bytes
+	end
+	return offset
+end
+
+local prefix_fields = {
+{{- range .PrefixFields}}
+	{ field = fields.{{.Abbrev}}, bytes = {{.Bytes}}, little_endian = {{ne .Type "bytes"}} },
+{{- end}}
+}
+
+local client_prefix_fields = {
+{{- range .ClientPrefixFields}}
+	{ field = fields.{{.Abbrev}}, bytes = {{.Bytes}}, little_endian = {{ne .Type "bytes"}} },
+{{- end}}
+}
+
+local payload_fields = {
+{{- range .PayloadFields}}
+	{ field = fields.{{.Abbrev}}, bytes = {{.Bytes}}, little_endian = {{ne .Type "bytes"}} },
+{{- end}}
+}
+
+local challenge_fields = {
+{{- range .ChallengeFields}}
+	{ field = fields.{{.Abbrev}}, bytes = {{.Bytes}}, little_endian = {{ne .Type "bytes"}} },
+{{- end}}
+}
+
+local PREFIX_BYTES = {{.PrefixBytes}}
+local PITTLE_BYTES = {{.PittleBytes}}
+local CHALLENGE_PACKET = {{.ChallengePacket}}
+local PAYLOAD_PACKET = {{.PayloadPacket}}
+local CIPHER_SUITE_PROTOCOL_VERSION = {{.CipherSuiteProtocolVersion}}
+
+function udpx.dissector(buffer, pinfo, tree)
+
+	local length = buffer:len()
+	if length < PREFIX_BYTES + PITTLE_BYTES then
+		return 0
+	end
+
+	pinfo.cols.protocol = "UDPX"
+
+	local subtree = tree:add(udpx, buffer(), "udpx")
+
+	-- packets to the gateway are always payload packets, and newer clients put their cipher suite in the packet type
+
+	local packet_type = buffer(1, 1):uint()
+	local prefix = prefix_fields
+	if gateway_ports[pinfo.dst_port] and math.floor(buffer(0, 1):uint() / 16) >= CIPHER_SUITE_PROTOCOL_VERSION then
+		packet_type = PAYLOAD_PACKET
+		prefix = client_prefix_fields
+	end
+
+	local offset = add_fields(subtree, buffer, 0, prefix)
+	local cleartext_fields = payload_fields
+	if packet_type == CHALLENGE_PACKET then
+		cleartext_fields = challenge_fields
+	end
+
+	local cleartext_bytes = 0
+	for _, field in ipairs(cleartext_fields) do
+		cleartext_bytes = cleartext_bytes + field.bytes
+	end
+
+	if length >= offset + cleartext_bytes + PITTLE_BYTES then
+		offset = add_fields(subtree, buffer, offset, cleartext_fields)
+	end
+
+	if length - PITTLE_BYTES > offset then
+		subtree:add(fields.encrypted, buffer(offset, length - PITTLE_BYTES - offset))
+	end
+	subtree:add(fields.pittle, buffer(length - PITTLE_BYTES, PITTLE_BYTES))
+
+	pinfo.cols.info = string.format("%s, %d bytes", packet_types[packet_type] or "Unknown", length)
+
+	return length
+end
+
+local udp_port = DissectorTable.get("udp.port")
+{{- range .Ports}}
+udp_port:add({{.}}, udpx)
+{{- end}}
+`
+
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mainReturnWithCode() int {
+
+	ports := flag.String("ports", "40000", "comma separated udp ports to dissect as udpx")
+	output := flag.String("output", "", "write to this file instead of stdout")
+	flag.Parse()
+
+	var portList []int
+	for _, value := range strings.Split(*ports, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || port <= 0 || port > 65535 {
+			core.Error("invalid port: %s", value)
+			return 1
+		}
+		portList = append(portList, port)
+	}
+
+	fields := append(append(append(append(append([]Field{}, prefixFields...), cipherSuiteField), payloadFields...), challengeFields...), postfixFields...)
+
+	var buffer bytes.Buffer
+	err := template.Must(template.New("dissector").Parse(dissectorTemplate)).Execute(&buffer, map[string]interface{}{
+		"Versions":                   versions(),
+		"PacketTypes":                packetTypes,
+		"CipherSuites":               cipherSuites(),
+		"Fields":                     fields,
+		"PrefixFields":               prefixFields,
+		"ClientPrefixFields":         clientPrefixFields(),
+		"PayloadFields":              payloadFields,
+		"ChallengeFields":            challengeFields,
+		"PrefixBytes":                core.PrefixBytes,
+		"PittleBytes":                core.PittleBytes,
+		"ChallengePacket":            core.ChallengePacket,
+		"PayloadPacket":              core.PayloadPacket,
+		"CipherSuiteProtocolVersion": core.CipherSuiteProtocolVersion,
+		"Ports":                      portList,
+	})
+	if err != nil {
+		core.Error("could not generate dissector: %v", err)
+		return 1
+	}
+
+	if *output == "" {
+		os.Stdout.Write(buffer.Bytes())
+		return 0
+	}
+
+	if err := os.WriteFile(*output, buffer.Bytes(), 0644); err != nil {
+		core.Error("could not write %s: %v", *output, err)
+		return 1
+	}
+
+	return 0
+}
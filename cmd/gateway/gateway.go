@@ -38,930 +38,4612 @@ import "C"
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/networknext/udpx/modules/analytics"
+	"github.com/networknext/udpx/modules/capture"
+	"github.com/networknext/udpx/modules/config"
 	"github.com/networknext/udpx/modules/core"
 	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/health"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/metrics"
+	"github.com/networknext/udpx/modules/netio"
+	"github.com/networknext/udpx/modules/pool"
+	"github.com/networknext/udpx/modules/redis"
+	"github.com/networknext/udpx/modules/router"
+	"github.com/networknext/udpx/modules/sessionstore"
+	"github.com/networknext/udpx/modules/status"
+	"github.com/networknext/udpx/modules/systemd"
+	"github.com/networknext/udpx/modules/tracing"
+	"github.com/networknext/udpx/modules/tunnel"
+	"github.com/networknext/udpx/modules/websocket"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/sys/unix"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const MaxPacketSize = 1500
-const SessionMapSwapTime = 60
+const SessionSweepInterval = time.Second
 const ChallengeTokenTimeout = 10
-const OldSequenceThreshold = 100
+const WebTransportCertificateLifetime = 10 * 24 * time.Hour
+const WebTransportDatagramBytes = 1100
+const WebTransportReassemblyTimeout = time.Second
+const WebTransportReassemblyMemory = 64 * 1024
+const DTLSHandshakeTimeout = 5 * time.Second
+const KickDuration = 5 * time.Minute
+const DefaultFilterKeyOverlap = time.Hour
+const SessionLookupWorkers = 8
+const SessionLookupQueueSize = 1024
+const SessionLookupTimeout = time.Second
+const SessionLookupExpiry = 10 * time.Second
+const SessionStoreBatchSize = 1000
+const DrainReportInterval = 10 * time.Second
 
 type SessionTokenUpdate struct {
 	SessionTokenData []byte
 	ExpireTimestamp  uint64
 }
 
+type SessionTokenRequest struct {
+	Channel          chan SessionTokenUpdate
+	SessionId        [core.SessionIdBytes]byte
+	SessionTokenData [core.SignedSessionTokenBytes]byte
+	Tenant           *Tenant
+}
+
 type SessionEntry struct {
-	ReceivedSequence                 uint64
-	ReceivedPackets                  [OldSequenceThreshold]uint64
-	UpdatingSessionToken             bool
-	SessionTokenChannel              chan SessionTokenUpdate
-	SessionTokenData                 [core.EncryptedSessionTokenBytes]byte
-	SessionTokenExpireTimestamp      uint64
-	SessionTokenSequence             uint64
-	SessionTokenCooldown             time.Time
-	SessionTokenRetryCount           int
-	ReceiveBandwidthBitsAccumulator  uint64
-	ReceiveBandwidthBitsPerSecondMax uint64
-	ReceiveBandwidthBitsResetTime    time.Time
-	PacketsReceivedInLastSecond      uint64
-	PacketsPerSecondMax              uint64
+	ReplayProtection                *core.ReplayProtection
+	UpdatingSessionToken            bool
+	SessionTokenChannel             chan SessionTokenUpdate
+	SessionKeys                     core.SessionKeys
+	ServerIndex                     int
+	TenantId                        uint16
+	SessionTokenData                [core.EncryptedSessionTokenBytes]byte
+	SessionTokenExpireTimestamp     uint64
+	SessionTokenSequence            uint64
+	SessionTokenCooldown            time.Time
+	SessionTokenRetryCount          int
+	ReceiveBandwidthBitsAccumulator uint64
+	ReceiveBandwidthBitsResetTime   time.Time
+	PacketsReceivedInLastSecond     uint64
+	PacketsPerSecondMax             uint64
+	UpLimiter                       *core.BandwidthLimiter
+	DownLimiter                     *core.BandwidthLimiter
+	Pacer                           *core.Pacer
+	PathStats                       *core.PathStats
+	UserId                          [core.UserIdBytes]byte
+	Usage                           core.UsageCounter
+	ProxyAddress                    atomic.Pointer[net.UDPAddr]
+	ClientAddress                   *net.UDPAddr
+	CreateTime                      time.Time
+	PreviousFilterKey               atomic.Bool
+	PacketVersion                   atomic.Uint32
+	CipherSuite                     atomic.Uint32
+	Relayed                         bool
+	SessionId                       [core.SessionIdBytes]byte
+	EndReason                       atomic.Value
+	LastSequence                    atomic.Uint64
+	ClientStats                     atomic.Pointer[core.ClientStats]
+	StoredSequence                  uint64
+}
+
+// SessionLookup is a session this gateway instance doesn't have, being looked up in the session store
+type SessionLookup struct {
+	SessionId  [core.SessionIdBytes]byte
+	CreateTime time.Time
+	Record     *sessionstore.Record
+	Done       atomic.Bool
+}
+
+// RouteEntry is a session this gateway relays for. Packets from the previous hop go to the next hop, and
+// packets back from the next hop go to the previous hop
+type RouteEntry struct {
+	PrevAddress     *net.UDPAddr
+	PrevSendAddress *net.UDPAddr
+	NextAddress     *net.UDPAddr
+	Hop             uint8
+}
+
+var Blocklist = &core.Blocklist{}
+
+// AcceptedCipherSuites are the cipher suites clients can encrypt payload with. Clients in any other cipher suite
+// are told to use PreferredCipherSuite instead
+var AcceptedCipherSuites [256]bool
+var PreferredCipherSuite byte
+
+var PacketFilters = core.CreateFilterChain(Blocklist, core.BasicFilter{}, core.AdvancedFilter{})
+
+var ChallengeSendLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+var ServerForwardLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+var ClientForwardLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+var SessionStoreLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+var ProtocolMismatchLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+var CipherSuiteRejectLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+var CookieSendLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+
+var Metrics = metrics.CreateRegistry()
+
+var Status = status.CreateReporter("udpx gateway", Metrics, time.Now())
+
+var PacketsReceived = Metrics.Counter("udpx_gateway_packets_received_total", "Packets received from clients.")
+var DroppedPackets = Metrics.Counter("udpx_gateway_packets_dropped_total", "Packets from clients dropped for being malformed, for the wrong gateway or over their session envelope.")
+var RateLimitedPackets = Metrics.Counter("udpx_gateway_packets_rate_limited_total", "Packets from clients dropped by the per address rate limiter.")
+var ProtocolMismatchPackets = Metrics.Counter("udpx_gateway_packets_protocol_mismatch_total", "Packets from clients speaking another protocol version, answered with a version reject.")
+var UnknownSourcePackets = Metrics.Counter("udpx_gateway_packets_unknown_source_total", "Packets from addresses without a session or route here, that cost the gateway crypto unless cookies are required.")
+var CookiesSent = Metrics.Counter("udpx_gateway_cookies_sent_total", "Cookies sent to unknown addresses while cookies were required.")
+var InvalidCookies = Metrics.Counter("udpx_gateway_cookies_invalid_total", "Cookies echoed back that had expired, or were sent to another address.")
+var CipherSuiteRejectedPackets = Metrics.Counter("udpx_gateway_packets_cipher_suite_rejected_total", "Packets from clients in a cipher suite this gateway doesn't accept, answered with a cipher suite reject.")
+var ReplayedPackets = Metrics.Counter("udpx_gateway_packets_replayed_total", "Packets from clients dropped as already received.")
+var PacketsForwardedToServer = Metrics.Counter(`udpx_gateway_packets_forwarded_total{direction="server"}`, "Packets forwarded between clients and the server.")
+var PacketsForwardedToClient = Metrics.Counter(`udpx_gateway_packets_forwarded_total{direction="client"}`, "Packets forwarded between clients and the server.")
+var ChallengesSent = Metrics.Counter("udpx_gateway_challenges_sent_total", "Challenge packets sent to clients.")
+var CryptoFailures = Metrics.Counter("udpx_gateway_crypto_failures_total", "Session tokens, challenge tokens and payloads that failed to decrypt.")
+var ExpiredSessionTokens = Metrics.Counter("udpx_gateway_session_tokens_expired_total", "Session tokens rejected for their timestamps.")
+var MismatchedSessionTokens = Metrics.Counter("udpx_gateway_session_tokens_ip_mismatch_total", "Session tokens bound to a different client ip than they were sent from.")
+var RevokedPacketsFromClient = Metrics.Counter(`udpx_gateway_packets_revoked_total{direction="server"}`, "Packets between the server and revoked sessions or users that were dropped.")
+var RevokedPacketsToClient = Metrics.Counter(`udpx_gateway_packets_revoked_total{direction="client"}`, "Packets between the server and revoked sessions or users that were dropped.")
+var RevocationPollFailures = Metrics.Counter("udpx_gateway_revocation_poll_failures_total", "Polls of the auth service revocation list that failed.")
+var ReplayedSessionTokens = Metrics.Counter("udpx_gateway_session_tokens_replayed_total", "Session tokens replayed from another address.")
+var SessionTokenRefreshFailures = Metrics.Counter("udpx_gateway_session_token_refresh_failures_total", "Session token refreshes that failed.")
+var SessionTokenRefreshLatency = Metrics.Histogram("udpx_gateway_session_token_refresh_seconds", "Time taken to refresh a session token with the auth service.", metrics.LatencyBuckets)
+var SessionTokensExtended = Metrics.Counter("udpx_gateway_session_tokens_extended_total", "Session tokens extended locally with the delegate key.")
+var UnknownTenantPackets = Metrics.Counter("udpx_gateway_packets_unknown_tenant_total", "Packets from clients dropped for session tokens of a tenant that isn't configured.")
+var TenantSessionsRejected = Metrics.Counter("udpx_gateway_tenant_sessions_rejected_total", "New sessions dropped because their tenant was at its session limit.")
+var SessionTokenRefreshesDeferred = Metrics.Counter("udpx_gateway_session_token_refreshes_deferred_total", "Session token refreshes put off because the refresh queue was full.")
+var SessionsCreated = Metrics.Counter("udpx_gateway_sessions_created_total", "Sessions created.")
+var RoutesCreated = Metrics.Counter("udpx_gateway_routes_created_total", "Routes set up through this gateway as a relay.")
+var PacketsRelayedToNext = Metrics.Counter(`udpx_gateway_packets_relayed_total{direction="next"}`, "Packets relayed to the next or previous hop of a route.")
+var PacketsRelayedToPrevious = Metrics.Counter(`udpx_gateway_packets_relayed_total{direction="previous"}`, "Packets relayed to the next or previous hop of a route.")
+var GatewayPingsSent = Metrics.Counter("udpx_gateway_mesh_pings_sent_total", "Pings sent to other gateways in the ping mesh.")
+var GatewayPongsReceived = Metrics.Counter("udpx_gateway_mesh_pongs_received_total", "Pongs received from other gateways in the ping mesh.")
+var PingMeshReportFailures = Metrics.Counter("udpx_gateway_mesh_report_failures_total", "Ping mesh reports to the router, and polls of its gateways, that failed.")
+var RelayPacketsDropped = Metrics.Counter("udpx_gateway_relay_packets_dropped_total", "Relay packets dropped for invalid or expired route tokens, or for being too large to relay.")
+var ConfigReloads = Metrics.Counter(`udpx_gateway_config_reloads_total{result="ok"}`, "Configuration reloads on SIGHUP or CONFIG_FILE changing, by whether the new configuration was valid.")
+var ConfigReloadFailures = Metrics.Counter(`udpx_gateway_config_reloads_total{result="failed"}`, "Configuration reloads on SIGHUP or CONFIG_FILE changing, by whether the new configuration was valid.")
+var SessionsKicked = Metrics.Counter("udpx_gateway_sessions_kicked_total", "Sessions ended through the admin api.")
+var SessionsContinued = Metrics.Counter("udpx_gateway_sessions_continued_total", "Sessions started on another gateway instance and continued on this one from the session store.")
+var SessionStoreFailures = Metrics.Counter("udpx_gateway_session_store_failures_total", "Session store reads and writes that failed.")
+var SessionLookupsPending = Metrics.Counter("udpx_gateway_session_lookup_packets_dropped_total", "Packets for unknown sessions dropped while the session was looked up in the session store.")
+var DrainRejectedPackets = Metrics.Counter("udpx_gateway_drain_rejected_packets_total", "Packets for new sessions and routes dropped while the gateway was draining.")
+var SessionsDisconnected = Metrics.Counter("udpx_gateway_sessions_disconnected_total", "Sessions ended by a disconnect packet from the client.")
+var ClientRTT = Metrics.Histogram("udpx_gateway_client_rtt_seconds", "Round trip time between the gateway and clients, sampled from acks.", metrics.LatencyBuckets)
+var ClientJitter = Metrics.Histogram("udpx_gateway_client_jitter_seconds", "Smoothed round trip time jitter between the gateway and clients, sampled from acks.", metrics.LatencyBuckets)
+var ClientPacketsLost = Metrics.Counter("udpx_gateway_client_packets_lost_total", "Packets forwarded to clients that were not acked in time.")
+var OverBandwidthPacketsFromClient = Metrics.Counter(`udpx_gateway_packets_over_bandwidth_total{direction="server"}`, "Packets over their session bandwidth limit, dropped or marked depending on BANDWIDTH_LIMIT_MODE.")
+var OverBandwidthPacketsToClient = Metrics.Counter(`udpx_gateway_packets_over_bandwidth_total{direction="client"}`, "Packets over their session bandwidth limit, dropped or marked depending on BANDWIDTH_LIMIT_MODE.")
+var PacedPacketsToClient = Metrics.Counter("udpx_gateway_packets_paced_total", "Packets to clients held back by their session pacer, with PACING_KBPS.")
+var ClientStatsReceived = Metrics.Counter("udpx_gateway_client_stats_received_total", "Stats packets received from clients.")
+var BytesForwardedToServer = Metrics.Counter(`udpx_gateway_bytes_forwarded_total{direction="server"}`, "Bytes of client packets forwarded to the server, and of packets forwarded to clients.")
+var BytesForwardedToClient = Metrics.Counter(`udpx_gateway_bytes_forwarded_total{direction="client"}`, "Bytes of client packets forwarded to the server, and of packets forwarded to clients.")
+var WebSocketConnections = Metrics.Gauge("udpx_gateway_websocket_connections", "Clients connected over the websocket fallback transport.")
+var WebTransportSessions = Metrics.Gauge("udpx_gateway_webtransport_sessions", "Browser clients connected over webtransport.")
+var WebTransportDatagramsTooLarge = Metrics.Counter("udpx_gateway_webtransport_datagrams_dropped_total", "Packets to webtransport clients dropped for fragments larger than their connection takes in a datagram.")
+var QUICConnections = Metrics.Gauge("udpx_gateway_quic_connections", "Clients connected in quic datagram mode.")
+var DTLSConnections = Metrics.Gauge("udpx_gateway_dtls_connections", "Clients connected in dtls mode.")
+
+var UsageAccounting = core.CreateUsageAccounting()
+
+var AdminToken string
+
+var SessionTables []*core.SessionTable
+
+// Analytics publishes session events when ANALYTICS_SINK is set
+var Analytics *analytics.Publisher
+
+// SessionStore shares sessions with the other gateway instances behind the same address. It is nil unless SESSION_STORE is set
+var SessionStore *sessionstore.Store
+
+// SessionLookups are the sessions looked up in the session store recently, keyed by session id
+var SessionLookups sync.Map
+var SessionLookupQueue chan *SessionLookup
+
+// DrainStartTime is when the gateway started draining on SIGUSR1, SIGTERM or the admin api, in unix nanoseconds,
+// or zero. Draining gateways take no new sessions or routes, and exit once the ones they have end. DrainedChannel
+// is closed when they have, or when DRAIN_TIMEOUT has passed
+var DrainStartTime atomic.Int64
+var DrainSessions atomic.Int64
+var DrainTimeout time.Duration
+var DrainChannel = make(chan struct{})
+var DrainedChannel = make(chan struct{})
+
+// HealthChecks are served on /ready and /health, and fail while draining
+var HealthChecks *health.Checks
+
+// PingMesh measures the links to the other gateways. It is nil unless PING_MESH_ADDRESSES or ROUTER_URL is set
+var PingMesh *core.PingMesh
+
+// RouteTable is shared by all threads, since replies from the next hop can arrive on a different socket
+var RouteTable *core.SessionTable
+
+var Revocations = core.CreateRevocationList()
+
+// KickedSessions are sessions ended through the admin api. Their packets are dropped for KickDuration, so
+// the client can't just start the session again with the same session token
+var KickedSessions = core.CreateRevocationList()
+
+var FilterKeys *core.FilterKeyRing
+
+var AdminConfig atomic.Pointer[map[string]interface{}]
+
+var RateLimiter *core.RateLimiter
+var RateLimitEnabled atomic.Bool
+
+// While CookiesRequired, addresses without a session or route here have to echo a cookie before we spend any
+// crypto on their packets. CookieMode is "on", "off" or "auto". In auto mode, cookies are required while packets
+// from unknown addresses arrive faster than CookiePacketsPerSecond, and for CookieCooldown after
+var CookieKey = core.RandomBytes(core.SipHashKeyBytes)
+var CookieMode atomic.Value
+var CookiesRequired atomic.Bool
+var CookiePacketsPerSecond uint64
+var CookieCooldown time.Duration
+
+// Tenants are the tenants configured in CONFIG_FILE, by tenant id. Session tokens with tenant id 0 belong to
+// the default tenant, which uses the top level settings
+var Tenants atomic.Pointer[map[uint16]*Tenant]
+
+// TenantSessions counts the sessions of each tenant, as *atomic.Int64 by tenant id. The counts carry over
+// config reloads, so they aren't kept on the Tenant
+var TenantSessions sync.Map
+
+// SessionTokenDelegatePublicKey is accepted on the session tokens of every tenant, when it is set
+var SessionTokenDelegatePublicKey []byte
+
+// RelayClientIPs maps the loopback address of each tunnelled client's relay socket to the client's real ip
+var RelayClientIPs sync.Map
+var ServerPool *core.ServerPool
+
+func init() {
+	Metrics.GaugeFunc("udpx_gateway_sessions_active", "Sessions that have not yet timed out.", func() int64 {
+		count := int64(0)
+		for _, table := range SessionTables {
+			count += int64(table.GetCount())
+		}
+		return count
+	})
+	Metrics.GaugeFunc("udpx_gateway_routes_active", "Routes relayed through this gateway that have not yet timed out.", func() int64 {
+		if RouteTable == nil {
+			return 0
+		}
+		return int64(RouteTable.GetCount())
+	})
+	Metrics.GaugeFunc("udpx_gateway_cookies_required", "Whether addresses without a session or route have to echo a cookie first.", func() int64 {
+		if CookiesRequired.Load() {
+			return 1
+		}
+		return 0
+	})
+	Metrics.GaugeFunc("udpx_gateway_draining", "Whether the gateway is draining its sessions before it exits.", func() int64 {
+		if DrainStartTime.Load() != 0 {
+			return 1
+		}
+		return 0
+	})
+	Metrics.CounterFunc("udpx_gateway_sessions_expired_total", "Sessions removed after receiving no packets for SESSION_TIMEOUT.", func() uint64 {
+		count := uint64(0)
+		for _, table := range SessionTables {
+			count += table.GetExpired()
+		}
+		return count
+	})
+	Metrics.CounterFunc("udpx_gateway_sessions_evicted_total", "Least recently used sessions evicted because the session table was full.", func() uint64 {
+		count := uint64(0)
+		for _, table := range SessionTables {
+			count += table.GetEvicted()
+		}
+		return count
+	})
+	for i, result := range []string{"published", "dropped", "failed"} {
+		resultIndex := i
+		Metrics.CounterFunc(fmt.Sprintf(`udpx_gateway_analytics_events_total{result="%s"}`, result), "Session analytics events published, dropped because the queue was full, or lost because the sink failed.", func() uint64 {
+			if Analytics == nil {
+				return 0
+			}
+			published, dropped, failed := Analytics.GetStats()
+			return [...]uint64{published, dropped, failed}[resultIndex]
+		})
+	}
+	for i := 0; i < PacketFilters.GetNumFilters(); i++ {
+		filterIndex := i
+		Metrics.CounterFunc(fmt.Sprintf(`udpx_gateway_packets_filtered_total{filter="%s"}`, PacketFilters.GetFilterName(i)), "Packets from clients dropped by the packet filters.", func() uint64 {
+			return PacketFilters.GetDropCount(filterIndex)
+		})
+	}
 }
 
 func main() {
 	os.Exit(mainReturnWithCode())
 }
 
-func mainReturnWithCode() int {
+func mainReturnWithCode() int {
+
+	serviceName := "udpx gateway"
+
+	log.SetService(serviceName)
+
+	core.Info("%s %s", serviceName, status.VersionString())
+
+	// configure. CONFIG_FILE is a yaml, json or env file for settings not in the environment, and the reloadable
+	// ones are read from it again on SIGHUP
+
+	configFile := envvar.Get("CONFIG_FILE", "")
+	fileConfig, err := config.Load(configFile)
+	if err != nil {
+		core.Error("invalid CONFIG_FILE: %v", err)
+		return 1
+	}
+	envvar.SetFileValues(fileConfig.Values())
+
+	configWatchInterval, err := envvar.GetDurationRange("CONFIG_WATCH_INTERVAL", 0, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid CONFIG_WATCH_INTERVAL: %v", err)
+		return 1
+	}
+
+	reloadableConfig, err := readReloadableConfig(fileConfig)
+	if err != nil {
+		core.Error("%v", err)
+		return 1
+	}
+
+	gatewayAddressConfig := envvar.Get("GATEWAY_ADDRESS", "127.0.0.1:40000")
+
+	gatewayAddress, err := core.ResolveAddress(gatewayAddressConfig)
+	if err != nil {
+		core.Error("invalid GATEWAY_ADDRESS: %v", err)
+		return 1
+	}
+
+	gatewayInternalAddress, err := core.ResolveAddress(envvar.Get("GATEWAY_INTERNAL_ADDRESS", "127.0.0.1:40001"))
+	if err != nil {
+		core.Error("invalid GATEWAY_INTERNAL_ADDRESS: %v", err)
+		return 1
+	}
+
+	balanceStrategy, err := core.ParseBalanceStrategy(envvar.Get("BALANCE_STRATEGY", "hash"))
+	if err != nil {
+		core.Error("invalid BALANCE_STRATEGY: %v", err)
+		return 1
+	}
+
+	serverPingInterval, err := envvar.GetDurationRange("SERVER_PING_INTERVAL", time.Second, time.Nanosecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SERVER_PING_INTERVAL: %v", err)
+		return 1
+	}
+
+	serverPingTimeout, err := envvar.GetDurationRange("SERVER_PING_TIMEOUT", 5*time.Second, time.Nanosecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SERVER_PING_TIMEOUT: %v", err)
+		return 1
+	}
+
+	// gateways ping each other to measure the links relayed sessions would take, and report them to the router.
+	// the gateways to ping are PING_MESH_ADDRESSES, or polled from the router when it isn't set
+
+	pingMeshAddresses, err := envvar.GetAddressList("PING_MESH_ADDRESSES", nil)
+	if err != nil {
+		core.Error("invalid PING_MESH_ADDRESSES: %v", err)
+		return 1
+	}
+
+	pingMeshInterval, err := envvar.GetDurationRange("PING_MESH_INTERVAL", time.Second, time.Millisecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid PING_MESH_INTERVAL: %v", err)
+		return 1
+	}
+
+	routerURL := strings.TrimSuffix(envvar.Get("ROUTER_URL", ""), "/")
+	routerToken := envvar.Get("ROUTER_TOKEN", "")
+
+	routerReportInterval, err := envvar.GetDurationRange("ROUTER_REPORT_INTERVAL", 10*time.Second, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid ROUTER_REPORT_INTERVAL: %v", err)
+		return 1
+	}
+
+	healthTimeout, err := envvar.GetDuration("HEALTH_CHECK_TIMEOUT", 500*time.Millisecond)
+	if err != nil {
+		core.Error("invalid HEALTH_CHECK_TIMEOUT: %v", err)
+		return 1
+	}
+
+	gatewayPrivateKey, err := envvar.GetBase64("GATEWAY_PRIVATE_KEY", nil)
+	if err != nil || len(gatewayPrivateKey) != core.PrivateKeyBytes_Box {
+		core.Error("missing or invalid GATEWAY_PRIVATE_KEY: %v", err)
+		return 1
+	}
+
+	gatewayPublicKey := core.PublicKey_Box(gatewayPrivateKey)
+
+	authPublicKey, err := envvar.GetBase64("AUTH_PUBLIC_KEY", nil)
+	if err != nil || len(authPublicKey) != core.PublicKeyBytes_Box {
+		core.Error("missing or invalid AUTH_PUBLIC_KEY: %v", err)
+		return 1
+	}
+
+	authSignPublicKey, err := envvar.GetBase64("AUTH_SIGN_PUBLIC_KEY", nil)
+	if err != nil || len(authSignPublicKey) != core.PublicKeyBytes_Sign {
+		core.Error("missing or invalid AUTH_SIGN_PUBLIC_KEY: %v", err)
+		return 1
+	}
+
+	// each thread has its own public and internal socket bound with SO_REUSEPORT, so the kernel spreads
+	// packets across them. pinning the threads keeps each one on its own cpu
+
+	numThreads, err := envvar.GetIntRange("NUM_THREADS", 1, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid NUM_THREADS: %v", err)
+		return 1
+	}
+
+	// with systemd socket activation, the sockets named udp, internal and http in the socket units are passed in
+	// and stay open across restarts, so packets queue in the kernel while the gateway restarts. there is a thread
+	// for each udp socket, so pass one per thread from socket units with ReusePort=yes. the internal sockets are
+	// shared between the threads. sockets that aren't passed in are bound as usual
+
+	activatedSockets, err := systemd.ListenSockets()
+	if err != nil {
+		core.Error("could not take socket activated sockets: %v", err)
+		return 1
+	}
+
+	activatedPublicSockets, err := activatedSockets.PacketConns("udp")
+	if err != nil {
+		core.Error("could not take socket activated udp sockets: %v", err)
+		return 1
+	}
+
+	activatedInternalSockets, err := activatedSockets.PacketConns("internal")
+	if err != nil {
+		core.Error("could not take socket activated internal sockets: %v", err)
+		return 1
+	}
+
+	activatedHTTPListener, err := activatedSockets.Listener("http")
+	if err != nil {
+		core.Error("could not take socket activated http socket: %v", err)
+		return 1
+	}
+
+	for _, name := range activatedSockets.Names() {
+		core.Warn("ignoring socket activated socket %q", name)
+	}
+	activatedSockets.Close()
+
+	if len(activatedPublicSockets) > 0 {
+		numThreads = len(activatedPublicSockets)
+	} else if numThreads > 1 && !netio.ReusePort {
+		core.Warn("NUM_THREADS is %d, but this platform can't spread packets across sockets. receiving on one socket", numThreads)
+		numThreads = 1
+	}
+
+	pinThreads, err := envvar.GetBool("PIN_THREADS", false)
+	if err != nil {
+		core.Error("invalid PIN_THREADS: %v", err)
+		return 1
+	}
+
+	readBuffer, err := envvar.GetInt("READ_BUFFER", 100000)
+	if err != nil {
+		core.Error("invalid READ_BUFFER: %v", err)
+		return 1
+	}
+
+	writeBuffer, err := envvar.GetInt("WRITE_BUFFER", 100000)
+	if err != nil {
+		core.Error("invalid WRITE_BUFFER: %v", err)
+		return 1
+	}
+
+	socketBatchSize, err := envvar.GetIntRange("SOCKET_BATCH_SIZE", netio.DefaultSocketBatchSize, 1, netio.MaxSocketBatchSize)
+	if err != nil {
+		core.Error("invalid SOCKET_BATCH_SIZE: %v", err)
+		return 1
+	}
+
+	// segmentation offload hands the kernel runs of packets as one message, and receives them coalesced.
+	// sockets fall back to a message per packet where the kernel does not support it
+
+	socketGSO, err := envvar.GetBool("SOCKET_GSO", true)
+	if err != nil {
+		core.Error("invalid SOCKET_GSO: %v", err)
+		return 1
+	}
+
+	socketGRO, err := envvar.GetBool("SOCKET_GRO", true)
+	if err != nil {
+		core.Error("invalid SOCKET_GRO: %v", err)
+		return 1
+	}
+
+	authURL := strings.TrimSuffix(envvar.Get("AUTH_URL", "http://localhost:60000"), "/")
+
+	authBearerToken := envvar.Get("AUTH_BEARER_TOKEN", "")
+
+	// packets for sessions and users revoked by the auth service are dropped once the next poll picks them up.
+	// auth only gives the revocation list to gateways with its GATEWAY_TOKEN
+
+	authGatewayToken := envvar.Get("AUTH_GATEWAY_TOKEN", "")
+
+	revocationPollInterval, err := envvar.GetDurationRange("REVOCATION_POLL_INTERVAL", 5*time.Second, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid REVOCATION_POLL_INTERVAL: %v", err)
+		return 1
+	}
+
+	// session tokens are refreshed by a fixed set of workers sharing one http client. when the queue is
+	// full the refresh is put off until the session's next packet after the cooldown
+
+	sessionTokenWorkers, err := envvar.GetIntRange("SESSION_TOKEN_WORKERS", 8, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SESSION_TOKEN_WORKERS: %v", err)
+		return 1
+	}
+
+	sessionTokenQueueSize, err := envvar.GetIntRange("SESSION_TOKEN_QUEUE_SIZE", 1024, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SESSION_TOKEN_QUEUE_SIZE: %v", err)
+		return 1
+	}
+
+	// with a delegate signing key pair the gateway extends session tokens itself instead of asking the auth
+	// service. extended tokens are signed with the delegate key, so every gateway a client can move to needs it
+
+	sessionTokenDelegatePublicKey, err := envvar.GetBase64("SESSION_TOKEN_DELEGATE_PUBLIC_KEY", nil)
+	if err != nil || (sessionTokenDelegatePublicKey != nil && len(sessionTokenDelegatePublicKey) != core.PublicKeyBytes_Sign) {
+		core.Error("invalid SESSION_TOKEN_DELEGATE_PUBLIC_KEY: %v", err)
+		return 1
+	}
+
+	sessionTokenDelegatePrivateKey, err := envvar.GetBase64("SESSION_TOKEN_DELEGATE_PRIVATE_KEY", nil)
+	if err != nil || (sessionTokenDelegatePrivateKey != nil && len(sessionTokenDelegatePrivateKey) != core.PrivateKeyBytes_Sign) {
+		core.Error("invalid SESSION_TOKEN_DELEGATE_PRIVATE_KEY: %v", err)
+		return 1
+	}
+
+	if (sessionTokenDelegatePublicKey == nil) != (sessionTokenDelegatePrivateKey == nil) {
+		core.Error("SESSION_TOKEN_DELEGATE_PUBLIC_KEY and SESSION_TOKEN_DELEGATE_PRIVATE_KEY must be set together")
+		return 1
+	}
+
+	sessionTokenSignKeys := [][]byte{authSignPublicKey}
+	if sessionTokenDelegatePublicKey != nil {
+		sessionTokenSignKeys = append(sessionTokenSignKeys, sessionTokenDelegatePublicKey)
+	}
+
+	SessionTokenDelegatePublicKey = sessionTokenDelegatePublicKey
+
+	nonceCacheSize, err := envvar.GetIntRange("NONCE_CACHE_SIZE", 100000, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid NONCE_CACHE_SIZE: %v", err)
+		return 1
+	}
+
+	rateLimitMaxAddresses, err := envvar.GetIntRange("RATE_LIMIT_MAX_ADDRESSES", 100000, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid RATE_LIMIT_MAX_ADDRESSES: %v", err)
+		return 1
+	}
+
+	// behind a load balancer speaking PROXY protocol v2, each datagram starts with a header carrying the client's
+	// real address. the packet filter and sessions use that address, and replies go back through the load balancer
+
+	proxyProtocol, err := envvar.GetBool("PROXY_PROTOCOL", false)
+	if err != nil {
+		core.Error("invalid PROXY_PROTOCOL: %v", err)
+		return 1
+	}
+
+	// packets from clients can be recorded to a capture file, and replayed against a test gateway with cmd/replay
+
+	captureFile := envvar.Get("CAPTURE_FILE", "")
+
+	captureMaxBytes, err := envvar.GetIntRange("CAPTURE_MAX_BYTES", 1024*1024*1024, capture.HeaderBytes, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid CAPTURE_MAX_BYTES: %v", err)
+		return 1
+	}
+
+	// session tokens bound to a client ip only work from that ip, or from the same network when these are lowered
+
+	tokenIPv4PrefixBits, err := envvar.GetIntRange("TOKEN_IP_PREFIX_BITS_IPV4", 32, 0, 32)
+	if err != nil {
+		core.Error("invalid TOKEN_IP_PREFIX_BITS_IPV4: %v", err)
+		return 1
+	}
+
+	tokenIPv6PrefixBits, err := envvar.GetIntRange("TOKEN_IP_PREFIX_BITS_IPV6", 64, 0, 128)
+	if err != nil {
+		core.Error("invalid TOKEN_IP_PREFIX_BITS_IPV6: %v", err)
+		return 1
+	}
+
+	sessionTimeout, err := envvar.GetDurationRange("SESSION_TIMEOUT", 60*time.Second, time.Nanosecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SESSION_TIMEOUT: %v", err)
+		return 1
+	}
+
+	maxSessions, err := envvar.GetIntRange("MAX_SESSIONS", 1000000, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid MAX_SESSIONS: %v", err)
+		return 1
+	}
+
+	filterKey, err := envvar.GetBase64("FILTER_KEY", nil)
+	if err != nil || (filterKey != nil && len(filterKey) != core.SipHashKeyBytes) {
+		core.Error("invalid FILTER_KEY: %v", err)
+		return 1
+	}
+
+	packetVersion := core.PacketVersion_FNV1a
+	if filterKey != nil {
+		packetVersion = core.PacketVersion_SipHash
+	}
+
+	accountingInterval, err := envvar.GetDurationRange("ACCOUNTING_INTERVAL", 10*time.Second, time.Nanosecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid ACCOUNTING_INTERVAL: %v", err)
+		return 1
+	}
+
+	// session start, stop and periodic stats events go to ANALYTICS_SINK, a file, pub/sub topic or kafka topic
+
+	analyticsSink := envvar.Get("ANALYTICS_SINK", "")
+
+	analyticsStatsInterval, err := envvar.GetDurationRange("ANALYTICS_STATS_INTERVAL", time.Minute, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid ANALYTICS_STATS_INTERVAL: %v", err)
+		return 1
+	}
+
+	analyticsQueueSize, err := envvar.GetIntRange("ANALYTICS_QUEUE_SIZE", 10000, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid ANALYTICS_QUEUE_SIZE: %v", err)
+		return 1
+	}
+
+	analyticsBatchSize, err := envvar.GetIntRange("ANALYTICS_BATCH_SIZE", 100, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid ANALYTICS_BATCH_SIZE: %v", err)
+		return 1
+	}
+
+	analyticsFlushInterval, err := envvar.GetDurationRange("ANALYTICS_FLUSH_INTERVAL", time.Second, time.Millisecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid ANALYTICS_FLUSH_INTERVAL: %v", err)
+		return 1
+	}
+
+	// gateway instances behind the same address share sessions through SESSION_STORE, a redis url
+
+	sessionStoreURL := envvar.Get("SESSION_STORE", "")
+
+	sessionStorePrefix := envvar.Get("SESSION_STORE_PREFIX", sessionstore.DefaultPrefix)
+
+	sessionStoreTimeout, err := envvar.GetDurationRange("SESSION_STORE_TIMEOUT", time.Second, time.Millisecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SESSION_STORE_TIMEOUT: %v", err)
+		return 1
+	}
+
+	sessionStoreInterval, err := envvar.GetDurationRange("SESSION_STORE_INTERVAL", sessionTimeout/3, time.Millisecond, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SESSION_STORE_INTERVAL: %v", err)
+		return 1
+	}
+
+	// draining gateways exit once their sessions have ended, or after DRAIN_TIMEOUT
+
+	DrainTimeout, err = envvar.GetDurationRange("DRAIN_TIMEOUT", 10*time.Minute, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid DRAIN_TIMEOUT: %v", err)
+		return 1
+	}
+
+	// kubernetes sends SIGTERM when the preStop hook returns, or straight away without one. with DRAIN_ON_SIGTERM
+	// the gateway drains on SIGTERM instead of exiting, so terminationGracePeriodSeconds should cover DRAIN_TIMEOUT
+
+	drainOnSigterm, err := envvar.GetBool("DRAIN_ON_SIGTERM", false)
+	if err != nil {
+		core.Error("invalid DRAIN_ON_SIGTERM: %v", err)
+		return 1
+	}
+
+	// on the way out, the packet threads and http requests in flight get up to SHUTDOWN_TIMEOUT to finish
+
+	shutdownTimeout, err := envvar.GetDurationRange("SHUTDOWN_TIMEOUT", 5*time.Second, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SHUTDOWN_TIMEOUT: %v", err)
+		return 1
+	}
+
+	// clients pick the fastest cipher suite for their cpu. CIPHER_SUITES defaults to every cipher suite available
+	// on this machine, in order of preference
+
+	var cipherSuites []string
+	for _, cipherSuite := range core.CipherSuites {
+		if core.CipherSuiteAvailable(cipherSuite) {
+			cipherSuites = append(cipherSuites, core.CipherSuiteName(cipherSuite))
+		}
+	}
+	cipherSuites = envvar.GetList("CIPHER_SUITES", cipherSuites)
+	for i, name := range cipherSuites {
+		cipherSuite, err := core.ParseCipherSuite(name)
+		if err != nil {
+			core.Error("invalid CIPHER_SUITES: %v", err)
+			return 1
+		}
+		if !core.CipherSuiteAvailable(cipherSuite) {
+			core.Error("invalid CIPHER_SUITES: %s is not available on this machine", core.CipherSuiteName(cipherSuite))
+			return 1
+		}
+		if i == 0 {
+			PreferredCipherSuite = cipherSuite
+		}
+		AcceptedCipherSuites[cipherSuite] = true
+		cipherSuites[i] = core.CipherSuiteName(cipherSuite)
+	}
+
+	// under attack, unknown addresses have to echo a stateless cookie before we decrypt anything they send, so
+	// spoofed packets cost one hash each. COOKIE_MODE=auto requires cookies while packets from unknown addresses
+	// arrive faster than COOKIE_PACKETS_PER_SECOND
+
+	cookieMode := strings.ToLower(envvar.Get("COOKIE_MODE", "auto"))
+	if cookieMode != "auto" && cookieMode != "on" && cookieMode != "off" {
+		core.Error("invalid COOKIE_MODE: must be auto, on or off")
+		return 1
+	}
+	CookieMode.Store(cookieMode)
+	CookiesRequired.Store(cookieMode == "on")
+
+	cookiePacketsPerSecond, err := envvar.GetIntRange("COOKIE_PACKETS_PER_SECOND", 10000, 1, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid COOKIE_PACKETS_PER_SECOND: %v", err)
+		return 1
+	}
+	CookiePacketsPerSecond = uint64(cookiePacketsPerSecond)
+
+	CookieCooldown, err = envvar.GetDurationRange("COOKIE_COOLDOWN", 30*time.Second, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid COOKIE_COOLDOWN: %v", err)
+		return 1
+	}
+
+	// the admin api listens on localhost, unless it requires client certificates signed by ADMIN_CLIENT_CA_FILE
+
+	AdminToken = envvar.Get("ADMIN_TOKEN", "")
+
+	adminAddress := envvar.Get("ADMIN_ADDRESS", "127.0.0.1:40080")
+
+	var adminTLSConfig *tls.Config
+	if adminClientCAFile := envvar.Get("ADMIN_CLIENT_CA_FILE", ""); adminClientCAFile != "" {
+		certificate, err := tls.LoadX509KeyPair(envvar.Get("ADMIN_CERT_FILE", ""), envvar.Get("ADMIN_KEY_FILE", ""))
+		if err != nil {
+			core.Error("invalid ADMIN_CERT_FILE or ADMIN_KEY_FILE: %v", err)
+			return 1
+		}
+		caData, err := os.ReadFile(adminClientCAFile)
+		if err != nil {
+			core.Error("invalid ADMIN_CLIENT_CA_FILE: %v", err)
+			return 1
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			core.Error("invalid ADMIN_CLIENT_CA_FILE: no certificates found")
+			return 1
+		}
+		adminTLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		}
+	} else if host, _, err := net.SplitHostPort(adminAddress); err != nil || net.ParseIP(host) == nil || !net.ParseIP(host).IsLoopback() {
+		core.Error("invalid ADMIN_ADDRESS: %s must be a loopback address unless ADMIN_CLIENT_CA_FILE is set", adminAddress)
+		return 1
+	}
+
+	bandwidthLimitUpKbps, err := envvar.GetFloat("BANDWIDTH_LIMIT_UP_KBPS", 0)
+	if err != nil || bandwidthLimitUpKbps < 0 {
+		core.Error("invalid BANDWIDTH_LIMIT_UP_KBPS: %v", err)
+		return 1
+	}
+
+	bandwidthLimitDownKbps, err := envvar.GetFloat("BANDWIDTH_LIMIT_DOWN_KBPS", 0)
+	if err != nil || bandwidthLimitDownKbps < 0 {
+		core.Error("invalid BANDWIDTH_LIMIT_DOWN_KBPS: %v", err)
+		return 1
+	}
+
+	bandwidthLimitBurst, err := envvar.GetDuration("BANDWIDTH_LIMIT_BURST", 250*time.Millisecond)
+	if err != nil {
+		core.Error("invalid BANDWIDTH_LIMIT_BURST: %v", err)
+		return 1
+	}
+
+	// packets over the limit are dropped, or marked and forwarded so the receiver can deprioritize them
+
+	bandwidthLimitMode := envvar.Get("BANDWIDTH_LIMIT_MODE", "drop")
+	if bandwidthLimitMode != "drop" && bandwidthLimitMode != "mark" {
+		core.Error("invalid BANDWIDTH_LIMIT_MODE: %s", bandwidthLimitMode)
+		return 1
+	}
+	markOverBandwidth := bandwidthLimitMode == "mark"
+
+	// packets to each client are paced at this rate, so bursts from the server are spread out over up to
+	// one rtt instead of overflowing the client's router
+
+	pacingKbps, err := envvar.GetFloat("PACING_KBPS", 0)
+	if err != nil || pacingKbps < 0 {
+		core.Error("invalid PACING_KBPS: %v", err)
+		return 1
+	}
+
+	// packets to clients are tagged with a dscp for their priority, eg. "AF41,high=EF", for networks that
+	// honor diffserv. servers set the priority of each packet they send
+
+	dscp, err := core.ParseDSCPConfig(envvar.Get("DSCP", ""))
+	if err != nil {
+		core.Error("invalid DSCP: %v", err)
+		return 1
+	}
+
+	// browsers reach the gateway with webtransport datagrams, and clients in quic or dtls mode over those.
+	// without a configured certificate, a short lived self-signed one is used, which browsers accept given
+	// its hash from /webtransport/certificate_hash. quic clients don't verify the certificate, and dtls
+	// clients only do when given the gateway's server name
+
+	webTransportPort := envvar.Get("WEBTRANSPORT_PORT", "")
+	quicPort := envvar.Get("QUIC_PORT", "")
+	dtlsPort := envvar.Get("DTLS_PORT", "")
+
+	var tlsConfig *tls.Config
+	var selfSignedCertificate *SelfSignedCertificate
+
+	if webTransportPort != "" || quicPort != "" || dtlsPort != "" {
+		certFile := envvar.Get("TLS_CERT_FILE", "")
+		keyFile := envvar.Get("TLS_KEY_FILE", "")
+		if certFile != "" || keyFile != "" {
+			certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				core.Error("invalid TLS_CERT_FILE or TLS_KEY_FILE: %v", err)
+				return 1
+			}
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		} else {
+			selfSignedCertificate = &SelfSignedCertificate{}
+			if _, _, err := selfSignedCertificate.Get(); err != nil {
+				core.Error("could not generate certificate: %v", err)
+				return 1
+			}
+			tlsConfig = &tls.Config{
+				GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+					certificate, _, err := selfSignedCertificate.Get()
+					return certificate, err
+				},
+			}
+		}
+	}
+
+	udpPort := envvar.Get("UDP_PORT", "40000")
+
+	if filterKey != nil {
+		FilterKeys = core.CreateFilterKeyRing(filterKey)
+	}
+
+	// the configuration as the admin api shows it. keys and tokens are left out
+
+	AdminConfig.Store(&map[string]interface{}{
+		"gateway_address":           gatewayAddress.String(),
+		"gateway_internal_address":  gatewayInternalAddress.String(),
+		"udp_port":                  udpPort,
+		"balance_strategy":          balanceStrategy.Name(),
+		"server_ping_interval":      serverPingInterval.String(),
+		"server_ping_timeout":       serverPingTimeout.String(),
+		"ping_mesh_interval":        pingMeshInterval.String(),
+		"router_url":                routerURL,
+		"router_report_interval":    routerReportInterval.String(),
+		"num_threads":               numThreads,
+		"pin_threads":               pinThreads,
+		"read_buffer":               readBuffer,
+		"write_buffer":              writeBuffer,
+		"socket_batch_size":         socketBatchSize,
+		"auth_url":                  authURL,
+		"revocation_poll_interval":  revocationPollInterval.String(),
+		"session_token_workers":     sessionTokenWorkers,
+		"session_token_queue_size":  sessionTokenQueueSize,
+		"session_token_delegate":    sessionTokenDelegatePrivateKey != nil,
+		"nonce_cache_size":          nonceCacheSize,
+		"rate_limit_max_addresses":  rateLimitMaxAddresses,
+		"proxy_protocol":            proxyProtocol,
+		"capture_file":              captureFile,
+		"token_ip_prefix_bits_ipv4": tokenIPv4PrefixBits,
+		"token_ip_prefix_bits_ipv6": tokenIPv6PrefixBits,
+		"session_timeout":           sessionTimeout.String(),
+		"max_sessions":              maxSessions,
+		"filter_key":                filterKey != nil,
+		"accounting_interval":       accountingInterval.String(),
+		"analytics_sink":            strings.SplitN(analyticsSink, "?", 2)[0],
+		"analytics_stats_interval":  analyticsStatsInterval.String(),
+		"analytics_batch_size":      analyticsBatchSize,
+		"session_store":             sessionStoreURL != "",
+		"session_store_prefix":      sessionStorePrefix,
+		"session_store_interval":    sessionStoreInterval.String(),
+		"drain_timeout":             DrainTimeout.String(),
+		"drain_on_sigterm":          drainOnSigterm,
+		"shutdown_timeout":          shutdownTimeout.String(),
+		"cipher_suites":             cipherSuites,
+		"cookie_mode":               cookieMode,
+		"cookie_packets_per_second": cookiePacketsPerSecond,
+		"cookie_cooldown":           CookieCooldown.String(),
+		"bandwidth_limit_up_kbps":   bandwidthLimitUpKbps,
+		"bandwidth_limit_down_kbps": bandwidthLimitDownKbps,
+		"bandwidth_limit_burst":     bandwidthLimitBurst.String(),
+		"bandwidth_limit_mode":      bandwidthLimitMode,
+		"pacing_kbps":               pacingKbps,
+		"dscp":                      dscp.String(),
+		"webtransport_port":         webTransportPort,
+		"quic_port":                 quicPort,
+		"dtls_port":                 dtlsPort,
+		"config_file":               configFile,
+		"config_watch_interval":     configWatchInterval.String(),
+	})
+
+	core.Info("starting gateway on port %s", udpPort)
+
+	core.Info("accepting cipher suites: %s", strings.Join(cipherSuites, ", "))
+
+	if numThreads > 1 {
+		core.Info("receiving on %d sockets (pinned to cpus: %v)", numThreads, pinThreads)
+	}
+
+	gatewayId := core.RandomBytes(core.GatewayIdBytes)
+
+	challengePrivateKey := core.Keygen_SecretBox()
+
+	// instances sharing sessions also share their gateway id and challenge key, so their packets are interchangeable
+
+	var sessionStoreClient *redis.Client
+	if sessionStoreURL != "" {
+		client, err := redis.CreateClient(sessionStoreURL, SessionLookupWorkers+2, sessionStoreTimeout)
+		if err != nil {
+			core.Error("invalid SESSION_STORE: %v", err)
+			return 1
+		}
+		defer client.Close()
+		sessionStoreClient = client
+		SessionStore = sessionstore.CreateStore(client, sessionStorePrefix, sessionTimeout)
+		identity, err := SessionStore.SharedIdentity(gatewayAddress.String(), sessionstore.Identity{GatewayId: gatewayId, ChallengeKey: challengePrivateKey})
+		if err != nil {
+			core.Error("could not get gateway identity from session store: %v", err)
+			return 1
+		}
+		gatewayId = identity.GatewayId
+		challengePrivateKey = identity.ChallengeKey
+		core.Info("sharing sessions through session store at %s", client.GetAddress())
+	}
+
+	core.Info("gateway id is %s", core.IdString(gatewayId))
+
+	nonceCache := core.CreateNonceCache(nonceCacheSize)
+
+	RateLimiter = core.CreateRateLimiter(reloadableConfig.RateLimitPacketsPerSecond, reloadableConfig.RateLimitBurst, rateLimitMaxAddresses)
+
+	ServerPool = core.CreateServerPool(reloadableConfig.ServerAddresses, balanceStrategy, time.Now())
+
+	for i := 0; i < ServerPool.GetNumServers(); i++ {
+		core.Info("forwarding to server %s", ServerPool.GetAddress(i))
+		registerServerMetrics(i)
+	}
+
+	core.Info("balancing sessions with %s strategy", balanceStrategy.Name())
+
+	if len(pingMeshAddresses) > 0 || routerURL != "" {
+		PingMesh = core.CreatePingMesh(gatewayAddress, pingMeshAddresses)
+	}
+
+	applyReloadableConfig(reloadableConfig)
+
+	Status.SetDetails(statusDetails)
+
+	if analyticsSink != "" {
+		sink, err := analytics.ParseSink(analyticsSink)
+		if err != nil {
+			core.Error("invalid ANALYTICS_SINK: %v", err)
+			return 1
+		}
+		Analytics = analytics.CreatePublisher(sink, analyticsQueueSize, analyticsBatchSize, analyticsFlushInterval)
+		defer func() {
+			for _, table := range SessionTables {
+				table.ForEach(func(sessionId [core.SessionIdBytes]byte, value interface{}) {
+					publishSessionEvent(analytics.SessionStopEvent, value.(*SessionEntry), gatewayAddress, "shutdown")
+				})
+			}
+			if err := Analytics.Close(); err != nil {
+				core.Error("could not close analytics sink: %v", err)
+			}
+			published, dropped, failed := Analytics.GetStats()
+			core.Info("published %d analytics events, %d dropped, %d failed", published, dropped, failed)
+		}()
+		core.Info("publishing session analytics to %s", strings.SplitN(analyticsSink, "?", 2)[0])
+	}
+
+	// session handshakes and token refreshes are traced when OTEL_EXPORTER_OTLP_ENDPOINT is set. the spans join
+	// the session's trace, which auth started when it issued the connect token
+
+	stopTracing, err := tracing.Start(serviceName)
+	if err != nil {
+		core.Error("invalid tracing config: %v", err)
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := stopTracing(ctx); err != nil {
+			core.Error("could not flush traces: %v", err)
+		}
+	}()
+
+	// each thread has its own session table, so sessions are only contended with the sweep
+
+	SessionTables = make([]*core.SessionTable, numThreads)
+	for i := range SessionTables {
+		SessionTables[i] = core.CreateSessionTable(sessionTimeout, (maxSessions+numThreads-1)/numThreads)
+		SessionTables[i].SetRemoveCallback(func(value interface{}) {
+			sessionEntry := value.(*SessionEntry)
+			ServerPool.Release(sessionEntry.ServerIndex)
+			tenantSessions(sessionEntry.TenantId).Add(-1)
+			UsageAccounting.SessionEnded(sessionEntry.UserId, sessionEntry.Usage.Get())
+			if Analytics != nil {
+				reason, _ := sessionEntry.EndReason.Load().(string)
+				if reason == "" {
+					reason = "expired"
+				}
+				publishSessionEvent(analytics.SessionStopEvent, sessionEntry, gatewayAddress, reason)
+			}
+			// sessions that time out here may have moved to another instance, so only sessions that have ended are deleted
+			if SessionStore != nil {
+				if reason, _ := sessionEntry.EndReason.Load().(string); reason == "disconnect" || reason == "kicked" {
+					go func() {
+						if err := SessionStore.Delete(sessionEntry.SessionId[:]); err != nil {
+							SessionStoreFailures.Inc()
+							SessionStoreLog.Error("could not delete session from session store: %v", err)
+						}
+					}()
+				}
+			}
+		})
+	}
+
+	RouteTable = core.CreateSessionTable(sessionTimeout, maxSessions)
+
+	pingConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		core.Error("could not create server ping socket: %v", err)
+		return 1
+	}
+
+	ctx, ctxCancelFunc := context.WithCancel(context.Background())
+
+	var captureWriter *capture.Writer
+	if captureFile != "" {
+		captureWriter, err = capture.Create(captureFile, gatewayAddress, int64(captureMaxBytes))
+		if err != nil {
+			core.Error("could not create capture file: %v", err)
+			ctxCancelFunc()
+			return 1
+		}
+		core.Info("capturing packets from clients to %s", captureFile)
+		defer func() {
+			if err := captureWriter.Close(); err != nil {
+				core.Error("could not write capture file: %v", err)
+			}
+			packets, dropped := captureWriter.GetStats()
+			core.Info("captured %d packets to %s, %d not captured", packets, captureFile, dropped)
+		}()
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := captureWriter.Flush(); err != nil {
+						core.Error("could not write capture file: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(SessionSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case currentTime := <-ticker.C:
+				for _, table := range SessionTables {
+					if expired := table.Expire(currentTime); expired > 0 {
+						core.Debug("expired %d idle sessions", expired)
+					}
+				}
+				if expired := RouteTable.Expire(currentTime); expired > 0 {
+					core.Debug("expired %d idle routes", expired)
+				}
+			}
+		}
+	}()
+
+	// aggregate session usage for the admin api
+
+	go func() {
+		ticker := time.NewTicker(accountingInterval)
+		defer ticker.Stop()
+		UsageAccounting.Aggregate(time.Now())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case currentTime := <-ticker.C:
+				for _, table := range SessionTables {
+					table.ForEach(func(sessionId [core.SessionIdBytes]byte, value interface{}) {
+						sessionEntry := value.(*SessionEntry)
+						UsageAccounting.AddSession(sessionId, sessionEntry.UserId, sessionEntry.Usage.Get())
+					})
+				}
+				UsageAccounting.Aggregate(currentTime)
+			}
+		}
+	}()
+
+	// publish periodic stats for each session
+
+	if Analytics != nil && analyticsStatsInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(analyticsStatsInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					for _, table := range SessionTables {
+						table.ForEach(func(sessionId [core.SessionIdBytes]byte, value interface{}) {
+							publishSessionEvent(analytics.SessionStatsEvent, value.(*SessionEntry), gatewayAddress, "")
+						})
+					}
+				}
+			}
+		}()
+	}
+
+	// look up sessions this instance doesn't have in the session store, and keep the sessions it has there
+	// from expiring. Sessions no packets have been received for since they were last stored are left to
+	// expire, since they may have moved to another instance
+
+	if SessionStore != nil {
+		SessionLookupQueue = make(chan *SessionLookup, SessionLookupQueueSize)
+		for i := 0; i < SessionLookupWorkers; i++ {
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case lookup := <-SessionLookupQueue:
+						record, err := SessionStore.Get(lookup.SessionId[:])
+						if err != nil {
+							SessionStoreFailures.Inc()
+							SessionStoreLog.Error("could not look up session in session store: %v", err)
+						}
+						lookup.Record = record
+						lookup.Done.Store(true)
+					}
+				}
+			}()
+		}
+		go func() {
+			ticker := time.NewTicker(sessionStoreInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					records := make(map[[core.SessionIdBytes]byte]sessionstore.Record)
+					for _, table := range SessionTables {
+						table.ForEach(func(sessionId [core.SessionIdBytes]byte, value interface{}) {
+							sessionEntry := value.(*SessionEntry)
+							record := storeRecord(sessionEntry)
+							if record.Sequence > sessionEntry.StoredSequence {
+								records[sessionId] = record
+								sessionEntry.StoredSequence = record.Sequence
+							}
+						})
+					}
+					for len(records) > 0 {
+						batch := make(map[[core.SessionIdBytes]byte]sessionstore.Record)
+						for sessionId, record := range records {
+							batch[sessionId] = record
+							delete(records, sessionId)
+							if len(batch) == SessionStoreBatchSize {
+								break
+							}
+						}
+						if err := SessionStore.Put(batch); err != nil {
+							SessionStoreFailures.Inc()
+							SessionStoreLog.Error("could not store sessions: %v", err)
+						}
+					}
+					currentTime := time.Now()
+					SessionLookups.Range(func(key interface{}, value interface{}) bool {
+						if currentTime.Sub(value.(*SessionLookup).CreateTime) > SessionLookupExpiry {
+							SessionLookups.Delete(key)
+						}
+						return true
+					})
+				}
+			}
+		}()
+	}
+
+	// ping servers so sessions are only sent to servers that are up
+
+	go func() {
+		buffer := [MaxPacketSize]byte{}
+		for {
+			packetBytes, from, err := pingConn.ReadFromUDP(buffer[:])
+			if err != nil {
+				break
+			}
+			if packetBytes != core.ServerPingPacketBytes || buffer[0] != 0 || buffer[1] != core.ServerPongPacket {
+				core.Debug("unexpected %d byte packet on server ping socket from %s", packetBytes, from)
+				continue
+			}
+			ServerPool.ReceivedPong(from, time.Now())
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(serverPingInterval)
+		defer ticker.Stop()
+		defer pingConn.Close()
+		sequence := uint64(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case currentTime := <-ticker.C:
+				for _, i := range ServerPool.UpdateHealth(currentTime, serverPingTimeout) {
+					if ServerPool.IsHealthy(i) {
+						core.Info("server %s is healthy", ServerPool.GetAddress(i))
+					} else {
+						core.Error("server %s is not responding to pings", ServerPool.GetAddress(i))
+					}
+				}
+				pingData := make([]byte, core.ServerPingPacketBytes)
+				index := 0
+				core.WriteUint8(pingData, &index, 0)
+				core.WriteUint8(pingData, &index, core.ServerPingPacket)
+				core.WriteUint64(pingData, &index, sequence)
+				sequence++
+				for i := 0; i < ServerPool.GetNumServers(); i++ {
+					if _, err := pingConn.WriteToUDP(pingData, ServerPool.GetAddress(i)); err != nil {
+						core.Debug("failed to ping server %s: %v", ServerPool.GetAddress(i), err)
+					}
+				}
+			}
+		}
+	}()
+
+	// refresh session tokens with the auth service
+
+	sessionTokenRequests := make(chan SessionTokenRequest, sessionTokenQueueSize)
+
+	sessionTokenClient := &http.Client{
+		Timeout: time.Second,
+		Transport: tracing.Transport(&http.Transport{
+			Dial: (&net.Dialer{
+				Timeout: time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: time.Second,
+			MaxIdleConnsPerHost: sessionTokenWorkers,
+		}),
+	}
+
+	for i := 0; i < sessionTokenWorkers; i++ {
+		go func() {
+			for request := range sessionTokenRequests {
+				var update SessionTokenUpdate
+				switch {
+				case sessionTokenDelegatePrivateKey != nil && request.Tenant != nil:
+					update = extendSessionToken(request.SessionTokenData, request.Tenant.SessionTokenSignKeys, sessionTokenDelegatePrivateKey)
+				case sessionTokenDelegatePrivateKey != nil:
+					update = extendSessionToken(request.SessionTokenData, sessionTokenSignKeys, sessionTokenDelegatePrivateKey)
+				case request.Tenant != nil:
+					update = refreshSessionToken(tracing.SessionContext(ctx, request.SessionId[:]), sessionTokenClient, request.Tenant.AuthURL, request.Tenant.AuthBearerToken, request.SessionTokenData, request.Tenant.AuthSignPublicKeys)
+				default:
+					update = refreshSessionToken(tracing.SessionContext(ctx, request.SessionId[:]), sessionTokenClient, authURL, authBearerToken, request.SessionTokenData, [][]byte{authSignPublicKey})
+				}
+
+				// the auth service and the delegate key sign session tokens. the gateway encrypts them to itself
+				// before they go back to the client
+
+				if len(update.SessionTokenData) != 0 {
+					encryptedSessionTokenData := make([]byte, core.EncryptedSessionTokenBytes)
+					core.EncryptSessionToken(update.SessionTokenData, encryptedSessionTokenData, gatewayPublicKey)
+					update.SessionTokenData = encryptedSessionTokenData
+				}
+
+				request.Channel <- update
+			}
+		}()
+	}
+
+	if revocationPollInterval > 0 && authGatewayToken == "" {
+		core.Info("AUTH_GATEWAY_TOKEN is not set. revocations will not be polled")
+	} else if revocationPollInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(revocationPollInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := pollRevocations(sessionTokenClient, authURL, authGatewayToken); err != nil {
+						core.Debug("failed to poll revocations: %v", err)
+						RevocationPollFailures.Inc()
+					}
+				}
+			}
+		}()
+	}
+
+	// /ready fails while draining or when a check fails, so load balancers and kubernetes stop sending new
+	// clients here. /health is the same as /ready, and /live only checks the gateway is answering
+
+	HealthChecks = health.CreateChecks(healthTimeout)
+	HealthChecks.Add("draining", func() error {
+		if DrainStartTime.Load() != 0 {
+			return fmt.Errorf("draining: %d sessions and %d routes left", activeSessions(), RouteTable.GetCount())
+		}
+		return nil
+	})
+	HealthChecks.Add("keys", func() error {
+		if bytes.Equal(gatewayPrivateKey, make([]byte, len(gatewayPrivateKey))) {
+			return fmt.Errorf("GATEWAY_PRIVATE_KEY is not loaded")
+		}
+		if len(sessionTokenSignKeys) == 0 {
+			return fmt.Errorf("AUTH_SIGN_PUBLIC_KEY is not loaded")
+		}
+		return nil
+	})
+	HealthChecks.Add("gateway_address", func() error {
+		_, err := core.ResolveAddress(gatewayAddressConfig)
+		return err
+	})
+	if sessionStoreClient != nil {
+		HealthChecks.Add("session_store", func() error {
+			_, err := sessionStoreClient.Do("PING")
+			return err
+		})
+	}
+
+	var wg sync.WaitGroup
+
+	var httpServer *http.Server
+
+	// --------------------------------------------------
+
+	// Start HTTP server
+	{
+		router := mux.NewRouter()
+		router.HandleFunc("/health", HealthChecks.ReadyHandler).Methods("GET")
+		router.HandleFunc("/ready", HealthChecks.ReadyHandler).Methods("GET")
+		router.HandleFunc("/live", health.LiveHandler).Methods("GET")
+		router.Handle("/status", Status).Methods("GET")
+		router.Handle("/metrics", Metrics).Methods("GET")
+		if selfSignedCertificate != nil {
+			router.HandleFunc("/webtransport/certificate_hash", certificateHashHandler(selfSignedCertificate)).Methods("GET")
+		}
+
+		httpPort := envvar.Get("HTTP_PORT", "40000")
+
+		httpServer = &http.Server{
+			Addr:    ":" + httpPort,
+			Handler: router,
+		}
+
+		go func() {
+			var err error
+			if activatedHTTPListener != nil {
+				core.Info("serving http on socket activated %s", activatedHTTPListener.Addr())
+				err = httpServer.Serve(activatedHTTPListener)
+			} else {
+				core.Debug("started http server on port %s", httpPort)
+				err = httpServer.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				core.Error("failed to start http server: %v", err)
+				return
+			}
+		}()
+	}
+
+	// --------------------------------------------------
+
+	// Start admin server
+
+	adminServer := startAdminServer(adminAddress, adminTLSConfig)
+
+	// --------------------------------------------------
+
+	// clients on networks that block udp fall back to tunnelling packets over a websocket. each websocket
+	// gets its own loopback socket, so its packets arrive on the public socket like any other client's
+
+	if websocketPort := envvar.Get("WEBSOCKET_PORT", ""); websocketPort != "" {
+
+		srv := &http.Server{
+			Addr:    ":" + websocketPort,
+			Handler: websocketHandler(core.ParseAddress("127.0.0.1:" + udpPort)),
+		}
+
+		go func() {
+			core.Info("started websocket server on port %s", websocketPort)
+			err := srv.ListenAndServe()
+			if err != nil {
+				core.Error("failed to start websocket server: %v", err)
+				return
+			}
+		}()
+	}
+
+	if webTransportPort != "" {
+
+		// the packets carry their own authentication, so webtransport sessions are accepted from pages on any origin
+
+		srv := &webtransport.Server{
+			H3: &http3.Server{
+				Addr:      ":" + webTransportPort,
+				TLSConfig: http3.ConfigureTLSConfig(tlsConfig.Clone()),
+			},
+			CheckOrigin: func(r *http.Request) bool { return true },
+		}
+		srv.H3.Handler = webTransportHandler(srv, core.ParseAddress("127.0.0.1:"+udpPort))
+		webtransport.ConfigureHTTP3Server(srv.H3)
+
+		go func() {
+			core.Info("started webtransport server on port %s", webTransportPort)
+			err := srv.ListenAndServe()
+			if err != nil {
+				core.Error("failed to start webtransport server: %v", err)
+				return
+			}
+		}()
+	}
+
+	// clients behind middleboxes that mangle bare udp can carry their packets in quic datagrams instead.
+	// like websockets, each connection gets its own loopback socket
+
+	if quicPort != "" {
+
+		quicTLSConfig := tlsConfig.Clone()
+		quicTLSConfig.NextProtos = []string{tunnel.Protocol}
+
+		go func() {
+			listener, err := quic.ListenAddr(":"+quicPort, quicTLSConfig, tunnel.Config())
+			if err != nil {
+				core.Error("failed to start quic server: %v", err)
+				return
+			}
+			core.Info("started quic server on port %s", quicPort)
+			for {
+				conn, err := listener.Accept(context.Background())
+				if err != nil {
+					core.Error("failed to accept quic connection: %v", err)
+					return
+				}
+				go relayQUICConnection(conn, core.ParseAddress("127.0.0.1:"+udpPort))
+			}
+		}()
+	}
+
+	if dtlsPort != "" {
+
+		getCertificate := func() (*tls.Certificate, error) {
+			if selfSignedCertificate != nil {
+				certificate, _, err := selfSignedCertificate.Get()
+				return certificate, err
+			}
+			return &tlsConfig.Certificates[0], nil
+		}
+
+		go func() {
+			listener, err := tunnel.ListenDTLS(":"+dtlsPort, getCertificate)
+			if err != nil {
+				core.Error("failed to start dtls server: %v", err)
+				return
+			}
+			core.Info("started dtls server on port %s", dtlsPort)
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					core.Error("failed to accept dtls connection: %v", err)
+					return
+				}
+				go relayDTLSConnection(conn, core.ParseAddress("127.0.0.1:"+udpPort))
+			}
+		}()
+	}
+
+	// --------------------------------------------------
+
+	// listen on public address
+
+	wg.Add(numThreads)
+
+	publicSocket := make([]*net.UDPConn, numThreads)
+
+	packetConfig := PacketConfig{
+		PublicSockets:            publicSocket,
+		ActivatedInternalSockets: activatedInternalSockets,
+		GatewayAddress:           gatewayAddress,
+		GatewayInternalAddress:   gatewayInternalAddress,
+		GatewayId:                gatewayId,
+		GatewayPrivateKey:        gatewayPrivateKey,
+		AuthPublicKey:            authPublicKey,
+		ChallengePrivateKey:      challengePrivateKey,
+		SessionTokenSignKeys:     sessionTokenSignKeys,
+		PacketVersion:            packetVersion,
+		PinThreads:               pinThreads,
+		ReadBuffer:               readBuffer,
+		WriteBuffer:              writeBuffer,
+		SocketBatchSize:          socketBatchSize,
+		SocketGSO:                socketGSO,
+		SocketGRO:                socketGRO,
+		ProxyProtocol:            proxyProtocol,
+		TokenIPv4PrefixBits:      tokenIPv4PrefixBits,
+		TokenIPv6PrefixBits:      tokenIPv6PrefixBits,
+		BandwidthLimitUpKbps:     bandwidthLimitUpKbps,
+		BandwidthLimitDownKbps:   bandwidthLimitDownKbps,
+		BandwidthLimitBurst:      bandwidthLimitBurst,
+		MarkOverBandwidth:        markOverBandwidth,
+		PacingKbps:               pacingKbps,
+		DSCP:                     dscp,
+		NonceCache:               nonceCache,
+		CaptureWriter:            captureWriter,
+		SessionTokenRequests:     sessionTokenRequests,
+	}
+
+	{
+		if len(activatedPublicSockets) > 0 {
+			core.Info("receiving packets on %d socket activated sockets at %s", len(activatedPublicSockets), activatedPublicSockets[0].LocalAddr())
+		}
+
+		for i := 0; i < numThreads; i++ {
+
+			var conn *net.UDPConn
+
+			if len(activatedPublicSockets) > 0 {
+				conn = activatedPublicSockets[i]
+			} else {
+				var err error
+				conn, err = netio.ListenUDP(ctx, ":"+udpPort)
+				if err != nil {
+					panic(fmt.Sprintf("could not bind socket: %v", err))
+				}
+			}
+
+			if err := conn.SetReadBuffer(readBuffer); err != nil {
+				panic(fmt.Sprintf("could not set connection read buffer size: %v", err))
+			}
+
+			if err := conn.SetWriteBuffer(writeBuffer); err != nil {
+				panic(fmt.Sprintf("could not set connection write buffer size: %v", err))
+			}
+
+			if dscp.Enabled() {
+				if err := core.SetDSCP(conn, dscp[core.PriorityNormal]); err != nil {
+					panic(fmt.Sprintf("could not set dscp: %v", err))
+				}
+			}
+
+			publicSocket[i] = conn
+		}
+
+		for i := 0; i < numThreads; i++ {
+
+			go func(thread int) {
+				processClientPackets(ctx, &packetConfig, thread)
+				wg.Done()
+			}(i)
+		}
+	}
+
+	// -----------------------------------------------------------------
+
+	// ping the other gateways from the public socket, so the pings take the same path as relayed packets
+
+	if PingMesh != nil {
+
+		core.Info("pinging other gateways every %s", pingMeshInterval)
+
+		go func() {
+			ticker := time.NewTicker(pingMeshInterval)
+			defer ticker.Stop()
+			sequence := uint64(0)
+			pingData := make([]byte, core.GatewayPingPacketBytes)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case currentTime := <-ticker.C:
+					var filterKey []byte
+					if FilterKeys != nil {
+						filterKey, _ = FilterKeys.Get(currentTime)
+					}
+					for _, peer := range PingMesh.GetPeers() {
+						core.WriteGatewayPingPacket(pingData, packetVersion, core.GatewayPingPacket, sequence, filterKey, gatewayAddress, peer)
+						PingMesh.PingSent(peer, sequence, currentTime)
+						if _, err := publicSocket[0].WriteToUDP(pingData, peer); err != nil {
+							core.Debug("failed to ping gateway %s: %v", peer, err)
+							continue
+						}
+						GatewayPingsSent.Inc()
+					}
+					sequence++
+				}
+			}
+		}()
+	}
+
+	// watch the rate of packets from unknown addresses, to require cookies in auto mode
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var lastAttackTime time.Time
+		lastPackets := UnknownSourcePackets.Get()
+		lastTime := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case currentTime := <-ticker.C:
+				packets := UnknownSourcePackets.Get()
+				packetsPerSecond := uint64(float64(packets-lastPackets) / currentTime.Sub(lastTime).Seconds())
+				lastPackets, lastTime = packets, currentTime
+				updateCookiesRequired(packetsPerSecond, &lastAttackTime, currentTime)
+			}
+		}
+	}()
+
+	// report the ping mesh to the router, and get the gateways to ping from it
+
+	if PingMesh != nil && routerURL != "" {
+
+		core.Info("reporting the ping mesh to the router at %s every %s", routerURL, routerReportInterval)
+
+		routerClient := &http.Client{Timeout: time.Second}
+
+		go func() {
+			ticker := time.NewTicker(routerReportInterval)
+			defer ticker.Stop()
+			for {
+				if len(pingMeshAddresses) == 0 {
+					if err := pollMeshPeers(routerClient, routerURL, routerToken); err != nil {
+						core.Debug("failed to poll router gateways: %v", err)
+						PingMeshReportFailures.Inc()
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := reportPingMesh(routerClient, routerURL, routerToken, gatewayAddress); err != nil {
+						core.Debug("failed to report ping mesh: %v", err)
+						PingMeshReportFailures.Inc()
+					}
+				}
+			}
+		}()
+	}
+
+	// -----------------------------------------------------------------
+
+	// listen on internal address
+
+	wg.Add(numThreads)
+
+	{
+		for i := 0; i < numThreads; i++ {
+
+			go func(thread int) {
+				processServerPackets(ctx, &packetConfig, thread)
+				wg.Done()
+			}(i)
+		}
+	}
+
+	// -----------------------------------------------------------------
+
+	// reload the server pool, rate limits, blocklist and log level on SIGHUP, or when CONFIG_FILE changes
+
+	go func() {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		var watchChan <-chan time.Time
+		var configModTime time.Time
+		if configFile != "" && configWatchInterval > 0 {
+			ticker := time.NewTicker(configWatchInterval)
+			defer ticker.Stop()
+			watchChan = ticker.C
+			if info, err := os.Stat(configFile); err == nil {
+				configModTime = info.ModTime()
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupChan:
+			case <-watchChan:
+				info, err := os.Stat(configFile)
+				if err != nil || info.ModTime().Equal(configModTime) {
+					continue
+				}
+				configModTime = info.ModTime()
+			}
+			if err := reloadConfig(configFile); err != nil {
+				core.Error("could not reload configuration: %v", err)
+				ConfigReloadFailures.Inc()
+				continue
+			}
+			ConfigReloads.Inc()
+		}
+	}()
+
+	// drain on SIGUSR1, and exit once the sessions and routes are gone or DRAIN_TIMEOUT has passed
+
+	go func() {
+		usr1Chan := make(chan os.Signal, 1)
+		if core.DrainSignal != nil {
+			signal.Notify(usr1Chan, core.DrainSignal)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-usr1Chan:
+			startDrain()
+		case <-DrainChannel:
+		}
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		reportTime := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			sessions, routes := activeSessions(), RouteTable.GetCount()
+			elapsed := time.Since(time.Unix(0, DrainStartTime.Load()))
+			if sessions == 0 && routes == 0 {
+				core.Info("drained in %s", elapsed.Round(time.Millisecond))
+				close(DrainedChannel)
+				return
+			}
+			if DrainTimeout > 0 && elapsed >= DrainTimeout {
+				core.Info("drain timed out after %s with %d sessions and %d routes left", DrainTimeout, sessions, routes)
+				close(DrainedChannel)
+				return
+			}
+			if time.Since(reportTime) >= DrainReportInterval {
+				core.Info("draining: %d sessions and %d routes left", sessions, routes)
+				reportTime = time.Now()
+			}
+		}
+	}()
+
+	// with DRAIN_ON_SIGTERM, SIGTERM drains like SIGUSR1. another signal while draining exits straight away
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-termChan:
+		if sig == syscall.SIGTERM && drainOnSigterm {
+			startDrain()
+			select {
+			case <-termChan:
+			case <-DrainedChannel:
+			}
+		}
+	case <-DrainedChannel:
+	}
+
+	fmt.Println("\nshutting down")
+
+	// cancelling the context closes the sockets, so the packet threads forward what they have read and exit.
+	// the http servers finish their requests, so a preStop hook waiting on the drain gets its answer
+
+	ctxCancelFunc()
+
+	shutdownContext, shutdownCancelFunc := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancelFunc()
+
+	for _, srv := range []*http.Server{httpServer, adminServer} {
+		if srv != nil {
+			srv.Shutdown(shutdownContext)
+		}
+	}
+
+	threadsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(threadsDone)
+	}()
+
+	select {
+	case <-threadsDone:
+	case <-shutdownContext.Done():
+		core.Error("packet threads did not stop within %s", shutdownTimeout)
+	}
+
+	fmt.Println("shutdown completed")
+
+	return 0
+}
+
+// PacketConfig is what the packet loops need from the environment. It is read once at startup and shared by
+// every thread, so nothing in it changes while the gateway runs; settings that reload live in ReloadableConfig.
+type PacketConfig struct {
+	PublicSockets            []*net.UDPConn
+	ActivatedInternalSockets []*net.UDPConn
+	GatewayAddress           *net.UDPAddr
+	GatewayInternalAddress   *net.UDPAddr
+	GatewayId                []byte
+	GatewayPrivateKey        []byte
+	AuthPublicKey            []byte
+	ChallengePrivateKey      []byte
+	SessionTokenSignKeys     [][]byte
+	PacketVersion            byte
+	PinThreads               bool
+	ReadBuffer               int
+	WriteBuffer              int
+	SocketBatchSize          int
+	SocketGSO                bool
+	SocketGRO                bool
+	ProxyProtocol            bool
+	TokenIPv4PrefixBits      int
+	TokenIPv6PrefixBits      int
+	BandwidthLimitUpKbps     float64
+	BandwidthLimitDownKbps   float64
+	BandwidthLimitBurst      time.Duration
+	MarkOverBandwidth        bool
+	PacingKbps               float64
+	DSCP                     core.DSCPConfig
+	NonceCache               *core.NonceCache
+	CaptureWriter            *capture.Writer
+	SessionTokenRequests     chan SessionTokenRequest
+}
+
+// processClientPackets reads packets from clients on the public socket of a thread, and forwards the ones
+// that decrypt to their server
+func processClientPackets(ctx context.Context, config *PacketConfig, thread int) {
+
+	conn := config.PublicSockets[thread]
+
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if config.PinThreads {
+		if err := core.PinThread(thread); err != nil {
+			core.Error("could not pin thread %d: %v", thread, err)
+		}
+	}
+
+	// packets are read and forwarded to servers in batches, to save on syscalls
+
+	reader, err := netio.CreateBatchReader(conn, config.SocketBatchSize, MaxPacketSize+core.MaxRelayBytes+core.CookieEchoHeaderBytes)
+	if err != nil {
+		panic(fmt.Sprintf("could not create batch reader: %v", err))
+	}
+
+	serverWriter, err := netio.CreateBatchWriter(conn, config.SocketBatchSize)
+	if err != nil {
+		panic(fmt.Sprintf("could not create batch writer: %v", err))
+	}
+
+	enableSegmentationOffload(reader, serverWriter, config.SocketGRO, config.SocketGSO, thread)
+
+	sessionTable := SessionTables[thread]
+
+	for {
+
+		// send what we have forwarded before waiting for more packets
+
+		if reader.Buffered() == 0 {
+			if err := serverWriter.Flush(); err != nil {
+				ServerForwardLog.Error("failed to forward payload to server: %v", err)
+			}
+		}
+
+		packetData, from, err := reader.ReadPacket()
+		if err != nil {
+			core.Debug("failed to read udp packet: %v", err)
+			break
+		}
+
+		PacketsReceived.Inc()
+
+		// replies go to where the packet came from, even when the client is somewhere else
+
+		replyAddress := from
+
+		if config.ProxyProtocol {
+			headerBytes, source, err := core.ReadProxyHeader(packetData)
+			if err != nil {
+				core.Debug("invalid proxy protocol header from %s: %v", from, err)
+				DroppedPackets.Inc()
+				continue
+			}
+			if source == nil {
+				continue
+			}
+			packetData = packetData[headerBytes:]
+			from = source
+		}
+
+		if config.CaptureWriter != nil {
+			config.CaptureWriter.Write(time.Now(), from, packetData)
+		}
+
+		// clients echo the cookie we sent them around their packets, until they hear back from us
+
+		cookieEchoed := false
+
+		if len(packetData) > core.VersionBytes && packetData[core.VersionBytes] == core.CookieEchoPacket {
+			var cookie uint64
+			innerPacket, ok := core.ReadCookieEchoPacket(packetData, &cookie)
+			if !ok {
+				core.Debug("invalid cookie echo packet from %s", from)
+				DroppedPackets.Inc()
+				continue
+			}
+			cookieEchoed = core.VerifyCookie(CookieKey, from, cookie, time.Now())
+			if !cookieEchoed {
+				core.Debug("invalid cookie from %s", from)
+				InvalidCookies.Inc()
+			}
+			packetData = innerPacket
+		}
+
+		// other gateways in the ping mesh ping us, and answer our pings
+
+		if len(packetData) == core.GatewayPingPacketBytes && (packetData[core.VersionBytes] == core.GatewayPingPacket || packetData[core.VersionBytes] == core.GatewayPongPacket) {
+			if RateLimitEnabled.Load() && !RateLimiter.Allow(from, time.Now()) {
+				core.Debug("rate limited gateway ping from %s", from)
+				RateLimitedPackets.Inc()
+				continue
+			}
+			gatewayPing(serverWriter, config.PacketVersion, packetData, from, replyAddress, config.GatewayAddress)
+			continue
+		}
+
+		// sessions routed through relays arrive in relay packets. pass them on to the next or previous
+		// hop, unless the route ends here
+
+		relayed := false
+
+		if len(packetData) > core.VersionBytes && packetData[core.VersionBytes] == core.RelayPacket {
+			if RateLimitEnabled.Load() && !RateLimiter.Allow(from, time.Now()) {
+				core.Debug("rate limited relay packet from %s", from)
+				RateLimitedPackets.Inc()
+				continue
+			}
+			innerPacket := relayPacket(serverWriter, config.PacketVersion, packetData, from, replyAddress, config.GatewayAddress, config.AuthPublicKey, config.GatewayPrivateKey, cookieEchoed)
+			if innerPacket == nil {
+				continue
+			}
+			packetData = innerPacket
+			relayed = true
+		}
+
+		packetBytes := len(packetData)
+
+		var clientPacket core.ClientPacket
+		if !core.ReadClientPacket(packetData, &clientPacket) {
+			core.Debug("packet is too small")
+			DroppedPackets.Inc()
+			continue
+		}
+
+		core.Debug("recv %d byte packet from %s", packetBytes, from)
+
+		// drop packets from addresses sending too fast, before we spend any time on crypto
+
+		if RateLimitEnabled.Load() && !relayed && !RateLimiter.Allow(from, time.Now()) {
+			core.Debug("rate limited packet from %s", from)
+			RateLimitedPackets.Inc()
+			continue
+		}
+
+		// drop unknown packet versions. older protocol versions are still read, and clients speaking a
+		// version we don't support are told so once their session token checks out, instead of timing
+		// out. every protocol version keeps the same prefix up to the session id, and the same packet
+		// filter
+
+		protocolMismatch := false
+
+		if !core.PacketVersionSupported(clientPacket.Version, config.PacketVersion) {
+			if core.PacketFilterVersion(clientPacket.Version) != core.PacketFilterVersion(config.PacketVersion) {
+				core.Debug("unknown packet version: %d", clientPacket.Version)
+				DroppedPackets.Inc()
+				continue
+			}
+			protocolMismatch = true
+		}
+
+		// packet filter
+
+		var magic [8]byte
+
+		var fromAddressBuffer [core.MaxAddressDataBytes]byte
+		var fromAddressPort uint16
+
+		var toAddressBuffer [core.MaxAddressDataBytes]byte
+		var toAddressPort uint16
+
+		fromAddressData := fromAddressBuffer[:core.GetAddressData(from, fromAddressBuffer[:], &fromAddressPort)]
+		toAddressData := toAddressBuffer[:core.GetAddressData(config.GatewayAddress, toAddressBuffer[:], &toAddressPort)]
+
+		filterPacket := core.FilterPacket{
+			Data:            packetData,
+			From:            from,
+			Magic:           magic[:],
+			FromAddressData: fromAddressData,
+			FromAddressPort: fromAddressPort,
+			ToAddressData:   toAddressData,
+			ToAddressPort:   toAddressPort,
+		}
+
+		if FilterKeys != nil {
+			filterPacket.FilterKey, filterPacket.PreviousFilterKey = FilterKeys.Get(time.Now())
+		}
+
+		if !PacketFilters.Filter(&filterPacket) {
+			continue
+		}
+
+		// replies to the client are keyed with whichever filter key it used
+
+		packetFilterKey := filterPacket.FilterKey
+		previousFilterKey := filterPacket.MatchedPreviousFilterKey
+
+		// packets from addresses without a session here cost a signature check and a key exchange. while
+		// cookies are required, those addresses get a cookie instead, and have to echo it first
+
+		if !cookieEchoed && !cookieExempt(from) {
+			var cookieSessionId [core.SessionIdBytes]byte
+			copy(cookieSessionId[:], clientPacket.SessionId[:])
+			value := sessionTable.Get(cookieSessionId)
+			if value == nil || !core.AddressEqual(value.(*SessionEntry).ClientAddress, from) {
+				UnknownSourcePackets.Inc()
+				if CookiesRequired.Load() {
+					sendCookie(serverWriter, clientPacket.Version, from, replyAddress)
+					continue
+				}
+			}
+		}
+
+		// save a copy of the encrypted session token, since the packet buffer is reused
+
+		sessionTokenData := clientPacket.SessionTokenData
+
+		var sessionTokenDataCopy [core.EncryptedSessionTokenBytes]byte
+
+		copy(sessionTokenDataCopy[:], sessionTokenData[:])
+
+		sessionTokenSequence := clientPacket.SessionTokenSequence
+
+		// decrypt session token, then verify it with the keys of its tenant
+
+		var signedSessionTokenData [core.SignedSessionTokenBytes]byte
+		if !core.DecryptSessionToken(sessionTokenData, clientPacket.SessionId[:], signedSessionTokenData[:], config.GatewayPrivateKey) {
+			core.Debug("could not decrypt session token")
+			CryptoFailures.Inc()
+			continue
+		}
+
+		signKeys := config.SessionTokenSignKeys
+		tenantId, _ := core.SignedSessionTokenTenantId(signedSessionTokenData[:])
+		var tenant *Tenant
+		if tenantId != 0 {
+			tenant = (*Tenants.Load())[tenantId]
+			if tenant == nil {
+				core.Debug("unknown tenant %d", tenantId)
+				UnknownTenantPackets.Inc()
+				continue
+			}
+			signKeys = tenant.SessionTokenSignKeys
+		}
+
+		index := 0
+		var sessionToken core.SessionToken
+		result := core.ReadSignedSessionToken(signedSessionTokenData[:], &index, &sessionToken, signKeys...)
+		if !result {
+			core.Debug("could not verify session token")
+			CryptoFailures.Inc()
+			continue
+		}
+
+		if err := core.ValidateSessionTokenTimestamps(&sessionToken, uint64(time.Now().Unix())); err != nil {
+			core.Debug("%v", err)
+			ExpiredSessionTokens.Inc()
+			continue
+		}
+
+		if Revocations.IsRevoked(sessionToken.SessionId[:], sessionToken.UserId[:], uint64(time.Now().Unix())) || KickedSessions.IsRevoked(sessionToken.SessionId[:], nil, uint64(time.Now().Unix())) {
+			core.Debug("session %s is revoked", core.IdString(sessionToken.SessionId[:]))
+			RevokedPacketsFromClient.Inc()
+			continue
+		}
+
+		clientIP := from.IP
+		if from.IP.IsLoopback() {
+			if relayClientIP, ok := RelayClientIPs.Load(from.String()); ok {
+				clientIP = relayClientIP.(net.IP)
+			}
+		}
+
+		if err := core.ValidateSessionTokenClientIP(&sessionToken, clientIP, config.TokenIPv4PrefixBits, config.TokenIPv6PrefixBits); err != nil {
+			core.Debug("%v", err)
+			MismatchedSessionTokens.Inc()
+			continue
+		}
+
+		senderPublicKey := clientPacket.SessionId
+
+		var sessionId [core.SessionIdBytes]byte
+		copy(sessionId[:], senderPublicKey[:])
+
+		var sessionEntry *SessionEntry
+		if value := sessionTable.Get(sessionId); value != nil {
+			sessionEntry = value.(*SessionEntry)
+		}
+
+		var sessionKeys core.SessionKeys
+		if sessionEntry != nil {
+			sessionKeys = sessionEntry.SessionKeys
+		} else {
+			sessionKeys = core.DeriveSessionKeys(core.SessionKey(senderPublicKey, config.GatewayPrivateKey), sessionId[:])
+		}
+
+		// clients speaking a protocol version we don't support get a version reject signed with the session
+		// keys, so they can't be told to fall back by anyone but the gateway they're talking to. like
+		// challenges, rejects only go out once the session token checks out
+
+		if protocolMismatch {
+			core.Debug("unknown packet version: %d", clientPacket.Version)
+			DroppedPackets.Inc()
+			ProtocolMismatchPackets.Inc()
+			ProtocolMismatchLog.Warn("%s speaks protocol version %d, but this gateway speaks protocol version %d", from, core.PacketProtocolVersion(clientPacket.Version), core.ProtocolVersion)
+			if !relayed {
+				var rejectData [core.VersionRejectPacketBytes]byte
+				if _, err := conn.WriteToUDP(rejectData[:core.WriteVersionRejectPacket(rejectData[:], config.PacketVersion, &sessionKeys)], replyAddress); err != nil {
+					ProtocolMismatchLog.Error("failed to send version reject: %v", err)
+				}
+			}
+			continue
+		}
+
+		// clients encrypting with a cipher suite we don't accept are told which one to use instead, in a
+		// reject signed with the session keys
+
+		cipherSuite := clientPacket.CipherSuite
+		if !AcceptedCipherSuites[cipherSuite] {
+			core.Debug("cipher suite %s is not accepted", core.CipherSuiteName(cipherSuite))
+			CipherSuiteRejectedPackets.Inc()
+			CipherSuiteRejectLog.Warn("%s encrypts with cipher suite %s, which this gateway doesn't accept", from, core.CipherSuiteName(cipherSuite))
+			if !relayed {
+				var rejectData [core.CipherSuiteRejectPacketBytes]byte
+				if _, err := conn.WriteToUDP(rejectData[:core.WriteCipherSuiteRejectPacket(rejectData[:], clientPacket.Version, PreferredCipherSuite, &sessionKeys)], replyAddress); err != nil {
+					CipherSuiteRejectLog.Error("failed to send cipher suite reject: %v", err)
+				}
+			}
+			continue
+		}
+
+		// decrypt packet
+
+		sequence := clientPacket.Sequence
+		encryptedData := clientPacket.EncryptedData
+
+		err = core.DecryptPayload(cipherSuite, sessionKeys.ClientToGateway[:], sequence, 0, encryptedData, len(encryptedData))
+		if err != nil {
+			core.Debug("could not decrypt payload packet")
+			CryptoFailures.Inc()
+			continue
+		}
+
+		// split packet into various pieces
+
+		headerIndex := core.PrefixBytes
+
+		payloadIndex := headerIndex + core.HeaderBytes
+		payloadBytes := packetBytes - payloadIndex - core.PostfixBytes
+
+		header := clientPacket.Header
+
+		payload := packetData[payloadIndex : payloadIndex+payloadBytes]
+
+		// ignore packet types we don't support
+
+		packetType := header[core.SessionIdBytes+core.SequenceBytes+core.AckBytes+core.AckBitsBytes+core.GatewayIdBytes+core.ServerIdBytes]
+		if packetType != core.PayloadPacket && packetType != core.KeepAlivePacket && packetType != core.DisconnectPacket && packetType != core.MTUProbePacket && packetType != core.ClientStatsPacket {
+			core.Debug("invalid packet type: %d", packetType)
+			DroppedPackets.Inc()
+			continue
+		}
+
+		// get packet gateway id
+
+		gatewayIdIndex := headerIndex + core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes
+
+		index = 0
+		var packetGatewayId [core.GatewayIdBytes]byte
+		core.ReadBytes(packetData[gatewayIdIndex:gatewayIdIndex+core.GatewayIdBytes], &index, packetGatewayId[:], core.GatewayIdBytes)
+
+		// get challenge token data
+
+		flagsIndex := core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes + core.GatewayIdBytes + core.ServerIdBytes + core.PacketTypeBytes
+		var challengeTokenData []byte
+		hasChallengeToken := (header[flagsIndex] & core.Flags_ChallengeToken) != 0
+		if hasChallengeToken {
+			challengeTokenData = payload[0:core.EncryptedChallengeTokenBytes]
+			payload = payload[core.EncryptedChallengeTokenBytes:]
+		}
+
+		// clear flags in header
+
+		header[flagsIndex] = 0
+
+		// process payload packet
+
+		core.Debug("payload is %d bytes", len(payload))
+
+		if sessionEntry == nil {
+
+			// *** no session entry ***
+
+			var handshakeTime time.Time
+			if tracing.Enabled() {
+				handshakeTime = time.Now()
+			}
+
+			if DrainStartTime.Load() != 0 {
+				core.Debug("draining. not accepting session %s", core.IdString(sessionId[:]))
+				DrainRejectedPackets.Inc()
+				continue
+			}
+
+			// the session may have been started on another gateway instance sharing the session store
+
+			var sessionRecord *sessionstore.Record
+			if SessionStore != nil && !hasChallengeToken {
+				var pending bool
+				sessionRecord, pending = lookupSession(sessionId)
+				if pending {
+					core.Debug("session %s is being looked up in the session store", core.IdString(sessionId[:]))
+					SessionLookupsPending.Inc()
+					continue
+				}
+			}
+
+			if packetType != core.PayloadPacket && sessionRecord == nil {
+				core.Debug("packet type %d requires a session", packetType)
+				continue
+			}
+
+			if hasChallengeToken || sessionRecord != nil {
+
+				// payload packet has a challenge token (challenge/response), or continues a session from the session store
+
+				firstSequence := sequence
+
+				if hasChallengeToken {
+
+					index := 0
+					var challengeToken core.ChallengeToken
+					result := core.ReadEncryptedChallengeToken(challengeTokenData, &index, &challengeToken, config.ChallengePrivateKey)
+					if !result {
+						core.Debug("challenge token did not decrypt")
+						CryptoFailures.Inc()
+						continue
+					}
+
+					if challengeToken.ExpireTimestamp <= uint64(time.Now().Unix()) {
+						core.Debug("challenge token expired")
+						continue
+					}
+
+					if !core.AddressEqual(&challengeToken.ClientAddress, from) {
+						core.Debug("challenge token client address mismatch")
+						continue
+					}
+
+					if !core.IdEqual(challengeToken.SessionId[:], sessionId[:]) {
+						core.Debug("challenge token session id mismatch")
+						continue
+					}
+
+					firstSequence = challengeToken.Sequence
+				}
+
+				var sessionId [core.SessionIdBytes]byte
+				for i := 0; i < core.SessionIdBytes; i++ {
+					sessionId[i] = senderPublicKey[i]
+				}
+
+				if !config.NonceCache.Check(sessionId[:], from, sessionToken.ExpireTimestamp, uint64(time.Now().Unix())) {
+					core.Debug("session token replayed from %s", from.String())
+					ReplayedSessionTokens.Inc()
+					continue
+				}
+
+				if tenant != nil && tenant.MaxSessions > 0 && tenantSessions(tenantId).Load() >= int64(tenant.MaxSessions) {
+					core.Debug("tenant %d is at its session limit. not accepting session %s", tenantId, core.IdString(sessionId[:]))
+					TenantSessionsRejected.Inc()
+					continue
+				}
+
+				// create new session entry
+
+				sessionEntry := &SessionEntry{ReplayProtection: core.CreateReplayProtection()}
+
+				if sessionRecord != nil {
+					sessionEntry.ReplayProtection.AdvanceSequence(sessionRecord.Sequence)
+				}
+				sessionEntry.ReplayProtection.AdvanceSequence(firstSequence)
+				sessionEntry.LastSequence.Store(firstSequence)
+
+				sessionEntry.SessionTokenChannel = make(chan SessionTokenUpdate, 1)
+				sessionEntry.SessionKeys = sessionKeys
+				copy(sessionEntry.SessionTokenData[:], sessionTokenDataCopy[:])
+				sessionEntry.SessionTokenExpireTimestamp = sessionToken.ExpireTimestamp
+				sessionEntry.SessionTokenSequence = sessionTokenSequence
+				upLimitKbps, downLimitKbps := config.BandwidthLimitUpKbps, config.BandwidthLimitDownKbps
+				if tenant != nil {
+					upLimitKbps, downLimitKbps = tenant.BandwidthLimits(upLimitKbps, downLimitKbps)
+				}
+				sessionEntry.UpLimiter = core.CreateBandwidthLimiter(core.SessionKbps(sessionToken.EnvelopeUpKbps, upLimitKbps), config.BandwidthLimitBurst, time.Now())
+				sessionEntry.DownLimiter = core.CreateBandwidthLimiter(core.SessionKbps(sessionToken.EnvelopeDownKbps, downLimitKbps), config.BandwidthLimitBurst, time.Now())
+				sessionEntry.PacketsPerSecondMax = uint64(float32(sessionToken.PacketsPerSecond) * 1.1)
+
+				sessionEntry.ReceiveBandwidthBitsResetTime = time.Now().Add(time.Second)
+
+				sessionEntry.PathStats = core.CreatePathStats()
+				sessionEntry.Pacer = core.CreatePacer(config.PacingKbps)
+
+				sessionEntry.SessionId = sessionId
+				sessionEntry.UserId = sessionToken.UserId
+				sessionEntry.TenantId = tenantId
+				sessionEntry.ClientAddress = from
+				sessionEntry.CreateTime = time.Now()
+				sessionEntry.PreviousFilterKey.Store(previousFilterKey)
+				sessionEntry.PacketVersion.Store(uint32(clientPacket.Version))
+				sessionEntry.CipherSuite.Store(uint32(cipherSuite))
+				sessionEntry.Relayed = relayed
+
+				if config.ProxyProtocol {
+					sessionEntry.ProxyAddress.Store(replyAddress)
+				}
+
+				// continued sessions stay on their server, if this instance forwards to it
+
+				serverFound := false
+				if sessionRecord != nil {
+					sessionEntry.CreateTime = sessionRecord.CreateTime
+					if serverAddress := core.ParseAddress(sessionRecord.ServerAddress); serverAddress != nil {
+						sessionEntry.ServerIndex, serverFound = claimServer(tenantId, serverAddress)
+					}
+				}
+				if !serverFound {
+					sessionEntry.ServerIndex = selectServer(tenantId, sessionId[:])
+				}
+
+				if sessionTable.Insert(sessionId, sessionEntry, time.Now()) {
+					core.Debug("session table is full. evicted least recently used session")
+				}
+
+				tenantSessions(tenantId).Add(1)
+
+				if sessionRecord != nil {
+					SessionsContinued.Inc()
+					core.Info("continued session %s from %s", core.IdString(sessionId[:]), from.String())
+				} else {
+					SessionsCreated.Inc()
+					if Analytics != nil {
+						publishSessionEvent(analytics.SessionStartEvent, sessionEntry, config.GatewayAddress, "")
+					}
+					core.Info("new session %s from %s", core.IdString(sessionId[:]), from.String())
+				}
+
+				if tracing.Enabled() {
+					_, span := tracing.StartSpan(tracing.SessionContext(context.Background(), sessionId[:]), "gateway.session_start", trace.WithTimestamp(handshakeTime), trace.WithAttributes(
+						attribute.String("udpx.client_address", from.String()),
+						attribute.Bool("udpx.continued", sessionRecord != nil),
+						attribute.Bool("udpx.relayed", relayed),
+						attribute.Int("udpx.tenant_id", int(tenantId)),
+						attribute.Int("udpx.server_index", sessionEntry.ServerIndex),
+					))
+					span.End()
+				}
+
+				if SessionStore != nil {
+					record := storeRecord(sessionEntry)
+					go func() {
+						if err := SessionStore.Put(map[[core.SessionIdBytes]byte]sessionstore.Record{sessionId: record}); err != nil {
+							SessionStoreFailures.Inc()
+							SessionStoreLog.Error("could not store session: %v", err)
+						}
+					}()
+				}
+
+			} else {
+
+				// respond with a challenge
+
+				challengeBuffer := pool.Get(MaxPacketSize)
+				challengePacketData := challengeBuffer.Data
+
+				challengeToken := core.ChallengeToken{}
+				challengeToken.ExpireTimestamp = uint64(time.Now().Unix() + ChallengeTokenTimeout)
+				challengeToken.ClientAddress = *from
+				challengeToken.SessionId = sessionId
+				challengeToken.Sequence = sequence
+
+				nonce := [core.NonceBytes_Box]byte{}
+				core.RandomBytes_InPlace(nonce[:])
+				nonce[9] &= 1 ^ (1 << 0)
+				nonce[9] |= (1 << 1)
+
+				index := 0
+
+				dummySessionToken := [core.EncryptedSessionTokenBytes]byte{}
+				dummySessionTokenSequence := uint64(0)
+
+				version := clientPacket.Version
+				core.WriteUint8(challengePacketData, &index, version)
+				core.WriteUint8(challengePacketData, &index, core.ChallengePacket)
+				chonkle := challengePacketData[index : index+core.ChonkleBytes]
+				index += core.ChonkleBytes
+				core.WriteBytes(challengePacketData, &index, dummySessionToken[:], core.EncryptedSessionTokenBytes)
+				core.WriteUint64(challengePacketData, &index, dummySessionTokenSequence)
+				core.WriteBytes(challengePacketData, &index, nonce[:], core.NonceBytes_Box)
+				encryptStart := index
+				core.WriteEncryptedChallengeToken(challengePacketData, &index, &challengeToken, config.ChallengePrivateKey)
+				core.WriteUint64(challengePacketData, &index, sequence)
+				core.WriteBytes(challengePacketData, &index, config.GatewayId[:], core.GatewayIdBytes)
+				core.KeyConfirmation(&sessionKeys, sequence, challengePacketData[index:index+core.KeyConfirmationBytes])
+				index += core.KeyConfirmationBytes
+				encryptFinish := index
+				index += core.HMACBytes_Box
+				pittle := challengePacketData[index : index+core.PittleBytes]
+				index += core.PittleBytes
+
+				challengePacketBytes := index
+				challengePacketData = challengePacketData[:challengePacketBytes]
+
+				core.Encrypt_Box(config.GatewayPrivateKey, sessionId[:], nonce[:], challengePacketData[encryptStart:encryptFinish], encryptFinish-encryptStart)
+
+				// setup packet prefix and postfix
+
+				var magic [core.MagicBytes]byte
+
+				var fromAddressBuffer [core.MaxAddressDataBytes]byte
+				var fromAddressPort uint16
+
+				var toAddressBuffer [core.MaxAddressDataBytes]byte
+				var toAddressPort uint16
+
+				fromAddressData := fromAddressBuffer[:core.GetAddressData(config.GatewayAddress, fromAddressBuffer[:], &fromAddressPort)]
+				toAddressData := toAddressBuffer[:core.GetAddressData(from, toAddressBuffer[:], &toAddressPort)]
+
+				if packetFilterKey != nil {
+					core.GenerateChonkleKeyed(chonkle[:], packetFilterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes)
+					core.GeneratePittleKeyed(pittle[:], packetFilterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes)
+				} else {
+					core.GenerateChonkle(chonkle[:], magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes)
+					core.GeneratePittle(pittle[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes)
+				}
+
+				if !core.BasicPacketFilter(challengePacketData, challengePacketBytes) {
+					panic("basic packet filter failed")
+				}
+
+				if packetFilterKey != nil {
+					if !core.AdvancedPacketFilterKeyed(challengePacketData, packetFilterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes) {
+						panic("advanced packet filter failed")
+					}
+				} else if !core.AdvancedPacketFilter(challengePacketData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes) {
+					panic("advanced packet filter failed")
+				}
+
+				// send it to the client, back along its route if it came through relays
+
+				if relayed {
+					relayBuffer := pool.Get(MaxPacketSize + core.RelayOverheadBytes)
+					relayPacketBytes := core.WriteRelayPacket(relayBuffer.Data, version, sessionId[:], 0, nil, challengePacketData, packetFilterKey, config.GatewayAddress, from)
+					challengeBuffer.Release()
+					challengeBuffer = relayBuffer
+					challengePacketData = relayBuffer.Data[:relayPacketBytes]
+				}
+
+				if _, err := conn.WriteToUDP(challengePacketData, replyAddress); err != nil {
+					ChallengeSendLog.Error("failed to send challenge packet to client: %v", err)
+				}
+
+				ChallengesSent.Inc()
+
+				if tracing.Enabled() {
+					_, span := tracing.StartSpan(tracing.SessionContext(context.Background(), sessionId[:]), "gateway.challenge", trace.WithTimestamp(handshakeTime), trace.WithAttributes(
+						attribute.String("udpx.client_address", from.String()),
+						attribute.Bool("udpx.relayed", relayed),
+					))
+					span.End()
+				}
+
+				core.Debug("send %d byte challenge packet to %s", len(challengePacketData), from.String())
+
+				challengeBuffer.Release()
+
+			}
+
+			continue
+		}
+
+		// drop packets without the correct gateway id
+
+		if !core.IdEqual(packetGatewayId[:], config.GatewayId[:]) {
+			core.Debug("wrong gateway id")
+			DroppedPackets.Inc()
+			continue
+		}
+
+		// drop packets that are too old, or have already been forwarded to the server
+
+		if sessionEntry.ReplayProtection.AlreadyReceived(sequence) {
+			core.Debug("packet %d has already been received", sequence)
+			ReplayedPackets.Inc()
+			continue
+		}
+
+		// do we have enough bandwidth available to receive this packet?
+
+		if sessionEntry.ReceiveBandwidthBitsResetTime.Before(time.Now()) {
+			receiveBandwidthMbps := float64(sessionEntry.ReceiveBandwidthBitsAccumulator) / 1000000.0
+			sessionEntry.ReceiveBandwidthBitsResetTime = time.Now().Add(time.Second)
+			sessionEntry.ReceiveBandwidthBitsAccumulator = 0
+			sessionEntry.PacketsReceivedInLastSecond = 0
+			stats := sessionEntry.PathStats.Stats()
+			core.Debug("session %s is %.2f mbps, rtt %.1fms, jitter %.1fms, packet loss %.1f%%", core.IdString(sessionId[:]), receiveBandwidthMbps,
+				float64(stats.RTT)/float64(time.Millisecond), float64(stats.Jitter)/float64(time.Millisecond), stats.PacketLoss*100)
+		}
+
+		if !sessionEntry.UpLimiter.Allow(len(packetData), time.Now()) {
+			OverBandwidthPacketsFromClient.Inc()
+			if !config.MarkOverBandwidth {
+				core.Debug("choke bw")
+				DroppedPackets.Inc()
+				continue
+			}
+			header[flagsIndex] |= core.Flags_OverBandwidth
+		}
+
+		sessionEntry.ReceiveBandwidthBitsAccumulator += uint64(core.WirePacketBits(len(packetData)))
+
+		// too many packets per-second?
+
+		if sessionEntry.PacketsReceivedInLastSecond > sessionEntry.PacketsPerSecondMax {
+			core.Debug("choke pps")
+			DroppedPackets.Inc()
+			continue
+		}
+
+		sessionEntry.PacketsReceivedInLastSecond++
+
+		// update session token
+
+		if sessionEntry.SessionTokenExpireTimestamp-uint64(10) <= uint64(time.Now().Unix()) && !sessionEntry.UpdatingSessionToken && sessionEntry.SessionTokenCooldown.Before(time.Now()) {
+
+			select {
+			case config.SessionTokenRequests <- SessionTokenRequest{Channel: sessionEntry.SessionTokenChannel, SessionId: sessionId, SessionTokenData: signedSessionTokenData, Tenant: tenant}:
+				sessionEntry.UpdatingSessionToken = true
+				if sessionEntry.SessionTokenRetryCount == 0 {
+					core.Debug("updating session token %s", core.IdString(sessionToken.SessionId[:]))
+				} else {
+					core.Debug("updating session token %s retry #%d", core.IdString(sessionToken.SessionId[:]), sessionEntry.SessionTokenRetryCount)
+				}
+			default:
+				core.Debug("session token refresh queue is full. deferring update of session token %s", core.IdString(sessionToken.SessionId[:]))
+				SessionTokenRefreshesDeferred.Inc()
+				sessionEntry.SessionTokenCooldown = time.Now().Add(time.Second)
+			}
+		}
+
+		if sessionEntry.UpdatingSessionToken {
+			select {
+			case update := <-sessionEntry.SessionTokenChannel:
+				if len(update.SessionTokenData) != 0 {
+					copy(sessionEntry.SessionTokenData[:], update.SessionTokenData[:])
+					sessionEntry.SessionTokenExpireTimestamp = update.ExpireTimestamp
+					sessionEntry.SessionTokenSequence++
+					sessionEntry.SessionTokenRetryCount = 0
+					core.Info("updated session token for session %s %d", core.IdString(sessionId[:]), sessionEntry.SessionTokenSequence)
+				} else {
+					core.Debug("failed to update session token %s :(", core.IdString(sessionId[:]))
+					SessionTokenRefreshFailures.Inc()
+					sessionEntry.SessionTokenRetryCount++
+					sessionEntry.SessionTokenCooldown = time.Now().Add(time.Second)
+				}
+				sessionEntry.UpdatingSessionToken = false
+			default:
+			}
+		}
+
+		// forward payload packet to server. move the session if its server stops answering pings
+
+		if !ServerPool.IsHealthy(sessionEntry.ServerIndex) {
+			ServerPool.Release(sessionEntry.ServerIndex)
+			sessionEntry.ServerIndex = selectServer(sessionEntry.TenantId, sessionId[:])
+		}
+
+		serverAddress := ServerPool.GetAddress(sessionEntry.ServerIndex)
+
+		forwardBuffer := pool.Get(MaxPacketSize)
+		forwardPacketData := forwardBuffer.Data
+
+		index = 0
+
+		version := byte(0)
+
+		core.WriteUint8(forwardPacketData, &index, version)
+		core.WriteAddress(forwardPacketData, &index, config.GatewayInternalAddress)
+		core.WriteAddress(forwardPacketData, &index, from)
+		core.WriteBytes(forwardPacketData[:], &index, sessionEntry.SessionTokenData[:], core.EncryptedSessionTokenBytes)
+		core.WriteUint64(forwardPacketData[:], &index, sessionEntry.SessionTokenSequence)
+		core.WriteBytes(forwardPacketData, &index, header, core.HeaderBytes)
+		core.WriteBytes(forwardPacketData, &index, payload, len(payload))
+
+		forwardPacketBytes := index
+
+		if err := serverWriter.WriteBuffer(forwardBuffer, forwardPacketBytes, serverAddress); err != nil {
+			ServerForwardLog.Error("failed to forward payload to server: %v", err)
+		} else {
+			PacketsForwardedToServer.Inc()
+			BytesForwardedToServer.Add(uint64(packetBytes))
+			sessionEntry.Usage.RecordUp(packetBytes)
+		}
+
+		core.Debug("send %d byte packet to %s", forwardPacketBytes, serverAddress.String())
+
+		// mark packet as received
+
+		sessionEntry.ReplayProtection.AdvanceSequence(sequence)
+
+		if sequence > sessionEntry.LastSequence.Load() {
+			sessionEntry.LastSequence.Store(sequence)
+		}
+
+		if config.ProxyProtocol {
+			if proxyAddress := sessionEntry.ProxyAddress.Load(); proxyAddress == nil || !core.AddressEqual(proxyAddress, replyAddress) {
+				sessionEntry.ProxyAddress.Store(replyAddress)
+			}
+		}
+
+		if sessionEntry.PreviousFilterKey.Load() != previousFilterKey {
+			sessionEntry.PreviousFilterKey.Store(previousFilterKey)
+		}
+
+		if sessionEntry.PacketVersion.Load() != uint32(clientPacket.Version) {
+			sessionEntry.PacketVersion.Store(uint32(clientPacket.Version))
+		}
+
+		if sessionEntry.CipherSuite.Load() != uint32(cipherSuite) {
+			sessionEntry.CipherSuite.Store(uint32(cipherSuite))
+		}
+
+		// the client acks the packets we forwarded to it from the server
+
+		index = core.SessionIdBytes + core.SequenceBytes
+		var ack uint64
+		var ackDelay uint32
+		core.ReadUint64(header, &index, &ack)
+		ackBits := header[index : index+core.AckBitsBytes]
+		index = core.HeaderBytes - core.AckDelayBytes
+		core.ReadUint32(header, &index, &ackDelay)
+
+		if rtt, ok := sessionEntry.PathStats.ProcessAcks(ack, ackBits, time.Duration(ackDelay)*time.Microsecond, time.Now()); ok {
+			sessionEntry.Pacer.SetRTT(rtt)
+			ClientRTT.Observe(rtt.Seconds())
+			ClientJitter.Observe(sessionEntry.PathStats.Stats().Jitter.Seconds())
+		}
+
+		// keep the latest stats from the client for the analytics events
+
+		if packetType == core.ClientStatsPacket {
+			var clientStats core.ClientStats
+			if core.ReadClientStats(payload, &clientStats) {
+				sessionEntry.ClientStats.Store(&clientStats)
+				ClientStatsReceived.Inc()
+			} else {
+				core.Debug("invalid client stats from session %s", core.IdString(sessionId[:]))
+			}
+		}
+
+		// the disconnect has been passed on to the server, so the session can end now
+
+		if packetType == core.DisconnectPacket {
+			sessionEntry.EndReason.Store("disconnect")
+			if sessionTable.Remove(sessionId) {
+				SessionsDisconnected.Inc()
+				core.Info("session %s disconnected", core.IdString(sessionId[:]))
+			}
+			continue
+		}
+
+		sessionTable.Touch(sessionId, time.Now())
+	}
+}
+
+// processServerPackets reads packets from servers on the internal socket of a thread, and forwards them to
+// their clients
+func processServerPackets(ctx context.Context, config *PacketConfig, thread int) {
+
+	if config.PinThreads {
+		if err := core.PinThread(thread); err != nil {
+			core.Error("could not pin internal thread %d: %v", thread, err)
+		}
+	}
+
+	var conn *net.UDPConn
+
+	if len(config.ActivatedInternalSockets) > 0 {
+		conn = config.ActivatedInternalSockets[thread%len(config.ActivatedInternalSockets)]
+	} else {
+		var err error
+		conn, err = netio.ListenUDP(ctx, config.GatewayInternalAddress.String())
+		if err != nil {
+			panic(fmt.Sprintf("could not bind internal socket: %v", err))
+		}
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := conn.SetReadBuffer(config.ReadBuffer); err != nil {
+		panic(fmt.Sprintf("could not set internal connection read buffer size: %v", err))
+	}
+
+	if err := conn.SetWriteBuffer(config.WriteBuffer); err != nil {
+		panic(fmt.Sprintf("could not set internal connection write buffer size: %v", err))
+	}
+
+	// packets from servers are read and forwarded to clients in batches too
+
+	reader, err := netio.CreateBatchReader(conn, config.SocketBatchSize, MaxPacketSize)
+	if err != nil {
+		panic(fmt.Sprintf("could not create internal batch reader: %v", err))
+	}
+
+	clientWriter, err := netio.CreateBatchWriter(config.PublicSockets[thread], config.SocketBatchSize)
+	if err != nil {
+		panic(fmt.Sprintf("could not create batch writer: %v", err))
+	}
+
+	enableSegmentationOffload(reader, clientWriter, config.SocketGRO, config.SocketGSO, thread)
+
+	// packets held back by a session's pacer are sent from their own goroutine when due
+
+	var pacedSender *core.PacedSender
+	if config.PacingKbps > 0 {
+		pacedSender = core.CreatePacedSender()
+	}
+
+	for {
+
+		if reader.Buffered() == 0 {
+			if err := clientWriter.Flush(); err != nil {
+				ClientForwardLog.Error("failed to forward packet to client: %v", err)
+			}
+		}
+
+		packetData, from, err := reader.ReadPacket()
+		if err != nil {
+			if ctx.Err() == nil {
+				core.Error("failed to read internal udp packet: %v", err)
+			}
+			break
+		}
+
+		packetBytes := len(packetData)
+
+		core.Debug("recv internal %d byte packet from %s", packetBytes, from.String())
+
+		if packetBytes < core.PacketTypeBytes+core.VersionBytes+core.AddressBytes+core.EncryptedSessionTokenBytes+core.SequenceBytes+core.HeaderBytes+core.MinPayloadBytes {
+			core.Debug("internal packet is too small")
+			continue
+		}
+
+		if packetData[0] != 0 {
+			core.Debug("unknown internal packet version: %d", packetData[0])
+			continue
+		}
+
+		if packetData[1] != core.PayloadPacket {
+			core.Debug("unknown internal packet type: %d", packetData[1])
+			continue
+		}
+
+		// read the client address the packet should be forwarded to
+
+		index := core.VersionBytes + core.PacketTypeBytes
+		var clientAddress net.UDPAddr
+		if !core.ReadAddress(packetData, &index, &clientAddress) || clientAddress.IP == nil {
+			core.Debug("invalid client address in internal packet")
+			continue
+		}
+
+		// grab the session token
+
+		sessionTokenData := packetData[index : index+core.EncryptedSessionTokenBytes]
+		index += core.EncryptedSessionTokenBytes
+
+		// grab the session token sequence
+
+		sessionTokenSequence := packetData[index : index+core.SequenceBytes]
+		index += core.SequenceBytes
+
+		// split the packet apart into sections
+
+		headerIndex := core.VersionBytes + core.PacketTypeBytes + core.AddressBytes + core.EncryptedSessionTokenBytes + core.SequenceBytes
+
+		payloadIndex := headerIndex + core.HeaderBytes
+		payloadBytes := len(packetData) - payloadIndex
+
+		core.Debug("payload bytes is %d", payloadBytes)
+
+		header := packetData[headerIndex : headerIndex+core.HeaderBytes]
+		payload := packetData[payloadIndex : payloadIndex+payloadBytes]
+
+		// kicked and revoked sessions get nothing more from the server, even once their entry is gone
+
+		sessionId := header[:core.SessionIdBytes]
+
+		sessionEntry := findSession(sessionId)
+
+		currentTimestamp := uint64(time.Now().Unix())
+
+		if KickedSessions.IsRevoked(sessionId, nil, currentTimestamp) || Revocations.IsRevoked(sessionId, sessionUserId(sessionEntry, sessionId, sessionTokenData, config.GatewayPrivateKey), currentTimestamp) {
+			RevokedPacketsToClient.Inc()
+			continue
+		}
+
+		// build the packet to send to the client
+
+		forwardBuffer := pool.Get(MaxPacketSize)
+		forwardPacketData := forwardBuffer.Data
+
+		index = 0
+
+		encryptStart := core.PrefixBytes + core.SessionIdBytes + core.SequenceBytes
+
+		core.WriteUint8(forwardPacketData, &index, config.PacketVersion)
+		core.WriteUint8(forwardPacketData, &index, core.PayloadPacket)
+		chonkle := forwardPacketData[index : index+core.ChonkleBytes]
+		index += core.ChonkleBytes
+		core.WriteBytes(forwardPacketData, &index, sessionTokenData, core.EncryptedSessionTokenBytes)
+		core.WriteBytes(forwardPacketData, &index, sessionTokenSequence, core.SequenceBytes)
+		forwardHeaderIndex := index
+		core.WriteBytes(forwardPacketData, &index, header, core.HeaderBytes)
+		core.WriteBytes(forwardPacketData, &index, payload, payloadBytes)
+		encryptFinish := index
+		index += core.HMACBytes_Box
+		pittle := forwardPacketData[index : index+core.PittleBytes]
+		index += core.PittleBytes
+
+		forwardPacketBytes := index
+		forwardPacketData = forwardPacketData[:forwardPacketBytes]
+
+		// answer in the protocol version the client speaks
+
+		if sessionEntry != nil {
+			forwardPacketData[0] = byte(sessionEntry.PacketVersion.Load())
+		}
+
+		// do we have enough bandwidth available to send this packet to the client?
+
+		if sessionEntry != nil && !sessionEntry.DownLimiter.Allow(forwardPacketBytes, time.Now()) {
+			OverBandwidthPacketsToClient.Inc()
+			if !config.MarkOverBandwidth {
+				core.Debug("choke bw to client")
+				forwardBuffer.Release()
+				continue
+			}
+			flagsIndex := core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes + core.GatewayIdBytes + core.ServerIdBytes + core.PacketTypeBytes
+			forwardPacketData[forwardHeaderIndex+flagsIndex] |= core.Flags_OverBandwidth
+		}
+
+		// encrypt the packet
+
+		sequenceData := header[core.SessionIdBytes : core.SessionIdBytes+core.SequenceBytes]
+
+		index = 0
+		sequence := uint64(0)
+		core.ReadUint64(sequenceData, &index, &sequence)
+
+		var sessionKeys core.SessionKeys
+		cipherSuite := core.CipherSuite_XChaCha20Poly1305
+		if sessionEntry != nil {
+			sessionKeys = sessionEntry.SessionKeys
+			cipherSuite = byte(sessionEntry.CipherSuite.Load())
+		} else {
+			sessionKeys = core.DeriveSessionKeys(core.SessionKey(sessionId, config.GatewayPrivateKey), sessionId)
+		}
+
+		core.EncryptPayload(cipherSuite, sessionKeys.GatewayToClient[:], sequence, core.NonceFlags_GatewayToClient, forwardPacketData[encryptStart:encryptFinish+core.HMACBytes_AEAD], encryptFinish-encryptStart)
+
+		// setup packet prefix and postfix
+
+		var magic [core.MagicBytes]byte
+
+		var fromAddressBuffer [core.MaxAddressDataBytes]byte
+		var fromAddressPort uint16
 
-	serviceName := "udpx gateway"
+		var toAddressBuffer [core.MaxAddressDataBytes]byte
+		var toAddressPort uint16
 
-	core.Info("%s", serviceName)
+		fromAddressData := fromAddressBuffer[:core.GetAddressData(config.GatewayAddress, fromAddressBuffer[:], &fromAddressPort)]
+		toAddressData := toAddressBuffer[:core.GetAddressData(&clientAddress, toAddressBuffer[:], &toAddressPort)]
 
-	// configure
+		var forwardFilterKey []byte
+		if FilterKeys != nil {
+			currentFilterKey, previousFilterKey := FilterKeys.Get(time.Now())
+			forwardFilterKey = currentFilterKey
+			if previousFilterKey != nil && sessionEntry != nil && sessionEntry.PreviousFilterKey.Load() {
+				forwardFilterKey = previousFilterKey
+			}
+		}
 
-	gatewayAddress, err := envvar.GetAddress("GATEWAY_ADDRESS", core.ParseAddress("127.0.0.1:40000"))
-	if err != nil {
-		core.Error("invalid GATEWAY_ADDRESS: %v", err)
-		return 1
-	}
+		if forwardFilterKey != nil {
+			core.GenerateChonkleKeyed(chonkle[:], forwardFilterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes)
+			core.GeneratePittleKeyed(pittle[:], forwardFilterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes)
+		} else {
+			core.GenerateChonkle(chonkle[:], magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes)
+			core.GeneratePittle(pittle[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes)
+		}
 
-	gatewayInternalAddress, err := envvar.GetAddress("GATEWAY_INTERNAL_ADDRESS", core.ParseAddress("127.0.0.1:40001"))
-	if err != nil {
-		core.Error("invalid GATEWAY_INTERNAL_ADDRESS: %v", err)
-		return 1
-	}
+		if !core.BasicPacketFilter(forwardPacketData, forwardPacketBytes) {
+			panic("basic packet filter failed")
+		}
 
-	serverAddress, err := envvar.GetAddress("SERVER_ADDRESS", core.ParseAddress("127.0.0.1:40000"))
-	if err != nil {
-		core.Error("invalid SERVER_ADDRESS: %v", err)
-		return 1
-	}
+		if forwardFilterKey != nil {
+			if !core.AdvancedPacketFilterKeyed(forwardPacketData, forwardFilterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes) {
+				panic("advanced packet filter failed")
+			}
+		} else if !core.AdvancedPacketFilter(forwardPacketData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes) {
+			panic("advanced packet filter failed")
+		}
 
-	gatewayPrivateKey, err := envvar.GetBase64("GATEWAY_PRIVATE_KEY", nil)
-	if err != nil || len(gatewayPrivateKey) != core.PrivateKeyBytes_Box {
-		core.Error("missing or invalid GATEWAY_PRIVATE_KEY: %v", err)
-		return 1
-	}
+		// sessions that came through relays go back along their route, wrapped for the last relay
+
+		if sessionEntry != nil && sessionEntry.Relayed {
+			relayBuffer := pool.Get(MaxPacketSize + core.RelayOverheadBytes)
+			relayPacketBytes := core.WriteRelayPacket(relayBuffer.Data, forwardPacketData[0], sessionId, 0, nil, forwardPacketData, forwardFilterKey, config.GatewayAddress, &clientAddress)
+			forwardBuffer.Release()
+			if relayPacketBytes == 0 {
+				core.Debug("packet is too large to relay")
+				RelayPacketsDropped.Inc()
+				relayBuffer.Release()
+				continue
+			}
+			forwardBuffer = relayBuffer
+			forwardPacketBytes = relayPacketBytes
+		}
 
-	authPublicKey, err := envvar.GetBase64("AUTH_PUBLIC_KEY", nil)
-	if err != nil || len(authPublicKey) != core.PublicKeyBytes_Box {
-		core.Error("missing or invalid AUTH_PUBLIC_KEY: %v", err)
-		return 1
-	}
+		// send it to the client, through the load balancer it reaches us through if there is one
 
-	numThreads, err := envvar.GetInt("NUM_THREADS", 1)
-	if err != nil {
-		core.Error("invalid NUM_THREADS: %v", err)
-		return 1
-	}
+		sendAddress := &clientAddress
+		if sessionEntry != nil {
+			if proxyAddress := sessionEntry.ProxyAddress.Load(); proxyAddress != nil {
+				sendAddress = proxyAddress
+			}
+		}
 
-	readBuffer, err := envvar.GetInt("READ_BUFFER", 100000)
-	if err != nil {
-		core.Error("invalid READ_BUFFER: %v", err)
-		return 1
-	}
+		// the socket tags packets with the normal priority config.DSCP. packets the server sent with another
+		// priority are tagged on their own, so they can't go in a batch
 
-	writeBuffer, err := envvar.GetInt("WRITE_BUFFER", 100000)
-	if err != nil {
-		core.Error("invalid WRITE_BUFFER: %v", err)
-		return 1
-	}
+		var dscpControl []byte
+		priority := core.PriorityFromFlags(header[core.SessionIdBytes+core.SequenceBytes+core.AckBytes+core.AckBitsBytes+core.GatewayIdBytes+core.ServerIdBytes+core.PacketTypeBytes])
+		if config.DSCP[priority] != config.DSCP[core.PriorityNormal] {
+			dscpControl = core.DSCPControlMessage(config.DSCP[priority], sendAddress)
+		}
 
-	udpPort := envvar.Get("UDP_PORT", "40000")
+		if pacedSender != nil && sessionEntry != nil {
+			if delay := sessionEntry.Pacer.Delay(forwardPacketBytes, time.Now()); delay > 0 {
+				pacedSender.Send(delay, func() {
+					if _, _, err := config.PublicSockets[thread].WriteMsgUDP(forwardBuffer.Data[:forwardPacketBytes], dscpControl, sendAddress); err != nil {
+						ClientForwardLog.Error("failed to forward paced packet to client: %v", err)
+					} else {
+						PacketsForwardedToClient.Inc()
+						BytesForwardedToClient.Add(uint64(forwardPacketBytes))
+						recordPacketSent(sessionEntry, sequence, forwardPacketBytes)
+					}
+					forwardBuffer.Release()
+				})
+				PacedPacketsToClient.Inc()
+				continue
+			}
+		}
 
-	core.Info("starting gateway on port %s", udpPort)
+		if dscpControl != nil {
+			_, _, err = config.PublicSockets[thread].WriteMsgUDP(forwardBuffer.Data[:forwardPacketBytes], dscpControl, sendAddress)
+			forwardBuffer.Release()
+		} else {
+			err = clientWriter.WriteBuffer(forwardBuffer, forwardPacketBytes, sendAddress)
+		}
 
-	gatewayId := core.RandomBytes(core.GatewayIdBytes)
+		if err != nil {
+			ClientForwardLog.Error("failed to forward packet to client: %v", err)
+		} else {
+			PacketsForwardedToClient.Inc()
+			BytesForwardedToClient.Add(uint64(forwardPacketBytes))
+			if sessionEntry != nil {
+				recordPacketSent(sessionEntry, sequence, forwardPacketBytes)
+			}
+		}
 
-	core.Info("gateway id is %s", core.IdString(gatewayId))
+		core.Debug("send %d byte packet to %s", forwardPacketBytes, clientAddress.String())
+	}
+}
 
-	challengePrivateKey := core.Keygen_SecretBox()
+func refreshSessionToken(ctx context.Context, client *http.Client, authURL string, authBearerToken string, inputSessionTokenData [core.SignedSessionTokenBytes]byte, authSignPublicKeys [][]byte) SessionTokenUpdate {
 
-	ctx, ctxCancelFunc := context.WithCancel(context.Background())
+	defer SessionTokenRefreshLatency.ObserveSince(time.Now())
 
-	var wg sync.WaitGroup
+	ctx, span := tracing.StartSpan(ctx, "gateway.refresh_session_token")
+	defer span.End()
 
-	// --------------------------------------------------
+	r, err := http.NewRequestWithContext(ctx, "POST", authURL+"/session_token", bytes.NewBuffer(inputSessionTokenData[:]))
+	if err != nil {
+		core.Debug("failed to create post request: %v", err)
+		return SessionTokenUpdate{}
+	}
+	if authBearerToken != "" {
+		r.Header.Set("Authorization", "Bearer "+authBearerToken)
+	}
 
-	// Start HTTP server
-	{
-		router := mux.NewRouter()
-		router.HandleFunc("/health", healthHandler).Methods("GET")
-		router.HandleFunc("/status", statusHandler).Methods("GET")
+	response, err := client.Do(r)
+	if err != nil {
+		core.Debug("error on post request: %s", err)
+		return SessionTokenUpdate{}
+	}
 
-		httpPort := envvar.Get("HTTP_PORT", "40000")
+	defer response.Body.Close()
 
-		srv := &http.Server{
-			Addr:    ":" + httpPort,
-			Handler: router,
-		}
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		core.Debug("error reading response data: %v", err)
+		return SessionTokenUpdate{}
+	}
 
-		go func() {
-			core.Debug("started http server on port %s", httpPort)
-			err := srv.ListenAndServe()
-			if err != nil {
-				core.Error("failed to start http server: %v", err)
-				return
-			}
-		}()
+	if len(responseData) != core.SignedSessionTokenBytes {
+		core.Debug("bad response size: %d", len(responseData))
+		return SessionTokenUpdate{}
 	}
 
-	// --------------------------------------------------
+	sessionTokenData := make([]byte, core.SignedSessionTokenBytes)
+	copy(sessionTokenData[:], responseData[:])
 
-	// listen on public address
+	index := 0
+	var sessionToken core.SessionToken
+	result := core.ReadSignedSessionToken(responseData[:], &index, &sessionToken, authSignPublicKeys...)
+	if !result {
+		core.Debug("invalid session token")
+		return SessionTokenUpdate{}
+	}
 
-	wg.Add(numThreads)
+	return SessionTokenUpdate{SessionTokenData: sessionTokenData, ExpireTimestamp: sessionToken.ExpireTimestamp}
+}
 
-	publicSocket := make([]*net.UDPConn, numThreads)
+// extendSessionToken extends a session token locally and signs it with the delegate key, so long sessions
+// don't depend on the auth service being reachable
+func extendSessionToken(inputSessionTokenData [core.SignedSessionTokenBytes]byte, signPublicKeys [][]byte, delegatePrivateKey []byte) SessionTokenUpdate {
 
-	{
-		lc := net.ListenConfig{
-			Control: func(network string, address string, c syscall.RawConn) error {
-				err := c.Control(func(fileDescriptor uintptr) {
-					err := unix.SetsockoptInt(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
-					if err != nil {
-						panic(fmt.Sprintf("failed to set reuse address socket option: %v", err))
-					}
+	index := 0
+	var sessionToken core.SessionToken
+	if !core.ReadSignedSessionToken(inputSessionTokenData[:], &index, &sessionToken, signPublicKeys...) {
+		core.Debug("invalid session token")
+		return SessionTokenUpdate{}
+	}
 
-					err = unix.SetsockoptInt(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-					if err != nil {
-						panic(fmt.Sprintf("failed to set reuse port socket option: %v", err))
-					}
-				})
+	if Revocations.IsRevoked(sessionToken.SessionId[:], sessionToken.UserId[:], uint64(time.Now().Unix())) {
+		core.Debug("session %s is revoked", core.IdString(sessionToken.SessionId[:]))
+		return SessionTokenUpdate{}
+	}
 
-				return err
-			},
-		}
+	if err := core.ExtendSessionToken(&sessionToken, uint64(time.Now().Unix())); err != nil {
+		core.Debug("%v", err)
+		return SessionTokenUpdate{}
+	}
 
-		for i := 0; i < numThreads; i++ {
+	index = 0
+	sessionTokenData := make([]byte, core.SignedSessionTokenBytes)
+	core.WriteSignedSessionToken(sessionTokenData, &index, &sessionToken, delegatePrivateKey)
 
-			lp, err := lc.ListenPacket(ctx, "udp", "0.0.0.0:"+udpPort)
-			if err != nil {
-				panic(fmt.Sprintf("could not bind socket: %v", err))
-			}
+	SessionTokensExtended.Inc()
 
-			conn := lp.(*net.UDPConn)
+	return SessionTokenUpdate{SessionTokenData: sessionTokenData, ExpireTimestamp: sessionToken.ExpireTimestamp}
+}
 
-			if err := conn.SetReadBuffer(readBuffer); err != nil {
-				panic(fmt.Sprintf("could not set connection read buffer size: %v", err))
-			}
+// pollRevocations fetches the revocation list from the auth service, if it changed since the last poll
+func pollRevocations(client *http.Client, authURL string, authGatewayToken string) error {
 
-			if err := conn.SetWriteBuffer(writeBuffer); err != nil {
-				panic(fmt.Sprintf("could not set connection write buffer size: %v", err))
-			}
+	r, err := http.NewRequest("GET", fmt.Sprintf("%s/revocations?version=%d", authURL, Revocations.GetVersion()), nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+authGatewayToken)
 
-			publicSocket[i] = conn
-		}
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
 
-		for i := 0; i < numThreads; i++ {
+	defer response.Body.Close()
 
-			go func(thread int) {
+	if response.StatusCode == http.StatusNotModified {
+		return nil
+	}
 
-				conn := publicSocket[thread]
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
 
-				defer conn.Close()
+	var revocations core.Revocations
+	if err := json.NewDecoder(response.Body).Decode(&revocations); err != nil {
+		return err
+	}
 
-				buffer := [MaxPacketSize]byte{}
+	if err := Revocations.Set(revocations); err != nil {
+		return err
+	}
 
-				sessionMap_Old := make(map[[core.SessionIdBytes]byte]*SessionEntry)
-				sessionMap_New := make(map[[core.SessionIdBytes]byte]*SessionEntry)
+	core.Debug("revocation list version %d: %d sessions, %d users", revocations.Version, len(revocations.Sessions), len(revocations.Users))
 
-				swapTime := time.Now().Unix() + SessionMapSwapTime
-				swapCount := 0
+	return nil
+}
 
-				for {
+// sessionUserId returns the user id of a session the server sends to, or nil if it can't be read. sessions
+// without an entry here still have their session token in each packet from the server, and only this gateway
+// can decrypt it
+func sessionUserId(sessionEntry *SessionEntry, sessionId []byte, sessionTokenData []byte, gatewayPrivateKey []byte) []byte {
+	if sessionEntry != nil {
+		return sessionEntry.UserId[:]
+	}
+	var signedSessionTokenData [core.SignedSessionTokenBytes]byte
+	if !core.DecryptSessionToken(sessionTokenData, sessionId, signedSessionTokenData[:], gatewayPrivateKey) {
+		return nil
+	}
+	index := 0
+	var sessionToken core.SessionToken
+	if !core.ReadSessionToken(signedSessionTokenData[:], &index, &sessionToken) {
+		return nil
+	}
+	return sessionToken.UserId[:]
+}
 
-					packetBytes, from, err := conn.ReadFromUDP(buffer[:])
-					if err != nil {
-						core.Debug("failed to read udp packet: %v", err)
-						break
-					}
+// findSession looks up the session for a packet from the server. Server packets
+// arrive on any thread, so the session is looked up in every thread's session table.
+func findSession(sessionId []byte) *SessionEntry {
+	var key [core.SessionIdBytes]byte
+	copy(key[:], sessionId)
+	for _, table := range SessionTables {
+		if value := table.Get(key); value != nil {
+			return value.(*SessionEntry)
+		}
+	}
+	return nil
+}
 
-					swapCount++
-					if swapCount > 100 {
-						currentTime := time.Now().Unix()
-						if currentTime >= swapTime {
-							swapCount = 0
-							swapTime = currentTime + SessionMapSwapTime
-							sessionMap_Old = sessionMap_New
-							sessionMap_New = make(map[[core.SessionIdBytes]byte]*SessionEntry)
-						}
-					}
+// enableSegmentationOffload turns on gro and gso where they are wanted, and carries on without them where
+// they are not supported. Only the first thread logs, since every thread's sockets behave the same.
+func enableSegmentationOffload(reader *netio.BatchReader, writer *netio.BatchWriter, gro bool, gso bool, thread int) {
+	if gro {
+		if err := reader.EnableGRO(); err != nil && thread == 0 {
+			core.Info("receiving without gro: %v", err)
+		}
+	}
+	if gso {
+		if err := writer.EnableGSO(); err != nil && thread == 0 {
+			core.Info("sending without gso: %v", err)
+		}
+	}
+}
 
-					if packetBytes < core.MinPacketSize {
-						core.Debug("packet is too small")
-						continue
-					}
+// recordPacketSent tracks packets forwarded to a client for its path stats and usage.
+func recordPacketSent(sessionEntry *SessionEntry, sequence uint64, packetBytes int) {
+	ClientPacketsLost.Add(uint64(sessionEntry.PathStats.PacketSent(sequence, time.Now())))
+	sessionEntry.Usage.RecordDown(packetBytes)
+}
 
-					packetData := buffer[:packetBytes]
+// websocketHandler relays each websocket message to the gateway as a udp packet, and each packet the
+// gateway sends back as a websocket message. the same packet framing is used either way
+
+// publishSessionEvent publishes a session event with the session's totals and path stats so far
+func publishSessionEvent(eventType string, sessionEntry *SessionEntry, gatewayAddress *net.UDPAddr, reason string) {
+	currentTime := time.Now()
+	usage := sessionEntry.Usage.Get()
+	stats := sessionEntry.PathStats.Stats()
+	event := analytics.Event{
+		Type:           eventType,
+		Timestamp:      currentTime,
+		GatewayAddress: gatewayAddress.String(),
+		SessionId:      core.IdString(sessionEntry.SessionId[:]),
+		UserId:         core.IdString(sessionEntry.UserId[:]),
+		ClientAddress:  sessionEntry.ClientAddress.String(),
+		ServerAddress:  ServerPool.GetAddress(sessionEntry.ServerIndex).String(),
+		Relayed:        sessionEntry.Relayed,
+		BytesUp:        usage.BytesUp,
+		BytesDown:      usage.BytesDown,
+		PacketsUp:      usage.PacketsUp,
+		PacketsDown:    usage.PacketsDown,
+		RTT:            float64(stats.RTT) / float64(time.Millisecond),
+		Jitter:         float64(stats.Jitter) / float64(time.Millisecond),
+		PacketLoss:     stats.PacketLoss,
+		Reason:         reason,
+	}
+	if eventType == analytics.SessionStopEvent {
+		event.Duration = currentTime.Sub(sessionEntry.CreateTime).Seconds()
+	}
+	if clientStats := sessionEntry.ClientStats.Load(); clientStats != nil {
+		event.FrameRate = clientStats.FrameRate.String()
+		event.ClientRTT = float64(clientStats.RTT) / float64(time.Millisecond)
+		event.Platform = clientStats.Platform.String()
+	}
+	Analytics.Publish(event)
+}
 
-					core.Debug("recv %d byte packet from %s", packetBytes, from)
+// filterGatewayPacket runs the packet filters on a packet passed between gateways, and returns the filter key to
+// use for whatever is sent on
+// lookupSession starts looking up a session in the session store, or returns the record it found. It
+// returns pending while the lookup hasn't finished, for up to SessionLookupTimeout
+func lookupSession(sessionId [core.SessionIdBytes]byte) (*sessionstore.Record, bool) {
+	value, ok := SessionLookups.Load(sessionId)
+	if !ok {
+		var loaded bool
+		value, loaded = SessionLookups.LoadOrStore(sessionId, &SessionLookup{SessionId: sessionId, CreateTime: time.Now()})
+		if !loaded {
+			select {
+			case SessionLookupQueue <- value.(*SessionLookup):
+			default:
+				value.(*SessionLookup).Done.Store(true)
+			}
+		}
+	}
+	lookup := value.(*SessionLookup)
+	if !lookup.Done.Load() {
+		return nil, time.Since(lookup.CreateTime) < SessionLookupTimeout
+	}
+	if lookup.Record != nil {
+		SessionLookups.Delete(sessionId)
+	}
+	return lookup.Record, false
+}
 
-					// drop unknown packet versions
+func storeRecord(sessionEntry *SessionEntry) sessionstore.Record {
+	return sessionstore.Record{
+		ServerAddress: ServerPool.GetAddress(sessionEntry.ServerIndex).String(),
+		CreateTime:    sessionEntry.CreateTime,
+		Sequence:      sessionEntry.LastSequence.Load(),
+	}
+}
 
-					if packetData[0] != 0 {
-						core.Debug("unknown packet version: %d", packetData[0])
-						continue
-					}
+func filterGatewayPacket(packetData []byte, from *net.UDPAddr, gatewayAddress *net.UDPAddr) ([]byte, bool) {
 
-					// packet filter
+	var magic [8]byte
 
-					if !core.BasicPacketFilter(packetData, packetBytes) {
-						core.Debug("basic packet filter failed")
-						continue
-					}
+	var fromAddressBuffer [core.MaxAddressDataBytes]byte
+	var fromAddressPort uint16
 
-					var magic [8]byte
+	var toAddressBuffer [core.MaxAddressDataBytes]byte
+	var toAddressPort uint16
 
-					var fromAddressData [4]byte
-					var fromAddressPort uint16
+	fromAddressData := fromAddressBuffer[:core.GetAddressData(from, fromAddressBuffer[:], &fromAddressPort)]
+	toAddressData := toAddressBuffer[:core.GetAddressData(gatewayAddress, toAddressBuffer[:], &toAddressPort)]
 
-					var toAddressData [4]byte
-					var toAddressPort uint16
+	filterPacket := core.FilterPacket{
+		Data:            packetData,
+		From:            from,
+		Magic:           magic[:],
+		FromAddressData: fromAddressData,
+		FromAddressPort: fromAddressPort,
+		ToAddressData:   toAddressData,
+		ToAddressPort:   toAddressPort,
+	}
 
-					core.GetAddressData(from, fromAddressData[:], &fromAddressPort)
-					core.GetAddressData(gatewayAddress, toAddressData[:], &toAddressPort)
+	if FilterKeys != nil {
+		filterPacket.FilterKey, filterPacket.PreviousFilterKey = FilterKeys.Get(time.Now())
+	}
 
-					if !core.AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes) {
-						core.Debug("advanced packet filter failed")
-						continue
-					}
+	if !PacketFilters.Filter(&filterPacket) {
+		return nil, false
+	}
 
-					// before we decrypt the session token in place, save a copy of the encrypted data
+	return filterPacket.FilterKey, true
+}
 
-					sessionTokenIndex := core.VersionBytes + core.PacketTypeBytes + core.ChonkleBytes
-					sessionTokenData := packetData[sessionTokenIndex : sessionTokenIndex+core.EncryptedSessionTokenBytes]
+// gatewayPing answers pings from other gateways, and passes pongs for our own pings to the ping mesh
+func gatewayPing(writer *netio.BatchWriter, packetVersion byte, packetData []byte, from *net.UDPAddr, replyAddress *net.UDPAddr, gatewayAddress *net.UDPAddr) {
 
-					var sessionTokenDataCopy [core.EncryptedSessionTokenBytes]byte
+	var sequence uint64
+	if !core.PacketVersionSupported(packetData[0], packetVersion) || !core.ReadGatewayPingPacket(packetData, &sequence) {
+		core.Debug("invalid gateway ping from %s", from)
+		DroppedPackets.Inc()
+		return
+	}
 
-					copy(sessionTokenDataCopy[:], sessionTokenData[:])
+	filterKey, ok := filterGatewayPacket(packetData, from, gatewayAddress)
+	if !ok {
+		return
+	}
 
-					sessionTokenSequenceIndex := sessionTokenIndex + core.EncryptedSessionTokenBytes
-					index := sessionTokenSequenceIndex
-					sessionTokenSequence := uint64(0)
-					core.ReadUint64(packetData, &index, &sessionTokenSequence)
+	if packetData[core.VersionBytes] == core.GatewayPongPacket {
+		if PingMesh == nil || !PingMesh.ReceivedPong(from, sequence, time.Now()) {
+			core.Debug("unexpected gateway pong from %s", from)
+			DroppedPackets.Inc()
+			return
+		}
+		GatewayPongsReceived.Inc()
+		return
+	}
 
-					// verify session token
+	buffer := pool.Get(core.GatewayPingPacketBytes)
+	packetBytes := core.WriteGatewayPingPacket(buffer.Data, packetData[0], core.GatewayPongPacket, sequence, filterKey, gatewayAddress, from)
+	if err := writer.WriteBuffer(buffer, packetBytes, replyAddress); err != nil {
+		core.Debug("failed to answer gateway ping from %s: %v", from, err)
+	}
+}
 
-					index = 0
-					var sessionToken core.SessionToken
-					result := core.ReadEncryptedSessionToken(sessionTokenData, &index, &sessionToken, authPublicKey, gatewayPrivateKey)
-					if !result {
-						core.Debug("could not decrypt session token")
-						continue
-					}
+// pollMeshPeers sets the gateways in the ping mesh to the ones the router plans routes across
+func pollMeshPeers(client *http.Client, routerURL string, routerToken string) error {
 
-					if sessionToken.ExpireTimestamp < uint64(time.Now().Unix()) {
-						core.Debug("session token has expired")
-						continue
-					}
+	r, err := http.NewRequest("GET", routerURL+"/gateways", nil)
+	if err != nil {
+		return err
+	}
+	if routerToken != "" {
+		r.Header.Set("Authorization", "Bearer "+routerToken)
+	}
 
-					sessionIdIndex := core.PrefixBytes
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
 
-					senderPublicKey := packetData[sessionIdIndex : sessionIdIndex+core.SessionIdBytes]
+	defer response.Body.Close()
 
-					var sessionId [core.SessionIdBytes]byte
-					copy(sessionId[:], senderPublicKey[:])
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
 
-					if !core.IdEqual(sessionToken.SessionId[:], sessionId[:]) {
-						core.Debug("session id mismatch")
-						continue
-					}
+	var gateways []string
+	if err := json.NewDecoder(response.Body).Decode(&gateways); err != nil {
+		return err
+	}
 
-					// decrypt packet
+	peers := make([]*net.UDPAddr, 0, len(gateways))
+	for _, gateway := range gateways {
+		address, err := core.ResolveAddress(gateway)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, address)
+	}
 
-					sequenceIndex := sessionIdIndex + core.SessionIdBytes
-					encryptedDataIndex := core.PrefixBytes + core.SessionIdBytes + core.SequenceBytes
+	PingMesh.SetPeers(peers)
 
-					sequenceData := packetData[sequenceIndex : sequenceIndex+core.SequenceBytes]
-					encryptedData := packetData[encryptedDataIndex : packetBytes-core.PittleBytes]
+	return nil
+}
 
-					nonce := make([]byte, core.NonceBytes_Box)
-					for i := 0; i < core.SequenceBytes; i++ {
-						nonce[i] = sequenceData[i]
-					}
+// reportPingMesh posts the measured links to the other gateways to the router
+func reportPingMesh(client *http.Client, routerURL string, routerToken string, gatewayAddress *net.UDPAddr) error {
 
-					err = core.Decrypt_Box(senderPublicKey, gatewayPrivateKey, nonce, encryptedData, len(encryptedData))
-					if err != nil {
-						core.Debug("could not decrypt payload packet")
-						continue
-					}
+	var measurements []router.Measurement
+	for _, peer := range PingMesh.Stats() {
+		if !peer.HasResponse {
+			continue
+		}
+		measurements = append(measurements, router.Measurement{From: gatewayAddress.String(), To: peer.Address, RTT: peer.RTT, Jitter: peer.Jitter, PacketLoss: peer.PacketLoss})
+	}
 
-					// split packet into various pieces
+	if len(measurements) == 0 {
+		return nil
+	}
 
-					headerIndex := core.PrefixBytes
+	data, err := json.Marshal(measurements)
+	if err != nil {
+		return err
+	}
 
-					payloadIndex := headerIndex + core.HeaderBytes
-					payloadBytes := packetBytes - payloadIndex - core.PostfixBytes
+	r, err := http.NewRequest("POST", routerURL+"/rtt", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if routerToken != "" {
+		r.Header.Set("Authorization", "Bearer "+routerToken)
+	}
 
-					header := packetData[headerIndex : headerIndex+core.HeaderBytes]
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
 
-					payload := packetData[payloadIndex : payloadIndex+payloadBytes]
+	defer response.Body.Close()
 
-					// ignore packet types we don't support
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
 
-					packetType := header[core.SessionIdBytes+core.SequenceBytes+core.AckBytes+core.AckBitsBytes+core.GatewayIdBytes+core.ServerIdBytes]
-					if packetType != core.PayloadPacket {
-						core.Debug("invalid packet type: %d", packetType)
-						continue
-					}
+	return nil
+}
 
-					// get packet sequence number
+// cookieExempt is true for addresses that never have to echo a cookie: the loopback sockets of tunnelled clients,
+// and the other gateways in the ping mesh, which relay packets for sessions that echoed a cookie at the first hop
+func cookieExempt(from *net.UDPAddr) bool {
+	return from.IP.IsLoopback() || (PingMesh != nil && PingMesh.IsPeer(from))
+}
 
-					index = 0
-					sequence := uint64(0)
-					core.ReadUint64(sequenceData, &index, &sequence)
+// sendCookie answers a packet from an unknown address with a cookie for that address. Cookies are smaller than
+// any packet that gets one, so they can't be used to amplify an attack
+func sendCookie(writer *netio.BatchWriter, packetVersion byte, from *net.UDPAddr, replyAddress *net.UDPAddr) {
+	buffer := pool.Get(core.CookiePacketBytes)
+	packetBytes := core.WriteCookiePacket(buffer.Data, packetVersion, core.GenerateCookie(CookieKey, from, time.Now()))
+	if err := writer.WriteBuffer(buffer, packetBytes, replyAddress); err != nil {
+		CookieSendLog.Error("failed to send cookie: %v", err)
+		return
+	}
+	CookiesSent.Inc()
+}
 
-					// get packet gateway id
+// updateCookiesRequired requires cookies in auto mode while packets from unknown addresses arrive faster than
+// CookiePacketsPerSecond, and for CookieCooldown after they slow down
+func updateCookiesRequired(packetsPerSecond uint64, lastAttackTime *time.Time, currentTime time.Time) {
+	if CookieMode.Load().(string) != "auto" {
+		return
+	}
+	if packetsPerSecond > CookiePacketsPerSecond {
+		*lastAttackTime = currentTime
+		if CookiesRequired.CompareAndSwap(false, true) {
+			core.Warn("%d packets per second from unknown addresses. cookies are required", packetsPerSecond)
+		}
+	} else if currentTime.Sub(*lastAttackTime) >= CookieCooldown {
+		if CookiesRequired.CompareAndSwap(true, false) {
+			core.Info("packets from unknown addresses are back under %d per second. cookies are no longer required", CookiePacketsPerSecond)
+		}
+	}
+}
 
-					gatewayIdIndex := headerIndex + core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes
+// relayPacket passes a relay packet on to the next or previous hop of its route. The route token for this
+// hop is checked when the route is set up, and again if the previous hop's address changes. It returns the
+// inner packet when the route ends at this gateway, to be processed like any other client packet
+func relayPacket(writer *netio.BatchWriter, packetVersion byte, packetData []byte, from *net.UDPAddr, replyAddress *net.UDPAddr, gatewayAddress *net.UDPAddr, authPublicKey []byte, gatewayPrivateKey []byte, cookieEchoed bool) []byte {
 
-					index = 0
-					var packetGatewayId [core.GatewayIdBytes]byte
-					core.ReadBytes(packetData[gatewayIdIndex:gatewayIdIndex+core.GatewayIdBytes], &index, packetGatewayId[:], core.GatewayIdBytes)
+	var relay core.RelayPacketData
+	if !core.PacketVersionSupported(packetData[0], packetVersion) || !core.ReadRelayPacket(packetData, &relay) {
+		core.Debug("invalid relay packet from %s", from)
+		DroppedPackets.Inc()
+		return nil
+	}
 
-					// get challenge token data
+	// relay packets go on in the protocol version they arrived in
 
-					flagsIndex := core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes + core.GatewayIdBytes + core.ServerIdBytes + core.PacketTypeBytes
-					var challengeTokenData []byte
-					hasChallengeToken := (header[flagsIndex] & core.Flags_ChallengeToken) != 0
-					if hasChallengeToken {
-						challengeTokenData = payload[0:core.EncryptedChallengeTokenBytes]
-						payload = payload[core.EncryptedChallengeTokenBytes:]
-					}
+	packetVersion = packetData[0]
 
-					// clear flags in header
+	filterKey, ok := filterGatewayPacket(packetData, from, gatewayAddress)
+	if !ok {
+		return nil
+	}
 
-					header[flagsIndex] = 0
+	var sessionId [core.SessionIdBytes]byte
+	copy(sessionId[:], relay.SessionId)
 
-					// process payload packet
+	var routeEntry *RouteEntry
+	if value := RouteTable.Get(sessionId); value != nil {
+		routeEntry = value.(*RouteEntry)
+	}
 
-					core.Debug("payload is %d bytes", len(payload))
+	// replies from the next hop go back the way the session came. the first relay unwraps them for the client
 
-					sessionEntry := sessionMap_New[sessionId]
-					if sessionEntry == nil {
-						sessionEntry = sessionMap_Old[sessionId]
-						if sessionEntry != nil {
-							// migrate old -> new session map
-							sessionMap_New[sessionId] = sessionEntry
-						}
-					}
+	if relay.NumRouteTokens == 0 && routeEntry != nil && core.AddressEqual(from, routeEntry.NextAddress) {
 
-					if sessionEntry == nil {
+		buffer := pool.Get(MaxPacketSize + core.MaxRelayBytes)
 
-						// *** no session entry ***
+		packetBytes := 0
+		if routeEntry.Hop == 0 {
+			if len(relay.InnerPacket) >= core.VersionBytes+core.PacketTypeBytes+core.ChonkleBytes+core.PittleBytes {
+				packetBytes = copy(buffer.Data, relay.InnerPacket)
+				core.WritePacketFilter(buffer.Data[:packetBytes], filterKey, gatewayAddress, routeEntry.PrevAddress)
+			}
+		} else {
+			packetBytes = core.WriteRelayPacket(buffer.Data, packetVersion, sessionId[:], 0, nil, relay.InnerPacket, filterKey, gatewayAddress, routeEntry.PrevAddress)
+		}
 
-						if hasChallengeToken {
+		if packetBytes == 0 {
+			core.Debug("invalid relay packet from %s", from)
+			RelayPacketsDropped.Inc()
+			buffer.Release()
+			return nil
+		}
 
-							// payload packet has a challenge token (challenge/response)
+		if err := writer.WriteBuffer(buffer, packetBytes, routeEntry.PrevSendAddress); err != nil {
+			ClientForwardLog.Error("failed to relay packet to previous hop: %v", err)
+		} else {
+			PacketsRelayedToPrevious.Inc()
+		}
 
-							index := 0
-							var challengeToken core.ChallengeToken
-							result := core.ReadEncryptedChallengeToken(challengeTokenData, &index, &challengeToken, challengePrivateKey)
-							if !result {
-								core.Debug("challenge token did not decrypt")
-								continue
-							}
+		RouteTable.Touch(sessionId, time.Now())
 
-							if challengeToken.ExpireTimestamp <= uint64(time.Now().Unix()) {
-								core.Debug("challenge token expired")
-								continue
-							}
+		return nil
+	}
 
-							if !core.AddressEqual(&challengeToken.ClientAddress, from) {
-								core.Debug("challenge token client address mismatch")
-								continue
-							}
+	if relay.NumRouteTokens == 0 {
+		return relay.InnerPacket
+	}
 
-							var sessionId [core.SessionIdBytes]byte
-							for i := 0; i < core.SessionIdBytes; i++ {
-								sessionId[i] = senderPublicKey[i]
-							}
+	if routeEntry == nil && DrainStartTime.Load() != 0 {
+		core.Debug("draining. not accepting route for session %s", core.IdString(sessionId[:]))
+		DrainRejectedPackets.Inc()
+		return nil
+	}
 
-							// create new session entry
+	if routeEntry == nil || !core.AddressEqual(from, routeEntry.PrevAddress) {
 
-							sessionEntry := &SessionEntry{ReceivedSequence: challengeToken.Sequence}
+		if !cookieEchoed && !cookieExempt(from) {
+			UnknownSourcePackets.Inc()
+			if CookiesRequired.Load() {
+				sendCookie(writer, packetVersion, from, replyAddress)
+				return nil
+			}
+		}
 
-							sessionEntry.SessionTokenChannel = make(chan SessionTokenUpdate, 1)
-							copy(sessionEntry.SessionTokenData[:], sessionTokenDataCopy[:])
-							sessionEntry.SessionTokenExpireTimestamp = sessionToken.ExpireTimestamp
-							sessionEntry.SessionTokenSequence = sessionTokenSequence
-							sessionEntry.ReceiveBandwidthBitsPerSecondMax = uint64(sessionToken.EnvelopeUpKbps * 1000.0)
-							sessionEntry.PacketsPerSecondMax = uint64(float32(sessionToken.PacketsPerSecond) * 1.1)
+		index := 0
+		var routeToken core.RouteToken
+		if !core.ReadEncryptedRouteToken(relay.RouteTokens, &index, &routeToken, authPublicKey, gatewayPrivateKey) {
+			core.Debug("could not decrypt route token")
+			RelayPacketsDropped.Inc()
+			return nil
+		}
 
-							sessionEntry.ReceiveBandwidthBitsResetTime = time.Now().Add(time.Second)
+		if routeToken.ExpireTimestamp <= uint64(time.Now().Unix()) {
+			core.Debug("route token expired")
+			RelayPacketsDropped.Inc()
+			return nil
+		}
 
-							sessionMap_New[sessionId] = sessionEntry
+		if !core.IdEqual(routeToken.SessionId[:], sessionId[:]) {
+			core.Debug("route token session id mismatch")
+			RelayPacketsDropped.Inc()
+			return nil
+		}
 
-							core.Info("new session %s from %s", core.IdString(sessionId[:]), from.String())
+		nextAddress := routeToken.NextAddress
 
-						} else {
+		routeEntry = &RouteEntry{PrevAddress: from, PrevSendAddress: replyAddress, NextAddress: &nextAddress, Hop: routeToken.Hop}
 
-							// respond with a challenge
+		RouteTable.Insert(sessionId, routeEntry, time.Now())
 
-							challengePacketData := make([]byte, MaxPacketSize)
+		RoutesCreated.Inc()
 
-							challengeToken := core.ChallengeToken{}
-							challengeToken.ExpireTimestamp = uint64(time.Now().Unix() + ChallengeTokenTimeout)
-							challengeToken.ClientAddress = *from
-							challengeToken.Sequence = sequence
+		core.Info("relaying session %s from %s to %s", core.IdString(sessionId[:]), from, &nextAddress)
+	}
 
-							nonce := [core.NonceBytes_Box]byte{}
-							core.RandomBytes_InPlace(nonce[:])
-							nonce[9] &= 1 ^ (1 << 0)
-							nonce[9] |= (1 << 1)
+	buffer := pool.Get(MaxPacketSize + core.MaxRelayBytes)
 
-							index := 0
+	packetBytes := core.WriteRelayPacket(buffer.Data, packetVersion, sessionId[:], relay.NumRouteTokens-1, relay.RouteTokens[core.EncryptedRouteTokenBytes:], relay.InnerPacket, filterKey, gatewayAddress, routeEntry.NextAddress)
+	if packetBytes == 0 {
+		core.Debug("invalid relay packet from %s", from)
+		RelayPacketsDropped.Inc()
+		buffer.Release()
+		return nil
+	}
 
-							dummySessionToken := [core.EncryptedSessionTokenBytes]byte{}
-							dummySessionTokenSequence := uint64(0)
+	if err := writer.WriteBuffer(buffer, packetBytes, routeEntry.NextAddress); err != nil {
+		ServerForwardLog.Error("failed to relay packet to next hop: %v", err)
+	} else {
+		PacketsRelayedToNext.Inc()
+	}
 
-							version := byte(0)
-							core.WriteUint8(challengePacketData, &index, version)
-							core.WriteUint8(challengePacketData, &index, core.ChallengePacket)
-							chonkle := challengePacketData[index : index+core.ChonkleBytes]
-							index += core.ChonkleBytes
-							core.WriteBytes(challengePacketData, &index, dummySessionToken[:], core.EncryptedSessionTokenBytes)
-							core.WriteUint64(challengePacketData, &index, dummySessionTokenSequence)
-							core.WriteBytes(challengePacketData, &index, nonce[:], core.NonceBytes_Box)
-							encryptStart := index
-							core.WriteEncryptedChallengeToken(challengePacketData, &index, &challengeToken, challengePrivateKey)
-							core.WriteUint64(challengePacketData, &index, sequence)
-							core.WriteBytes(challengePacketData, &index, gatewayId[:], core.GatewayIdBytes)
-							encryptFinish := index
-							index += core.HMACBytes_Box
-							pittle := challengePacketData[index : index+core.PittleBytes]
-							index += core.PittleBytes
+	RouteTable.Touch(sessionId, time.Now())
 
-							challengePacketBytes := index
-							challengePacketData = challengePacketData[:challengePacketBytes]
+	return nil
+}
 
-							core.Encrypt_Box(gatewayPrivateKey, sessionId[:], nonce[:], challengePacketData[encryptStart:encryptFinish], encryptFinish-encryptStart)
+func websocketHandler(gatewayAddress *net.UDPAddr) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-							// setup packet prefix and postfix
+		relayConn, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+		if err != nil {
+			core.Error("could not create websocket relay socket: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 
-							var magic [core.MagicBytes]byte
+		header := http.Header{}
+		header.Set(core.WebSocketClientAddressHeader, relayConn.LocalAddr().String())
 
-							var fromAddressData [4]byte
-							var fromAddressPort uint16
+		conn, err := websocket.Upgrade(w, r, header)
+		if err != nil {
+			core.Debug("websocket upgrade failed: %v", err)
+			relayConn.Close()
+			return
+		}
 
-							var toAddressData [4]byte
-							var toAddressPort uint16
+		WebSocketConnections.Add(1)
 
-							core.GetAddressData(gatewayAddress, fromAddressData[:], &fromAddressPort)
-							core.GetAddressData(from, toAddressData[:], &toAddressPort)
+		core.Debug("websocket client %s relayed from %s", conn.RemoteAddr(), relayConn.LocalAddr())
 
-							core.GenerateChonkle(chonkle[:], magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes)
+		relayPackets(relayConn, conn.RemoteAddr(), gatewayAddress, conn.ReadMessage, conn.WriteMessage, func() { conn.Close() })
 
-							core.GeneratePittle(pittle[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes)
+		WebSocketConnections.Add(-1)
 
-							if !core.BasicPacketFilter(challengePacketData, challengePacketBytes) {
-								panic("basic packet filter failed")
-							}
+		core.Debug("websocket client %s disconnected", conn.RemoteAddr())
+	}
+}
 
-							if !core.AdvancedPacketFilter(challengePacketData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, challengePacketBytes) {
-								panic("advanced packet filter failed")
-							}
+// webTransportHandler relays packets to and from webtransport datagrams. browsers only take datagrams of a
+// little over 1200 bytes, so packets are split into fragments of at most WebTransportDatagramBytes, in the
+// same format as fragmented payloads. browsers can't read the response headers either, so the relay address
+// is sent on a unidirectional stream instead, before any datagrams
 
-							// send it to the client
+func webTransportHandler(server *webtransport.Server, gatewayAddress *net.UDPAddr) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-							if _, err := conn.WriteToUDP(challengePacketData, from); err != nil {
-								core.Error("failed to send challenge packet to client: %v", err)
-							}
+		relayConn, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+		if err != nil {
+			core.Error("could not create webtransport relay socket: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 
-							core.Debug("send %d byte challenge packet to %s", len(challengePacketData), from.String())
+		session, err := server.Upgrade(w, r)
+		if err != nil {
+			core.Debug("webtransport upgrade failed: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			relayConn.Close()
+			return
+		}
 
-						}
+		stream, err := session.OpenUniStream()
+		if err == nil {
+			_, err = stream.Write([]byte(relayConn.LocalAddr().String()))
+			stream.Close()
+		}
+		if err != nil {
+			core.Debug("could not send webtransport client address: %v", err)
+			session.CloseWithError(0, "")
+			relayConn.Close()
+			return
+		}
 
-						continue
-					}
+		WebTransportSessions.Add(1)
 
-					// drop packets without the correct gateway id
+		core.Debug("webtransport client %s relayed from %s", session.RemoteAddr(), relayConn.LocalAddr())
 
-					if !core.IdEqual(packetGatewayId[:], gatewayId[:]) {
-						core.Debug("wrong gateway id")
-						continue
-					}
+		reassembler := core.CreateReassembler(WebTransportReassemblyTimeout, WebTransportReassemblyMemory)
 
-					// drop packets that are too old
+		receivePacket := func() ([]byte, error) {
+			for {
+				datagram, err := session.ReceiveDatagram(session.Context())
+				if err != nil {
+					return nil, err
+				}
+				packetData, err := reassembler.ProcessFragment(datagram, time.Now())
+				if err != nil {
+					core.Debug("invalid webtransport datagram: %v", err)
+					DroppedPackets.Inc()
+					continue
+				}
+				if packetData != nil {
+					return packetData, nil
+				}
+			}
+		}
 
-					oldSequence := uint64(0)
+		// fragments larger than the connection takes in a datagram are dropped, like packets over the path mtu
 
-					if sessionEntry.ReceivedSequence > OldSequenceThreshold {
-						oldSequence = sessionEntry.ReceivedSequence - OldSequenceThreshold
-					}
+		packetId := uint16(0)
 
-					if sequence < oldSequence {
-						core.Debug("sequence number is too old: %d", sequence)
-						continue
-					}
+		sendPacket := func(packetData []byte) error {
+			fragments, err := tunnel.Fragment(packetId, packetData, WebTransportDatagramBytes)
+			if err != nil {
+				return err
+			}
+			packetId++
+			for _, fragment := range fragments {
+				err := session.SendDatagram(fragment)
+				var tooLarge *quic.DatagramTooLargeError
+				if errors.As(err, &tooLarge) {
+					WebTransportDatagramsTooLarge.Inc()
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
 
-					// drop packets that have already been forwarded to the server
+		relayPackets(relayConn, session.RemoteAddr(), gatewayAddress, receivePacket, sendPacket, func() { session.CloseWithError(0, "") })
 
-					if sessionEntry.ReceivedPackets[sequence%OldSequenceThreshold] == sequence {
-						core.Debug("packet %d has already been forwarded to the server", sequence)
-					}
+		WebTransportSessions.Add(-1)
 
-					// do we have enough bandwidth available to receive this packet?
+		core.Debug("webtransport client %s disconnected", session.RemoteAddr())
+	}
+}
 
-					if sessionEntry.ReceiveBandwidthBitsResetTime.Before(time.Now()) {
-						receiveBandwidthMbps := float64(sessionEntry.ReceiveBandwidthBitsAccumulator) / 1000000.0
-						sessionEntry.ReceiveBandwidthBitsResetTime = time.Now().Add(time.Second)
-						sessionEntry.ReceiveBandwidthBitsAccumulator = 0
-						sessionEntry.PacketsReceivedInLastSecond = 0
-						core.Debug("session %s is %.2f mbps", core.IdString(sessionId[:]), receiveBandwidthMbps)
-					}
+// relayQUICConnection relays packets to and from a client in quic mode. QUIC finds the largest datagram
+// the path takes, so packets are only fragmented when they don't fit in one
 
-					wireBits := uint64(core.WirePacketBits(len(packetData)))
+func relayQUICConnection(conn *quic.Conn, gatewayAddress *net.UDPAddr) {
 
-					canReceivePacket := true
+	relayConn, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+	if err != nil {
+		core.Error("could not create quic relay socket: %v", err)
+		conn.CloseWithError(0, "")
+		return
+	}
 
-					if sessionEntry.ReceiveBandwidthBitsAccumulator+wireBits <= sessionEntry.ReceiveBandwidthBitsPerSecondMax {
-						sessionEntry.ReceiveBandwidthBitsAccumulator += wireBits
-					} else {
-						canReceivePacket = false
-					}
+	tunnelConn, err := tunnel.Accept(conn, relayConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		core.Debug("could not accept quic connection: %v", err)
+		conn.CloseWithError(0, "")
+		relayConn.Close()
+		return
+	}
 
-					if !canReceivePacket {
-						core.Debug("choke bw")
-						continue
-					}
+	QUICConnections.Add(1)
 
-					// too many packets per-second?
+	core.Debug("quic client %s relayed from %s", conn.RemoteAddr(), relayConn.LocalAddr())
 
-					if sessionEntry.PacketsReceivedInLastSecond > sessionEntry.PacketsPerSecondMax {
-						canReceivePacket = false
-						core.Debug("choke pps")
-						continue						
-					}
+	relayPackets(relayConn, conn.RemoteAddr(), gatewayAddress, tunnelConn.ReadPacket, tunnelConn.WritePacket, func() { tunnelConn.Close() })
 
-					sessionEntry.PacketsReceivedInLastSecond++
+	QUICConnections.Add(-1)
 
-					// update session token
+	core.Debug("quic client %s disconnected", conn.RemoteAddr())
+}
 
-					if sessionEntry.SessionTokenExpireTimestamp-uint64(10) <= uint64(time.Now().Unix()) && !sessionEntry.UpdatingSessionToken && sessionEntry.SessionTokenCooldown.Before(time.Now()) {
+func relayDTLSConnection(conn net.Conn, gatewayAddress *net.UDPAddr) {
 
-						sessionEntry.UpdatingSessionToken = true
+	relayConn, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+	if err != nil {
+		core.Error("could not create dtls relay socket: %v", err)
+		conn.Close()
+		return
+	}
 
-						if sessionEntry.SessionTokenRetryCount == 0 {
-							core.Debug("updating session token %s", core.IdString(sessionToken.SessionId[:]))
-						} else {
-							core.Debug("updating session token %s retry #%d", core.IdString(sessionToken.SessionId[:]), sessionEntry.SessionTokenRetryCount)
-						}
+	tunnelConn, err := tunnel.AcceptDTLS(conn, relayConn.LocalAddr().(*net.UDPAddr), DTLSHandshakeTimeout)
+	if err != nil {
+		core.Debug("could not accept dtls connection: %v", err)
+		conn.Close()
+		relayConn.Close()
+		return
+	}
 
-						go func(channel chan SessionTokenUpdate, inputSessionTokenData [core.EncryptedSessionTokenBytes]byte) {
+	DTLSConnections.Add(1)
 
-							var netTransport = &http.Transport{
-								Dial: (&net.Dialer{
-									Timeout: time.Second,
-								}).Dial,
-								TLSHandshakeTimeout: time.Second,
-							}
+	core.Debug("dtls client %s relayed from %s", conn.RemoteAddr(), relayConn.LocalAddr())
 
-							var c = &http.Client{
-								Timeout:   time.Second,
-								Transport: netTransport,
-							}
+	relayPackets(relayConn, conn.RemoteAddr(), gatewayAddress, tunnelConn.ReadPacket, tunnelConn.WritePacket, func() { tunnelConn.Close() })
 
-							r, err := http.NewRequest("POST", "http://localhost:60000/session_token", bytes.NewBuffer(inputSessionTokenData[:]))
-							if err != nil {
-								core.Debug("failed to create post request: %v", err)
-								channel <- SessionTokenUpdate{}
-								return
-							}
-							response, err := c.Do(r)
+	DTLSConnections.Add(-1)
 
-							if response == nil {
-								core.Debug("nil response from post")
-								channel <- SessionTokenUpdate{}
-								return
-							}
+	core.Debug("dtls client %s disconnected", conn.RemoteAddr())
+}
 
-							defer response.Body.Close()
+// relayPackets forwards packets between a tunnelled client and the gateway through a loopback socket, so the
+// gateway sees them like packets from any other client. it returns once either side is closed
 
-							if err != nil {
-								core.Debug("error on post request: %s", err)
-								channel <- SessionTokenUpdate{}
-								return
-							}
+func relayPackets(relayConn *net.UDPConn, clientAddress net.Addr, gatewayAddress *net.UDPAddr, readPacket func() ([]byte, error), writePacket func(packetData []byte) error, closeTunnel func()) {
 
-							responseData, err := ioutil.ReadAll(response.Body)
-							if err != nil {
-								core.Debug("error reading response data: %v")
-								channel <- SessionTokenUpdate{}
-								return
-							}
+	// session tokens bound to a client ip are checked against the tunnelled client, not the relay socket
 
-							if len(responseData) != core.EncryptedSessionTokenBytes {
-								core.Debug("bad response size: %d", len(responseData))
-								channel <- SessionTokenUpdate{}
-								return
-							}
+	relayAddress := relayConn.LocalAddr().String()
+	if clientIP := addressIP(clientAddress); clientIP != nil {
+		RelayClientIPs.Store(relayAddress, clientIP)
+		defer RelayClientIPs.Delete(relayAddress)
+	}
 
-							sessionTokenData := make([]byte, core.EncryptedSessionTokenBytes)
-							copy(sessionTokenData[:], responseData[:])
+	go func() {
+		packetData := make([]byte, MaxPacketSize)
+		for {
+			packetBytes, from, err := relayConn.ReadFromUDP(packetData)
+			if err != nil {
+				break
+			}
+			if !core.AddressEqual(from, gatewayAddress) {
+				continue
+			}
+			if err := writePacket(packetData[:packetBytes]); err != nil {
+				break
+			}
+		}
+		closeTunnel()
+	}()
 
-							index := 0
-							var sessionToken core.SessionToken
-							result := core.ReadEncryptedSessionToken(responseData[:], &index, &sessionToken, authPublicKey[:], gatewayPrivateKey[:])
-							if !result {
-								core.Debug("invalid session token")
-								channel <- SessionTokenUpdate{}
-								return
-							}
+	for {
+		packetData, err := readPacket()
+		if err != nil {
+			break
+		}
+		if len(packetData) > MaxPacketSize {
+			DroppedPackets.Inc()
+			continue
+		}
+		if _, err := relayConn.WriteToUDP(packetData, gatewayAddress); err != nil {
+			core.Debug("failed to relay packet: %v", err)
+		}
+	}
 
-							channel <- SessionTokenUpdate{SessionTokenData: sessionTokenData, ExpireTimestamp: sessionToken.ExpireTimestamp}
+	relayConn.Close()
+	closeTunnel()
+}
 
-						}(sessionEntry.SessionTokenChannel, sessionTokenDataCopy)
-					}
+func addressIP(address net.Addr) net.IP {
+	switch address := address.(type) {
+	case *net.UDPAddr:
+		return address.IP
+	case *net.TCPAddr:
+		return address.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
 
-					if sessionEntry.UpdatingSessionToken {
-						select {
-						case update := <-sessionEntry.SessionTokenChannel:
-							if len(update.SessionTokenData) != 0 {
-								copy(sessionEntry.SessionTokenData[:], update.SessionTokenData[:])
-								sessionEntry.SessionTokenExpireTimestamp = update.ExpireTimestamp
-								sessionEntry.SessionTokenSequence++
-								sessionEntry.SessionTokenRetryCount = 0
-								core.Info("updated session token for session %s %d", core.IdString(sessionId[:]), sessionEntry.SessionTokenSequence)
-							} else {
-								core.Debug("failed to update session token %s :(", core.IdString(sessionId[:]))
-								sessionEntry.SessionTokenRetryCount++
-								sessionEntry.SessionTokenCooldown = time.Now().Add(time.Second)
-							}
-							sessionEntry.UpdatingSessionToken = false
-						default:
-						}
-					}
+// ReloadableConfig is the configuration that can be changed without a restart, by editing CONFIG_FILE
+type ReloadableConfig struct {
+	ServerAddresses           []*net.UDPAddr
+	RateLimitPacketsPerSecond float64
+	RateLimitBurst            float64
+	Blocklist                 []*net.IPNet
+	LogLevel                  *log.Level
+	Tenants                   map[uint16]*Tenant
+}
 
-					// forward payload packet to server
+// Tenant is one customer sharing the gateway. Its session tokens carry its tenant id and are only accepted
+// when signed by its own keys, and its sessions go to its own servers, so games sharing a fleet are isolated
+// from each other. Tenants are configured under tenants in CONFIG_FILE, keyed by tenant id:
+//
+//	tenants:
+//	  7:
+//	    auth_sign_public_keys: [...]
+//	    auth_url: https://auth.example.com
+//	    server_addresses: [10.0.1.1:50000]
+//	    bandwidth_limit_up_kbps: 512
+//	    max_sessions: 10000
+//
+// Only auth_sign_public_keys is required. Tenants without servers share the default servers, and limits
+// that aren't set are the gateway's own.
+type Tenant struct {
+	Id                     uint16
+	AuthSignPublicKeys     [][]byte
+	AuthURL                string
+	AuthBearerToken        string
+	ServerAddresses        []*net.UDPAddr
+	BandwidthLimitUpKbps   float64
+	BandwidthLimitDownKbps float64
+	MaxSessions            int
+
+	// SessionTokenSignKeys are the auth keys and the delegate key, if there is one
+	SessionTokenSignKeys [][]byte
+}
 
-					forwardPacketData := make([]byte, MaxPacketSize)
+// BandwidthLimits returns the tenant's session bandwidth limits, or the gateway limits where it has none
+func (tenant *Tenant) BandwidthLimits(upKbps float64, downKbps float64) (float64, float64) {
+	if tenant.BandwidthLimitUpKbps > 0 {
+		upKbps = tenant.BandwidthLimitUpKbps
+	}
+	if tenant.BandwidthLimitDownKbps > 0 {
+		downKbps = tenant.BandwidthLimitDownKbps
+	}
+	return upKbps, downKbps
+}
 
-					index = 0
+func readTenants(fileConfig *config.Config) (map[uint16]*Tenant, error) {
 
-					version := byte(0)
+	tenants := make(map[uint16]*Tenant)
 
-					core.WriteUint8(forwardPacketData, &index, version)
-					core.WriteAddress(forwardPacketData, &index, gatewayInternalAddress)
-					core.WriteAddress(forwardPacketData, &index, from)
-					core.WriteBytes(forwardPacketData[:], &index, sessionEntry.SessionTokenData[:], core.EncryptedSessionTokenBytes)
-					core.WriteUint64(forwardPacketData[:], &index, sessionEntry.SessionTokenSequence)
-					core.WriteBytes(forwardPacketData, &index, header, core.HeaderBytes)
-					core.WriteBytes(forwardPacketData, &index, payload, len(payload))
+	for _, name := range fileConfig.Names() {
+		if !strings.HasPrefix(name, "TENANTS_") {
+			continue
+		}
+		idString := strings.SplitN(strings.TrimPrefix(name, "TENANTS_"), "_", 2)[0]
+		id, err := strconv.ParseUint(idString, 10, 16)
+		if err != nil || id == 0 {
+			return nil, fileConfig.Invalid(name, fmt.Errorf("tenant ids are 1 to 65535"))
+		}
+		if tenants[uint16(id)] != nil {
+			continue
+		}
 
-					forwardPacketBytes := index
-					forwardPacketData = forwardPacketData[:forwardPacketBytes]
+		prefix := fmt.Sprintf("TENANTS_%s_", idString)
+		tenant := &Tenant{Id: uint16(id)}
 
-					if _, err := conn.WriteToUDP(forwardPacketData, serverAddress); err != nil {
-						core.Error("failed to forward payload to server: %v", err)
-					}
+		for _, key := range fileConfig.GetList(prefix+"AUTH_SIGN_PUBLIC_KEYS", nil) {
+			publicKey, err := base64.StdEncoding.DecodeString(key)
+			if err != nil || len(publicKey) != core.PublicKeyBytes_Sign {
+				return nil, fileConfig.Invalid(prefix+"AUTH_SIGN_PUBLIC_KEYS", fmt.Errorf("expected base64 encoded %d byte keys", core.PublicKeyBytes_Sign))
+			}
+			tenant.AuthSignPublicKeys = append(tenant.AuthSignPublicKeys, publicKey)
+		}
+		if len(tenant.AuthSignPublicKeys) == 0 {
+			return nil, fmt.Errorf("tenant %d has no auth_sign_public_keys", id)
+		}
 
-					core.Debug("send %d byte packet to %s", forwardPacketBytes, serverAddress.String())
+		tenant.AuthURL = strings.TrimSuffix(fileConfig.Get(prefix+"AUTH_URL", fileConfig.Get("AUTH_URL", "http://localhost:60000")), "/")
+		tenant.AuthBearerToken = fileConfig.Get(prefix+"AUTH_BEARER_TOKEN", fileConfig.Get("AUTH_BEARER_TOKEN", ""))
 
-					// mark packet as received
+		tenant.ServerAddresses, err = fileConfig.GetAddressList(prefix+"SERVER_ADDRESSES", nil)
+		if err != nil {
+			return nil, err
+		}
 
-					if sessionEntry.ReceivedSequence < sequence {
-						sessionEntry.ReceivedSequence = sequence
-					}
+		tenant.BandwidthLimitUpKbps, err = fileConfig.GetFloat(prefix+"BANDWIDTH_LIMIT_UP_KBPS", 0)
+		if err != nil {
+			return nil, err
+		}
 
-					sessionEntry.ReceivedPackets[sequence%OldSequenceThreshold] = sequence
-				}
+		tenant.BandwidthLimitDownKbps, err = fileConfig.GetFloat(prefix+"BANDWIDTH_LIMIT_DOWN_KBPS", 0)
+		if err != nil {
+			return nil, err
+		}
 
-				wg.Done()
+		tenant.MaxSessions, err = fileConfig.GetInt(prefix+"MAX_SESSIONS", 0)
+		if err != nil {
+			return nil, err
+		}
 
-			}(i)
+		if tenant.BandwidthLimitUpKbps < 0 || tenant.BandwidthLimitDownKbps < 0 || tenant.MaxSessions < 0 {
+			return nil, fmt.Errorf("tenant %d has negative limits", id)
 		}
+
+		tenants[tenant.Id] = tenant
 	}
 
-	// -----------------------------------------------------------------
+	return tenants, nil
+}
 
-	// listen on internal address
+// tenantSessions returns the session count of a tenant, registering its metric the first time it is seen
+func tenantSessions(tenantId uint16) *atomic.Int64 {
+	if value, ok := TenantSessions.Load(tenantId); ok {
+		return value.(*atomic.Int64)
+	}
+	value, loaded := TenantSessions.LoadOrStore(tenantId, &atomic.Int64{})
+	sessions := value.(*atomic.Int64)
+	if !loaded {
+		Metrics.GaugeFunc(fmt.Sprintf(`udpx_gateway_tenant_sessions{tenant="%d"}`, tenantId), "Sessions of each tenant. The default tenant is 0.", sessions.Load)
+	}
+	return sessions
+}
 
-	wg.Add(numThreads)
+// selectServer picks one of the tenant's servers for a new session, or one of the default servers if the
+// tenant has none
+func selectServer(tenantId uint16, sessionId []byte) int {
+	if index, ok := ServerPool.SelectTenant(tenantId, sessionId); ok {
+		return index
+	}
+	return ServerPool.Select(sessionId)
+}
 
-	{
-		lc := net.ListenConfig{
-			Control: func(network string, address string, c syscall.RawConn) error {
-				err := c.Control(func(fileDescriptor uintptr) {
-					err := unix.SetsockoptInt(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
-					if err != nil {
-						panic(fmt.Sprintf("failed to set reuse address socket option: %v", err))
-					}
+func claimServer(tenantId uint16, address *net.UDPAddr) (int, bool) {
+	if index, ok := ServerPool.ClaimTenant(tenantId, address); ok {
+		return index, true
+	}
+	return ServerPool.Claim(address)
+}
 
-					err = unix.SetsockoptInt(int(fileDescriptor), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-					if err != nil {
-						panic(fmt.Sprintf("failed to set reuse port socket option: %v", err))
-					}
-				})
+func readReloadableConfig(fileConfig *config.Config) (*ReloadableConfig, error) {
 
-				return err
-			},
-		}
+	reloadableConfig := &ReloadableConfig{}
 
-		for i := 0; i < numThreads; i++ {
+	// SERVER_ADDRESSES is a comma separated list of servers to balance sessions across
 
-			go func(thread int) {
+	defaultServerAddress, err := fileConfig.GetAddress("SERVER_ADDRESS", core.ParseAddress("127.0.0.1:40000"))
+	if err != nil {
+		return nil, err
+	}
 
-				lp, err := lc.ListenPacket(ctx, "udp", gatewayInternalAddress.String())
-				if err != nil {
-					panic(fmt.Sprintf("could not bind internal socket: %v", err))
-				}
+	reloadableConfig.ServerAddresses, err = fileConfig.GetAddressList("SERVER_ADDRESSES", []*net.UDPAddr{defaultServerAddress})
+	if err != nil {
+		return nil, err
+	}
+	if len(reloadableConfig.ServerAddresses) == 0 {
+		return nil, fileConfig.Invalid("SERVER_ADDRESSES", fmt.Errorf("no servers"))
+	}
 
-				conn := lp.(*net.UDPConn)
-				defer conn.Close()
+	reloadableConfig.RateLimitPacketsPerSecond, err = fileConfig.GetFloat("RATE_LIMIT_PACKETS_PER_SECOND", 1000)
+	if err != nil {
+		return nil, err
+	}
 
-				if err := conn.SetReadBuffer(readBuffer); err != nil {
-					panic(fmt.Sprintf("could not set internal connection read buffer size: %v", err))
-				}
+	reloadableConfig.RateLimitBurst, err = fileConfig.GetFloat("RATE_LIMIT_BURST", 2000)
+	if err != nil {
+		return nil, err
+	}
 
-				if err := conn.SetWriteBuffer(writeBuffer); err != nil {
-					panic(fmt.Sprintf("could not set internal connection write buffer size: %v", err))
-				}
+	// BLOCKLIST is a comma separated list of ips and networks to drop packets from
 
-				buffer := [MaxPacketSize]byte{}
+	reloadableConfig.Blocklist, err = core.ParseBlocklist(fileConfig.Get("BLOCKLIST", ""))
+	if err != nil {
+		return nil, fileConfig.Invalid("BLOCKLIST", err)
+	}
 
-				for {
+	reloadableConfig.Tenants, err = readTenants(fileConfig)
+	if err != nil {
+		return nil, err
+	}
 
-					packetBytes, from, err := conn.ReadFromUDP(buffer[:])
-					if err != nil {
-						core.Error("failed to read internal udp packet: %v", err)
-						break
-					}
+	// the log level is left alone unless LOG_LEVEL is set, so changes through the admin api stick
 
-					packetData := buffer[:packetBytes]
+	if fileConfig.Exists("LOG_LEVEL") {
+		level, err := log.ParseLevel(fileConfig.Get("LOG_LEVEL", ""))
+		if err != nil {
+			return nil, fileConfig.Invalid("LOG_LEVEL", err)
+		}
+		reloadableConfig.LogLevel = &level
+	}
 
-					core.Debug("recv internal %d byte packet from %s", packetBytes, from.String())
+	return reloadableConfig, nil
+}
 
-					if packetBytes < core.PacketTypeBytes+core.VersionBytes+core.AddressBytes+core.EncryptedSessionTokenBytes+core.SequenceBytes+core.HeaderBytes+core.MinPayloadBytes {
-						core.Debug("internal packet is too small")
-						continue
-					}
+// reloadConfig reads CONFIG_FILE again and applies the reloadable configuration. Nothing changes unless all
+// of it is valid. settings in the environment win over the file, so they can't be changed this way
 
-					if packetData[0] != 0 {
-						core.Debug("unknown internal packet version: %d", packetData[0])
-						continue
-					}
+func reloadConfig(configFile string) error {
+	fileConfig, err := config.Load(configFile)
+	if err != nil {
+		return err
+	}
+	reloadableConfig, err := readReloadableConfig(fileConfig)
+	if err != nil {
+		return err
+	}
+	envvar.SetFileValues(fileConfig.Values())
+	applyReloadableConfig(reloadableConfig)
+	core.Info("reloaded configuration")
+	return nil
+}
 
-					if packetData[1] != core.PayloadPacket {
-						core.Debug("unknown internal packet type: %d", packetData[1])
-						continue
-					}
+func applyReloadableConfig(reloadableConfig *ReloadableConfig) {
 
-					// read the client address the packet should be forwarded to
+	// sessions on servers taken out of the pool stay there until they end
 
-					index := core.VersionBytes + core.PacketTypeBytes
-					var clientAddress net.UDPAddr
-					core.ReadAddress(packetData, &index, &clientAddress)
+	numServers := ServerPool.GetNumServers()
+	for _, index := range ServerPool.SetServers(reloadableConfig.ServerAddresses, time.Now()) {
+		core.Info("forwarding to server %s", ServerPool.GetAddress(index))
+		registerServerMetrics(index)
+	}
 
-					// grab the session token
+	// servers of tenants that were taken out of the config are removed too
 
-					sessionTokenData := packetData[index : index+core.EncryptedSessionTokenBytes]
-					index += core.EncryptedSessionTokenBytes
+	if tenants := Tenants.Load(); tenants != nil {
+		for id := range *tenants {
+			if reloadableConfig.Tenants[id] == nil {
+				ServerPool.SetTenantServers(id, nil, time.Now())
+			}
+		}
+	}
+	for id, tenant := range reloadableConfig.Tenants {
+		for _, index := range ServerPool.SetTenantServers(id, tenant.ServerAddresses, time.Now()) {
+			core.Info("forwarding tenant %d to server %s", id, ServerPool.GetAddress(index))
+			registerServerMetrics(index)
+		}
+		tenant.SessionTokenSignKeys = append([][]byte{}, tenant.AuthSignPublicKeys...)
+		if SessionTokenDelegatePublicKey != nil {
+			tenant.SessionTokenSignKeys = append(tenant.SessionTokenSignKeys, SessionTokenDelegatePublicKey)
+		}
+	}
+	Tenants.Store(&reloadableConfig.Tenants)
 
-					// grab the session token sequence
+	for i := 0; i < numServers; i++ {
+		if server := ServerPool.GetServerState(i); server.Removed {
+			core.Debug("server %s is not in the pool. %d sessions left on it", server.Address.String(), server.Sessions)
+		}
+	}
 
-					sessionTokenSequence := packetData[index : index+core.SequenceBytes]
-					index += core.SequenceBytes
+	RateLimiter.SetLimit(reloadableConfig.RateLimitPacketsPerSecond, reloadableConfig.RateLimitBurst)
+	RateLimitEnabled.Store(reloadableConfig.RateLimitPacketsPerSecond > 0)
 
-					// split the packet apart into sections
+	Blocklist.Set(reloadableConfig.Blocklist)
 
-					headerIndex := core.VersionBytes + core.PacketTypeBytes + core.AddressBytes + core.EncryptedSessionTokenBytes + core.SequenceBytes
+	if reloadableConfig.LogLevel != nil {
+		log.Default().SetLevel(*reloadableConfig.LogLevel)
+	}
 
-					payloadIndex := headerIndex + core.HeaderBytes
-					payloadBytes := len(packetData) - payloadIndex
+	blocklist := make([]string, len(reloadableConfig.Blocklist))
+	for i := range reloadableConfig.Blocklist {
+		blocklist[i] = reloadableConfig.Blocklist[i].String()
+	}
 
-					core.Debug("payload bytes is %d", payloadBytes)
+	adminConfig := make(map[string]interface{})
+	for key, value := range *AdminConfig.Load() {
+		adminConfig[key] = value
+	}
+	adminConfig["server_addresses"] = reloadableConfig.ServerAddresses
+	adminConfig["rate_limit_packets_per_second"] = reloadableConfig.RateLimitPacketsPerSecond
+	adminConfig["rate_limit_burst"] = reloadableConfig.RateLimitBurst
+	adminConfig["blocklist"] = blocklist
+	tenants := make(map[string]interface{}, len(reloadableConfig.Tenants))
+	for id, tenant := range reloadableConfig.Tenants {
+		tenants[strconv.Itoa(int(id))] = map[string]interface{}{
+			"auth_url":                  tenant.AuthURL,
+			"server_addresses":          tenant.ServerAddresses,
+			"bandwidth_limit_up_kbps":   tenant.BandwidthLimitUpKbps,
+			"bandwidth_limit_down_kbps": tenant.BandwidthLimitDownKbps,
+			"max_sessions":              tenant.MaxSessions,
+		}
+	}
+	adminConfig["tenants"] = tenants
+	AdminConfig.Store(&adminConfig)
+	Status.SetConfig(adminConfig)
+}
 
-					header := packetData[headerIndex : headerIndex+core.HeaderBytes]
-					payload := packetData[payloadIndex : payloadIndex+payloadBytes]
+func registerServerMetrics(serverIndex int) {
+	labels := fmt.Sprintf(`server="%s"`, ServerPool.GetAddress(serverIndex).String())
+	if tenant := ServerPool.GetServerState(serverIndex).Tenant; tenant != 0 {
+		labels += fmt.Sprintf(`,tenant="%d"`, tenant)
+	}
+	Metrics.GaugeFunc("udpx_gateway_server_healthy{"+labels+"}", "Whether the server is answering pings.", func() int64 {
+		if ServerPool.IsHealthy(serverIndex) {
+			return 1
+		}
+		return 0
+	})
+	Metrics.GaugeFunc("udpx_gateway_server_sessions{"+labels+"}", "Sessions forwarded to the server.", func() int64 {
+		return ServerPool.GetServerState(serverIndex).Sessions
+	})
+}
 
-					// build the packet to send to the client
+// SelfSignedCertificate is the webtransport certificate when none is configured. Browsers only accept
+// self-signed certificates valid for two weeks or less, given their hash, so it is regenerated halfway through.
+type SelfSignedCertificate struct {
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	hash        [sha256.Size]byte
+	renewTime   time.Time
+}
 
-					forwardPacketData := make([]byte, MaxPacketSize)
+func (c *SelfSignedCertificate) Get() (*tls.Certificate, [sha256.Size]byte, error) {
 
-					index = 0
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-					version := byte(0)
+	if c.certificate != nil && time.Now().Before(c.renewTime) {
+		return c.certificate, c.hash, nil
+	}
 
-					encryptStart := core.PrefixBytes + core.SessionIdBytes + core.SequenceBytes
+	certificate, err := tunnel.GenerateCertificate(WebTransportCertificateLifetime)
+	if err != nil {
+		return nil, c.hash, err
+	}
 
-					core.WriteUint8(forwardPacketData, &index, version)
-					core.WriteUint8(forwardPacketData, &index, core.PayloadPacket)
-					chonkle := forwardPacketData[index : index+core.ChonkleBytes]
-					index += core.ChonkleBytes
-					core.WriteBytes(forwardPacketData, &index, sessionTokenData, core.EncryptedSessionTokenBytes)
-					core.WriteBytes(forwardPacketData, &index, sessionTokenSequence, core.SequenceBytes)
-					core.WriteBytes(forwardPacketData, &index, header, core.HeaderBytes)
-					core.WriteBytes(forwardPacketData, &index, payload, payloadBytes)
-					encryptFinish := index
-					index += core.HMACBytes_Box
-					pittle := forwardPacketData[index : index+core.PittleBytes]
-					index += core.PittleBytes
+	c.certificate = certificate
+	c.hash = sha256.Sum256(certificate.Certificate[0])
+	c.renewTime = time.Now().Add(WebTransportCertificateLifetime / 2)
 
-					forwardPacketBytes := index
-					forwardPacketData = forwardPacketData[:forwardPacketBytes]
+	core.Info("generated webtransport certificate with sha-256 hash %s", base64.StdEncoding.EncodeToString(c.hash[:]))
 
-					// encrypt the packet
+	return c.certificate, c.hash, nil
+}
 
-					sessionId := header[:core.SessionIdBytes]
+// certificateHashHandler serves the hash of the self-signed certificate, in the form browsers take it in
+// the serverCertificateHashes webtransport option
 
-					sequenceData := header[core.SessionIdBytes : core.SessionIdBytes+core.SequenceBytes]
+func certificateHashHandler(certificate *SelfSignedCertificate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, hash, err := certificate.Get()
+		if err != nil {
+			core.Error("could not generate webtransport certificate: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"algorithm": "sha-256", "value": base64.StdEncoding.EncodeToString(hash[:])})
+	}
+}
 
-					index = 0
-					sequence := uint64(0)
-					core.ReadUint64(sequenceData, &index, &sequence)
+// statusDetails is what /status shows beyond the counters: sessions, draining, and the servers
+func statusDetails() map[string]interface{} {
+	details := map[string]interface{}{
+		"active_sessions":  activeSessions(),
+		"protocol_version": core.ProtocolVersion,
+	}
+	if drainStartTime := DrainStartTime.Load(); drainStartTime != 0 {
+		details["draining_seconds"] = time.Since(time.Unix(0, drainStartTime)).Seconds()
+	}
+	if ServerPool != nil {
+		servers := make([]map[string]interface{}, 0, ServerPool.GetNumServers())
+		for i := 0; i < ServerPool.GetNumServers(); i++ {
+			server := ServerPool.GetServerState(i)
+			servers = append(servers, map[string]interface{}{
+				"address":  server.Address.String(),
+				"tenant":   server.Tenant,
+				"healthy":  server.Healthy,
+				"sessions": server.Sessions,
+				"removed":  server.Removed,
+			})
+		}
+		details["servers"] = servers
+	}
+	return details
+}
 
-					nonce := make([]byte, core.NonceBytes_Box)
-					for i := 0; i < core.SequenceBytes; i++ {
-						nonce[i] = sequenceData[i]
-					}
-					nonce[9] |= (1 << 0)
-					nonce[9] &= 1 ^ (1 << 1)
+// startAdminServer serves the admin api on adminAddress, with client certificates when adminTLSConfig is set.
+// It returns nil without serving anything when ADMIN_TOKEN is not set.
+func startAdminServer(adminAddress string, adminTLSConfig *tls.Config) *http.Server {
 
-					core.Encrypt_Box(gatewayPrivateKey, sessionId, nonce, forwardPacketData[encryptStart:encryptFinish], encryptFinish-encryptStart)
+	if AdminToken == "" {
+		core.Info("ADMIN_TOKEN is not set. admin api is disabled")
+		return nil
+	}
 
-					// setup packet prefix and postfix
+	router := mux.NewRouter()
+	router.Handle("/admin/sessions", requireAdminToken(http.HandlerFunc(adminSessionsHandler))).Methods("GET")
+	router.Handle("/admin/sessions/{session_id}", requireAdminToken(http.HandlerFunc(adminKickSessionHandler))).Methods("DELETE")
+	router.Handle("/admin/users", requireAdminToken(http.HandlerFunc(adminUsersHandler))).Methods("GET")
+	router.Handle("/admin/users/{user_id}", requireAdminToken(http.HandlerFunc(adminUserHandler))).Methods("GET")
+	router.Handle("/admin/config", requireAdminToken(http.HandlerFunc(adminConfigHandler))).Methods("GET")
+	router.Handle("/admin/ping_mesh", requireAdminToken(http.HandlerFunc(adminPingMeshHandler))).Methods("GET")
+	router.Handle("/admin/log_level", requireAdminToken(http.HandlerFunc(adminLogLevelHandler))).Methods("GET", "PUT")
+	router.Handle("/admin/filter_key/rotate", requireAdminToken(http.HandlerFunc(adminRotateFilterKeyHandler))).Methods("POST")
+	router.Handle("/admin/cookies", requireAdminToken(http.HandlerFunc(adminCookiesHandler))).Methods("GET", "PUT")
+	router.Handle("/admin/drain", requireAdminToken(http.HandlerFunc(adminDrainHandler))).Methods("GET", "POST")
+	router.Handle("/admin/prestop", requireAdminToken(http.HandlerFunc(adminPrestopHandler))).Methods("GET", "POST")
+
+	adminServer := &http.Server{
+		Addr:      adminAddress,
+		Handler:   router,
+		TLSConfig: adminTLSConfig,
+	}
 
-					var magic [core.MagicBytes]byte
+	go func() {
+		core.Info("started admin server on %s", adminAddress)
+		var err error
+		if adminTLSConfig != nil {
+			err = adminServer.ListenAndServeTLS("", "")
+		} else {
+			err = adminServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			core.Error("failed to start admin server: %v", err)
+			return
+		}
+	}()
 
-					var fromAddressData [4]byte
-					var fromAddressPort uint16
+	return adminServer
+}
 
-					var toAddressData [4]byte
-					var toAddressPort uint16
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+AdminToken)) != 1 {
+			core.Debug("invalid admin token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-					core.GetAddressData(gatewayAddress, fromAddressData[:], &fromAddressPort)
-					core.GetAddressData(&clientAddress, toAddressData[:], &toAddressPort)
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		core.Debug("failed to write json response: %v", err)
+	}
+}
 
-					core.GenerateChonkle(chonkle[:], magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes)
+// AdminSession is a live session as the admin api lists it, with its rates as of the last aggregation
+type AdminSession struct {
+	core.SessionUsage
+	ClientAddress string  `json:"client_address"`
+	ProxyAddress  string  `json:"proxy_address,omitempty"`
+	ServerAddress string  `json:"server_address"`
+	TenantId      uint16  `json:"tenant_id"`
+	AgeSeconds    float64 `json:"age_seconds"`
+}
 
-					core.GeneratePittle(pittle[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes)
+func adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := -1
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	rates := make(map[string]core.SessionUsage)
+	for _, session := range UsageAccounting.GetSessions() {
+		rates[session.SessionId] = session
+	}
+	sessions := []AdminSession{}
+	for _, table := range SessionTables {
+		table.ForEach(func(sessionId [core.SessionIdBytes]byte, value interface{}) {
+			sessionEntry := value.(*SessionEntry)
+			session := AdminSession{SessionUsage: rates[core.IdString(sessionId[:])]}
+			session.SessionId = core.IdString(sessionId[:])
+			session.UserId = core.IdString(sessionEntry.UserId[:])
+			session.Usage = sessionEntry.Usage.Get()
+			session.ClientAddress = sessionEntry.ClientAddress.String()
+			if proxyAddress := sessionEntry.ProxyAddress.Load(); proxyAddress != nil {
+				session.ProxyAddress = proxyAddress.String()
+			}
+			session.ServerAddress = ServerPool.GetAddress(sessionEntry.ServerIndex).String()
+			session.TenantId = sessionEntry.TenantId
+			session.AgeSeconds = time.Since(sessionEntry.CreateTime).Seconds()
+			sessions = append(sessions, session)
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].KbpsUp+sessions[i].KbpsDown > sessions[j].KbpsUp+sessions[j].KbpsDown
+	})
+	if limit >= 0 && limit < len(sessions) {
+		sessions = sessions[:limit]
+	}
+	writeJSON(w, sessions)
+}
 
-					if !core.BasicPacketFilter(forwardPacketData, forwardPacketBytes) {
-						panic("basic packet filter failed")
-					}
+// adminKickSessionHandler ends a session. Its packets are dropped for KickDuration after, so the client
+// can't start it again
 
-					if !core.AdvancedPacketFilter(forwardPacketData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, forwardPacketBytes) {
-						panic("advanced packet filter failed")
-					}
+func adminKickSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var sessionId [core.SessionIdBytes]byte
+	if err := core.ParseId(strings.ToLower(mux.Vars(r)["session_id"]), sessionId[:]); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	currentTimestamp := uint64(time.Now().Unix())
+	KickedSessions.RevokeSession(sessionId, currentTimestamp+uint64(KickDuration.Seconds()), currentTimestamp)
+	for _, table := range SessionTables {
+		if value := table.Get(sessionId); value != nil {
+			value.(*SessionEntry).EndReason.Store("kicked")
+		}
+		if table.Remove(sessionId) {
+			SessionsKicked.Inc()
+			core.Info("session %s kicked", core.IdString(sessionId[:]))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
 
-					// send it to the client
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, UsageAccounting.GetUsers())
+}
 
-					if _, err := publicSocket[thread].WriteToUDP(forwardPacketData, &clientAddress); err != nil {
-						core.Error("failed to forward packet to client: %v", err)
-					}
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, *AdminConfig.Load())
+}
 
-					core.Debug("send %d byte packet to %s", len(forwardPacketData), clientAddress.String())
-				}
+// adminPingMeshHandler shows the RTT, jitter and packet loss to each gateway in the ping mesh
+func adminPingMeshHandler(w http.ResponseWriter, r *http.Request) {
+	if PingMesh == nil {
+		writeJSON(w, []core.PingMeshPeer{})
+		return
+	}
+	writeJSON(w, PingMesh.Stats())
+}
 
-				wg.Done()
+type AdminCookies struct {
+	Mode             string `json:"mode"`
+	Required         bool   `json:"required"`
+	PacketsPerSecond uint64 `json:"packets_per_second"`
+	Cooldown         string `json:"cooldown"`
+}
 
-			}(i)
+// adminCookiesHandler sets the cookie mode on PUT, so cookies can be required before an attack is detected, or
+// turned off when auto mode gets it wrong
+func adminCookiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var request AdminCookies
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mode := strings.ToLower(request.Mode)
+		if mode != "auto" && mode != "on" && mode != "off" {
+			http.Error(w, "mode must be auto, on or off", http.StatusBadRequest)
+			return
+		}
+		CookieMode.Store(mode)
+		if mode != "auto" {
+			CookiesRequired.Store(mode == "on")
 		}
+		core.Info("cookie mode set to %s", mode)
 	}
+	writeJSON(w, AdminCookies{Mode: CookieMode.Load().(string), Required: CookiesRequired.Load(), PacketsPerSecond: CookiePacketsPerSecond, Cooldown: CookieCooldown.String()})
+}
 
-	// -----------------------------------------------------------------
+type AdminLogLevel struct {
+	Level string `json:"level"`
+}
 
-	termChan := make(chan os.Signal, 1)
-	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
-	<-termChan
+func adminLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var request AdminLogLevel
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		level, err := log.ParseLevel(request.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Default().SetLevel(level)
+		core.Info("log level set to %s", level)
+	}
+	writeJSON(w, AdminLogLevel{Level: log.Default().GetLevel().String()})
+}
 
-	fmt.Println("\nshutting down")
+// AdminFilterKeyRotation rotates the filter key, the secret clients and the gateway key their packet filter
+// hashes with. Without a new key, one is generated. The previous key is accepted for the overlap, by default
+// DefaultFilterKeyOverlap, while clients are given the new key
+type AdminFilterKeyRotation struct {
+	FilterKey string `json:"filter_key"`
+	Overlap   string `json:"overlap,omitempty"`
+}
 
-	ctxCancelFunc()
+func adminRotateFilterKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if FilterKeys == nil {
+		http.Error(w, "FILTER_KEY is not set", http.StatusConflict)
+		return
+	}
+	var request AdminFilterKeyRotation
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	filterKey := core.RandomBytes(core.SipHashKeyBytes)
+	if request.FilterKey != "" {
+		var err error
+		filterKey, err = base64.StdEncoding.DecodeString(request.FilterKey)
+		if err != nil || len(filterKey) != core.SipHashKeyBytes {
+			http.Error(w, "invalid filter key", http.StatusBadRequest)
+			return
+		}
+	}
+	overlap := DefaultFilterKeyOverlap
+	if request.Overlap != "" {
+		var err error
+		overlap, err = time.ParseDuration(request.Overlap)
+		if err != nil || overlap < 0 {
+			http.Error(w, "invalid overlap", http.StatusBadRequest)
+			return
+		}
+	}
+	FilterKeys.Rotate(filterKey, overlap, time.Now())
+	core.Info("rotated filter key. the previous key is accepted for %s", overlap)
+	writeJSON(w, AdminFilterKeyRotation{FilterKey: base64.StdEncoding.EncodeToString(filterKey), Overlap: overlap.String()})
+}
 
-	fmt.Println("shutdown completed")
+func adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	userId := strings.ToLower(mux.Vars(r)["user_id"])
+	for _, user := range UsageAccounting.GetUsers() {
+		if user.UserId == userId {
+			writeJSON(w, user)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
 
-	return 0
+func activeSessions() int {
+	count := 0
+	for _, table := range SessionTables {
+		count += table.GetCount()
+	}
+	return count
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+func startDrain() {
+	if DrainStartTime.CompareAndSwap(0, time.Now().UnixNano()) {
+		DrainSessions.Store(int64(activeSessions()))
+		close(DrainChannel)
+		core.Info("draining %d sessions. no new sessions are accepted", DrainSessions.Load())
+	}
+}
+
+// adminPrestopHandler starts draining and answers once the gateway has drained, so it can be called from a
+// kubernetes preStop hook. kubernetes holds SIGTERM back until the hook returns
+func adminPrestopHandler(w http.ResponseWriter, r *http.Request) {
+	startDrain()
+	select {
+	case <-DrainedChannel:
+	case <-r.Context().Done():
 		return
 	}
-	defer r.Body.Close()
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
+	adminDrainHandler(w, r)
+}
+
+type AdminDrain struct {
+	Draining       bool    `json:"draining"`
+	StartTime      string  `json:"start_time,omitempty"`
+	ElapsedSeconds float64 `json:"elapsed_seconds,omitempty"`
+	Timeout        string  `json:"timeout"`
+	Sessions       int     `json:"sessions"`
+	Routes         int     `json:"routes"`
+	StartSessions  int64   `json:"start_sessions,omitempty"`
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "hello world\n")
+// adminDrainHandler starts draining on POST, and reports drain progress
+func adminDrainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		startDrain()
+	}
+	response := AdminDrain{Timeout: DrainTimeout.String(), Sessions: activeSessions()}
+	if RouteTable != nil {
+		response.Routes = RouteTable.GetCount()
+	}
+	if drainStartTime := DrainStartTime.Load(); drainStartTime != 0 {
+		response.Draining = true
+		response.StartTime = time.Unix(0, drainStartTime).UTC().Format(time.RFC3339)
+		response.ElapsedSeconds = time.Since(time.Unix(0, drainStartTime)).Seconds()
+		response.StartSessions = DrainSessions.Load()
+	}
+	writeJSON(w, response)
 }
@@ -0,0 +1,452 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/client"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/metrics"
+	"github.com/networknext/udpx/modules/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// freePort returns a loopback port that nothing is listening on right now
+
+func freePort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func waitForHealth(t *testing.T, url string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		response, err := http.Get(url + "/health")
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("gateway is not healthy")
+}
+
+// testEnvironment is the gateway the tests share, with the server it forwards to and the auth services it
+// refreshes session tokens with. the gateway keeps its state in globals and runs until the test binary exits,
+// so it is started once, and each test sets the server callbacks it needs
+
+type testEnvironment struct {
+	GatewayAddress   *net.UDPAddr
+	GatewayPublicKey []byte
+	InternalAddress  *net.UDPAddr
+	Auth             *testAuth
+	TenantAuth       *testAuth
+	Server           *server.Server
+	ServerMetrics    *metrics.Registry
+
+	callbacks atomic.Pointer[server.Config]
+	dir       string
+}
+
+const TestTenantId = 7
+
+var environment *testEnvironment
+var environmentOnce sync.Once
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if environment != nil {
+		os.RemoveAll(environment.dir)
+	}
+	os.Exit(code)
+}
+
+func startEnvironment(t *testing.T) *testEnvironment {
+	environmentOnce.Do(func() {
+		environment = createEnvironment(t)
+	})
+	if environment == nil {
+		t.Fatal("could not start the gateway")
+	}
+	return environment
+}
+
+func createEnvironment(t *testing.T) *testEnvironment {
+
+	gatewayPublicKey, gatewayPrivateKey := core.Keygen_Box()
+	authPublicKey, _ := core.Keygen_Box()
+
+	gatewayPort := strconv.Itoa(freePort(t))
+	internalPort := strconv.Itoa(freePort(t))
+	httpPort := strconv.Itoa(freePort(t))
+
+	environment := &testEnvironment{
+		GatewayAddress:   core.ParseAddress("127.0.0.1:" + gatewayPort),
+		GatewayPublicKey: gatewayPublicKey,
+		InternalAddress:  core.ParseAddress("127.0.0.1:" + internalPort),
+		ServerMetrics:    metrics.CreateRegistry(),
+	}
+
+	environment.Auth = startTestAuth(environment.GatewayAddress, gatewayPublicKey, 0)
+	environment.TenantAuth = startTestAuth(environment.GatewayAddress, gatewayPublicKey, TestTenantId)
+
+	serverConfig := server.DefaultConfig()
+	serverConfig.Metrics = environment.ServerMetrics
+	serverConfig.PacketCallback = func(client *server.Client, payload []byte) {
+		if callback := environment.callbacks.Load().PacketCallback; callback != nil {
+			callback(client, payload)
+		}
+	}
+	serverConfig.MessageCallback = func(client *server.Client, message []byte) {
+		if callback := environment.callbacks.Load().MessageCallback; callback != nil {
+			callback(client, message)
+		}
+	}
+	serverConfig.ClientDisconnectCallback = func(client *server.Client) {
+		if callback := environment.callbacks.Load().ClientDisconnectCallback; callback != nil {
+			callback(client)
+		}
+	}
+	environment.callbacks.Store(&server.Config{})
+
+	var err error
+	environment.Server, err = server.Listen("127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Errorf("could not start server: %v", err)
+		return nil
+	}
+
+	// the tenant's auth signs with its own key, which only the tenant config has
+
+	environment.dir, err = os.MkdirTemp("", "udpx_gateway_test")
+	if err != nil {
+		t.Errorf("could not create config dir: %v", err)
+		return nil
+	}
+
+	configFile := filepath.Join(environment.dir, "gateway.json")
+	configData := fmt.Sprintf(`{"tenants": {"%d": {"auth_url": %q, "auth_sign_public_keys": [%q], "max_sessions": 1}}}`, TestTenantId, environment.TenantAuth.URL, base64.StdEncoding.EncodeToString(environment.TenantAuth.signPublicKey))
+	if err := os.WriteFile(configFile, []byte(configData), 0644); err != nil {
+		t.Errorf("could not write config file: %v", err)
+		return nil
+	}
+
+	t.Setenv("CONFIG_FILE", configFile)
+	t.Setenv("HTTP_PORT", httpPort)
+	t.Setenv("UDP_PORT", gatewayPort)
+	t.Setenv("GATEWAY_ADDRESS", environment.GatewayAddress.String())
+	t.Setenv("GATEWAY_INTERNAL_ADDRESS", environment.InternalAddress.String())
+	t.Setenv("GATEWAY_PRIVATE_KEY", base64.StdEncoding.EncodeToString(gatewayPrivateKey))
+	t.Setenv("AUTH_PUBLIC_KEY", base64.StdEncoding.EncodeToString(authPublicKey))
+	t.Setenv("AUTH_SIGN_PUBLIC_KEY", base64.StdEncoding.EncodeToString(environment.Auth.signPublicKey))
+	t.Setenv("AUTH_URL", environment.Auth.URL)
+	t.Setenv("SERVER_ADDRESS", environment.Server.GetAddress().String())
+
+	go mainReturnWithCode()
+
+	waitForHealth(t, "http://127.0.0.1:"+httpPort)
+
+	return environment
+}
+
+// SetCallbacks sets the server callbacks for the test that is running
+
+func (environment *testEnvironment) SetCallbacks(t *testing.T, callbacks server.Config) {
+	environment.callbacks.Store(&callbacks)
+	t.Cleanup(func() {
+		environment.callbacks.Store(&server.Config{})
+	})
+}
+
+// TestGateway runs the gateway in process between a client and a server. payloads and reliable messages
+// go from the client through the gateway to the server, which echoes them back along the return path, so
+// this covers decrypting and forwarding to the server, mapping the server's packets back to the client's
+// session, and the packet filter on the way down
+
+func TestGateway(t *testing.T) {
+
+	environment := startEnvironment(t)
+
+	environment.SetCallbacks(t, server.Config{
+		PacketCallback: func(client *server.Client, payload []byte) {
+			client.Send(payload)
+		},
+		MessageCallback: func(client *server.Client, message []byte) {
+			client.SendMessage(message)
+		},
+	})
+
+	var userId [core.UserIdBytes]byte
+	connectToken := core.GenerateConnectToken(userId[:], 2500, 10000, 100, 0, 0, core.ConnectTokenExpireSeconds, environment.GatewayAddress, environment.GatewayPublicKey, environment.Auth.signPrivateKey)
+
+	payloads := make(chan []byte, 100)
+	messages := make(chan []byte, 100)
+
+	clientAddress := core.ParseAddress("127.0.0.1:" + strconv.Itoa(freePort(t)))
+	config := client.DefaultConfig()
+	config.BindAddress = clientAddress.String()
+	config.ClientAddress = clientAddress
+	config.ReceiveCallback = func(payload []byte) {
+		payloads <- payload
+	}
+	config.MessageCallback = func(message []byte) {
+		messages <- message
+	}
+
+	session, err := client.Connect(connectToken, config)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer session.Close()
+
+	payload := make([]byte, core.MinPayloadBytes)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	// the first payloads are answered with a challenge, so keep sending until one comes back
+
+	timeout := time.After(5 * time.Second)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	echoed := false
+	for !echoed {
+		select {
+		case received := <-payloads:
+			assert.Equal(t, payload, received)
+			echoed = true
+		case <-ticker.C:
+			session.Send(payload)
+		case <-timeout:
+			t.Fatal("no payload came back through the gateway")
+		}
+	}
+
+	assert.Equal(t, client.StateConnected, session.GetState())
+
+	// reliable messages are acked in both directions through the gateway
+
+	assert.Nil(t, session.SendMessage([]byte("hello")))
+
+	select {
+	case message := <-messages:
+		assert.True(t, bytes.Equal([]byte("hello"), message))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reliable message came back through the gateway")
+	}
+
+	assert.True(t, PacketsForwardedToServer.Get() > 0)
+	assert.True(t, PacketsForwardedToClient.Get() > 0)
+	assert.Equal(t, 1, environment.Server.GetNumClients())
+}
+
+// forwardedToClient sends a payload packet to the gateway's internal address the way a server does, and
+// returns true if the gateway forwards it on to the client listening on clientConn
+
+func forwardedToClient(t *testing.T, environment *testEnvironment, clientConn *net.UDPConn, sessionId []byte, sessionTokenData []byte) bool {
+
+	packetData := make([]byte, MaxPacketSize)
+	index := 0
+	core.WriteUint8(packetData, &index, 0)
+	core.WriteUint8(packetData, &index, core.PayloadPacket)
+	core.WriteAddress(packetData, &index, clientConn.LocalAddr().(*net.UDPAddr))
+	core.WriteBytes(packetData, &index, sessionTokenData, core.EncryptedSessionTokenBytes)
+	index += core.SequenceBytes
+	core.WriteBytes(packetData, &index, sessionId, core.SessionIdBytes)
+	index += core.HeaderBytes - core.SessionIdBytes
+	index += core.MinPayloadBytes
+
+	serverConn, err := net.DialUDP("udp", nil, environment.InternalAddress)
+	if !assert.Nil(t, err) {
+		return false
+	}
+	defer serverConn.Close()
+
+	_, err = serverConn.Write(packetData[:index])
+	assert.Nil(t, err)
+
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = clientConn.ReadFromUDP(packetData)
+	return err == nil
+}
+
+// TestKickedSessionDownstream checks that the server can't reach a kicked session. kicking removes the session
+// entry, and without one the gateway would otherwise derive the keys from the session id and forward anyway
+
+func TestKickedSessionDownstream(t *testing.T) {
+
+	environment := startEnvironment(t)
+
+	clientConn, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer clientConn.Close()
+
+	sessionId := core.RandomBytes(core.SessionIdBytes)
+	sessionTokenData := core.RandomBytes(core.EncryptedSessionTokenBytes)
+
+	assert.True(t, forwardedToClient(t, environment, clientConn, sessionId, sessionTokenData))
+
+	var kickedSessionId [core.SessionIdBytes]byte
+	copy(kickedSessionId[:], sessionId)
+	currentTimestamp := uint64(time.Now().Unix())
+	KickedSessions.RevokeSession(kickedSessionId, currentTimestamp+uint64(KickDuration.Seconds()), currentTimestamp)
+
+	revoked := RevokedPacketsToClient.Get()
+	assert.False(t, forwardedToClient(t, environment, clientConn, sessionId, sessionTokenData))
+	assert.True(t, RevokedPacketsToClient.Get() > revoked)
+}
+
+// TestRevokedSessionDownstream checks that the server can't reach a revoked session or user once the session
+// entry has expired. the user id comes from the session token the server sends along
+
+func TestRevokedSessionDownstream(t *testing.T) {
+
+	environment := startEnvironment(t)
+
+	clientConn, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer clientConn.Close()
+
+	currentTimestamp := uint64(time.Now().Unix())
+
+	writeSessionToken := func(sessionToken *core.SessionToken) []byte {
+		copy(sessionToken.SessionId[:], core.RandomBytes(core.SessionIdBytes))
+		copy(sessionToken.UserId[:], core.RandomBytes(core.UserIdBytes))
+		sessionToken.IssueTimestamp = currentTimestamp
+		sessionToken.ExpireTimestamp = currentTimestamp + 60
+		sessionTokenData := make([]byte, core.EncryptedSessionTokenBytes)
+		index := 0
+		core.WriteEncryptedSessionToken(sessionTokenData, &index, sessionToken, environment.Auth.signPrivateKey, environment.GatewayPublicKey)
+		return sessionTokenData
+	}
+
+	// a revoked session
+
+	var sessionToken core.SessionToken
+	sessionTokenData := writeSessionToken(&sessionToken)
+	assert.True(t, forwardedToClient(t, environment, clientConn, sessionToken.SessionId[:], sessionTokenData))
+
+	Revocations.RevokeSession(sessionToken.SessionId, currentTimestamp+60, currentTimestamp)
+
+	revoked := RevokedPacketsToClient.Get()
+	assert.False(t, forwardedToClient(t, environment, clientConn, sessionToken.SessionId[:], sessionTokenData))
+	assert.True(t, RevokedPacketsToClient.Get() > revoked)
+
+	// a session of a revoked user
+
+	sessionTokenData = writeSessionToken(&sessionToken)
+	assert.True(t, forwardedToClient(t, environment, clientConn, sessionToken.SessionId[:], sessionTokenData))
+
+	Revocations.RevokeUser(sessionToken.UserId, currentTimestamp+60, currentTimestamp)
+	defer Revocations.RestoreUser(sessionToken.UserId, currentTimestamp)
+
+	revoked = RevokedPacketsToClient.Get()
+	assert.False(t, forwardedToClient(t, environment, clientConn, sessionToken.SessionId[:], sessionTokenData))
+	assert.True(t, RevokedPacketsToClient.Get() > revoked)
+}
+
+// TestExtendSessionToken covers gateways with a delegate key, which extend session tokens themselves instead
+// of asking auth
+
+func TestExtendSessionToken(t *testing.T) {
+
+	authSignPublicKey, authSignPrivateKey := core.Keygen_Sign()
+	delegatePublicKey, delegatePrivateKey := core.Keygen_Sign()
+	signPublicKeys := [][]byte{authSignPublicKey, delegatePublicKey}
+
+	currentTimestamp := uint64(time.Now().Unix())
+
+	sessionToken := core.SessionToken{
+		IssueTimestamp:  currentTimestamp,
+		ExpireTimestamp: currentTimestamp + 2,
+	}
+	copy(sessionToken.SessionId[:], core.RandomBytes(core.SessionIdBytes))
+	copy(sessionToken.UserId[:], core.RandomBytes(core.UserIdBytes))
+
+	var sessionTokenData [core.SignedSessionTokenBytes]byte
+	index := 0
+	core.WriteSignedSessionToken(sessionTokenData[:], &index, &sessionToken, authSignPrivateKey)
+
+	extended := SessionTokensExtended.Get()
+
+	update := extendSessionToken(sessionTokenData, signPublicKeys, delegatePrivateKey)
+	assert.Equal(t, sessionToken.ExpireTimestamp+core.SessionTokenExtensionSeconds, update.ExpireTimestamp)
+	assert.Equal(t, extended+1, SessionTokensExtended.Get())
+
+	// the extended token is signed with the delegate key, and can be extended again
+
+	index = 0
+	var extendedToken core.SessionToken
+	assert.True(t, core.ReadSignedSessionToken(update.SessionTokenData, &index, &extendedToken, delegatePublicKey))
+	assert.Equal(t, sessionToken.SessionId, extendedToken.SessionId)
+	assert.Equal(t, update.ExpireTimestamp, extendedToken.ExpireTimestamp)
+
+	// tokens signed by anyone else are not extended
+
+	_, otherPrivateKey := core.Keygen_Sign()
+	index = 0
+	core.WriteSignedSessionToken(sessionTokenData[:], &index, &sessionToken, otherPrivateKey)
+	assert.Nil(t, extendSessionToken(sessionTokenData, signPublicKeys, delegatePrivateKey).SessionTokenData)
+
+	// nor are tokens of revoked users
+
+	index = 0
+	core.WriteSignedSessionToken(sessionTokenData[:], &index, &sessionToken, authSignPrivateKey)
+	Revocations.RevokeUser(sessionToken.UserId, currentTimestamp+60, currentTimestamp)
+	defer Revocations.RestoreUser(sessionToken.UserId, currentTimestamp)
+	assert.Nil(t, extendSessionToken(sessionTokenData, signPublicKeys, delegatePrivateKey).SessionTokenData)
+
+	assert.Equal(t, extended+1, SessionTokensExtended.Get())
+}
@@ -0,0 +1,397 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/client"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/server"
+	"github.com/stretchr/testify/assert"
+)
+
+const TestTimeout = 5 * time.Second
+
+// connect tokens from the test auth expire quickly, so sessions outlive their first session token within the test
+
+const TestConnectTokenSeconds = 2
+
+// testAuth stands in for the auth service. it issues connect tokens and extends session tokens with the same
+// core calls as cmd/auth, whose own tests cover its handlers, so the gateway can be run against it in process
+
+type testAuth struct {
+	*httptest.Server
+	ConnectTokensIssued atomic.Uint64
+	SessionTokensIssued atomic.Uint64
+
+	gatewayAddress   *net.UDPAddr
+	gatewayPublicKey []byte
+	signPublicKey    []byte
+	signPrivateKey   []byte
+	tenantId         uint16
+}
+
+func startTestAuth(gatewayAddress *net.UDPAddr, gatewayPublicKey []byte, tenantId uint16) *testAuth {
+	auth := &testAuth{
+		gatewayAddress:   gatewayAddress,
+		gatewayPublicKey: gatewayPublicKey,
+		tenantId:         tenantId,
+	}
+	auth.signPublicKey, auth.signPrivateKey = core.Keygen_Sign()
+	router := http.NewServeMux()
+	router.HandleFunc("/connect_token", auth.connectTokenHandler)
+	router.HandleFunc("/session_token", auth.sessionTokenHandler)
+	auth.Server = httptest.NewServer(router)
+	return auth
+}
+
+func (auth *testAuth) connectTokenHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(userId) != core.UserIdBytes {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	connectToken := core.GenerateBoundConnectToken(userId, 2500, 10000, 100, 0, 0, TestConnectTokenSeconds, auth.gatewayAddress, auth.gatewayPublicKey, auth.signPrivateKey, auth.tenantId, nil)
+	auth.ConnectTokensIssued.Add(1)
+	w.Write(connectToken)
+}
+
+func (auth *testAuth) sessionTokenHandler(w http.ResponseWriter, r *http.Request) {
+	requestData, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(requestData) != core.SignedSessionTokenBytes {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	index := 0
+	var sessionToken core.SessionToken
+	if !core.ReadSignedSessionToken(requestData, &index, &sessionToken, auth.signPublicKey) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := core.ExtendSessionToken(&sessionToken, uint64(time.Now().Unix())); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	index = 0
+	responseData := [core.SignedSessionTokenBytes]byte{}
+	core.WriteSignedSessionToken(responseData[:], &index, &sessionToken, auth.signPrivateKey)
+	auth.SessionTokensIssued.Add(1)
+	w.Write(responseData[:])
+}
+
+// FetchConnectToken gets a connect token for a user, the way a game backend would
+func (auth *testAuth) FetchConnectToken(userId []byte) ([]byte, error) {
+	response, err := http.Post(auth.URL+"/connect_token", "application/octet-stream", bytes.NewReader(userId))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	connectToken, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth returned %d", response.StatusCode)
+	}
+	return connectToken, nil
+}
+
+// waitFor polls until condition is true, or fails the test after the test timeout
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(TestTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, what string, channel chan []byte) []byte {
+	t.Helper()
+	select {
+	case data := <-channel:
+		return data
+	case <-time.After(TestTimeout):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	return nil
+}
+
+func testPayload(bytes int, seed int) []byte {
+	payload := make([]byte, bytes)
+	for i := range payload {
+		payload[i] = byte(i + seed)
+	}
+	return payload
+}
+
+// counters returns every counter on the gateway, the server and auth. the environment is shared, so tests
+// compare the counters from before and after
+
+func counters(environment *testEnvironment, auth *testAuth) map[string]uint64 {
+	values := make(map[string]uint64)
+	for _, registry := range []map[string]uint64{Metrics.Counters(), environment.ServerMetrics.Counters()} {
+		for name, value := range registry {
+			values[name] = value
+		}
+	}
+	values["udpx_auth_connect_tokens_issued_total"] = auth.ConnectTokensIssued.Load()
+	values["udpx_auth_session_tokens_issued_total"] = auth.SessionTokensIssued.Load()
+	return values
+}
+
+// TestSession takes a client through a whole session: fetching a connect token from auth, connecting
+// through the gateway, exchanging payloads and reliable messages with the server, outliving its first
+// session token as the gateway refreshes it with auth, and disconnecting. Then it checks every counter on
+// auth, the gateway and the server, so a protocol change that drops or mangles packets anywhere shows up
+
+func TestSession(t *testing.T) {
+	environment := startEnvironment(t)
+	testSession(t, environment, environment.Auth)
+}
+
+// TestSessionTenant runs the session for a tenant, whose auth service signs with a key that only the
+// gateway's tenant config has
+
+func TestSessionTenant(t *testing.T) {
+	environment := startEnvironment(t)
+	testSession(t, environment, environment.TenantAuth)
+}
+
+func testSession(t *testing.T, environment *testEnvironment, auth *testAuth) {
+
+	serverPayloads := make(chan []byte, 100)
+	disconnected := make(chan *server.Client, 1)
+
+	environment.SetCallbacks(t, server.Config{
+		PacketCallback: func(client *server.Client, payload []byte) {
+			serverPayloads <- payload
+			if len(payload) == core.MinPayloadBytes {
+				client.Send(payload)
+			}
+		},
+		MessageCallback: func(client *server.Client, message []byte) {
+			client.SendMessage(message)
+		},
+		ClientDisconnectCallback: func(client *server.Client) {
+			disconnected <- client
+		},
+	})
+
+	// sessions from earlier tests are gone before counting starts
+
+	waitFor(t, "earlier sessions to end", func() bool {
+		return activeSessions() == 0 && environment.Server.GetNumClients() == 0
+	})
+
+	before := counters(environment, auth)
+
+	// fetch a connect token
+
+	connectToken, err := auth.FetchConnectToken(core.RandomBytes(core.UserIdBytes))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	index := 0
+	var connectData core.ConnectData
+	assert.True(t, core.ReadConnectData(connectToken, &index, &connectData))
+	assert.True(t, core.AddressEqual(environment.GatewayAddress, &connectData.GatewayAddress))
+
+	// connect. the first payloads are answered with a challenge, so keep sending until one comes back
+
+	clientPayloads := make(chan []byte, 100)
+	clientMessages := make(chan []byte, 100)
+
+	config := client.DefaultConfig()
+	config.BindAddress = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	config.ClientAddress = core.ParseAddress(config.BindAddress)
+	config.ReceiveCallback = func(payload []byte) {
+		clientPayloads <- payload
+	}
+	config.MessageCallback = func(message []byte) {
+		clientMessages <- message
+	}
+
+	session, err := client.Connect(connectToken, config)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer session.Close()
+
+	payload := testPayload(core.MinPayloadBytes, 0)
+	waitFor(t, "the first payload to come back", func() bool {
+		session.Send(payload)
+		select {
+		case received := <-clientPayloads:
+			return assert.Equal(t, payload, received)
+		case <-time.After(20 * time.Millisecond):
+			return false
+		}
+	})
+
+	assert.Equal(t, client.StateConnected, session.GetState())
+
+	for len(serverPayloads) > 0 {
+		<-serverPayloads
+	}
+
+	// payloads are echoed back by the server
+
+	const NumPayloads = 10
+
+	for i := 0; i < NumPayloads; i++ {
+		payload := testPayload(core.MinPayloadBytes, i)
+		assert.Nil(t, session.Send(payload))
+		assert.Equal(t, payload, receive(t, "a payload on the server", serverPayloads))
+		assert.Equal(t, payload, receive(t, "a payload back on the client", clientPayloads))
+	}
+
+	// large payloads are fragmented on the way up and reassembled on the server
+
+	const NumFragmentedPayloads = 3
+
+	for i := 0; i < NumFragmentedPayloads; i++ {
+		payload := testPayload(4000+i*1000, i)
+		assert.Nil(t, session.Send(payload))
+		assert.Equal(t, payload, receive(t, "a fragmented payload on the server", serverPayloads))
+	}
+
+	// reliable messages come back in order
+
+	const NumMessages = 5
+
+	for i := 0; i < NumMessages; i++ {
+		assert.Nil(t, session.SendMessage([]byte(fmt.Sprintf("message %d", i))))
+	}
+	for i := 0; i < NumMessages; i++ {
+		assert.True(t, bytes.Equal([]byte(fmt.Sprintf("message %d", i)), receive(t, "a reliable message back on the client", clientMessages)))
+	}
+
+	// the session outlives its first session token, which the gateway refreshes
+
+	expireTime := time.Unix(int64(connectData.ExpireTimestamp), 0)
+	for time.Now().Before(expireTime.Add(time.Second)) {
+		assert.Nil(t, session.Send(payload))
+		receive(t, "a payload on the server", serverPayloads)
+		receive(t, "a payload back on the client", clientPayloads)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, client.StateConnected, session.GetState())
+
+	// disconnect
+
+	session.Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(TestTimeout):
+		t.Fatal("server did not see the disconnect")
+	}
+
+	waitFor(t, "the gateway to see the disconnect", func() bool {
+		return SessionsDisconnected.Get() == before["udpx_gateway_sessions_disconnected_total"]+1
+	})
+
+	// counters with an exact change, then counters that must have moved. every other counter must not move
+
+	exact := map[string]uint64{
+		"udpx_auth_connect_tokens_issued_total":          1,
+		"udpx_gateway_sessions_created_total":            1,
+		"udpx_gateway_sessions_disconnected_total":       1,
+		"udpx_server_sessions_created_total":             1,
+		"udpx_server_sessions_disconnected_total":        1,
+		"udpx_server_fragmented_payloads_received_total": NumFragmentedPayloads,
+		"udpx_server_reliable_messages_received_total":   NumMessages,
+	}
+
+	moved := []string{
+		"udpx_auth_session_tokens_issued_total",
+		"udpx_gateway_challenges_sent_total",
+		"udpx_gateway_client_stats_received_total",
+		"udpx_gateway_packets_received_total",
+		`udpx_gateway_packets_forwarded_total{direction="server"}`,
+		`udpx_gateway_packets_forwarded_total{direction="client"}`,
+		`udpx_gateway_bytes_forwarded_total{direction="server"}`,
+		`udpx_gateway_bytes_forwarded_total{direction="client"}`,
+		"udpx_server_packets_received_total",
+		"udpx_server_packets_sent_total",
+	}
+
+	// the gateway counts packets it forwarded to the client that weren't acked, and the last few before the
+	// disconnect never are
+
+	anything := []string{
+		"udpx_gateway_client_packets_lost_total",
+	}
+
+	after := counters(environment, auth)
+
+	for name, value := range exact {
+		assert.Equal(t, value, after[name]-before[name], name)
+	}
+	for _, name := range moved {
+		assert.True(t, after[name] > before[name], name)
+	}
+
+	for name, value := range after {
+		if !strings.Contains(name, "_total") {
+			continue
+		}
+		if _, ok := exact[name]; ok {
+			continue
+		}
+		expected := true
+		for _, other := range append(moved, anything...) {
+			if name == other {
+				expected = false
+			}
+		}
+		if expected {
+			assert.Equal(t, before[name], value, name)
+		}
+	}
+}
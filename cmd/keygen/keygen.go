@@ -32,18 +32,91 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
 	"github.com/networknext/udpx/modules/core"
 )
 
 func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mainReturnWithCode() int {
+
+	format := flag.String("format", "text", "output format: text, env or json")
+	names := flag.String("names", "GATEWAY,AUTH", "comma separated env var prefixes to generate keypairs for (env and json formats)")
+	sign := flag.Bool("sign", false, "generate signing keypairs instead of box keypairs")
+	output := flag.String("output", "", "write to this file instead of stdout")
+	flag.Parse()
+
+	keygen := core.Keygen_Box
+	if *sign {
+		keygen = core.Keygen_Sign
+	}
+
+	var buffer bytes.Buffer
+
+	switch *format {
+
+	case "text":
+		publicKey, privateKey := keygen()
+		fmt.Fprintf(&buffer, "public key: %s\n", base64.StdEncoding.EncodeToString(publicKey))
+		fmt.Fprintf(&buffer, "private key: %s\n", base64.StdEncoding.EncodeToString(privateKey))
+
+	case "env", "json":
+		keys := make(map[string]string)
+		var order []string
+		for _, name := range strings.Split(*names, ",") {
+			name = strings.ToUpper(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			publicKey, privateKey := keygen()
+			keys[name+"_PUBLIC_KEY"] = base64.StdEncoding.EncodeToString(publicKey)
+			keys[name+"_PRIVATE_KEY"] = base64.StdEncoding.EncodeToString(privateKey)
+			order = append(order, name+"_PUBLIC_KEY", name+"_PRIVATE_KEY")
+		}
+		if len(order) == 0 {
+			core.Error("no key names given")
+			return 1
+		}
+		if *format == "env" {
+			for _, key := range order {
+				fmt.Fprintf(&buffer, "%s=%s\n", key, keys[key])
+			}
+		} else {
+			data, err := json.MarshalIndent(keys, "", "\t")
+			if err != nil {
+				core.Error("could not encode json: %v", err)
+				return 1
+			}
+			buffer.Write(data)
+			buffer.WriteString("\n")
+		}
+
+	default:
+		core.Error("unknown format: %s", *format)
+		return 1
+	}
+
+	if *output == "" {
+		os.Stdout.Write(buffer.Bytes())
+		return 0
+	}
 
-	publicKey, privateKey := core.Keygen_Box()
+	// output contains private keys, so don't make it readable by anybody else
 
-	publicKey_base64 := base64.StdEncoding.EncodeToString(publicKey)
-	privateKey_base64 := base64.StdEncoding.EncodeToString(privateKey)
+	if err := ioutil.WriteFile(*output, buffer.Bytes(), 0600); err != nil {
+		core.Error("could not write %s: %v", *output, err)
+		return 1
+	}
 
-	fmt.Printf("public key: %s\n", publicKey_base64)
-	fmt.Printf("private key: %s\n", privateKey_base64)
+	return 0
 }
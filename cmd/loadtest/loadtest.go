@@ -0,0 +1,447 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/client"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/log"
+)
+
+// gateway counters that count packets dropped, reported by how much they went up during the test
+
+var dropCounters = []string{
+	"udpx_gateway_packets_dropped_total",
+	"udpx_gateway_packets_filtered_total",
+	"udpx_gateway_packets_rate_limited_total",
+	"udpx_gateway_packets_replayed_total",
+	"udpx_gateway_packets_revoked_total",
+	"udpx_gateway_packets_over_bandwidth_total",
+	"udpx_gateway_crypto_failures_total",
+	"udpx_gateway_session_tokens_expired_total",
+	"udpx_gateway_session_tokens_ip_mismatch_total",
+	"udpx_gateway_session_tokens_replayed_total",
+	"udpx_gateway_webtransport_datagrams_dropped_total",
+}
+
+var (
+	payloadsSent     atomic.Uint64
+	payloadsReceived atomic.Uint64
+	bytesSent        atomic.Uint64
+	bytesReceived    atomic.Uint64
+	clientsConnected atomic.Int64
+	clientsFailed    atomic.Int64
+)
+
+// Results are collected from every client while the test runs
+type Results struct {
+	mutex        sync.Mutex
+	rtts         []time.Duration
+	connectTimes []time.Duration
+	stats        []core.PathStatsSnapshot
+}
+
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mainReturnWithCode() int {
+
+	log.SetService("udpx loadtest")
+
+	// configure
+
+	authURL := strings.TrimSuffix(envvar.Get("AUTH_URL", "http://127.0.0.1:60000"), "/")
+	authBearerToken := envvar.Get("AUTH_BEARER_TOKEN", "")
+	gatewayMetricsURL := envvar.Get("GATEWAY_METRICS_URL", "http://127.0.0.1:40000/metrics")
+
+	numClients, err := envvar.GetIntRange("NUM_CLIENTS", 100, 1, 10000)
+	if err != nil {
+		core.Error("invalid NUM_CLIENTS: %v", err)
+		return 1
+	}
+
+	packetsPerSecond, err := envvar.GetIntRange("PACKETS_PER_SECOND", 60, 1, 255)
+	if err != nil {
+		core.Error("invalid PACKETS_PER_SECOND: %v", err)
+		return 1
+	}
+
+	payloadBytes, err := envvar.GetIntRange("PAYLOAD_BYTES", core.MinPayloadBytes, 1, client.MaxPayloadBytes)
+	if err != nil {
+		core.Error("invalid PAYLOAD_BYTES: %v", err)
+		return 1
+	}
+
+	envelopeUpKbps, err := envvar.GetIntRange("ENVELOPE_UP_KBPS", 2500, 1, 1000000)
+	if err != nil {
+		core.Error("invalid ENVELOPE_UP_KBPS: %v", err)
+		return 1
+	}
+
+	envelopeDownKbps, err := envvar.GetIntRange("ENVELOPE_DOWN_KBPS", 10000, 1, 1000000)
+	if err != nil {
+		core.Error("invalid ENVELOPE_DOWN_KBPS: %v", err)
+		return 1
+	}
+
+	duration, err := envvar.GetDurationRange("DURATION", 30*time.Second, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid DURATION: %v", err)
+		return 1
+	}
+
+	// client starts are spread over RAMP_UP, so the gateway isn't hit with every handshake at once
+
+	rampUp, err := envvar.GetDurationRange("RAMP_UP", 5*time.Second, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid RAMP_UP: %v", err)
+		return 1
+	}
+
+	// clients bind consecutive ports from CLIENT_BASE_PORT. CLIENT_IP is the address the gateway sees them at
+
+	clientBasePort, err := envvar.GetIntRange("CLIENT_BASE_PORT", 30000, 1024, 65535-numClients)
+	if err != nil {
+		core.Error("invalid CLIENT_BASE_PORT: %v", err)
+		return 1
+	}
+
+	clientIP := net.ParseIP(envvar.Get("CLIENT_IP", "127.0.0.1"))
+	if clientIP == nil {
+		core.Error("invalid CLIENT_IP: %s", envvar.Get("CLIENT_IP", ""))
+		return 1
+	}
+
+	filterKey, err := envvar.GetBase64("FILTER_KEY", nil)
+	if err != nil || (filterKey != nil && len(filterKey) != core.SipHashKeyBytes) {
+		core.Error("invalid FILTER_KEY: %v", err)
+		return 1
+	}
+
+	// as a functional test, the run fails if any client can't connect or loss is over MAX_PACKET_LOSS
+
+	maxPacketLoss, err := envvar.GetFloat("MAX_PACKET_LOSS", 0.05)
+	if err != nil || maxPacketLoss < 0 || maxPacketLoss > 1 {
+		core.Error("invalid MAX_PACKET_LOSS: %v", err)
+		return 1
+	}
+
+	core.Info("%d clients at %d packets per second for %v", numClients, packetsPerSecond, duration)
+
+	dropsBefore, err := scrapeCounters(gatewayMetricsURL)
+	if err != nil {
+		core.Debug("could not read gateway metrics: %v", err)
+	}
+
+	// run the clients
+
+	results := &Results{}
+
+	startTime := time.Now()
+	endTime := startTime.Add(rampUp + duration)
+
+	var clientsDone sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		clientsDone.Add(1)
+		go func(clientIndex int) {
+			defer clientsDone.Done()
+			time.Sleep(rampUp * time.Duration(clientIndex) / time.Duration(numClients))
+			clientAddress := &net.UDPAddr{IP: clientIP, Port: clientBasePort + clientIndex}
+			runClient(authURL, authBearerToken, clientAddress, filterKey, uint32(envelopeUpKbps), uint32(envelopeDownKbps), packetsPerSecond, payloadBytes, endTime, results)
+		}(i)
+	}
+
+	progressTicker := time.NewTicker(5 * time.Second)
+	previousSent, previousReceived := uint64(0), uint64(0)
+	previousTime := startTime
+	for time.Now().Before(endTime) {
+		<-progressTicker.C
+		sent, received := payloadsSent.Load(), payloadsReceived.Load()
+		seconds := time.Since(previousTime).Seconds()
+		core.Info("%d connected, %d failed. %.0f payloads/s sent, %.0f payloads/s received",
+			clientsConnected.Load(), clientsFailed.Load(), float64(sent-previousSent)/seconds, float64(received-previousReceived)/seconds)
+		previousSent, previousReceived, previousTime = sent, received, time.Now()
+	}
+	progressTicker.Stop()
+
+	clientsDone.Wait()
+
+	elapsed := time.Since(startTime) - rampUp/2
+
+	// report
+
+	var packetsSent, packetsAcked, packetsLost uint64
+	for _, stats := range results.stats {
+		packetsSent += stats.PacketsSent
+		packetsAcked += stats.PacketsAcked
+		packetsLost += stats.PacketsLost
+	}
+
+	packetLoss := 0.0
+	if packetsSent > 0 {
+		packetLoss = float64(packetsLost) / float64(packetsSent)
+	}
+
+	echoed := 0.0
+	if payloadsSent.Load() > 0 {
+		echoed = float64(payloadsReceived.Load()) / float64(payloadsSent.Load())
+	}
+
+	fmt.Printf("\nclients: %d connected, %d failed\n", clientsConnected.Load(), clientsFailed.Load())
+	fmt.Printf("sent: %d payloads, %.0f/s, %.1f mbps\n", payloadsSent.Load(), float64(payloadsSent.Load())/elapsed.Seconds(), float64(bytesSent.Load())*8/elapsed.Seconds()/1e6)
+	fmt.Printf("received: %d payloads, %.0f/s, %.1f mbps, %.1f%% of sent\n", payloadsReceived.Load(), float64(payloadsReceived.Load())/elapsed.Seconds(), float64(bytesReceived.Load())*8/elapsed.Seconds()/1e6, echoed*100)
+	fmt.Printf("packet loss: %.2f%% (%d sent, %d acked, %d lost)\n", packetLoss*100, packetsSent, packetsAcked, packetsLost)
+	fmt.Printf("rtt: %s\n", formatPercentiles(results.rtts))
+	fmt.Printf("connect time: %s\n", formatPercentiles(results.connectTimes))
+
+	dropsAfter, err := scrapeCounters(gatewayMetricsURL)
+	if err != nil {
+		fmt.Printf("gateway drops: could not read %s: %v\n", gatewayMetricsURL, err)
+	} else {
+		fmt.Printf("gateway drops:\n")
+		drops := 0
+		for _, name := range sortedKeys(dropsAfter) {
+			if delta := dropsAfter[name] - dropsBefore[name]; delta > 0 {
+				fmt.Printf("  %s %.0f\n", name, delta)
+				drops++
+			}
+		}
+		if drops == 0 {
+			fmt.Printf("  none\n")
+		}
+	}
+
+	if clientsFailed.Load() > 0 || packetLoss > maxPacketLoss {
+		core.Error("load test failed: %d clients failed, %.2f%% packet loss", clientsFailed.Load(), packetLoss*100)
+		return 1
+	}
+
+	return 0
+}
+
+// runClient connects one client and sends payloads at the given rate until the end time
+func runClient(authURL string, authBearerToken string, clientAddress *net.UDPAddr, filterKey []byte, envelopeUpKbps uint32, envelopeDownKbps uint32, packetsPerSecond int, payloadBytes int, endTime time.Time, results *Results) {
+
+	connectToken, err := requestConnectToken(authURL, authBearerToken, envelopeUpKbps, envelopeDownKbps, uint8(packetsPerSecond))
+	if err != nil {
+		core.Error("client %s could not get a connect token: %v", clientAddress, err)
+		clientsFailed.Add(1)
+		return
+	}
+
+	connected := make(chan struct{})
+	var connectedOnce sync.Once
+
+	config := client.DefaultConfig()
+	config.BindAddress = fmt.Sprintf(":%d", clientAddress.Port)
+	config.ClientAddress = clientAddress
+	config.FilterKey = filterKey
+
+	config.ReceiveCallback = func(payload []byte) {
+		payloadsReceived.Add(1)
+		bytesReceived.Add(uint64(len(payload)))
+	}
+
+	config.StateCallback = func(state client.State) {
+		if state == client.StateConnected {
+			connectedOnce.Do(func() { close(connected) })
+		}
+	}
+
+	connectStart := time.Now()
+
+	session, err := client.Connect(connectToken, config)
+	if err != nil {
+		core.Error("client %s could not connect: %v", clientAddress, err)
+		clientsFailed.Add(1)
+		return
+	}
+	defer session.Close()
+
+	payload := make([]byte, payloadBytes)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	sendTicker := time.NewTicker(time.Second / time.Duration(packetsPerSecond))
+	defer sendTicker.Stop()
+
+	sampleTicker := time.NewTicker(time.Second)
+	defer sampleTicker.Stop()
+
+	isConnected := false
+
+	for time.Now().Before(endTime) {
+		select {
+
+		case <-connected:
+			connected = nil
+			isConnected = true
+			clientsConnected.Add(1)
+			results.mutex.Lock()
+			results.connectTimes = append(results.connectTimes, time.Since(connectStart))
+			results.mutex.Unlock()
+
+		case <-sendTicker.C:
+			if session.GetState() != client.StateDisconnected && session.Send(payload) == nil {
+				payloadsSent.Add(1)
+				bytesSent.Add(uint64(len(payload)))
+			}
+
+		case <-sampleTicker.C:
+			if isConnected {
+				stats := session.GetStats()
+				if stats.RTT > 0 {
+					results.mutex.Lock()
+					results.rtts = append(results.rtts, stats.RTT)
+					results.mutex.Unlock()
+				}
+			}
+		}
+	}
+
+	if !isConnected {
+		core.Error("client %s did not connect", clientAddress)
+		clientsFailed.Add(1)
+		return
+	}
+
+	if session.GetState() == client.StateDisconnected {
+		core.Error("client %s disconnected", clientAddress)
+		clientsFailed.Add(1)
+	}
+
+	results.mutex.Lock()
+	results.stats = append(results.stats, session.GetStats())
+	results.mutex.Unlock()
+}
+
+func requestConnectToken(authURL string, authBearerToken string, envelopeUpKbps uint32, envelopeDownKbps uint32, packetsPerSecond uint8) ([]byte, error) {
+
+	requestData := make([]byte, core.UserIdBytes+core.EnvelopeBytes+core.PacketsPerSecondBytes)
+	index := 0
+	core.WriteBytes(requestData, &index, core.RandomBytes(core.UserIdBytes), core.UserIdBytes)
+	core.WriteUint32(requestData, &index, envelopeUpKbps)
+	core.WriteUint32(requestData, &index, envelopeDownKbps)
+	core.WriteUint8(requestData, &index, packetsPerSecond)
+
+	request, err := http.NewRequest("POST", authURL+"/connect_token", bytes.NewReader(requestData))
+	if err != nil {
+		return nil, err
+	}
+	if authBearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+authBearerToken)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	connectToken, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK || (len(connectToken) < core.ConnectTokenBytes || len(connectToken) > core.MaxConnectTokenBytes) {
+		return nil, fmt.Errorf("auth returned %d with %d bytes", response.StatusCode, len(connectToken))
+	}
+
+	return connectToken, nil
+}
+
+// scrapeCounters reads the drop counters from the gateway metrics, keyed by name and labels
+func scrapeCounters(url string) (map[string]float64, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", response.StatusCode)
+	}
+	counters := make(map[string]float64)
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name, _, _ := strings.Cut(fields[0], "{")
+		for _, dropCounter := range dropCounters {
+			if name == dropCounter {
+				value, err := strconv.ParseFloat(fields[1], 64)
+				if err == nil {
+					counters[fields[0]] = value
+				}
+			}
+		}
+	}
+	return counters, scanner.Err()
+}
+
+func formatPercentiles(values []time.Duration) string {
+	if len(values) == 0 {
+		return "no samples"
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	percentile := func(p float64) float64 {
+		return float64(values[int(p*float64(len(values)-1))]) / float64(time.Millisecond)
+	}
+	return fmt.Sprintf("p50 %.1fms, p90 %.1fms, p99 %.1fms, max %.1fms", percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,432 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+const PacketMarker = "udpx:packet"
+
+type FieldTag struct {
+	Skip       bool
+	Optional   bool
+	Bits       int
+	Min        string
+	Max        string
+	Resolution string
+	MaxLength  int
+}
+
+type Field struct {
+	Name string
+	Type string
+	Tag  FieldTag
+}
+
+type Packet struct {
+	Name   string
+	Fields []Field
+}
+
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mainReturnWithCode() int {
+
+	input := flag.String("input", os.Getenv("GOFILE"), "go source file containing packet structs")
+	output := flag.String("output", "", "generated go source file (default <input>_packetgen.go)")
+	flag.Parse()
+
+	if *input == "" {
+		core.Error("missing -input file")
+		return 1
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(*input, ".go") + "_packetgen.go"
+	}
+
+	packageName, packets, err := parsePackets(*input)
+	if err != nil {
+		core.Error("%v", err)
+		return 1
+	}
+
+	if len(packets) == 0 {
+		core.Error("no structs marked with //%s in %s", PacketMarker, *input)
+		return 1
+	}
+
+	source, err := generate(packageName, packets)
+	if err != nil {
+		core.Error("%v", err)
+		return 1
+	}
+
+	if err := ioutil.WriteFile(*output, source, 0644); err != nil {
+		core.Error("could not write %s: %v", *output, err)
+		return 1
+	}
+
+	core.Info("generated %d packets in %s", len(packets), *output)
+
+	return 0
+}
+
+func parsePackets(filename string) (string, []Packet, error) {
+
+	fileSet := token.NewFileSet()
+
+	file, err := parser.ParseFile(fileSet, filename, nil, parser.ParseComments)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not parse %s: %v", filename, err)
+	}
+
+	packets := []Packet{}
+
+	for _, decl := range file.Decls {
+
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+
+		for _, spec := range genDecl.Specs {
+
+			typeSpec := spec.(*ast.TypeSpec)
+
+			structType, ok := typeSpec.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+
+			if !hasMarker(genDecl.Doc) && !hasMarker(typeSpec.Doc) {
+				continue
+			}
+
+			packet := Packet{Name: typeSpec.Name.Name}
+
+			for _, field := range structType.Fields.List {
+
+				tag := FieldTag{}
+				if field.Tag != nil {
+					tagString, err := strconv.Unquote(field.Tag.Value)
+					if err != nil {
+						return "", nil, fmt.Errorf("%s: bad tag: %v", fileSet.Position(field.Pos()), err)
+					}
+					tag, err = parseTag(reflect.StructTag(tagString).Get("udpx"))
+					if err != nil {
+						return "", nil, fmt.Errorf("%s: %v", fileSet.Position(field.Pos()), err)
+					}
+				}
+
+				if tag.Skip {
+					continue
+				}
+
+				if len(field.Names) == 0 {
+					return "", nil, fmt.Errorf("%s: embedded fields are not supported", fileSet.Position(field.Pos()))
+				}
+
+				var typeString bytes.Buffer
+				if err := format.Node(&typeString, fileSet, field.Type); err != nil {
+					return "", nil, err
+				}
+
+				for _, name := range field.Names {
+					packet.Fields = append(packet.Fields, Field{Name: name.Name, Type: typeString.String(), Tag: tag})
+				}
+			}
+
+			packets = append(packets, packet)
+		}
+	}
+
+	return file.Name.Name, packets, nil
+}
+
+func hasMarker(comments *ast.CommentGroup) bool {
+	if comments == nil {
+		return false
+	}
+	for _, comment := range comments.List {
+		if strings.TrimSpace(strings.TrimPrefix(comment.Text, "//")) == PacketMarker {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTag(tag string) (FieldTag, error) {
+	fieldTag := FieldTag{}
+	if tag == "" {
+		return fieldTag, nil
+	}
+	if tag == "-" {
+		fieldTag.Skip = true
+		return fieldTag, nil
+	}
+	for _, option := range strings.Split(tag, ",") {
+		option = strings.TrimSpace(option)
+		key, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			key, value = option[:i], option[i+1:]
+		}
+		var err error
+		switch key {
+		case "optional":
+			fieldTag.Optional = true
+		case "bits":
+			fieldTag.Bits, err = strconv.Atoi(value)
+			if err == nil && (fieldTag.Bits < 1 || fieldTag.Bits > 32) {
+				err = fmt.Errorf("bits must be in [1,32]")
+			}
+		case "min":
+			_, err = strconv.ParseFloat(value, 64)
+			fieldTag.Min = value
+		case "max":
+			_, err = strconv.ParseFloat(value, 64)
+			fieldTag.Max = value
+		case "resolution":
+			_, err = strconv.ParseFloat(value, 64)
+			fieldTag.Resolution = value
+		case "maxlen":
+			fieldTag.MaxLength, err = strconv.Atoi(value)
+			if err == nil && fieldTag.MaxLength <= 0 {
+				err = fmt.Errorf("maxlen must be positive")
+			}
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return fieldTag, fmt.Errorf("invalid udpx tag option %q: %v", option, err)
+		}
+	}
+	return fieldTag, nil
+}
+
+func generate(packageName string, packets []Packet) ([]byte, error) {
+
+	corePrefix := "core."
+	if packageName == "core" {
+		corePrefix = ""
+	}
+
+	var out bytes.Buffer
+
+	fmt.Fprintf(&out, "// Code generated by packetgen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&out, "package %s\n\n", packageName)
+
+	imports := []string{}
+	for _, packet := range packets {
+		for _, field := range packet.Fields {
+			if field.Tag.Optional && field.Type == "net.UDPAddr" {
+				imports = append(imports, "net")
+				break
+			}
+		}
+		if len(imports) > 0 {
+			break
+		}
+	}
+	if corePrefix != "" {
+		if len(imports) > 0 {
+			imports = append(imports, "")
+		}
+		imports = append(imports, "github.com/networknext/udpx/modules/core")
+	}
+	if len(imports) > 0 {
+		fmt.Fprintf(&out, "import (\n")
+		for _, path := range imports {
+			if path == "" {
+				fmt.Fprintf(&out, "\n")
+				continue
+			}
+			fmt.Fprintf(&out, "\t%q\n", path)
+		}
+		fmt.Fprintf(&out, ")\n\n")
+	}
+
+	for _, packet := range packets {
+
+		fmt.Fprintf(&out, "func (packet *%s) Serialize(stream %sStream) error {\n", packet.Name, corePrefix)
+
+		for _, field := range packet.Fields {
+			code, err := serializeField(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", packet.Name, field.Name, err)
+			}
+			if field.Tag.Optional {
+				zeroCheck, zeroValue, err := zeroField(field)
+				if err != nil {
+					return nil, fmt.Errorf("%s.%s: %v", packet.Name, field.Name, err)
+				}
+				fmt.Fprintf(&out, "\t{\n\t\thas%s := %s\n\t\tstream.SerializeBool(&has%s)\n\t\tif has%s {\n%s\t\t} else if stream.IsReading() {\n\t\t\tpacket.%s = %s\n\t\t}\n\t}\n",
+					field.Name, zeroCheck, field.Name, field.Name, indent(code, 2), field.Name, zeroValue)
+			} else {
+				out.WriteString(indent(code, 1))
+			}
+		}
+
+		fmt.Fprintf(&out, "\treturn stream.Error()\n}\n\n")
+
+		fmt.Fprintf(&out, "func Write%s(buffer []byte, packet *%s) (int, error) {\n", packet.Name, packet.Name)
+		fmt.Fprintf(&out, "\tstream := %sCreateWriteStream(buffer)\n", corePrefix)
+		fmt.Fprintf(&out, "\tif err := packet.Serialize(stream); err != nil {\n\t\treturn 0, err\n\t}\n")
+		fmt.Fprintf(&out, "\tstream.Flush()\n\treturn stream.GetBytesProcessed(), nil\n}\n\n")
+
+		fmt.Fprintf(&out, "func Read%s(buffer []byte, packet *%s) error {\n", packet.Name, packet.Name)
+		fmt.Fprintf(&out, "\tstream := %sCreateReadStream(buffer)\n", corePrefix)
+		fmt.Fprintf(&out, "\treturn packet.Serialize(stream)\n}\n\n")
+	}
+
+	source, err := format.Source(out.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("could not format generated code: %v\n%s", err, out.String())
+	}
+
+	return source, nil
+}
+
+func serializeField(field Field) (string, error) {
+
+	name := "packet." + field.Name
+	tag := field.Tag
+
+	if tag.Bits != 0 {
+		switch field.Type {
+		case "uint32":
+			return fmt.Sprintf("stream.SerializeBits(&%s, %d)\n", name, tag.Bits), nil
+		case "uint8", "uint16":
+			return fmt.Sprintf("{\n\tvalue := uint32(%s)\n\tstream.SerializeBits(&value, %d)\n\t%s = %s(value)\n}\n", name, tag.Bits, name, field.Type), nil
+		default:
+			return "", fmt.Errorf("bits is not supported for type %s", field.Type)
+		}
+	}
+
+	if tag.Resolution != "" {
+		if field.Type != "float32" || tag.Min == "" || tag.Max == "" {
+			return "", fmt.Errorf("resolution requires a float32 field with min and max")
+		}
+		return fmt.Sprintf("stream.SerializeCompressedFloat(&%s, %s, %s, %s)\n", name, tag.Min, tag.Max, tag.Resolution), nil
+	}
+
+	switch field.Type {
+
+	case "bool":
+		return fmt.Sprintf("stream.SerializeBool(&%s)\n", name), nil
+
+	case "uint8", "uint16", "uint32", "uint64", "float32", "float64":
+		return fmt.Sprintf("stream.Serialize%s(&%s)\n", strings.Title(field.Type), name), nil
+
+	case "int8", "int16", "int32":
+		min, max := tag.Min, tag.Max
+		if min == "" || max == "" {
+			bits := map[string]int{"int8": 8, "int16": 16, "int32": 32}[field.Type]
+			min = strconv.FormatInt(-(int64(1) << uint(bits-1)), 10)
+			max = strconv.FormatInt((int64(1)<<uint(bits-1))-1, 10)
+		}
+		if field.Type == "int32" {
+			return fmt.Sprintf("stream.SerializeInteger(&%s, %s, %s)\n", name, min, max), nil
+		}
+		return fmt.Sprintf("{\n\tvalue := int32(%s)\n\tstream.SerializeInteger(&value, %s, %s)\n\t%s = %s(value)\n}\n", name, min, max, name, field.Type), nil
+
+	case "string":
+		if tag.MaxLength == 0 {
+			return "", fmt.Errorf("string fields require maxlen")
+		}
+		return fmt.Sprintf("stream.SerializeString(&%s, %d)\n", name, tag.MaxLength), nil
+
+	case "[]byte":
+		if tag.MaxLength == 0 {
+			return "", fmt.Errorf("[]byte fields require maxlen")
+		}
+		return fmt.Sprintf("{\n\tlength := int32(len(%s))\n\tstream.SerializeInteger(&length, 0, %d)\n\tif stream.IsReading() && stream.Error() == nil {\n\t\t%s = make([]byte, length)\n\t}\n\tif length > 0 {\n\t\tstream.SerializeBytes(%s)\n\t}\n}\n", name, tag.MaxLength, name, name), nil
+
+	case "net.UDPAddr":
+		return fmt.Sprintf("stream.SerializeAddress(&%s)\n", name), nil
+	}
+
+	if strings.HasPrefix(field.Type, "[") && strings.HasSuffix(field.Type, "]byte") {
+		return fmt.Sprintf("stream.SerializeBytes(%s[:])\n", name), nil
+	}
+
+	return "", fmt.Errorf("unsupported type %s", field.Type)
+}
+
+func zeroField(field Field) (string, string, error) {
+	name := "packet." + field.Name
+	switch field.Type {
+	case "bool":
+		return name, "false", nil
+	case "uint8", "uint16", "uint32", "uint64", "int8", "int16", "int32", "float32", "float64":
+		return name + " != 0", "0", nil
+	case "string":
+		return name + ` != ""`, `""`, nil
+	case "[]byte":
+		return "len(" + name + ") != 0", "nil", nil
+	case "net.UDPAddr":
+		return name + ".IP != nil", "net.UDPAddr{}", nil
+	}
+	if strings.HasPrefix(field.Type, "[") && strings.HasSuffix(field.Type, "]byte") {
+		return name + " != " + field.Type + "{}", field.Type + "{}", nil
+	}
+	return "", "", fmt.Errorf("optional is not supported for type %s", field.Type)
+}
+
+func indent(code string, depth int) string {
+	prefix := strings.Repeat("\t", depth)
+	lines := strings.SplitAfter(code, "\n")
+	var out strings.Builder
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		out.WriteString(prefix + line)
+	}
+	return out.String()
+}
@@ -0,0 +1,189 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/networknext/udpx/cmd/packetgen/testdata/example"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden output in testdata")
+
+const goldenInput = "testdata/example/packets.go"
+const goldenOutput = "testdata/example/packets_packetgen.go"
+
+func TestGenerateGolden(t *testing.T) {
+
+	packageName, packets, err := parsePackets(goldenInput)
+	assert.Nil(t, err)
+	assert.Equal(t, "example", packageName)
+	assert.Equal(t, 2, len(packets))
+
+	source, err := generate(packageName, packets)
+	assert.Nil(t, err)
+
+	if *update {
+		assert.Nil(t, ioutil.WriteFile(goldenOutput, source, 0644))
+	}
+
+	golden, err := ioutil.ReadFile(goldenOutput)
+	assert.Nil(t, err)
+	if !bytes.Equal(golden, source) {
+		t.Fatalf("generated code differs from %s. run go test ./cmd/packetgen -update if the change is intended", goldenOutput)
+	}
+}
+
+func TestGeneratedRoundTrip(t *testing.T) {
+
+	t.Parallel()
+
+	written := example.PlayerState{
+		PlayerId:  0x1122334455667788,
+		Health:    100,
+		Team:      5,
+		Frame:     123456,
+		Alive:     true,
+		Score:     -750,
+		Delta:     -3,
+		Speed:     12.5,
+		Distance:  1234.5678,
+		Yaw:       -123.456,
+		Name:      "player",
+		Payload:   []byte{1, 2, 3, 4, 5},
+		SessionId: [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Address:   *core.ParseAddress("10.0.0.1:30000"),
+		Comment:   "hello",
+		Relay:     *core.ParseAddress("[2001:db8::1]:40000"),
+		Cached:    99,
+	}
+
+	buffer := make([]byte, 1024)
+	bytesWritten, err := example.WritePlayerState(buffer, &written)
+	assert.Nil(t, err)
+
+	var read example.PlayerState
+	assert.Nil(t, example.ReadPlayerState(buffer[:bytesWritten], &read))
+
+	// compressed floats come back within their resolution, and skipped fields aren't sent
+
+	assert.InDelta(t, float64(written.Yaw), float64(read.Yaw), 0.01)
+	assert.Equal(t, 0, read.Cached)
+
+	read.Yaw, read.Cached = written.Yaw, written.Cached
+	assert.True(t, written.Address.IP.Equal(read.Address.IP))
+	assert.True(t, written.Relay.IP.Equal(read.Relay.IP))
+	read.Address.IP, read.Relay.IP = written.Address.IP, written.Relay.IP
+	assert.Equal(t, written, read)
+
+	// optional fields left empty read back empty
+
+	written.Comment = ""
+	written.Relay = net.UDPAddr{}
+	bytesWritten, err = example.WritePlayerState(buffer, &written)
+	assert.Nil(t, err)
+	read = example.PlayerState{Comment: "stale", Relay: *core.ParseAddress("10.0.0.2:1")}
+	assert.Nil(t, example.ReadPlayerState(buffer[:bytesWritten], &read))
+	assert.Equal(t, "", read.Comment)
+	assert.Nil(t, read.Relay.IP)
+}
+
+func TestGeneratedCompressedFloat(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 1024)
+
+	for _, yaw := range []float32{-180, -179.995, -90.123, 0, 0.004, 45.678, 179.99, 180} {
+		written := example.PlayerState{Yaw: yaw}
+		bytesWritten, err := example.WritePlayerState(buffer, &written)
+		assert.Nil(t, err)
+		var read example.PlayerState
+		assert.Nil(t, example.ReadPlayerState(buffer[:bytesWritten], &read))
+		assert.True(t, math.Abs(float64(read.Yaw-yaw)) <= 0.01, "yaw %f read back as %f", yaw, read.Yaw)
+	}
+}
+
+func TestGeneratedReadTruncated(t *testing.T) {
+
+	t.Parallel()
+
+	written := example.Ping{Sequence: 1000}
+	buffer := make([]byte, 64)
+	bytesWritten, err := example.WritePing(buffer, &written)
+	assert.Nil(t, err)
+
+	var read example.Ping
+	assert.Nil(t, example.ReadPing(buffer[:bytesWritten], &read))
+	assert.Equal(t, written, read)
+	assert.NotNil(t, example.ReadPing(buffer[:bytesWritten-1], &read))
+}
+
+func TestParseTag(t *testing.T) {
+
+	t.Parallel()
+
+	tag, err := parseTag("optional,bits=7")
+	assert.Nil(t, err)
+	assert.Equal(t, FieldTag{Optional: true, Bits: 7}, tag)
+
+	tag, err = parseTag("-")
+	assert.Nil(t, err)
+	assert.True(t, tag.Skip)
+
+	for _, invalid := range []string{"bits=0", "bits=33", "bits=x", "min=low", "maxlen=0", "resolution=fine", "unknown"} {
+		_, err := parseTag(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+
+	t.Parallel()
+
+	for _, field := range []Field{
+		{Name: "Name", Type: "string"},
+		{Name: "Yaw", Type: "float32", Tag: FieldTag{Resolution: "0.01"}},
+		{Name: "Count", Type: "int64", Tag: FieldTag{Bits: 8}},
+		{Name: "Values", Type: "map[string]int"},
+	} {
+		_, err := generate("example", []Packet{{Name: "Bad", Fields: []Field{field}}})
+		assert.NotNil(t, err, field.Name)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package example is the packetgen golden test input. Regenerate packets_packetgen.go with
+// "go test ./cmd/packetgen -update" after changing packetgen or these structs.
+package example
+
+//go:generate go run ../../packetgen.go -input packets.go
+
+import "net"
+
+//udpx:packet
+type PlayerState struct {
+	PlayerId  uint64
+	Health    uint8  `udpx:"bits=7"`
+	Team      uint16 `udpx:"bits=3"`
+	Frame     uint32 `udpx:"bits=20"`
+	Alive     bool
+	Score     int32 `udpx:"min=-1000,max=1000"`
+	Delta     int8
+	Speed     float32
+	Distance  float64
+	Yaw       float32 `udpx:"min=-180,max=180,resolution=0.01"`
+	Name      string  `udpx:"maxlen=32"`
+	Payload   []byte  `udpx:"maxlen=64"`
+	SessionId [8]byte
+	Address   net.UDPAddr
+	Comment   string      `udpx:"optional,maxlen=16"`
+	Relay     net.UDPAddr `udpx:"optional"`
+	Cached    int         `udpx:"-"`
+}
+
+//udpx:packet
+type Ping struct {
+	Sequence uint64
+}
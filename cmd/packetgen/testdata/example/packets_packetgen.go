@@ -0,0 +1,99 @@
+// Code generated by packetgen. DO NOT EDIT.
+
+package example
+
+import (
+	"net"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+func (packet *PlayerState) Serialize(stream core.Stream) error {
+	stream.SerializeUint64(&packet.PlayerId)
+	{
+		value := uint32(packet.Health)
+		stream.SerializeBits(&value, 7)
+		packet.Health = uint8(value)
+	}
+	{
+		value := uint32(packet.Team)
+		stream.SerializeBits(&value, 3)
+		packet.Team = uint16(value)
+	}
+	stream.SerializeBits(&packet.Frame, 20)
+	stream.SerializeBool(&packet.Alive)
+	stream.SerializeInteger(&packet.Score, -1000, 1000)
+	{
+		value := int32(packet.Delta)
+		stream.SerializeInteger(&value, -128, 127)
+		packet.Delta = int8(value)
+	}
+	stream.SerializeFloat32(&packet.Speed)
+	stream.SerializeFloat64(&packet.Distance)
+	stream.SerializeCompressedFloat(&packet.Yaw, -180, 180, 0.01)
+	stream.SerializeString(&packet.Name, 32)
+	{
+		length := int32(len(packet.Payload))
+		stream.SerializeInteger(&length, 0, 64)
+		if stream.IsReading() && stream.Error() == nil {
+			packet.Payload = make([]byte, length)
+		}
+		if length > 0 {
+			stream.SerializeBytes(packet.Payload)
+		}
+	}
+	stream.SerializeBytes(packet.SessionId[:])
+	stream.SerializeAddress(&packet.Address)
+	{
+		hasComment := packet.Comment != ""
+		stream.SerializeBool(&hasComment)
+		if hasComment {
+			stream.SerializeString(&packet.Comment, 16)
+		} else if stream.IsReading() {
+			packet.Comment = ""
+		}
+	}
+	{
+		hasRelay := packet.Relay.IP != nil
+		stream.SerializeBool(&hasRelay)
+		if hasRelay {
+			stream.SerializeAddress(&packet.Relay)
+		} else if stream.IsReading() {
+			packet.Relay = net.UDPAddr{}
+		}
+	}
+	return stream.Error()
+}
+
+func WritePlayerState(buffer []byte, packet *PlayerState) (int, error) {
+	stream := core.CreateWriteStream(buffer)
+	if err := packet.Serialize(stream); err != nil {
+		return 0, err
+	}
+	stream.Flush()
+	return stream.GetBytesProcessed(), nil
+}
+
+func ReadPlayerState(buffer []byte, packet *PlayerState) error {
+	stream := core.CreateReadStream(buffer)
+	return packet.Serialize(stream)
+}
+
+func (packet *Ping) Serialize(stream core.Stream) error {
+	stream.SerializeUint64(&packet.Sequence)
+	return stream.Error()
+}
+
+func WritePing(buffer []byte, packet *Ping) (int, error) {
+	stream := core.CreateWriteStream(buffer)
+	if err := packet.Serialize(stream); err != nil {
+		return 0, err
+	}
+	stream.Flush()
+	return stream.GetBytesProcessed(), nil
+}
+
+func ReadPing(buffer []byte, packet *Ping) error {
+	stream := core.CreateReadStream(buffer)
+	return packet.Serialize(stream)
+}
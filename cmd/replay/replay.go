@@ -0,0 +1,231 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/networknext/udpx/modules/capture"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/status"
+)
+
+const MaxPacketSize = 1500
+
+var repliesReceived atomic.Uint64
+
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mainReturnWithCode() int {
+
+	serviceName := "udpx replay"
+
+	log.SetService(serviceName)
+
+	core.Info("%s %s", serviceName, status.VersionString())
+
+	// configure. captures are recorded by running a gateway with CAPTURE_FILE set
+
+	captureFile := envvar.Get("CAPTURE_FILE", "")
+	if captureFile == "" {
+		core.Error("CAPTURE_FILE is not set")
+		return 1
+	}
+
+	gatewayAddress, err := envvar.GetAddress("GATEWAY_ADDRESS", core.ParseAddress("127.0.0.1:40000"))
+	if err != nil {
+		core.Error("invalid GATEWAY_ADDRESS: %v", err)
+		return 1
+	}
+
+	// 2 replays twice as fast as the packets were captured, 0 as fast as possible
+
+	speed, err := envvar.GetFloat("SPEED", 1)
+	if err != nil || speed < 0 {
+		core.Error("invalid SPEED: %v", err)
+		return 1
+	}
+
+	// the packet filter and session tokens check the address packets come from. with PROXY_PROTOCOL, each packet
+	// carries the address it was captured from in a PROXY protocol header, so a gateway with PROXY_PROTOCOL set
+	// sees the original clients. otherwise each captured address is replayed from its own socket
+
+	proxyProtocol, err := envvar.GetBool("PROXY_PROTOCOL", true)
+	if err != nil {
+		core.Error("invalid PROXY_PROTOCOL: %v", err)
+		return 1
+	}
+
+	bindIP := envvar.Get("BIND_IP", "")
+
+	reader, err := capture.Open(captureFile)
+	if err != nil {
+		core.Error("could not open capture file: %v", err)
+		return 1
+	}
+	defer reader.Close()
+
+	core.Info("replaying %s to %s at %gx speed", captureFile, gatewayAddress, speed)
+	core.Info("packets were captured by gateway %s. run the test gateway with GATEWAY_ADDRESS=%s and the same keys, so they pass the packet filter and decrypt", reader.GatewayAddress, reader.GatewayAddress)
+
+	ctx, ctxCancelFunc := context.WithCancel(context.Background())
+	defer ctxCancelFunc()
+
+	go func() {
+		termChan := make(chan os.Signal, 1)
+		signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
+		<-termChan
+		ctxCancelFunc()
+	}()
+
+	// one socket per captured address, or a single socket for everything with the proxy protocol
+
+	var receivers sync.WaitGroup
+	sockets := make(map[string]*net.UDPConn)
+	defer func() {
+		for _, conn := range sockets {
+			conn.Close()
+		}
+		receivers.Wait()
+	}()
+
+	getSocket := func(from *net.UDPAddr) (*net.UDPConn, error) {
+		key := ""
+		if !proxyProtocol {
+			key = from.String()
+		}
+		if conn, ok := sockets[key]; ok {
+			return conn, nil
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(bindIP)})
+		if err != nil {
+			return nil, err
+		}
+		sockets[key] = conn
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			buffer := make([]byte, MaxPacketSize)
+			for {
+				if _, _, err := conn.ReadFromUDP(buffer); err != nil {
+					return
+				}
+				repliesReceived.Add(1)
+			}
+		}()
+		return conn, nil
+	}
+
+	// replay packets with the same gaps between them as when they were captured, divided by the speed
+
+	var packet capture.Packet
+	var firstPacketTime time.Time
+	startTime := time.Now()
+
+	packetsSent := 0
+	bytesSent := 0
+	sources := make(map[string]bool)
+
+	packetData := make([]byte, core.ProxyProtocolHeaderBytes+core.ProxyProtocolAddressBytes_UDP6+capture.MaxPacketBytes)
+
+	for ctx.Err() == nil {
+
+		err := reader.Read(&packet)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			core.Info("capture file ends part way through a packet")
+			break
+		}
+		if err != nil {
+			core.Error("could not read capture file: %v", err)
+			return 1
+		}
+
+		if firstPacketTime.IsZero() {
+			firstPacketTime = packet.Time
+		}
+
+		if speed > 0 {
+			sendTime := startTime.Add(time.Duration(float64(packet.Time.Sub(firstPacketTime)) / speed))
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(sendTime)):
+			}
+		}
+
+		conn, err := getSocket(packet.From)
+		if err != nil {
+			core.Error("could not create socket: %v", err)
+			return 1
+		}
+
+		headerBytes := 0
+		if proxyProtocol {
+			headerBytes = core.WriteProxyHeader(packetData, packet.From, reader.GatewayAddress)
+		}
+		copy(packetData[headerBytes:], packet.Data)
+
+		if _, err := conn.WriteToUDP(packetData[:headerBytes+len(packet.Data)], gatewayAddress); err != nil {
+			core.Debug("could not send packet: %v", err)
+			continue
+		}
+
+		packetsSent++
+		bytesSent += len(packet.Data)
+		sources[packet.From.String()] = true
+	}
+
+	// give the gateway a moment to reply to the last packets
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+
+	core.Info("replayed %d packets (%d bytes) from %d addresses in %.1fs, %d replies received", packetsSent, bytesSent, len(sources), time.Since(startTime).Seconds(), repliesReceived.Load())
+
+	return 0
+}
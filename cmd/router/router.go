@@ -0,0 +1,291 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/metrics"
+	"github.com/networknext/udpx/modules/router"
+	"github.com/networknext/udpx/modules/status"
+
+	"github.com/gorilla/mux"
+)
+
+// Allows us to return an exit code and allows log flushes and deferred functions
+// to finish before exiting.
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+const MaxMeasurementsBytes = 1024 * 1024
+
+var Planner *router.Planner
+var RouterToken string
+
+var Metrics = metrics.CreateRegistry()
+
+var Status = status.CreateReporter("udpx router", Metrics, time.Now())
+
+var MeasurementsAccepted = Metrics.Counter("udpx_router_measurements_total", "RTT measurements folded into links.")
+var MeasurementsRejected = Metrics.Counter("udpx_router_measurements_rejected_total", "RTT measurements rejected as invalid.")
+var DirectRoutes = Metrics.Counter(`udpx_router_routes_total{type="direct"}`, "Routes planned.")
+var RelayedRoutes = Metrics.Counter(`udpx_router_routes_total{type="relayed"}`, "Routes planned.")
+var RouteFailures = Metrics.Counter("udpx_router_route_failures_total", "Route requests with no route to the server.")
+var LinksActive = Metrics.Gauge("udpx_router_links_active", "Links with a measurement newer than RTT_MAX_AGE.")
+
+func mainReturnWithCode() int {
+
+	serviceName := "udpx router"
+
+	log.SetService(serviceName)
+
+	core.Info("%s %s", serviceName, status.VersionString())
+
+	// configure
+
+	gatewayAddresses, err := envvar.GetAddressList("GATEWAY_ADDRESSES", nil)
+	if err != nil || len(gatewayAddresses) == 0 {
+		core.Error("missing or invalid GATEWAY_ADDRESSES: %v", err)
+		return 1
+	}
+
+	routeThreshold, err := envvar.GetDuration("ROUTE_THRESHOLD", 10*time.Millisecond)
+	if err != nil {
+		core.Error("invalid ROUTE_THRESHOLD: %v", err)
+		return 1
+	}
+
+	rttMaxAge, err := envvar.GetDurationRange("RTT_MAX_AGE", time.Minute, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid RTT_MAX_AGE: %v", err)
+		return 1
+	}
+
+	shutdownTimeout, err := envvar.GetDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		core.Error("invalid SHUTDOWN_TIMEOUT: %v", err)
+		return 1
+	}
+
+	// gateways and whatever measures client regions post rtts with this token, and the auth service asks for routes with it
+
+	RouterToken = envvar.Get("ROUTER_TOKEN", "")
+	if RouterToken == "" {
+		core.Info("ROUTER_TOKEN is not set. anybody can post rtt measurements and request routes")
+	}
+
+	gateways := make([]string, len(gatewayAddresses))
+	for i := range gatewayAddresses {
+		gateways[i] = gatewayAddresses[i].String()
+	}
+
+	Planner = router.CreatePlanner(gateways, routeThreshold, rttMaxAge)
+
+	core.Info("planning routes across %d gateways", len(gateways))
+
+	// prune stale links
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			LinksActive.Set(int64(Planner.Prune(time.Now())))
+		}
+	}()
+
+	Status.SetConfig(envvar.Values())
+	Status.SetDetails(func() map[string]interface{} {
+		return map[string]interface{}{"links_active": LinksActive.Get()}
+	})
+
+	// start web server
+
+	httpRouter := mux.NewRouter()
+	httpRouter.HandleFunc("/health", healthHandler).Methods("GET")
+	httpRouter.Handle("/status", Status).Methods("GET")
+	httpRouter.Handle("/metrics", Metrics).Methods("GET")
+	httpRouter.Handle("/rtt", requireRouterToken(http.HandlerFunc(rttHandler))).Methods("POST")
+	httpRouter.Handle("/route", requireRouterToken(http.HandlerFunc(routeHandler))).Methods("GET")
+	httpRouter.Handle("/gateways", requireRouterToken(http.HandlerFunc(gatewaysHandler))).Methods("GET")
+	httpRouter.Handle("/links", requireRouterToken(http.HandlerFunc(linksHandler))).Methods("GET")
+
+	httpPort := envvar.Get("HTTP_PORT", "61000")
+
+	srv := &http.Server{
+		Addr:    ":" + httpPort,
+		Handler: httpRouter,
+	}
+
+	go func() {
+		core.Info("started http server on port %s", httpPort)
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			core.Error("failed to start http server: %v", err)
+			return
+		}
+	}()
+
+	// wait for shutdown
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
+	<-termChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		core.Error("failed to drain http requests: %v", err)
+		return 1
+	}
+
+	fmt.Println("shutdown completed")
+
+	return 0
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func requireRouterToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RouterToken == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+RouterToken)) != 1 {
+			core.Debug("invalid router token")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rttHandler takes a json array of measurements. measurements that don't fit the gateways are skipped, and the
+// request fails only if none of them were used
+
+func rttHandler(w http.ResponseWriter, r *http.Request) {
+
+	var measurements []router.Measurement
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxMeasurementsBytes)).Decode(&measurements); err != nil {
+		core.Debug("could not read measurements: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	currentTime := time.Now()
+	accepted := 0
+	for _, measurement := range measurements {
+		if err := Planner.AddMeasurement(measurement, currentTime); err != nil {
+			core.Debug("rejected measurement: %v", err)
+			MeasurementsRejected.Inc()
+			continue
+		}
+		MeasurementsAccepted.Inc()
+		accepted++
+	}
+
+	if accepted == 0 && len(measurements) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func routeHandler(w http.ResponseWriter, r *http.Request) {
+
+	region := r.URL.Query().Get("region")
+	if region == "" {
+		core.Debug("missing region")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	route, err := Planner.Route(region, time.Now())
+	if err != nil {
+		core.Debug("no route for region %s", region)
+		RouteFailures.Inc()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(route.RelayAddresses) > 0 {
+		RelayedRoutes.Inc()
+	} else {
+		DirectRoutes.Inc()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(route); err != nil {
+		core.Debug("failed to write route: %v", err)
+	}
+}
+
+// gatewaysHandler serves the gateways routes are planned across, so gateways know who to ping
+
+func gatewaysHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Planner.GetGateways()); err != nil {
+		core.Debug("failed to write gateways: %v", err)
+	}
+}
+
+func linksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Planner.Links(time.Now())); err != nil {
+		core.Debug("failed to write links: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/simulator"
+	"github.com/networknext/udpx/modules/status"
+)
+
+func main() {
+	os.Exit(mainReturnWithCode())
+}
+
+func mainReturnWithCode() int {
+
+	serviceName := "udpx simulator"
+
+	log.SetService(serviceName)
+
+	core.Info("%s %s", serviceName, status.VersionString())
+
+	// configure. put the simulator at the address clients send to, and forward to the gateway
+
+	listenAddress := envvar.Get("LISTEN_ADDRESS", "127.0.0.1:45000")
+
+	targetAddress, err := envvar.GetAddress("TARGET_ADDRESS", core.ParseAddress("127.0.0.1:40000"))
+	if err != nil {
+		core.Error("invalid TARGET_ADDRESS: %v", err)
+		return 1
+	}
+
+	// with UPSTREAM_IP set, the target sees a client sending from port P at UPSTREAM_IP:P, so udpx clients
+	// can set CLIENT_ADDRESS to match. otherwise clients are forwarded from ephemeral ports
+
+	var upstreamIP net.IP
+	if value := envvar.Get("UPSTREAM_IP", ""); value != "" {
+		upstreamIP = net.ParseIP(value)
+		if upstreamIP == nil {
+			core.Error("invalid UPSTREAM_IP: %s", value)
+			return 1
+		}
+	}
+
+	var config simulator.Config
+
+	config.Latency, err = envvar.GetDurationRange("LATENCY", 0, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid LATENCY: %v", err)
+		return 1
+	}
+
+	config.Jitter, err = envvar.GetDurationRange("JITTER", 0, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid JITTER: %v", err)
+		return 1
+	}
+
+	config.ReorderDelay, err = envvar.GetDurationRange("REORDER_DELAY", 50*time.Millisecond, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid REORDER_DELAY: %v", err)
+		return 1
+	}
+
+	for name, value := range map[string]*float64{"PACKET_LOSS": &config.Loss, "PACKET_DUPLICATION": &config.Duplication, "PACKET_REORDER": &config.Reorder} {
+		*value, err = envvar.GetFloat(name, 0)
+		if err != nil || *value < 0 || *value > 1 {
+			core.Error("invalid %s: %v", name, err)
+			return 1
+		}
+	}
+
+	// the same SEED gives the same packets the same fate
+
+	seed, err := envvar.GetInt("SEED", int(time.Now().UnixNano()))
+	if err != nil {
+		core.Error("invalid SEED: %v", err)
+		return 1
+	}
+	config.Seed = int64(seed)
+
+	statusInterval, err := envvar.GetDurationRange("STATUS_INTERVAL", 10*time.Second, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid STATUS_INTERVAL: %v", err)
+		return 1
+	}
+
+	// start
+
+	networkSimulator := simulator.Create(config)
+	defer networkSimulator.Close()
+
+	proxy, err := simulator.Listen(listenAddress, targetAddress, upstreamIP, networkSimulator)
+	if err != nil {
+		core.Error("could not start proxy: %v", err)
+		return 1
+	}
+	defer proxy.Close()
+
+	core.Info("forwarding %s to %s with %v latency, %v jitter, %.1f%% loss, %.1f%% duplication, %.1f%% reordering (seed %d)",
+		proxy.GetAddress(), targetAddress, config.Latency, config.Jitter, config.Loss*100, config.Duplication*100, config.Reorder*100, config.Seed)
+
+	go func() {
+		ticker := time.NewTicker(statusInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			stats := networkSimulator.GetStats()
+			core.Info("%d routes. %d packets, %d dropped, %d duplicated, %d reordered", proxy.GetNumRoutes(), stats.Packets, stats.Dropped, stats.Duplicated, stats.Reordered)
+		}
+	}()
+
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, os.Interrupt, syscall.SIGTERM)
+	<-termChan
+
+	core.Info("shutting down")
+
+	return 0
+}
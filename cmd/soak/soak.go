@@ -29,152 +29,665 @@
 	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 */
 
+// soak runs a server, a network simulator and simulated clients in process against a gateway and auth service
+// run from ./dist, for hours, then checks that sessions, goroutines and memory all came back down. the gateway
+// and auth are separate binaries, so they run as child processes.
+
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/client"
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/server"
+	"github.com/networknext/udpx/modules/simulator"
 )
 
+// clients reach the gateway through the proxy at the public gateway address. the gateway itself listens on
+// the next ports up
+
 const (
-	clientBin       = "./dist/client"
-	gatewayBin      = "./dist/gateway"
-	serverBin       = "./dist/server"
-	authBin         = "./dist/auth"
-	connectTokenBin = "./dist/connect_token"
+	publicGatewayAddress   = "127.0.0.1:40000"
+	gatewayPort            = 40010
+	gatewayInternalAddress = "127.0.0.1:40011"
+	serverAddress          = "127.0.0.1:50000"
+	authPort               = 60000
 )
 
-func client(port uint16) *exec.Cmd {
+var (
+	sessionsStarted   atomic.Uint64
+	sessionsAbandoned atomic.Uint64
+	payloadsSent      atomic.Uint64
+	payloadsReceived  atomic.Uint64
+	messagesReceived  atomic.Uint64
+	corruptPayloads   atomic.Uint64
+	corruptMessages   atomic.Uint64
+	tokenFailures     atomic.Uint64
+)
 
-	// get connect token
+func main() {
+	os.Exit(mainReturnWithCode())
+}
 
-	connect_token_cmd := exec.Command(connectTokenBin)
-	if connect_token_cmd == nil {
-		panic("could not exec connect token")
+func mainReturnWithCode() int {
+
+	log.SetService("udpx soak")
+
+	// configure
+
+	duration, err := envvar.GetDurationRange("SOAK_DURATION", time.Hour, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SOAK_DURATION: %v", err)
+		return 1
 	}
 
-	connect_token_cmd.Env = os.Environ()
-	connect_token_cmd.Env = append(connect_token_cmd.Env, "GATEWAY_ADDRESS=127.0.0.1:40000")
-	connect_token_cmd.Env = append(connect_token_cmd.Env, "GATEWAY_PUBLIC_KEY=vnIjsJWZzgq+nS9t3KU7ch5BFhgDkm2U2bm7/2W6eRs=")
-	connect_token_cmd.Env = append(connect_token_cmd.Env, "GATEWAY_PRIVATE_KEY=qmnxBZs2UElVT4SXCdDuX4td+qtPkuXLL5VdOE0vvcA=")
-	connect_token_cmd.Env = append(connect_token_cmd.Env, "AUTH_PRIVATE_KEY=VmmdIRwxUb7vmzupzHbBHqJF3WPpLrp0Y0EzepAzny0=")
+	numClients, err := envvar.GetIntRange("NUM_CLIENTS", 16, 1, 1000)
+	if err != nil {
+		core.Error("invalid NUM_CLIENTS: %v", err)
+		return 1
+	}
+
+	clientBasePort, err := envvar.GetIntRange("CLIENT_BASE_PORT", 30000, 1024, 65535-numClients)
+	if err != nil {
+		core.Error("invalid CLIENT_BASE_PORT: %v", err)
+		return 1
+	}
+
+	packetsPerSecond, err := envvar.GetIntRange("PACKETS_PER_SECOND", 20, 1, 100)
+	if err != nil {
+		core.Error("invalid PACKETS_PER_SECOND: %v", err)
+		return 1
+	}
 
-	connectToken, err := connect_token_cmd.Output()
+	maxPayloadBytes, err := envvar.GetIntRange("MAX_PAYLOAD_BYTES", 8000, 1, client.MaxPayloadBytes)
 	if err != nil {
-		panic("could not get connect token output")
+		core.Error("invalid MAX_PAYLOAD_BYTES: %v", err)
+		return 1
 	}
 
-	// run client
+	// each session lasts a random time up to SESSION_LIFETIME, then closes or is abandoned without telling the
+	// gateway, which has to time it out
 
-	client_cmd := exec.Command(clientBin)
-	if client_cmd == nil {
-		panic("could not exec client!\n")
-		return nil
+	sessionLifetime, err := envvar.GetDurationRange("SESSION_LIFETIME", 5*time.Minute, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SESSION_LIFETIME: %v", err)
+		return 1
 	}
 
-	client_cmd.Env = os.Environ()
-	client_cmd.Env = append(client_cmd.Env, fmt.Sprintf("CONNECT_TOKEN=%s", connectToken))
-	client_cmd.Env = append(client_cmd.Env, fmt.Sprintf("UDP_PORT=%d", port))
-	client_cmd.Env = append(client_cmd.Env, fmt.Sprintf("CLIENT_ADDRESS=127.0.0.1:%d", port))
+	abandonProbability, err := envvar.GetFloat("ABANDON_PROBABILITY", 0.2)
+	if err != nil || abandonProbability < 0 || abandonProbability > 1 {
+		core.Error("invalid ABANDON_PROBABILITY: %v", err)
+		return 1
+	}
 
-	// client_cmd.Stdout = os.Stdout
-	// client_cmd.Stderr = os.Stderr
+	sessionTimeout, err := envvar.GetDurationRange("SESSION_TIMEOUT", 10*time.Second, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SESSION_TIMEOUT: %v", err)
+		return 1
+	}
 
-	client_cmd.Start()
+	// bad network conditions are simulated between the clients and the gateway, in both directions
 
-	return client_cmd
-}
+	simulatorConfig := simulator.Config{Seed: time.Now().UnixNano()}
 
-func gateway() *exec.Cmd {
+	for name, value := range map[string]*float64{"PACKET_LOSS": &simulatorConfig.Loss, "PACKET_DUPLICATION": &simulatorConfig.Duplication, "PACKET_REORDER": &simulatorConfig.Reorder} {
+		defaultValue := map[string]float64{"PACKET_LOSS": 0.02, "PACKET_DUPLICATION": 0.01, "PACKET_REORDER": 0.01}[name]
+		*value, err = envvar.GetFloat(name, defaultValue)
+		if err != nil || *value < 0 || *value > 1 {
+			core.Error("invalid %s: %v", name, err)
+			return 1
+		}
+	}
 
-	cmd := exec.Command(gatewayBin)
-	if cmd == nil {
-		panic("could not create gateway!\n")
-		return nil
+	simulatorConfig.Latency, err = envvar.GetDurationRange("LATENCY", 10*time.Millisecond, 0, time.Second)
+	if err != nil {
+		core.Error("invalid LATENCY: %v", err)
+		return 1
 	}
 
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "HTTP_PORT=40000")
-	cmd.Env = append(cmd.Env, "UDP_PORT=40000")
-	cmd.Env = append(cmd.Env, "GATEWAY_ADDRESS=127.0.0.1:40000")
-	cmd.Env = append(cmd.Env, "GATEWAY_INTERNAL_ADDRESS=127.0.0.1:40001")
-	cmd.Env = append(cmd.Env, "GATEWAY_PRIVATE_KEY=qmnxBZs2UElVT4SXCdDuX4td+qtPkuXLL5VdOE0vvcA=")
-	cmd.Env = append(cmd.Env, "AUTH_PUBLIC_KEY=i9XuIDN5ePgWiRGZZoxNKjQv3ZC9JAfMjXGTIr4peQM=")
-	cmd.Env = append(cmd.Env, "SERVER_ADDRESS=127.0.0.1:50000")
+	simulatorConfig.Jitter, err = envvar.GetDurationRange("JITTER", 5*time.Millisecond, 0, time.Second)
+	if err != nil {
+		core.Error("invalid JITTER: %v", err)
+		return 1
+	}
 
-	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
+	simulatorConfig.ReorderDelay, err = envvar.GetDurationRange("REORDER_DELAY", 50*time.Millisecond, 0, time.Second)
+	if err != nil {
+		core.Error("invalid REORDER_DELAY: %v", err)
+		return 1
+	}
+
+	outageInterval, err := envvar.GetDurationRange("OUTAGE_INTERVAL", 10*time.Minute, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid OUTAGE_INTERVAL: %v", err)
+		return 1
+	}
 
-	cmd.Start()
+	outageDuration, err := envvar.GetDurationRange("OUTAGE_DURATION", 15*time.Second, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid OUTAGE_DURATION: %v", err)
+		return 1
+	}
 
-	return cmd
-}
+	sampleInterval, err := envvar.GetDurationRange("SAMPLE_INTERVAL", time.Minute, time.Second, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid SAMPLE_INTERVAL: %v", err)
+		return 1
+	}
+
+	maxMemoryGrowth, err := envvar.GetFloat("MAX_MEMORY_GROWTH", 0.5)
+	if err != nil || maxMemoryGrowth < 0 {
+		core.Error("invalid MAX_MEMORY_GROWTH: %v", err)
+		return 1
+	}
+
+	maxGoroutineGrowth, err := envvar.GetIntRange("MAX_GOROUTINE_GROWTH", 10, 0, envvar.NoLimit)
+	if err != nil {
+		core.Error("invalid MAX_GOROUTINE_GROWTH: %v", err)
+		return 1
+	}
+
+	// keys default to the dev keys the Makefile uses
+
+	gatewayPublicKey := envvar.Get("GATEWAY_PUBLIC_KEY", "vnIjsJWZzgq+nS9t3KU7ch5BFhgDkm2U2bm7/2W6eRs=")
+	gatewayPrivateKey := envvar.Get("GATEWAY_PRIVATE_KEY", "qmnxBZs2UElVT4SXCdDuX4td+qtPkuXLL5VdOE0vvcA=")
+	authPublicKey := envvar.Get("AUTH_PUBLIC_KEY", "i9XuIDN5ePgWiRGZZoxNKjQv3ZC9JAfMjXGTIr4peQM=")
+	authPrivateKey := envvar.Get("AUTH_PRIVATE_KEY", "VmmdIRwxUb7vmzupzHbBHqJF3WPpLrp0Y0EzepAzny0=")
+	authSignPublicKey := envvar.Get("AUTH_SIGN_PUBLIC_KEY", "l+UJOJj71eTdI1lxDJ1kwFeJBmLuy9+N+0rjbvX67Xs=")
+	authSignPrivateKey := envvar.Get("AUTH_SIGN_PRIVATE_KEY", "OCIq8HDXnRC3qPWMh/QdsA8/ukw9gimtcwnwodCU/y6X5Qk4mPvV5N0jWXEMnWTAV4kGYu7L3437SuNu9frtew==")
+
+	gatewayBinary := envvar.Get("GATEWAY_BINARY", "./dist/gateway")
+	authBinary := envvar.Get("AUTH_BINARY", "./dist/auth")
+	logDir := envvar.Get("LOG_DIR", "./dist")
+
+	core.Info("soaking %d clients for %v", numClients, duration)
+
+	// start the server. it checks payloads and echoes messages back
+
+	serverConfig := server.DefaultConfig()
+	serverConfig.SessionTimeout = sessionTimeout
+
+	serverConfig.PacketCallback = func(serverClient *server.Client, payload []byte) {
+		if !checkPayload(payload) {
+			corruptPayloads.Add(1)
+			return
+		}
+		response := make([]byte, core.MinPayloadBytes)
+		fillPayload(response)
+		serverClient.Send(response)
+	}
+
+	serverConfig.MessageCallback = func(serverClient *server.Client, message []byte) {
+		serverClient.SendMessage(message)
+	}
+
+	udpServer, err := server.Listen(serverAddress, serverConfig)
+	if err != nil {
+		core.Error("could not start server: %v", err)
+		return 1
+	}
+	defer udpServer.Close()
+
+	// start auth and the gateway
+
+	auth, err := startProcess(authBinary, filepath.Join(logDir, "soak_auth.log"),
+		fmt.Sprintf("HTTP_PORT=%d", authPort),
+		"GATEWAY_ADDRESS="+publicGatewayAddress,
+		"GATEWAY_PUBLIC_KEY="+gatewayPublicKey,
+		"AUTH_PUBLIC_KEY="+authPublicKey,
+		"AUTH_PRIVATE_KEY="+authPrivateKey,
+		"AUTH_SIGN_PUBLIC_KEY="+authSignPublicKey,
+		"AUTH_SIGN_PRIVATE_KEY="+authSignPrivateKey,
+	)
+	if err != nil {
+		core.Error("could not start auth: %v", err)
+		return 1
+	}
+	defer stopProcess(auth)
+
+	gateway, err := startProcess(gatewayBinary, filepath.Join(logDir, "soak_gateway.log"),
+		fmt.Sprintf("HTTP_PORT=%d", gatewayPort),
+		fmt.Sprintf("UDP_PORT=%d", gatewayPort),
+		"GATEWAY_ADDRESS="+publicGatewayAddress,
+		"GATEWAY_INTERNAL_ADDRESS="+gatewayInternalAddress,
+		"GATEWAY_PRIVATE_KEY="+gatewayPrivateKey,
+		"AUTH_PUBLIC_KEY="+authPublicKey,
+		"AUTH_SIGN_PUBLIC_KEY="+authSignPublicKey,
+		fmt.Sprintf("AUTH_URL=http://127.0.0.1:%d", authPort),
+		"SERVER_ADDRESS="+serverAddress,
+		"SESSION_TIMEOUT="+sessionTimeout.String(),
+	)
+	if err != nil {
+		core.Error("could not start gateway: %v", err)
+		return 1
+	}
+	defer stopProcess(gateway)
+
+	authURL := fmt.Sprintf("http://127.0.0.1:%d", authPort)
+	gatewayURL := fmt.Sprintf("http://127.0.0.1:%d", gatewayPort)
+
+	for _, url := range []string{authURL, gatewayURL} {
+		if err := waitForHealth(url, 10*time.Second); err != nil {
+			core.Error("%v", err)
+			return 1
+		}
+	}
+
+	// start the simulator proxy, with a route for each client port
+
+	networkSimulator := simulator.Create(simulatorConfig)
+	defer networkSimulator.Close()
+
+	proxy, err := simulator.Listen(publicGatewayAddress, core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", gatewayPort)), nil, networkSimulator)
+	if err != nil {
+		core.Error("could not start proxy: %v", err)
+		return 1
+	}
+
+	clientAddresses := make([]*net.UDPAddr, numClients)
+	routes := make([]*simulator.Route, numClients)
+	for i := range routes {
+		clientAddresses[i] = core.ParseAddress(fmt.Sprintf("127.0.0.1:%d", clientBasePort+i))
+		routes[i], err = proxy.AddRoute(clientAddresses[i])
+		if err != nil {
+			core.Error("could not create proxy route: %v", err)
+			proxy.Close()
+			return 1
+		}
+	}
 
-func server() *exec.Cmd {
-	cmd := exec.Command(serverBin)
-	if cmd == nil {
-		panic("could not create server!\n")
-		return nil
-	}
-	cmd.Env = append(cmd.Env, "HTTP_PORT=50000")
-	cmd.Env = append(cmd.Env, "UDP_PORT=50000")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Start()
-	return cmd
+	// everything that should be running for the whole soak is running now, so anything above this when the
+	// clients are gone is a leak
+
+	baselineGoroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var clientsDone sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		clientsDone.Add(1)
+		go func(clientIndex int) {
+			defer clientsDone.Done()
+			soakClient(ctx, authURL, clientAddresses[clientIndex], routes[clientIndex], packetsPerSecond, maxPayloadBytes, sessionLifetime, abandonProbability)
+		}(i)
+	}
+
+	if outageInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(outageInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					core.Info("outage for %v", outageDuration)
+					networkSimulator.Outage(time.Now().Add(outageDuration))
+				}
+			}
+		}()
+	}
+
+	// sample memory and sessions while the soak runs
+
+	var samples []Sample
+	startTime := time.Now()
+	ticker := time.NewTicker(sampleInterval)
+	for time.Since(startTime) < duration {
+		<-ticker.C
+		sample := takeSample(gateway, gatewayURL, udpServer)
+		samples = append(samples, sample)
+		core.Info("%v: %d gateway sessions, %d server clients, %d goroutines, %.1fMB heap, %.1fMB gateway rss. %d sessions, %d abandoned, %d/%d payloads, %d messages, %d dropped by proxy",
+			time.Since(startTime).Round(time.Second), sample.GatewaySessions, sample.ServerClients, sample.Goroutines,
+			float64(sample.HeapBytes)/1e6, float64(sample.GatewayRSSBytes)/1e6, sessionsStarted.Load(), sessionsAbandoned.Load(),
+			payloadsReceived.Load(), payloadsSent.Load(), messagesReceived.Load(), networkSimulator.GetStats().Dropped)
+	}
+	ticker.Stop()
+
+	// stop the clients, then wait for abandoned sessions to time out everywhere
+
+	core.Info("stopping clients")
+
+	cancel()
+	clientsDone.Wait()
+
+	time.Sleep(sessionTimeout + 5*time.Second)
+
+	final := takeSample(gateway, gatewayURL, udpServer)
+
+	proxy.Close()
+	http.DefaultClient.CloseIdleConnections()
+	time.Sleep(time.Second)
+
+	finalGoroutines := runtime.NumGoroutine()
+
+	// check
+
+	var failures []string
+
+	if final.GatewaySessions != 0 {
+		failures = append(failures, fmt.Sprintf("%d sessions left on the gateway", final.GatewaySessions))
+	}
+
+	if final.ServerClients != 0 {
+		failures = append(failures, fmt.Sprintf("%d clients left on the server", final.ServerClients))
+	}
+
+	if finalGoroutines > baselineGoroutines+maxGoroutineGrowth {
+		failures = append(failures, fmt.Sprintf("%d goroutines at the end, %d at the start", finalGoroutines, baselineGoroutines))
+	}
+
+	if corruptPayloads.Load() != 0 || corruptMessages.Load() != 0 {
+		failures = append(failures, fmt.Sprintf("%d corrupt payloads and %d corrupt messages", corruptPayloads.Load(), corruptMessages.Load()))
+	}
+
+	if sessionsStarted.Load() == 0 || payloadsReceived.Load() == 0 {
+		failures = append(failures, "no traffic got through")
+	}
+
+	if growth, ok := memoryGrowth(samples, func(sample Sample) uint64 { return sample.HeapBytes }); ok && growth > maxMemoryGrowth {
+		failures = append(failures, fmt.Sprintf("soak heap grew %.0f%%", growth*100))
+	}
+
+	if growth, ok := memoryGrowth(samples, func(sample Sample) uint64 { return sample.GatewayRSSBytes }); ok && growth > maxMemoryGrowth {
+		failures = append(failures, fmt.Sprintf("gateway memory grew %.0f%%", growth*100))
+	}
+
+	core.Info("%d sessions (%d abandoned), %d of %d payloads echoed, %d messages, %d failed token requests",
+		sessionsStarted.Load(), sessionsAbandoned.Load(), payloadsReceived.Load(), payloadsSent.Load(), messagesReceived.Load(), tokenFailures.Load())
+
+	if len(failures) > 0 {
+		for _, failure := range failures {
+			core.Error("soak failed: %s", failure)
+		}
+		return 1
+	}
+
+	core.Info("soak passed")
+
+	return 0
 }
 
-func auth() *exec.Cmd {
+// soakClient runs sessions on the link's port one after another until the context is done
+func soakClient(ctx context.Context, authURL string, clientAddress *net.UDPAddr, route *simulator.Route, packetsPerSecond int, maxPayloadBytes int, sessionLifetime time.Duration, abandonProbability float64) {
+
+	for ctx.Err() == nil {
+
+		connectToken, err := requestConnectToken(authURL)
+		if err != nil {
+			core.Debug("could not get connect token: %v", err)
+			tokenFailures.Add(1)
+			sleep(ctx, time.Second)
+			continue
+		}
+
+		// messages come back from the server in the order they were sent
+
+		var messageMutex sync.Mutex
+		nextMessageId := 0
+
+		config := client.DefaultConfig()
+		config.BindAddress = clientAddress.String()
+		config.ClientAddress = route.UpstreamAddress()
+
+		config.ReceiveCallback = func(payload []byte) {
+			if len(payload) != core.MinPayloadBytes || !checkPayload(payload) {
+				corruptPayloads.Add(1)
+				return
+			}
+			payloadsReceived.Add(1)
+		}
+
+		config.MessageCallback = func(message []byte) {
+			messageMutex.Lock()
+			defer messageMutex.Unlock()
+			if !bytes.HasPrefix(message, []byte(fmt.Sprintf("soak message %d:", nextMessageId))) {
+				corruptMessages.Add(1)
+			}
+			nextMessageId++
+			messagesReceived.Add(1)
+		}
+
+		disconnected := make(chan struct{})
+		var disconnectOnce sync.Once
+		config.StateCallback = func(state client.State) {
+			if state == client.StateDisconnected {
+				disconnectOnce.Do(func() { close(disconnected) })
+			}
+		}
+
+		session, err := client.Connect(connectToken, config)
+		if err != nil {
+			core.Debug("could not connect: %v", err)
+			sleep(ctx, time.Second)
+			continue
+		}
+
+		sessionsStarted.Add(1)
+
+		lifetime := sessionLifetime/10 + time.Duration(rand.Int63n(int64(sessionLifetime-sessionLifetime/10)+1))
+		endTime := time.Now().Add(lifetime)
+
+		sendTicker := time.NewTicker(time.Second / time.Duration(packetsPerSecond))
+		messageId := 0
+
+	session:
+		for time.Now().Before(endTime) {
+			select {
+			case <-ctx.Done():
+				break session
+			case <-disconnected:
+				break session
+			case <-sendTicker.C:
+			}
+
+			payload := make([]byte, 1+rand.Intn(maxPayloadBytes))
+			fillPayload(payload)
+			if session.Send(payload) == nil {
+				payloadsSent.Add(1)
+			}
+
+			if rand.Intn(packetsPerSecond) == 0 {
+				message := append([]byte(fmt.Sprintf("soak message %d:", messageId)), make([]byte, rand.Intn(256))...)
+				if session.SendMessage(message) == nil {
+					messageId++
+				}
+			}
+		}
+
+		sendTicker.Stop()
+
+		// abandoned sessions go quiet without the gateway and server hearing about it
+
+		if ctx.Err() == nil && rand.Float64() < abandonProbability {
+			route.SetPartitioned(true)
+			session.Close()
+			route.SetPartitioned(false)
+			sessionsAbandoned.Add(1)
+			continue
+		}
+
+		session.Close()
+	}
+}
 
-	cmd := exec.Command(authBin)
+func requestConnectToken(authURL string) ([]byte, error) {
+	userId := core.RandomBytes(core.UserIdBytes)
+	response, err := http.Post(authURL+"/connect_token", "application/octet-stream", bytes.NewReader(userId))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	connectToken, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK || (len(connectToken) < core.ConnectTokenBytes || len(connectToken) > core.MaxConnectTokenBytes) {
+		return nil, fmt.Errorf("auth returned %d with %d bytes", response.StatusCode, len(connectToken))
+	}
+	return connectToken, nil
+}
 
-	if cmd == nil {
-		panic("could not create auth!\n")
-		return nil
+// payloads are filled with a pattern that depends on their length, so truncated or mixed up payloads show up
+func fillPayload(payload []byte) {
+	for i := range payload {
+		payload[i] = byte(i + len(payload))
 	}
+}
 
-	cmd.Env = append(cmd.Env, "HTTP_PORT=60000")
-	cmd.Env = append(cmd.Env, "GATEWAY_ADDRESS=127.0.0.1:40000")
-	cmd.Env = append(cmd.Env, "GATEWAY_PUBLIC_KEY=vnIjsJWZzgq+nS9t3KU7ch5BFhgDkm2U2bm7/2W6eRs=")
-	cmd.Env = append(cmd.Env, "GATEWAY_PRIVATE_KEY=qmnxBZs2UElVT4SXCdDuX4td+qtPkuXLL5VdOE0vvcA=")
-	cmd.Env = append(cmd.Env, "AUTH_PUBLIC_KEY=i9XuIDN5ePgWiRGZZoxNKjQv3ZC9JAfMjXGTIr4peQM=")
-	cmd.Env = append(cmd.Env, "AUTH_PRIVATE_KEY=VmmdIRwxUb7vmzupzHbBHqJF3WPpLrp0Y0EzepAzny0=")
+func checkPayload(payload []byte) bool {
+	for i := range payload {
+		if payload[i] != byte(i+len(payload)) {
+			return false
+		}
+	}
+	return true
+}
 
-	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
+func sleep(ctx context.Context, duration time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(duration):
+	}
+}
 
-	cmd.Start()
+// -------------------------------------------------------------------------------
 
-	return cmd
+type Sample struct {
+	GatewaySessions int
+	ServerClients   int
+	Goroutines      int
+	HeapBytes       uint64
+	GatewayRSSBytes uint64
 }
 
-func soak() {
+func takeSample(gateway *exec.Cmd, gatewayURL string, udpServer *server.Server) Sample {
+	runtime.GC()
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return Sample{
+		GatewaySessions: scrapeGauge(gatewayURL+"/metrics", "udpx_gateway_sessions_active"),
+		ServerClients:   udpServer.GetNumClients(),
+		Goroutines:      runtime.NumGoroutine(),
+		HeapBytes:       memStats.HeapInuse,
+		GatewayRSSBytes: processRSS(gateway.Process.Pid),
+	}
+}
 
-	const NumClients = 10
+// memoryGrowth compares the last quarter of the samples with the second, leaving the first quarter for
+// everything to warm up. there need to be enough samples for this to mean anything
+func memoryGrowth(samples []Sample, value func(Sample) uint64) (float64, bool) {
+	if len(samples) < 8 {
+		return 0, false
+	}
+	quarter := len(samples) / 4
+	average := func(samples []Sample) float64 {
+		total := 0.0
+		for _, sample := range samples {
+			total += float64(value(sample))
+		}
+		return total / float64(len(samples))
+	}
+	before := average(samples[quarter : 2*quarter])
+	after := average(samples[len(samples)-quarter:])
+	if before == 0 {
+		return 0, false
+	}
+	return after/before - 1, true
+}
 
-	auth_cmd := auth()
-	server_cmd := server()
-	gateway_cmd := gateway()
-	client_cmd := make([]*exec.Cmd, NumClients)
-	for i := 0; i < NumClients; i++ {
-		client_cmd[i] = client(uint16(30000 + i))
+func scrapeGauge(url string, name string) int {
+	response, err := http.Get(url)
+	if err != nil {
+		return -1
 	}
+	defer response.Body.Close()
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == name {
+			value, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return -1
+			}
+			return value
+		}
+	}
+	return -1
+}
 
-	server_cmd.Wait()
+// processRSS reads the resident memory of a process from /proc. it is zero where there is no /proc
+func processRSS(pid int) uint64 {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kilobytes, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kilobytes * 1024
+		}
+	}
+	return 0
+}
 
-	auth_cmd.Process.Signal(os.Interrupt)
-	auth_cmd.Wait()
+// -------------------------------------------------------------------------------
 
-	gateway_cmd.Process.Signal(os.Interrupt)
-	gateway_cmd.Wait()
+func startProcess(binary string, logFile string, env ...string) (*exec.Cmd, error) {
+	output, err := os.Create(logFile)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		output.Close()
+		return nil, err
+	}
+	return cmd, nil
+}
 
-	for i := 0; i < NumClients; i++ {
-		client_cmd[i].Process.Signal(os.Interrupt)
-		client_cmd[i].Wait()
+func stopProcess(cmd *exec.Cmd) {
+	cmd.Process.Signal(os.Interrupt)
+	cmd.Wait()
+	if output, ok := cmd.Stdout.(*os.File); ok {
+		output.Close()
 	}
 }
 
-func main() {
-	soak()
+func waitForHealth(url string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		response, err := http.Get(url + "/health")
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("%s is not healthy after %v", url, timeout)
 }
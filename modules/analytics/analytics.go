@@ -0,0 +1,182 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package analytics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+const SessionStartEvent = "session_start"
+const SessionStatsEvent = "session_stats"
+const SessionStopEvent = "session_stop"
+
+// Token events are audit records from auth, for each connect token or session token it issues or refuses
+const ConnectTokenEvent = "connect_token"
+const SessionTokenEvent = "session_token"
+const TokenRefusedEvent = "token_refused"
+
+// Event is a session lifecycle or periodic stats event. Byte and packet counts are totals since the session
+// started, RTT and jitter are in milliseconds, and duration is in seconds. Frame rate, client RTT and
+// platform are from the latest stats the client sent, if it has sent any. Token events have the session id
+// the token is for, the gateway it was issued for, and when it expires.
+type Event struct {
+	Type           string    `json:"type"`
+	Timestamp      time.Time `json:"timestamp"`
+	GatewayAddress string    `json:"gateway_address"`
+	SessionId      string    `json:"session_id"`
+	UserId         string    `json:"user_id"`
+	ClientAddress  string    `json:"client_address,omitempty"`
+	ServerAddress  string    `json:"server_address,omitempty"`
+	Relayed        bool      `json:"relayed,omitempty"`
+	BytesUp        uint64    `json:"bytes_up"`
+	BytesDown      uint64    `json:"bytes_down"`
+	PacketsUp      uint64    `json:"packets_up"`
+	PacketsDown    uint64    `json:"packets_down"`
+	RTT            float64   `json:"rtt"`
+	Jitter         float64   `json:"jitter"`
+	PacketLoss     float64   `json:"packet_loss"`
+	Duration       float64   `json:"duration,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	FrameRate      string    `json:"frame_rate,omitempty"`
+	ClientRTT      float64   `json:"client_rtt,omitempty"`
+	Platform       string    `json:"platform,omitempty"`
+	ExpireTime     time.Time `json:"expire_time,omitzero"`
+}
+
+// Sink is where events end up. Write is only ever called from one goroutine at a time.
+type Sink interface {
+	Write(events []Event) error
+	Close() error
+}
+
+// Publisher queues events and writes them to its sink in batches, from a goroutine of its own, so publishing
+// never waits on the sink. Events are dropped when the queue is full, and lost when the sink fails.
+type Publisher struct {
+	sink          Sink
+	events        chan Event
+	done          chan struct{}
+	batchSize     int
+	flushInterval time.Duration
+	mutex         sync.RWMutex
+	closed        bool
+	published     atomic.Uint64
+	dropped       atomic.Uint64
+	failed        atomic.Uint64
+}
+
+func CreatePublisher(sink Sink, queueSize int, batchSize int, flushInterval time.Duration) *Publisher {
+	publisher := &Publisher{
+		sink:          sink,
+		events:        make(chan Event, queueSize),
+		done:          make(chan struct{}),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+	go publisher.run()
+	return publisher
+}
+
+// Publish queues an event, and returns false if it was dropped.
+func (publisher *Publisher) Publish(event Event) bool {
+	publisher.mutex.RLock()
+	defer publisher.mutex.RUnlock()
+	if publisher.closed {
+		publisher.dropped.Add(1)
+		return false
+	}
+	select {
+	case publisher.events <- event:
+		return true
+	default:
+		publisher.dropped.Add(1)
+		return false
+	}
+}
+
+func (publisher *Publisher) run() {
+	ticker := time.NewTicker(publisher.flushInterval)
+	defer ticker.Stop()
+	batch := make([]Event, 0, publisher.batchSize)
+	for {
+		select {
+		case event, ok := <-publisher.events:
+			if !ok {
+				publisher.flush(batch)
+				close(publisher.done)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= publisher.batchSize {
+				batch = publisher.flush(batch)
+			}
+		case <-ticker.C:
+			batch = publisher.flush(batch)
+		}
+	}
+}
+
+func (publisher *Publisher) flush(batch []Event) []Event {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := publisher.sink.Write(batch); err != nil {
+		core.Error("failed to publish %d analytics events: %v", len(batch), err)
+		publisher.failed.Add(uint64(len(batch)))
+	} else {
+		publisher.published.Add(uint64(len(batch)))
+	}
+	return batch[:0]
+}
+
+// Close writes the events still queued and closes the sink. Events published after Close are dropped.
+func (publisher *Publisher) Close() error {
+	publisher.mutex.Lock()
+	if publisher.closed {
+		publisher.mutex.Unlock()
+		return nil
+	}
+	publisher.closed = true
+	close(publisher.events)
+	publisher.mutex.Unlock()
+	<-publisher.done
+	return publisher.sink.Close()
+}
+
+// GetStats returns how many events were written to the sink, dropped because the queue was full, and lost
+// because the sink failed.
+func (publisher *Publisher) GetStats() (uint64, uint64, uint64) {
+	return publisher.published.Load(), publisher.dropped.Load(), publisher.failed.Load()
+}
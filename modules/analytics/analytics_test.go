@@ -0,0 +1,155 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package analytics
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSink struct {
+	mutex   sync.Mutex
+	batches [][]Event
+	err     error
+	block   chan struct{}
+	closed  bool
+}
+
+func (sink *testSink) Write(events []Event) error {
+	if sink.block != nil {
+		<-sink.block
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.err != nil {
+		return sink.err
+	}
+	sink.batches = append(sink.batches, append([]Event(nil), events...))
+	return nil
+}
+
+func (sink *testSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.closed = true
+	return nil
+}
+
+func (sink *testSink) getBatches() [][]Event {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.batches
+}
+
+func TestPublisherBatches(t *testing.T) {
+	t.Parallel()
+
+	sink := &testSink{}
+	publisher := CreatePublisher(sink, 100, 10, time.Hour)
+
+	for i := 0; i < 25; i++ {
+		assert.True(t, publisher.Publish(Event{Type: SessionStatsEvent, PacketsUp: uint64(i)}))
+	}
+
+	assert.Eventually(t, func() bool { return len(sink.getBatches()) == 2 }, time.Second, time.Millisecond)
+
+	// the rest are written on close
+
+	assert.NoError(t, publisher.Close())
+	assert.True(t, sink.closed)
+
+	batches := sink.getBatches()
+	assert.Equal(t, 3, len(batches))
+	assert.Equal(t, 10, len(batches[0]))
+	assert.Equal(t, 5, len(batches[2]))
+	assert.Equal(t, uint64(24), batches[2][4].PacketsUp)
+
+	assert.False(t, publisher.Publish(Event{Type: SessionStopEvent}))
+
+	published, dropped, failed := publisher.GetStats()
+	assert.Equal(t, uint64(25), published)
+	assert.Equal(t, uint64(1), dropped)
+	assert.Equal(t, uint64(0), failed)
+}
+
+func TestPublisherFlushInterval(t *testing.T) {
+	t.Parallel()
+
+	sink := &testSink{}
+	publisher := CreatePublisher(sink, 100, 10, 10*time.Millisecond)
+	defer publisher.Close()
+
+	publisher.Publish(Event{Type: SessionStartEvent})
+
+	assert.Eventually(t, func() bool { return len(sink.getBatches()) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestPublisherDrops(t *testing.T) {
+	t.Parallel()
+
+	// while the sink is stuck, events past the queue size are dropped
+
+	sink := &testSink{block: make(chan struct{})}
+	publisher := CreatePublisher(sink, 5, 1, time.Hour)
+
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		if publisher.Publish(Event{Type: SessionStatsEvent}) {
+			accepted++
+		}
+	}
+	assert.True(t, accepted <= 6)
+
+	close(sink.block)
+	assert.NoError(t, publisher.Close())
+
+	published, dropped, _ := publisher.GetStats()
+	assert.Equal(t, uint64(accepted), published)
+	assert.Equal(t, uint64(20-accepted), dropped)
+
+	// failed writes are counted
+
+	sink = &testSink{err: errors.New("unavailable")}
+	publisher = CreatePublisher(sink, 5, 2, time.Hour)
+	publisher.Publish(Event{Type: SessionStatsEvent})
+	publisher.Publish(Event{Type: SessionStatsEvent})
+	publisher.Publish(Event{Type: SessionStatsEvent})
+	assert.NoError(t, publisher.Close())
+
+	published, _, failed := publisher.GetStats()
+	assert.Equal(t, uint64(0), published)
+	assert.Equal(t, uint64(3), failed)
+}
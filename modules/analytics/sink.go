@@ -0,0 +1,277 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const PubSubEndpoint = "https://pubsub.googleapis.com"
+const PubSubMaxMessages = 1000
+
+var MetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// ParseSink creates a sink from a url:
+//
+//	file:/var/log/udpx/events.jsonl           appends events as json lines
+//	pubsub://project/topic                    publishes to google pub/sub, authenticated as the instance's service account
+//	pubsub://project/topic?endpoint=http://localhost:8085   publishes to a pub/sub emulator
+//	kafka://host:8082/topic                   produces to kafka through a kafka rest proxy, kafka+https:// for tls
+func ParseSink(sinkURL string) (Sink, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, fmt.Errorf("file sink needs a path")
+		}
+		return CreateFileSink(path)
+	case "pubsub":
+		topic := strings.Trim(u.Path, "/")
+		if u.Host == "" || topic == "" {
+			return nil, fmt.Errorf("pubsub sink needs a project and topic")
+		}
+		return CreatePubSubSink(u.Host, topic, u.Query().Get("endpoint")), nil
+	case "kafka", "kafka+https":
+		topic := strings.Trim(u.Path, "/")
+		if u.Host == "" || topic == "" {
+			return nil, fmt.Errorf("kafka sink needs a rest proxy address and topic")
+		}
+		scheme := "http"
+		if u.Scheme == "kafka+https" {
+			scheme = "https"
+		}
+		return CreateKafkaSink(scheme+"://"+u.Host, topic), nil
+	}
+	return nil, fmt.Errorf("unsupported sink %q", u.Scheme)
+}
+
+// FileSink appends events to a file, one json object per line.
+type FileSink struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func CreateFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (sink *FileSink) Write(events []Event) error {
+	encoder := json.NewEncoder(sink.writer)
+	for i := range events {
+		if err := encoder.Encode(&events[i]); err != nil {
+			return err
+		}
+	}
+	return sink.writer.Flush()
+}
+
+func (sink *FileSink) Close() error {
+	if err := sink.writer.Flush(); err != nil {
+		sink.file.Close()
+		return err
+	}
+	return sink.file.Close()
+}
+
+type pubSubMessage struct {
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// PubSubSink publishes events to a google pub/sub topic with its rest api. Against the real endpoint, it
+// authenticates with an access token from the metadata server, so it needs to run on google cloud.
+type PubSubSink struct {
+	client       *http.Client
+	publishURL   string
+	useToken     bool
+	token        string
+	tokenExpires time.Time
+}
+
+func CreatePubSubSink(project string, topic string, endpoint string) *PubSubSink {
+	useToken := endpoint == ""
+	if endpoint == "" {
+		endpoint = PubSubEndpoint
+	}
+	return &PubSubSink{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		publishURL: fmt.Sprintf("%s/v1/projects/%s/topics/%s:publish", strings.TrimSuffix(endpoint, "/"), url.PathEscape(project), url.PathEscape(topic)),
+		useToken:   useToken,
+	}
+}
+
+func (sink *PubSubSink) getToken() (string, error) {
+	if sink.token != "" && time.Now().Before(sink.tokenExpires) {
+		return sink.token, nil
+	}
+	r, err := http.NewRequest("GET", MetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Metadata-Flavor", "Google")
+	response, err := sink.client.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d getting access token", response.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	sink.token = token.AccessToken
+	sink.tokenExpires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return sink.token, nil
+}
+
+func (sink *PubSubSink) Write(events []Event) error {
+	for len(events) > 0 {
+		count := len(events)
+		if count > PubSubMaxMessages {
+			count = PubSubMaxMessages
+		}
+		if err := sink.publish(events[:count]); err != nil {
+			return err
+		}
+		events = events[count:]
+	}
+	return nil
+}
+
+func (sink *PubSubSink) publish(events []Event) error {
+	request := struct {
+		Messages []pubSubMessage `json:"messages"`
+	}{Messages: make([]pubSubMessage, len(events))}
+	for i := range events {
+		data, err := json.Marshal(&events[i])
+		if err != nil {
+			return err
+		}
+		request.Messages[i] = pubSubMessage{Data: data, Attributes: map[string]string{"type": events[i].Type}}
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	if sink.useToken {
+		token, err := sink.getToken()
+		if err != nil {
+			return err
+		}
+		headers["Authorization"] = "Bearer " + token
+	}
+	return post(sink.client, sink.publishURL, headers, request)
+}
+
+func (sink *PubSubSink) Close() error {
+	return nil
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value *Event `json:"value"`
+}
+
+// KafkaSink produces events to a kafka topic through a kafka rest proxy. Events are keyed by session id, so
+// the events of a session stay in order.
+type KafkaSink struct {
+	client     *http.Client
+	produceURL string
+}
+
+func CreateKafkaSink(proxyURL string, topic string) *KafkaSink {
+	return &KafkaSink{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		produceURL: fmt.Sprintf("%s/topics/%s", strings.TrimSuffix(proxyURL, "/"), url.PathEscape(topic)),
+	}
+}
+
+func (sink *KafkaSink) Write(events []Event) error {
+	request := struct {
+		Records []kafkaRecord `json:"records"`
+	}{Records: make([]kafkaRecord, len(events))}
+	for i := range events {
+		request.Records[i] = kafkaRecord{Key: events[i].SessionId, Value: &events[i]}
+	}
+	headers := map[string]string{"Content-Type": "application/vnd.kafka.json.v2+json", "Accept": "application/vnd.kafka.v2+json"}
+	return post(sink.client, sink.produceURL, headers, request)
+}
+
+func (sink *KafkaSink) Close() error {
+	return nil
+}
+
+func post(client *http.Client, url string, headers map[string]string, request interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	response, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package analytics
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testEvents = []Event{
+	{Type: SessionStartEvent, Timestamp: time.Unix(1700000000, 0).UTC(), SessionId: "aa", UserId: "bb"},
+	{Type: SessionStopEvent, Timestamp: time.Unix(1700000060, 0).UTC(), SessionId: "aa", UserId: "bb", BytesUp: 1000, Duration: 60, Reason: "disconnect", FrameRate: "60-119", ClientRTT: 42, Platform: "windows"},
+}
+
+func TestEventExpireTime(t *testing.T) {
+	t.Parallel()
+
+	data, err := json.Marshal(&testEvents[0])
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "expire_time")
+
+	tokenEvent := Event{Type: ConnectTokenEvent, Timestamp: time.Unix(1700000120, 0).UTC(), GatewayAddress: "127.0.0.1:40000", SessionId: "cc", UserId: "bb", ClientAddress: "10.0.0.1", ExpireTime: time.Unix(1700000130, 0).UTC()}
+	data, err = json.Marshal(&tokenEvent)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"expire_time":"2023-11-14T22:15:30Z"`)
+
+	var decoded Event
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, tokenEvent, decoded)
+}
+
+func TestParseSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	sink, err := ParseSink("file:" + path)
+	assert.NoError(t, err)
+	assert.IsType(t, &FileSink{}, sink)
+	sink.Close()
+
+	sink, err = ParseSink("file://" + path)
+	assert.NoError(t, err)
+	assert.IsType(t, &FileSink{}, sink)
+	sink.Close()
+
+	sink, err = ParseSink("pubsub://project/topic")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://pubsub.googleapis.com/v1/projects/project/topics/topic:publish", sink.(*PubSubSink).publishURL)
+	assert.True(t, sink.(*PubSubSink).useToken)
+
+	sink, err = ParseSink("pubsub://project/topic?endpoint=http://localhost:8085")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8085/v1/projects/project/topics/topic:publish", sink.(*PubSubSink).publishURL)
+	assert.False(t, sink.(*PubSubSink).useToken)
+
+	sink, err = ParseSink("kafka://proxy:8082/events")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy:8082/topics/events", sink.(*KafkaSink).produceURL)
+
+	sink, err = ParseSink("kafka+https://proxy:8082/events")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://proxy:8082/topics/events", sink.(*KafkaSink).produceURL)
+
+	for _, sinkURL := range []string{"file:", "pubsub://project", "kafka://proxy:8082", "s3://bucket/events"} {
+		_, err = ParseSink(sinkURL)
+		assert.Error(t, err, sinkURL)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	for i := 0; i < 2; i++ {
+		sink, err := CreateFileSink(path)
+		assert.NoError(t, err)
+		assert.NoError(t, sink.Write(testEvents))
+		assert.NoError(t, sink.Close())
+	}
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	assert.Equal(t, append(append([]Event(nil), testEvents...), testEvents...), events)
+}
+
+func TestPubSubSink(t *testing.T) {
+	t.Parallel()
+
+	var received []Event
+	var attributes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/projects/project/topics/topic:publish", r.URL.Path)
+		var request struct {
+			Messages []pubSubMessage `json:"messages"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		for _, message := range request.Messages {
+			var event Event
+			assert.NoError(t, json.Unmarshal(message.Data, &event))
+			received = append(received, event)
+			attributes = append(attributes, message.Attributes["type"])
+		}
+		w.Write([]byte(`{"messageIds":[]}`))
+	}))
+	defer server.Close()
+
+	sink := CreatePubSubSink("project", "topic", server.URL)
+	assert.NoError(t, sink.Write(testEvents))
+	assert.Equal(t, testEvents, received)
+	assert.Equal(t, []string{SessionStartEvent, SessionStopEvent}, attributes)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	assert.Error(t, sink.Write(testEvents))
+}
+
+func TestKafkaSink(t *testing.T) {
+	t.Parallel()
+
+	var keys []string
+	var received []Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/events", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		var request struct {
+			Records []struct {
+				Key   string `json:"key"`
+				Value Event  `json:"value"`
+			} `json:"records"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		for _, record := range request.Records {
+			keys = append(keys, record.Key)
+			received = append(received, record.Value)
+		}
+		w.Write([]byte(`{"offsets":[]}`))
+	}))
+	defer server.Close()
+
+	sink := CreateKafkaSink(server.URL, "events")
+	assert.NoError(t, sink.Write(testEvents))
+	assert.Equal(t, testEvents, received)
+	assert.Equal(t, []string{"aa", "aa"}, keys)
+}
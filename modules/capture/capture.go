@@ -0,0 +1,213 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+// A capture file is a header followed by one record per packet. The header is the magic and the address of the
+// gateway the packets were sent to, which the packet filter hashes, so replays must go to a gateway configured
+// with the same address. Each record is the receive time in nanoseconds since the unix epoch, the address the
+// packet came from, the packet length and the packet data. Numbers are little endian.
+
+var Magic = []byte("UDPXCAP1")
+
+const HeaderBytes = 8 + core.AddressBytes
+const RecordHeaderBytes = 8 + core.AddressBytes + 2
+
+const MaxPacketBytes = 65535
+
+type Packet struct {
+	Time time.Time
+	From *net.UDPAddr
+	Data []byte
+}
+
+// Writer appends packets to a capture file. It is safe to call from multiple goroutines, and stops writing
+// once the file reaches maxBytes, so a forgotten capture can't fill the disk.
+type Writer struct {
+	mutex    sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	bytes    int64
+	maxBytes int64
+	packets  uint64
+	dropped  uint64
+	err      error
+}
+
+func Create(path string, gatewayAddress *net.UDPAddr, maxBytes int64) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	writer := &Writer{file: file, writer: bufio.NewWriterSize(file, 1024*1024), maxBytes: maxBytes}
+	var header [HeaderBytes]byte
+	index := 0
+	core.WriteBytes(header[:], &index, Magic, len(Magic))
+	core.WriteAddress(header[:], &index, gatewayAddress)
+	if _, err := writer.writer.Write(header[:]); err != nil {
+		file.Close()
+		return nil, err
+	}
+	writer.bytes = HeaderBytes
+	return writer, nil
+}
+
+// Write records a packet. It returns false if the packet was not written because the file is full or a
+// previous write failed.
+func (writer *Writer) Write(receiveTime time.Time, from *net.UDPAddr, packetData []byte) bool {
+	if len(packetData) > MaxPacketBytes {
+		packetData = packetData[:MaxPacketBytes]
+	}
+	var header [RecordHeaderBytes]byte
+	index := 0
+	core.WriteUint64(header[:], &index, uint64(receiveTime.UnixNano()))
+	core.WriteAddress(header[:], &index, from)
+	core.WriteUint16(header[:], &index, uint16(len(packetData)))
+	recordBytes := int64(RecordHeaderBytes + len(packetData))
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.err != nil || writer.bytes+recordBytes > writer.maxBytes {
+		writer.dropped++
+		return false
+	}
+	if _, err := writer.writer.Write(header[:]); err != nil {
+		writer.err = err
+		return false
+	}
+	if _, err := writer.writer.Write(packetData); err != nil {
+		writer.err = err
+		return false
+	}
+	writer.bytes += recordBytes
+	writer.packets++
+	return true
+}
+
+// Flush writes buffered packets to the file, so it can be read while the capture is still running.
+func (writer *Writer) Flush() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.err != nil {
+		return writer.err
+	}
+	writer.err = writer.writer.Flush()
+	return writer.err
+}
+
+func (writer *Writer) Close() error {
+	err := writer.Flush()
+	if closeErr := writer.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// GetStats returns the number of packets written and the number dropped because the file was full.
+func (writer *Writer) GetStats() (packets uint64, dropped uint64) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return writer.packets, writer.dropped
+}
+
+type Reader struct {
+	file           *os.File
+	reader         *bufio.Reader
+	GatewayAddress *net.UDPAddr
+}
+
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := &Reader{file: file, reader: bufio.NewReaderSize(file, 1024*1024)}
+	var header [HeaderBytes]byte
+	if _, err := io.ReadFull(reader.reader, header[:]); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not read capture header: %v", err)
+	}
+	if !bytes.Equal(header[:len(Magic)], Magic) {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a capture file", path)
+	}
+	index := len(Magic)
+	reader.GatewayAddress = &net.UDPAddr{}
+	if !core.ReadAddress(header[:], &index, reader.GatewayAddress) {
+		file.Close()
+		return nil, fmt.Errorf("invalid gateway address in capture header")
+	}
+	return reader, nil
+}
+
+// Read reads the next packet. It returns io.EOF at the end of the file, and io.ErrUnexpectedEOF if the last
+// packet was cut short, which happens when the gateway is killed in the middle of a capture.
+func (reader *Reader) Read(packet *Packet) error {
+	var header [RecordHeaderBytes]byte
+	if _, err := io.ReadFull(reader.reader, header[:]); err != nil {
+		return err
+	}
+	index := 0
+	var timestamp uint64
+	core.ReadUint64(header[:], &index, &timestamp)
+	packet.From = &net.UDPAddr{}
+	if !core.ReadAddress(header[:], &index, packet.From) {
+		return fmt.Errorf("invalid address in capture record")
+	}
+	var packetBytes uint16
+	core.ReadUint16(header[:], &index, &packetBytes)
+	packet.Time = time.Unix(0, int64(timestamp))
+	packet.Data = make([]byte, packetBytes)
+	if _, err := io.ReadFull(reader.reader, packet.Data); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (reader *Reader) Close() error {
+	return reader.file.Close()
+}
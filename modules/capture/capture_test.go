@@ -0,0 +1,153 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package capture
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapture(t *testing.T) {
+
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "gateway.capture")
+
+	gatewayAddress := core.ParseAddress("198.51.100.1:40000")
+	startTime := time.Unix(1700000000, 123456789)
+
+	writer, err := Create(path, gatewayAddress, 1024*1024)
+	assert.Nil(t, err)
+
+	froms := []string{"127.0.0.1:30000", "[2001:db8::7]:51000", "203.0.113.7:1"}
+	for i, from := range froms {
+		packetData := make([]byte, 100*(i+1))
+		for j := range packetData {
+			packetData[j] = byte(i + j)
+		}
+		assert.True(t, writer.Write(startTime.Add(time.Duration(i)*time.Millisecond), core.ParseAddress(from), packetData))
+	}
+	assert.True(t, writer.Write(startTime.Add(time.Second), core.ParseAddress(froms[0]), nil))
+	assert.Nil(t, writer.Close())
+
+	packets, dropped := writer.GetStats()
+	assert.Equal(t, uint64(4), packets)
+	assert.Equal(t, uint64(0), dropped)
+
+	// packets read back in order, with their times and addresses
+
+	reader, err := Open(path)
+	assert.Nil(t, err)
+	defer reader.Close()
+	assert.True(t, core.AddressEqual(gatewayAddress, reader.GatewayAddress))
+
+	var packet Packet
+	for i, from := range froms {
+		assert.Nil(t, reader.Read(&packet))
+		assert.True(t, packet.Time.Equal(startTime.Add(time.Duration(i)*time.Millisecond)))
+		assert.True(t, core.AddressEqual(core.ParseAddress(from), packet.From))
+		assert.Equal(t, 100*(i+1), len(packet.Data))
+		assert.Equal(t, byte(i+99), packet.Data[99])
+	}
+	assert.Nil(t, reader.Read(&packet))
+	assert.Equal(t, 0, len(packet.Data))
+	assert.Equal(t, io.EOF, reader.Read(&packet))
+}
+
+func TestCaptureFull(t *testing.T) {
+
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "gateway.capture")
+
+	// only two packets fit
+
+	writer, err := Create(path, core.ParseAddress("127.0.0.1:40000"), HeaderBytes+2*(RecordHeaderBytes+100))
+	assert.Nil(t, err)
+
+	from := core.ParseAddress("127.0.0.1:30000")
+	assert.True(t, writer.Write(time.Now(), from, make([]byte, 100)))
+	assert.True(t, writer.Write(time.Now(), from, make([]byte, 100)))
+	assert.False(t, writer.Write(time.Now(), from, make([]byte, 100)))
+	assert.False(t, writer.Write(time.Now(), from, make([]byte, 1)))
+	assert.Nil(t, writer.Close())
+
+	packets, dropped := writer.GetStats()
+	assert.Equal(t, uint64(2), packets)
+	assert.Equal(t, uint64(2), dropped)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(HeaderBytes+2*(RecordHeaderBytes+100)), info.Size())
+}
+
+func TestCaptureTruncated(t *testing.T) {
+
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gateway.capture")
+
+	writer, err := Create(path, core.ParseAddress("127.0.0.1:40000"), 1024*1024)
+	assert.Nil(t, err)
+	assert.True(t, writer.Write(time.Now(), core.ParseAddress("127.0.0.1:30000"), make([]byte, 100)))
+	assert.True(t, writer.Write(time.Now(), core.ParseAddress("127.0.0.1:30000"), make([]byte, 100)))
+	assert.Nil(t, writer.Close())
+
+	// a capture cut off in the middle of a packet reads up to that packet
+
+	assert.Nil(t, os.Truncate(path, HeaderBytes+RecordHeaderBytes+100+RecordHeaderBytes+50))
+
+	reader, err := Open(path)
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	var packet Packet
+	assert.Nil(t, reader.Read(&packet))
+	assert.Equal(t, io.ErrUnexpectedEOF, reader.Read(&packet))
+
+	// files that aren't captures don't open
+
+	notCapture := filepath.Join(dir, "not.capture")
+	assert.Nil(t, os.WriteFile(notCapture, make([]byte, 100), 0644))
+	_, err = Open(notCapture)
+	assert.NotNil(t, err)
+
+	_, err = Open(filepath.Join(dir, "missing.capture"))
+	assert.NotNil(t, err)
+}
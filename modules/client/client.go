@@ -0,0 +1,2026 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/reliable"
+	"github.com/networknext/udpx/modules/tunnel"
+	"github.com/networknext/udpx/modules/websocket"
+)
+
+const MaxPacketSize = 1500
+const OldSequenceThreshold = 100
+const SequenceBufferSize = 1024
+const QueueSize = 1024
+const NumDisconnectPackets = 3
+const ReliableUpdateInterval = 10 * time.Millisecond
+const MTUProbeCheckInterval = 50 * time.Millisecond
+const UpdateInterval = 100 * time.Millisecond
+const QUICHandshakeTimeout = 5 * time.Second
+const DTLSHandshakeTimeout = 5 * time.Second
+const ConnectTokenRetryInterval = time.Second
+const QualityUpdateInterval = time.Second
+
+// MaxPayloadBytes is the largest payload that can be sent. Payloads other than MinPayloadBytes long are fragmented.
+
+const MaxPayloadBytes = core.MaxFragments * (core.MinPayloadBytes - core.FragmentHeaderBytes)
+
+var SendLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+
+type State int
+
+const (
+	StateConnecting State = iota
+	StateConnected
+	StateDisconnected
+)
+
+func (state State) String() string {
+	switch state {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return fmt.Sprintf("unknown(%d)", int(state))
+}
+
+// Config configures a session. ClientAddress is the address gateways see packets coming from, which the
+// packet filter is keyed on. If QUICGatewayAddress is set, packets to the gateway go in QUIC datagrams
+// to that address instead of bare udp, and if DTLSGatewayAddress is set they go in DTLS records, with the
+// gateway certificate verified for DTLSServerName if that is set. Multipath sessions send over the path
+// to the primary gateway while it is up, or over the path to an IPv6 gateway if PreferIPv6 is set. If WebSocketURL is set and nothing arrives from the gateway within
+// UDPHandshakeTimeout, packets to that gateway are tunnelled over a websocket instead. If Route is set, from
+// core.GenerateRoute, packets to the primary gateway go through the relays on the route.
+//
+// If nothing is received from the primary gateway for FailoverTimeout, the session fails over to the next
+// fallback gateway in the connect token, and on around the list, keeping the same session token. Failover
+// is for bare udp, so it is off when WebSocketURL, QUICGatewayAddress or DTLSGatewayAddress is set. If
+// FetchConnectToken is set, it is called for a new connect token when the session token has expired or
+// nothing has been received for IdleTimeout, and the session starts over with it, under a new session id,
+// rather than disconnecting.
+//
+// Connection quality is scored from RTT, jitter and packet loss each QualityUpdateInterval, and
+// QualityCallback is called with the quality and rolling score whenever the quality changes, eg. so the
+// game can raise its interpolation delay or warn the player.
+//
+// When the gateways in the connect token are in both address families, the session races the primary
+// gateway against the first gateway in the other family, started ConnectRaceDelay later, and keeps
+// whichever answers first. This is the happy eyeballs approach, for dual stack networks where one family
+// is broken. Racing is for bare udp, and is off when ConnectRaceDelay is zero.
+//
+// Once connected, the session sends the gateway its stats every StatsInterval: the frame rate bucket from
+// SetFrameRate, the RTT it measures, and Platform. The gateway attaches them to its analytics events.
+// Stats are off when StatsInterval is zero.
+//
+// If PacingKbps is set, packets to the gateways are paced at that rate, so bursts of packets, like the
+// fragments of a large payload, are spread out over up to one RTT rather than sent back to back.
+//
+// Where the network honors DiffServ, DSCP tags the packets sent to the gateways with a DSCP for each
+// priority. Payloads are sent with normal priority unless sent with SendWithPriority, and everything else
+// is sent with normal priority. Tagging is only supported on linux, and only over bare udp. The callbacks
+// are optional, and are called from the session's own goroutines.
+type Config struct {
+	BindAddress             string
+	ClientAddress           *net.UDPAddr
+	MultipathGatewayAddress *net.UDPAddr
+	ReadBuffer              int
+	WriteBuffer             int
+	FilterKey               []byte
+	KeepAliveInterval       time.Duration
+	IdleTimeout             time.Duration
+	MTUProbeInterval        time.Duration
+	QUICGatewayAddress      string
+	DTLSGatewayAddress      string
+	DTLSServerName          string
+	WebSocketURL            string
+	UDPHandshakeTimeout     time.Duration
+	PreferIPv6              bool
+	Route                   []byte
+	FailoverTimeout         time.Duration
+	ConnectRaceDelay        time.Duration
+	StatsInterval           time.Duration
+	Platform                core.Platform
+	PacingKbps              float64
+	DSCP                    core.DSCPConfig
+
+	ReceiveCallback   func(payload []byte)
+	MessageCallback   func(message []byte)
+	AckCallback       func(payloadId uint64)
+	StateCallback     func(state State)
+	QualityCallback   func(quality core.Quality, score float64)
+	FetchConnectToken func() ([]byte, error)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		BindAddress:         ":0",
+		ReadBuffer:          100000,
+		WriteBuffer:         100000,
+		KeepAliveInterval:   time.Second,
+		IdleTimeout:         10 * time.Second,
+		MTUProbeInterval:    500 * time.Millisecond,
+		UDPHandshakeTimeout: 5 * time.Second,
+		FailoverTimeout:     3 * time.Second,
+		ConnectRaceDelay:    250 * time.Millisecond,
+		StatsInterval:       10 * time.Second,
+	}
+}
+
+// path is the connection to one gateway. Multipath sessions have a path to each of two gateways,
+// sharing the session id, session keys and sequence numbers.
+type path struct {
+	gatewayAddress *net.UDPAddr
+	clientAddress  *net.UDPAddr
+	tunnel         packetTunnel
+	route          *core.Route
+	receivedPacket bool
+
+	sessionTokenData       []byte
+	sessionTokenSequence   uint64
+	sessionTokenExpireTime time.Time
+
+	gatewayId [core.GatewayIdBytes]byte
+
+	connectedToServer             bool
+	hasChallengeToken             bool
+	challengeTokenData            [core.EncryptedChallengeTokenBytes]byte
+	challengeTokenSequence        uint64
+	challengeTokenExpireTimestamp uint64
+	challengeTokenGatewayId       [core.GatewayIdBytes]byte
+
+	// gateways under attack send a cookie, which goes around our packets until the gateway answers with payload
+	hasCookie bool
+	cookie    uint64
+
+	sendBandwidthBitsAccumulator uint64
+
+	lastReceiveTime time.Time
+}
+
+// packetTunnel carries packets to a gateway over something other than bare udp
+type packetTunnel interface {
+	WritePacket(packetData []byte) error
+	ReadPacket() ([]byte, error)
+	Close() error
+}
+
+type webSocketTunnel struct {
+	*websocket.Conn
+}
+
+func (t webSocketTunnel) WritePacket(packetData []byte) error {
+	return t.WriteMessage(packetData)
+}
+
+func (t webSocketTunnel) ReadPacket() ([]byte, error) {
+	return t.ReadMessage()
+}
+
+// Session is a connection to the server through one or two gateways. It sends keep-alives while there
+// is nothing else to send, picks up refreshed session tokens from the gateways, and disconnects when
+// nothing is received for the idle timeout or the session token expires.
+type Session struct {
+	config Config
+
+	conn *net.UDPConn
+
+	packetFilter     byte
+	gatewayPublicKey []byte
+	clientPrivateKey []byte
+	sessionId        []byte
+	sessionKeys      core.SessionKeys
+	fecEncoder       *core.FECEncoder
+
+	pathStats        *core.PathStats
+	pathMTU          *core.PathMTU
+	reliableEndpoint *reliable.Endpoint
+	pacer            *core.Pacer
+	pacedSender      *core.PacedSender
+
+	payloadSendQueue    chan queuedPayload
+	connectTokenChannel chan []byte
+	closeChannel        chan struct{}
+	doneChannel         chan struct{}
+	closeOnce           sync.Once
+
+	stateMutex sync.Mutex
+	state      State
+
+	// everything below is shared by the send and receive goroutines
+
+	mutex sync.Mutex
+
+	paths         []*path
+	pathOrder     []int
+	serverId      [core.ServerIdBytes]byte
+	disconnecting bool
+
+	// packets are written in the newest protocol version, until an older gateway rejects it
+
+	packetVersion byte
+
+	// payload is encrypted with the fastest cipher suite on this machine, until a gateway rejects it
+
+	cipherSuite byte
+
+	// the first path fails over through the gateways in the connect token, primary gateway first
+
+	gatewayAddresses     []*net.UDPAddr
+	gatewayIndex         int
+	route                *core.Route
+	failoverTime         time.Time
+	fetchingConnectToken bool
+	fetchTime            time.Time
+	refetched            bool
+
+	// while connecting, the first path races the primary gateway against a gateway in the other address
+	// family, with the same session token and sequence numbers
+
+	race        *path
+	raceIndex   int
+	raceTime    time.Time
+	raceStarted bool
+
+	sendSequence        uint64
+	payloadId           uint64
+	sequenceToPayloadId [SequenceBufferSize]uint64
+	lastSendTime        time.Time
+
+	receiveSequence     uint64
+	receiveSequenceTime time.Time
+	lastReceiveTime     time.Time
+	receivedPackets     [SequenceBufferSize]uint64
+	ackedPackets        [SequenceBufferSize]uint64
+	ackBuffer           [SequenceBufferSize]uint64
+
+	sendBandwidthBitsPerSecondMax uint64
+	sendBandwidthBitsResetTime    time.Time
+
+	connectionQuality core.ConnectionQuality
+	qualityUpdateTime time.Time
+
+	frameRate     float64
+	statsSendTime time.Time
+
+	duplicatePacketsReceived uint64
+
+	err error
+}
+
+// Connect starts a session with the connect token from the auth service. It returns once the client
+// socket is open. The session is connecting until the first packet arrives from the server.
+func Connect(connectToken []byte, config Config) (*Session, error) {
+
+	if len(connectToken) < core.ConnectTokenBytes || len(connectToken) > core.MaxConnectTokenBytes {
+		return nil, fmt.Errorf("connect token must be %d to %d bytes, got %d", core.ConnectTokenBytes, core.MaxConnectTokenBytes, len(connectToken))
+	}
+
+	if config.ClientAddress == nil {
+		return nil, fmt.Errorf("missing client address")
+	}
+
+	if config.FilterKey != nil && len(config.FilterKey) != core.SipHashKeyBytes {
+		return nil, fmt.Errorf("filter key must be %d bytes, got %d", core.SipHashKeyBytes, len(config.FilterKey))
+	}
+
+	if config.QUICGatewayAddress != "" && config.DTLSGatewayAddress != "" {
+		return nil, fmt.Errorf("quic and dtls gateway addresses can't both be set")
+	}
+
+	var route *core.Route
+	if config.Route != nil {
+		route = &core.Route{}
+		if !core.ReadRoute(config.Route, route) {
+			return nil, fmt.Errorf("invalid route")
+		}
+		if config.QUICGatewayAddress != "" || config.DTLSGatewayAddress != "" || config.WebSocketURL != "" {
+			return nil, fmt.Errorf("routes can't be used with quic, dtls or websockets")
+		}
+	}
+
+	if config.KeepAliveInterval <= 0 || config.IdleTimeout <= 0 || config.MTUProbeInterval < 0 || config.FailoverTimeout < 0 || config.ConnectRaceDelay < 0 {
+		return nil, fmt.Errorf("invalid keep-alive interval, idle timeout, mtu probe interval, failover timeout or connect race delay")
+	}
+
+	if config.StatsInterval < 0 || config.Platform >= core.NumPlatforms {
+		return nil, fmt.Errorf("invalid stats interval or platform")
+	}
+
+	if config.PacingKbps < 0 {
+		return nil, fmt.Errorf("invalid pacing rate")
+	}
+
+	for _, dscp := range config.DSCP {
+		if dscp < 0 || dscp > core.MaxDSCP {
+			return nil, fmt.Errorf("invalid dscp %d", dscp)
+		}
+	}
+
+	if config.WebSocketURL != "" && config.UDPHandshakeTimeout <= 0 {
+		return nil, fmt.Errorf("invalid udp handshake timeout")
+	}
+
+	index := 0
+	var connectData core.ConnectData
+	if !core.ReadConnectData(connectToken, &index, &connectData) {
+		return nil, fmt.Errorf("invalid connect data")
+	}
+
+	fallbackGateways, ok := core.ReadFallbackGateways(connectToken)
+	if !ok {
+		return nil, fmt.Errorf("invalid fallback gateways")
+	}
+
+	// multipath sessions also connect to a second gateway with the same connect token. gateways all share
+	// the same key pair, so the session token in the connect token is valid on any of them
+
+	if config.MultipathGatewayAddress != nil && core.AddressEqual(config.MultipathGatewayAddress, &connectData.GatewayAddress) {
+		return nil, fmt.Errorf("multipath gateway address is the same as the gateway address")
+	}
+
+	session := &Session{config: config}
+
+	// payloads are sent with forward error correction when the connect token asks for it
+
+	if connectData.FECDataShards != 0 {
+		fecEncoder, err := core.CreateFECEncoder(int(connectData.FECDataShards), int(connectData.FECParityShards))
+		if err != nil {
+			return nil, fmt.Errorf("invalid connect data: %v", err)
+		}
+		session.fecEncoder = fecEncoder
+		core.Info("fec is %d data shards, %d parity shards", connectData.FECDataShards, connectData.FECParityShards)
+	}
+
+	session.packetFilter = core.PacketFilter_FNV1a
+	if config.FilterKey != nil {
+		session.packetFilter = core.PacketFilter_SipHash
+	}
+	session.packetVersion = core.PacketVersion(core.ProtocolVersion, session.packetFilter)
+	session.cipherSuite = core.PreferredCipherSuite()
+
+	gatewayAddresses := []*net.UDPAddr{&connectData.GatewayAddress}
+	if config.MultipathGatewayAddress != nil {
+		gatewayAddresses = append(gatewayAddresses, config.MultipathGatewayAddress)
+	}
+
+	session.paths = make([]*path, len(gatewayAddresses))
+	for i := range session.paths {
+		session.paths[i] = &path{gatewayAddress: gatewayAddresses[i], clientAddress: config.ClientAddress}
+		session.paths[i].sessionTokenData = make([]byte, core.EncryptedSessionTokenBytes)
+		copy(session.paths[i].sessionTokenData[:], connectToken[core.ConnectDataBytes:core.ConnectTokenBytes])
+		session.paths[i].sessionTokenExpireTime = time.Unix(int64(connectData.ExpireTimestamp), 0)
+	}
+
+	session.gatewayAddresses = failoverGateways(&connectData.GatewayAddress, fallbackGateways, config.MultipathGatewayAddress)
+	session.failoverTime = time.Now()
+
+	// routed sessions send to the first relay, and get packets back from it
+
+	if route != nil {
+		session.route = route
+		session.paths[0].gatewayAddress = &route.RelayAddress
+		session.paths[0].route = route
+	}
+
+	// paths are preferred in order, primary gateway first. with PreferIPv6, paths to ipv6 gateways go first
+
+	session.pathOrder = make([]int, len(session.paths))
+	for i := range session.pathOrder {
+		session.pathOrder[i] = i
+	}
+	if config.PreferIPv6 {
+		sort.SliceStable(session.pathOrder, func(a, b int) bool {
+			return isIPv6(session.paths[session.pathOrder[a]].gatewayAddress) && !isIPv6(session.paths[session.pathOrder[b]].gatewayAddress)
+		})
+	}
+
+	session.gatewayPublicKey = connectData.GatewayPublicKey[:]
+	session.clientPrivateKey = connectData.ClientPrivateKey[:]
+	session.sessionId = connectData.ClientPublicKey[:]
+	session.sessionKeys = core.DeriveSessionKeys(core.SessionKey(session.gatewayPublicKey, session.clientPrivateKey), session.sessionId)
+
+	session.sendBandwidthBitsPerSecondMax = uint64(connectData.EnvelopeUpKbps * 1000)
+	session.sendBandwidthBitsResetTime = time.Now().Add(time.Second)
+
+	session.sendSequence = uint64(10000) + uint64(rand.Intn(10000))
+	session.lastReceiveTime = time.Now()
+	for i := range session.sequenceToPayloadId {
+		session.sequenceToPayloadId[i] = ^uint64(0)
+	}
+
+	session.pathStats = core.CreatePathStats()
+	session.pathMTU = core.CreatePathMTU(core.MinPacketSize, core.MaxPathMTU, config.MTUProbeInterval)
+	session.reliableEndpoint = reliable.CreateEndpoint(reliable.DefaultResendTime)
+	session.pacer = core.CreatePacer(config.PacingKbps)
+
+	session.payloadSendQueue = make(chan queuedPayload, QueueSize)
+	session.connectTokenChannel = make(chan []byte, 1)
+	session.closeChannel = make(chan struct{})
+	session.doneChannel = make(chan struct{})
+
+	// create client socket
+
+	bindAddress, err := net.ResolveUDPAddr("udp", config.BindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", bindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("could not bind socket: %v", err)
+	}
+
+	if err := conn.SetReadBuffer(config.ReadBuffer); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not set connection read buffer size: %v", err)
+	}
+
+	if err := conn.SetWriteBuffer(config.WriteBuffer); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not set connection write buffer size: %v", err)
+	}
+
+	// packets are tagged with the normal priority dscp by default, and other priorities per packet. the
+	// same config is used on every platform, so the session goes ahead untagged where dscp isn't supported
+
+	if config.DSCP.Enabled() {
+		if err := core.SetDSCP(conn, config.DSCP[core.PriorityNormal]); err != nil {
+			core.Error("packets will not be tagged: %v", err)
+		}
+	}
+
+	session.conn = conn
+
+	// in quic and dtls modes the gateway sees our packets coming from its end of the connection, not from us
+
+	var connectTunnel packetTunnel
+	var tunnelMode, tunnelAddress string
+	if config.QUICGatewayAddress != "" {
+		quicConn, clientAddress, err := tunnel.Dial(config.QUICGatewayAddress, QUICHandshakeTimeout)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not connect over quic: %v", err)
+		}
+		connectTunnel = quicConn
+		tunnelMode, tunnelAddress = "quic", config.QUICGatewayAddress
+		session.paths[0].clientAddress = clientAddress
+	} else if config.DTLSGatewayAddress != "" {
+		dtlsConn, clientAddress, err := tunnel.DialDTLS(config.DTLSGatewayAddress, config.DTLSServerName, DTLSHandshakeTimeout)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not connect over dtls: %v", err)
+		}
+		connectTunnel = dtlsConn
+		tunnelMode, tunnelAddress = "dtls", config.DTLSGatewayAddress
+		session.paths[0].clientAddress = clientAddress
+	}
+	session.paths[0].tunnel = connectTunnel
+
+	core.Info("session id is %s", core.IdString(session.sessionId))
+
+	for i := range session.paths {
+		if session.paths[i].route != nil {
+			core.Info("connecting to %s through %d relays, starting at %s", &connectData.GatewayAddress, session.paths[i].route.NumRouteTokens, session.paths[i].gatewayAddress)
+		} else if session.paths[i].tunnel != nil {
+			core.Info("connecting to %s over %s at %s", session.paths[i].gatewayAddress, tunnelMode, tunnelAddress)
+		} else {
+			core.Info("connecting to %s", session.paths[i].gatewayAddress)
+		}
+	}
+
+	if len(session.gatewayAddresses) > 1 {
+		core.Info("failing over to %v", session.gatewayAddresses[1:])
+	}
+
+	session.startRace()
+
+	if config.PacingKbps > 0 {
+		core.Info("pacing packets at %.0f kbps", config.PacingKbps)
+		session.pacedSender = core.CreatePacedSender()
+	}
+
+	go session.sendLoop()
+	go session.receiveLoop()
+
+	if connectTunnel != nil {
+		go session.tunnelReceiveLoop(0, connectTunnel)
+	}
+
+	if config.WebSocketURL != "" {
+		go session.webSocketFallback()
+	}
+
+	return session, nil
+}
+
+// queuedPayload is a payload waiting to be sent, with the priority it is tagged with
+type queuedPayload struct {
+	data     []byte
+	priority core.Priority
+}
+
+// Send queues a copy of the payload to be sent unreliably. Payloads of exactly MinPayloadBytes go in a
+// single packet over every path, with forward error correction if the connect token asks for it. Other
+// payloads are split into fragments as large as the path mtu allows.
+func (session *Session) Send(payload []byte) error {
+	return session.SendWithPriority(payload, core.PriorityNormal)
+}
+
+// SendWithPriority is Send, with the packets tagged with the DSCP for the priority.
+func (session *Session) SendWithPriority(payload []byte, priority core.Priority) error {
+	if priority >= core.NumPriorities {
+		return fmt.Errorf("unknown priority %d", priority)
+	}
+	if len(payload) == 0 || len(payload) > MaxPayloadBytes {
+		return fmt.Errorf("payload must be between 1 and %d bytes, got %d", MaxPayloadBytes, len(payload))
+	}
+	if session.GetState() == StateDisconnected {
+		return fmt.Errorf("session is disconnected")
+	}
+	select {
+	case session.payloadSendQueue <- queuedPayload{data: append([]byte(nil), payload...), priority: priority}:
+		return nil
+	default:
+		return fmt.Errorf("send queue is full")
+	}
+}
+
+// SendMessage queues a message on the reliable channel. Messages are delivered to the server in order.
+func (session *Session) SendMessage(message []byte) error {
+	if session.GetState() == StateDisconnected {
+		return fmt.Errorf("session is disconnected")
+	}
+	return session.reliableEndpoint.SendMessage(message)
+}
+
+// Close tells the gateways and server we are leaving, so the session ends now instead of timing out,
+// and closes the client socket.
+func (session *Session) Close() {
+	session.closeOnce.Do(func() {
+		close(session.closeChannel)
+	})
+	<-session.doneChannel
+}
+
+// GetError returns why the session closed itself, or nil. A gateway speaking another protocol version closes
+// the session with a *core.ProtocolVersionError, and one that wants a cipher suite this machine doesn't have
+// closes it with a *core.CipherSuiteError.
+func (session *Session) GetError() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.err
+}
+
+func (session *Session) GetState() State {
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+	return session.state
+}
+
+// GetCipherSuite returns the cipher suite the session encrypts payload with
+func (session *Session) GetCipherSuite() byte {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.cipherSuite
+}
+
+func (session *Session) GetSessionId() []byte {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.sessionId
+}
+
+func (session *Session) GetStats() core.PathStatsSnapshot {
+	return session.pathStats.Stats()
+}
+
+// GetQuality returns the connection quality and its rolling score from 0 to 100
+func (session *Session) GetQuality() (core.Quality, float64) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.connectionQuality.Quality()
+}
+
+// SetFrameRate sets the frame rate reported to the gateway in the session's stats, in frames per second
+func (session *Session) SetFrameRate(frameRate float64) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.frameRate = frameRate
+}
+
+func (session *Session) GetMTU() int {
+	return session.pathMTU.GetMTU()
+}
+
+func (session *Session) GetNumPaths() int {
+	return len(session.paths)
+}
+
+func (session *Session) GetDuplicatePackets() uint64 {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.duplicatePacketsReceived
+}
+
+// updateState returns true if the state changed. disconnected is final
+
+func (session *Session) updateState(state State) bool {
+	session.stateMutex.Lock()
+	defer session.stateMutex.Unlock()
+	if session.state == state || session.state == StateDisconnected {
+		return false
+	}
+	session.state = state
+	return true
+}
+
+func (session *Session) setState(state State) {
+	if session.updateState(state) && session.config.StateCallback != nil {
+		session.config.StateCallback(state)
+	}
+}
+
+func isIPv6(address *net.UDPAddr) bool {
+	return address.IP.To4() == nil
+}
+
+// preferredPath is the first path in preference order, unless nothing has been received over it for a
+// while and something has been received over another path
+
+func (session *Session) preferredPath() int {
+	for _, i := range session.pathOrder {
+		if time.Since(session.paths[i].lastReceiveTime) < core.PathTimeout {
+			return i
+		}
+	}
+	return session.pathOrder[0]
+}
+
+// sendPacket sends a packet over the preferred path, or over every path when multipath is true.
+// the copies have the same sequence, so the server only processes whichever arrives first.
+// the caller must hold the session mutex
+
+func (session *Session) sendPacket(packetType byte, channelId byte, payload []byte, priority core.Priority, multipath bool) {
+
+	sent := false
+
+	preferred := session.preferredPath()
+
+	if multipath {
+		for i, path := range session.paths {
+			if session.sendPacketOverPath(path, i, packetType, channelId, payload, priority) {
+				sent = true
+			}
+		}
+	} else {
+		sent = session.sendPacketOverPath(session.paths[preferred], preferred, packetType, channelId, payload, priority)
+	}
+
+	// packets over the first path also go to the gateway it is racing, so either gateway can connect us
+
+	if session.race != nil && session.raceStarted && (multipath || preferred == 0) {
+		if session.sendPacketOverPath(session.race, 0, packetType, channelId, payload, priority) {
+			sent = true
+		}
+	}
+
+	if sent {
+		session.pathStats.PacketSent(session.sendSequence, time.Now())
+	}
+
+	session.lastSendTime = time.Now()
+
+	// payloads sent with fec can be recovered without their packet being acked, so only payloads
+	// on the unreliable channel are tracked
+
+	if packetType == core.PayloadPacket && channelId == core.UnreliableChannel {
+		session.sequenceToPayloadId[session.sendSequence%SequenceBufferSize] = session.payloadId
+		session.payloadId++
+	} else {
+		session.sequenceToPayloadId[session.sendSequence%SequenceBufferSize] = ^uint64(0)
+	}
+	session.sendSequence++
+}
+
+func (session *Session) sendPacketOverPath(path *path, pathIndex int, packetType byte, channelId byte, payload []byte, priority core.Priority) bool {
+
+	ack_bits := [core.AckBitsBytes]byte{}
+
+	core.GetAckBits(session.receiveSequence, session.receivedPackets[:], ack_bits[:])
+
+	packetData := make([]byte, MaxPacketSize)
+
+	index := 0
+
+	pathSequence := core.PathSequence(session.sendSequence, pathIndex)
+
+	core.Debug("send packet sequence = %d", session.sendSequence)
+	core.Debug("send packet ack = %d", session.receiveSequence)
+	core.Debug("send packet ack_bits = %x", ack_bits)
+
+	core.WriteUint8(packetData, &index, session.packetVersion)
+	core.WriteUint8(packetData, &index, session.cipherSuite)
+	chonkle := packetData[index : index+core.ChonkleBytes]
+	index += core.ChonkleBytes
+	core.WriteBytes(packetData, &index, path.sessionTokenData, core.EncryptedSessionTokenBytes)
+	core.WriteUint64(packetData, &index, path.sessionTokenSequence)
+	core.WriteBytes(packetData, &index, session.sessionId, core.SessionIdBytes)
+	core.WriteUint64(packetData, &index, pathSequence)
+	encryptStart := index
+	// acks are in the sequence space of the path, so each gateway can match them to the packets it sent
+	core.WriteUint64(packetData, &index, core.PathSequence(session.receiveSequence, pathIndex))
+	core.WriteBytes(packetData, &index, ack_bits[:], len(ack_bits))
+	if path.hasChallengeToken {
+		core.WriteBytes(packetData, &index, path.challengeTokenGatewayId[:], core.GatewayIdBytes)
+	} else {
+		core.WriteBytes(packetData, &index, path.gatewayId[:], core.GatewayIdBytes)
+	}
+	core.WriteBytes(packetData, &index, session.serverId[:], core.ServerIdBytes)
+	core.WriteUint8(packetData, &index, packetType)
+	if path.hasChallengeToken {
+		core.WriteUint8(packetData, &index, core.Flags_ChallengeToken)
+		core.WriteUint8(packetData, &index, channelId)
+		core.WriteUint32(packetData, &index, 0)
+		core.WriteBytes(packetData, &index, path.challengeTokenData[:], core.EncryptedChallengeTokenBytes)
+	} else {
+		core.WriteUint8(packetData, &index, 0)
+		core.WriteUint8(packetData, &index, channelId)
+		ackDelay := uint32(0)
+		if !session.receiveSequenceTime.IsZero() {
+			ackDelay = core.AckDelayMicroseconds(time.Since(session.receiveSequenceTime))
+		}
+		core.WriteUint32(packetData, &index, ackDelay)
+	}
+	core.WriteBytes(packetData, &index, payload[:], len(payload))
+	encryptFinish := index
+	index += core.HMACBytes_Box
+	pittle := packetData[index : index+core.PittleBytes]
+	index += core.PittleBytes
+
+	core.EncryptPayload(session.cipherSuite, session.sessionKeys.ClientToGateway[:], pathSequence, 0, packetData[encryptStart:encryptFinish+core.HMACBytes_AEAD], encryptFinish-encryptStart)
+
+	packetBytes := index
+	packetData = packetData[:packetBytes]
+
+	var magic [core.MagicBytes]byte
+
+	var fromAddressBuffer [core.MaxAddressDataBytes]byte
+	var fromAddressPort uint16
+
+	var toAddressBuffer [core.MaxAddressDataBytes]byte
+	var toAddressPort uint16
+
+	fromAddressData := fromAddressBuffer[:core.GetAddressData(path.clientAddress, fromAddressBuffer[:], &fromAddressPort)]
+	toAddressData := toAddressBuffer[:core.GetAddressData(path.gatewayAddress, toAddressBuffer[:], &toAddressPort)]
+
+	filterKey := session.config.FilterKey
+	if filterKey != nil {
+		core.GenerateChonkleKeyed(chonkle[:], filterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes)
+		core.GeneratePittleKeyed(pittle[:], filterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes)
+	} else {
+		core.GenerateChonkle(chonkle[:], magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes)
+		core.GeneratePittle(pittle[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes)
+	}
+
+	// packets on a route are wrapped for the first relay, with the route tokens for every hop
+
+	if path.route != nil {
+		relayPacketData := make([]byte, MaxPacketSize+core.MaxRelayBytes)
+		relayPacketBytes := core.WriteRelayPacket(relayPacketData, session.packetVersion, session.sessionId, path.route.NumRouteTokens, path.route.RouteTokens, packetData, filterKey, path.clientAddress, path.gatewayAddress)
+		if relayPacketBytes == 0 {
+			core.Debug("packet is too large to relay")
+			return false
+		}
+		packetData = relayPacketData[:relayPacketBytes]
+	}
+
+	if path.hasCookie {
+		cookiePacketData := make([]byte, len(packetData)+core.CookieEchoHeaderBytes)
+		packetData = cookiePacketData[:core.WriteCookieEchoPacket(cookiePacketData, session.packetVersion, path.cookie, packetData)]
+	}
+
+	// do we have enough bandwidth available to send this packet?
+
+	wireBits := uint64(core.WirePacketBits(len(packetData)))
+
+	if path.sendBandwidthBitsAccumulator+wireBits > session.sendBandwidthBitsPerSecondMax {
+		core.Debug("choke")
+		return false
+	}
+
+	path.sendBandwidthBitsAccumulator += wireBits
+
+	// send the packet, once the pacer lets it go
+
+	if delay := session.pacer.Delay(len(packetData), time.Now()); delay > 0 {
+		tunnel, gatewayAddress := path.tunnel, path.gatewayAddress
+		session.pacedSender.Send(delay, func() {
+			session.writePacket(tunnel, gatewayAddress, packetData, priority)
+		})
+		core.Debug("paced %d byte packet to %s by %s", len(packetData), path.gatewayAddress, delay)
+		return true
+	}
+
+	sent := session.writePacket(path.tunnel, path.gatewayAddress, packetData, priority)
+
+	core.Debug("sent %d byte packet to %s", len(packetData), path.gatewayAddress)
+
+	// time out the challenge token if it's too old
+
+	if path.hasChallengeToken && path.challengeTokenExpireTimestamp <= uint64(time.Now().Unix()) {
+		core.Debug("timed out challenge token")
+		path.hasChallengeToken = false
+	}
+
+	return sent
+}
+
+func (session *Session) writePacket(tunnel packetTunnel, gatewayAddress *net.UDPAddr, packetData []byte, priority core.Priority) bool {
+
+	sent := false
+
+	// the socket tags packets with the normal priority dscp, so only packets with another dscp need their own
+
+	var control []byte
+	if dscp := session.config.DSCP[priority]; dscp != session.config.DSCP[core.PriorityNormal] {
+		control = core.DSCPControlMessage(dscp, gatewayAddress)
+	}
+
+	if tunnel != nil {
+		if err := tunnel.WritePacket(packetData); err != nil {
+			SendLog.Error("failed to write tunnelled packet: %v", err)
+		} else {
+			sent = true
+		}
+	} else if _, _, err := session.conn.WriteMsgUDP(packetData, control, gatewayAddress); err != nil {
+		SendLog.Error("failed to write udp packet: %v", err)
+	} else {
+		sent = true
+	}
+
+	return sent
+}
+
+// sendLoop owns the send side of the session. payloads, keep-alives and disconnects are time critical,
+// or keep the session alive on each gateway, so they go over every path. everything else only goes over
+// the preferred path
+
+func (session *Session) sendLoop() {
+
+	keepAliveTicker := time.NewTicker(session.config.KeepAliveInterval / 4)
+	defer keepAliveTicker.Stop()
+
+	reliableTicker := time.NewTicker(ReliableUpdateInterval)
+	defer reliableTicker.Stop()
+
+	updateTicker := time.NewTicker(UpdateInterval)
+	defer updateTicker.Stop()
+
+	var mtuProbeTicker <-chan time.Time
+	if session.config.MTUProbeInterval > 0 {
+		ticker := time.NewTicker(MTUProbeCheckInterval)
+		defer ticker.Stop()
+		mtuProbeTicker = ticker.C
+	}
+
+	fragmentPacketId := uint16(0)
+
+	for {
+		select {
+
+		case queued := <-session.payloadSendQueue:
+			payload, priority := queued.data, queued.priority
+			if len(payload) == core.MinPayloadBytes && session.fecEncoder != nil {
+				shards, err := session.fecEncoder.Encode(payload)
+				if err != nil {
+					core.Error("could not encode payload: %v", err)
+					continue
+				}
+				session.mutex.Lock()
+				for i := range shards {
+					session.sendPacket(core.PayloadPacket, core.FECChannel, shards[i], priority, true)
+				}
+				session.mutex.Unlock()
+			} else if len(payload) == core.MinPayloadBytes {
+				session.mutex.Lock()
+				session.sendPacket(core.PayloadPacket, core.UnreliableChannel, payload, priority, true)
+				session.mutex.Unlock()
+			} else {
+				// payloads that fit in one fragment are padded to the minimum payload size, rather than the path mtu
+				fragmentBytes := core.PayloadBytesFromPacket(session.pathMTU.GetMTU())
+				if len(payload) <= core.MinPayloadBytes-core.FragmentHeaderBytes {
+					fragmentBytes = core.MinPayloadBytes
+				}
+				fragments, err := core.FragmentPayload(fragmentPacketId, payload, fragmentBytes)
+				if err != nil {
+					core.Error("could not fragment payload: %v", err)
+					continue
+				}
+				fragmentPacketId++
+				session.mutex.Lock()
+				for i := range fragments {
+					session.sendPacket(core.PayloadPacket, core.FragmentChannel, fragments[i], priority, false)
+				}
+				session.mutex.Unlock()
+			}
+
+		case <-keepAliveTicker.C:
+			// only send keep-alives while there are no payloads to send
+			session.mutex.Lock()
+			if time.Since(session.lastSendTime) >= session.config.KeepAliveInterval {
+				session.sendPacket(core.KeepAlivePacket, core.UnreliableChannel, make([]byte, core.MinPayloadBytes), core.PriorityNormal, true)
+			}
+			session.mutex.Unlock()
+
+		case <-reliableTicker.C:
+			// reliable messages and acks go in their own packets on the reliable channel
+			if session.reliableEndpoint.HasPacketToSend(time.Now()) {
+				payload := make([]byte, core.MinPayloadBytes)
+				session.reliableEndpoint.GeneratePacket(time.Now(), payload)
+				session.mutex.Lock()
+				session.sendPacket(core.PayloadPacket, core.ReliableChannel, payload, core.PriorityNormal, false)
+				session.mutex.Unlock()
+			}
+
+		case <-mtuProbeTicker:
+			// probes are padded out to the probe size. the challenge token would make them larger, so wait until we are connected
+			session.mutex.Lock()
+			if !session.paths[session.preferredPath()].hasChallengeToken {
+				if probeBytes := session.pathMTU.GetProbe(time.Now()); probeBytes != 0 {
+					payload := make([]byte, core.PayloadBytesFromPacket(probeBytes))
+					index := 0
+					core.WriteUint16(payload, &index, uint16(probeBytes))
+					session.sendPacket(core.MTUProbePacket, core.UnreliableChannel, payload, core.PriorityNormal, false)
+				}
+			}
+			session.mutex.Unlock()
+
+		case <-updateTicker.C:
+			if !session.update() {
+				session.disconnect()
+				return
+			}
+			session.updateRace()
+			session.failover()
+			session.updateQuality()
+			session.sendStats()
+
+		case connectToken := <-session.connectTokenChannel:
+			session.reconnect(connectToken)
+
+		case <-session.closeChannel:
+			session.disconnect()
+			return
+		}
+	}
+}
+
+// update resets the bandwidth accounting each second, and returns false once the session has timed out
+
+func (session *Session) update() bool {
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	timedOut := true
+	for _, path := range session.paths {
+		if !path.sessionTokenExpireTime.Before(time.Now()) {
+			timedOut = false
+		}
+	}
+
+	// with a way to fetch connect tokens, the session starts over instead of ending. it still ends if nothing
+	// is received for the idle timeout after starting over
+
+	if timedOut {
+		if session.config.FetchConnectToken == nil {
+			core.Info("disconnected. session token expired")
+			return false
+		}
+		session.fetchConnectToken()
+	}
+
+	if time.Since(session.lastReceiveTime) > session.config.IdleTimeout {
+		if session.config.FetchConnectToken == nil || session.refetched {
+			core.Info("timed out. nothing received for %s", session.config.IdleTimeout)
+			return false
+		}
+		core.Info("nothing received for %s. fetching a new connect token", session.config.IdleTimeout)
+		session.refetched = true
+		session.lastReceiveTime = time.Now()
+		session.fetchConnectToken()
+	}
+
+	if session.sendBandwidthBitsResetTime.Before(time.Now()) {
+		sendBandwidthBits := uint64(0)
+		for _, path := range session.paths {
+			sendBandwidthBits += path.sendBandwidthBitsAccumulator
+			path.sendBandwidthBitsAccumulator = 0
+		}
+		sendBandwidthMbps := float64(sendBandwidthBits) / 1000000.0
+		session.sendBandwidthBitsResetTime = time.Now().Add(time.Second)
+		stats := session.pathStats.Stats()
+		core.Debug("%.2f mbps, rtt %.1fms, jitter %.1fms, packet loss %.1f%%", sendBandwidthMbps,
+			float64(stats.RTT)/float64(time.Millisecond), float64(stats.Jitter)/float64(time.Millisecond), stats.PacketLoss*100)
+	}
+
+	return true
+}
+
+// updateQuality scores the path stats into the connection quality, and calls the quality callback when
+// the quality changes
+
+func (session *Session) updateQuality() {
+	session.mutex.Lock()
+	if time.Since(session.qualityUpdateTime) < QualityUpdateInterval {
+		session.mutex.Unlock()
+		return
+	}
+	session.qualityUpdateTime = time.Now()
+	changed := session.connectionQuality.Update(session.pathStats.Stats())
+	quality, score := session.connectionQuality.Quality()
+	session.mutex.Unlock()
+
+	if changed {
+		if session.config.QualityCallback != nil {
+			session.config.QualityCallback(quality, score)
+		}
+	}
+}
+
+// sendStats sends the gateway a stats packet every stats interval while connected
+
+func (session *Session) sendStats() {
+
+	if session.config.StatsInterval <= 0 || session.GetState() != StateConnected {
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if time.Since(session.statsSendTime) < session.config.StatsInterval || session.disconnecting {
+		return
+	}
+	session.statsSendTime = time.Now()
+
+	stats := core.ClientStats{
+		FrameRate: core.GetFrameRateBucket(session.frameRate),
+		RTT:       session.pathStats.Stats().RTT,
+		Platform:  session.config.Platform,
+	}
+
+	payload := make([]byte, core.MinPayloadBytes)
+	core.WriteClientStats(payload, &stats)
+	session.sendPacket(core.ClientStatsPacket, core.UnreliableChannel, payload, core.PriorityNormal, false)
+}
+
+// disconnect sends a few disconnect packets in case some are lost, then closes the socket and any tunnels.
+// nothing else is sent once we start disconnecting, otherwise the gateway would challenge us again.
+// Close returns before the state callback is called, so the callback can call Close too
+
+func (session *Session) disconnect() {
+	session.mutex.Lock()
+	for i := 0; i < NumDisconnectPackets; i++ {
+		session.sendPacket(core.DisconnectPacket, core.UnreliableChannel, make([]byte, core.MinPayloadBytes), core.PriorityNormal, true)
+	}
+	session.disconnecting = true
+	if session.pacedSender != nil {
+		session.pacedSender.Close()
+	}
+	for _, path := range session.paths {
+		if path.tunnel != nil {
+			path.tunnel.Close()
+		}
+	}
+	session.mutex.Unlock()
+	session.conn.Close()
+	changed := session.updateState(StateDisconnected)
+	close(session.doneChannel)
+	if changed && session.config.StateCallback != nil {
+		session.config.StateCallback(StateDisconnected)
+	}
+}
+
+// failoverGateways are the gateways the first path goes through in order: the primary gateway, then the
+// fallback gateways other than the primary and multipath gateways
+
+func failoverGateways(gatewayAddress *net.UDPAddr, fallbackGateways []net.UDPAddr, multipathGatewayAddress *net.UDPAddr) []*net.UDPAddr {
+	gatewayAddresses := []*net.UDPAddr{gatewayAddress}
+	for i := range fallbackGateways {
+		fallbackGateway := &fallbackGateways[i]
+		if core.AddressEqual(fallbackGateway, gatewayAddress) || (multipathGatewayAddress != nil && core.AddressEqual(fallbackGateway, multipathGatewayAddress)) {
+			continue
+		}
+		gatewayAddresses = append(gatewayAddresses, fallbackGateway)
+	}
+	return gatewayAddresses
+}
+
+// switchGateway points the first path at a gateway in the failover list. the path starts over with the
+// new gateway, which challenges us before forwarding to the server, and a keep-alive goes to it straight
+// away. the caller must hold the session mutex
+
+func (session *Session) switchGateway(gatewayIndex int) {
+	path := session.paths[0]
+	session.gatewayIndex = gatewayIndex
+	session.failoverTime = time.Now()
+	path.gatewayAddress = session.gatewayAddresses[gatewayIndex]
+	path.route = nil
+	if gatewayIndex == 0 && session.route != nil {
+		path.gatewayAddress = &session.route.RelayAddress
+		path.route = session.route
+	}
+	path.receivedPacket = false
+	path.connectedToServer = false
+	path.hasChallengeToken = false
+	path.hasCookie = false
+	path.gatewayId = [core.GatewayIdBytes]byte{}
+	path.lastReceiveTime = time.Time{}
+	session.lastSendTime = time.Time{}
+	session.race = nil
+}
+
+// startRace sets up the race for the first path, against the first gateway in the failover list in the
+// other address family to the primary gateway. the caller must hold the session mutex
+
+func (session *Session) startRace() {
+
+	session.race = nil
+
+	first := session.paths[0]
+	if session.config.ConnectRaceDelay <= 0 || session.config.WebSocketURL != "" || first.tunnel != nil || first.route != nil {
+		return
+	}
+
+	for i := 1; i < len(session.gatewayAddresses); i++ {
+		if isIPv6(session.gatewayAddresses[i]) == isIPv6(session.gatewayAddresses[0]) {
+			continue
+		}
+		race := &path{gatewayAddress: session.gatewayAddresses[i], clientAddress: first.clientAddress}
+		race.sessionTokenData = make([]byte, core.EncryptedSessionTokenBytes)
+		copy(race.sessionTokenData, first.sessionTokenData)
+		race.sessionTokenSequence = first.sessionTokenSequence
+		race.sessionTokenExpireTime = first.sessionTokenExpireTime
+		session.race = race
+		session.raceIndex = i
+		session.raceTime = time.Now().Add(session.config.ConnectRaceDelay)
+		session.raceStarted = false
+		return
+	}
+}
+
+// updateRace starts sending to the gateway the first path is racing once the connect race delay is up,
+// with a keep-alive straight away
+
+func (session *Session) updateRace() {
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.race == nil || session.raceStarted || session.disconnecting || time.Now().Before(session.raceTime) {
+		return
+	}
+
+	core.Info("nothing received from %s for %s. racing %s", session.paths[0].gatewayAddress, session.config.ConnectRaceDelay, session.race.gatewayAddress)
+
+	session.raceStarted = true
+	session.sendPacket(core.KeepAlivePacket, core.UnreliableChannel, make([]byte, core.MinPayloadBytes), core.PriorityNormal, true)
+}
+
+// failover moves the first path on to the next gateway when nothing has been received from its gateway
+// for the failover timeout, while its session token is still valid
+
+func (session *Session) failover() {
+
+	if session.config.FailoverTimeout <= 0 || session.config.WebSocketURL != "" {
+		return
+	}
+
+	session.mutex.Lock()
+
+	path := session.paths[0]
+
+	lastReceiveTime := path.lastReceiveTime
+	if session.failoverTime.After(lastReceiveTime) {
+		lastReceiveTime = session.failoverTime
+	}
+
+	if len(session.gatewayAddresses) < 2 || path.tunnel != nil || session.disconnecting || session.fetchingConnectToken ||
+		path.sessionTokenExpireTime.Before(time.Now()) || time.Since(lastReceiveTime) < session.config.FailoverTimeout {
+		session.mutex.Unlock()
+		return
+	}
+
+	gatewayIndex := (session.gatewayIndex + 1) % len(session.gatewayAddresses)
+
+	core.Info("nothing received from %s for %s. failing over to %s", session.gatewayAddresses[session.gatewayIndex], session.config.FailoverTimeout, session.gatewayAddresses[gatewayIndex])
+
+	session.switchGateway(gatewayIndex)
+
+	reconnecting := true
+	for _, other := range session.paths {
+		if other.connectedToServer {
+			reconnecting = false
+		}
+	}
+
+	session.mutex.Unlock()
+
+	if reconnecting {
+		session.setState(StateConnecting)
+	}
+}
+
+// fetchConnectToken calls the config's FetchConnectToken without blocking the send loop, which starts the
+// session over with the connect token it returns. the caller must hold the session mutex
+
+func (session *Session) fetchConnectToken() {
+	if session.fetchingConnectToken || session.disconnecting || time.Since(session.fetchTime) < ConnectTokenRetryInterval {
+		return
+	}
+	session.fetchingConnectToken = true
+	session.fetchTime = time.Now()
+	go func() {
+		connectToken, err := session.config.FetchConnectToken()
+		if err != nil {
+			core.Error("could not fetch connect token: %v", err)
+			connectToken = nil
+		}
+		select {
+		case session.connectTokenChannel <- connectToken:
+		case <-session.doneChannel:
+		}
+	}()
+}
+
+// reconnect starts the session over with a new connect token: a new session id, keys and session token,
+// and the gateways in the new token. reliable messages not yet acked are sent again in the new session
+
+func (session *Session) reconnect(connectToken []byte) {
+
+	session.mutex.Lock()
+
+	session.fetchingConnectToken = false
+
+	if connectToken == nil || session.disconnecting {
+		session.mutex.Unlock()
+		return
+	}
+
+	index := 0
+	var connectData core.ConnectData
+	fallbackGateways, ok := core.ReadFallbackGateways(connectToken)
+	if len(connectToken) < core.ConnectTokenBytes || !ok || !core.ReadConnectData(connectToken, &index, &connectData) {
+		session.mutex.Unlock()
+		core.Error("fetched connect token is invalid")
+		return
+	}
+
+	session.gatewayPublicKey = connectData.GatewayPublicKey[:]
+	session.clientPrivateKey = connectData.ClientPrivateKey[:]
+	session.sessionId = connectData.ClientPublicKey[:]
+	session.sessionKeys = core.DeriveSessionKeys(core.SessionKey(session.gatewayPublicKey, session.clientPrivateKey), session.sessionId)
+
+	session.sendBandwidthBitsPerSecondMax = uint64(connectData.EnvelopeUpKbps * 1000)
+
+	for _, path := range session.paths {
+		copy(path.sessionTokenData[:], connectToken[core.ConnectDataBytes:core.ConnectTokenBytes])
+		path.sessionTokenSequence = 0
+		path.sessionTokenExpireTime = time.Unix(int64(connectData.ExpireTimestamp), 0)
+		path.connectedToServer = false
+		path.hasChallengeToken = false
+		path.gatewayId = [core.GatewayIdBytes]byte{}
+	}
+
+	// routes are bound to the session id, so they can't be used in the new session
+
+	session.route = nil
+	session.gatewayAddresses = failoverGateways(&connectData.GatewayAddress, fallbackGateways, session.config.MultipathGatewayAddress)
+	session.switchGateway(0)
+	session.startRace()
+
+	session.serverId = [core.ServerIdBytes]byte{}
+	session.receiveSequence = 0
+	session.receivedPackets = [SequenceBufferSize]uint64{}
+	session.ackedPackets = [SequenceBufferSize]uint64{}
+	for i := range session.sequenceToPayloadId {
+		session.sequenceToPayloadId[i] = ^uint64(0)
+	}
+	session.lastReceiveTime = time.Now()
+
+	session.reliableEndpoint.Reset()
+
+	core.Info("starting over with a new connect token. session id is %s, connecting to %s", core.IdString(session.sessionId), &connectData.GatewayAddress)
+
+	session.mutex.Unlock()
+
+	session.setState(StateConnecting)
+}
+
+func (session *Session) receiveLoop() {
+
+	for {
+
+		packetData := make([]byte, MaxPacketSize)
+
+		packetBytes, from, err := session.conn.ReadFromUDP(packetData)
+		if err != nil {
+			core.Debug("failed to read udp packet: %v", err)
+			break
+		}
+
+		pathIndex := -1
+		racing := false
+		session.mutex.Lock()
+		for i := range session.paths {
+			if core.AddressEqual(from, session.paths[i].gatewayAddress) {
+				pathIndex = i
+				break
+			}
+		}
+		if pathIndex < 0 && session.race != nil && core.AddressEqual(from, session.race.gatewayAddress) {
+			racing = true
+		}
+		session.mutex.Unlock()
+
+		if racing {
+			session.processRacePacket(packetData[:packetBytes])
+			continue
+		}
+
+		if pathIndex < 0 {
+			core.Debug("packet is not from gateway")
+			continue
+		}
+
+		session.processPacket(pathIndex, packetData[:packetBytes])
+	}
+}
+
+// webSocketFallback tunnels the first path over a websocket if nothing arrives from its gateway within
+// the handshake timeout, for networks that block udp entirely. it keeps trying until connected
+
+func (session *Session) webSocketFallback() {
+
+	timeout := session.config.UDPHandshakeTimeout
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+
+		select {
+		case <-timer.C:
+		case <-session.doneChannel:
+			return
+		}
+
+		session.mutex.Lock()
+		received := session.paths[0].receivedPacket
+		session.mutex.Unlock()
+
+		if received {
+			return
+		}
+
+		core.Info("nothing received for %s. connecting over websocket to %s", timeout, session.config.WebSocketURL)
+
+		conn, header, err := websocket.Dial(session.config.WebSocketURL, timeout)
+		if err != nil {
+			core.Error("could not connect over websocket: %v", err)
+			timer.Reset(timeout)
+			continue
+		}
+
+		clientAddress, err := net.ResolveUDPAddr("udp", header.Get(core.WebSocketClientAddressHeader))
+		if err != nil {
+			core.Error("invalid websocket client address: %v", err)
+			conn.Close()
+			timer.Reset(timeout)
+			continue
+		}
+
+		session.mutex.Lock()
+		if session.disconnecting {
+			session.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		if session.paths[0].tunnel != nil {
+			session.paths[0].tunnel.Close()
+		}
+		session.paths[0].tunnel = webSocketTunnel{conn}
+		session.paths[0].clientAddress = clientAddress
+		session.mutex.Unlock()
+
+		core.Info("connected over websocket to %s", session.config.WebSocketURL)
+
+		session.tunnelReceiveLoop(0, webSocketTunnel{conn})
+
+		return
+	}
+}
+
+func (session *Session) tunnelReceiveLoop(pathIndex int, packetTunnel packetTunnel) {
+	for {
+		packetData, err := packetTunnel.ReadPacket()
+		if err != nil {
+			core.Debug("failed to read tunnelled packet: %v", err)
+			break
+		}
+		if len(packetData) > MaxPacketSize {
+			core.Debug("packet is too large")
+			continue
+		}
+		session.processPacket(pathIndex, packetData)
+	}
+}
+
+// processPacket filters a packet from the gateway on the path, whether it came over udp or a tunnel
+
+func (session *Session) processPacket(pathIndex int, packetData []byte) {
+
+	session.mutex.Lock()
+	path := session.paths[pathIndex]
+	receivedPacket := path.receivedPacket
+	sessionKeys := session.sessionKeys
+	session.mutex.Unlock()
+
+	// version rejects are signed with the session keys, and only count while the primary gateway hasn't sent
+	// anything that got through the filter. an older gateway we can still speak to gets its version, otherwise
+	// the session ends
+
+	var gatewayVersion byte
+	if core.ReadVersionRejectPacket(packetData, &sessionKeys, &gatewayVersion) {
+		if pathIndex == 0 && !receivedPacket {
+			session.versionRejected(path, gatewayVersion)
+		}
+		return
+	}
+
+	// and so are cipher suite rejects
+
+	var gatewayCipherSuite byte
+	if core.ReadCipherSuiteRejectPacket(packetData, &sessionKeys, &gatewayCipherSuite) {
+		if pathIndex == 0 && !receivedPacket {
+			session.cipherSuiteRejected(path, gatewayCipherSuite)
+		}
+		return
+	}
+
+	// and so are cookies. the gateway sends a fresh one for any cookie it doesn't accept, so a forged cookie
+	// costs us at most one round trip
+
+	var cookie uint64
+	if core.ReadCookiePacket(packetData, &cookie) {
+		session.cookieReceived(path, cookie)
+		return
+	}
+
+	if !session.filterPacket(path, packetData) {
+		return
+	}
+
+	// the primary gateway answering first ends the race
+
+	session.mutex.Lock()
+	path.receivedPacket = true
+	if pathIndex == 0 && session.race != nil {
+		if session.raceStarted {
+			core.Info("%s answered first", path.gatewayAddress)
+		}
+		session.race = nil
+	}
+	session.mutex.Unlock()
+
+	switch packetData[core.VersionBytes] {
+	case core.PayloadPacket:
+		session.processPayloadPacket(pathIndex, packetData)
+	case core.ChallengePacket:
+		session.processChallengePacket(pathIndex, packetData)
+	}
+}
+
+// versionRejected falls back to the protocol version of a gateway that rejected ours, or closes the session
+// when there is no version both speak
+
+func (session *Session) versionRejected(path *path, gatewayVersion byte) {
+	session.mutex.Lock()
+	protocolVersion := core.PacketProtocolVersion(session.packetVersion)
+	if gatewayVersion == protocolVersion {
+		session.mutex.Unlock()
+		return
+	}
+	version, ok := core.NegotiateProtocolVersion(gatewayVersion)
+	if ok && version < protocolVersion {
+		core.Info("%s speaks protocol version %d. falling back to it", path.gatewayAddress, version)
+		session.packetVersion = core.PacketVersion(version, session.packetFilter)
+		if version < core.CipherSuiteProtocolVersion {
+			session.cipherSuite = core.CipherSuite_XChaCha20Poly1305
+		}
+	}
+	session.mutex.Unlock()
+	if !ok || version >= protocolVersion {
+		session.closeWithError(&core.ProtocolVersionError{GatewayAddress: path.gatewayAddress.String(), GatewayVersion: gatewayVersion, ProtocolVersion: protocolVersion})
+	}
+}
+
+// cipherSuiteRejected switches to the cipher suite a gateway wants instead of ours, or closes the session
+// when it isn't available here
+
+func (session *Session) cipherSuiteRejected(path *path, gatewayCipherSuite byte) {
+	session.mutex.Lock()
+	if gatewayCipherSuite == session.cipherSuite {
+		session.mutex.Unlock()
+		return
+	}
+	ok := core.CipherSuiteAvailable(gatewayCipherSuite)
+	if ok {
+		core.Info("%s wants cipher suite %s. switching to it", path.gatewayAddress, core.CipherSuiteName(gatewayCipherSuite))
+		session.cipherSuite = gatewayCipherSuite
+	}
+	session.mutex.Unlock()
+	if !ok {
+		session.closeWithError(&core.CipherSuiteError{GatewayAddress: path.gatewayAddress.String(), CipherSuite: gatewayCipherSuite})
+	}
+}
+
+// cookieReceived echoes a cookie from the gateway around every packet we send it, until it answers with payload
+
+func (session *Session) cookieReceived(path *path, cookie uint64) {
+	session.mutex.Lock()
+	if !path.hasCookie {
+		core.Info("%s requires a cookie. echoing it", path.gatewayAddress)
+	}
+	path.hasCookie = true
+	path.cookie = cookie
+	session.mutex.Unlock()
+}
+
+// closeWithError closes the session from inside, without waiting for it to finish closing
+
+func (session *Session) closeWithError(err error) {
+	session.mutex.Lock()
+	if session.err == nil {
+		session.err = err
+		core.Error("%v", err)
+	}
+	session.mutex.Unlock()
+	session.closeOnce.Do(func() {
+		close(session.closeChannel)
+	})
+}
+
+// processRacePacket processes a packet from the gateway the first path is racing. if it gets through
+// the filter before anything from the primary gateway, the racing gateway wins and the first path
+// carries on through it
+
+func (session *Session) processRacePacket(packetData []byte) {
+
+	session.mutex.Lock()
+	race := session.race
+	session.mutex.Unlock()
+
+	var cookie uint64
+	if race != nil && core.ReadCookiePacket(packetData, &cookie) {
+		session.cookieReceived(race, cookie)
+		return
+	}
+
+	if race == nil || !session.filterPacket(race, packetData) {
+		return
+	}
+
+	session.mutex.Lock()
+	if session.race != race {
+		session.mutex.Unlock()
+		return
+	}
+	core.Info("%s answered first. connecting through it instead of %s", race.gatewayAddress, session.paths[0].gatewayAddress)
+	session.paths[0] = race
+	session.gatewayIndex = session.raceIndex
+	session.failoverTime = time.Now()
+	session.race = nil
+	session.mutex.Unlock()
+
+	session.processPacket(0, packetData)
+}
+
+// filterPacket returns true if a packet passes the packet filters for the path
+
+func (session *Session) filterPacket(path *path, packetData []byte) bool {
+
+	packetBytes := len(packetData)
+
+	if packetBytes < core.PrefixBytes {
+		core.Debug("packet is too small")
+		return false
+	}
+
+	if !core.PacketVersionSupported(packetData[0], session.packetFilter) {
+		core.Debug("unknown packet version: %d", packetData[0])
+		return false
+	}
+
+	if packetData[1] != core.PayloadPacket && packetData[1] != core.ChallengePacket {
+		core.Debug("unknown packet type %d", packetData[1])
+		return false
+	}
+
+	// packet filter
+
+	if !core.BasicPacketFilter(packetData, packetBytes) {
+		core.Debug("basic packet filter failed")
+		return false
+	}
+
+	session.mutex.Lock()
+	gatewayAddress := path.gatewayAddress
+	clientAddress := path.clientAddress
+	session.mutex.Unlock()
+
+	var magic [8]byte
+
+	var fromAddressBuffer [core.MaxAddressDataBytes]byte
+	var fromAddressPort uint16
+
+	var toAddressBuffer [core.MaxAddressDataBytes]byte
+	var toAddressPort uint16
+
+	fromAddressData := fromAddressBuffer[:core.GetAddressData(gatewayAddress, fromAddressBuffer[:], &fromAddressPort)]
+	toAddressData := toAddressBuffer[:core.GetAddressData(clientAddress, toAddressBuffer[:], &toAddressPort)]
+
+	filterKey := session.config.FilterKey
+	if filterKey != nil {
+		if !core.AdvancedPacketFilterKeyed(packetData, filterKey, fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes) {
+			core.Debug("advanced packet filter failed")
+			return false
+		}
+	} else if !core.AdvancedPacketFilter(packetData, magic[:], fromAddressData[:], fromAddressPort, toAddressData[:], toAddressPort, packetBytes) {
+		core.Debug("advanced packet filter failed")
+		return false
+	}
+
+	return true
+}
+
+func (session *Session) processPayloadPacket(pathIndex int, packetData []byte) {
+
+	path := session.paths[pathIndex]
+
+	session.mutex.Lock()
+	gatewayAddress := path.gatewayAddress
+	sessionKeys := session.sessionKeys
+	cipherSuite := session.cipherSuite
+	expectedSessionId := session.sessionId
+	session.mutex.Unlock()
+
+	packetBytes := len(packetData)
+
+	core.Debug("received %d byte payload packet from gateway %s", packetBytes, gatewayAddress)
+
+	// session id must match client public key
+
+	sessionIdIndex := core.PrefixBytes
+
+	sessionId := packetData[sessionIdIndex : sessionIdIndex+core.SessionIdBytes]
+
+	if !core.IdEqual(sessionId, expectedSessionId) {
+		core.Debug("session id mismatch")
+		return
+	}
+
+	// decrypt packet
+
+	sequenceIndex := core.PrefixBytes + core.SessionIdBytes
+	encryptedDataIndex := sequenceIndex + core.SequenceBytes
+
+	sequenceData := packetData[sequenceIndex : sequenceIndex+core.SequenceBytes]
+	encryptedData := packetData[encryptedDataIndex : packetBytes-core.PittleBytes]
+
+	index := 0
+	pathSequence := uint64(0)
+	core.ReadUint64(sequenceData, &index, &pathSequence)
+
+	if core.SequencePath(pathSequence) != pathIndex {
+		core.Debug("packet sequence is for another path")
+		return
+	}
+
+	err := core.DecryptPayload(cipherSuite, sessionKeys.GatewayToClient[:], pathSequence, core.NonceFlags_GatewayToClient, encryptedData, len(encryptedData))
+	if err != nil {
+		core.Debug("could not decrypt payload packet")
+		return
+	}
+
+	sequence := core.SessionSequence(pathSequence)
+
+	// split decrypted packet into various pieces
+
+	headerIndex := core.PrefixBytes
+
+	payloadIndex := headerIndex + core.HeaderBytes
+	payloadBytes := packetBytes - payloadIndex - core.PostfixBytes
+
+	header := packetData[headerIndex : headerIndex+core.HeaderBytes]
+
+	payload := packetData[payloadIndex : payloadIndex+payloadBytes]
+
+	// check encrypted packet type matches
+
+	packetType := header[core.SessionIdBytes+core.SequenceBytes+core.AckBytes+core.AckBitsBytes+core.GatewayIdBytes+core.ServerIdBytes]
+	if packetType != core.PayloadPacket && packetType != core.KeepAlivePacket && packetType != core.MTUProbePacket {
+		core.Debug("packet type mismatch: %d", packetType)
+		return
+	}
+
+	channelId := header[core.SessionIdBytes+core.SequenceBytes+core.AckBytes+core.AckBitsBytes+core.GatewayIdBytes+core.ServerIdBytes+core.PacketTypeBytes+core.FlagsBytes]
+	if channelId != core.UnreliableChannel && channelId != core.ReliableChannel {
+		core.Debug("unknown channel: %d", channelId)
+		return
+	}
+
+	var receivedPayload []byte
+	var payloadAcks []uint64
+
+	session.mutex.Lock()
+
+	session.lastReceiveTime = time.Now()
+	session.refetched = false
+	path.lastReceiveTime = time.Now()
+	path.hasCookie = false
+
+	// packet sequence must not be too old
+
+	if session.receiveSequence > OldSequenceThreshold && sequence < session.receiveSequence-OldSequenceThreshold {
+		session.mutex.Unlock()
+		core.Debug("packet sequence is too old: %d", sequence)
+		return
+	}
+
+	if sequence > session.receiveSequence {
+		session.receiveSequence = sequence
+		session.receiveSequenceTime = time.Now()
+	}
+
+	// the server sends payloads over every path, so only process the first copy to arrive
+
+	duplicate := session.receivedPackets[sequence%SequenceBufferSize] == sequence
+	if duplicate {
+		session.duplicatePacketsReceived++
+	}
+
+	session.receivedPackets[sequence%SequenceBufferSize] = sequence
+
+	// update session token if the gateway has a newer one
+
+	sessionTokenDataIndex := core.VersionBytes + core.PacketTypeBytes + core.ChonkleBytes
+	sessionTokenSequenceIndex := sessionTokenDataIndex + core.EncryptedSessionTokenBytes
+
+	index = sessionTokenSequenceIndex
+	var packetSessionTokenSequence uint64
+	core.ReadUint64(packetData, &index, &packetSessionTokenSequence)
+
+	if packetSessionTokenSequence > path.sessionTokenSequence {
+		core.Info("updated session token %d", packetSessionTokenSequence)
+		copy(path.sessionTokenData[:], packetData[sessionTokenDataIndex:sessionTokenDataIndex+core.EncryptedSessionTokenBytes])
+		path.sessionTokenSequence = packetSessionTokenSequence
+		path.sessionTokenExpireTime = time.Now().Add(time.Second * core.ConnectTokenExpireSeconds)
+	}
+
+	// process payload packet
+
+	if duplicate {
+		core.Debug("packet %d is a duplicate", sequence)
+	} else if packetType == core.PayloadPacket && channelId == core.ReliableChannel {
+		if err := session.reliableEndpoint.ProcessPacket(payload); err != nil {
+			core.Debug("could not process reliable packet: %v", err)
+		}
+	} else if packetType == core.PayloadPacket {
+		core.Debug("payload is %d bytes", len(payload))
+		receivedPayload = payload
+	} else if packetType == core.MTUProbePacket {
+		index := 0
+		var probeBytes uint16
+		if core.ReadUint16(payload, &index, &probeBytes) {
+			previousMTU := session.pathMTU.GetMTU()
+			session.pathMTU.ProbeAcked(int(probeBytes), time.Now())
+			if session.pathMTU.GetMTU() != previousMTU {
+				core.Info("path mtu is %d bytes", session.pathMTU.GetMTU())
+			}
+		}
+	} else {
+		core.Debug("received keep-alive")
+	}
+
+	// process acks
+
+	packet_ack := uint64(0)
+	packet_ack_bits := [core.AckBitsBytes]byte{}
+
+	index = core.SessionIdBytes + core.SequenceBytes
+	core.ReadUint64(header, &index, &packet_ack)
+	core.ReadBytes(header, &index, packet_ack_bits[:], core.AckBitsBytes)
+
+	core.Debug("recv packet sequence = %d", sequence)
+	core.Debug("recv packet ack = %d", packet_ack)
+	core.Debug("recv packet ack_bits = %x", packet_ack_bits)
+
+	index = core.HeaderBytes - core.AckDelayBytes
+	var packetAckDelay uint32
+	core.ReadUint32(header, &index, &packetAckDelay)
+
+	packet_ack = core.SessionSequence(packet_ack)
+
+	if rtt, ok := session.pathStats.ProcessAcks(packet_ack, packet_ack_bits[:], time.Duration(packetAckDelay)*time.Microsecond, time.Now()); ok {
+		session.pacer.SetRTT(rtt)
+	}
+
+	acks := core.ProcessAcks(packet_ack, packet_ack_bits[:], session.ackedPackets[:], session.ackBuffer[:])
+
+	for i := range acks {
+		core.Debug("ack packet %d", acks[i])
+		session.ackedPackets[acks[i]%SequenceBufferSize] = acks[i]
+		payloadAck := session.sequenceToPayloadId[acks[i]%SequenceBufferSize]
+		if payloadAck != ^uint64(0) {
+			payloadAcks = append(payloadAcks, payloadAck)
+		}
+	}
+
+	// check if we have a new gateway
+
+	gatewayIdIndex := sessionIdIndex + core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes
+
+	packetGatewayId := packetData[gatewayIdIndex : gatewayIdIndex+core.GatewayIdBytes]
+
+	if !core.IdEqual(packetGatewayId, path.gatewayId[:]) {
+		core.Info("connected to gateway %s at %s", core.IdString(packetGatewayId), path.gatewayAddress)
+		copy(path.gatewayId[:], packetGatewayId[:])
+	}
+
+	// check if we have a new server
+
+	serverIdIndex := gatewayIdIndex + core.GatewayIdBytes
+
+	packetServerId := packetData[serverIdIndex : serverIdIndex+core.ServerIdBytes]
+
+	if !core.IdEqual(packetServerId, session.serverId[:]) {
+		core.Info("connected to server %s", core.IdString(packetServerId))
+		copy(session.serverId[:], packetServerId[:])
+	}
+
+	// clear challenge token
+
+	if path.hasChallengeToken {
+		core.Debug("cleared challenge token")
+		path.hasChallengeToken = false
+	}
+
+	path.connectedToServer = true
+
+	session.mutex.Unlock()
+
+	// callbacks are called without the session mutex held, so they can send
+
+	session.setState(StateConnected)
+
+	if receivedPayload != nil && session.config.ReceiveCallback != nil {
+		session.config.ReceiveCallback(receivedPayload)
+	}
+
+	if session.config.AckCallback != nil {
+		for _, payloadAck := range payloadAcks {
+			session.config.AckCallback(payloadAck)
+		}
+	}
+
+	for {
+		message := session.reliableEndpoint.ReceiveMessage()
+		if message == nil {
+			break
+		}
+		if session.config.MessageCallback != nil {
+			session.config.MessageCallback(message)
+		}
+	}
+}
+
+func (session *Session) processChallengePacket(pathIndex int, packetData []byte) {
+
+	path := session.paths[pathIndex]
+
+	session.mutex.Lock()
+	gatewayAddress := path.gatewayAddress
+	gatewayPublicKey := session.gatewayPublicKey
+	clientPrivateKey := session.clientPrivateKey
+	sessionKeys := session.sessionKeys
+	session.mutex.Unlock()
+
+	core.Debug("received %d byte challenge packet from gateway %s", len(packetData), gatewayAddress)
+
+	if len(packetData) != core.ChallengePacketBytes {
+		core.Debug("bad challenge packet size: got %d, expected %d", len(packetData), core.ChallengePacketBytes)
+		return
+	}
+
+	nonceIndex := core.VersionBytes + core.PacketTypeBytes + core.ChonkleBytes + core.EncryptedSessionTokenBytes + core.SequenceBytes
+
+	encryptedDataIndex := nonceIndex + core.NonceBytes_Box
+
+	encryptedData := packetData[encryptedDataIndex:]
+
+	nonce := packetData[nonceIndex : nonceIndex+core.NonceBytes_Box]
+
+	err := core.Decrypt_Box(gatewayPublicKey, clientPrivateKey, nonce, encryptedData, len(encryptedData)-core.PittleBytes)
+	if err != nil {
+		core.Debug("could not decrypt challenge packet")
+		return
+	}
+
+	packetChallengeTokenData := packetData[encryptedDataIndex : encryptedDataIndex+core.EncryptedChallengeTokenBytes]
+
+	packetChallengeSequence := uint64(0)
+	index := encryptedDataIndex + core.EncryptedChallengeTokenBytes
+	core.ReadUint64(packetData, &index, &packetChallengeSequence)
+
+	var packetGatewayId [core.GatewayIdBytes]byte
+	core.ReadBytes(packetData, &index, packetGatewayId[:], core.GatewayIdBytes)
+
+	if !core.VerifyKeyConfirmation(&sessionKeys, packetChallengeSequence, packetData[index:index+core.KeyConfirmationBytes]) {
+		core.Debug("challenge packet key confirmation failed")
+		return
+	}
+
+	// the session is connecting again once no path is connected to the server
+
+	reconnecting := false
+
+	session.mutex.Lock()
+
+	if !path.hasChallengeToken || path.challengeTokenSequence < packetChallengeSequence {
+		if path.connectedToServer {
+			core.Info("reconnecting to %s...", path.gatewayAddress)
+			path.connectedToServer = false
+			reconnecting = true
+			for _, other := range session.paths {
+				if other.connectedToServer {
+					reconnecting = false
+				}
+			}
+		}
+		path.hasChallengeToken = true
+		copy(path.challengeTokenData[:], packetChallengeTokenData)
+		path.challengeTokenSequence = packetChallengeSequence
+		path.challengeTokenExpireTimestamp = uint64(time.Now().Unix()) + 2
+		copy(path.challengeTokenGatewayId[:], packetGatewayId[:])
+		core.Debug("updated challenge token: %d", packetChallengeSequence)
+	}
+
+	session.mutex.Unlock()
+
+	if reconnecting {
+		session.setState(StateConnecting)
+	}
+}
@@ -0,0 +1,692 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestToken(t *testing.T, gatewayAddress *net.UDPAddr) []byte {
+	connectToken, _ := createTestTokenWithGatewayKey(t, gatewayAddress)
+	return connectToken
+}
+
+func createTestTokenWithGatewayKey(t *testing.T, gatewayAddress *net.UDPAddr) ([]byte, []byte) {
+	gatewayPublicKey, gatewayPrivateKey := core.Keygen_Box()
+	_, authPrivateKey := core.Keygen_Sign()
+	var userId [core.UserIdBytes]byte
+	connectToken := core.GenerateConnectToken(userId[:], 2500, 10000, 100, 0, 0, core.ConnectTokenExpireSeconds, gatewayAddress, gatewayPublicKey, authPrivateKey)
+	assert.Equal(t, core.ConnectTokenBytes, len(connectToken))
+	return connectToken, gatewayPrivateKey
+}
+
+// gatewaySessionKeys derives the session keys the gateway would from a client packet
+func gatewaySessionKeys(t *testing.T, packetData []byte, gatewayPrivateKey []byte) core.SessionKeys {
+	var clientPacket core.ClientPacket
+	assert.True(t, core.ReadClientPacket(packetData, &clientPacket))
+	return core.DeriveSessionKeys(core.SessionKey(clientPacket.SessionId, gatewayPrivateKey), clientPacket.SessionId)
+}
+
+func createTestGateway(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+	assert.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func createTestConfig() Config {
+	config := DefaultConfig()
+	config.BindAddress = "127.0.0.1:0"
+	config.ClientAddress = core.ParseAddress("127.0.0.1:30000")
+	return config
+}
+
+func TestState(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "connecting", StateConnecting.String())
+	assert.Equal(t, "connected", StateConnected.String())
+	assert.Equal(t, "disconnected", StateDisconnected.String())
+	assert.Equal(t, "unknown(10)", State(10).String())
+}
+
+func TestConnectInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	connectToken := createTestToken(t, gateway.LocalAddr().(*net.UDPAddr))
+
+	_, err := Connect(connectToken[:10], createTestConfig())
+	assert.NotNil(t, err)
+
+	config := createTestConfig()
+	config.ClientAddress = nil
+	_, err = Connect(connectToken, config)
+	assert.NotNil(t, err)
+
+	config = createTestConfig()
+	config.FilterKey = make([]byte, 3)
+	_, err = Connect(connectToken, config)
+	assert.NotNil(t, err)
+
+	config = createTestConfig()
+	config.MultipathGatewayAddress = gateway.LocalAddr().(*net.UDPAddr)
+	_, err = Connect(connectToken, config)
+	assert.NotNil(t, err)
+
+	config = createTestConfig()
+	config.WebSocketURL = "ws://127.0.0.1:40002"
+	config.UDPHandshakeTimeout = 0
+	_, err = Connect(connectToken, config)
+	assert.NotNil(t, err)
+
+	config = createTestConfig()
+	config.QUICGatewayAddress = "127.0.0.1:40004"
+	config.DTLSGatewayAddress = "127.0.0.1:40005"
+	_, err = Connect(connectToken, config)
+	assert.NotNil(t, err)
+}
+
+func TestSession(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	states := make(chan State, 10)
+
+	config := createTestConfig()
+	config.StateCallback = func(state State) {
+		states <- state
+	}
+
+	session, err := Connect(createTestToken(t, gateway.LocalAddr().(*net.UDPAddr)), config)
+	assert.Nil(t, err)
+	assert.Equal(t, StateConnecting, session.GetState())
+	assert.Equal(t, 1, session.GetNumPaths())
+
+	// payloads of the minimum size go in one packet, everything else is fragmented
+
+	assert.Nil(t, session.Send(make([]byte, core.MinPayloadBytes)))
+	assert.Nil(t, session.Send(make([]byte, 10)))
+	assert.Nil(t, session.Send(make([]byte, 3000)))
+	assert.NotNil(t, session.Send(nil))
+	assert.NotNil(t, session.Send(make([]byte, MaxPayloadBytes+1)))
+
+	packetData := make([]byte, MaxPacketSize)
+	for i := 0; i < 5; i++ {
+		packetBytes, _, err := gateway.ReadFromUDP(packetData)
+		assert.Nil(t, err)
+		assert.Equal(t, core.MinPacketSize, packetBytes)
+		assert.Equal(t, core.PreferredCipherSuite(), packetData[1])
+		assert.True(t, core.BasicPacketFilter(packetData, packetBytes))
+	}
+
+	session.Close()
+	session.Close()
+
+	assert.Equal(t, StateDisconnected, <-states)
+	assert.Equal(t, StateDisconnected, session.GetState())
+	assert.NotNil(t, session.Send(make([]byte, core.MinPayloadBytes)))
+	assert.NotNil(t, session.SendMessage([]byte("hello")))
+}
+
+func TestSessionPreferIPv6(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	ipv6Gateway, err := net.ListenUDP("udp", core.ParseAddress("[::1]:0"))
+	if err != nil {
+		t.Skip("no ipv6 loopback")
+	}
+	defer ipv6Gateway.Close()
+
+	// mtu probes, which are larger than any other packet, go over the preferred path only. the primary
+	// gateway is preferred by default, and the ipv6 gateway with PreferIPv6
+
+	for _, preferIPv6 := range []bool{false, true} {
+
+		config := createTestConfig()
+		config.BindAddress = ":0"
+		config.MultipathGatewayAddress = ipv6Gateway.LocalAddr().(*net.UDPAddr)
+		config.PreferIPv6 = preferIPv6
+
+		session, err := Connect(createTestToken(t, gateway.LocalAddr().(*net.UDPAddr)), config)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, session.GetNumPaths())
+
+		preferred, other := gateway, ipv6Gateway
+		if preferIPv6 {
+			preferred, other = ipv6Gateway, gateway
+		}
+
+		packetData := make([]byte, MaxPacketSize)
+		preferred.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			packetBytes, _, err := preferred.ReadFromUDP(packetData)
+			assert.Nil(t, err)
+			if err != nil || packetBytes > core.MinPacketSize {
+				break
+			}
+		}
+
+		other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		for {
+			packetBytes, _, err := other.ReadFromUDP(packetData)
+			if err != nil {
+				break
+			}
+			assert.Equal(t, core.MinPacketSize, packetBytes)
+		}
+
+		session.Close()
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	states := make(chan State, 10)
+
+	config := createTestConfig()
+	config.IdleTimeout = 200 * time.Millisecond
+	config.StateCallback = func(state State) {
+		states <- state
+	}
+
+	session, err := Connect(createTestToken(t, gateway.LocalAddr().(*net.UDPAddr)), config)
+	assert.Nil(t, err)
+
+	select {
+	case state := <-states:
+		assert.Equal(t, StateDisconnected, state)
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not time out")
+	}
+
+	session.Close()
+}
+
+func TestSessionFailover(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	fallbackGateway := createTestGateway(t)
+	defer fallbackGateway.Close()
+
+	// the primary gateway never answers, so the session fails over to the fallback gateway with the same token
+
+	config := createTestConfig()
+	config.FailoverTimeout = 500 * time.Millisecond
+
+	connectToken := core.AppendFallbackGateways(createTestToken(t, gateway.LocalAddr().(*net.UDPAddr)), []*net.UDPAddr{fallbackGateway.LocalAddr().(*net.UDPAddr)})
+
+	session, err := Connect(connectToken, config)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	packetData := make([]byte, MaxPacketSize)
+	packetBytes, _, err := fallbackGateway.ReadFromUDP(packetData)
+	assert.Nil(t, err)
+	assert.True(t, core.BasicPacketFilter(packetData, packetBytes))
+	assert.Equal(t, StateConnecting, session.GetState())
+}
+
+func TestSessionVersionReject(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	states := make(chan State, 10)
+
+	config := createTestConfig()
+	config.StateCallback = func(state State) {
+		states <- state
+	}
+
+	connectToken, gatewayPrivateKey := createTestTokenWithGatewayKey(t, gateway.LocalAddr().(*net.UDPAddr))
+	session, err := Connect(connectToken, config)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	packetData := make([]byte, MaxPacketSize)
+	packetBytes, from, err := gateway.ReadFromUDP(packetData)
+	assert.Nil(t, err)
+
+	assert.Equal(t, core.PacketVersion_FNV1a, packetData[0])
+
+	keys := gatewaySessionKeys(t, packetData[:packetBytes], gatewayPrivateKey)
+
+	// a reject that wasn't sent with the session keys is ignored
+
+	otherKeys := core.DeriveSessionKeys(core.RandomBytes(core.SessionKeyBytes), keys.Confirmation[:])
+	rejectData := make([]byte, core.VersionRejectPacketBytes)
+	session.processPacket(0, rejectData[:core.WriteVersionRejectPacket(rejectData, core.PacketVersion(core.MinProtocolVersion, core.PacketFilter_FNV1a), &otherKeys)])
+	session.mutex.Lock()
+	assert.Equal(t, core.PacketVersion_FNV1a, session.packetVersion)
+	session.mutex.Unlock()
+
+	// a reject for the version the client speaks is ignored, and one from an older gateway falls back to its version
+
+	gateway.WriteToUDP(rejectData[:core.WriteVersionRejectPacket(rejectData, core.PacketVersion_FNV1a, &keys)], from)
+	gateway.WriteToUDP(rejectData[:core.WriteVersionRejectPacket(rejectData, core.PacketVersion(core.MinProtocolVersion, core.PacketFilter_FNV1a), &keys)], from)
+
+	for packetData[0] != core.PacketVersion(core.MinProtocolVersion, core.PacketFilter_FNV1a) {
+		_, _, err = gateway.ReadFromUDP(packetData)
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+
+	// versions before cipher suites only speak xchacha20poly1305
+
+	assert.Equal(t, core.CipherSuite_XChaCha20Poly1305, packetData[1])
+	assert.Equal(t, core.CipherSuite_XChaCha20Poly1305, session.GetCipherSuite())
+
+	// one from a newer gateway that doesn't speak the client's version closes the session
+
+	gateway.WriteToUDP(rejectData[:core.WriteVersionRejectPacket(rejectData, core.PacketVersion(core.ProtocolVersion+1, core.PacketFilter_FNV1a), &keys)], from)
+
+	select {
+	case state := <-states:
+		assert.Equal(t, StateDisconnected, state)
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not close")
+	}
+
+	versionError, ok := session.GetError().(*core.ProtocolVersionError)
+	assert.True(t, ok)
+	assert.Equal(t, core.ProtocolVersion+1, versionError.GatewayVersion)
+	assert.Equal(t, gateway.LocalAddr().String(), versionError.GatewayAddress)
+}
+
+func TestSessionCipherSuiteReject(t *testing.T) {
+
+	t.Parallel()
+
+	if !core.CipherSuiteAvailable(core.CipherSuite_AES256GCM) {
+		t.Skip("aes256gcm is not available on this machine")
+	}
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	states := make(chan State, 10)
+
+	config := createTestConfig()
+	config.StateCallback = func(state State) {
+		states <- state
+	}
+
+	connectToken, gatewayPrivateKey := createTestTokenWithGatewayKey(t, gateway.LocalAddr().(*net.UDPAddr))
+	session, err := Connect(connectToken, config)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	packetData := make([]byte, MaxPacketSize)
+	packetBytes, from, err := gateway.ReadFromUDP(packetData)
+	assert.Nil(t, err)
+
+	assert.Equal(t, core.CipherSuite_AES256GCM, packetData[1])
+	assert.Equal(t, core.CipherSuite_AES256GCM, session.GetCipherSuite())
+
+	keys := gatewaySessionKeys(t, packetData[:packetBytes], gatewayPrivateKey)
+
+	// a reject that wasn't sent with the session keys is ignored
+
+	otherKeys := core.DeriveSessionKeys(core.RandomBytes(core.SessionKeyBytes), keys.Confirmation[:])
+	rejectData := make([]byte, core.CipherSuiteRejectPacketBytes)
+	session.processPacket(0, rejectData[:core.WriteCipherSuiteRejectPacket(rejectData, core.PacketVersion_FNV1a, core.CipherSuite_XChaCha20Poly1305, &otherKeys)])
+	assert.Equal(t, core.CipherSuite_AES256GCM, session.GetCipherSuite())
+
+	// a gateway that doesn't accept aes256gcm gets xchacha20poly1305 instead
+
+	gateway.WriteToUDP(rejectData[:core.WriteCipherSuiteRejectPacket(rejectData, core.PacketVersion_FNV1a, core.CipherSuite_XChaCha20Poly1305, &keys)], from)
+
+	for packetData[1] != core.CipherSuite_XChaCha20Poly1305 {
+		_, _, err = gateway.ReadFromUDP(packetData)
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+	assert.Equal(t, core.CipherSuite_XChaCha20Poly1305, session.GetCipherSuite())
+
+	// one wanting a cipher suite the client doesn't have closes the session
+
+	gateway.WriteToUDP(rejectData[:core.WriteCipherSuiteRejectPacket(rejectData, core.PacketVersion_FNV1a, 99, &keys)], from)
+
+	select {
+	case state := <-states:
+		assert.Equal(t, StateDisconnected, state)
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not close")
+	}
+
+	cipherSuiteError, ok := session.GetError().(*core.CipherSuiteError)
+	assert.True(t, ok)
+	assert.Equal(t, byte(99), cipherSuiteError.CipherSuite)
+	assert.Equal(t, gateway.LocalAddr().String(), cipherSuiteError.GatewayAddress)
+}
+
+func TestSessionCookie(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	session, err := Connect(createTestToken(t, gateway.LocalAddr().(*net.UDPAddr)), createTestConfig())
+	assert.Nil(t, err)
+	defer session.Close()
+
+	packetData := make([]byte, MaxPacketSize+core.CookieEchoHeaderBytes)
+	packetBytes, from, err := gateway.ReadFromUDP(packetData)
+	assert.Nil(t, err)
+	assert.NotEqual(t, core.CookieEchoPacket, packetData[core.VersionBytes])
+	clientPacketBytes := packetBytes
+
+	// a gateway requiring cookies gets the cookie echoed around every packet after it
+
+	cookieData := make([]byte, core.CookiePacketBytes)
+	gateway.WriteToUDP(cookieData[:core.WriteCookiePacket(cookieData, core.PacketVersion_FNV1a, 0x1122334455667788)], from)
+
+	for packetData[core.VersionBytes] != core.CookieEchoPacket {
+		packetBytes, _, err = gateway.ReadFromUDP(packetData)
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+
+	var cookie uint64
+	echoedPacketData, ok := core.ReadCookieEchoPacket(packetData[:packetBytes], &cookie)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0x1122334455667788), cookie)
+	assert.Equal(t, clientPacketBytes, len(echoedPacketData))
+	assert.Equal(t, session.GetCipherSuite(), echoedPacketData[1])
+}
+
+// writeTestChallengePacket writes a challenge packet that gets through the client's packet filter, but
+// doesn't decrypt
+
+func writeTestChallengePacket(from *net.UDPAddr, to *net.UDPAddr) []byte {
+	packetData := make([]byte, core.ChallengePacketBytes)
+	packetData[0] = core.PacketVersion_FNV1a
+	packetData[1] = core.ChallengePacket
+	var magic [core.MagicBytes]byte
+	var fromAddressData [core.MaxAddressDataBytes]byte
+	var toAddressData [core.MaxAddressDataBytes]byte
+	var fromPort, toPort uint16
+	fromAddressBytes := core.GetAddressData(from, fromAddressData[:], &fromPort)
+	toAddressBytes := core.GetAddressData(to, toAddressData[:], &toPort)
+	core.GenerateChonkle(packetData[2:2+core.ChonkleBytes], magic[:], fromAddressData[:fromAddressBytes], fromPort, toAddressData[:toAddressBytes], toPort, len(packetData))
+	core.GeneratePittle(packetData[len(packetData)-core.PittleBytes:], fromAddressData[:fromAddressBytes], fromPort, toAddressData[:toAddressBytes], toPort, len(packetData))
+	return packetData
+}
+
+func TestSessionConnectRace(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	ipv6Gateway, err := net.ListenUDP("udp", core.ParseAddress("[::1]:0"))
+	if err != nil {
+		t.Skip("no ipv6 loopback")
+	}
+	defer ipv6Gateway.Close()
+	ipv6Gateway.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the primary gateway never answers, so the ipv6 gateway in the connect token is raced after the
+	// connect race delay, well before failover, and wins when it answers
+
+	config := createTestConfig()
+	config.BindAddress = ":0"
+	config.KeepAliveInterval = 100 * time.Millisecond
+	config.MTUProbeInterval = 0
+	config.ConnectRaceDelay = 200 * time.Millisecond
+	config.FailoverTimeout = 10 * time.Second
+
+	connectToken := core.AppendFallbackGateways(createTestToken(t, gateway.LocalAddr().(*net.UDPAddr)), []*net.UDPAddr{ipv6Gateway.LocalAddr().(*net.UDPAddr)})
+
+	start := time.Now()
+	session, err := Connect(connectToken, config)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	packetData := make([]byte, MaxPacketSize)
+	packetBytes, from, err := ipv6Gateway.ReadFromUDP(packetData)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, core.BasicPacketFilter(packetData, packetBytes))
+	assert.True(t, time.Since(start) >= config.ConnectRaceDelay)
+
+	_, err = ipv6Gateway.WriteToUDP(writeTestChallengePacket(ipv6Gateway.LocalAddr().(*net.UDPAddr), config.ClientAddress), from)
+	assert.Nil(t, err)
+
+	// once the ipv6 gateway has won, nothing more goes to the primary gateway
+
+	time.Sleep(100 * time.Millisecond)
+
+	gateway.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		if _, _, err := gateway.ReadFromUDP(packetData); err != nil {
+			break
+		}
+	}
+
+	gateway.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err = gateway.ReadFromUDP(packetData)
+	assert.NotNil(t, err)
+
+	ipv6Gateway.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err = ipv6Gateway.ReadFromUDP(packetData)
+	assert.Nil(t, err)
+}
+
+func TestSessionFetchConnectToken(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	otherGateway := createTestGateway(t)
+	defer otherGateway.Close()
+
+	// instead of disconnecting on idle timeout, the session starts over with a fetched connect token
+
+	connectToken := createTestToken(t, otherGateway.LocalAddr().(*net.UDPAddr))
+
+	config := createTestConfig()
+	config.IdleTimeout = 200 * time.Millisecond
+	config.FetchConnectToken = func() ([]byte, error) {
+		return connectToken, nil
+	}
+
+	session, err := Connect(createTestToken(t, gateway.LocalAddr().(*net.UDPAddr)), config)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	packetData := make([]byte, MaxPacketSize)
+	packetBytes, _, err := otherGateway.ReadFromUDP(packetData)
+	assert.Nil(t, err)
+	assert.True(t, core.BasicPacketFilter(packetData, packetBytes))
+
+	index := 0
+	var connectData core.ConnectData
+	core.ReadConnectData(connectToken, &index, &connectData)
+	assert.Equal(t, connectData.ClientPublicKey[:], session.GetSessionId())
+}
+
+func TestSessionPacing(t *testing.T) {
+
+	t.Parallel()
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	// a large payload is fragmented into a burst of packets, more than the pacer lets go back to back
+
+	config := createTestConfig()
+	config.MTUProbeInterval = 0
+	config.PacingKbps = 500
+
+	session, err := Connect(createTestToken(t, gateway.LocalAddr().(*net.UDPAddr)), config)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	payload := make([]byte, 20000)
+	fragments, err := core.FragmentPayload(0, payload, core.PayloadBytesFromPacket(session.GetMTU()))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	assert.Nil(t, session.Send(payload))
+
+	packetData := make([]byte, MaxPacketSize)
+	for i := 0; i < len(fragments); i++ {
+		_, _, err := gateway.ReadFromUDP(packetData)
+		assert.Nil(t, err)
+		if err != nil {
+			break
+		}
+	}
+
+	// there is no rtt yet, so the burst is spread over the default maximum delay
+
+	assert.True(t, time.Since(start) >= core.PacerDefaultMaxDelay)
+}
+
+func TestSessionWebSocketFallback(t *testing.T) {
+
+	t.Parallel()
+
+	// the gateway never answers over udp, so the session falls back to the websocket
+
+	gateway := createTestGateway(t)
+	defer gateway.Close()
+
+	gatewayAddress := gateway.LocalAddr().(*net.UDPAddr)
+	relayAddress := core.ParseAddress("127.0.0.1:31000")
+
+	messages := make(chan []byte, 100)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := http.Header{}
+		header.Set(core.WebSocketClientAddressHeader, relayAddress.String())
+		conn, err := websocket.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- message
+		}
+	}))
+	defer server.Close()
+
+	config := createTestConfig()
+	config.WebSocketURL = "ws" + strings.TrimPrefix(server.URL, "http")
+	config.UDPHandshakeTimeout = 100 * time.Millisecond
+
+	session, err := Connect(createTestToken(t, gatewayAddress), config)
+	assert.Nil(t, err)
+
+	var packetData []byte
+	timeout := time.After(5 * time.Second)
+	for packetData == nil {
+		assert.Nil(t, session.Send(make([]byte, core.MinPayloadBytes)))
+		select {
+		case packetData = <-messages:
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("nothing sent over websocket")
+		}
+	}
+
+	// packets over the websocket are filtered against the relay address the gateway sees them from
+
+	var magic [core.MagicBytes]byte
+	var fromAddressBuffer, toAddressBuffer [core.MaxAddressDataBytes]byte
+	var fromAddressPort, toAddressPort uint16
+	fromAddressData := fromAddressBuffer[:core.GetAddressData(relayAddress, fromAddressBuffer[:], &fromAddressPort)]
+	toAddressData := toAddressBuffer[:core.GetAddressData(gatewayAddress, toAddressBuffer[:], &toAddressPort)]
+
+	assert.Equal(t, core.MinPacketSize, len(packetData))
+	assert.Equal(t, core.PreferredCipherSuite(), packetData[1])
+	assert.True(t, core.AdvancedPacketFilter(packetData, magic[:], fromAddressData, fromAddressPort, toAddressData, toAddressPort, len(packetData)))
+
+	// closing the session closes the websocket
+
+	session.Close()
+
+	for {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("websocket was not closed")
+		}
+	}
+}
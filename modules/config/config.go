@@ -0,0 +1,384 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/networknext/udpx/modules/envvar"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is configuration read from a YAML, JSON or env file, with environment variables taking precedence over
+// the file. Nested keys are flattened to environment variable names, so rate_limit: {burst: 100} in a file is
+// the same setting as RATE_LIMIT_BURST.
+type Config struct {
+	path   string
+	values map[string]string
+	keys   map[string]string
+}
+
+// Load reads a config file. Files ending in .json are read as JSON, .yaml and .yml as YAML, and anything else
+// as NAME=VALUE lines. An empty path gives a config that only reads the environment.
+func Load(path string) (*Config, error) {
+	config := &Config{path: path, values: make(map[string]string), keys: make(map[string]string)}
+	if path == "" {
+		return config, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+
+	case ".json", ".yaml", ".yml":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var document map[string]interface{}
+		if strings.ToLower(filepath.Ext(path)) == ".json" {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			err = decoder.Decode(&document)
+		} else {
+			err = yaml.Unmarshal(data, &document)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", path, err)
+		}
+		if err := config.flatten("", "", document); err != nil {
+			return nil, err
+		}
+
+	default:
+		values, err := envvar.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range values {
+			if err := config.set(key, key, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return config, nil
+}
+
+func (config *Config) flatten(name string, key string, document map[string]interface{}) error {
+	for childKey, value := range document {
+		childName := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(childKey))
+		if name != "" {
+			childName = name + "_" + childName
+			childKey = key + "." + childKey
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := config.flatten(childName, childKey, value); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, len(value))
+			for i := range value {
+				item, ok := scalar(value[i])
+				if !ok {
+					return fmt.Errorf("invalid %s in %s: list items must be values", childKey, config.path)
+				}
+				items[i] = item
+			}
+			if err := config.set(childName, childKey, strings.Join(items, ",")); err != nil {
+				return err
+			}
+		default:
+			item, ok := scalar(value)
+			if !ok {
+				return fmt.Errorf("invalid %s in %s: unsupported value", childKey, config.path)
+			}
+			if err := config.set(childName, childKey, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func scalar(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return value, true
+	case bool, int, int64, uint64, float64, json.Number:
+		return fmt.Sprint(value), true
+	case time.Time:
+		return value.Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+func (config *Config) set(name string, key string, value string) error {
+	if existing, ok := config.keys[name]; ok {
+		return fmt.Errorf("invalid %s in %s: same setting as %s", key, config.path, existing)
+	}
+	config.values[name] = value
+	config.keys[name] = key
+	return nil
+}
+
+// Values returns the settings in the file by environment variable name, so they can be handed to envvar.SetFileValues
+// for code that reads envvar directly.
+func (config *Config) Values() map[string]string {
+	values := make(map[string]string, len(config.values))
+	for name, value := range config.values {
+		values[name] = value
+	}
+	return values
+}
+
+// Names returns the environment variable names of the settings in the file, sorted.
+func (config *Config) Names() []string {
+	names := make([]string, 0, len(config.values))
+	for name := range config.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (config *Config) lookup(name string) (string, bool) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	value, ok := config.values[name]
+	return value, ok
+}
+
+// describe names a setting the way the operator wrote it, so errors point at the right line of the file or
+// the right environment variable.
+func (config *Config) describe(name string) string {
+	if _, ok := os.LookupEnv(name); !ok {
+		if key, ok := config.keys[name]; ok {
+			return fmt.Sprintf("%s in %s", key, config.path)
+		}
+	}
+	return name
+}
+
+func (config *Config) invalid(name string, value string, expected string) error {
+	return fmt.Errorf("invalid %s: expected %s, got %q", config.describe(name), expected, value)
+}
+
+// Invalid wraps an error from validating a setting, naming where the setting came from.
+func (config *Config) Invalid(name string, err error) error {
+	return fmt.Errorf("invalid %s: %v", config.describe(name), err)
+}
+
+func (config *Config) Exists(name string) bool {
+	_, ok := config.lookup(name)
+	return ok
+}
+
+func (config *Config) Get(name string, defaultValue string) string {
+	value, ok := config.lookup(name)
+	if !ok {
+		return defaultValue
+	}
+	return value
+}
+
+func (config *Config) GetList(name string, defaultValue []string) []string {
+	value, ok := config.lookup(name)
+	if !ok {
+		return defaultValue
+	}
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	items := strings.Split(value, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+func (config *Config) GetInt(name string, defaultValue int) (int, error) {
+	valueString, ok := config.lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(valueString), 10, 64)
+	if err != nil {
+		return defaultValue, config.invalid(name, valueString, "an integer")
+	}
+	return int(value), nil
+}
+
+func (config *Config) GetFloat(name string, defaultValue float64) (float64, error) {
+	valueString, ok := config.lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(valueString), 64)
+	if err != nil {
+		return defaultValue, config.invalid(name, valueString, "a number")
+	}
+	return value, nil
+}
+
+func (config *Config) GetBool(name string, defaultValue bool) (bool, error) {
+	valueString, ok := config.lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseBool(strings.TrimSpace(valueString))
+	if err != nil {
+		return defaultValue, config.invalid(name, valueString, "true or false")
+	}
+	return value, nil
+}
+
+func (config *Config) GetDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	valueString, ok := config.lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(strings.TrimSpace(valueString))
+	if err != nil {
+		return defaultValue, config.invalid(name, valueString, "a duration like 500ms or 5m")
+	}
+	return value, nil
+}
+
+// GetSize reads a number of bytes, optionally with a unit. KB, MB and GB are powers of 1000 and KiB, MiB and GiB
+// are powers of 1024.
+func (config *Config) GetSize(name string, defaultValue int) (int, error) {
+	valueString, ok := config.lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := ParseSize(valueString)
+	if err != nil {
+		return defaultValue, config.invalid(name, valueString, "a size like 4096, 64KiB or 4MB")
+	}
+	return value, nil
+}
+
+func (config *Config) GetBase64(name string, defaultValue []byte) ([]byte, error) {
+	valueString, ok := config.lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(valueString))
+	if err != nil {
+		return defaultValue, config.invalid(name, valueString, "base64")
+	}
+	return value, nil
+}
+
+// GetKey reads a base64 key that must be exactly keyBytes long. The value is left out of errors.
+func (config *Config) GetKey(name string, keyBytes int, defaultValue []byte) ([]byte, error) {
+	valueString, ok := config.lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(valueString))
+	if err != nil || len(value) != keyBytes {
+		return defaultValue, fmt.Errorf("invalid %s: expected a base64 encoded %d byte key", config.describe(name), keyBytes)
+	}
+	return value, nil
+}
+
+func (config *Config) GetAddress(name string, defaultValue *net.UDPAddr) (*net.UDPAddr, error) {
+	valueString, ok := config.lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := net.ResolveUDPAddr("udp", strings.TrimSpace(valueString))
+	if err != nil {
+		return defaultValue, config.invalid(name, valueString, "an address like 127.0.0.1:40000")
+	}
+	return value, nil
+}
+
+// GetAddressList reads a comma separated list of addresses, or a list in the file.
+func (config *Config) GetAddressList(name string, defaultValue []*net.UDPAddr) ([]*net.UDPAddr, error) {
+	if !config.Exists(name) {
+		return defaultValue, nil
+	}
+	var addresses []*net.UDPAddr
+	for _, item := range config.GetList(name, nil) {
+		address, err := net.ResolveUDPAddr("udp", item)
+		if err != nil {
+			return defaultValue, config.invalid(name, item, "an address like 127.0.0.1:40000")
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+func ParseSize(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	multiplier := 1
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int(size) * multiplier, nil
+}
@@ -0,0 +1,218 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name string, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestLoadYAML(t *testing.T) {
+
+	t.Parallel()
+
+	path := writeFile(t, "gateway.yaml", `
+server_addresses:
+  - 127.0.0.1:50000
+  - 127.0.0.1:50001
+rate_limit:
+  packets_per_second: 500
+  burst: 1.5
+idle-timeout: 30s
+read_buffer: 4MiB
+filter_key: 8KiJuKn9vkLtsC97Ak+3AjydnOa6bbX6W/EUcPkKIAs=
+prefer_ipv6: true
+`)
+
+	config, err := Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"FILTER_KEY", "IDLE_TIMEOUT", "PREFER_IPV6", "RATE_LIMIT_BURST", "RATE_LIMIT_PACKETS_PER_SECOND", "READ_BUFFER", "SERVER_ADDRESSES"}, config.Names())
+
+	// nested keys and lists are flattened to the environment variable names
+
+	addresses, err := config.GetAddressList("SERVER_ADDRESSES", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(addresses))
+	assert.Equal(t, "127.0.0.1:50001", addresses[1].String())
+
+	packetsPerSecond, err := config.GetInt("RATE_LIMIT_PACKETS_PER_SECOND", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, packetsPerSecond)
+
+	burst, err := config.GetFloat("RATE_LIMIT_BURST", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, burst)
+
+	idleTimeout, err := config.GetDuration("IDLE_TIMEOUT", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, idleTimeout)
+
+	readBuffer, err := config.GetSize("READ_BUFFER", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4*1024*1024, readBuffer)
+
+	key, err := config.GetKey("FILTER_KEY", 32, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 32, len(key))
+
+	preferIPv6, err := config.GetBool("PREFER_IPV6", false)
+	assert.Nil(t, err)
+	assert.True(t, preferIPv6)
+
+	// missing settings get the default
+
+	assert.False(t, config.Exists("MISSING_SETTING"))
+	missing, err := config.GetDuration("MISSING_SETTING", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, missing)
+}
+
+func TestLoadJSON(t *testing.T) {
+
+	t.Parallel()
+
+	path := writeFile(t, "gateway.json", `{"rate_limit": {"burst": 20000000000}, "blocklist": ["10.0.0.0/8", "192.168.1.1"], "log_level": null}`)
+
+	config, err := Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "20000000000", config.Get("RATE_LIMIT_BURST", ""))
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1"}, config.GetList("BLOCKLIST", nil))
+	assert.True(t, config.Exists("LOG_LEVEL"))
+	assert.Equal(t, "", config.Get("LOG_LEVEL", "info"))
+
+	_, err = Load(writeFile(t, "broken.json", `{"rate_limit": `))
+	assert.NotNil(t, err)
+}
+
+func TestLoadEnvFile(t *testing.T) {
+
+	t.Parallel()
+
+	config, err := Load(writeFile(t, "gateway.env", "# comment\nRATE_LIMIT_BURST=100\n\nBLOCKLIST=10.0.0.1\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"RATE_LIMIT_BURST": "100", "BLOCKLIST": "10.0.0.1"}, config.Values())
+
+	config, err = Load("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(config.Values()))
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.NotNil(t, err)
+}
+
+func TestInvalidSettings(t *testing.T) {
+
+	t.Parallel()
+
+	path := writeFile(t, "gateway.yaml", `
+rate_limit:
+  burst: lots
+idle_timeout: 30
+read_buffer: 4 bananas
+filter_key: c2hvcnQ=
+server_addresses: [127.0.0.1:50000, "not an address"]
+`)
+
+	config, err := Load(path)
+	assert.Nil(t, err)
+
+	// errors name the key as it is written in the file
+
+	_, err = config.GetFloat("RATE_LIMIT_BURST", 0)
+	assert.Contains(t, err.Error(), "rate_limit.burst in "+path)
+
+	_, err = config.GetDuration("IDLE_TIMEOUT", 0)
+	assert.Contains(t, err.Error(), "idle_timeout in "+path)
+
+	_, err = config.GetSize("READ_BUFFER", 0)
+	assert.Contains(t, err.Error(), "read_buffer")
+
+	_, err = config.GetAddressList("SERVER_ADDRESSES", nil)
+	assert.Contains(t, err.Error(), "server_addresses")
+	assert.Contains(t, err.Error(), "not an address")
+
+	// keys are never echoed back
+
+	_, err = config.GetKey("FILTER_KEY", 32, nil)
+	assert.Contains(t, err.Error(), "filter_key")
+	assert.NotContains(t, err.Error(), "c2hvcnQ=")
+
+	// two spellings of one setting are rejected
+
+	_, err = Load(writeFile(t, "duplicate.yaml", "rate_limit:\n  burst: 1\nRATE_LIMIT_BURST: 2\n"))
+	assert.NotNil(t, err)
+
+	_, err = Load(writeFile(t, "nested.yaml", "servers:\n  - address: 127.0.0.1:50000\n"))
+	assert.NotNil(t, err)
+}
+
+func TestEnvironmentOverridesFile(t *testing.T) {
+
+	t.Setenv("UDPX_CONFIG_TEST_BURST", "lots")
+
+	config, err := Load(writeFile(t, "gateway.yaml", "udpx_config_test_burst: 100\nudpx_config_test_rate: 50\n"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "lots", config.Get("UDPX_CONFIG_TEST_BURST", ""))
+	assert.Equal(t, "50", config.Get("UDPX_CONFIG_TEST_RATE", ""))
+
+	// the error names the environment variable, since that is where the value came from
+
+	_, err = config.GetInt("UDPX_CONFIG_TEST_BURST", 0)
+	assert.Contains(t, err.Error(), "invalid UDPX_CONFIG_TEST_BURST:")
+}
+
+func TestParseSize(t *testing.T) {
+
+	t.Parallel()
+
+	for value, expected := range map[string]int{"0": 0, "1500": 1500, "1500B": 1500, "64KiB": 65536, "2 MB": 2000000, "1GiB": 1 << 30} {
+		size, err := ParseSize(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+
+	for _, value := range []string{"", "KiB", "-1", "1.5MB", "4 bananas"} {
+		_, err := ParseSize(value)
+		assert.NotNil(t, err, value)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter is a token bucket of wire bits for one direction of a session.
+// The bucket holds burst worth of bandwidth, and never less than one maximum size packet.
+type BandwidthLimiter struct {
+	mutex         sync.Mutex
+	bitsPerSecond float64
+	burstBits     float64
+	tokens        float64
+	lastUpdate    time.Time
+}
+
+// CreateBandwidthLimiter creates a limiter that starts with a full bucket. A limit of zero kbps is unlimited.
+func CreateBandwidthLimiter(kbps float64, burst time.Duration, currentTime time.Time) *BandwidthLimiter {
+	limiter := &BandwidthLimiter{}
+	limiter.bitsPerSecond = kbps * 1000
+	limiter.burstBits = limiter.bitsPerSecond * burst.Seconds()
+	if minBurstBits := float64(WirePacketBits(MaxPathMTU)); limiter.burstBits < minBurstBits {
+		limiter.burstBits = minBurstBits
+	}
+	limiter.tokens = limiter.burstBits
+	limiter.lastUpdate = currentTime
+	return limiter
+}
+
+func (limiter *BandwidthLimiter) Allow(packetBytes int, currentTime time.Time) bool {
+
+	if limiter.bitsPerSecond <= 0 {
+		return true
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	elapsed := currentTime.Sub(limiter.lastUpdate).Seconds()
+	if elapsed > 0 {
+		limiter.tokens += elapsed * limiter.bitsPerSecond
+		if limiter.tokens > limiter.burstBits {
+			limiter.tokens = limiter.burstBits
+		}
+		limiter.lastUpdate = currentTime
+	}
+
+	bits := float64(WirePacketBits(packetBytes))
+	if limiter.tokens < bits {
+		return false
+	}
+
+	limiter.tokens -= bits
+
+	return true
+}
+
+func (limiter *BandwidthLimiter) GetKbps() float64 {
+	return limiter.bitsPerSecond / 1000
+}
+
+// SessionKbps is the bandwidth limit for a session: its envelope from the connect token,
+// capped to the gateway limit. A gateway limit of zero leaves the envelope as is.
+func SessionKbps(envelopeKbps uint32, limitKbps float64) float64 {
+	kbps := float64(envelopeKbps)
+	if limitKbps > 0 && (kbps <= 0 || limitKbps < kbps) {
+		kbps = limitKbps
+	}
+	return kbps
+}
@@ -0,0 +1,108 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+
+	t.Parallel()
+
+	currentTime := time.Unix(1000, 0)
+
+	// 1000 byte packets are 8352 wire bits, so a 100 kbps limit with a one second burst allows 11
+
+	limiter := CreateBandwidthLimiter(100, time.Second, currentTime)
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if limiter.Allow(1000, currentTime) {
+			allowed++
+		}
+	}
+	assert.Equal(t, 11, allowed)
+
+	// tokens refill at the limit. 8128 bits are left over from the burst
+
+	assert.True(t, limiter.Allow(1000, currentTime.Add(3*time.Millisecond)))
+	assert.False(t, limiter.Allow(1000, currentTime.Add(50*time.Millisecond)))
+	assert.True(t, limiter.Allow(1000, currentTime.Add(86*time.Millisecond)))
+	assert.False(t, limiter.Allow(1000, currentTime.Add(86*time.Millisecond)))
+
+	// sustained sending is held to the limit
+
+	allowed = 0
+	for i := 0; i < 1000; i++ {
+		if limiter.Allow(1000, currentTime.Add(time.Second+time.Duration(i)*10*time.Millisecond)) {
+			allowed++
+		}
+	}
+	assert.InDelta(t, 10*100000/8352+11, allowed, 2)
+}
+
+func TestBandwidthLimiterMinimumBurst(t *testing.T) {
+
+	t.Parallel()
+
+	currentTime := time.Unix(1000, 0)
+
+	// a low limit still lets a maximum size packet through
+
+	limiter := CreateBandwidthLimiter(1, time.Millisecond, currentTime)
+	assert.True(t, limiter.Allow(MaxPathMTU, currentTime))
+	assert.False(t, limiter.Allow(MaxPathMTU, currentTime))
+}
+
+func TestBandwidthLimiterUnlimited(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := CreateBandwidthLimiter(0, time.Second, time.Unix(1000, 0))
+	for i := 0; i < 1000; i++ {
+		assert.True(t, limiter.Allow(MaxPathMTU, time.Unix(1000, 0)))
+	}
+}
+
+func TestSessionKbps(t *testing.T) {
+
+	t.Parallel()
+
+	assert.Equal(t, 2500.0, SessionKbps(2500, 0))
+	assert.Equal(t, 1000.0, SessionKbps(2500, 1000))
+	assert.Equal(t, 2500.0, SessionKbps(2500, 5000))
+	assert.Equal(t, 1000.0, SessionKbps(0, 1000))
+}
@@ -0,0 +1,273 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// benchmarks for the per-packet hot path. run them with "make bench", which compares ns/op and allocs/op
+// against a saved baseline
+
+const benchmarkPayloadBytes = 1024
+
+var benchmarkFromAddress = [4]byte{10, 0, 0, 1}
+var benchmarkToAddress = [4]byte{10, 0, 0, 2}
+
+const benchmarkFromPort = 30000
+const benchmarkToPort = 40000
+
+var benchmarkSink bool
+
+func BenchmarkWriteUint64(b *testing.B) {
+	var buffer [8]byte
+	for n := 0; n < b.N; n++ {
+		index := 0
+		WriteUint64(buffer[:], &index, uint64(n))
+	}
+}
+
+func BenchmarkReadUint64(b *testing.B) {
+	var buffer [8]byte
+	var value uint64
+	for n := 0; n < b.N; n++ {
+		index := 0
+		benchmarkSink = ReadUint64(buffer[:], &index, &value)
+	}
+}
+
+func BenchmarkWriteAddress(b *testing.B) {
+	var buffer [AddressBytes]byte
+	address := ParseAddress("127.0.0.1:40000")
+	for n := 0; n < b.N; n++ {
+		index := 0
+		WriteAddress(buffer[:], &index, address)
+	}
+}
+
+func BenchmarkReadAddress(b *testing.B) {
+	var buffer [AddressBytes]byte
+	index := 0
+	WriteAddress(buffer[:], &index, ParseAddress("127.0.0.1:40000"))
+	var address net.UDPAddr
+	for n := 0; n < b.N; n++ {
+		index := 0
+		benchmarkSink = ReadAddress(buffer[:], &index, &address)
+	}
+}
+
+func BenchmarkWriteSessionToken(b *testing.B) {
+	var buffer [SessionTokenBytes]byte
+	var token SessionToken
+	for n := 0; n < b.N; n++ {
+		index := 0
+		token.IssueTimestamp = uint64(n)
+		WriteSessionToken(buffer[:], &index, &token)
+	}
+}
+
+func BenchmarkReadSessionToken(b *testing.B) {
+	var buffer [SessionTokenBytes]byte
+	var token SessionToken
+	for n := 0; n < b.N; n++ {
+		index := 0
+		benchmarkSink = ReadSessionToken(buffer[:], &index, &token)
+	}
+}
+
+func BenchmarkGenerateChonkle(b *testing.B) {
+	var output [ChonkleBytes]byte
+	var magic [8]byte
+	for n := 0; n < b.N; n++ {
+		GenerateChonkle(output[:], magic[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, MinPacketSize)
+	}
+}
+
+func BenchmarkGenerateChonkleKeyed(b *testing.B) {
+	var output [ChonkleBytes]byte
+	var filterKey [SipHashKeyBytes]byte
+	for n := 0; n < b.N; n++ {
+		GenerateChonkleKeyed(output[:], filterKey[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, MinPacketSize)
+	}
+}
+
+func BenchmarkGeneratePittle(b *testing.B) {
+	var output [PittleBytes]byte
+	for n := 0; n < b.N; n++ {
+		GeneratePittle(output[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, MinPacketSize)
+	}
+}
+
+func BenchmarkGeneratePittleKeyed(b *testing.B) {
+	var output [PittleBytes]byte
+	var filterKey [SipHashKeyBytes]byte
+	for n := 0; n < b.N; n++ {
+		GeneratePittleKeyed(output[:], filterKey[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, MinPacketSize)
+	}
+}
+
+func BenchmarkAdvancedPacketFilter(b *testing.B) {
+	var magic [8]byte
+	packet := make([]byte, MinPacketSize)
+	GenerateChonkle(packet[2:], magic[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, len(packet))
+	GeneratePittle(packet[len(packet)-PittleBytes:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, len(packet))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		benchmarkSink = AdvancedPacketFilter(packet, magic[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, len(packet))
+	}
+	if !benchmarkSink {
+		b.Fatal("packet did not pass the filter")
+	}
+}
+
+func BenchmarkAdvancedPacketFilterKeyed(b *testing.B) {
+	var filterKey [SipHashKeyBytes]byte
+	packet := make([]byte, MinPacketSize)
+	GenerateChonkleKeyed(packet[2:], filterKey[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, len(packet))
+	GeneratePittleKeyed(packet[len(packet)-PittleBytes:], filterKey[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, len(packet))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		benchmarkSink = AdvancedPacketFilterKeyed(packet, filterKey[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, len(packet))
+	}
+	if !benchmarkSink {
+		b.Fatal("packet did not pass the filter")
+	}
+}
+
+// payload crypto is benchmarked for each cipher suite available on the machine, so the numbers show which
+// suite PreferredCipherSuite should pick there
+
+func benchmarkCipherSuites(b *testing.B, benchmark func(b *testing.B, cipherSuite byte)) {
+	for _, cipherSuite := range CipherSuites {
+		if !CipherSuiteAvailable(cipherSuite) {
+			continue
+		}
+		b.Run(CipherSuiteName(cipherSuite), func(b *testing.B) {
+			benchmark(b, cipherSuite)
+		})
+	}
+}
+
+func BenchmarkEncryptPayload(b *testing.B) {
+	benchmarkCipherSuites(b, func(b *testing.B, cipherSuite byte) {
+		sessionKey := RandomBytes(SessionKeyBytes)
+		buffer := make([]byte, benchmarkPayloadBytes+HMACBytes_AEAD)
+		b.SetBytes(benchmarkPayloadBytes)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			EncryptPayload(cipherSuite, sessionKey, uint64(n), 0, buffer, benchmarkPayloadBytes)
+		}
+	})
+}
+
+func BenchmarkDecryptPayload(b *testing.B) {
+	benchmarkCipherSuites(b, func(b *testing.B, cipherSuite byte) {
+		sessionKey := RandomBytes(SessionKeyBytes)
+		encrypted := make([]byte, benchmarkPayloadBytes+HMACBytes_AEAD)
+		EncryptPayload(cipherSuite, sessionKey, 1000, 0, encrypted, benchmarkPayloadBytes)
+		buffer := make([]byte, len(encrypted))
+		b.SetBytes(benchmarkPayloadBytes)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			copy(buffer, encrypted)
+			if err := DecryptPayload(cipherSuite, sessionKey, 1000, 0, buffer, len(buffer)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReadSignedSessionToken(b *testing.B) {
+	authPublicKey, authPrivateKey := Keygen_Sign()
+	buffer := make([]byte, SignedSessionTokenBytes)
+	index := 0
+	WriteSignedSessionToken(buffer, &index, &SessionToken{}, authPrivateKey)
+	var token SessionToken
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		index := 0
+		if !ReadSignedSessionToken(buffer, &index, &token, authPublicKey) {
+			b.Fatal("could not read session token")
+		}
+	}
+}
+
+func BenchmarkDecryptSessionToken(b *testing.B) {
+	_, authPrivateKey := Keygen_Sign()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+	sessionToken := SessionToken{}
+	buffer := make([]byte, EncryptedSessionTokenBytes)
+	index := 0
+	WriteEncryptedSessionToken(buffer, &index, &sessionToken, authPrivateKey, gatewayPublicKey)
+	signedTokenData := make([]byte, SignedSessionTokenBytes)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if !DecryptSessionToken(buffer, sessionToken.SessionId[:], signedTokenData, gatewayPrivateKey) {
+			b.Fatal("could not decrypt session token")
+		}
+	}
+}
+
+func BenchmarkReadClientPacket(b *testing.B) {
+	packetData := make([]byte, PacketBytesFromPayload(benchmarkPayloadBytes))
+	var packet ClientPacket
+	for n := 0; n < b.N; n++ {
+		benchmarkSink = ReadClientPacket(packetData, &packet)
+	}
+}
+
+// the serialization and filter functions run for every packet, so they must not allocate
+
+func TestHotPathAllocations(t *testing.T) {
+
+	var buffer [SessionTokenBytes]byte
+	var token SessionToken
+	var output [ChonkleBytes]byte
+	var magic [8]byte
+	var filterKey [SipHashKeyBytes]byte
+
+	allocations := testing.AllocsPerRun(1000, func() {
+		index := 0
+		WriteSessionToken(buffer[:], &index, &token)
+		index = 0
+		ReadSessionToken(buffer[:], &index, &token)
+		GenerateChonkle(output[:], magic[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, MinPacketSize)
+		GenerateChonkleKeyed(output[:], filterKey[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, MinPacketSize)
+		GeneratePittle(output[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, MinPacketSize)
+		GeneratePittleKeyed(output[:], filterKey[:], benchmarkFromAddress[:], benchmarkFromPort, benchmarkToAddress[:], benchmarkToPort, MinPacketSize)
+	})
+
+	assert.Equal(t, 0.0, allocations)
+}
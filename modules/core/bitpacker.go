@@ -0,0 +1,266 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+type BitWriter struct {
+	buffer      []byte
+	scratch     uint64
+	scratchBits int
+	bitsWritten int
+	byteIndex   int
+}
+
+func CreateBitWriter(buffer []byte) *BitWriter {
+	return &BitWriter{buffer: buffer}
+}
+
+func (writer *BitWriter) WriteBits(value uint32, bits int) error {
+	if bits <= 0 || bits > 32 {
+		return fmt.Errorf("invalid number of bits to write: %d", bits)
+	}
+	if writer.bitsWritten+bits > len(writer.buffer)*8 {
+		return fmt.Errorf("bit writer overflow: %d bits written, %d bits available", writer.bitsWritten, writer.GetBitsAvailable())
+	}
+	writer.scratch |= (uint64(value) & ((uint64(1) << uint(bits)) - 1)) << uint(writer.scratchBits)
+	writer.scratchBits += bits
+	for writer.scratchBits >= 8 {
+		writer.buffer[writer.byteIndex] = byte(writer.scratch)
+		writer.byteIndex++
+		writer.scratch >>= 8
+		writer.scratchBits -= 8
+	}
+	writer.bitsWritten += bits
+	return nil
+}
+
+func (writer *BitWriter) WriteAlign() error {
+	remainderBits := writer.GetAlignBits()
+	if remainderBits > 0 {
+		return writer.WriteBits(0, remainderBits)
+	}
+	return nil
+}
+
+func (writer *BitWriter) WriteBytes(data []byte, bytes int) error {
+	if writer.GetAlignBits() != 0 {
+		return fmt.Errorf("bit writer must be aligned to write bytes")
+	}
+	if writer.bitsWritten+bytes*8 > len(writer.buffer)*8 {
+		return fmt.Errorf("bit writer overflow: %d bits written, %d bits available", writer.bitsWritten, writer.GetBitsAvailable())
+	}
+	copy(writer.buffer[writer.byteIndex:], data[:bytes])
+	writer.byteIndex += bytes
+	writer.bitsWritten += bytes * 8
+	return nil
+}
+
+func (writer *BitWriter) FlushBits() {
+	if writer.scratchBits > 0 {
+		writer.buffer[writer.byteIndex] = byte(writer.scratch)
+		writer.byteIndex++
+		writer.scratch = 0
+		writer.scratchBits = 0
+		writer.bitsWritten = writer.byteIndex * 8
+	}
+}
+
+func (writer *BitWriter) GetAlignBits() int {
+	return (8 - writer.bitsWritten%8) % 8
+}
+
+func (writer *BitWriter) GetBitsWritten() int {
+	return writer.bitsWritten
+}
+
+func (writer *BitWriter) GetBitsAvailable() int {
+	return len(writer.buffer)*8 - writer.bitsWritten
+}
+
+func (writer *BitWriter) GetBytesWritten() int {
+	return (writer.bitsWritten + 7) / 8
+}
+
+func (writer *BitWriter) GetData() []byte {
+	return writer.buffer[:writer.GetBytesWritten()]
+}
+
+type BitReader struct {
+	buffer      []byte
+	scratch     uint64
+	scratchBits int
+	bitsRead    int
+	byteIndex   int
+}
+
+func CreateBitReader(buffer []byte) *BitReader {
+	return &BitReader{buffer: buffer}
+}
+
+func (reader *BitReader) WouldReadPastEnd(bits int) bool {
+	return reader.bitsRead+bits > len(reader.buffer)*8
+}
+
+func (reader *BitReader) ReadBits(bits int) (uint32, error) {
+	if bits <= 0 || bits > 32 {
+		return 0, fmt.Errorf("invalid number of bits to read: %d", bits)
+	}
+	if reader.WouldReadPastEnd(bits) {
+		return 0, fmt.Errorf("bit reader would read past end: %d bits read, %d bits remaining", reader.bitsRead, reader.GetBitsRemaining())
+	}
+	for reader.scratchBits < bits {
+		reader.scratch |= uint64(reader.buffer[reader.byteIndex]) << uint(reader.scratchBits)
+		reader.byteIndex++
+		reader.scratchBits += 8
+	}
+	value := uint32(reader.scratch & ((uint64(1) << uint(bits)) - 1))
+	reader.scratch >>= uint(bits)
+	reader.scratchBits -= bits
+	reader.bitsRead += bits
+	return value, nil
+}
+
+func (reader *BitReader) ReadAlign() error {
+	remainderBits := reader.GetAlignBits()
+	if remainderBits > 0 {
+		value, err := reader.ReadBits(remainderBits)
+		if err != nil {
+			return err
+		}
+		if value != 0 {
+			return fmt.Errorf("bit reader align bits are not zero")
+		}
+	}
+	return nil
+}
+
+func (reader *BitReader) ReadBytes(data []byte, bytes int) error {
+	if reader.GetAlignBits() != 0 {
+		return fmt.Errorf("bit reader must be aligned to read bytes")
+	}
+	if reader.WouldReadPastEnd(bytes * 8) {
+		return fmt.Errorf("bit reader would read past end: %d bits read, %d bits remaining", reader.bitsRead, reader.GetBitsRemaining())
+	}
+	copy(data[:bytes], reader.buffer[reader.byteIndex:reader.byteIndex+bytes])
+	reader.byteIndex += bytes
+	reader.bitsRead += bytes * 8
+	return nil
+}
+
+func (reader *BitReader) GetAlignBits() int {
+	return (8 - reader.bitsRead%8) % 8
+}
+
+func (reader *BitReader) GetBitsRead() int {
+	return reader.bitsRead
+}
+
+func (reader *BitReader) GetBitsRemaining() int {
+	return len(reader.buffer)*8 - reader.bitsRead
+}
+
+func (reader *BitReader) GetBytesRead() int {
+	return (reader.bitsRead + 7) / 8
+}
+
+func BitsRequired(min uint32, max uint32) int {
+	if min == max {
+		return 0
+	}
+	return bits.Len32(max - min)
+}
+
+func compressedFloatParams(min float32, max float32, resolution float32) (uint32, int, error) {
+	if !(max > min) || !(resolution > 0) {
+		return 0, 0, fmt.Errorf("invalid compressed float parameters: min = %f, max = %f, resolution = %f", min, max, resolution)
+	}
+	maxIntegerValue := math.Ceil(float64(max-min) / float64(resolution))
+	if maxIntegerValue > math.MaxUint32 {
+		return 0, 0, fmt.Errorf("compressed float needs more than 32 bits: min = %f, max = %f, resolution = %f", min, max, resolution)
+	}
+	return uint32(maxIntegerValue), BitsRequired(0, uint32(maxIntegerValue)), nil
+}
+
+func WriteCompressedFloat(writer *BitWriter, value float32, min float32, max float32, resolution float32) error {
+	maxIntegerValue, bits, err := compressedFloatParams(min, max, resolution)
+	if err != nil {
+		return err
+	}
+	normalizedValue := float64(value-min) / float64(max-min)
+	if normalizedValue < 0 || math.IsNaN(normalizedValue) {
+		normalizedValue = 0
+	} else if normalizedValue > 1 {
+		normalizedValue = 1
+	}
+	integerValue := uint32(math.Floor(normalizedValue*float64(maxIntegerValue) + 0.5))
+	return writer.WriteBits(integerValue, bits)
+}
+
+func ReadCompressedFloat(reader *BitReader, value *float32, min float32, max float32, resolution float32) error {
+	maxIntegerValue, bits, err := compressedFloatParams(min, max, resolution)
+	if err != nil {
+		return err
+	}
+	integerValue, err := reader.ReadBits(bits)
+	if err != nil {
+		return err
+	}
+	if integerValue > maxIntegerValue {
+		return fmt.Errorf("compressed float value out of range: %d > %d", integerValue, maxIntegerValue)
+	}
+	normalizedValue := float64(integerValue) / float64(maxIntegerValue)
+	*value = float32(normalizedValue*float64(max-min) + float64(min))
+	return nil
+}
+
+func WriteCompressedVector3(writer *BitWriter, vector [3]float32, min float32, max float32, resolution float32) error {
+	for i := 0; i < 3; i++ {
+		if err := WriteCompressedFloat(writer, vector[i], min, max, resolution); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ReadCompressedVector3(reader *BitReader, vector *[3]float32, min float32, max float32, resolution float32) error {
+	for i := 0; i < 3; i++ {
+		if err := ReadCompressedFloat(reader, &vector[i], min, max, resolution); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBitpacker(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 256)
+
+	writer := CreateBitWriter(buffer)
+
+	assert.Equal(t, 0, writer.GetBitsWritten())
+	assert.Equal(t, 0, writer.GetBytesWritten())
+	assert.Equal(t, len(buffer)*8, writer.GetBitsAvailable())
+
+	assert.NoError(t, writer.WriteBits(0, 1))
+	assert.NoError(t, writer.WriteBits(1, 1))
+	assert.NoError(t, writer.WriteBits(10, 8))
+	assert.NoError(t, writer.WriteBits(255, 8))
+	assert.NoError(t, writer.WriteBits(1000, 10))
+	assert.NoError(t, writer.WriteBits(50000, 16))
+	assert.NoError(t, writer.WriteBits(9999999, 32))
+	assert.NoError(t, writer.WriteAlign())
+	assert.NoError(t, writer.WriteBytes([]byte{1, 2, 3, 4}, 4))
+	assert.NoError(t, writer.WriteBits(5, 3))
+	writer.FlushBits()
+
+	assert.Equal(t, 120, writer.GetBitsWritten())
+
+	bytesWritten := writer.GetBytesWritten()
+
+	assert.Equal(t, 15, bytesWritten)
+	assert.Equal(t, bytesWritten, len(writer.GetData()))
+
+	reader := CreateBitReader(writer.GetData())
+
+	assert.Equal(t, 0, reader.GetBitsRead())
+	assert.Equal(t, bytesWritten*8, reader.GetBitsRemaining())
+
+	a, err := reader.ReadBits(1)
+	assert.NoError(t, err)
+	b, err := reader.ReadBits(1)
+	assert.NoError(t, err)
+	c, err := reader.ReadBits(8)
+	assert.NoError(t, err)
+	d, err := reader.ReadBits(8)
+	assert.NoError(t, err)
+	e, err := reader.ReadBits(10)
+	assert.NoError(t, err)
+	f, err := reader.ReadBits(16)
+	assert.NoError(t, err)
+	g, err := reader.ReadBits(32)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.ReadAlign())
+	var h [4]byte
+	assert.NoError(t, reader.ReadBytes(h[:], 4))
+	i, err := reader.ReadBits(3)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint32(0), a)
+	assert.Equal(t, uint32(1), b)
+	assert.Equal(t, uint32(10), c)
+	assert.Equal(t, uint32(255), d)
+	assert.Equal(t, uint32(1000), e)
+	assert.Equal(t, uint32(50000), f)
+	assert.Equal(t, uint32(9999999), g)
+	assert.Equal(t, [4]byte{1, 2, 3, 4}, h)
+	assert.Equal(t, uint32(5), i)
+
+	// can't read past the end
+
+	_, err = reader.ReadBits(8)
+	assert.Error(t, err)
+}
+
+func TestBitpackerMatchesByteOrder(t *testing.T) {
+
+	t.Parallel()
+
+	// byte aligned writes must produce the same data as the byte oriented write functions
+
+	expected := make([]byte, 15)
+	index := 0
+	WriteUint8(expected, &index, 200)
+	WriteUint16(expected, &index, 40000)
+	WriteUint32(expected, &index, 3000000000)
+	WriteUint64(expected, &index, 0x0102030405060708)
+
+	buffer := make([]byte, 15)
+	writer := CreateBitWriter(buffer)
+	assert.NoError(t, writer.WriteBits(200, 8))
+	assert.NoError(t, writer.WriteBits(40000, 16))
+	assert.NoError(t, writer.WriteBits(3000000000, 32))
+	assert.NoError(t, writer.WriteBits(0x05060708, 32))
+	assert.NoError(t, writer.WriteBits(0x01020304, 32))
+	writer.FlushBits()
+
+	assert.Equal(t, expected, writer.GetData())
+}
+
+func TestBitWriterOverflow(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 2)
+
+	writer := CreateBitWriter(buffer)
+
+	assert.NoError(t, writer.WriteBits(1, 12))
+	assert.Error(t, writer.WriteBits(1, 5))
+	assert.NoError(t, writer.WriteBits(1, 4))
+	assert.Error(t, writer.WriteBits(1, 1))
+
+	writer = CreateBitWriter(buffer)
+	assert.NoError(t, writer.WriteBits(1, 3))
+	assert.Error(t, writer.WriteBytes([]byte{1}, 1))
+	assert.Error(t, writer.WriteBits(1, 0))
+	assert.Error(t, writer.WriteBits(1, 33))
+}
+
+func TestBitsRequired(t *testing.T) {
+
+	t.Parallel()
+
+	assert.Equal(t, 0, BitsRequired(0, 0))
+	assert.Equal(t, 1, BitsRequired(0, 1))
+	assert.Equal(t, 2, BitsRequired(0, 3))
+	assert.Equal(t, 3, BitsRequired(0, 4))
+	assert.Equal(t, 8, BitsRequired(0, 255))
+	assert.Equal(t, 8, BitsRequired(100, 355))
+	assert.Equal(t, 32, BitsRequired(0, 0xFFFFFFFF))
+}
+
+func TestCompressedFloat(t *testing.T) {
+
+	t.Parallel()
+
+	const min = float32(-1000.0)
+	const max = float32(1000.0)
+	const resolution = float32(0.01)
+
+	values := []float32{-1000.0, -500.25, -0.01, 0.0, 0.005, 1.23, 999.99, 1000.0}
+
+	buffer := make([]byte, 256)
+
+	writer := CreateBitWriter(buffer)
+	for i := range values {
+		assert.NoError(t, WriteCompressedFloat(writer, values[i], min, max, resolution))
+	}
+
+	// out of range values are clamped
+
+	assert.NoError(t, WriteCompressedFloat(writer, -5000.0, min, max, resolution))
+	assert.NoError(t, WriteCompressedFloat(writer, 5000.0, min, max, resolution))
+
+	// 200000 values fit in 18 bits
+
+	assert.Equal(t, (len(values)+2)*18, writer.GetBitsWritten())
+
+	writer.FlushBits()
+
+	reader := CreateBitReader(writer.GetData())
+	for i := range values {
+		var value float32
+		assert.NoError(t, ReadCompressedFloat(reader, &value, min, max, resolution))
+		assert.InDelta(t, values[i], value, float64(resolution))
+	}
+
+	var value float32
+	assert.NoError(t, ReadCompressedFloat(reader, &value, min, max, resolution))
+	assert.Equal(t, min, value)
+	assert.NoError(t, ReadCompressedFloat(reader, &value, min, max, resolution))
+	assert.Equal(t, max, value)
+
+	// invalid parameters
+
+	assert.Error(t, WriteCompressedFloat(writer, 0, 10, -10, resolution))
+	assert.Error(t, WriteCompressedFloat(writer, 0, min, max, 0))
+}
+
+func TestCompressedVector3(t *testing.T) {
+
+	t.Parallel()
+
+	vector := [3]float32{1.5, -20.25, 300.125}
+
+	buffer := make([]byte, 64)
+
+	writer := CreateBitWriter(buffer)
+	assert.NoError(t, WriteCompressedVector3(writer, vector, -512, 512, 0.001))
+	writer.FlushBits()
+
+	var readVector [3]float32
+	reader := CreateBitReader(writer.GetData())
+	assert.NoError(t, ReadCompressedVector3(reader, &readVector, -512, 512, 0.001))
+
+	for i := 0; i < 3; i++ {
+		assert.InDelta(t, vector[i], readVector[i], 0.001)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+// #cgo pkg-config: libsodium
+// #include <sodium.h>
+import "C"
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Payload packets are encrypted with one of these cipher suites, picked by the client. XChaCha20-Poly1305 is
+// fast on any cpu, so every client and gateway speaks it. AES-256-GCM is faster on cpus with AES instructions,
+// and libsodium only provides it on those.
+const CipherSuite_XChaCha20Poly1305 = byte(0)
+const CipherSuite_AES256GCM = byte(1)
+
+const CipherSuiteBytes = 1
+
+// Clients speaking CipherSuiteProtocolVersion or later write their cipher suite in the packet type byte of the
+// prefix. Older clients always write PayloadPacket there, which reads as CipherSuite_XChaCha20Poly1305.
+const CipherSuiteProtocolVersion = byte(2)
+
+const KeyBytes_AES256GCM = 32
+const NonceBytes_AES256GCM = 12
+const HMACBytes_AES256GCM = 16
+
+// CipherSuites has every cipher suite, in order of preference.
+var CipherSuites = []byte{CipherSuite_AES256GCM, CipherSuite_XChaCha20Poly1305}
+
+var cipherSuiteNames = map[byte]string{
+	CipherSuite_XChaCha20Poly1305: "xchacha20poly1305",
+	CipherSuite_AES256GCM:         "aes256gcm",
+}
+
+// libsodium detects the cpu features it can use in sodium_init, so AES-256-GCM is unavailable without it
+
+func init() {
+	if C.sodium_init() < 0 {
+		panic("could not initialize libsodium")
+	}
+}
+
+func CipherSuiteName(cipherSuite byte) string {
+	if name, ok := cipherSuiteNames[cipherSuite]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", cipherSuite)
+}
+
+func ParseCipherSuite(name string) (byte, error) {
+	for cipherSuite, cipherSuiteName := range cipherSuiteNames {
+		if strings.EqualFold(strings.TrimSpace(name), cipherSuiteName) {
+			return cipherSuite, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+// CipherSuiteAvailable returns true if payload packets can be encrypted with the cipher suite on this machine.
+func CipherSuiteAvailable(cipherSuite byte) bool {
+	switch cipherSuite {
+	case CipherSuite_XChaCha20Poly1305:
+		return true
+	case CipherSuite_AES256GCM:
+		return C.crypto_aead_aes256gcm_is_available() == 1
+	default:
+		return false
+	}
+}
+
+// PreferredCipherSuite returns the fastest cipher suite available on this machine.
+func PreferredCipherSuite() byte {
+	for _, cipherSuite := range CipherSuites {
+		if CipherSuiteAvailable(cipherSuite) {
+			return cipherSuite
+		}
+	}
+	return CipherSuite_XChaCha20Poly1305
+}
+
+// Encrypt_AES256GCM must only be called when CipherSuiteAvailable(CipherSuite_AES256GCM) is true.
+func Encrypt_AES256GCM(key []byte, nonce []byte, additionalData []byte, buffer []byte, bytes int) int {
+	var additionalDataPointer *C.uchar
+	if len(additionalData) > 0 {
+		additionalDataPointer = (*C.uchar)(&additionalData[0])
+	}
+	C.crypto_aead_aes256gcm_encrypt((*C.uchar)(&buffer[0]),
+		nil,
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		additionalDataPointer,
+		C.ulonglong(len(additionalData)),
+		nil,
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&key[0]))
+	return bytes + HMACBytes_AES256GCM
+}
+
+func Decrypt_AES256GCM(key []byte, nonce []byte, additionalData []byte, buffer []byte, bytes int) error {
+	if bytes < HMACBytes_AES256GCM {
+		return fmt.Errorf("failed to decrypt: %d bytes is too small", bytes)
+	}
+	var additionalDataPointer *C.uchar
+	if len(additionalData) > 0 {
+		additionalDataPointer = (*C.uchar)(&additionalData[0])
+	}
+	result := C.crypto_aead_aes256gcm_decrypt((*C.uchar)(&buffer[0]),
+		nil,
+		nil,
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		additionalDataPointer,
+		C.ulonglong(len(additionalData)),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&key[0]))
+	if result != 0 {
+		return fmt.Errorf("failed to decrypt: result = %d", result)
+	} else {
+		return nil
+	}
+}
+
+// Gateways answer packets in a cipher suite they don't accept with a cipher suite reject packet, which carries
+// the cipher suite to use instead. Like version rejects, it is much smaller than any packet it answers, and
+// authenticated with the session keys of the packet it answers.
+const CipherSuiteRejectPacket = byte(12)
+
+const CipherSuiteRejectPacketBytes = VersionBytes + PacketTypeBytes + CipherSuiteBytes + RejectMACBytes
+
+func WriteCipherSuiteRejectPacket(buffer []byte, version byte, cipherSuite byte, keys *SessionKeys) int {
+	index := 0
+	WriteUint8(buffer, &index, version)
+	WriteUint8(buffer, &index, CipherSuiteRejectPacket)
+	WriteUint8(buffer, &index, cipherSuite)
+	RejectMAC(keys, buffer[:index], buffer[index:])
+	return CipherSuiteRejectPacketBytes
+}
+
+// ReadCipherSuiteRejectPacket returns false if the packet isn't a cipher suite reject, or wasn't sent with
+// these keys.
+func ReadCipherSuiteRejectPacket(packetData []byte, keys *SessionKeys, cipherSuite *byte) bool {
+	if len(packetData) != CipherSuiteRejectPacketBytes || packetData[VersionBytes] != CipherSuiteRejectPacket {
+		return false
+	}
+	if !VerifyRejectMAC(keys, packetData[:VersionBytes+PacketTypeBytes+CipherSuiteBytes], packetData[VersionBytes+PacketTypeBytes+CipherSuiteBytes:]) {
+		return false
+	}
+	*cipherSuite = packetData[VersionBytes+PacketTypeBytes]
+	return true
+}
+
+// CipherSuiteError is the error a client session closes with when its gateway wants a cipher suite the client
+// can't speak.
+type CipherSuiteError struct {
+	GatewayAddress string
+	CipherSuite    byte
+}
+
+func (err *CipherSuiteError) Error() string {
+	return fmt.Sprintf("gateway %s wants cipher suite %s, which is not available on this machine", err.GatewayAddress, CipherSuiteName(err.CipherSuite))
+}
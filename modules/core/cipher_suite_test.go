@@ -0,0 +1,212 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCipherSuiteNames(t *testing.T) {
+
+	t.Parallel()
+
+	for _, cipherSuite := range CipherSuites {
+		parsed, err := ParseCipherSuite(CipherSuiteName(cipherSuite))
+		assert.NoError(t, err)
+		assert.Equal(t, cipherSuite, parsed)
+	}
+
+	cipherSuite, err := ParseCipherSuite(" AES256GCM ")
+	assert.NoError(t, err)
+	assert.Equal(t, CipherSuite_AES256GCM, cipherSuite)
+
+	_, err = ParseCipherSuite("rot13")
+	assert.Error(t, err)
+
+	assert.Equal(t, "unknown (99)", CipherSuiteName(99))
+}
+
+func TestCipherSuiteAvailable(t *testing.T) {
+
+	t.Parallel()
+
+	assert.True(t, CipherSuiteAvailable(CipherSuite_XChaCha20Poly1305))
+	assert.False(t, CipherSuiteAvailable(99))
+
+	// the preferred cipher suite is the first available one
+
+	preferred := PreferredCipherSuite()
+	assert.True(t, CipherSuiteAvailable(preferred))
+	if CipherSuiteAvailable(CipherSuite_AES256GCM) {
+		assert.Equal(t, CipherSuite_AES256GCM, preferred)
+	} else {
+		assert.Equal(t, CipherSuite_XChaCha20Poly1305, preferred)
+	}
+
+	// clients that predate cipher suites write PayloadPacket where the cipher suite goes
+
+	assert.Equal(t, PayloadPacket, CipherSuite_XChaCha20Poly1305)
+}
+
+func TestEncryptPayloadCipherSuites(t *testing.T) {
+
+	t.Parallel()
+
+	sessionKey := RandomBytes(SessionKeyBytes)
+	data := RandomBytes(256)
+
+	for _, cipherSuite := range CipherSuites {
+
+		if !CipherSuiteAvailable(cipherSuite) {
+			t.Logf("%s is not available", CipherSuiteName(cipherSuite))
+			continue
+		}
+
+		buffer := make([]byte, len(data)+HMACBytes_AEAD)
+		copy(buffer, data)
+
+		encryptedBytes := EncryptPayload(cipherSuite, sessionKey, 1000, 0, buffer, len(data))
+		assert.Equal(t, len(data)+HMACBytes_AEAD, encryptedBytes)
+		assert.NotEqual(t, data, buffer[:len(data)])
+
+		encrypted := make([]byte, len(buffer))
+		copy(encrypted, buffer)
+
+		assert.NoError(t, DecryptPayload(cipherSuite, sessionKey, 1000, 0, buffer, encryptedBytes))
+		assert.Equal(t, data, buffer[:len(data)])
+
+		// the sequence and direction are still part of the nonce
+
+		copy(buffer, encrypted)
+		assert.Error(t, DecryptPayload(cipherSuite, sessionKey, 1001, 0, buffer, encryptedBytes))
+
+		copy(buffer, encrypted)
+		assert.Error(t, DecryptPayload(cipherSuite, sessionKey, 1000, NonceFlags_GatewayToClient, buffer, encryptedBytes))
+
+		// packets don't decrypt with any other cipher suite
+
+		for _, otherCipherSuite := range CipherSuites {
+			if otherCipherSuite != cipherSuite && CipherSuiteAvailable(otherCipherSuite) {
+				copy(buffer, encrypted)
+				assert.Error(t, DecryptPayload(otherCipherSuite, sessionKey, 1000, 0, buffer, encryptedBytes))
+			}
+		}
+
+		assert.Error(t, DecryptPayload(cipherSuite, sessionKey, 1000, 0, buffer, HMACBytes_AEAD-1))
+	}
+
+	buffer := make([]byte, len(data)+HMACBytes_AEAD)
+	assert.Error(t, DecryptPayload(99, sessionKey, 1000, 0, buffer, len(buffer)))
+}
+
+func TestCipherSuiteRejectPacket(t *testing.T) {
+
+	t.Parallel()
+
+	keys := DeriveSessionKeys(RandomBytes(SessionKeyBytes), RandomBytes(SessionIdBytes))
+
+	var packetData [CipherSuiteRejectPacketBytes]byte
+	assert.Equal(t, CipherSuiteRejectPacketBytes, WriteCipherSuiteRejectPacket(packetData[:], PacketVersion_SipHash, CipherSuite_XChaCha20Poly1305, &keys))
+	assert.Equal(t, PacketVersion_SipHash, packetData[0])
+
+	var cipherSuite byte = 99
+	assert.True(t, ReadCipherSuiteRejectPacket(packetData[:], &keys, &cipherSuite))
+	assert.Equal(t, CipherSuite_XChaCha20Poly1305, cipherSuite)
+
+	// version rejects and longer packets aren't cipher suite rejects
+
+	var versionReject [VersionRejectPacketBytes]byte
+	WriteVersionRejectPacket(versionReject[:], PacketVersion_SipHash, &keys)
+	assert.False(t, ReadCipherSuiteRejectPacket(versionReject[:], &keys, &cipherSuite))
+	assert.False(t, ReadCipherSuiteRejectPacket(append(packetData[:], 0), &keys, &cipherSuite))
+
+	// and neither are rejects for other sessions, or rejects with a cipher suite swapped in
+
+	otherKeys := DeriveSessionKeys(RandomBytes(SessionKeyBytes), RandomBytes(SessionIdBytes))
+	assert.False(t, ReadCipherSuiteRejectPacket(packetData[:], &otherKeys, &cipherSuite))
+
+	packetData[VersionBytes+PacketTypeBytes] = CipherSuite_AES256GCM
+	assert.False(t, ReadCipherSuiteRejectPacket(packetData[:], &keys, &cipherSuite))
+
+	err := &CipherSuiteError{GatewayAddress: "127.0.0.1:40000", CipherSuite: CipherSuite_AES256GCM}
+	assert.Equal(t, "gateway 127.0.0.1:40000 wants cipher suite aes256gcm, which is not available on this machine", err.Error())
+}
+
+func TestReadClientPacketCipherSuite(t *testing.T) {
+
+	t.Parallel()
+
+	packetData := make([]byte, MinPacketSize)
+	packetData[VersionBytes] = CipherSuite_AES256GCM
+
+	var clientPacket ClientPacket
+
+	packetData[0] = PacketVersion(CipherSuiteProtocolVersion, PacketFilter_FNV1a)
+	assert.True(t, ReadClientPacket(packetData, &clientPacket))
+	assert.Equal(t, CipherSuite_AES256GCM, clientPacket.CipherSuite)
+
+	// older clients always encrypt with xchacha20poly1305, whatever is in the packet type byte
+
+	packetData[0] = PacketVersion(CipherSuiteProtocolVersion-1, PacketFilter_FNV1a)
+	assert.True(t, ReadClientPacket(packetData, &clientPacket))
+	assert.Equal(t, CipherSuite_XChaCha20Poly1305, clientPacket.CipherSuite)
+}
+
+// TestClientPacketCipherSuites sends a client packet in each cipher suite through the same steps the gateway takes
+
+func TestClientPacketCipherSuites(t *testing.T) {
+
+	t.Parallel()
+
+	authPublicKey, authPrivateKey := Keygen_Sign()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+	clientPublicKey, clientPrivateKey := Keygen_Box()
+
+	sessionToken := SessionToken{}
+	copy(sessionToken.SessionId[:], clientPublicKey)
+
+	sessionKeys := DeriveSessionKeys(SessionKey(gatewayPublicKey, clientPrivateKey), clientPublicKey)
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 30000}
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+	for _, cipherSuite := range CipherSuites {
+		if !CipherSuiteAvailable(cipherSuite) {
+			continue
+		}
+		packetData := writeClientPacketWithCipherSuite(cipherSuite, &sessionKeys, &sessionToken, authPrivateKey, gatewayPublicKey, 1234, MinPayloadBytes, from, to)
+		assert.True(t, receiveClientPacket(packetData, from, to, authPublicKey, gatewayPrivateKey))
+	}
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+// ClientPacket is a packet sent from a client to the gateway, split into its parts before anything is
+// decrypted. The slices point into the packet data.
+type ClientPacket struct {
+	Version              uint8
+	CipherSuite          uint8
+	SessionTokenData     []byte
+	SessionTokenSequence uint64
+	SessionId            []byte
+	Sequence             uint64
+	Header               []byte
+	EncryptedData        []byte
+}
+
+// ReadClientPacket splits a client packet into its parts. It returns false for packets smaller than the
+// smallest packet a client sends, so nothing after it needs to check lengths before the payload is decrypted.
+func ReadClientPacket(packetData []byte, packet *ClientPacket) bool {
+	if len(packetData) < MinPacketSize {
+		return false
+	}
+	packet.Version = packetData[0]
+	packet.CipherSuite = CipherSuite_XChaCha20Poly1305
+	if PacketProtocolVersion(packet.Version) >= CipherSuiteProtocolVersion {
+		packet.CipherSuite = packetData[VersionBytes]
+	}
+	sessionTokenIndex := VersionBytes + PacketTypeBytes + ChonkleBytes
+	packet.SessionTokenData = packetData[sessionTokenIndex : sessionTokenIndex+EncryptedSessionTokenBytes]
+	index := sessionTokenIndex + EncryptedSessionTokenBytes
+	ReadUint64(packetData, &index, &packet.SessionTokenSequence)
+	packet.SessionId = packetData[PrefixBytes : PrefixBytes+SessionIdBytes]
+	index = PrefixBytes + SessionIdBytes
+	ReadUint64(packetData, &index, &packet.Sequence)
+	packet.Header = packetData[PrefixBytes : PrefixBytes+HeaderBytes]
+	packet.EncryptedData = packetData[PrefixBytes+SessionIdBytes+SequenceBytes : len(packetData)-PittleBytes]
+	return true
+}
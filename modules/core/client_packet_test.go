@@ -0,0 +1,289 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeClientPacket writes a payload packet the way the client does, with a session token signed by
+// authPrivateKey and encrypted to gatewayPublicKey.
+func writeClientPacket(sessionKeys *SessionKeys, sessionToken *SessionToken, authPrivateKey []byte, gatewayPublicKey []byte, sequence uint64, payloadBytes int, from *net.UDPAddr, to *net.UDPAddr) []byte {
+	return writeClientPacketWithCipherSuite(CipherSuite_XChaCha20Poly1305, sessionKeys, sessionToken, authPrivateKey, gatewayPublicKey, sequence, payloadBytes, from, to)
+}
+
+func writeClientPacketWithCipherSuite(cipherSuite byte, sessionKeys *SessionKeys, sessionToken *SessionToken, authPrivateKey []byte, gatewayPublicKey []byte, sequence uint64, payloadBytes int, from *net.UDPAddr, to *net.UDPAddr) []byte {
+
+	packetData := make([]byte, PacketBytesFromPayload(payloadBytes))
+
+	index := 0
+	WriteUint8(packetData, &index, PacketVersion_FNV1a)
+	WriteUint8(packetData, &index, cipherSuite)
+	chonkle := packetData[index : index+ChonkleBytes]
+	index += ChonkleBytes
+	WriteEncryptedSessionToken(packetData, &index, sessionToken, authPrivateKey, gatewayPublicKey)
+	WriteUint64(packetData, &index, 0)
+	WriteBytes(packetData, &index, sessionToken.SessionId[:], SessionIdBytes)
+	WriteUint64(packetData, &index, sequence)
+	encryptStart := index
+	index += HeaderBytes - SessionIdBytes - SequenceBytes - FlagsBytes - ChannelIdBytes - AckDelayBytes - PacketTypeBytes
+	WriteUint8(packetData, &index, PayloadPacket)
+	index += FlagsBytes + ChannelIdBytes + AckDelayBytes
+	for i := 0; i < payloadBytes; i++ {
+		WriteUint8(packetData, &index, byte(i))
+	}
+	encryptFinish := index
+	index += HMACBytes_Box
+	pittle := packetData[index : index+PittleBytes]
+
+	EncryptPayload(cipherSuite, sessionKeys.ClientToGateway[:], sequence, 0, packetData[encryptStart:encryptFinish+HMACBytes_AEAD], encryptFinish-encryptStart)
+
+	var magic [MagicBytes]byte
+	var fromAddressData [MaxAddressDataBytes]byte
+	var toAddressData [MaxAddressDataBytes]byte
+	var fromPort, toPort uint16
+	fromAddressBytes := GetAddressData(from, fromAddressData[:], &fromPort)
+	toAddressBytes := GetAddressData(to, toAddressData[:], &toPort)
+	GenerateChonkle(chonkle, magic[:], fromAddressData[:fromAddressBytes], fromPort, toAddressData[:toAddressBytes], toPort, len(packetData))
+	GeneratePittle(pittle, fromAddressData[:fromAddressBytes], fromPort, toAddressData[:toAddressBytes], toPort, len(packetData))
+
+	return packetData
+}
+
+// receiveClientPacket runs a packet through the same steps as the gateway does before a session exists,
+// returning true if the payload decrypts.
+func receiveClientPacket(packetData []byte, from *net.UDPAddr, to *net.UDPAddr, authPublicKey []byte, gatewayPrivateKey []byte) bool {
+
+	var clientPacket ClientPacket
+	if !ReadClientPacket(packetData, &clientPacket) {
+		return false
+	}
+
+	var magic [MagicBytes]byte
+	var fromAddressData [MaxAddressDataBytes]byte
+	var toAddressData [MaxAddressDataBytes]byte
+	filterPacket := FilterPacket{Data: packetData, From: from, Magic: magic[:]}
+	filterPacket.FromAddressData = fromAddressData[:GetAddressData(from, fromAddressData[:], &filterPacket.FromAddressPort)]
+	filterPacket.ToAddressData = toAddressData[:GetAddressData(to, toAddressData[:], &filterPacket.ToAddressPort)]
+	if !CreateFilterChain(BasicFilter{}, AdvancedFilter{}).Filter(&filterPacket) {
+		return false
+	}
+
+	var signedSessionTokenData [SignedSessionTokenBytes]byte
+	if !DecryptSessionToken(clientPacket.SessionTokenData, clientPacket.SessionId, signedSessionTokenData[:], gatewayPrivateKey) {
+		return false
+	}
+
+	index := 0
+	var sessionToken SessionToken
+	if !ReadSignedSessionToken(signedSessionTokenData[:], &index, &sessionToken, authPublicKey) {
+		return false
+	}
+
+	if !IdEqual(sessionToken.SessionId[:], clientPacket.SessionId) {
+		return false
+	}
+
+	sessionKeys := DeriveSessionKeys(SessionKey(clientPacket.SessionId, gatewayPrivateKey), clientPacket.SessionId)
+
+	return DecryptPayload(clientPacket.CipherSuite, sessionKeys.ClientToGateway[:], clientPacket.Sequence, 0, clientPacket.EncryptedData, len(clientPacket.EncryptedData)) == nil
+}
+
+func TestReadClientPacket(t *testing.T) {
+
+	t.Parallel()
+
+	authPublicKey, authPrivateKey := Keygen_Sign()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+	clientPublicKey, clientPrivateKey := Keygen_Box()
+
+	sessionToken := SessionToken{}
+	copy(sessionToken.SessionId[:], clientPublicKey)
+
+	sessionKeys := DeriveSessionKeys(SessionKey(gatewayPublicKey, clientPrivateKey), clientPublicKey)
+
+	from := ParseAddress("127.0.0.1:30000")
+	to := ParseAddress("127.0.0.1:40000")
+
+	packetData := writeClientPacket(&sessionKeys, &sessionToken, authPrivateKey, gatewayPublicKey, 1234, MinPayloadBytes, from, to)
+
+	var clientPacket ClientPacket
+	assert.True(t, ReadClientPacket(packetData, &clientPacket))
+	assert.Equal(t, PacketVersion_FNV1a, clientPacket.Version)
+	assert.Equal(t, CipherSuite_XChaCha20Poly1305, clientPacket.CipherSuite)
+	assert.Equal(t, EncryptedSessionTokenBytes, len(clientPacket.SessionTokenData))
+	assert.Equal(t, uint64(0), clientPacket.SessionTokenSequence)
+	assert.Equal(t, clientPublicKey, clientPacket.SessionId)
+	assert.Equal(t, uint64(1234), clientPacket.Sequence)
+	assert.Equal(t, HeaderBytes, len(clientPacket.Header))
+	assert.Equal(t, len(packetData)-PrefixBytes-SessionIdBytes-SequenceBytes-PittleBytes, len(clientPacket.EncryptedData))
+
+	assert.True(t, receiveClientPacket(packetData, from, to, authPublicKey, gatewayPrivateKey))
+
+	// packets too small to hold a payload don't read
+
+	assert.False(t, ReadClientPacket(packetData[:MinPacketSize-1], &clientPacket))
+	assert.False(t, ReadClientPacket(nil, &clientPacket))
+}
+
+// the fuzz targets use fixed keys, so the seeds in testdata/fuzz get past decryption. if the wire format
+// changes, rewrite the seeds with "go test ./modules/core -run TestFuzzSeeds -update"
+
+var update = flag.Bool("update", false, "rewrite the fuzz seeds in testdata/fuzz")
+
+var fuzzAuthPrivateKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+var fuzzAuthPublicKey = []byte(fuzzAuthPrivateKey.Public().(ed25519.PublicKey))
+var fuzzGatewayPrivateKey = bytes.Repeat([]byte{2}, PrivateKeyBytes_Box)
+var fuzzClientPrivateKey = bytes.Repeat([]byte{3}, PrivateKeyBytes_Box)
+
+var fuzzFrom = ParseAddress("127.0.0.1:30000")
+var fuzzTo = ParseAddress("127.0.0.1:40000")
+
+func writeFuzzClientPacket(sequence uint64, payloadBytes int) []byte {
+	gatewayPublicKey := PublicKey_Box(fuzzGatewayPrivateKey)
+	clientPublicKey := PublicKey_Box(fuzzClientPrivateKey)
+	sessionToken := SessionToken{}
+	copy(sessionToken.SessionId[:], clientPublicKey)
+	sessionKeys := DeriveSessionKeys(SessionKey(gatewayPublicKey, fuzzClientPrivateKey), clientPublicKey)
+	return writeClientPacket(&sessionKeys, &sessionToken, fuzzAuthPrivateKey, gatewayPublicKey, sequence, payloadBytes, fuzzFrom, fuzzTo)
+}
+
+func writeFuzzConnectToken() []byte {
+	userId := make([]byte, UserIdBytes)
+	return GenerateConnectToken(userId, 256, 256, 10, 0, 0, 60, fuzzTo, PublicKey_Box(fuzzGatewayPrivateKey), fuzzAuthPrivateKey)
+}
+
+// readFuzzSeed reads a seed file in the format go test writes to testdata/fuzz
+func readFuzzSeed(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0] != "go test fuzz v1" || !strings.HasPrefix(lines[1], "[]byte(") || !strings.HasSuffix(lines[1], ")") {
+		return nil, fmt.Errorf("%s is not a []byte fuzz seed", path)
+	}
+	seed, err := strconv.Unquote(strings.TrimSuffix(strings.TrimPrefix(lines[1], "[]byte("), ")"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a []byte fuzz seed: %v", path, err)
+	}
+	return []byte(seed), nil
+}
+
+func writeFuzzSeed(path string, seed []byte) error {
+	return os.WriteFile(path, []byte(fmt.Sprintf("go test fuzz v1\n[]byte(%s)\n", strconv.Quote(string(seed)))), 0644)
+}
+
+func TestFuzzSeeds(t *testing.T) {
+
+	clientPackets := map[string][]byte{
+		"payload_packet":               writeFuzzClientPacket(1, MinPayloadBytes),
+		"payload_packet_next_sequence": writeFuzzClientPacket(2, MinPayloadBytes+100),
+	}
+
+	connectTokens := map[string][]byte{
+		"connect_token": writeFuzzConnectToken(),
+	}
+
+	if *update {
+		for name, seed := range clientPackets {
+			assert.Nil(t, writeFuzzSeed(filepath.Join("testdata/fuzz/FuzzReadClientPacket", name), seed))
+		}
+		for name, seed := range connectTokens {
+			assert.Nil(t, writeFuzzSeed(filepath.Join("testdata/fuzz/FuzzReadConnectToken", name), seed))
+		}
+	}
+
+	// the session token is encrypted with a fresh ephemeral key each time, so the seeds can't be compared to
+	// what is written now. they have to get all the way through instead
+
+	for name := range clientPackets {
+		packetData, err := readFuzzSeed(filepath.Join("testdata/fuzz/FuzzReadClientPacket", name))
+		assert.Nil(t, err)
+		assert.True(t, receiveClientPacket(packetData, fuzzFrom, fuzzTo, fuzzAuthPublicKey, fuzzGatewayPrivateKey), name)
+	}
+
+	for name := range connectTokens {
+		connectToken, err := readFuzzSeed(filepath.Join("testdata/fuzz/FuzzReadConnectToken", name))
+		assert.Nil(t, err)
+		index := 0
+		var connectData ConnectData
+		if !assert.True(t, ReadConnectData(connectToken, &index, &connectData), name) {
+			continue
+		}
+		signedSessionTokenData := make([]byte, SignedSessionTokenBytes)
+		assert.True(t, DecryptSessionToken(connectToken[ConnectDataBytes:], connectData.ClientPublicKey[:], signedSessionTokenData, fuzzGatewayPrivateKey), name)
+		index = 0
+		var sessionToken SessionToken
+		assert.True(t, ReadSignedSessionToken(signedSessionTokenData, &index, &sessionToken, fuzzAuthPublicKey), name)
+	}
+}
+
+// FuzzReadClientPacket feeds packets through everything the gateway does to a packet from a client before it
+// has a session.
+func FuzzReadClientPacket(f *testing.F) {
+
+	f.Add(writeFuzzClientPacket(1, MinPayloadBytes))
+	f.Add(writeFuzzClientPacket(2, MinPayloadBytes+100))
+
+	proxyPacket := make([]byte, ProxyProtocolHeaderBytes+ProxyProtocolAddressBytes_UDP4+MinPacketSize)
+	headerBytes := WriteProxyHeader(proxyPacket, fuzzFrom, fuzzTo)
+	copy(proxyPacket[headerBytes:], writeFuzzClientPacket(3, MinPayloadBytes))
+	f.Add(proxyPacket)
+
+	f.Fuzz(func(t *testing.T, packetData []byte) {
+
+		// load balancers in front of the gateway can prepend a proxy protocol header
+
+		packetFrom := fuzzFrom
+		if headerBytes, source, err := ReadProxyHeader(packetData); err == nil {
+			assert.LessOrEqual(t, headerBytes, len(packetData))
+			packetData = packetData[headerBytes:]
+			if source != nil {
+				packetFrom = source
+			}
+		}
+
+		receiveClientPacket(packetData, packetFrom, fuzzTo, fuzzAuthPublicKey, fuzzGatewayPrivateKey)
+	})
+}
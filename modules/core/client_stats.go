@@ -0,0 +1,197 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Clients send a stats packet every so often with how the session looks from their end. The gateway
+// attaches the latest stats to its analytics events, and forwards the packet to the server like a
+// keep-alive so it is acked.
+const ClientStatsPacket = byte(10)
+
+const ClientStatsVersion = 0
+
+const ClientStatsBytes = 1 + 1 + 1 + 2
+
+// MaxClientStatsRTT is the largest RTT a stats packet can carry. Larger RTTs are capped.
+const MaxClientStatsRTT = 65535 * time.Millisecond
+
+// FrameRateBucket is the client frame rate, bucketed so it is coarse enough to aggregate.
+type FrameRateBucket uint8
+
+const (
+	FrameRateUnknown FrameRateBucket = iota
+	FrameRateBelow30
+	FrameRate30
+	FrameRate60
+	FrameRate120
+	NumFrameRateBuckets
+)
+
+func (bucket FrameRateBucket) String() string {
+	switch bucket {
+	case FrameRateUnknown:
+		return "unknown"
+	case FrameRateBelow30:
+		return "<30"
+	case FrameRate30:
+		return "30-59"
+	case FrameRate60:
+		return "60-119"
+	case FrameRate120:
+		return "120+"
+	}
+	return fmt.Sprintf("unknown(%d)", int(bucket))
+}
+
+// GetFrameRateBucket returns the bucket for a frame rate in frames per second. Frame rates are rounded
+// first, so 59.94 fps is in the 60 fps bucket. Zero or less is unknown.
+func GetFrameRateBucket(frameRate float64) FrameRateBucket {
+	frameRate = math.Round(frameRate)
+	switch {
+	case frameRate <= 0:
+		return FrameRateUnknown
+	case frameRate < 30:
+		return FrameRateBelow30
+	case frameRate < 60:
+		return FrameRate30
+	case frameRate < 120:
+		return FrameRate60
+	}
+	return FrameRate120
+}
+
+// Platform is the platform the client is running on.
+type Platform uint8
+
+const (
+	PlatformUnknown Platform = iota
+	PlatformWindows
+	PlatformMac
+	PlatformLinux
+	PlatformIOS
+	PlatformAndroid
+	PlatformPlayStation
+	PlatformXbox
+	PlatformSwitch
+	NumPlatforms
+)
+
+func (platform Platform) String() string {
+	switch platform {
+	case PlatformUnknown:
+		return "unknown"
+	case PlatformWindows:
+		return "windows"
+	case PlatformMac:
+		return "mac"
+	case PlatformLinux:
+		return "linux"
+	case PlatformIOS:
+		return "ios"
+	case PlatformAndroid:
+		return "android"
+	case PlatformPlayStation:
+		return "playstation"
+	case PlatformXbox:
+		return "xbox"
+	case PlatformSwitch:
+		return "switch"
+	}
+	return fmt.Sprintf("unknown(%d)", int(platform))
+}
+
+func ParsePlatform(value string) (Platform, error) {
+	for platform := Platform(0); platform < NumPlatforms; platform++ {
+		if strings.EqualFold(value, platform.String()) {
+			return platform, nil
+		}
+	}
+	return PlatformUnknown, fmt.Errorf("unknown platform %q", value)
+}
+
+// ClientStats is what the client reports about the session. RTT is the RTT the client perceives, to the
+// millisecond.
+type ClientStats struct {
+	FrameRate FrameRateBucket
+	RTT       time.Duration
+	Platform  Platform
+}
+
+// WriteClientStats writes client stats to the start of a stats packet payload.
+func WriteClientStats(payload []byte, stats *ClientStats) {
+	rtt := stats.RTT
+	if rtt > MaxClientStatsRTT {
+		rtt = MaxClientStatsRTT
+	}
+	if rtt < 0 {
+		rtt = 0
+	}
+	index := 0
+	WriteUint8(payload, &index, ClientStatsVersion)
+	WriteUint8(payload, &index, uint8(stats.FrameRate))
+	WriteUint8(payload, &index, uint8(stats.Platform))
+	WriteUint16(payload, &index, uint16(rtt/time.Millisecond))
+}
+
+// ReadClientStats reads client stats from a stats packet payload. Unknown frame rate buckets and
+// platforms read as unknown, so older gateways can read stats from newer clients.
+func ReadClientStats(payload []byte, stats *ClientStats) bool {
+	if len(payload) < ClientStatsBytes {
+		return false
+	}
+	index := 0
+	var version, frameRate, platform uint8
+	var rtt uint16
+	ReadUint8(payload, &index, &version)
+	if version != ClientStatsVersion {
+		return false
+	}
+	ReadUint8(payload, &index, &frameRate)
+	ReadUint8(payload, &index, &platform)
+	ReadUint16(payload, &index, &rtt)
+	stats.FrameRate = FrameRateBucket(frameRate)
+	if stats.FrameRate >= NumFrameRateBuckets {
+		stats.FrameRate = FrameRateUnknown
+	}
+	stats.Platform = Platform(platform)
+	if stats.Platform >= NumPlatforms {
+		stats.Platform = PlatformUnknown
+	}
+	stats.RTT = time.Duration(rtt) * time.Millisecond
+	return true
+}
@@ -0,0 +1,94 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetFrameRateBucket(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, FrameRateUnknown, GetFrameRateBucket(0))
+	assert.Equal(t, FrameRateBelow30, GetFrameRateBucket(24))
+	assert.Equal(t, FrameRate30, GetFrameRateBucket(30))
+	assert.Equal(t, FrameRate60, GetFrameRateBucket(59.94))
+	assert.Equal(t, FrameRate60, GetFrameRateBucket(60))
+	assert.Equal(t, FrameRate120, GetFrameRateBucket(144))
+	assert.Equal(t, "60-119", FrameRate60.String())
+}
+
+func TestParsePlatform(t *testing.T) {
+	t.Parallel()
+	for platform := Platform(0); platform < NumPlatforms; platform++ {
+		parsed, err := ParsePlatform(platform.String())
+		assert.Nil(t, err)
+		assert.Equal(t, platform, parsed)
+	}
+	platform, err := ParsePlatform("PlayStation")
+	assert.Nil(t, err)
+	assert.Equal(t, PlatformPlayStation, platform)
+	_, err = ParsePlatform("amiga")
+	assert.NotNil(t, err)
+}
+
+func TestClientStats(t *testing.T) {
+
+	t.Parallel()
+
+	payload := make([]byte, MinPayloadBytes)
+
+	stats := ClientStats{FrameRate: FrameRate60, RTT: 42 * time.Millisecond, Platform: PlatformSwitch}
+	WriteClientStats(payload, &stats)
+
+	var read ClientStats
+	assert.True(t, ReadClientStats(payload, &read))
+	assert.Equal(t, stats, read)
+
+	// rtt is capped, and unknown values from newer clients read as unknown
+
+	stats.RTT = time.Minute * 2
+	WriteClientStats(payload, &stats)
+	payload[1] = 200
+	payload[2] = 200
+	assert.True(t, ReadClientStats(payload, &read))
+	assert.Equal(t, MaxClientStatsRTT, read.RTT)
+	assert.Equal(t, FrameRateUnknown, read.FrameRate)
+	assert.Equal(t, PlatformUnknown, read.Platform)
+
+	assert.False(t, ReadClientStats(payload[:ClientStatsBytes-1], &read))
+
+	payload[0] = ClientStatsVersion + 1
+	assert.False(t, ReadClientStats(payload, &read))
+}
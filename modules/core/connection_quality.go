@@ -0,0 +1,151 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// Quality is a coarse grade of connection quality, for games to act on, eg. by raising interpolation
+// delay or warning the player. QualityUnknown is before there is anything to grade.
+type Quality int
+
+const (
+	QualityUnknown Quality = iota
+	QualityPoor
+	QualityFair
+	QualityGood
+	QualityExcellent
+)
+
+func (quality Quality) String() string {
+	switch quality {
+	case QualityUnknown:
+		return "unknown"
+	case QualityPoor:
+		return "poor"
+	case QualityFair:
+		return "fair"
+	case QualityGood:
+		return "good"
+	case QualityExcellent:
+		return "excellent"
+	}
+	return fmt.Sprintf("unknown(%d)", int(quality))
+}
+
+// scores at or above each threshold get that quality or better
+
+const QualityFairScore = 40.0
+const QualityGoodScore = 60.0
+const QualityExcellentScore = 80.0
+
+// the score has to be this far past a threshold to change quality, so it doesn't flap around the threshold
+
+const QualityHysteresis = 5.0
+
+// the rolling score moves this fraction of the way to each new score
+
+const QualitySmoothing = 0.25
+
+// QualityScore scores a connection from 0 to 100. Latency counts as RTT plus twice the jitter, and costs
+// a point per 4ms over 20ms. Each percent of packet loss costs 2.5 points.
+func QualityScore(rtt time.Duration, jitter time.Duration, packetLoss float64) float64 {
+	latency := float64(rtt+2*jitter) / float64(time.Millisecond)
+	score := 100.0
+	if latency > 20 {
+		score -= (latency - 20) / 4
+	}
+	score -= packetLoss * 100 * 2.5
+	if score < 0 {
+		score = 0
+	}
+	if score > 100 {
+		score = 100
+	}
+	return score
+}
+
+func qualityForScore(score float64) Quality {
+	switch {
+	case score >= QualityExcellentScore:
+		return QualityExcellent
+	case score >= QualityGoodScore:
+		return QualityGood
+	case score >= QualityFairScore:
+		return QualityFair
+	}
+	return QualityPoor
+}
+
+// ConnectionQuality keeps a rolling quality score for a connection from its path stats, and grades it.
+// It is not safe for concurrent use.
+type ConnectionQuality struct {
+	score   float64
+	quality Quality
+}
+
+// Update scores the latest path stats into the rolling score. It returns true when the quality changes.
+// Nothing is scored until a packet has been acked.
+func (connectionQuality *ConnectionQuality) Update(stats PathStatsSnapshot) bool {
+
+	if stats.PacketsAcked == 0 {
+		return false
+	}
+
+	score := QualityScore(stats.RTT, stats.Jitter, stats.PacketLoss)
+
+	if connectionQuality.quality == QualityUnknown {
+		connectionQuality.score = score
+		connectionQuality.quality = qualityForScore(score)
+		return true
+	}
+
+	connectionQuality.score += (score - connectionQuality.score) * QualitySmoothing
+
+	quality := connectionQuality.quality
+	if up := qualityForScore(connectionQuality.score - QualityHysteresis); up > quality {
+		quality = up
+	} else if down := qualityForScore(connectionQuality.score + QualityHysteresis); down < quality {
+		quality = down
+	}
+
+	changed := quality != connectionQuality.quality
+	connectionQuality.quality = quality
+	return changed
+}
+
+// Quality returns the current quality and rolling score.
+func (connectionQuality *ConnectionQuality) Quality() (Quality, float64) {
+	return connectionQuality.quality, connectionQuality.score
+}
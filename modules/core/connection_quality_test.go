@@ -0,0 +1,106 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQualityScore(t *testing.T) {
+
+	t.Parallel()
+
+	assert.Equal(t, 100.0, QualityScore(10*time.Millisecond, 0, 0))
+	assert.Equal(t, 80.0, QualityScore(100*time.Millisecond, 0, 0))
+	assert.Equal(t, 80.0, QualityScore(60*time.Millisecond, 20*time.Millisecond, 0))
+	assert.Equal(t, 75.0, QualityScore(10*time.Millisecond, 0, 0.1))
+	assert.Equal(t, 0.0, QualityScore(time.Second, 0, 0.5))
+
+	assert.Equal(t, QualityExcellent, qualityForScore(80))
+	assert.Equal(t, QualityGood, qualityForScore(79))
+	assert.Equal(t, QualityFair, qualityForScore(40))
+	assert.Equal(t, QualityPoor, qualityForScore(39))
+	assert.Equal(t, "excellent", QualityExcellent.String())
+}
+
+func TestConnectionQuality(t *testing.T) {
+
+	t.Parallel()
+
+	var connectionQuality ConnectionQuality
+
+	// nothing is graded until something is acked
+
+	assert.False(t, connectionQuality.Update(PathStatsSnapshot{RTT: 10 * time.Millisecond}))
+	quality, _ := connectionQuality.Quality()
+	assert.Equal(t, QualityUnknown, quality)
+
+	good := PathStatsSnapshot{RTT: 10 * time.Millisecond, PacketsAcked: 1}
+	assert.True(t, connectionQuality.Update(good))
+	quality, score := connectionQuality.Quality()
+	assert.Equal(t, QualityExcellent, quality)
+	assert.Equal(t, 100.0, score)
+
+	// the rolling score falls gradually, so one bad update doesn't change the quality
+
+	bad := PathStatsSnapshot{RTT: 10 * time.Millisecond, PacketLoss: 0.12, PacketsAcked: 1}
+	assert.False(t, connectionQuality.Update(bad))
+
+	changes := 0
+	for i := 0; i < 20; i++ {
+		if connectionQuality.Update(bad) {
+			changes++
+		}
+	}
+	quality, score = connectionQuality.Quality()
+	assert.Equal(t, QualityGood, quality)
+	assert.InDelta(t, 70.0, score, 0.1)
+	assert.Equal(t, 1, changes)
+
+	// a score just over the threshold isn't enough to go back up
+
+	okay := PathStatsSnapshot{RTT: 10 * time.Millisecond, PacketLoss: 0.072, PacketsAcked: 1}
+	for i := 0; i < 20; i++ {
+		assert.False(t, connectionQuality.Update(okay))
+	}
+	quality, _ = connectionQuality.Quality()
+	assert.Equal(t, QualityGood, quality)
+
+	for i := 0; i < 20; i++ {
+		connectionQuality.Update(good)
+	}
+	quality, _ = connectionQuality.Quality()
+	assert.Equal(t, QualityExcellent, quality)
+}
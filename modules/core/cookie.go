@@ -0,0 +1,114 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"time"
+)
+
+// Gateways under attack answer packets from unknown addresses with a cookie instead of decrypting their tokens.
+// The cookie is a keyed hash of the source address and the current time window, so the gateway keeps no state
+// for it, and only a client that receives packets at its address can echo it back around its next packets.
+const CookiePacket = byte(13)
+const CookieEchoPacket = byte(14)
+
+const CookieBytes = 8
+
+// CookieWindow is how often cookies change. Cookies from the previous window are still accepted, so a cookie
+// is valid for at least one window.
+const CookieWindow = 10 * time.Second
+
+const CookiePacketBytes = VersionBytes + PacketTypeBytes + CookieBytes
+const CookieEchoHeaderBytes = VersionBytes + PacketTypeBytes + CookieBytes
+
+func cookieForWindow(key []byte, address *net.UDPAddr, window uint64) uint64 {
+	var buffer [8 + MaxAddressDataBytes + 2]byte
+	index := 0
+	WriteUint64(buffer[:], &index, window)
+	var port uint16
+	index += GetAddressData(address, buffer[index:index+MaxAddressDataBytes], &port)
+	WriteUint16(buffer[:], &index, port)
+	return SipHash24(key, buffer[:index])
+}
+
+func cookieWindow(currentTime time.Time) uint64 {
+	return uint64(currentTime.UnixNano() / int64(CookieWindow))
+}
+
+func GenerateCookie(key []byte, address *net.UDPAddr, currentTime time.Time) uint64 {
+	return cookieForWindow(key, address, cookieWindow(currentTime))
+}
+
+func VerifyCookie(key []byte, address *net.UDPAddr, cookie uint64, currentTime time.Time) bool {
+	window := cookieWindow(currentTime)
+	return cookie == cookieForWindow(key, address, window) || cookie == cookieForWindow(key, address, window-1)
+}
+
+func WriteCookiePacket(buffer []byte, version byte, cookie uint64) int {
+	index := 0
+	WriteUint8(buffer, &index, version)
+	WriteUint8(buffer, &index, CookiePacket)
+	WriteUint64(buffer, &index, cookie)
+	return CookiePacketBytes
+}
+
+func ReadCookiePacket(packetData []byte, cookie *uint64) bool {
+	if len(packetData) != CookiePacketBytes || packetData[VersionBytes] != CookiePacket {
+		return false
+	}
+	index := VersionBytes + PacketTypeBytes
+	return ReadUint64(packetData, &index, cookie)
+}
+
+// WriteCookieEchoPacket writes the packet with the cookie in front of it. The buffer must have room for
+// CookieEchoHeaderBytes more than the packet.
+func WriteCookieEchoPacket(buffer []byte, version byte, cookie uint64, packetData []byte) int {
+	index := 0
+	WriteUint8(buffer, &index, version)
+	WriteUint8(buffer, &index, CookieEchoPacket)
+	WriteUint64(buffer, &index, cookie)
+	index += copy(buffer[index:], packetData)
+	return index
+}
+
+// ReadCookieEchoPacket reads the cookie and returns the packet it was echoed with.
+func ReadCookieEchoPacket(packetData []byte, cookie *uint64) ([]byte, bool) {
+	if len(packetData) <= CookieEchoHeaderBytes || packetData[VersionBytes] != CookieEchoPacket {
+		return nil, false
+	}
+	index := VersionBytes + PacketTypeBytes
+	if !ReadUint64(packetData, &index, cookie) {
+		return nil, false
+	}
+	return packetData[index:], true
+}
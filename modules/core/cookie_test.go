@@ -0,0 +1,112 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookie(t *testing.T) {
+
+	t.Parallel()
+
+	key := RandomBytes(SipHashKeyBytes)
+
+	address := ParseAddress("10.0.0.1:30000")
+	currentTime := time.Unix(1000000, 0)
+
+	cookie := GenerateCookie(key, address, currentTime)
+	assert.Equal(t, cookie, GenerateCookie(key, ParseAddress("10.0.0.1:30000"), currentTime))
+	assert.True(t, VerifyCookie(key, address, cookie, currentTime))
+
+	// cookies are accepted until the end of the next window
+
+	assert.True(t, VerifyCookie(key, address, cookie, currentTime.Add(CookieWindow)))
+	assert.False(t, VerifyCookie(key, address, cookie, currentTime.Add(2*CookieWindow)))
+	assert.False(t, VerifyCookie(key, address, cookie, currentTime.Add(-CookieWindow)))
+
+	// cookies are only valid for the address they were sent to, and the key they were made with
+
+	assert.False(t, VerifyCookie(key, ParseAddress("10.0.0.1:30001"), cookie, currentTime))
+	assert.False(t, VerifyCookie(key, ParseAddress("10.0.0.2:30000"), cookie, currentTime))
+	assert.False(t, VerifyCookie(key, ParseAddress("[::1]:30000"), cookie, currentTime))
+
+	otherKey := RandomBytes(SipHashKeyBytes)
+	assert.False(t, VerifyCookie(otherKey, address, cookie, currentTime))
+}
+
+func TestCookiePacket(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 256)
+	packetBytes := WriteCookiePacket(buffer, PacketVersion_FNV1a, 0x1122334455667788)
+	assert.Equal(t, CookiePacketBytes, packetBytes)
+	assert.Equal(t, PacketVersion_FNV1a, buffer[0])
+	assert.Equal(t, CookiePacket, buffer[VersionBytes])
+
+	var cookie uint64
+	assert.True(t, ReadCookiePacket(buffer[:packetBytes], &cookie))
+	assert.Equal(t, uint64(0x1122334455667788), cookie)
+
+	assert.False(t, ReadCookiePacket(buffer[:packetBytes-1], &cookie))
+	assert.False(t, ReadCookiePacket(buffer[:packetBytes+1], &cookie))
+	buffer[VersionBytes] = CookieEchoPacket
+	assert.False(t, ReadCookiePacket(buffer[:packetBytes], &cookie))
+}
+
+func TestCookieEchoPacket(t *testing.T) {
+
+	t.Parallel()
+
+	packetData := RandomBytes(100)
+
+	buffer := make([]byte, len(packetData)+CookieEchoHeaderBytes)
+	packetBytes := WriteCookieEchoPacket(buffer, PacketVersion_FNV1a, 0x1122334455667788, packetData)
+	assert.Equal(t, len(packetData)+CookieEchoHeaderBytes, packetBytes)
+	assert.Equal(t, CookieEchoPacket, buffer[VersionBytes])
+
+	var cookie uint64
+	echoedPacketData, ok := ReadCookieEchoPacket(buffer[:packetBytes], &cookie)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0x1122334455667788), cookie)
+	assert.Equal(t, packetData, echoedPacketData)
+
+	_, ok = ReadCookieEchoPacket(buffer[:CookieEchoHeaderBytes], &cookie)
+	assert.False(t, ok)
+	buffer[VersionBytes] = CookiePacket
+	_, ok = ReadCookieEchoPacket(buffer[:packetBytes], &cookie)
+	assert.False(t, ok)
+}
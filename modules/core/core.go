@@ -43,9 +43,11 @@ import (
 	"hash/fnv"
 	"math"
 	"net"
-	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/networknext/udpx/modules/log"
 )
 
 const MagicBytes = 8
@@ -60,23 +62,67 @@ const AckBytes = 8
 const AckBitsBytes = 32
 const PittleBytes = 2
 const AddressBytes = 19
+const MaxAddressDataBytes = 16
 const PacketTypeBytes = 1
 const FlagsBytes = 1
+const ChannelIdBytes = 1
+const AckDelayBytes = 4
+
+// The version byte at the start of each packet has the protocol version in its high four bits and the packet
+// filter in its low four bits. Bump ProtocolVersion whenever the packet format changes, and add the change to
+// ProtocolVersions in version.go. Keep the prefix up to the session id and the packet filter the same, so
+// gateways can answer versions they don't read with version rejects.
+const ProtocolVersion = byte(2)
+
+const PacketFilter_FNV1a = byte(0)
+const PacketFilter_SipHash = byte(1)
+
+const PacketVersion_FNV1a = ProtocolVersion<<4 | PacketFilter_FNV1a
+const PacketVersion_SipHash = ProtocolVersion<<4 | PacketFilter_SipHash
 
 const PayloadPacket = byte(0)
 const ChallengePacket = byte(1)
+const ServerPingPacket = byte(2)
+const ServerPongPacket = byte(3)
+const KeepAlivePacket = byte(4)
+const DisconnectPacket = byte(5)
+const MTUProbePacket = byte(6)
+
+const UnreliableChannel = byte(0)
+const ReliableChannel = byte(1)
+const FragmentChannel = byte(2)
+const FECChannel = byte(3)
+
+const ServerPingPacketBytes = VersionBytes + PacketTypeBytes + SequenceBytes
+const MTUProbeSizeBytes = 2
 
 const PublicKeyBytes_Box = 32
 const PrivateKeyBytes_Box = 32
 const NonceBytes_Box = 24
 const HMACBytes_Box = 16
 
+const PublicKeyBytes_Sign = 32
+const PrivateKeyBytes_Sign = 64
+const SignatureBytes_Sign = 64
+
 const PrivateKeyBytes_SecretBox = 32
 const NonceBytes_SecretBox = 24
 const HMACBytes_SecretBox = 16
 
+const KeyBytes_Stream = 32
+const NonceBytes_Stream = 24
+
+const KeyBytes_AEAD = 32
+const NonceBytes_AEAD = 24
+const HMACBytes_AEAD = 16
+
+const SessionKeyBytes = KeyBytes_AEAD
+
+const NonceFlags_GatewayToClient = (1 << 0)
+const NonceFlags_Challenge = (1 << 1)
+
 const PrefixBytes = VersionBytes + PacketTypeBytes + ChonkleBytes + EncryptedSessionTokenBytes + SequenceBytes
-const HeaderBytes = SessionIdBytes + SequenceBytes + AckBytes + AckBitsBytes + GatewayIdBytes + ServerIdBytes + PacketTypeBytes + FlagsBytes
+const HeaderBytes = SessionIdBytes + SequenceBytes + AckBytes + AckBitsBytes + GatewayIdBytes + ServerIdBytes + PacketTypeBytes + FlagsBytes + ChannelIdBytes + AckDelayBytes
 const PostfixBytes = HMACBytes_Box + PittleBytes
 
 const MinPayloadBytes = 1000
@@ -84,27 +130,56 @@ const MinPayloadBytes = 1000
 const MinPacketSize = PrefixBytes + HeaderBytes + MinPayloadBytes + PostfixBytes
 
 const Flags_ChallengeToken = (1 << 0)
+const Flags_OverBandwidth = (1 << 1)
+const Flags_PriorityHigh = (1 << 2)
+const Flags_PriorityLow = (1 << 3)
 
-const ChallengePacketBytes = PrefixBytes + NonceBytes_Box + EncryptedChallengeTokenBytes + SequenceBytes + GatewayIdBytes + PostfixBytes
+const ChallengePacketBytes = PrefixBytes + NonceBytes_Box + EncryptedChallengeTokenBytes + SequenceBytes + GatewayIdBytes + KeyConfirmationBytes + PostfixBytes
 
 const ConnectTokenExpireSeconds = 20
 const SessionTokenExtensionSeconds = 10
+const TimestampToleranceSeconds = 5
+
+const TimestampBytes = 8
 
 const EnvelopeBytes = 8
 
 const PacketsPerSecondBytes = 1
 
-const SessionTokenBytes = 8 + SessionIdBytes + UserIdBytes + EnvelopeBytes + PacketsPerSecondBytes
-const EncryptedSessionTokenBytes = NonceBytes_SecretBox + SessionTokenBytes + HMACBytes_SecretBox
+const FECConfigBytes = 2
+
+const ClientIPBytes = net.IPv6len
 
-const ConnectDataBytes = PublicKeyBytes_Box + PrivateKeyBytes_Box + AddressBytes + PublicKeyBytes_Box + EnvelopeBytes + PacketsPerSecondBytes
+const TenantIdBytes = 2
+
+const SessionTokenBytes = TimestampBytes + TimestampBytes + SessionIdBytes + UserIdBytes + EnvelopeBytes + PacketsPerSecondBytes + ClientIPBytes + TenantIdBytes
+const SignedSessionTokenBytes = SessionTokenBytes + SignatureBytes_Sign
+
+// Session tokens travel in every client packet, so they are encrypted to the gateway on the wire: an ephemeral
+// public key, then the signed session token without its session id, which is in the packet header already.
+// The signature authenticates the token, so there is no MAC, and encrypted tokens are no bigger than signed ones.
+const EncryptedSessionTokenBytes = PublicKeyBytes_Box + SignedSessionTokenBytes - SessionIdBytes
+
+const ConnectDataBytes = PublicKeyBytes_Box + PrivateKeyBytes_Box + AddressBytes + PublicKeyBytes_Box + EnvelopeBytes + PacketsPerSecondBytes + FECConfigBytes + TimestampBytes
 
 const ConnectTokenBytes = ConnectDataBytes + EncryptedSessionTokenBytes
 
+const MaxFallbackGateways = 4
+
+const MaxConnectTokenBytes = ConnectTokenBytes + 1 + MaxFallbackGateways*AddressBytes
+
+const MaxVarint32Bytes = 5
+const MaxVarint64Bytes = 10
+
 const EthernetHeaderBytes = 18
 const IPv4HeaderBytes = 18
 const UDPHeaderBytes = 8
 
+// clients tunnelling packets over a websocket are told the loopback address the gateway sees their packets
+// coming from in this handshake response header, since the packet filter is keyed on it
+
+const WebSocketClientAddressHeader = "Udpx-Client-Address"
+
 func Keygen_Box() ([]byte, []byte) {
 	var publicKey [PublicKeyBytes_Box]byte
 	var privateKey [PrivateKeyBytes_Box]byte
@@ -113,6 +188,14 @@ func Keygen_Box() ([]byte, []byte) {
 	return publicKey[:], privateKey[:]
 }
 
+func Keygen_Sign() ([]byte, []byte) {
+	var publicKey [PublicKeyBytes_Sign]byte
+	var privateKey [PrivateKeyBytes_Sign]byte
+	C.crypto_sign_keypair((*C.uchar)(&publicKey[0]),
+		(*C.uchar)(&privateKey[0]))
+	return publicKey[:], privateKey[:]
+}
+
 func Encrypt_Box(senderPrivateKey []byte, receiverPublicKey []byte, nonce []byte, buffer []byte, bytes int) int {
 	C.crypto_box_easy((*C.uchar)(&buffer[0]),
 		(*C.uchar)(&buffer[0]),
@@ -138,6 +221,34 @@ func Decrypt_Box(senderPublicKey []byte, receiverPrivateKey []byte, nonce []byte
 	}
 }
 
+func PublicKey_Box(privateKey []byte) []byte {
+	var publicKey [PublicKeyBytes_Box]byte
+	C.crypto_scalarmult_base((*C.uchar)(&publicKey[0]),
+		(*C.uchar)(&privateKey[0]))
+	return publicKey[:]
+}
+
+func Sign(privateKey []byte, message []byte, signature []byte) {
+	C.crypto_sign_detached((*C.uchar)(&signature[0]),
+		nil,
+		(*C.uchar)(&message[0]),
+		C.ulonglong(len(message)),
+		(*C.uchar)(&privateKey[0]))
+}
+
+func Verify(publicKey []byte, message []byte, signature []byte) error {
+	result := C.crypto_sign_verify_detached(
+		(*C.uchar)(&signature[0]),
+		(*C.uchar)(&message[0]),
+		C.ulonglong(len(message)),
+		(*C.uchar)(&publicKey[0]))
+	if result != 0 {
+		return fmt.Errorf("failed to verify: result = %d", result)
+	} else {
+		return nil
+	}
+}
+
 func Keygen_SecretBox() []byte {
 	key := make([]byte, PrivateKeyBytes_SecretBox)
 	C.crypto_secretbox_keygen((*C.uchar)(&key[0]))
@@ -167,27 +278,111 @@ func Decrypt_SecretBox(privateKey []byte, nonce []byte, buffer []byte, bytes int
 	}
 }
 
-var debugLogs bool
+func Xor_Stream(key []byte, nonce []byte, buffer []byte, bytes int) {
+	C.crypto_stream_xchacha20_xor((*C.uchar)(&buffer[0]),
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&key[0]))
+}
+
+func Encrypt_AEAD(key []byte, nonce []byte, additionalData []byte, buffer []byte, bytes int) int {
+	var additionalDataPointer *C.uchar
+	if len(additionalData) > 0 {
+		additionalDataPointer = (*C.uchar)(&additionalData[0])
+	}
+	C.crypto_aead_xchacha20poly1305_ietf_encrypt((*C.uchar)(&buffer[0]),
+		nil,
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		additionalDataPointer,
+		C.ulonglong(len(additionalData)),
+		nil,
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&key[0]))
+	return bytes + HMACBytes_AEAD
+}
+
+func Decrypt_AEAD(key []byte, nonce []byte, additionalData []byte, buffer []byte, bytes int) error {
+	if bytes < HMACBytes_AEAD {
+		return fmt.Errorf("failed to decrypt: %d bytes is too small", bytes)
+	}
+	var additionalDataPointer *C.uchar
+	if len(additionalData) > 0 {
+		additionalDataPointer = (*C.uchar)(&additionalData[0])
+	}
+	result := C.crypto_aead_xchacha20poly1305_ietf_decrypt((*C.uchar)(&buffer[0]),
+		nil,
+		nil,
+		(*C.uchar)(&buffer[0]),
+		C.ulonglong(bytes),
+		additionalDataPointer,
+		C.ulonglong(len(additionalData)),
+		(*C.uchar)(&nonce[0]),
+		(*C.uchar)(&key[0]))
+	if result != 0 {
+		return fmt.Errorf("failed to decrypt: result = %d", result)
+	} else {
+		return nil
+	}
+}
+
+// SessionKey precomputes the shared key for a box keypair, so payload packets
+// don't pay for a key exchange each time they are encrypted or decrypted.
+func SessionKey(publicKey []byte, privateKey []byte) []byte {
+	key := make([]byte, SessionKeyBytes)
+	C.crypto_box_beforenm((*C.uchar)(&key[0]),
+		(*C.uchar)(&publicKey[0]),
+		(*C.uchar)(&privateKey[0]))
+	return key
+}
+
+func PayloadNonce(nonce []byte, sequence uint64, flags byte) {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.LittleEndian.PutUint64(nonce, sequence)
+	nonce[9] = flags
+}
+
+// EncryptPayload encrypts a payload packet with the session's cipher suite. AES-256-GCM has a shorter nonce,
+// which still fits the sequence and flags.
+func EncryptPayload(cipherSuite byte, sessionKey []byte, sequence uint64, flags byte, buffer []byte, bytes int) int {
+	var nonce [NonceBytes_AEAD]byte
+	PayloadNonce(nonce[:], sequence, flags)
+	if cipherSuite == CipherSuite_AES256GCM {
+		return Encrypt_AES256GCM(sessionKey, nonce[:NonceBytes_AES256GCM], nil, buffer, bytes)
+	}
+	return Encrypt_AEAD(sessionKey, nonce[:], nil, buffer, bytes)
+}
 
-func init() {
-	value, ok := os.LookupEnv("UDPX_DEBUG_LOGS")
-	if ok && value == "1" {
-		debugLogs = true
+func DecryptPayload(cipherSuite byte, sessionKey []byte, sequence uint64, flags byte, buffer []byte, bytes int) error {
+	var nonce [NonceBytes_AEAD]byte
+	PayloadNonce(nonce[:], sequence, flags)
+	switch cipherSuite {
+	case CipherSuite_XChaCha20Poly1305:
+		return Decrypt_AEAD(sessionKey, nonce[:], nil, buffer, bytes)
+	case CipherSuite_AES256GCM:
+		return Decrypt_AES256GCM(sessionKey, nonce[:NonceBytes_AES256GCM], nil, buffer, bytes)
+	default:
+		return fmt.Errorf("failed to decrypt: unknown cipher suite %d", cipherSuite)
 	}
 }
 
 func Error(s string, params ...interface{}) {
-	fmt.Printf("error: "+s+"\n", params...)
+	log.Error(s, params...)
+}
+
+func Warn(s string, params ...interface{}) {
+	log.Warn(s, params...)
 }
 
 func Debug(s string, params ...interface{}) {
-	if debugLogs {
-		fmt.Printf(s+"\n", params...)
-	}
+	log.Debug(s, params...)
 }
 
 func Info(s string, params ...interface{}) {
-	fmt.Printf(s+"\n", params...)
+	log.Info(s, params...)
 }
 
 const (
@@ -210,6 +405,27 @@ func ParseAddress(input string) *net.UDPAddr {
 	return address
 }
 
+func ResolveAddress(input string) (*net.UDPAddr, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return nil, fmt.Errorf("empty address")
+	}
+	host, port, err := net.SplitHostPort(input)
+	if err != nil {
+		// no port, so this is a bare ip, ipv6 literal or hostname
+		host = strings.TrimSuffix(strings.TrimPrefix(input, "["), "]")
+		port = "0"
+	}
+	if host == "" {
+		return nil, fmt.Errorf("missing host in address %s", input)
+	}
+	address, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve address %s: %v", input, err)
+	}
+	return address, nil
+}
+
 func WriteBool(data []byte, index *int, value bool) {
 	if value {
 		data[*index] = byte(1)
@@ -270,6 +486,14 @@ func WriteBytes(data []byte, index *int, value []byte, numBytes int) {
 	}
 }
 
+func WriteVarint32(data []byte, index *int, value uint32) {
+	*index += binary.PutUvarint(data[*index:], uint64(value))
+}
+
+func WriteVarint64(data []byte, index *int, value uint64) {
+	*index += binary.PutUvarint(data[*index:], value)
+}
+
 func WriteAddress(buffer []byte, index *int, address *net.UDPAddr) {
 	if address == nil {
 		buffer[*index] = IPAddressNone
@@ -288,13 +512,103 @@ func WriteAddress(buffer []byte, index *int, address *net.UDPAddr) {
 		buffer[*index+6] = (byte)(port >> 8)
 	} else {
 		buffer[*index] = IPAddressIPv6
-		copy(buffer[*index+1:], address.IP)
+		ipv6 := address.IP.To16()
+		if ipv6 == nil {
+			ipv6 = net.IPv6zero
+		}
+		copy(buffer[*index+1:*index+17], ipv6)
 		buffer[*index+17] = (byte)(port & 0xFF)
 		buffer[*index+18] = (byte)(port >> 8)
 	}
 	*index += AddressBytes
 }
 
+func checkWriteBounds(data []byte, index *int, bytes int) error {
+	if *index < 0 || *index+bytes > len(data) {
+		return fmt.Errorf("buffer overflow: need %d bytes at index %d, buffer is %d bytes", bytes, *index, len(data))
+	}
+	return nil
+}
+
+func WriteSafeBool(data []byte, index *int, value bool) error {
+	if err := checkWriteBounds(data, index, 1); err != nil {
+		return err
+	}
+	WriteBool(data, index, value)
+	return nil
+}
+
+func WriteSafeUint8(data []byte, index *int, value uint8) error {
+	if err := checkWriteBounds(data, index, 1); err != nil {
+		return err
+	}
+	WriteUint8(data, index, value)
+	return nil
+}
+
+func WriteSafeUint16(data []byte, index *int, value uint16) error {
+	if err := checkWriteBounds(data, index, 2); err != nil {
+		return err
+	}
+	WriteUint16(data, index, value)
+	return nil
+}
+
+func WriteSafeUint32(data []byte, index *int, value uint32) error {
+	if err := checkWriteBounds(data, index, 4); err != nil {
+		return err
+	}
+	WriteUint32(data, index, value)
+	return nil
+}
+
+func WriteSafeUint64(data []byte, index *int, value uint64) error {
+	if err := checkWriteBounds(data, index, 8); err != nil {
+		return err
+	}
+	WriteUint64(data, index, value)
+	return nil
+}
+
+func WriteSafeFloat32(data []byte, index *int, value float32) error {
+	return WriteSafeUint32(data, index, math.Float32bits(value))
+}
+
+func WriteSafeFloat64(data []byte, index *int, value float64) error {
+	return WriteSafeUint64(data, index, math.Float64bits(value))
+}
+
+func WriteSafeString(data []byte, index *int, value string, maxStringLength uint32) error {
+	stringLength := uint32(len(value))
+	if stringLength > maxStringLength {
+		return fmt.Errorf("string is too long: %d bytes, max is %d", stringLength, maxStringLength)
+	}
+	if err := checkWriteBounds(data, index, 4+int(stringLength)); err != nil {
+		return err
+	}
+	WriteString(data, index, value, maxStringLength)
+	return nil
+}
+
+func WriteSafeBytes(data []byte, index *int, value []byte, numBytes int) error {
+	if numBytes > len(value) {
+		return fmt.Errorf("not enough bytes to write: have %d, need %d", len(value), numBytes)
+	}
+	if err := checkWriteBounds(data, index, numBytes); err != nil {
+		return err
+	}
+	WriteBytes(data, index, value, numBytes)
+	return nil
+}
+
+func WriteSafeAddress(buffer []byte, index *int, address *net.UDPAddr) error {
+	if err := checkWriteBounds(buffer, index, AddressBytes); err != nil {
+		return err
+	}
+	WriteAddress(buffer, index, address)
+	return nil
+}
+
 func ReadBool(data []byte, index *int, value *bool) bool {
 	if *index+1 > len(data) {
 		return false
@@ -375,12 +689,24 @@ func ReadString(data []byte, index *int, value *string, maxStringLength uint32)
 	if *index+int(stringLength) > len(data) {
 		return false
 	}
-	stringData := make([]byte, stringLength)
-	for i := uint32(0); i < stringLength; i++ {
-		stringData[i] = data[*index]
-		*index++
+	*value = string(data[*index : *index+int(stringLength)])
+	*index += int(stringLength)
+	return true
+}
+
+func ReadStringInto(data []byte, index *int, value []byte, stringLength *int, maxStringLength uint32) bool {
+	start := *index
+	var length uint32
+	if !ReadUint32(data, index, &length) {
+		return false
 	}
-	*value = string(stringData)
+	if length > maxStringLength || int(length) > len(value) || *index+int(length) > len(data) {
+		*index = start
+		return false
+	}
+	copy(value, data[*index:*index+int(length)])
+	*index += int(length)
+	*stringLength = int(length)
 	return true
 }
 
@@ -395,15 +721,68 @@ func ReadBytes(data []byte, index *int, value []byte, bytes uint32) bool {
 	return true
 }
 
+func ReadBytesInto(data []byte, index *int, value []byte) bool {
+	if *index+len(value) > len(data) {
+		return false
+	}
+	copy(value, data[*index:*index+len(value)])
+	*index += len(value)
+	return true
+}
+
+func ReadBytesRef(data []byte, index *int, value *[]byte, bytes int) bool {
+	if bytes < 0 || *index+bytes > len(data) {
+		return false
+	}
+	*value = data[*index : *index+bytes : *index+bytes]
+	*index += bytes
+	return true
+}
+
+func ReadVarint32(data []byte, index *int, value *uint32) bool {
+	if *index >= len(data) {
+		return false
+	}
+	uint64Value, bytes := binary.Uvarint(data[*index:])
+	if bytes <= 0 || bytes > MaxVarint32Bytes || uint64Value > math.MaxUint32 {
+		return false
+	}
+	*value = uint32(uint64Value)
+	*index += bytes
+	return true
+}
+
+func ReadVarint64(data []byte, index *int, value *uint64) bool {
+	if *index >= len(data) {
+		return false
+	}
+	uint64Value, bytes := binary.Uvarint(data[*index:])
+	if bytes <= 0 {
+		return false
+	}
+	*value = uint64Value
+	*index += bytes
+	return true
+}
+
+// ReadAddress reads an address into memory the address owns, so it stays valid once the buffer is reused.
+// It returns false for truncated buffers and unknown address types.
 func ReadAddress(buffer []byte, index *int, address *net.UDPAddr) bool {
+	if *index < 0 || *index+AddressBytes > len(buffer) {
+		return false
+	}
 	addressType := buffer[*index]
 	switch addressType {
+	case IPAddressNone:
+		*address = net.UDPAddr{}
 	case IPAddressIPv4:
 		*address = net.UDPAddr{IP: net.IPv4(buffer[*index+1], buffer[*index+2], buffer[*index+3], buffer[*index+4]), Port: ((int)(binary.LittleEndian.Uint16(buffer[*index+5:])))}
-		break
 	case IPAddressIPv6:
-		*address = net.UDPAddr{IP: buffer[*index+1:], Port: ((int)(binary.LittleEndian.Uint16(buffer[*index+17:])))}
-		break
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, buffer[*index+1:*index+17])
+		*address = net.UDPAddr{IP: ip, Port: ((int)(binary.LittleEndian.Uint16(buffer[*index+17:])))}
+	default:
+		return false
 	}
 	*index += AddressBytes
 	return true
@@ -478,8 +857,40 @@ func GenerateChonkle(output []byte, magic []byte, fromAddressData []byte, fromPo
 	hash.Write(packetLengthData[:])
 	hashValue := hash.Sum64()
 
+	chonkleFromHash(output, hashValue)
+}
+
+func filterHashData(buffer []byte, domain byte, fromAddressData []byte, fromPort uint16, toAddressData []byte, toPort uint16, packetLength int) []byte {
+	index := 0
+	WriteUint8(buffer, &index, domain)
+	WriteBytes(buffer, &index, fromAddressData, len(fromAddressData))
+	WriteUint16(buffer, &index, fromPort)
+	WriteBytes(buffer, &index, toAddressData, len(toAddressData))
+	WriteUint16(buffer, &index, toPort)
+	WriteUint32(buffer, &index, uint32(packetLength))
+	return buffer[:index]
+}
+
+// The keyed variants replace the magic with a secret SipHash key, so the chonkle
+// and pittle can't be computed by anyone who doesn't have the key.
+
+func GeneratePittleKeyed(output []byte, filterKey []byte, fromAddressData []byte, fromPort uint16, toAddressData []byte, toPort uint16, packetLength int) {
+	var buffer [1 + 2*(MaxAddressDataBytes+2) + 4]byte
+	hashValue := SipHash24(filterKey, filterHashData(buffer[:], 'p', fromAddressData, fromPort, toAddressData, toPort, packetLength))
+	output[0] = 1 | byte(hashValue)
+	output[1] = 1 | byte(hashValue>>8)
+}
+
+func GenerateChonkleKeyed(output []byte, filterKey []byte, fromAddressData []byte, fromPort uint16, toAddressData []byte, toPort uint16, packetLength int) {
+	var buffer [1 + 2*(MaxAddressDataBytes+2) + 4]byte
+	hashValue := SipHash24(filterKey, filterHashData(buffer[:], 'c', fromAddressData, fromPort, toAddressData, toPort, packetLength))
+	chonkleFromHash(output, hashValue)
+}
+
+func chonkleFromHash(output []byte, hashValue uint64) {
+
 	var data [8]byte
-	binary.LittleEndian.PutUint64(data[:], uint64(hashValue))
+	binary.LittleEndian.PutUint64(data[:], hashValue)
 
 	output[0] = ((data[6] & 0xC0) >> 6) + 42
 	output[1] = (data[3] & 0x1F) + 200
@@ -592,13 +1003,33 @@ func AdvancedPacketFilter(data []byte, magic []byte, fromAddress []byte, fromPor
 	return true
 }
 
-func GetAddressData(address *net.UDPAddr, addressData []byte, addressPort *uint16) {
-	// todo: ipv6 support
-	addressData[0] = address.IP[0]
-	addressData[1] = address.IP[1]
-	addressData[2] = address.IP[2]
-	addressData[3] = address.IP[3]
+func AdvancedPacketFilterKeyed(data []byte, filterKey []byte, fromAddress []byte, fromPort uint16, toAddress []byte, toPort uint16, packetLength int) bool {
+	var a [15]byte
+	var b [2]byte
+	GenerateChonkleKeyed(a[:], filterKey, fromAddress, fromPort, toAddress, toPort, packetLength)
+	GeneratePittleKeyed(b[:], filterKey, fromAddress, fromPort, toAddress, toPort, packetLength)
+	if bytes.Compare(a[0:15], data[2:17]) != 0 {
+		return false
+	}
+	if bytes.Compare(b[0:2], data[packetLength-2:packetLength]) != 0 {
+		return false
+	}
+	return true
+}
+
+func GetAddressData(address *net.UDPAddr, addressData []byte, addressPort *uint16) int {
 	*addressPort = uint16(address.Port)
+	ipv4 := address.IP.To4()
+	if ipv4 != nil {
+		copy(addressData, ipv4)
+		return net.IPv4len
+	}
+	ipv6 := address.IP.To16()
+	if ipv6 != nil {
+		copy(addressData, ipv6)
+		return net.IPv6len
+	}
+	return 0
 }
 
 func IdString(id []byte) string {
@@ -609,6 +1040,8 @@ func IdString(id []byte) string {
 	return string
 }
 
+// AddressEqual compares addresses by ip and port. IPv4-mapped IPv6 addresses, which dual-stack sockets see ipv4
+// clients as, are equal to the plain IPv4 address.
 func AddressEqual(a *net.UDPAddr, b *net.UDPAddr) bool {
 	return net.IP.Equal(a.IP, b.IP) && a.Port == b.Port
 }
@@ -629,15 +1062,17 @@ type ChallengeToken struct {
 	ExpireTimestamp uint64
 	ClientAddress   net.UDPAddr
 	GatewayAddress  net.UDPAddr
+	SessionId       [SessionIdBytes]byte
 	Sequence        uint64
 }
 
-const ChallengeTokenBytes = 8 + AddressBytes + 8
+const ChallengeTokenBytes = 8 + AddressBytes + SessionIdBytes + 8
 const EncryptedChallengeTokenBytes = NonceBytes_SecretBox + ChallengeTokenBytes + HMACBytes_SecretBox
 
 func WriteChallengeToken(buffer []byte, index *int, token *ChallengeToken) {
 	WriteUint64(buffer, index, token.ExpireTimestamp)
 	WriteAddress(buffer, index, &token.ClientAddress)
+	WriteBytes(buffer, index, token.SessionId[:], SessionIdBytes)
 	WriteUint64(buffer, index, token.Sequence)
 }
 
@@ -646,11 +1081,22 @@ func ReadChallengeToken(buffer []byte, index *int, token *ChallengeToken) bool {
 		return false
 	}
 	ReadUint64(buffer, index, &token.ExpireTimestamp)
-	ReadAddress(buffer, index, &token.ClientAddress)
+	if !ReadAddress(buffer, index, &token.ClientAddress) {
+		return false
+	}
+	ReadBytes(buffer, index, token.SessionId[:], SessionIdBytes)
 	ReadUint64(buffer, index, &token.Sequence)
 	return true
 }
 
+func (token *ChallengeToken) Serialize(stream Stream) error {
+	stream.SerializeUint64(&token.ExpireTimestamp)
+	stream.SerializeAddress(&token.ClientAddress)
+	stream.SerializeBytes(token.SessionId[:])
+	stream.SerializeUint64(&token.Sequence)
+	return stream.Error()
+}
+
 func WriteEncryptedChallengeToken(buffer []byte, index *int, token *ChallengeToken, privateKey []byte) {
 	nonce := buffer[*index : *index+NonceBytes_SecretBox]
 	RandomBytes_InPlace(nonce)
@@ -679,40 +1125,28 @@ func ReadEncryptedChallengeToken(buffer []byte, index *int, token *ChallengeToke
 
 func GetAckBits(latestReceivedSequence uint64, receivedPackets []uint64, ack_bits []byte) {
 	totalBits := uint64(len(ack_bits) * 8)
-	ack := make([]byte, totalBits)
 	bufferSize := uint64(len(receivedPackets))
-	i := 0
+	i := uint64(0)
 	minSequence := latestReceivedSequence - totalBits
 	for sequence := latestReceivedSequence; sequence > minSequence; sequence-- {
 		if receivedPackets[sequence%bufferSize] == sequence {
-			ack[i] = 1
-		}
-		i++
-	}
-	for i := uint64(0); i < totalBits; i++ {
-		if ack[i] == 1 {
 			byteIndex := i / 8
 			bitIndex := i % 8
 			ack_bits[byteIndex] |= (1 << bitIndex)
 		}
+		i++
 	}
 }
 
 func ProcessAcks(ackSequence uint64, ack_bits []byte, ackedPackets []uint64, ackBuffer []uint64) []uint64 {
 	totalBits := uint64(len(ack_bits) * 8)
-	ack := make([]byte, totalBits)
-	for i := uint64(0); i < totalBits; i++ {
-		byteIndex := i / 8
-		bitIndex := i % 8
-		if (ack_bits[byteIndex] & (1 << bitIndex)) != 0 {
-			ack[i] = 1
-		}
-	}
 	bufferSize := uint64(len(ackedPackets))
 	numAcks := 0
 	for i := uint64(0); i < totalBits; i++ {
+		byteIndex := i / 8
+		bitIndex := i % 8
 		sequence := ackSequence - i
-		if ack[i] == 1 && ackedPackets[sequence%bufferSize] != sequence {
+		if (ack_bits[byteIndex]&(1<<bitIndex)) != 0 && ackedPackets[sequence%bufferSize] != sequence {
 			ackBuffer[numAcks] = sequence
 			numAcks++
 		}
@@ -721,62 +1155,201 @@ func ProcessAcks(ackSequence uint64, ack_bits []byte, ackedPackets []uint64, ack
 }
 
 type SessionToken struct {
+	IssueTimestamp   uint64
 	ExpireTimestamp  uint64
 	SessionId        [SessionIdBytes]byte
 	UserId           [UserIdBytes]byte
 	EnvelopeUpKbps   uint32
 	EnvelopeDownKbps uint32
 	PacketsPerSecond uint8
+	ClientIP         [ClientIPBytes]byte
+	TenantId         uint16
 }
 
 func WriteSessionToken(buffer []byte, index *int, token *SessionToken) {
+	WriteUint64(buffer, index, token.IssueTimestamp)
 	WriteUint64(buffer, index, token.ExpireTimestamp)
 	WriteBytes(buffer, index, token.SessionId[:], SessionIdBytes)
 	WriteBytes(buffer, index, token.UserId[:], UserIdBytes)
 	WriteUint32(buffer, index, token.EnvelopeUpKbps)
 	WriteUint32(buffer, index, token.EnvelopeDownKbps)
 	WriteUint8(buffer, index, token.PacketsPerSecond)
+	WriteBytes(buffer, index, token.ClientIP[:], ClientIPBytes)
+	WriteUint16(buffer, index, token.TenantId)
 }
 
 func ReadSessionToken(buffer []byte, index *int, token *SessionToken) bool {
 	if len(buffer)-*index < SessionTokenBytes {
 		return false
 	}
+	ReadUint64(buffer, index, &token.IssueTimestamp)
 	ReadUint64(buffer, index, &token.ExpireTimestamp)
 	ReadBytes(buffer, index, token.SessionId[:], SessionIdBytes)
 	ReadBytes(buffer, index, token.UserId[:], UserIdBytes)
 	ReadUint32(buffer, index, &token.EnvelopeUpKbps)
 	ReadUint32(buffer, index, &token.EnvelopeDownKbps)
 	ReadUint8(buffer, index, &token.PacketsPerSecond)
+	ReadBytes(buffer, index, token.ClientIP[:], ClientIPBytes)
+	ReadUint16(buffer, index, &token.TenantId)
 	return true
 }
 
-func WriteEncryptedSessionToken(buffer []byte, index *int, token *SessionToken, senderPrivateKey []byte, receiverPublicKey []byte) {
-	nonce := buffer[*index : *index+NonceBytes_Box]
-	RandomBytes_InPlace(nonce)
-	*index += NonceBytes_Box
-	tokenData := buffer[*index : *index+SessionTokenBytes+HMACBytes_Box]
+func (token *SessionToken) Serialize(stream Stream) error {
+	stream.SerializeUint64(&token.IssueTimestamp)
+	stream.SerializeUint64(&token.ExpireTimestamp)
+	stream.SerializeBytes(token.SessionId[:])
+	stream.SerializeBytes(token.UserId[:])
+	stream.SerializeUint32(&token.EnvelopeUpKbps)
+	stream.SerializeUint32(&token.EnvelopeDownKbps)
+	stream.SerializeUint8(&token.PacketsPerSecond)
+	stream.SerializeBytes(token.ClientIP[:])
+	stream.SerializeUint16(&token.TenantId)
+	return stream.Error()
+}
+
+// BindClientIP ties the session token to the ip the client requested it from. Tokens with no client ip,
+// which is all zeros on the wire, are accepted from anywhere.
+func (token *SessionToken) BindClientIP(clientIP net.IP) {
+	copy(token.ClientIP[:], clientIP.To16())
+}
+
+// ValidateSessionTokenClientIP checks a packet's source ip against the ip the session token is bound to.
+// Clients behind carrier grade nat or using ipv6 privacy addresses change ip within a network, so only the
+// first ipv4PrefixBits or ipv6PrefixBits of the ips have to match.
+func ValidateSessionTokenClientIP(token *SessionToken, clientIP net.IP, ipv4PrefixBits int, ipv6PrefixBits int) error {
+	boundIP := net.IP(token.ClientIP[:])
+	if boundIP.Equal(net.IPv6unspecified) {
+		return nil
+	}
+	var mask net.IPMask
+	if boundIP.To4() != nil {
+		mask = net.CIDRMask(96+ipv4PrefixBits, 128)
+	} else {
+		mask = net.CIDRMask(ipv6PrefixBits, 128)
+	}
+	if clientIP.To16() == nil || !boundIP.Mask(mask).Equal(clientIP.To16().Mask(mask)) {
+		return fmt.Errorf("session token is bound to %s, not %s", boundIP, clientIP)
+	}
+	return nil
+}
+
+// WriteSignedSessionToken writes the session token followed by its signature. Gateways check the signature
+// with the auth public signing key alone, so the auth service never needs a gateway private key.
+// Tokens sent to clients are also encrypted, see WriteEncryptedSessionToken.
+func WriteSignedSessionToken(buffer []byte, index *int, token *SessionToken, privateKey []byte) {
+	tokenData := buffer[*index : *index+SignedSessionTokenBytes]
 	WriteSessionToken(buffer, index, token)
-	Encrypt_Box(senderPrivateKey, receiverPublicKey, nonce, tokenData, SessionTokenBytes)
-	*index += HMACBytes_Box
+	Sign(privateKey, tokenData[:SessionTokenBytes], tokenData[SessionTokenBytes:])
+	*index += SignatureBytes_Sign
+}
+
+// SignedSessionTokenTenantId reads the tenant id of a signed session token without checking the signature,
+// so the gateway knows which tenant's keys to check it with.
+func SignedSessionTokenTenantId(buffer []byte) (uint16, bool) {
+	if len(buffer) < SignedSessionTokenBytes {
+		return 0, false
+	}
+	index := SessionTokenBytes - TenantIdBytes
+	var tenantId uint16
+	ReadUint16(buffer, &index, &tenantId)
+	return tenantId, true
 }
 
-func ReadEncryptedSessionToken(buffer []byte, index *int, token *SessionToken, senderPublicKey []byte, receiverPrivateKey []byte) bool {
-	if len(buffer)-*index < EncryptedSessionTokenBytes {
+// ReadSignedSessionToken reads a session token that is signed by one of publicKeys.
+func ReadSignedSessionToken(buffer []byte, index *int, token *SessionToken, publicKeys ...[]byte) bool {
+	if len(buffer)-*index < SignedSessionTokenBytes {
 		return false
 	}
-	nonce := buffer[*index : *index+NonceBytes_Box]
-	*index += NonceBytes_Box
-	tokenData := buffer[*index : *index+SessionTokenBytes+HMACBytes_Box]
-	err := Decrypt_Box(senderPublicKey, receiverPrivateKey, nonce, tokenData, SessionTokenBytes+HMACBytes_Box)
-	if err != nil {
+	tokenData := buffer[*index : *index+SignedSessionTokenBytes]
+	signed := false
+	for _, publicKey := range publicKeys {
+		if Verify(publicKey, tokenData[:SessionTokenBytes], tokenData[SessionTokenBytes:]) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
 		return false
 	}
 	result := ReadSessionToken(buffer, index, token)
-	*index += HMACBytes_Box
+	*index += SignatureBytes_Sign
 	return result
 }
 
+// WriteEncryptedSessionToken signs the session token, then encrypts it to the gateway public key, so only the
+// gateway can read the user id, envelope and bound client ip that clients carry in every packet.
+func WriteEncryptedSessionToken(buffer []byte, index *int, token *SessionToken, privateKey []byte, gatewayPublicKey []byte) {
+	var signedTokenData [SignedSessionTokenBytes]byte
+	signedIndex := 0
+	WriteSignedSessionToken(signedTokenData[:], &signedIndex, token, privateKey)
+	EncryptSessionToken(signedTokenData[:], buffer[*index:*index+EncryptedSessionTokenBytes], gatewayPublicKey)
+	*index += EncryptedSessionTokenBytes
+}
+
+const sessionTokenSessionIdIndex = TimestampBytes + TimestampBytes
+
+// sessionTokenKey derives the key stream key of an encrypted session token. Each token has its own ephemeral
+// key, so the nonce is always zero.
+func sessionTokenKey(sharedKey []byte, sessionId []byte) []byte {
+	key := make([]byte, KeyBytes_Stream)
+	HKDF(sharedKey, sessionId, []byte("udpx session token"), key)
+	return key
+}
+
+// EncryptSessionToken encrypts a signed session token to the gateway public key.
+func EncryptSessionToken(signedTokenData []byte, encryptedTokenData []byte, gatewayPublicKey []byte) {
+	publicKey, privateKey := Keygen_Box()
+	copy(encryptedTokenData, publicKey)
+	tokenData := encryptedTokenData[PublicKeyBytes_Box:EncryptedSessionTokenBytes]
+	copy(tokenData, signedTokenData[:sessionTokenSessionIdIndex])
+	copy(tokenData[sessionTokenSessionIdIndex:], signedTokenData[sessionTokenSessionIdIndex+SessionIdBytes:SignedSessionTokenBytes])
+	sessionId := signedTokenData[sessionTokenSessionIdIndex : sessionTokenSessionIdIndex+SessionIdBytes]
+	var nonce [NonceBytes_Stream]byte
+	Xor_Stream(sessionTokenKey(SessionKey(gatewayPublicKey, privateKey), sessionId), nonce[:], tokenData, len(tokenData))
+}
+
+// DecryptSessionToken decrypts the session token of a packet from sessionId into its signed form. The
+// signature still has to be checked with ReadSignedSessionToken, which also catches tampering.
+func DecryptSessionToken(encryptedTokenData []byte, sessionId []byte, signedTokenData []byte, gatewayPrivateKey []byte) bool {
+	if len(encryptedTokenData) < EncryptedSessionTokenBytes || len(sessionId) != SessionIdBytes || len(signedTokenData) < SignedSessionTokenBytes {
+		return false
+	}
+	var tokenData [EncryptedSessionTokenBytes - PublicKeyBytes_Box]byte
+	copy(tokenData[:], encryptedTokenData[PublicKeyBytes_Box:EncryptedSessionTokenBytes])
+	var nonce [NonceBytes_Stream]byte
+	Xor_Stream(sessionTokenKey(SessionKey(encryptedTokenData[:PublicKeyBytes_Box], gatewayPrivateKey), sessionId), nonce[:], tokenData[:], len(tokenData))
+	copy(signedTokenData, tokenData[:sessionTokenSessionIdIndex])
+	copy(signedTokenData[sessionTokenSessionIdIndex:], sessionId)
+	copy(signedTokenData[sessionTokenSessionIdIndex+SessionIdBytes:], tokenData[sessionTokenSessionIdIndex:])
+	return true
+}
+
+func ValidateSessionTokenTimestamps(token *SessionToken, currentTimestamp uint64) error {
+	if token.IssueTimestamp > currentTimestamp+TimestampToleranceSeconds {
+		return fmt.Errorf("session token issued in the future: issued %d, current %d", token.IssueTimestamp, currentTimestamp)
+	}
+	if token.ExpireTimestamp <= token.IssueTimestamp {
+		return fmt.Errorf("session token expires before it is issued: issued %d, expires %d", token.IssueTimestamp, token.ExpireTimestamp)
+	}
+	if token.ExpireTimestamp < currentTimestamp {
+		return fmt.Errorf("session token expired: expired %d, current %d", token.ExpireTimestamp, currentTimestamp)
+	}
+	return nil
+}
+
+// ExtendSessionToken pushes the expiry of a session token out by SessionTokenExtensionSeconds. Tokens can only
+// be extended once they are close to expiring, so a session can't bank time ahead.
+func ExtendSessionToken(token *SessionToken, currentTimestamp uint64) error {
+	if token.ExpireTimestamp > currentTimestamp+SessionTokenExtensionSeconds {
+		return fmt.Errorf("session token extended too soon: expires %d, current %d", token.ExpireTimestamp, currentTimestamp)
+	}
+	if err := ValidateSessionTokenTimestamps(token, currentTimestamp); err != nil {
+		return err
+	}
+	token.ExpireTimestamp += SessionTokenExtensionSeconds
+	return nil
+}
+
 type ConnectData struct {
 	ClientPublicKey  [PublicKeyBytes_Box]byte
 	ClientPrivateKey [PrivateKeyBytes_Box]byte
@@ -785,6 +1358,9 @@ type ConnectData struct {
 	EnvelopeUpKbps   uint32
 	EnvelopeDownKbps uint32
 	PacketsPerSecond uint8
+	FECDataShards    uint8
+	FECParityShards  uint8
+	ExpireTimestamp  uint64
 }
 
 func WriteConnectData(buffer []byte, index *int, connectData *ConnectData) {
@@ -795,6 +1371,9 @@ func WriteConnectData(buffer []byte, index *int, connectData *ConnectData) {
 	WriteUint32(buffer, index, connectData.EnvelopeUpKbps)
 	WriteUint32(buffer, index, connectData.EnvelopeDownKbps)
 	WriteUint8(buffer, index, connectData.PacketsPerSecond)
+	WriteUint8(buffer, index, connectData.FECDataShards)
+	WriteUint8(buffer, index, connectData.FECParityShards)
+	WriteUint64(buffer, index, connectData.ExpireTimestamp)
 }
 
 func ReadConnectData(buffer []byte, index *int, connectData *ConnectData) bool {
@@ -803,15 +1382,42 @@ func ReadConnectData(buffer []byte, index *int, connectData *ConnectData) bool {
 	}
 	ReadBytes(buffer, index, connectData.ClientPublicKey[:], PublicKeyBytes_Box)
 	ReadBytes(buffer, index, connectData.ClientPrivateKey[:], PrivateKeyBytes_Box)
-	ReadAddress(buffer, index, &connectData.GatewayAddress)
+	if !ReadAddress(buffer, index, &connectData.GatewayAddress) {
+		return false
+	}
 	ReadBytes(buffer, index, connectData.GatewayPublicKey[:], PublicKeyBytes_Box)
 	ReadUint32(buffer, index, &connectData.EnvelopeUpKbps)
 	ReadUint32(buffer, index, &connectData.EnvelopeDownKbps)
 	ReadUint8(buffer, index, &connectData.PacketsPerSecond)
+	ReadUint8(buffer, index, &connectData.FECDataShards)
+	ReadUint8(buffer, index, &connectData.FECParityShards)
+	ReadUint64(buffer, index, &connectData.ExpireTimestamp)
 	return true
 }
 
-func GenerateConnectToken(userId []byte, envelopeUpKbps uint32, envelopeDownKbps uint32, packetsPerSecond uint8, gatewayAddress *net.UDPAddr, gatewayPublicKey []byte, senderPrivateKey []byte, receiverPublicKey []byte) []byte {
+func (connectData *ConnectData) Serialize(stream Stream) error {
+	stream.SerializeBytes(connectData.ClientPublicKey[:])
+	stream.SerializeBytes(connectData.ClientPrivateKey[:])
+	stream.SerializeAddress(&connectData.GatewayAddress)
+	stream.SerializeBytes(connectData.GatewayPublicKey[:])
+	stream.SerializeUint32(&connectData.EnvelopeUpKbps)
+	stream.SerializeUint32(&connectData.EnvelopeDownKbps)
+	stream.SerializeUint8(&connectData.PacketsPerSecond)
+	stream.SerializeUint8(&connectData.FECDataShards)
+	stream.SerializeUint8(&connectData.FECParityShards)
+	stream.SerializeUint64(&connectData.ExpireTimestamp)
+	return stream.Error()
+}
+
+func GenerateConnectToken(userId []byte, envelopeUpKbps uint32, envelopeDownKbps uint32, packetsPerSecond uint8, fecDataShards uint8, fecParityShards uint8, expireSeconds uint64, gatewayAddress *net.UDPAddr, gatewayPublicKey []byte, authPrivateKey []byte) []byte {
+	return GenerateBoundConnectToken(userId, envelopeUpKbps, envelopeDownKbps, packetsPerSecond, fecDataShards, fecParityShards, expireSeconds, gatewayAddress, gatewayPublicKey, authPrivateKey, 0, nil)
+}
+
+// GenerateBoundConnectToken generates a connect token for a tenant whose session token only works from
+// clientIP, or from anywhere if clientIP is nil.
+func GenerateBoundConnectToken(userId []byte, envelopeUpKbps uint32, envelopeDownKbps uint32, packetsPerSecond uint8, fecDataShards uint8, fecParityShards uint8, expireSeconds uint64, gatewayAddress *net.UDPAddr, gatewayPublicKey []byte, authPrivateKey []byte, tenantId uint16, clientIP net.IP) []byte {
+
+	currentTimestamp := uint64(time.Now().Unix())
 
 	publicKey, privateKey := Keygen_Box()
 
@@ -823,14 +1429,22 @@ func GenerateConnectToken(userId []byte, envelopeUpKbps uint32, envelopeDownKbps
 	connectData.EnvelopeUpKbps = envelopeUpKbps
 	connectData.EnvelopeDownKbps = envelopeDownKbps
 	connectData.PacketsPerSecond = packetsPerSecond
+	connectData.FECDataShards = fecDataShards
+	connectData.FECParityShards = fecParityShards
+	connectData.ExpireTimestamp = currentTimestamp + expireSeconds
 
 	sessionToken := SessionToken{}
-	sessionToken.ExpireTimestamp = uint64(time.Now().Unix()) + ConnectTokenExpireSeconds
+	sessionToken.IssueTimestamp = currentTimestamp
+	sessionToken.ExpireTimestamp = currentTimestamp + expireSeconds
 	copy(sessionToken.SessionId[:], connectData.ClientPublicKey[:])
 	copy(sessionToken.UserId[:], userId[:])
 	sessionToken.EnvelopeUpKbps = envelopeUpKbps
 	sessionToken.EnvelopeDownKbps = envelopeDownKbps
 	sessionToken.PacketsPerSecond = packetsPerSecond
+	sessionToken.TenantId = tenantId
+	if clientIP != nil {
+		sessionToken.BindClientIP(clientIP)
+	}
 
 	buffer := make([]byte, ConnectDataBytes+EncryptedSessionTokenBytes)
 
@@ -838,11 +1452,53 @@ func GenerateConnectToken(userId []byte, envelopeUpKbps uint32, envelopeDownKbps
 
 	WriteConnectData(buffer, &index, &connectData)
 
-	WriteEncryptedSessionToken(buffer, &index, &sessionToken, senderPrivateKey, receiverPublicKey)
+	WriteEncryptedSessionToken(buffer, &index, &sessionToken, authPrivateKey, gatewayPublicKey)
 
 	return buffer
 }
 
+// AppendFallbackGateways adds the gateways a client fails over to, in order, after the session token in a
+// connect token. Connect tokens without fallback gateways are ConnectTokenBytes long.
+func AppendFallbackGateways(connectToken []byte, gatewayAddresses []*net.UDPAddr) []byte {
+	if len(gatewayAddresses) == 0 {
+		return connectToken[:ConnectTokenBytes]
+	}
+	if len(gatewayAddresses) > MaxFallbackGateways {
+		gatewayAddresses = gatewayAddresses[:MaxFallbackGateways]
+	}
+	buffer := make([]byte, ConnectTokenBytes+1+len(gatewayAddresses)*AddressBytes)
+	copy(buffer, connectToken[:ConnectTokenBytes])
+	index := ConnectTokenBytes
+	WriteUint8(buffer, &index, uint8(len(gatewayAddresses)))
+	for _, gatewayAddress := range gatewayAddresses {
+		WriteAddress(buffer, &index, gatewayAddress)
+	}
+	return buffer
+}
+
+// ReadFallbackGateways reads the fallback gateways after the session token in a connect token. It returns
+// false if the connect token has the wrong length for them.
+func ReadFallbackGateways(connectToken []byte) ([]net.UDPAddr, bool) {
+	if len(connectToken) == ConnectTokenBytes {
+		return nil, true
+	}
+	index := ConnectTokenBytes
+	var numGateways uint8
+	if !ReadUint8(connectToken, &index, &numGateways) || numGateways == 0 || numGateways > MaxFallbackGateways {
+		return nil, false
+	}
+	if len(connectToken) != ConnectTokenBytes+1+int(numGateways)*AddressBytes {
+		return nil, false
+	}
+	gatewayAddresses := make([]net.UDPAddr, numGateways)
+	for i := range gatewayAddresses {
+		if !ReadAddress(connectToken, &index, &gatewayAddresses[i]) || gatewayAddresses[i].IP == nil {
+			return nil, false
+		}
+	}
+	return gatewayAddresses, true
+}
+
 func WirePacketBits(packetBytes int) int {
 	return (EthernetHeaderBytes + IPv4HeaderBytes + UDPHeaderBytes + packetBytes) * 8
 }
@@ -853,3 +1509,11 @@ func PacketBytesFromPayload(payloadBytes int) int {
 	}
 	return payloadBytes + PrefixBytes + HeaderBytes + PostfixBytes
 }
+
+func PayloadBytesFromPacket(packetBytes int) int {
+	payloadBytes := packetBytes - PrefixBytes - HeaderBytes - PostfixBytes
+	if payloadBytes < MinPayloadBytes {
+		payloadBytes = MinPayloadBytes
+	}
+	return payloadBytes
+}
@@ -32,9 +32,12 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"math/rand"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -145,6 +148,39 @@ func TestPittleAndChonkle(t *testing.T) {
 	}
 }
 
+func TestPittleAndChonkleKeyed(t *testing.T) {
+
+	t.Parallel()
+	extra := VersionBytes + PacketTypeBytes + ChonkleBytes + PittleBytes
+	random := rand.New(rand.NewSource(42))
+	var output [1500]byte
+	output[0] = PacketVersion_SipHash
+	for i := 0; i < 1000; i++ {
+		var filterKey [SipHashKeyBytes]byte
+		var wrongKey [SipHashKeyBytes]byte
+		var fromAddress [16]byte
+		var toAddress [4]byte
+		random.Read(filterKey[:])
+		random.Read(wrongKey[:])
+		random.Read(fromAddress[:])
+		random.Read(toAddress[:])
+		fromPort := uint16(i + 1000000)
+		toPort := uint16(i + 5000)
+		packetLength := extra + (i % (len(output) - extra))
+		GenerateChonkleKeyed(output[VersionBytes+PacketTypeBytes:], filterKey[:], fromAddress[:], fromPort, toAddress[:], toPort, packetLength)
+		GeneratePittleKeyed(output[packetLength-PittleBytes:], filterKey[:], fromAddress[:], fromPort, toAddress[:], toPort, packetLength)
+		assert.True(t, BasicPacketFilter(output[:], packetLength))
+		assert.True(t, AdvancedPacketFilterKeyed(output[:], filterKey[:], fromAddress[:], fromPort, toAddress[:], toPort, packetLength))
+		assert.False(t, AdvancedPacketFilterKeyed(output[:], wrongKey[:], fromAddress[:], fromPort, toAddress[:], toPort, packetLength))
+		assert.False(t, AdvancedPacketFilterKeyed(output[:], filterKey[:], fromAddress[:], fromPort+1, toAddress[:], toPort, packetLength))
+
+		packet := FilterPacket{Data: output[:packetLength], FromAddressData: fromAddress[:], FromAddressPort: fromPort, ToAddressData: toAddress[:], ToAddressPort: toPort}
+		assert.False(t, AdvancedFilter{}.Filter(&packet))
+		packet.FilterKey = filterKey[:]
+		assert.True(t, AdvancedFilter{}.Filter(&packet))
+	}
+}
+
 func TestBasicPacketFilter(t *testing.T) {
 
 	t.Parallel()
@@ -232,6 +268,39 @@ func TestEncryptBox(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSign(t *testing.T) {
+
+	t.Parallel()
+
+	publicKey, privateKey := Keygen_Sign()
+
+	assert.Equal(t, PublicKeyBytes_Sign, len(publicKey))
+	assert.Equal(t, PrivateKeyBytes_Sign, len(privateKey))
+
+	// sign random data and verify the signature
+
+	message := RandomBytes(256)
+	signature := make([]byte, SignatureBytes_Sign)
+
+	Sign(privateKey, message, signature)
+
+	assert.NoError(t, Verify(publicKey, message, signature))
+
+	// verification should fail if the message changes
+
+	message[0] ^= 1
+
+	assert.Error(t, Verify(publicKey, message, signature))
+
+	message[0] ^= 1
+
+	// verification should fail with the wrong public key
+
+	otherPublicKey, _ := Keygen_Sign()
+
+	assert.Error(t, Verify(otherPublicKey, message, signature))
+}
+
 func TestEncryptSecretBox(t *testing.T) {
 
 	t.Parallel()
@@ -278,6 +347,64 @@ func TestEncryptSecretBox(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestEncryptPayload(t *testing.T) {
+
+	t.Parallel()
+
+	clientPublicKey, clientPrivateKey := Keygen_Box()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+
+	// both sides derive the same session key
+
+	clientSessionKey := SessionKey(gatewayPublicKey, clientPrivateKey)
+	gatewaySessionKey := SessionKey(clientPublicKey, gatewayPrivateKey)
+
+	assert.Equal(t, SessionKeyBytes, len(clientSessionKey))
+	assert.Equal(t, clientSessionKey, gatewaySessionKey)
+
+	// encrypt a payload and verify we can decrypt it
+
+	data := RandomBytes(256)
+
+	buffer := make([]byte, 256+HMACBytes_AEAD)
+	copy(buffer, data)
+
+	encryptedBytes := EncryptPayload(CipherSuite_XChaCha20Poly1305, clientSessionKey, 1000, 0, buffer, len(data))
+
+	assert.Equal(t, 256+HMACBytes_AEAD, encryptedBytes)
+	assert.NotEqual(t, data, buffer[:len(data)])
+
+	encrypted := make([]byte, len(buffer))
+	copy(encrypted, buffer)
+
+	assert.NoError(t, DecryptPayload(CipherSuite_XChaCha20Poly1305, gatewaySessionKey, 1000, 0, buffer, encryptedBytes))
+	assert.Equal(t, data, buffer[:len(data)])
+
+	// decryption should fail with the wrong sequence or direction
+
+	copy(buffer, encrypted)
+	assert.Error(t, DecryptPayload(CipherSuite_XChaCha20Poly1305, gatewaySessionKey, 1001, 0, buffer, encryptedBytes))
+
+	copy(buffer, encrypted)
+	assert.Error(t, DecryptPayload(CipherSuite_XChaCha20Poly1305, gatewaySessionKey, 1000, NonceFlags_GatewayToClient, buffer, encryptedBytes))
+
+	// decryption should fail with garbage data
+
+	garbageData := RandomBytes(256 + HMACBytes_AEAD)
+	assert.Error(t, DecryptPayload(CipherSuite_XChaCha20Poly1305, gatewaySessionKey, 1000, 0, garbageData, encryptedBytes))
+
+	// decryption should fail if the additional data doesn't match
+
+	nonce := RandomBytes(NonceBytes_AEAD)
+	copy(buffer, data)
+	encryptedBytes = Encrypt_AEAD(clientSessionKey, nonce, []byte("header"), buffer, len(data))
+	copy(encrypted, buffer)
+	assert.Error(t, Decrypt_AEAD(clientSessionKey, nonce, []byte("HEADER"), buffer, encryptedBytes))
+	copy(buffer, encrypted)
+	assert.NoError(t, Decrypt_AEAD(clientSessionKey, nonce, []byte("header"), buffer, encryptedBytes))
+	assert.Equal(t, data, buffer[:len(data)])
+}
+
 func TestChallengeToken(t *testing.T) {
 
 	t.Parallel()
@@ -289,6 +416,7 @@ func TestChallengeToken(t *testing.T) {
 	challengeToken := ChallengeToken{}
 	challengeToken.ExpireTimestamp = uint64(time.Now().Unix() + 10)
 	challengeToken.ClientAddress = *ParseAddress("127.0.0.1:30000")
+	RandomBytes_InPlace(challengeToken.SessionId[:])
 	challengeToken.Sequence = 10000
 
 	// write the challenge token to a buffer and read it back in
@@ -349,35 +477,96 @@ func TestAckBits(t *testing.T) {
 
 	t.Parallel()
 
-	// todo
+	receivedPackets := make([]uint64, 1024)
+
+	for _, sequence := range []uint64{1000, 999, 997, 990, 969, 745, 744} {
+		receivedPackets[sequence%1024] = sequence
+	}
+
+	// bit n acks the packet n before the latest, as far back as the bits go
+
+	var ackBits [AckBitsBytes]byte
 
+	GetAckBits(1000, receivedPackets, ackBits[:])
+
+	assert.Equal(t, byte(0x0b), ackBits[0])
+	assert.Equal(t, byte(0x04), ackBits[1])
+	assert.Equal(t, byte(0x80), ackBits[3])
+	assert.Equal(t, byte(0), ackBits[4])
+	assert.Equal(t, byte(0x80), ackBits[AckBitsBytes-1])
+
+	// sequences too early to fill the bits are not acked
+
+	ackBits = [AckBitsBytes]byte{}
+
+	GetAckBits(10, receivedPackets, ackBits[:])
+
+	assert.Equal(t, [AckBitsBytes]byte{}, ackBits)
 }
 
 func TestProcessAcks(t *testing.T) {
 
 	t.Parallel()
 
-	// todo
+	ackedPackets := make([]uint64, 1024)
+	ackBuffer := make([]uint64, 1024)
+
+	var ackBits [AckBitsBytes]byte
+	ackBits[0] = 0x0b
+	ackBits[3] = 0x80
+
+	// acks come back newest first
+
+	acks := ProcessAcks(1000, ackBits[:], ackedPackets, ackBuffer)
+
+	assert.Equal(t, []uint64{1000, 999, 997, 969}, acks)
+
+	// packets already acked are not acked again
+
+	ackedPackets[999%1024] = 999
+
+	acks = ProcessAcks(1000, ackBits[:], ackedPackets, ackBuffer)
+
+	assert.Equal(t, []uint64{1000, 997, 969}, acks)
+}
+
+// acks are processed for every packet, so they must not allocate. AllocsPerRun can't run in parallel tests
+
+func TestAckAllocations(t *testing.T) {
+
+	receivedPackets := make([]uint64, 1024)
+	ackedPackets := make([]uint64, 1024)
+	ackBuffer := make([]uint64, 1024)
+
+	var ackBits [AckBitsBytes]byte
 
+	allocations := testing.AllocsPerRun(100, func() {
+		GetAckBits(1000, receivedPackets, ackBits[:])
+		ProcessAcks(1000, ackBits[:], ackedPackets, ackBuffer)
+	})
+
+	assert.Equal(t, 0.0, allocations)
 }
 
 func TestSessionToken(t *testing.T) {
 
 	t.Parallel()
 
-	senderPublicKey, senderPrivateKey := Keygen_Box()
-	receiverPublicKey, receiverPrivateKey := Keygen_Box()
+	publicKey, privateKey := Keygen_Sign()
 
 	sessionToken := SessionToken{}
+	sessionToken.IssueTimestamp = uint64(time.Now().Unix())
 	sessionToken.ExpireTimestamp = uint64(time.Now().Unix() + 20)
 	RandomBytes_InPlace(sessionToken.SessionId[:])
 	RandomBytes_InPlace(sessionToken.UserId[:])
 	sessionToken.EnvelopeUpKbps = 2500
 	sessionToken.EnvelopeDownKbps = 10000
+	sessionToken.BindClientIP(net.ParseIP("203.0.113.7"))
+	sessionToken.TenantId = 7
 
 	// write the session token to a buffer and read it back in
 
-	buffer := make([]byte, EncryptedSessionTokenBytes)
+	buffer := make([]byte, SignedSessionTokenBytes)
 
 	index := 0
 
@@ -403,32 +592,330 @@ func TestSessionToken(t *testing.T) {
 
 	assert.False(t, result)
 
-	// write an encrypted session token and read it back
+	// write a signed session token and read it back
 
 	index = 0
-	WriteEncryptedSessionToken(buffer, &index, &sessionToken, senderPrivateKey, receiverPublicKey)
-	assert.Equal(t, index, EncryptedSessionTokenBytes)
+	WriteSignedSessionToken(buffer, &index, &sessionToken, privateKey)
+	assert.Equal(t, index, SignedSessionTokenBytes)
 
 	index = 0
-	result = ReadEncryptedSessionToken(buffer, &index, &readSessionToken, senderPublicKey, receiverPrivateKey)
-	assert.Equal(t, index, EncryptedSessionTokenBytes)
+	result = ReadSignedSessionToken(buffer, &index, &readSessionToken, publicKey)
+	assert.Equal(t, index, SignedSessionTokenBytes)
 
 	assert.True(t, result)
 	assert.Equal(t, sessionToken, readSessionToken)
 
-	// can't read an encrypted session token if the buffer is too small
+	// the tenant id can be read before the signature is checked
+
+	tenantId, ok := SignedSessionTokenTenantId(buffer)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(7), tenantId)
+
+	_, ok = SignedSessionTokenTenantId(buffer[:SessionTokenBytes])
+	assert.False(t, ok)
+
+	// the token reads if any of the public keys signed it, and not otherwise
+
+	otherPublicKey, _ := Keygen_Sign()
+
+	index = 0
+	assert.True(t, ReadSignedSessionToken(buffer, &index, &readSessionToken, otherPublicKey, publicKey))
+
+	index = 0
+	assert.False(t, ReadSignedSessionToken(buffer, &index, &readSessionToken, otherPublicKey))
+
+	index = 0
+	assert.False(t, ReadSignedSessionToken(buffer, &index, &readSessionToken))
+
+	// can't read a signed session token that was changed after signing
+
+	buffer[0] ^= 1
+	index = 0
+	assert.False(t, ReadSignedSessionToken(buffer, &index, &readSessionToken, publicKey))
+	buffer[0] ^= 1
+
+	// can't read a signed session token if the buffer is too small
 
 	index = 0
-	result = ReadEncryptedSessionToken(buffer[:5], &index, &readSessionToken, senderPublicKey, receiverPrivateKey)
+	result = ReadSignedSessionToken(buffer[:5], &index, &readSessionToken, publicKey)
 	assert.False(t, result)
 
-	// can't read an encrypted session token if the buffer is garbage
+	// can't read a signed session token if the buffer is garbage
 
-	buffer = make([]byte, EncryptedSessionTokenBytes)
-	result = ReadEncryptedSessionToken(buffer, &index, &readSessionToken, senderPublicKey, receiverPrivateKey)
+	buffer = make([]byte, SignedSessionTokenBytes)
+	result = ReadSignedSessionToken(buffer, &index, &readSessionToken, publicKey)
 	assert.False(t, result)
 }
 
+func TestEncryptedSessionToken(t *testing.T) {
+
+	t.Parallel()
+
+	publicKey, privateKey := Keygen_Sign()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+
+	sessionToken := SessionToken{}
+	sessionToken.IssueTimestamp = uint64(time.Now().Unix())
+	sessionToken.ExpireTimestamp = uint64(time.Now().Unix() + 20)
+	RandomBytes_InPlace(sessionToken.SessionId[:])
+	RandomBytes_InPlace(sessionToken.UserId[:])
+	sessionToken.EnvelopeUpKbps = 2500
+	sessionToken.EnvelopeDownKbps = 10000
+	sessionToken.BindClientIP(net.ParseIP("203.0.113.7"))
+	sessionToken.TenantId = 7
+
+	// encrypted session tokens are the same size as signed ones, so packets don't grow
+
+	assert.Equal(t, SignedSessionTokenBytes, EncryptedSessionTokenBytes)
+
+	buffer := make([]byte, EncryptedSessionTokenBytes)
+	index := 0
+	WriteEncryptedSessionToken(buffer, &index, &sessionToken, privateKey, gatewayPublicKey)
+	assert.Equal(t, EncryptedSessionTokenBytes, index)
+
+	// none of the user id, envelope, bound client ip or tenant are visible on the wire
+
+	plaintext := make([]byte, SessionTokenBytes)
+	index = 0
+	WriteSessionToken(plaintext, &index, &sessionToken)
+	userIdIndex := TimestampBytes + TimestampBytes + SessionIdBytes
+	assert.False(t, bytes.Contains(buffer, sessionToken.UserId[:]))
+	assert.False(t, bytes.Contains(buffer, plaintext[userIdIndex+UserIdBytes:userIdIndex+UserIdBytes+EnvelopeBytes]))
+	assert.False(t, bytes.Contains(buffer, plaintext[SessionTokenBytes-ClientIPBytes-TenantIdBytes:]))
+
+	// the gateway decrypts it with the session id from the packet header, then checks the signature
+
+	signedTokenData := make([]byte, SignedSessionTokenBytes)
+	assert.True(t, DecryptSessionToken(buffer, sessionToken.SessionId[:], signedTokenData, gatewayPrivateKey))
+
+	var readSessionToken SessionToken
+	index = 0
+	assert.True(t, ReadSignedSessionToken(signedTokenData, &index, &readSessionToken, publicKey))
+	assert.Equal(t, sessionToken, readSessionToken)
+
+	// tokens decrypted with another gateway key, for another session id or after being changed don't verify
+
+	_, otherGatewayPrivateKey := Keygen_Box()
+	assert.True(t, DecryptSessionToken(buffer, sessionToken.SessionId[:], signedTokenData, otherGatewayPrivateKey))
+	index = 0
+	assert.False(t, ReadSignedSessionToken(signedTokenData, &index, &readSessionToken, publicKey))
+
+	otherSessionId := RandomBytes(SessionIdBytes)
+	assert.True(t, DecryptSessionToken(buffer, otherSessionId, signedTokenData, gatewayPrivateKey))
+	index = 0
+	assert.False(t, ReadSignedSessionToken(signedTokenData, &index, &readSessionToken, publicKey))
+
+	buffer[PublicKeyBytes_Box] ^= 1
+	assert.True(t, DecryptSessionToken(buffer, sessionToken.SessionId[:], signedTokenData, gatewayPrivateKey))
+	index = 0
+	assert.False(t, ReadSignedSessionToken(signedTokenData, &index, &readSessionToken, publicKey))
+
+	// can't decrypt a session token if a buffer is too small
+
+	assert.False(t, DecryptSessionToken(buffer[:5], sessionToken.SessionId[:], signedTokenData, gatewayPrivateKey))
+	assert.False(t, DecryptSessionToken(buffer, sessionToken.SessionId[:], signedTokenData[:5], gatewayPrivateKey))
+}
+
+func TestValidateSessionTokenTimestamps(t *testing.T) {
+
+	t.Parallel()
+
+	currentTimestamp := uint64(time.Now().Unix())
+
+	sessionToken := SessionToken{}
+	sessionToken.IssueTimestamp = currentTimestamp
+	sessionToken.ExpireTimestamp = currentTimestamp + ConnectTokenExpireSeconds
+	assert.NoError(t, ValidateSessionTokenTimestamps(&sessionToken, currentTimestamp))
+
+	// small clock skew between auth and gateway is tolerated
+
+	sessionToken.IssueTimestamp = currentTimestamp + TimestampToleranceSeconds
+	assert.NoError(t, ValidateSessionTokenTimestamps(&sessionToken, currentTimestamp))
+
+	// tokens issued too far in the future are rejected
+
+	sessionToken.IssueTimestamp = currentTimestamp + TimestampToleranceSeconds + 1
+	assert.Error(t, ValidateSessionTokenTimestamps(&sessionToken, currentTimestamp))
+
+	// tokens that expire before they are issued are rejected
+
+	sessionToken.IssueTimestamp = currentTimestamp
+	sessionToken.ExpireTimestamp = currentTimestamp
+	assert.Error(t, ValidateSessionTokenTimestamps(&sessionToken, currentTimestamp))
+
+	// expired tokens are rejected
+
+	sessionToken.IssueTimestamp = currentTimestamp - 100
+	sessionToken.ExpireTimestamp = currentTimestamp - 1
+	assert.Error(t, ValidateSessionTokenTimestamps(&sessionToken, currentTimestamp))
+}
+
+func TestExtendSessionToken(t *testing.T) {
+
+	t.Parallel()
+
+	currentTimestamp := uint64(time.Now().Unix())
+
+	// tokens close to expiring are extended
+
+	sessionToken := SessionToken{}
+	sessionToken.IssueTimestamp = currentTimestamp - 100
+	sessionToken.ExpireTimestamp = currentTimestamp + SessionTokenExtensionSeconds
+	assert.NoError(t, ExtendSessionToken(&sessionToken, currentTimestamp))
+	assert.Equal(t, currentTimestamp+2*SessionTokenExtensionSeconds, sessionToken.ExpireTimestamp)
+
+	// tokens with plenty of time left are not
+
+	assert.Error(t, ExtendSessionToken(&sessionToken, currentTimestamp))
+	assert.Equal(t, currentTimestamp+2*SessionTokenExtensionSeconds, sessionToken.ExpireTimestamp)
+
+	// expired tokens can't be brought back
+
+	sessionToken.ExpireTimestamp = currentTimestamp - 1
+	assert.Error(t, ExtendSessionToken(&sessionToken, currentTimestamp))
+	assert.Equal(t, currentTimestamp-1, sessionToken.ExpireTimestamp)
+}
+
+func TestValidateSessionTokenClientIP(t *testing.T) {
+
+	t.Parallel()
+
+	// unbound tokens are accepted from anywhere
+
+	sessionToken := SessionToken{}
+	assert.NoError(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("198.51.100.1"), 32, 64))
+	assert.NoError(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("2001:db8::1"), 32, 64))
+
+	// bound ipv4 tokens match exactly by default, or within the prefix when tolerating cgnat
+
+	sessionToken.BindClientIP(net.ParseIP("203.0.113.7"))
+	assert.NoError(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("203.0.113.7"), 32, 64))
+	assert.NoError(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("::ffff:203.0.113.7"), 32, 64))
+	assert.Error(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("203.0.113.8"), 32, 64))
+	assert.NoError(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("203.0.113.8"), 24, 64))
+	assert.Error(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("203.0.114.7"), 24, 64))
+	assert.Error(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("2001:db8::1"), 32, 64))
+	assert.Error(t, ValidateSessionTokenClientIP(&sessionToken, nil, 32, 64))
+
+	// bound ipv6 tokens match within the prefix, so privacy addresses keep working
+
+	sessionToken = SessionToken{}
+	sessionToken.BindClientIP(net.ParseIP("2001:db8:1:2::1"))
+	assert.NoError(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("2001:db8:1:2:aaaa::9"), 32, 64))
+	assert.Error(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("2001:db8:1:3::1"), 32, 64))
+	assert.Error(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("203.0.113.7"), 32, 64))
+}
+
+// readConnectSessionToken reads the session token of a connect token, the way the gateway does
+func readConnectSessionToken(connectToken []byte, gatewayPrivateKey []byte, authPublicKey []byte) (SessionToken, bool) {
+	var sessionToken SessionToken
+	index := 0
+	var connectData ConnectData
+	if !ReadConnectData(connectToken, &index, &connectData) {
+		return sessionToken, false
+	}
+	signedTokenData := make([]byte, SignedSessionTokenBytes)
+	if !DecryptSessionToken(connectToken[index:], connectData.ClientPublicKey[:], signedTokenData, gatewayPrivateKey) {
+		return sessionToken, false
+	}
+	index = 0
+	return sessionToken, ReadSignedSessionToken(signedTokenData, &index, &sessionToken, authPublicKey)
+}
+
+func TestGenerateBoundConnectToken(t *testing.T) {
+
+	t.Parallel()
+
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+	authPublicKey, authPrivateKey := Keygen_Sign()
+
+	var userId [UserIdBytes]byte
+
+	connectToken := GenerateBoundConnectToken(userId[:], 2500, 10000, 100, 0, 0, 60, ParseAddress("127.0.0.1:40000"), gatewayPublicKey, authPrivateKey, 3, net.ParseIP("203.0.113.7"))
+	assert.Equal(t, ConnectTokenBytes, len(connectToken))
+
+	sessionToken, ok := readConnectSessionToken(connectToken, gatewayPrivateKey, authPublicKey)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(3), sessionToken.TenantId)
+	assert.NoError(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("203.0.113.7"), 32, 64))
+	assert.Error(t, ValidateSessionTokenClientIP(&sessionToken, net.ParseIP("198.51.100.1"), 32, 64))
+}
+
+func TestGenerateConnectTokenExpiry(t *testing.T) {
+
+	t.Parallel()
+
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+	authPublicKey, authPrivateKey := Keygen_Sign()
+
+	var userId [UserIdBytes]byte
+
+	currentTimestamp := uint64(time.Now().Unix())
+
+	connectToken := GenerateConnectToken(userId[:], 2500, 10000, 100, 4, 2, 60, ParseAddress("127.0.0.1:40000"), gatewayPublicKey, authPrivateKey)
+	assert.Equal(t, ConnectTokenBytes, len(connectToken))
+
+	index := 0
+	var connectData ConnectData
+	assert.True(t, ReadConnectData(connectToken, &index, &connectData))
+
+	sessionToken, ok := readConnectSessionToken(connectToken, gatewayPrivateKey, authPublicKey)
+	assert.True(t, ok)
+
+	assert.True(t, sessionToken.IssueTimestamp >= currentTimestamp)
+	assert.Equal(t, sessionToken.IssueTimestamp+60, sessionToken.ExpireTimestamp)
+	assert.Equal(t, sessionToken.ExpireTimestamp, connectData.ExpireTimestamp)
+	assert.Equal(t, uint8(4), connectData.FECDataShards)
+	assert.Equal(t, uint8(2), connectData.FECParityShards)
+	assert.NoError(t, ValidateSessionTokenTimestamps(&sessionToken, currentTimestamp))
+}
+
+func TestFallbackGateways(t *testing.T) {
+
+	t.Parallel()
+
+	gatewayPublicKey, _ := Keygen_Box()
+	_, authPrivateKey := Keygen_Sign()
+
+	var userId [UserIdBytes]byte
+
+	connectToken := GenerateConnectToken(userId[:], 2500, 10000, 100, 0, 0, 60, ParseAddress("127.0.0.1:40000"), gatewayPublicKey, authPrivateKey)
+
+	fallbackGateways, ok := ReadFallbackGateways(connectToken)
+	assert.True(t, ok)
+	assert.Nil(t, fallbackGateways)
+
+	assert.Equal(t, connectToken, AppendFallbackGateways(connectToken, nil))
+
+	tokenWithFallbacks := AppendFallbackGateways(connectToken, []*net.UDPAddr{ParseAddress("127.0.0.1:41000"), ParseAddress("[::1]:42000")})
+	assert.Equal(t, ConnectTokenBytes+1+2*AddressBytes, len(tokenWithFallbacks))
+	assert.Equal(t, connectToken, tokenWithFallbacks[:ConnectTokenBytes])
+
+	fallbackGateways, ok = ReadFallbackGateways(tokenWithFallbacks)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(fallbackGateways))
+	assert.True(t, AddressEqual(ParseAddress("127.0.0.1:41000"), &fallbackGateways[0]))
+	assert.True(t, AddressEqual(ParseAddress("[::1]:42000"), &fallbackGateways[1]))
+
+	// only MaxFallbackGateways fit in a connect token
+
+	var manyGateways []*net.UDPAddr
+	for i := 0; i < MaxFallbackGateways+2; i++ {
+		manyGateways = append(manyGateways, ParseAddress(fmt.Sprintf("127.0.0.1:%d", 41000+i)))
+	}
+	tokenWithFallbacks = AppendFallbackGateways(connectToken, manyGateways)
+	assert.Equal(t, MaxConnectTokenBytes, len(tokenWithFallbacks))
+	fallbackGateways, ok = ReadFallbackGateways(tokenWithFallbacks)
+	assert.True(t, ok)
+	assert.Equal(t, MaxFallbackGateways, len(fallbackGateways))
+
+	_, ok = ReadFallbackGateways(tokenWithFallbacks[:len(tokenWithFallbacks)-1])
+	assert.False(t, ok)
+
+	_, ok = ReadFallbackGateways(append(append([]byte(nil), connectToken...), 0))
+	assert.False(t, ok)
+}
+
 func TestConnectData(t *testing.T) {
 
 	t.Parallel()
@@ -440,6 +927,9 @@ func TestConnectData(t *testing.T) {
 	copy(connectData.ClientPrivateKey[:], privateKey)
 	connectData.GatewayAddress = *ParseAddress("127.0.0.1:40000")
 	RandomBytes_InPlace(connectData.GatewayPublicKey[:])
+	connectData.FECDataShards = 8
+	connectData.FECParityShards = 3
+	connectData.ExpireTimestamp = uint64(time.Now().Unix() + 20)
 
 	// write the connect data to a buffer and read it back in
 
@@ -469,3 +959,566 @@ func TestConnectData(t *testing.T) {
 
 	assert.False(t, result)
 }
+
+func TestWriteSafe(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 64)
+
+	index := 0
+
+	assert.NoError(t, WriteSafeBool(buffer, &index, true))
+	assert.NoError(t, WriteSafeUint8(buffer, &index, 10))
+	assert.NoError(t, WriteSafeUint16(buffer, &index, 1000))
+	assert.NoError(t, WriteSafeUint32(buffer, &index, 100000))
+	assert.NoError(t, WriteSafeUint64(buffer, &index, 10000000000))
+	assert.NoError(t, WriteSafeFloat32(buffer, &index, 100.0))
+	assert.NoError(t, WriteSafeFloat64(buffer, &index, 1000000.0))
+	assert.NoError(t, WriteSafeString(buffer, &index, "hello", 10))
+	assert.NoError(t, WriteSafeBytes(buffer, &index, []byte{1, 2, 3}, 3))
+	assert.NoError(t, WriteSafeAddress(buffer, &index, ParseAddress("127.0.0.1:40000")))
+
+	assert.Equal(t, 1+1+2+4+8+4+8+4+5+3+AddressBytes, index)
+
+	// writes past the end of the buffer return an error and leave the index unchanged
+
+	full := index
+
+	assert.Error(t, WriteSafeUint64(buffer, &index, 0))
+	assert.Error(t, WriteSafeString(buffer, &index, "this string is too long", 100))
+	assert.Error(t, WriteSafeString(buffer, &index, "hello", 4))
+	assert.Error(t, WriteSafeBytes(buffer, &index, []byte{1}, 2))
+	assert.Error(t, WriteSafeAddress(buffer, &index, ParseAddress("127.0.0.1:40000")))
+
+	assert.Equal(t, full, index)
+
+	assert.NoError(t, WriteSafeUint8(buffer, &index, 1))
+	assert.NoError(t, WriteSafeUint32(buffer, &index, 1))
+	assert.Error(t, WriteSafeUint8(buffer, &index, 1))
+}
+
+func TestVarint(t *testing.T) {
+
+	t.Parallel()
+
+	values32 := []uint32{0, 1, 127, 128, 255, 300, 16383, 16384, 1000000, math.MaxUint32}
+	sizes32 := []int{1, 1, 1, 2, 2, 2, 2, 3, 3, 5}
+
+	buffer := make([]byte, 256)
+
+	for i := range values32 {
+		index := 0
+		WriteVarint32(buffer, &index, values32[i])
+		assert.Equal(t, sizes32[i], index)
+		var value uint32
+		readIndex := 0
+		assert.True(t, ReadVarint32(buffer[:index], &readIndex, &value))
+		assert.Equal(t, values32[i], value)
+		assert.Equal(t, index, readIndex)
+	}
+
+	values64 := []uint64{0, 1, 127, 128, 1 << 32, 1 << 56, math.MaxUint64}
+	sizes64 := []int{1, 1, 1, 2, 5, 9, 10}
+
+	for i := range values64 {
+		index := 0
+		WriteVarint64(buffer, &index, values64[i])
+		assert.Equal(t, sizes64[i], index)
+		var value uint64
+		readIndex := 0
+		assert.True(t, ReadVarint64(buffer[:index], &readIndex, &value))
+		assert.Equal(t, values64[i], value)
+		assert.Equal(t, index, readIndex)
+	}
+
+	// truncated varints fail to read
+
+	index := 0
+	WriteVarint64(buffer, &index, math.MaxUint64)
+	var value64 uint64
+	readIndex := 0
+	assert.False(t, ReadVarint64(buffer[:index-1], &readIndex, &value64))
+	assert.Equal(t, 0, readIndex)
+
+	// 64 bit values don't fit in a 32 bit varint
+
+	var value32 uint32
+	readIndex = 0
+	assert.False(t, ReadVarint32(buffer[:index], &readIndex, &value32))
+
+	// empty buffer
+
+	readIndex = 0
+	assert.False(t, ReadVarint32(buffer[:0], &readIndex, &value32))
+}
+
+func TestAddressRoundTrip(t *testing.T) {
+
+	t.Parallel()
+
+	inputs := []string{
+		"127.0.0.1:40000",
+		"10.0.0.1:0",
+		"255.255.255.255:65535",
+		"[::1]:50000",
+		"[2001:db8::ff00:42:8329]:12345",
+		"[fe80::1%eth0]:30000",
+	}
+
+	for _, input := range inputs {
+
+		address, err := net.ResolveUDPAddr("udp", input)
+		assert.NoError(t, err)
+
+		buffer := make([]byte, AddressBytes)
+
+		index := 0
+		WriteAddress(buffer, &index, address)
+		assert.Equal(t, AddressBytes, index)
+
+		var readAddress net.UDPAddr
+		index = 0
+		assert.True(t, ReadAddress(buffer, &index, &readAddress))
+		assert.Equal(t, AddressBytes, index)
+
+		// the zone is not part of the wire format
+
+		assert.True(t, address.IP.Equal(readAddress.IP), input)
+		assert.Equal(t, address.Port, readAddress.Port, input)
+		assert.Equal(t, "", readAddress.Zone, input)
+	}
+}
+
+func TestAddressIPv4Mapped(t *testing.T) {
+
+	t.Parallel()
+
+	// dual-stack sockets see ipv4 clients as ipv4-mapped ipv6 addresses. these go on the wire as ipv4,
+	// and compare equal to the plain ipv4 address
+
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 30000}
+	plain := ParseAddress("10.0.0.1:30000")
+	assert.Equal(t, net.IPv6len, len(mapped.IP))
+	assert.True(t, AddressEqual(mapped, plain))
+	assert.False(t, AddressEqual(mapped, ParseAddress("[::a00:1]:30000")))
+
+	buffer := make([]byte, AddressBytes)
+	index := 0
+	WriteAddress(buffer, &index, mapped)
+	assert.Equal(t, byte(IPAddressIPv4), buffer[0])
+
+	var readAddress net.UDPAddr
+	index = 0
+	ReadAddress(buffer, &index, &readAddress)
+	assert.True(t, AddressEqual(plain, &readAddress))
+
+	var a, b [MaxAddressDataBytes]byte
+	var aPort, bPort uint16
+	aBytes := GetAddressData(mapped, a[:], &aPort)
+	bBytes := GetAddressData(plain, b[:], &bPort)
+	assert.Equal(t, a[:aBytes], b[:bBytes])
+}
+
+func TestReadAddressCopies(t *testing.T) {
+
+	t.Parallel()
+
+	// addresses read from a packet stay valid after the packet buffer is reused
+
+	address := ParseAddress("[2001:db8::1]:40000")
+
+	buffer := make([]byte, AddressBytes)
+	index := 0
+	WriteAddress(buffer, &index, address)
+
+	var readAddress net.UDPAddr
+	index = 0
+	ReadAddress(buffer, &index, &readAddress)
+
+	for i := range buffer {
+		buffer[i] = 0xFF
+	}
+
+	assert.True(t, AddressEqual(address, &readAddress))
+
+	// an address without an ip is written as the unspecified ipv6 address, not left as whatever was in the buffer
+
+	index = 0
+	WriteAddress(buffer, &index, &net.UDPAddr{Port: 1000})
+	index = 0
+	ReadAddress(buffer, &index, &readAddress)
+	assert.True(t, readAddress.IP.Equal(net.IPv6zero))
+	assert.Equal(t, 1000, readAddress.Port)
+}
+
+func TestReadAddressInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, AddressBytes)
+	index := 0
+	WriteAddress(buffer, &index, ParseAddress("[2001:db8::1]:40000"))
+
+	var address net.UDPAddr
+
+	// truncated buffers and unknown address types fail without moving the index
+
+	index = 0
+	assert.False(t, ReadAddress(buffer[:AddressBytes-1], &index, &address))
+	assert.Equal(t, 0, index)
+
+	index = 1
+	assert.False(t, ReadAddress(buffer, &index, &address))
+	assert.Equal(t, 1, index)
+
+	buffer[0] = 3
+	index = 0
+	assert.False(t, ReadAddress(buffer, &index, &address))
+	assert.Equal(t, 0, index)
+
+	// no address reads back as an empty address, not whatever was there before
+
+	address = *ParseAddress("10.0.0.1:1000")
+	index = 0
+	WriteAddress(buffer, &index, nil)
+	index = 0
+	assert.True(t, ReadAddress(buffer, &index, &address))
+	assert.Nil(t, address.IP)
+	assert.Equal(t, 0, address.Port)
+
+	// challenge tokens and connect data with an unknown address type don't read
+
+	buffer = make([]byte, ChallengeTokenBytes)
+	buffer[8] = 3
+	index = 0
+	var challengeToken ChallengeToken
+	assert.False(t, ReadChallengeToken(buffer, &index, &challengeToken))
+}
+
+func TestGetAddressData(t *testing.T) {
+
+	t.Parallel()
+
+	var addressData [MaxAddressDataBytes]byte
+	var addressPort uint16
+
+	bytes := GetAddressData(ParseAddress("1.2.3.4:5000"), addressData[:], &addressPort)
+	assert.Equal(t, 4, bytes)
+	assert.Equal(t, []byte{1, 2, 3, 4}, addressData[:bytes])
+	assert.Equal(t, uint16(5000), addressPort)
+
+	ipv6 := net.ParseIP("2001:db8::ff00:42:8329")
+	bytes = GetAddressData(&net.UDPAddr{IP: ipv6, Port: 6000, Zone: "eth0"}, addressData[:], &addressPort)
+	assert.Equal(t, 16, bytes)
+	assert.Equal(t, []byte(ipv6), addressData[:bytes])
+	assert.Equal(t, uint16(6000), addressPort)
+
+	bytes = GetAddressData(&net.UDPAddr{Port: 7000}, addressData[:], &addressPort)
+	assert.Equal(t, 0, bytes)
+	assert.Equal(t, uint16(7000), addressPort)
+
+	// address data read back from the wire matches the original address data
+
+	for _, input := range []string{"127.0.0.1:40000", "[::1]:50000", "[fe80::1%eth0]:30000"} {
+
+		address, err := net.ResolveUDPAddr("udp", input)
+		assert.NoError(t, err)
+
+		buffer := make([]byte, AddressBytes)
+		index := 0
+		WriteAddress(buffer, &index, address)
+
+		var readAddress net.UDPAddr
+		index = 0
+		ReadAddress(buffer, &index, &readAddress)
+
+		var a, b [MaxAddressDataBytes]byte
+		var aPort, bPort uint16
+		aBytes := GetAddressData(address, a[:], &aPort)
+		bBytes := GetAddressData(&readAddress, b[:], &bPort)
+		assert.Equal(t, a[:aBytes], b[:bBytes], input)
+		assert.Equal(t, aPort, bPort, input)
+	}
+}
+
+func TestAddressMidPacket(t *testing.T) {
+
+	t.Parallel()
+
+	// addresses are written and read at the index like every other field
+
+	clientAddress := ParseAddress("10.0.0.1:30000")
+	gatewayAddress := ParseAddress("[2001:db8::1]:40000")
+
+	buffer := make([]byte, 1+AddressBytes+8+AddressBytes+1)
+
+	index := 0
+	WriteUint8(buffer, &index, 1)
+	WriteAddress(buffer, &index, clientAddress)
+	WriteUint64(buffer, &index, 12345)
+	WriteAddress(buffer, &index, gatewayAddress)
+	WriteUint8(buffer, &index, 2)
+	assert.Equal(t, len(buffer), index)
+
+	var a, b uint8
+	var sequence uint64
+	var readClientAddress, readGatewayAddress net.UDPAddr
+
+	index = 0
+	ReadUint8(buffer, &index, &a)
+	assert.True(t, ReadAddress(buffer, &index, &readClientAddress))
+	ReadUint64(buffer, &index, &sequence)
+	assert.True(t, ReadAddress(buffer, &index, &readGatewayAddress))
+	ReadUint8(buffer, &index, &b)
+	assert.Equal(t, len(buffer), index)
+
+	assert.Equal(t, uint8(1), a)
+	assert.Equal(t, uint8(2), b)
+	assert.Equal(t, uint64(12345), sequence)
+	assert.True(t, AddressEqual(clientAddress, &readClientAddress))
+	assert.True(t, AddressEqual(gatewayAddress, &readGatewayAddress))
+}
+
+func TestResolveAddress(t *testing.T) {
+
+	t.Parallel()
+
+	address, err := ResolveAddress("127.0.0.1:40000")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:40000", address.String())
+
+	address, err = ResolveAddress("127.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:0", address.String())
+
+	address, err = ResolveAddress("[::1]:50000")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:50000", address.String())
+
+	address, err = ResolveAddress("[::1]")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:0", address.String())
+
+	address, err = ResolveAddress("::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:0", address.String())
+
+	address, err = ResolveAddress(" 10.0.0.1:1000 ")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:1000", address.String())
+
+	address, err = ResolveAddress("localhost:30000")
+	assert.NoError(t, err)
+	assert.True(t, address.IP.IsLoopback())
+	assert.Equal(t, 30000, address.Port)
+
+	_, err = ResolveAddress("")
+	assert.Error(t, err)
+
+	_, err = ResolveAddress(":40000")
+	assert.Error(t, err)
+
+	_, err = ResolveAddress("127.0.0.1:notaport")
+	assert.Error(t, err)
+
+	_, err = ResolveAddress("127.0.0.1:99999")
+	assert.Error(t, err)
+
+	_, err = ResolveAddress("this.host.does.not.exist.invalid:40000")
+	assert.Error(t, err)
+}
+
+func TestReadInto(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 256)
+
+	index := 0
+	WriteString(buffer, &index, "hello world", 32)
+	WriteBytes(buffer, &index, []byte{1, 2, 3, 4, 5}, 5)
+	WriteBytes(buffer, &index, []byte{6, 7, 8}, 3)
+	data := buffer[:index]
+
+	// read string into a caller provided buffer
+
+	index = 0
+	var stringData [32]byte
+	stringLength := 0
+	assert.True(t, ReadStringInto(data, &index, stringData[:], &stringLength, 32))
+	assert.Equal(t, "hello world", string(stringData[:stringLength]))
+
+	// read bytes into a caller provided buffer
+
+	var bytesData [5]byte
+	assert.True(t, ReadBytesInto(data, &index, bytesData[:]))
+	assert.Equal(t, [5]byte{1, 2, 3, 4, 5}, bytesData)
+
+	// read a reference to the bytes without copying
+
+	var ref []byte
+	assert.True(t, ReadBytesRef(data, &index, &ref, 3))
+	assert.Equal(t, []byte{6, 7, 8}, ref)
+	assert.Equal(t, len(data), index)
+	assert.Equal(t, 3, cap(ref))
+
+	data[len(data)-1] = 9
+	assert.Equal(t, byte(9), ref[2])
+
+	// reading past the end fails and leaves the index untouched
+
+	assert.False(t, ReadBytesInto(data, &index, bytesData[:]))
+	assert.False(t, ReadBytesRef(data, &index, &ref, 1))
+	assert.Equal(t, len(data), index)
+
+	// string longer than the max or the destination buffer fails
+
+	index = 0
+	assert.False(t, ReadStringInto(data, &index, stringData[:], &stringLength, 5))
+	assert.Equal(t, 0, index)
+	assert.False(t, ReadStringInto(data, &index, stringData[:4], &stringLength, 32))
+	assert.Equal(t, 0, index)
+
+	// read string still works
+
+	index = 0
+	var value string
+	assert.True(t, ReadString(data, &index, &value, 32))
+	assert.Equal(t, "hello world", value)
+}
+
+// Fuzz targets for everything that reads data off the wire. Malformed input must fail to read, never panic.
+// Run one with "go test ./modules/core -run '^$' -fuzz FuzzReadAddress".
+
+func FuzzReadString(f *testing.F) {
+	buffer := make([]byte, 64)
+	index := 0
+	WriteString(buffer, &index, "hello world", 32)
+	f.Add(buffer[:index], uint32(32))
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 'a'}, uint32(math.MaxUint32))
+	f.Fuzz(func(t *testing.T, data []byte, maxStringLength uint32) {
+		index := 0
+		var value string
+		if !ReadString(data, &index, &value, maxStringLength) {
+			return
+		}
+		assert.LessOrEqual(t, uint32(len(value)), maxStringLength)
+		assert.Equal(t, 4+len(value), index)
+
+		var valueData [256]byte
+		var valueLength int
+		index = 0
+		if ReadStringInto(data, &index, valueData[:], &valueLength, maxStringLength) {
+			assert.Equal(t, value, string(valueData[:valueLength]))
+		}
+	})
+}
+
+func FuzzReadBytes(f *testing.F) {
+	f.Add([]byte{1, 2, 3, 4, 5}, 0, uint16(5))
+	f.Add([]byte{1, 2, 3}, 2, uint16(2))
+	f.Fuzz(func(t *testing.T, data []byte, start int, bytes uint16) {
+		// indexes always come from earlier reads of the same data
+		if start < 0 || start > len(data) {
+			return
+		}
+		value := make([]byte, bytes)
+		index := start
+		if ReadBytes(data, &index, value, uint32(bytes)) {
+			assert.Equal(t, data[start:start+int(bytes)], value)
+			assert.Equal(t, start+int(bytes), index)
+		}
+		index = start
+		if ReadBytesInto(data, &index, value) {
+			assert.Equal(t, data[start:start+int(bytes)], value)
+		}
+		var ref []byte
+		index = start
+		if ReadBytesRef(data, &index, &ref, int(bytes)) {
+			assert.Equal(t, data[start:start+int(bytes)], ref)
+		}
+	})
+}
+
+func FuzzReadAddress(f *testing.F) {
+	for _, address := range []string{"127.0.0.1:40000", "[2001:db8::1]:50000", "[::ffff:10.0.0.1]:1"} {
+		buffer := make([]byte, AddressBytes)
+		index := 0
+		WriteAddress(buffer, &index, ParseAddress(address))
+		f.Add(buffer)
+	}
+	f.Add([]byte{IPAddressNone})
+	f.Add([]byte{0xFF, 1, 2, 3, 4, 5, 6})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		index := 0
+		var address net.UDPAddr
+		if !ReadAddress(data, &index, &address) {
+			assert.Equal(t, 0, index)
+			return
+		}
+		assert.Equal(t, AddressBytes, index)
+		if data[0] == IPAddressNone {
+			return
+		}
+
+		// whatever reads back in writes out the same
+
+		buffer := make([]byte, AddressBytes)
+		index = 0
+		WriteAddress(buffer, &index, &address)
+		index = 0
+		var readAddress net.UDPAddr
+		assert.True(t, ReadAddress(buffer, &index, &readAddress))
+		assert.True(t, AddressEqual(&address, &readAddress))
+	})
+}
+
+func FuzzReadConnectToken(f *testing.F) {
+	gatewayPublicKey, _ := Keygen_Box()
+	_, authPrivateKey := Keygen_Sign()
+	userId := make([]byte, UserIdBytes)
+	f.Add(GenerateConnectToken(userId, 256, 256, 10, 0, 0, 60, ParseAddress("127.0.0.1:40000"), gatewayPublicKey, authPrivateKey))
+	f.Add(GenerateBoundConnectToken(userId, 256, 256, 10, 8, 3, 60, ParseAddress("[2001:db8::1]:40000"), gatewayPublicKey, authPrivateKey, 1, net.ParseIP("2001:db8::2")))
+	f.Fuzz(func(t *testing.T, connectToken []byte) {
+		index := 0
+		var connectData ConnectData
+		if !ReadConnectData(connectToken, &index, &connectData) {
+			return
+		}
+		assert.Equal(t, ConnectDataBytes, index)
+
+		buffer := make([]byte, ConnectDataBytes)
+		index = 0
+		WriteConnectData(buffer, &index, &connectData)
+		index = 0
+		var readConnectData ConnectData
+		assert.True(t, ReadConnectData(buffer, &index, &readConnectData))
+		assert.Equal(t, connectData.GatewayPublicKey, readConnectData.GatewayPublicKey)
+		assert.Equal(t, connectData.ExpireTimestamp, readConnectData.ExpireTimestamp)
+	})
+}
+
+func FuzzReadSessionToken(f *testing.F) {
+	publicKey, privateKey := Keygen_Sign()
+	sessionToken := SessionToken{IssueTimestamp: 1, ExpireTimestamp: 2, EnvelopeUpKbps: 256, EnvelopeDownKbps: 1024, PacketsPerSecond: 10}
+	sessionToken.BindClientIP(net.ParseIP("203.0.113.7"))
+	buffer := make([]byte, SignedSessionTokenBytes)
+	index := 0
+	WriteSessionToken(buffer, &index, &sessionToken)
+	f.Add(buffer[:index])
+	index = 0
+	WriteSignedSessionToken(buffer, &index, &sessionToken, privateKey)
+	f.Add(buffer)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		index := 0
+		var readSessionToken SessionToken
+		if ReadSessionToken(data, &index, &readSessionToken) {
+			assert.Equal(t, SessionTokenBytes, index)
+		}
+		index = 0
+		if ReadSignedSessionToken(data, &index, &readSessionToken, publicKey) {
+			assert.Equal(t, SignedSessionTokenBytes, index)
+		}
+	})
+}
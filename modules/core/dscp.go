@@ -0,0 +1,173 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Priority is the traffic class of a packet. Where the network honors DiffServ, each priority can be
+// tagged with its own DSCP. Packets from the server carry their priority in the header flags, so the
+// gateway can tag them on the way to the client.
+type Priority uint8
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityLow
+	NumPriorities
+)
+
+func (priority Priority) String() string {
+	switch priority {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	}
+	return fmt.Sprintf("unknown(%d)", int(priority))
+}
+
+func ParsePriority(value string) (Priority, error) {
+	for priority := Priority(0); priority < NumPriorities; priority++ {
+		if strings.EqualFold(value, priority.String()) {
+			return priority, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q", value)
+}
+
+// PriorityFlags are the header flags for a priority
+func PriorityFlags(priority Priority) uint8 {
+	switch priority {
+	case PriorityHigh:
+		return Flags_PriorityHigh
+	case PriorityLow:
+		return Flags_PriorityLow
+	}
+	return 0
+}
+
+// PriorityFromFlags reads the priority from header flags
+func PriorityFromFlags(flags uint8) Priority {
+	switch {
+	case flags&Flags_PriorityHigh != 0:
+		return PriorityHigh
+	case flags&Flags_PriorityLow != 0:
+		return PriorityLow
+	}
+	return PriorityNormal
+}
+
+const MaxDSCP = 63
+
+const DSCP_Default = 0
+const DSCP_LE = 1
+const DSCP_CS1 = 8
+const DSCP_AF41 = 34
+const DSCP_VA = 44
+const DSCP_EF = 46
+
+// ParseDSCP parses a DSCP as a number from 0 to 63, or by name: CS0 to CS7, AF11 to AF43, EF, VA or LE
+func ParseDSCP(value string) (int, error) {
+	name := strings.ToUpper(strings.TrimSpace(value))
+	switch {
+	case name == "EF":
+		return DSCP_EF, nil
+	case name == "VA":
+		return DSCP_VA, nil
+	case name == "LE":
+		return DSCP_LE, nil
+	case len(name) == 3 && strings.HasPrefix(name, "CS") && name[2] >= '0' && name[2] <= '7':
+		return int(name[2]-'0') * 8, nil
+	case len(name) == 4 && strings.HasPrefix(name, "AF") && name[2] >= '1' && name[2] <= '4' && name[3] >= '1' && name[3] <= '3':
+		return int(name[2]-'0')*8 + int(name[3]-'0')*2, nil
+	}
+	dscp, err := strconv.Atoi(name)
+	if err != nil || dscp < 0 || dscp > MaxDSCP {
+		return 0, fmt.Errorf("invalid dscp %q", value)
+	}
+	return dscp, nil
+}
+
+// DSCPConfig is the DSCP packets of each priority are tagged with. Zero leaves packets untagged.
+type DSCPConfig [NumPriorities]int
+
+// ParseDSCPConfig parses a comma separated list of priority=dscp, eg. "normal=AF41,high=EF,low=CS1". A
+// dscp on its own sets every priority, so "AF41,high=EF" tags everything but high priority packets AF41.
+func ParseDSCPConfig(value string) (DSCPConfig, error) {
+	var config DSCPConfig
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, dscpValue, hasPriority := strings.Cut(entry, "=")
+		if !hasPriority {
+			dscp, err := ParseDSCP(entry)
+			if err != nil {
+				return DSCPConfig{}, err
+			}
+			for i := range config {
+				config[i] = dscp
+			}
+			continue
+		}
+		priority, err := ParsePriority(strings.TrimSpace(name))
+		if err != nil {
+			return DSCPConfig{}, err
+		}
+		dscp, err := ParseDSCP(dscpValue)
+		if err != nil {
+			return DSCPConfig{}, err
+		}
+		config[priority] = dscp
+	}
+	return config, nil
+}
+
+func (config DSCPConfig) String() string {
+	entries := make([]string, NumPriorities)
+	for priority := Priority(0); priority < NumPriorities; priority++ {
+		entries[priority] = fmt.Sprintf("%s=%d", priority, config[priority])
+	}
+	return strings.Join(entries, ",")
+}
+
+// Enabled is true if any priority is tagged
+func (config DSCPConfig) Enabled() bool {
+	return config != DSCPConfig{}
+}
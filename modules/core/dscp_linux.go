@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetDSCP tags every packet sent on the socket with the DSCP, unless the packet has its own.
+func SetDSCP(conn *net.UDPConn, dscp int) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		var family int
+		family, sockoptErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if sockoptErr != nil {
+			return
+		}
+		// dual stack sockets send ipv4 packets with IP_TOS and ipv6 packets with IPV6_TCLASS
+		if family == unix.AF_INET6 {
+			if sockoptErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, dscp<<2); sockoptErr != nil {
+				return
+			}
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, dscp<<2)
+			return
+		}
+		sockoptErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	if sockoptErr != nil {
+		return fmt.Errorf("could not set dscp: %v", sockoptErr)
+	}
+	return nil
+}
+
+// DSCPControlMessage is the control message that tags one packet to the address with the DSCP, for
+// net.UDPConn.WriteMsgUDP.
+func DSCPControlMessage(dscp int, address *net.UDPAddr) []byte {
+	control := make([]byte, unix.CmsgSpace(4))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+	if address.IP.To4() != nil {
+		header.Level = unix.IPPROTO_IP
+		header.Type = unix.IP_TOS
+	} else {
+		header.Level = unix.IPPROTO_IPV6
+		header.Type = unix.IPV6_TCLASS
+	}
+	header.SetLen(unix.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&control[unix.CmsgLen(0)])) = int32(dscp << 2)
+	return control
+}
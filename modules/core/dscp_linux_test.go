@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetDSCP(t *testing.T) {
+
+	t.Parallel()
+
+	for _, network := range []string{"udp4", "udp"} {
+
+		conn, err := net.ListenUDP(network, nil)
+		assert.Nil(t, err)
+		defer conn.Close()
+
+		assert.Nil(t, SetDSCP(conn, DSCP_AF41))
+
+		rawConn, err := conn.SyscallConn()
+		assert.Nil(t, err)
+		rawConn.Control(func(fd uintptr) {
+			option := unix.IP_TOS
+			level := unix.IPPROTO_IP
+			if network == "udp" {
+				level, option = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+			}
+			value, err := unix.GetsockoptInt(int(fd), level, option)
+			assert.Nil(t, err)
+			assert.Equal(t, DSCP_AF41<<2, value)
+		})
+	}
+}
+
+func TestDSCPControlMessage(t *testing.T) {
+
+	t.Parallel()
+
+	receiver, err := net.ListenUDP("udp4", ParseAddress("127.0.0.1:0"))
+	assert.Nil(t, err)
+	defer receiver.Close()
+
+	sender, err := net.ListenUDP("udp4", ParseAddress("127.0.0.1:0"))
+	assert.Nil(t, err)
+	defer sender.Close()
+
+	// the receiver reads the tos of each packet, which is the dscp the packet was tagged with
+
+	rawConn, err := receiver.SyscallConn()
+	assert.Nil(t, err)
+	rawConn.Control(func(fd uintptr) {
+		assert.Nil(t, unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1))
+	})
+
+	address := receiver.LocalAddr().(*net.UDPAddr)
+	_, _, err = sender.WriteMsgUDP([]byte("hello"), DSCPControlMessage(DSCP_EF, address), address)
+	assert.Nil(t, err)
+
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packetData := make([]byte, 100)
+	control := make([]byte, 100)
+	_, controlBytes, _, _, err := receiver.ReadMsgUDP(packetData, control)
+	assert.Nil(t, err)
+
+	messages, err := unix.ParseSocketControlMessage(control[:controlBytes])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	if len(messages) == 1 {
+		assert.Equal(t, int32(unix.IP_TOS), messages[0].Header.Type)
+		assert.Equal(t, byte(DSCP_EF<<2), messages[0].Data[0])
+	}
+}
@@ -0,0 +1,94 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDSCP(t *testing.T) {
+
+	t.Parallel()
+
+	for value, expected := range map[string]int{"EF": 46, "ef": 46, "AF41": 34, "AF11": 10, "AF43": 38, "CS0": 0, "CS1": 8, "CS6": 48, "VA": 44, "LE": 1, "0": 0, "63": 63} {
+		dscp, err := ParseDSCP(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, dscp, value)
+	}
+
+	for _, value := range []string{"", "64", "-1", "AF44", "AF51", "CS8", "XX"} {
+		_, err := ParseDSCP(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestParseDSCPConfig(t *testing.T) {
+
+	t.Parallel()
+
+	config, err := ParseDSCPConfig("")
+	assert.Nil(t, err)
+	assert.False(t, config.Enabled())
+
+	config, err = ParseDSCPConfig("EF")
+	assert.Nil(t, err)
+	assert.Equal(t, DSCPConfig{DSCP_EF, DSCP_EF, DSCP_EF}, config)
+
+	config, err = ParseDSCPConfig("AF41, high=EF, low=CS1")
+	assert.Nil(t, err)
+	assert.Equal(t, DSCP_AF41, config[PriorityNormal])
+	assert.Equal(t, DSCP_EF, config[PriorityHigh])
+	assert.Equal(t, DSCP_CS1, config[PriorityLow])
+	assert.Equal(t, "normal=34,high=46,low=8", config.String())
+	assert.True(t, config.Enabled())
+
+	_, err = ParseDSCPConfig("urgent=EF")
+	assert.NotNil(t, err)
+
+	_, err = ParseDSCPConfig("high=99")
+	assert.NotNil(t, err)
+}
+
+func TestPriorityFlags(t *testing.T) {
+
+	t.Parallel()
+
+	for priority := Priority(0); priority < NumPriorities; priority++ {
+		assert.Equal(t, priority, PriorityFromFlags(PriorityFlags(priority)|Flags_OverBandwidth))
+		parsed, err := ParsePriority(priority.String())
+		assert.Nil(t, err)
+		assert.Equal(t, priority, parsed)
+	}
+	assert.Equal(t, uint8(0), PriorityFlags(PriorityNormal))
+}
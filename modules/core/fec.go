@@ -0,0 +1,432 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+// FEC shards start with the group id, the shard index in the group, and the number of data and parity shards
+// in the group, so the receiver can decode any group without knowing the sender's parameters up front.
+const FECHeaderBytes = 5
+
+// Parity shards cover each data shard prefixed with its length, so data shards of different sizes can be recovered.
+const FECLengthBytes = 2
+
+const MaxFECShards = 32
+
+// FECGroups is how many groups the decoder keeps at once. Shards for older groups are dropped.
+const FECGroups = 64
+
+const DefaultFECTimeout = time.Second
+
+// Reed-Solomon over GF(2^8) with the 0x11d polynomial.
+
+var gfExp [512]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// fecCoefficient is the coefficient of a data shard in a parity shard. The parity rows form a Cauchy matrix
+// with each column scaled so the first parity shard is the XOR of the data shards. Any square submatrix of
+// a scaled Cauchy matrix is invertible, so the data can be recovered from any dataShards of the shards.
+func fecCoefficient(dataShards int, parity int, data int) byte {
+	x0 := byte(dataShards)
+	x := byte(dataShards + parity)
+	y := byte(data)
+	return gfMul(x0^y, gfInv(x^y))
+}
+
+func validateFEC(dataShards int, parityShards int) error {
+	if dataShards < 1 || parityShards < 1 || dataShards+parityShards > MaxFECShards {
+		return fmt.Errorf("invalid fec parameters: %d data shards, %d parity shards", dataShards, parityShards)
+	}
+	return nil
+}
+
+// ValidateFECConfig checks the FEC parameters carried in a connect token. Zero data and parity shards disables FEC.
+func ValidateFECConfig(dataShards int, parityShards int) error {
+	if dataShards == 0 && parityShards == 0 {
+		return nil
+	}
+	return validateFEC(dataShards, parityShards)
+}
+
+// FECEncoder groups payloads and generates the parity shards for each group. Data shards are sent straight away,
+// so FEC only adds latency when a shard has to be recovered.
+type FECEncoder struct {
+	dataShards   int
+	parityShards int
+	groupId      uint16
+	group        [][]byte
+}
+
+func CreateFECEncoder(dataShards int, parityShards int) (*FECEncoder, error) {
+	if err := validateFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+	encoder := &FECEncoder{}
+	encoder.dataShards = dataShards
+	encoder.parityShards = parityShards
+	return encoder, nil
+}
+
+// Encode returns the shards to send for the payload: its data shard, followed by the parity shards
+// when the payload completes a group.
+func (encoder *FECEncoder) Encode(payload []byte) ([][]byte, error) {
+
+	if len(payload) > 0xffff {
+		return nil, fmt.Errorf("fec payload is too large: %d bytes", len(payload))
+	}
+
+	shards := [][]byte{encoder.writeShard(len(encoder.group), payload)}
+
+	encoder.group = append(encoder.group, payload)
+
+	if len(encoder.group) < encoder.dataShards {
+		return shards, nil
+	}
+
+	parityBytes := 0
+	for i := range encoder.group {
+		if len(encoder.group[i]) > parityBytes {
+			parityBytes = len(encoder.group[i])
+		}
+	}
+	parityBytes += FECLengthBytes
+
+	for p := 0; p < encoder.parityShards; p++ {
+		parity := make([]byte, parityBytes)
+		for i := range encoder.group {
+			fecMulAdd(parity, fecPadShard(encoder.group[i], parityBytes), fecCoefficient(encoder.dataShards, p, i))
+		}
+		shards = append(shards, encoder.writeShard(encoder.dataShards+p, parity))
+	}
+
+	encoder.group = encoder.group[:0]
+	encoder.groupId++
+
+	return shards, nil
+}
+
+func (encoder *FECEncoder) writeShard(shardIndex int, data []byte) []byte {
+	shard := make([]byte, FECHeaderBytes+len(data))
+	index := 0
+	WriteUint16(shard, &index, encoder.groupId)
+	WriteUint8(shard, &index, uint8(shardIndex))
+	WriteUint8(shard, &index, uint8(encoder.dataShards))
+	WriteUint8(shard, &index, uint8(encoder.parityShards))
+	WriteBytes(shard, &index, data, len(data))
+	return shard
+}
+
+// fecPadShard prefixes a data shard with its length and pads it out to the parity shard size.
+func fecPadShard(data []byte, shardBytes int) []byte {
+	padded := make([]byte, shardBytes)
+	index := 0
+	WriteUint16(padded, &index, uint16(len(data)))
+	copy(padded[FECLengthBytes:], data)
+	return padded
+}
+
+func fecMulAdd(output []byte, input []byte, coefficient byte) {
+	if coefficient == 0 {
+		return
+	}
+	if coefficient == 1 {
+		for i := range input {
+			output[i] ^= input[i]
+		}
+		return
+	}
+	logCoefficient := int(gfLog[coefficient])
+	for i := range input {
+		if input[i] != 0 {
+			output[i] ^= gfExp[int(gfLog[input[i]])+logCoefficient]
+		}
+	}
+}
+
+type fecGroup struct {
+	groupId      uint16
+	dataShards   int
+	parityShards int
+	shards       [MaxFECShards][]byte
+	received     int
+	complete     bool
+	createTime   time.Time
+}
+
+// FECDecoder delivers data shards as they arrive, and recovers missing data shards once
+// any dataShards of the shards in their group have arrived. Groups older than the timeout
+// are discarded, so a group id that has wrapped around starts a new group.
+type FECDecoder struct {
+	timeout   time.Duration
+	groups    [FECGroups]*fecGroup
+	recovered uint64
+}
+
+func CreateFECDecoder(timeout time.Duration) *FECDecoder {
+	decoder := &FECDecoder{}
+	decoder.timeout = timeout
+	return decoder
+}
+
+// ProcessShard returns the payloads that became available with this shard, in group order.
+func (decoder *FECDecoder) ProcessShard(shard []byte, currentTime time.Time) ([][]byte, error) {
+
+	if len(shard) < FECHeaderBytes {
+		return nil, fmt.Errorf("fec shard is too small: %d bytes", len(shard))
+	}
+
+	index := 0
+	var groupId uint16
+	var shardIndex, dataShards, parityShards uint8
+	ReadUint16(shard, &index, &groupId)
+	ReadUint8(shard, &index, &shardIndex)
+	ReadUint8(shard, &index, &dataShards)
+	ReadUint8(shard, &index, &parityShards)
+
+	if err := validateFEC(int(dataShards), int(parityShards)); err != nil {
+		return nil, err
+	}
+
+	if int(shardIndex) >= int(dataShards)+int(parityShards) {
+		return nil, fmt.Errorf("fec shard index %d is out of range", shardIndex)
+	}
+
+	data := shard[FECHeaderBytes:]
+
+	if int(shardIndex) >= int(dataShards) && len(data) < FECLengthBytes {
+		return nil, fmt.Errorf("fec parity shard is too small: %d bytes", len(data))
+	}
+
+	slot := int(groupId) % FECGroups
+	group := decoder.groups[slot]
+	if group != nil && group.groupId == groupId && currentTime.Sub(group.createTime) > decoder.timeout {
+		group = nil
+	}
+	if group == nil || group.groupId != groupId {
+		group = &fecGroup{groupId: groupId, dataShards: int(dataShards), parityShards: int(parityShards), createTime: currentTime}
+		decoder.groups[slot] = group
+	}
+
+	if int(dataShards) != group.dataShards || int(parityShards) != group.parityShards {
+		return nil, fmt.Errorf("fec shard parameters do not match its group")
+	}
+
+	if group.shards[shardIndex] != nil || group.complete {
+		return nil, nil
+	}
+
+	group.shards[shardIndex] = append([]byte(nil), data...)
+	group.received++
+
+	var payloads [][]byte
+
+	if int(shardIndex) < group.dataShards {
+		payloads = append(payloads, group.shards[shardIndex])
+	}
+
+	if group.received < group.dataShards {
+		return payloads, nil
+	}
+
+	group.complete = true
+
+	recovered, err := group.recover()
+	if err != nil {
+		return payloads, err
+	}
+
+	decoder.recovered += uint64(len(recovered))
+
+	return append(payloads, recovered...), nil
+}
+
+// recover solves for the missing data shards from the first dataShards shards received.
+func (group *fecGroup) recover() ([][]byte, error) {
+
+	k := group.dataShards
+
+	var missing []int
+	for i := 0; i < k; i++ {
+		if group.shards[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	shardBytes := 0
+	rows := make([]int, 0, k)
+	for i := 0; i < k+group.parityShards && len(rows) < k; i++ {
+		if group.shards[i] == nil {
+			continue
+		}
+		rows = append(rows, i)
+		if i >= k {
+			shardBytes = len(group.shards[i])
+		}
+	}
+
+	for _, row := range rows {
+		if row >= k && len(group.shards[row]) != shardBytes {
+			return nil, fmt.Errorf("fec parity shards in group %d differ in size", group.groupId)
+		}
+		if row < k && len(group.shards[row])+FECLengthBytes > shardBytes {
+			return nil, fmt.Errorf("fec data shard in group %d is larger than its parity shards", group.groupId)
+		}
+	}
+
+	// build the rows of the encoding matrix for the shards we have, and invert it
+
+	matrix := make([][]byte, k)
+	for r, row := range rows {
+		matrix[r] = make([]byte, k)
+		if row < k {
+			matrix[r][row] = 1
+		} else {
+			for c := 0; c < k; c++ {
+				matrix[r][c] = fecCoefficient(k, row-k, c)
+			}
+		}
+	}
+
+	inverse, err := gfInvertMatrix(matrix)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make([][]byte, k)
+	for r, row := range rows {
+		if row < k {
+			inputs[r] = fecPadShard(group.shards[row], shardBytes)
+		} else {
+			inputs[r] = group.shards[row]
+		}
+	}
+
+	payloads := make([][]byte, 0, len(missing))
+
+	for _, i := range missing {
+		padded := make([]byte, shardBytes)
+		for r := range inputs {
+			fecMulAdd(padded, inputs[r], inverse[i][r])
+		}
+		index := 0
+		var payloadBytes uint16
+		ReadUint16(padded, &index, &payloadBytes)
+		if int(payloadBytes) > shardBytes-FECLengthBytes {
+			return payloads, fmt.Errorf("fec recovered shard in group %d has a bad length", group.groupId)
+		}
+		group.shards[i] = padded[FECLengthBytes : FECLengthBytes+int(payloadBytes)]
+		payloads = append(payloads, group.shards[i])
+	}
+
+	return payloads, nil
+}
+
+func gfInvertMatrix(matrix [][]byte) ([][]byte, error) {
+
+	n := len(matrix)
+
+	work := make([][]byte, n)
+	for i := range matrix {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], matrix[i])
+		work[i][n+i] = 1
+	}
+
+	for column := 0; column < n; column++ {
+
+		pivot := -1
+		for row := column; row < n; row++ {
+			if work[row][column] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("fec matrix is singular")
+		}
+		work[column], work[pivot] = work[pivot], work[column]
+
+		scale := gfInv(work[column][column])
+		for i := range work[column] {
+			work[column][i] = gfMul(work[column][i], scale)
+		}
+
+		for row := 0; row < n; row++ {
+			if row != column && work[row][column] != 0 {
+				fecMulAdd(work[row], work[column], work[row][column])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
+
+func (decoder *FECDecoder) GetRecovered() uint64 {
+	return decoder.recovered
+}
@@ -0,0 +1,178 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fecTestPayload(i int) []byte {
+	payload := make([]byte, 100+i*37)
+	for j := range payload {
+		payload[j] = byte(i + j)
+	}
+	return payload
+}
+
+func TestFECRecovery(t *testing.T) {
+
+	t.Parallel()
+
+	const dataShards = 8
+	const parityShards = 3
+
+	encoder, err := CreateFECEncoder(dataShards, parityShards)
+	assert.NoError(t, err)
+
+	currentTime := time.Unix(1000, 0)
+
+	for groups := 0; groups < 20; groups++ {
+
+		var shards [][]byte
+		for i := 0; i < dataShards; i++ {
+			output, err := encoder.Encode(fecTestPayload(i))
+			assert.NoError(t, err)
+			shards = append(shards, output...)
+		}
+		assert.Equal(t, dataShards+parityShards, len(shards))
+
+		// lose up to parityShards shards anywhere in the group, and the rest arrive in any order
+
+		lost := rand.Perm(len(shards))[:rand.Intn(parityShards+1)]
+		for _, i := range lost {
+			shards[i] = nil
+		}
+		rand.Shuffle(len(shards), func(i, j int) { shards[i], shards[j] = shards[j], shards[i] })
+
+		decoder := CreateFECDecoder(DefaultFECTimeout)
+
+		received := make(map[string]bool)
+		for _, shard := range shards {
+			if shard == nil {
+				continue
+			}
+			payloads, err := decoder.ProcessShard(shard, currentTime)
+			assert.NoError(t, err)
+			for _, payload := range payloads {
+				assert.False(t, received[string(payload)])
+				received[string(payload)] = true
+			}
+		}
+
+		assert.Equal(t, dataShards, len(received))
+		for i := 0; i < dataShards; i++ {
+			assert.True(t, received[string(fecTestPayload(i))])
+		}
+	}
+}
+
+func TestFECXOR(t *testing.T) {
+
+	t.Parallel()
+
+	// the first parity shard is the xor of the length prefixed data shards
+
+	encoder, err := CreateFECEncoder(2, 1)
+	assert.NoError(t, err)
+
+	_, err = encoder.Encode([]byte{1, 2, 3})
+	assert.NoError(t, err)
+	shards, err := encoder.Encode([]byte{4, 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(shards))
+
+	assert.Equal(t, []byte{3 ^ 2, 0, 1 ^ 4, 2 ^ 5, 3}, shards[1][FECHeaderBytes:])
+}
+
+func TestFECTooManyLost(t *testing.T) {
+
+	t.Parallel()
+
+	encoder, err := CreateFECEncoder(4, 1)
+	assert.NoError(t, err)
+
+	var shards [][]byte
+	for i := 0; i < 4; i++ {
+		output, err := encoder.Encode(fecTestPayload(i))
+		assert.NoError(t, err)
+		shards = append(shards, output...)
+	}
+
+	// two data shards lost with one parity shard can't be recovered, but the rest are still delivered
+
+	decoder := CreateFECDecoder(DefaultFECTimeout)
+	delivered := 0
+	for _, i := range []int{0, 3, 4} {
+		payloads, err := decoder.ProcessShard(shards[i], time.Unix(1000, 0))
+		assert.NoError(t, err)
+		delivered += len(payloads)
+	}
+	assert.Equal(t, 2, delivered)
+	assert.Equal(t, uint64(0), decoder.GetRecovered())
+}
+
+func TestFECInvalidShards(t *testing.T) {
+
+	t.Parallel()
+
+	_, err := CreateFECEncoder(0, 1)
+	assert.Error(t, err)
+	_, err = CreateFECEncoder(30, 3)
+	assert.Error(t, err)
+
+	assert.NoError(t, ValidateFECConfig(0, 0))
+	assert.NoError(t, ValidateFECConfig(4, 2))
+	assert.Error(t, ValidateFECConfig(4, 0))
+
+	decoder := CreateFECDecoder(DefaultFECTimeout)
+	currentTime := time.Unix(1000, 0)
+
+	_, err = decoder.ProcessShard([]byte{0, 0, 0}, currentTime)
+	assert.Error(t, err)
+
+	_, err = decoder.ProcessShard([]byte{0, 0, 5, 4, 1, 1, 2, 3}, currentTime)
+	assert.Error(t, err)
+
+	_, err = decoder.ProcessShard([]byte{0, 0, 0, 40, 1, 1, 2, 3}, currentTime)
+	assert.Error(t, err)
+
+	// shards in a group must agree on its parameters
+
+	_, err = decoder.ProcessShard([]byte{0, 0, 0, 4, 1, 1, 2, 3}, currentTime)
+	assert.NoError(t, err)
+	_, err = decoder.ProcessShard([]byte{0, 0, 1, 4, 2, 1, 2, 3}, currentTime)
+	assert.Error(t, err)
+}
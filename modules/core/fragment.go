@@ -0,0 +1,252 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const FragmentPacketIdBytes = 2
+const FragmentIndexBytes = 1
+const FragmentCountBytes = 1
+const FragmentDataBytes = 2
+
+const FragmentHeaderBytes = FragmentPacketIdBytes + FragmentIndexBytes + FragmentCountBytes + FragmentDataBytes
+
+const MaxFragments = 64
+
+// FragmentPayload splits a payload into fragments of exactly fragmentBytes each, including the
+// fragment header. The last fragment is zero padded so every fragment packet is the same size.
+func FragmentPayload(packetId uint16, payload []byte, fragmentBytes int) ([][]byte, error) {
+	if fragmentBytes <= FragmentHeaderBytes || fragmentBytes-FragmentHeaderBytes > 0xFFFF {
+		return nil, fmt.Errorf("invalid fragment size: %d", fragmentBytes)
+	}
+	maxDataBytes := fragmentBytes - FragmentHeaderBytes
+	numFragments := (len(payload) + maxDataBytes - 1) / maxDataBytes
+	if numFragments == 0 {
+		numFragments = 1
+	}
+	if numFragments > MaxFragments {
+		return nil, fmt.Errorf("payload is too large to fragment: %d bytes needs %d fragments, max is %d", len(payload), numFragments, MaxFragments)
+	}
+	fragments := make([][]byte, numFragments)
+	for i := range fragments {
+		start := i * maxDataBytes
+		finish := start + maxDataBytes
+		if finish > len(payload) {
+			finish = len(payload)
+		}
+		fragment := make([]byte, fragmentBytes)
+		index := 0
+		WriteUint16(fragment, &index, packetId)
+		WriteUint8(fragment, &index, uint8(i))
+		WriteUint8(fragment, &index, uint8(numFragments))
+		WriteUint16(fragment, &index, uint16(finish-start))
+		copy(fragment[index:], payload[start:finish])
+		fragments[i] = fragment
+	}
+	return fragments, nil
+}
+
+type reassemblyEntry struct {
+	packetId   uint16
+	createTime time.Time
+	fragments  [][]byte
+	received   int
+	bytes      int
+}
+
+// Reassembler collects fragments until every fragment of a payload has arrived. Payloads
+// that are not complete within the timeout are expired, and once buffered fragments would
+// exceed the memory limit the oldest incomplete payloads are evicted to make room.
+type Reassembler struct {
+	mutex     sync.Mutex
+	timeout   time.Duration
+	maxMemory int
+	memory    int
+	entries   map[uint16]*list.Element
+	order     *list.List
+	expired   uint64
+	evicted   uint64
+}
+
+func CreateReassembler(timeout time.Duration, maxMemory int) *Reassembler {
+	reassembler := &Reassembler{}
+	reassembler.timeout = timeout
+	reassembler.maxMemory = maxMemory
+	reassembler.entries = make(map[uint16]*list.Element)
+	reassembler.order = list.New()
+	return reassembler
+}
+
+func (reassembler *Reassembler) remove(element *list.Element) {
+	entry := element.Value.(*reassemblyEntry)
+	reassembler.order.Remove(element)
+	delete(reassembler.entries, entry.packetId)
+	reassembler.memory -= entry.bytes
+}
+
+// ProcessFragment adds a fragment and returns the reassembled payload once the last fragment
+// arrives. It returns nil without error while fragments are still missing, or for duplicates.
+func (reassembler *Reassembler) ProcessFragment(fragment []byte, currentTime time.Time) ([]byte, error) {
+
+	index := 0
+
+	var packetId uint16
+	var fragmentIndex uint8
+	var fragmentCount uint8
+	var dataBytes uint16
+
+	if !ReadUint16(fragment, &index, &packetId) ||
+		!ReadUint8(fragment, &index, &fragmentIndex) ||
+		!ReadUint8(fragment, &index, &fragmentCount) ||
+		!ReadUint16(fragment, &index, &dataBytes) {
+		return nil, fmt.Errorf("fragment is too small")
+	}
+
+	if fragmentCount == 0 || fragmentCount > MaxFragments || fragmentIndex >= fragmentCount {
+		return nil, fmt.Errorf("invalid fragment %d/%d", fragmentIndex, fragmentCount)
+	}
+
+	if int(dataBytes) > len(fragment)-FragmentHeaderBytes {
+		return nil, fmt.Errorf("fragment data is truncated")
+	}
+
+	data := fragment[index : index+int(dataBytes)]
+
+	if fragmentCount == 1 {
+		return append([]byte(nil), data...), nil
+	}
+
+	if int(dataBytes) > reassembler.maxMemory {
+		return nil, fmt.Errorf("fragment is larger than the reassembly memory limit")
+	}
+
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+
+	// packet ids wrap around, so an entry older than the timeout belongs to an earlier packet
+
+	element, exists := reassembler.entries[packetId]
+	if exists && currentTime.Sub(element.Value.(*reassemblyEntry).createTime) >= reassembler.timeout {
+		reassembler.remove(element)
+		reassembler.expired++
+		exists = false
+	}
+
+	var entry *reassemblyEntry
+	if exists {
+		entry = element.Value.(*reassemblyEntry)
+		if len(entry.fragments) != int(fragmentCount) {
+			return nil, fmt.Errorf("fragment count mismatch for packet %d: expected %d, got %d", packetId, len(entry.fragments), fragmentCount)
+		}
+		if entry.fragments[fragmentIndex] != nil {
+			return nil, nil
+		}
+	}
+
+	for reassembler.memory+int(dataBytes) > reassembler.maxMemory {
+		oldest := reassembler.order.Back()
+		if oldest == element {
+			return nil, fmt.Errorf("fragment does not fit in reassembly memory")
+		}
+		reassembler.remove(oldest)
+		reassembler.evicted++
+	}
+
+	if entry == nil {
+		entry = &reassemblyEntry{packetId: packetId, createTime: currentTime, fragments: make([][]byte, fragmentCount)}
+		reassembler.entries[packetId] = reassembler.order.PushFront(entry)
+	}
+
+	entry.fragments[fragmentIndex] = append([]byte(nil), data...)
+	entry.received++
+	entry.bytes += int(dataBytes)
+	reassembler.memory += int(dataBytes)
+
+	if entry.received < len(entry.fragments) {
+		return nil, nil
+	}
+
+	reassembler.remove(reassembler.entries[packetId])
+
+	payload := make([]byte, 0, entry.bytes)
+	for _, data := range entry.fragments {
+		payload = append(payload, data...)
+	}
+	return payload, nil
+}
+
+// Expire removes payloads that were not completed within the timeout, and returns the number removed.
+func (reassembler *Reassembler) Expire(currentTime time.Time) int {
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+	count := 0
+	for {
+		oldest := reassembler.order.Back()
+		if oldest == nil || currentTime.Sub(oldest.Value.(*reassemblyEntry).createTime) < reassembler.timeout {
+			break
+		}
+		reassembler.remove(oldest)
+		count++
+	}
+	reassembler.expired += uint64(count)
+	return count
+}
+
+// GetMemory returns the number of fragment data bytes buffered.
+func (reassembler *Reassembler) GetMemory() int {
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+	return reassembler.memory
+}
+
+func (reassembler *Reassembler) GetPending() int {
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+	return reassembler.order.Len()
+}
+
+func (reassembler *Reassembler) GetExpired() uint64 {
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+	return reassembler.expired
+}
+
+func (reassembler *Reassembler) GetEvicted() uint64 {
+	reassembler.mutex.Lock()
+	defer reassembler.mutex.Unlock()
+	return reassembler.evicted
+}
@@ -0,0 +1,222 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragmentPayload(t *testing.T) {
+
+	t.Parallel()
+
+	payload := RandomBytes(2500)
+
+	fragments, err := FragmentPayload(7, payload, MinPayloadBytes)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(fragments))
+	for i := range fragments {
+		assert.Equal(t, MinPayloadBytes, len(fragments[i]))
+	}
+
+	reassembler := CreateReassembler(time.Second, 100000)
+
+	currentTime := time.Unix(1000, 0)
+
+	// deliver out of order with a duplicate
+
+	result, err := reassembler.ProcessFragment(fragments[2], currentTime)
+	assert.Nil(t, result)
+	assert.Nil(t, err)
+	result, err = reassembler.ProcessFragment(fragments[0], currentTime)
+	assert.Nil(t, result)
+	assert.Nil(t, err)
+	result, err = reassembler.ProcessFragment(fragments[0], currentTime)
+	assert.Nil(t, result)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, reassembler.GetPending())
+
+	result, err = reassembler.ProcessFragment(fragments[1], currentTime)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, result)
+	assert.Equal(t, 0, reassembler.GetPending())
+	assert.Equal(t, 0, reassembler.GetMemory())
+}
+
+func TestFragmentSingle(t *testing.T) {
+
+	t.Parallel()
+
+	payload := RandomBytes(100)
+
+	fragments, err := FragmentPayload(0, payload, MinPayloadBytes)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(fragments))
+
+	reassembler := CreateReassembler(time.Second, 100000)
+	result, err := reassembler.ProcessFragment(fragments[0], time.Unix(1000, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, payload, result)
+	assert.Equal(t, 0, reassembler.GetPending())
+
+	fragments, err = FragmentPayload(0, nil, MinPayloadBytes)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(fragments))
+}
+
+func TestFragmentErrors(t *testing.T) {
+
+	t.Parallel()
+
+	_, err := FragmentPayload(0, RandomBytes(100), FragmentHeaderBytes)
+	assert.NotNil(t, err)
+
+	_, err = FragmentPayload(0, RandomBytes(MaxFragments*10+1), FragmentHeaderBytes+10)
+	assert.NotNil(t, err)
+
+	reassembler := CreateReassembler(time.Second, 100000)
+	currentTime := time.Unix(1000, 0)
+
+	_, err = reassembler.ProcessFragment(make([]byte, FragmentHeaderBytes-1), currentTime)
+	assert.NotNil(t, err)
+
+	fragments, err := FragmentPayload(1, RandomBytes(100), 60)
+	assert.Nil(t, err)
+
+	// index out of range
+
+	bad := append([]byte(nil), fragments[0]...)
+	bad[FragmentPacketIdBytes] = bad[FragmentPacketIdBytes+FragmentIndexBytes]
+	_, err = reassembler.ProcessFragment(bad, currentTime)
+	assert.NotNil(t, err)
+
+	// data longer than the fragment
+
+	_, err = reassembler.ProcessFragment(fragments[0][:30], currentTime)
+	assert.NotNil(t, err)
+
+	// fragment count changes for the same packet
+
+	_, err = reassembler.ProcessFragment(fragments[0], currentTime)
+	assert.Nil(t, err)
+	other, err := FragmentPayload(1, RandomBytes(200), 60)
+	assert.Nil(t, err)
+	_, err = reassembler.ProcessFragment(other[1], currentTime)
+	assert.NotNil(t, err)
+}
+
+func TestFragmentExpire(t *testing.T) {
+
+	t.Parallel()
+
+	reassembler := CreateReassembler(time.Second, 100000)
+
+	currentTime := time.Unix(1000, 0)
+
+	a, _ := FragmentPayload(1, RandomBytes(2000), MinPayloadBytes)
+	b, _ := FragmentPayload(2, RandomBytes(2000), MinPayloadBytes)
+
+	reassembler.ProcessFragment(a[0], currentTime)
+	reassembler.ProcessFragment(b[0], currentTime.Add(500*time.Millisecond))
+	assert.Equal(t, 2, reassembler.GetPending())
+
+	assert.Equal(t, 0, reassembler.Expire(currentTime.Add(999*time.Millisecond)))
+	assert.Equal(t, 1, reassembler.Expire(currentTime.Add(time.Second)))
+	assert.Equal(t, 1, reassembler.GetPending())
+	assert.Equal(t, uint64(1), reassembler.GetExpired())
+
+	// a reused packet id starts over once the old entry has timed out
+
+	payload := RandomBytes(1500)
+	c, _ := FragmentPayload(2, payload, MinPayloadBytes)
+	assert.Equal(t, 2, len(c))
+	result, err := reassembler.ProcessFragment(c[1], currentTime.Add(2*time.Second))
+	assert.Nil(t, result)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), reassembler.GetExpired())
+	result, err = reassembler.ProcessFragment(c[0], currentTime.Add(2*time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, payload, result)
+}
+
+func TestFragmentMemoryLimit(t *testing.T) {
+
+	t.Parallel()
+
+	maxDataBytes := MinPayloadBytes - FragmentHeaderBytes
+
+	reassembler := CreateReassembler(time.Second, 3*maxDataBytes)
+
+	currentTime := time.Unix(1000, 0)
+
+	var packets [][][]byte
+	var payloads [][]byte
+	for i := 0; i < 3; i++ {
+		payload := RandomBytes(3 * maxDataBytes)
+		fragments, err := FragmentPayload(uint16(i), payload, MinPayloadBytes)
+		assert.Nil(t, err)
+		payloads = append(payloads, payload)
+		packets = append(packets, fragments)
+	}
+
+	reassembler.ProcessFragment(packets[0][0], currentTime)
+	reassembler.ProcessFragment(packets[1][0], currentTime)
+	reassembler.ProcessFragment(packets[2][0], currentTime)
+	assert.Equal(t, 3*maxDataBytes, reassembler.GetMemory())
+
+	// the next fragment evicts the oldest incomplete packet
+
+	reassembler.ProcessFragment(packets[2][1], currentTime)
+	assert.Equal(t, uint64(1), reassembler.GetEvicted())
+	assert.Equal(t, 2, reassembler.GetPending())
+
+	// a packet can never need more memory than the limit
+
+	reassembler.ProcessFragment(packets[1][1], currentTime)
+	_, err := reassembler.ProcessFragment(packets[2][2], currentTime)
+	assert.Nil(t, err)
+	assert.True(t, reassembler.GetMemory() <= 3*maxDataBytes)
+
+	// random order delivery of the evicted packet still works on its own
+
+	reassembler = CreateReassembler(time.Second, 3*maxDataBytes)
+	order := rand.Perm(3)
+	var result []byte
+	for _, i := range order {
+		result, _ = reassembler.ProcessFragment(packets[0][i], currentTime)
+	}
+	assert.Equal(t, payloads[0], result)
+}
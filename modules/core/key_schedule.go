@@ -0,0 +1,115 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const KeyConfirmationBytes = 16
+const RejectMACBytes = 16
+
+// SessionKeys are derived from the box shared key for a session, so each
+// direction has its own key and a leaked key only exposes one direction.
+type SessionKeys struct {
+	ClientToGateway [SessionKeyBytes]byte
+	GatewayToClient [SessionKeyBytes]byte
+	Confirmation    [SessionKeyBytes]byte
+	Reject          [SessionKeyBytes]byte
+}
+
+// HKDF implements HKDF-SHA256 (RFC 5869), filling output with key material.
+func HKDF(secret []byte, salt []byte, info []byte, output []byte) {
+
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	pseudoRandomKey := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, pseudoRandomKey)
+	var block []byte
+	counter := byte(1)
+	for len(output) > 0 {
+		expand.Reset()
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(block[:0])
+		n := copy(output, block)
+		output = output[n:]
+		counter++
+	}
+}
+
+func DeriveSessionKeys(sharedKey []byte, sessionId []byte) SessionKeys {
+	var keys SessionKeys
+	HKDF(sharedKey, sessionId, []byte("udpx client to gateway"), keys.ClientToGateway[:])
+	HKDF(sharedKey, sessionId, []byte("udpx gateway to client"), keys.GatewayToClient[:])
+	HKDF(sharedKey, sessionId, []byte("udpx key confirmation"), keys.Confirmation[:])
+	HKDF(sharedKey, sessionId, []byte("udpx reject"), keys.Reject[:])
+	return keys
+}
+
+// KeyConfirmation is sent by the gateway in challenge packets, so the client
+// can check both sides derived the same session keys before it sends payload.
+func KeyConfirmation(keys *SessionKeys, sequence uint64, output []byte) {
+	var sequenceData [8]byte
+	binary.LittleEndian.PutUint64(sequenceData[:], sequence)
+	mac := hmac.New(sha256.New, keys.Confirmation[:])
+	mac.Write(sequenceData[:])
+	copy(output[:KeyConfirmationBytes], mac.Sum(nil))
+}
+
+func VerifyKeyConfirmation(keys *SessionKeys, sequence uint64, confirmation []byte) bool {
+	var expected [KeyConfirmationBytes]byte
+	KeyConfirmation(keys, sequence, expected[:])
+	return len(confirmation) == KeyConfirmationBytes && hmac.Equal(expected[:], confirmation)
+}
+
+// RejectMAC authenticates the packets a gateway rejects a client's packets with, so a forged reject can't
+// make the client fall back to an older protocol version or cipher suite, or end its session.
+func RejectMAC(keys *SessionKeys, rejectData []byte, output []byte) {
+	mac := hmac.New(sha256.New, keys.Reject[:])
+	mac.Write(rejectData)
+	copy(output[:RejectMACBytes], mac.Sum(nil))
+}
+
+func VerifyRejectMAC(keys *SessionKeys, rejectData []byte, rejectMAC []byte) bool {
+	var expected [RejectMACBytes]byte
+	RejectMAC(keys, rejectData, expected[:])
+	return len(rejectMAC) == RejectMACBytes && hmac.Equal(expected[:], rejectMAC)
+}
@@ -0,0 +1,104 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHKDF(t *testing.T) {
+
+	t.Parallel()
+
+	// RFC 5869 test case 1
+
+	secret, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+
+	output := make([]byte, 42)
+	HKDF(secret, salt, info, output)
+
+	assert.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865", hex.EncodeToString(output))
+
+	// RFC 5869 test case 3, no salt and no info
+
+	output = make([]byte, 42)
+	HKDF(secret, nil, nil, output)
+
+	assert.Equal(t, "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8", hex.EncodeToString(output))
+}
+
+func TestDeriveSessionKeys(t *testing.T) {
+
+	t.Parallel()
+
+	clientPublicKey, clientPrivateKey := Keygen_Box()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+
+	clientKeys := DeriveSessionKeys(SessionKey(gatewayPublicKey, clientPrivateKey), clientPublicKey)
+	gatewayKeys := DeriveSessionKeys(SessionKey(clientPublicKey, gatewayPrivateKey), clientPublicKey)
+
+	assert.Equal(t, clientKeys, gatewayKeys)
+	assert.NotEqual(t, clientKeys.ClientToGateway, clientKeys.GatewayToClient)
+	assert.NotEqual(t, clientKeys.ClientToGateway, clientKeys.Confirmation)
+
+	// keys are bound to the session id
+
+	otherKeys := DeriveSessionKeys(SessionKey(gatewayPublicKey, clientPrivateKey), gatewayPublicKey)
+	assert.NotEqual(t, clientKeys.ClientToGateway, otherKeys.ClientToGateway)
+
+	// key confirmation
+
+	var confirmation [KeyConfirmationBytes]byte
+	KeyConfirmation(&gatewayKeys, 1000, confirmation[:])
+
+	assert.True(t, VerifyKeyConfirmation(&clientKeys, 1000, confirmation[:]))
+	assert.False(t, VerifyKeyConfirmation(&clientKeys, 1001, confirmation[:]))
+	assert.False(t, VerifyKeyConfirmation(&otherKeys, 1000, confirmation[:]))
+	assert.False(t, VerifyKeyConfirmation(&clientKeys, 1000, confirmation[:8]))
+
+	// reject macs
+
+	assert.NotEqual(t, clientKeys.Confirmation, clientKeys.Reject)
+
+	var rejectMAC [RejectMACBytes]byte
+	RejectMAC(&gatewayKeys, []byte{PacketVersion_FNV1a, VersionRejectPacket}, rejectMAC[:])
+
+	assert.True(t, VerifyRejectMAC(&clientKeys, []byte{PacketVersion_FNV1a, VersionRejectPacket}, rejectMAC[:]))
+	assert.False(t, VerifyRejectMAC(&clientKeys, []byte{PacketVersion_SipHash, VersionRejectPacket}, rejectMAC[:]))
+	assert.False(t, VerifyRejectMAC(&otherKeys, []byte{PacketVersion_FNV1a, VersionRejectPacket}, rejectMAC[:]))
+	assert.False(t, VerifyRejectMAC(&clientKeys, []byte{PacketVersion_FNV1a, VersionRejectPacket}, rejectMAC[:8]))
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import "time"
+
+// MaxPaths is the most gateways a multipath session sends over at once.
+const MaxPaths = 2
+
+// PathTimeout is how long a path stays active after the last packet received over it.
+const PathTimeout = time.Second
+
+// Each path of a multipath session has its own sequence space, selected by the top bit of the sequence.
+// All gateways share the same key, so this keeps the copies of a packet sent over different paths from
+// ever being encrypted with the same nonce. The server and client deduplicate on the session sequence.
+const PathSequenceBit = uint64(1) << 63
+
+func PathSequence(sequence uint64, path int) uint64 {
+	if path != 0 {
+		return sequence | PathSequenceBit
+	}
+	return sequence &^ PathSequenceBit
+}
+
+func SessionSequence(sequence uint64) uint64 {
+	return sequence &^ PathSequenceBit
+}
+
+func SequencePath(sequence uint64) int {
+	if sequence&PathSequenceBit != 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathSequence(t *testing.T) {
+
+	t.Parallel()
+
+	sequence := uint64(10000)
+
+	assert.Equal(t, sequence, PathSequence(sequence, 0))
+	assert.NotEqual(t, sequence, PathSequence(sequence, 1))
+
+	for path := 0; path < MaxPaths; path++ {
+		pathSequence := PathSequence(sequence, path)
+		assert.Equal(t, path, SequencePath(pathSequence))
+		assert.Equal(t, sequence, SessionSequence(pathSequence))
+		assert.Equal(t, pathSequence, PathSequence(pathSequence, path))
+	}
+
+	// the same packet over two paths is never encrypted with the same nonce
+
+	var nonceA, nonceB [NonceBytes_AEAD]byte
+	PayloadNonce(nonceA[:], PathSequence(sequence, 0), 0)
+	PayloadNonce(nonceB[:], PathSequence(sequence, 1), 0)
+	assert.NotEqual(t, nonceA, nonceB)
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"sync"
+)
+
+const NonceCacheKeyBytes = SessionIdBytes
+
+type nonceCacheEntry struct {
+	key             [NonceCacheKeyBytes]byte
+	address         net.UDPAddr
+	expireTimestamp uint64
+}
+
+// setAddress copies the ip, since the caller's address may point into a packet buffer that gets reused
+func (entry *nonceCacheEntry) setAddress(address *net.UDPAddr) {
+	entry.address = net.UDPAddr{IP: append(net.IP(nil), address.IP...), Port: address.Port}
+}
+
+// NonceCache remembers connect token ids until they expire, so a captured token
+// can't be used to open sessions from more than one source address. Entries are
+// kept in a fixed size ring buffer in insertion order, with a map for lookup.
+// When the ring is full the oldest entry is evicted, even if it has not expired.
+type NonceCache struct {
+	mutex   sync.Mutex
+	entries []nonceCacheEntry
+	head    int
+	count   int
+	lookup  map[[NonceCacheKeyBytes]byte]int
+	evicted uint64
+}
+
+func CreateNonceCache(capacity int) *NonceCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	cache := &NonceCache{}
+	cache.entries = make([]nonceCacheEntry, capacity)
+	cache.lookup = make(map[[NonceCacheKeyBytes]byte]int, capacity)
+	return cache
+}
+
+func (cache *NonceCache) removeOldest() {
+	entry := &cache.entries[cache.head]
+	delete(cache.lookup, entry.key)
+	*entry = nonceCacheEntry{}
+	cache.head = (cache.head + 1) % len(cache.entries)
+	cache.count--
+}
+
+func (cache *NonceCache) expire(currentTimestamp uint64) {
+	for cache.count > 0 && cache.entries[cache.head].expireTimestamp < currentTimestamp {
+		cache.removeOldest()
+	}
+}
+
+// Check returns true if the key has not been seen before, or was last seen from
+// the same address. It returns false if the key is in use from another address.
+func (cache *NonceCache) Check(key []byte, address *net.UDPAddr, expireTimestamp uint64, currentTimestamp uint64) bool {
+
+	var cacheKey [NonceCacheKeyBytes]byte
+	copy(cacheKey[:], key)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.expire(currentTimestamp)
+
+	if slot, exists := cache.lookup[cacheKey]; exists {
+		entry := &cache.entries[slot]
+		if entry.expireTimestamp >= currentTimestamp && !AddressEqual(&entry.address, address) {
+			return false
+		}
+		entry.setAddress(address)
+		if expireTimestamp > entry.expireTimestamp {
+			entry.expireTimestamp = expireTimestamp
+		}
+		return true
+	}
+
+	if cache.count == len(cache.entries) {
+		cache.removeOldest()
+		cache.evicted++
+	}
+
+	slot := (cache.head + cache.count) % len(cache.entries)
+	entry := &cache.entries[slot]
+	entry.key = cacheKey
+	entry.setAddress(address)
+	entry.expireTimestamp = expireTimestamp
+	cache.lookup[cacheKey] = slot
+	cache.count++
+
+	return true
+}
+
+func (cache *NonceCache) GetCount() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.count
+}
+
+func (cache *NonceCache) GetEvicted() uint64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.evicted
+}
@@ -0,0 +1,122 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceCache(t *testing.T) {
+
+	t.Parallel()
+
+	cache := CreateNonceCache(4)
+
+	keyA := RandomBytes(NonceCacheKeyBytes)
+	keyB := RandomBytes(NonceCacheKeyBytes)
+
+	addressA := ParseAddress("10.0.0.1:50000")
+	addressB := ParseAddress("10.0.0.2:50000")
+
+	// first use of a key is accepted, and reuse from the same address is fine
+
+	assert.True(t, cache.Check(keyA, addressA, 100, 10))
+	assert.True(t, cache.Check(keyA, addressA, 100, 20))
+	assert.Equal(t, 1, cache.GetCount())
+
+	// reuse from a different address is rejected while the key is live
+
+	assert.False(t, cache.Check(keyA, addressB, 100, 30))
+
+	// different keys don't interfere
+
+	assert.True(t, cache.Check(keyB, addressB, 50, 30))
+	assert.Equal(t, 2, cache.GetCount())
+
+	// once expired, keys are forgotten
+
+	assert.True(t, cache.Check(keyB, addressA, 200, 60))
+	assert.True(t, cache.Check(keyA, addressB, 200, 101))
+}
+
+func TestNonceCacheAddressCopy(t *testing.T) {
+
+	t.Parallel()
+
+	cache := CreateNonceCache(4)
+
+	key := RandomBytes(NonceCacheKeyBytes)
+
+	// the address is remembered even when the caller's ip is overwritten afterwards, as happens
+	// when it points into a packet buffer
+
+	address := ParseAddress("[2001:db8::1]:50000")
+	original := ParseAddress("[2001:db8::1]:50000")
+
+	assert.True(t, cache.Check(key, address, 100, 10))
+
+	address.IP[15] = 2
+
+	assert.False(t, cache.Check(key, address, 100, 20))
+	assert.True(t, cache.Check(key, original, 100, 20))
+}
+
+func TestNonceCacheEviction(t *testing.T) {
+
+	t.Parallel()
+
+	cache := CreateNonceCache(2)
+
+	address := ParseAddress("10.0.0.1:50000")
+	otherAddress := ParseAddress("10.0.0.2:50000")
+
+	keys := [][]byte{
+		RandomBytes(NonceCacheKeyBytes),
+		RandomBytes(NonceCacheKeyBytes),
+		RandomBytes(NonceCacheKeyBytes),
+	}
+
+	for i := range keys {
+		assert.True(t, cache.Check(keys[i], address, 100, 10))
+	}
+
+	assert.Equal(t, 2, cache.GetCount())
+	assert.Equal(t, uint64(1), cache.GetEvicted())
+
+	// the oldest key was evicted to make room, the newest keys are still protected
+
+	assert.False(t, cache.Check(keys[2], otherAddress, 100, 10))
+	assert.True(t, cache.Check(keys[0], otherAddress, 100, 10))
+	assert.False(t, cache.Check(keys[0], address, 100, 10))
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// PacerBurstPackets is how many maximum size packets a pacer lets go out back to back
+const PacerBurstPackets = 4
+
+// PacerDefaultMaxDelay is the longest a pacer holds a packet until it has an RTT
+const PacerDefaultMaxDelay = 25 * time.Millisecond
+
+// PacerMinMaxDelay is the least a pacer is allowed to spread a burst over, however low the RTT
+const PacerMinMaxDelay = time.Millisecond
+
+// Pacer spaces the packets of one flow out at a pacing rate, so a burst of packets is spread out on the
+// wire rather than sent back to back, where it can overflow the shallow buffers of consumer routers.
+// Bursts are spread over at most one RTT, so pacing never holds a packet longer than that. A rate of
+// zero kbps turns pacing off.
+type Pacer struct {
+	mutex         sync.Mutex
+	bitsPerSecond float64
+	burst         time.Duration
+	maxDelay      time.Duration
+	nextSendTime  time.Time
+}
+
+func CreatePacer(kbps float64) *Pacer {
+	pacer := &Pacer{}
+	pacer.bitsPerSecond = kbps * 1000
+	if pacer.bitsPerSecond > 0 {
+		pacer.burst = time.Duration(float64(PacerBurstPackets*WirePacketBits(MaxPathMTU)) / pacer.bitsPerSecond * float64(time.Second))
+	}
+	pacer.maxDelay = PacerDefaultMaxDelay
+	return pacer
+}
+
+// SetRTT sets how long a burst can be spread over.
+func (pacer *Pacer) SetRTT(rtt time.Duration) {
+	if rtt < PacerMinMaxDelay {
+		rtt = PacerMinMaxDelay
+	}
+	pacer.mutex.Lock()
+	pacer.maxDelay = rtt
+	pacer.mutex.Unlock()
+}
+
+// Delay returns how long to hold a packet before sending it. Packets are never dropped, only delayed, so
+// the packet must be sent once the delay is up.
+func (pacer *Pacer) Delay(packetBytes int, currentTime time.Time) time.Duration {
+
+	if pacer.bitsPerSecond <= 0 {
+		return 0
+	}
+
+	pacer.mutex.Lock()
+	defer pacer.mutex.Unlock()
+
+	// time not spent sending builds up a burst allowance, up to PacerBurstPackets
+
+	if earliest := currentTime.Add(-pacer.burst); pacer.nextSendTime.Before(earliest) {
+		pacer.nextSendTime = earliest
+	}
+
+	sendTime := pacer.nextSendTime
+	if sendTime.Before(currentTime) {
+		sendTime = currentTime
+	}
+	if latest := currentTime.Add(pacer.maxDelay); sendTime.After(latest) {
+		sendTime = latest
+		pacer.nextSendTime = latest
+	}
+
+	pacer.nextSendTime = pacer.nextSendTime.Add(time.Duration(float64(WirePacketBits(packetBytes)) / pacer.bitsPerSecond * float64(time.Second)))
+
+	return sendTime.Sub(currentTime)
+}
+
+// PacedSender holds packets that have been delayed by a pacer, and writes each one from its own goroutine
+// when it is due. Packets due at the same time are written in the order they were sent.
+type PacedSender struct {
+	mutex    sync.Mutex
+	queue    pacedQueue
+	sequence uint64
+	wake     chan struct{}
+	closed   chan struct{}
+	done     chan struct{}
+}
+
+func CreatePacedSender() *PacedSender {
+	sender := &PacedSender{}
+	sender.wake = make(chan struct{}, 1)
+	sender.closed = make(chan struct{})
+	sender.done = make(chan struct{})
+	go sender.sendLoop()
+	return sender
+}
+
+// Send calls write once the delay is up.
+func (sender *PacedSender) Send(delay time.Duration, write func()) {
+	sender.mutex.Lock()
+	sender.sequence++
+	heap.Push(&sender.queue, &pacedPacket{sendTime: time.Now().Add(delay), sequence: sender.sequence, write: write})
+	sender.mutex.Unlock()
+	select {
+	case sender.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pending is how many packets are waiting to be sent.
+func (sender *PacedSender) Pending() int {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	return sender.queue.Len()
+}
+
+// Close writes the packets that are still waiting straight away, and stops the sender.
+func (sender *PacedSender) Close() {
+	close(sender.closed)
+	<-sender.done
+}
+
+func (sender *PacedSender) sendLoop() {
+	defer close(sender.done)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		closed := false
+		select {
+		case <-sender.closed:
+			closed = true
+		default:
+		}
+
+		sender.mutex.Lock()
+		var due []*pacedPacket
+		wait := time.Hour
+		currentTime := time.Now()
+		for sender.queue.Len() > 0 {
+			next := sender.queue[0]
+			if !closed && next.sendTime.After(currentTime) {
+				wait = next.sendTime.Sub(currentTime)
+				break
+			}
+			due = append(due, heap.Pop(&sender.queue).(*pacedPacket))
+		}
+		sender.mutex.Unlock()
+
+		for _, packet := range due {
+			packet.write()
+		}
+
+		if closed {
+			return
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-sender.closed:
+		case <-sender.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+type pacedPacket struct {
+	sendTime time.Time
+	sequence uint64
+	write    func()
+}
+
+type pacedQueue []*pacedPacket
+
+func (queue pacedQueue) Len() int { return len(queue) }
+
+func (queue pacedQueue) Less(i, j int) bool {
+	if queue[i].sendTime.Equal(queue[j].sendTime) {
+		return queue[i].sequence < queue[j].sequence
+	}
+	return queue[i].sendTime.Before(queue[j].sendTime)
+}
+
+func (queue pacedQueue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *pacedQueue) Push(value interface{}) { *queue = append(*queue, value.(*pacedPacket)) }
+
+func (queue *pacedQueue) Pop() interface{} {
+	old := *queue
+	packet := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return packet
+}
@@ -0,0 +1,120 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacer(t *testing.T) {
+
+	t.Parallel()
+
+	currentTime := time.Unix(1000, 0)
+
+	assert.Equal(t, time.Duration(0), CreatePacer(0).Delay(MaxPathMTU, currentTime))
+
+	pacer := CreatePacer(1000)
+	pacer.SetRTT(100 * time.Millisecond)
+
+	packetBytes := 1000
+	interval := time.Duration(float64(WirePacketBits(packetBytes)) / 1000000 * float64(time.Second))
+
+	// a short burst goes straight out, then packets are spaced at the pacing rate
+
+	burstPackets := 0
+	for pacer.Delay(packetBytes, currentTime) == 0 {
+		burstPackets++
+	}
+	assert.Equal(t, PacerBurstPackets*WirePacketBits(MaxPathMTU)/WirePacketBits(packetBytes)+1, burstPackets)
+
+	previous := pacer.Delay(packetBytes, currentTime)
+	for i := 0; i < 5; i++ {
+		delay := pacer.Delay(packetBytes, currentTime)
+		assert.InDelta(t, float64(interval), float64(delay-previous), float64(time.Microsecond))
+		previous = delay
+	}
+
+	// the burst is spread over at most one rtt
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, pacer.Delay(packetBytes, currentTime) <= 100*time.Millisecond)
+	}
+	assert.Equal(t, 100*time.Millisecond, pacer.Delay(packetBytes, currentTime))
+
+	// once the burst has gone out, packets go straight out again
+
+	currentTime = currentTime.Add(time.Second)
+	assert.Equal(t, time.Duration(0), pacer.Delay(packetBytes, currentTime))
+}
+
+func TestPacedSender(t *testing.T) {
+
+	t.Parallel()
+
+	sender := CreatePacedSender()
+
+	var mutex sync.Mutex
+	var written []int
+	write := func(i int) func() {
+		return func() {
+			mutex.Lock()
+			written = append(written, i)
+			mutex.Unlock()
+		}
+	}
+
+	done := make(chan struct{})
+	sender.Send(30*time.Millisecond, func() { write(3)(); close(done) })
+	sender.Send(10*time.Millisecond, write(1))
+	sender.Send(10*time.Millisecond, write(2))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("paced packets were not sent")
+	}
+
+	// packets still waiting are written on close
+
+	sender.Send(time.Hour, write(4))
+	assert.Equal(t, 1, sender.Pending())
+	sender.Close()
+
+	mutex.Lock()
+	assert.Equal(t, []int{1, 2, 3, 4}, written)
+	mutex.Unlock()
+}
@@ -0,0 +1,296 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const basicFilterBytes = 2 + ChonkleBytes
+
+var basicFilterTable [ChonkleBytes][256]byte
+
+// The batch filter checks each chonkle byte with a table lookup instead of a
+// branch per byte. The table is built by probing BasicPacketFilter one byte at
+// a time from a packet known to pass, so both always agree.
+func init() {
+	passing := [basicFilterBytes]byte{0, 0, 0x2A, 0xC8, 0x05, 0x00, 0x4E, 0x60, 0x64, 0x07, 0x25, 0x7C, 0xAF, 0x21, 0x61, 0xD2, 0x11}
+	if !BasicPacketFilter(passing[:], len(passing)) {
+		panic("basic packet filter table seed does not pass")
+	}
+	for i := 0; i < ChonkleBytes; i++ {
+		probe := passing
+		for value := 0; value < 256; value++ {
+			probe[2+i] = byte(value)
+			if BasicPacketFilter(probe[:], len(probe)) {
+				basicFilterTable[i][value] = 1
+			}
+		}
+	}
+}
+
+// FilterPackets runs the basic packet filter over a batch of packets, writing
+// true to results for each packet that passes.
+func FilterPackets(packets [][]byte, results []bool) {
+	for i, packet := range packets {
+		if len(packet) < basicFilterBytes {
+			results[i] = false
+			continue
+		}
+		data := packet[2:basicFilterBytes]
+		pass := basicFilterTable[0][data[0]] &
+			basicFilterTable[1][data[1]] &
+			basicFilterTable[2][data[2]] &
+			basicFilterTable[3][data[3]] &
+			basicFilterTable[4][data[4]] &
+			basicFilterTable[5][data[5]] &
+			basicFilterTable[6][data[6]] &
+			basicFilterTable[7][data[7]] &
+			basicFilterTable[8][data[8]] &
+			basicFilterTable[9][data[9]] &
+			basicFilterTable[10][data[10]] &
+			basicFilterTable[11][data[11]] &
+			basicFilterTable[12][data[12]] &
+			basicFilterTable[13][data[13]] &
+			basicFilterTable[14][data[14]]
+		results[i] = pass != 0
+	}
+}
+
+type FilterPacket struct {
+	Data            []byte
+	From            *net.UDPAddr
+	Magic           []byte
+	FromAddressData []byte
+	FromAddressPort uint16
+	ToAddressData   []byte
+	ToAddressPort   uint16
+	FilterKey       []byte
+
+	// PreviousFilterKey is also accepted while a rotated out filter key lapses. When the packet matches it,
+	// the advanced filter swaps it into FilterKey and sets MatchedPreviousFilterKey, so replies use the key
+	// the client has.
+	PreviousFilterKey        []byte
+	MatchedPreviousFilterKey bool
+}
+
+// PacketFilter returns true if the packet should be processed, false to drop it.
+type PacketFilter interface {
+	Name() string
+	Filter(packet *FilterPacket) bool
+}
+
+type BasicFilter struct{}
+
+func (filter BasicFilter) Name() string {
+	return "basic"
+}
+
+func (filter BasicFilter) Filter(packet *FilterPacket) bool {
+	return BasicPacketFilter(packet.Data, len(packet.Data))
+}
+
+type AdvancedFilter struct{}
+
+func (filter AdvancedFilter) Name() string {
+	return "advanced"
+}
+
+func (filter AdvancedFilter) Filter(packet *FilterPacket) bool {
+	if PacketFilterVersion(packet.Data[0]) == PacketFilter_SipHash {
+		if len(packet.FilterKey) != SipHashKeyBytes {
+			return false
+		}
+		if AdvancedPacketFilterKeyed(packet.Data, packet.FilterKey, packet.FromAddressData, packet.FromAddressPort, packet.ToAddressData, packet.ToAddressPort, len(packet.Data)) {
+			return true
+		}
+		if len(packet.PreviousFilterKey) != SipHashKeyBytes || !AdvancedPacketFilterKeyed(packet.Data, packet.PreviousFilterKey, packet.FromAddressData, packet.FromAddressPort, packet.ToAddressData, packet.ToAddressPort, len(packet.Data)) {
+			return false
+		}
+		packet.FilterKey = packet.PreviousFilterKey
+		packet.MatchedPreviousFilterKey = true
+		return true
+	}
+	return AdvancedPacketFilter(packet.Data, packet.Magic, packet.FromAddressData, packet.FromAddressPort, packet.ToAddressData, packet.ToAddressPort, len(packet.Data))
+}
+
+// Blocklist drops packets from blocked ips and networks. The list can be replaced while packets are
+// being filtered.
+type Blocklist struct {
+	networks atomic.Pointer[[]*net.IPNet]
+}
+
+// ParseBlocklist parses a comma separated list of ips and networks in CIDR notation.
+func ParseBlocklist(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (blocklist *Blocklist) Set(networks []*net.IPNet) {
+	blocklist.networks.Store(&networks)
+}
+
+func (blocklist *Blocklist) Contains(ip net.IP) bool {
+	networks := blocklist.networks.Load()
+	if networks == nil {
+		return false
+	}
+	for _, network := range *networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (blocklist *Blocklist) Name() string {
+	return "blocklist"
+}
+
+func (blocklist *Blocklist) Filter(packet *FilterPacket) bool {
+	return !blocklist.Contains(packet.From.IP)
+}
+
+type PacketFilterFunc struct {
+	FilterName string
+	Function   func(packet *FilterPacket) bool
+}
+
+func (filter PacketFilterFunc) Name() string {
+	return filter.FilterName
+}
+
+func (filter PacketFilterFunc) Filter(packet *FilterPacket) bool {
+	return filter.Function(packet)
+}
+
+// FilterChain runs packet filters in order, stopping at the first filter that
+// drops the packet. Filters must be added before the chain is shared between
+// goroutines, drop counters are safe to read at any time.
+type FilterChain struct {
+	filters []PacketFilter
+	drops   []uint64
+}
+
+func CreateFilterChain(filters ...PacketFilter) *FilterChain {
+	chain := &FilterChain{}
+	for _, filter := range filters {
+		chain.Add(filter)
+	}
+	return chain
+}
+
+func (chain *FilterChain) Add(filter PacketFilter) {
+	chain.filters = append(chain.filters, filter)
+	chain.drops = append(chain.drops, 0)
+}
+
+func (chain *FilterChain) Filter(packet *FilterPacket) bool {
+	for i, filter := range chain.filters {
+		if !filter.Filter(packet) {
+			atomic.AddUint64(&chain.drops[i], 1)
+			Debug("%s packet filter failed", filter.Name())
+			return false
+		}
+	}
+	return true
+}
+
+func (chain *FilterChain) GetNumFilters() int {
+	return len(chain.filters)
+}
+
+func (chain *FilterChain) GetFilterName(index int) string {
+	return chain.filters[index].Name()
+}
+
+func (chain *FilterChain) GetDropCount(index int) uint64 {
+	return atomic.LoadUint64(&chain.drops[index])
+}
+
+type filterKeys struct {
+	current        []byte
+	previous       []byte
+	previousExpire time.Time
+}
+
+// FilterKeyRing holds the filter key packets are keyed with. When it is rotated, the previous key stays
+// valid for an overlap, so clients can be moved over to the new key without dropping their packets.
+type FilterKeyRing struct {
+	keys atomic.Pointer[filterKeys]
+}
+
+func CreateFilterKeyRing(key []byte) *FilterKeyRing {
+	ring := &FilterKeyRing{}
+	ring.keys.Store(&filterKeys{current: key})
+	return ring
+}
+
+// Get returns the current filter key, and the previous key while it is still valid or nil.
+func (ring *FilterKeyRing) Get(currentTime time.Time) ([]byte, []byte) {
+	keys := ring.keys.Load()
+	if keys.previous == nil || !currentTime.Before(keys.previousExpire) {
+		return keys.current, nil
+	}
+	return keys.current, keys.previous
+}
+
+func (ring *FilterKeyRing) Rotate(key []byte, overlap time.Duration, currentTime time.Time) {
+	current := ring.keys.Load().current
+	ring.keys.Store(&filterKeys{current: key, previous: current, previousExpire: currentTime.Add(overlap)})
+}
@@ -0,0 +1,267 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterChain(t *testing.T) {
+
+	t.Parallel()
+
+	magic := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fromAddress := [4]byte{1, 2, 3, 4}
+	toAddress := [4]byte{4, 3, 2, 1}
+	fromPort := uint16(1000)
+	toPort := uint16(5000)
+
+	packetData := make([]byte, 100)
+	GenerateChonkle(packetData[VersionBytes+PacketTypeBytes:], magic[:], fromAddress[:], fromPort, toAddress[:], toPort, len(packetData))
+	GeneratePittle(packetData[len(packetData)-PittleBytes:], fromAddress[:], fromPort, toAddress[:], toPort, len(packetData))
+
+	packet := FilterPacket{
+		Data:            packetData,
+		From:            ParseAddress("1.2.3.4:1000"),
+		Magic:           magic[:],
+		FromAddressData: fromAddress[:],
+		FromAddressPort: fromPort,
+		ToAddressData:   toAddress[:],
+		ToAddressPort:   toPort,
+	}
+
+	blocked := ParseAddress("1.2.3.4:1000")
+
+	blocklist := PacketFilterFunc{
+		FilterName: "blocklist",
+		Function: func(packet *FilterPacket) bool {
+			return !AddressEqual(packet.From, blocked)
+		},
+	}
+
+	chain := CreateFilterChain(BasicFilter{}, AdvancedFilter{})
+
+	assert.True(t, chain.Filter(&packet))
+
+	chain.Add(blocklist)
+
+	assert.Equal(t, 3, chain.GetNumFilters())
+	assert.Equal(t, "basic", chain.GetFilterName(0))
+	assert.Equal(t, "advanced", chain.GetFilterName(1))
+	assert.Equal(t, "blocklist", chain.GetFilterName(2))
+
+	assert.False(t, chain.Filter(&packet))
+	assert.Equal(t, uint64(1), chain.GetDropCount(2))
+
+	// a packet with a bad pittle passes the basic filter but not the advanced filter
+
+	packetData[len(packetData)-1] ^= 0xFF
+
+	assert.False(t, chain.Filter(&packet))
+	assert.Equal(t, uint64(0), chain.GetDropCount(0))
+	assert.Equal(t, uint64(1), chain.GetDropCount(1))
+	assert.Equal(t, uint64(1), chain.GetDropCount(2))
+}
+
+func TestFilterKeyRotation(t *testing.T) {
+
+	t.Parallel()
+
+	oldKey := make([]byte, SipHashKeyBytes)
+	newKey := make([]byte, SipHashKeyBytes)
+	RandomBytes_InPlace(oldKey)
+	RandomBytes_InPlace(newKey)
+
+	fromAddress := [4]byte{1, 2, 3, 4}
+	toAddress := [4]byte{4, 3, 2, 1}
+	fromPort := uint16(1000)
+	toPort := uint16(5000)
+
+	packetData := make([]byte, 100)
+	packetData[0] = PacketVersion_SipHash
+	GenerateChonkleKeyed(packetData[VersionBytes+PacketTypeBytes:], oldKey, fromAddress[:], fromPort, toAddress[:], toPort, len(packetData))
+	GeneratePittleKeyed(packetData[len(packetData)-PittleBytes:], oldKey, fromAddress[:], fromPort, toAddress[:], toPort, len(packetData))
+
+	ring := CreateFilterKeyRing(oldKey)
+
+	currentTime := time.Now()
+
+	current, previous := ring.Get(currentTime)
+	assert.Equal(t, oldKey, current)
+	assert.Nil(t, previous)
+
+	// after a rotation, packets keyed with the previous key pass until the overlap ends
+
+	ring.Rotate(newKey, time.Minute, currentTime)
+
+	current, previous = ring.Get(currentTime)
+	assert.Equal(t, newKey, current)
+	assert.Equal(t, oldKey, previous)
+
+	packet := FilterPacket{
+		Data:              packetData,
+		FromAddressData:   fromAddress[:],
+		FromAddressPort:   fromPort,
+		ToAddressData:     toAddress[:],
+		ToAddressPort:     toPort,
+		FilterKey:         current,
+		PreviousFilterKey: previous,
+	}
+
+	assert.True(t, AdvancedFilter{}.Filter(&packet))
+	assert.Equal(t, oldKey, packet.FilterKey)
+	assert.True(t, packet.MatchedPreviousFilterKey)
+
+	current, previous = ring.Get(currentTime.Add(time.Minute))
+	assert.Equal(t, newKey, current)
+	assert.Nil(t, previous)
+
+	packet.FilterKey = current
+	packet.PreviousFilterKey = previous
+	assert.False(t, AdvancedFilter{}.Filter(&packet))
+}
+
+func TestBlocklist(t *testing.T) {
+
+	t.Parallel()
+
+	blocklist := &Blocklist{}
+
+	packet := FilterPacket{From: ParseAddress("10.1.2.3:50000")}
+
+	assert.True(t, blocklist.Filter(&packet))
+
+	networks, err := ParseBlocklist("10.1.0.0/16, 192.168.1.1,2001:db8::1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(networks))
+
+	blocklist.Set(networks)
+
+	assert.False(t, blocklist.Filter(&packet))
+	assert.True(t, blocklist.Contains(net.ParseIP("192.168.1.1")))
+	assert.True(t, blocklist.Contains(net.ParseIP("::ffff:192.168.1.1")))
+	assert.False(t, blocklist.Contains(net.ParseIP("192.168.1.2")))
+	assert.True(t, blocklist.Contains(net.ParseIP("2001:db8::1")))
+	assert.False(t, blocklist.Contains(net.ParseIP("2001:db8::2")))
+
+	blocklist.Set(nil)
+	assert.True(t, blocklist.Filter(&packet))
+
+	networks, err = ParseBlocklist("")
+	assert.NoError(t, err)
+	assert.Nil(t, networks)
+
+	_, err = ParseBlocklist("10.1.2.3,bogus")
+	assert.Error(t, err)
+
+	_, err = ParseBlocklist("10.1.2.3/33")
+	assert.Error(t, err)
+}
+
+func TestFilterPackets(t *testing.T) {
+
+	t.Parallel()
+
+	random := rand.New(rand.NewSource(42))
+
+	const NumPackets = 10000
+
+	packets := make([][]byte, NumPackets)
+	expected := make([]bool, NumPackets)
+
+	for i := range packets {
+		packets[i] = make([]byte, 18+random.Intn(100))
+		random.Read(packets[i])
+		if i%2 == 0 {
+			var magic [8]byte
+			var fromAddress [4]byte
+			var toAddress [4]byte
+			random.Read(magic[:])
+			random.Read(fromAddress[:])
+			random.Read(toAddress[:])
+			GenerateChonkle(packets[i][2:], magic[:], fromAddress[:], uint16(i), toAddress[:], uint16(i+1), len(packets[i]))
+			assert.True(t, BasicPacketFilter(packets[i], len(packets[i])))
+		}
+		expected[i] = BasicPacketFilter(packets[i], len(packets[i]))
+	}
+
+	// packets too small to hold a chonkle never pass
+
+	packets = append(packets, []byte{}, make([]byte, 5))
+	expected = append(expected, false, false)
+
+	results := make([]bool, len(packets))
+	for i := range results {
+		results[i] = true
+	}
+
+	FilterPackets(packets, results)
+
+	assert.Equal(t, expected, results)
+}
+
+func BenchmarkBasicPacketFilter(b *testing.B) {
+	packets, results := benchmarkFilterPackets()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i, packet := range packets {
+			results[i] = BasicPacketFilter(packet, len(packet))
+		}
+	}
+}
+
+func BenchmarkFilterPackets(b *testing.B) {
+	packets, results := benchmarkFilterPackets()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		FilterPackets(packets, results)
+	}
+}
+
+func benchmarkFilterPackets() ([][]byte, []bool) {
+	random := rand.New(rand.NewSource(42))
+	packets := make([][]byte, 64)
+	for i := range packets {
+		packets[i] = make([]byte, MinPacketSize)
+		random.Read(packets[i])
+		var magic [8]byte
+		var fromAddress [4]byte
+		var toAddress [4]byte
+		GenerateChonkle(packets[i][2:], magic[:], fromAddress[:], uint16(i), toAddress[:], 40000, len(packets[i]))
+	}
+	return packets, make([]bool, len(packets))
+}
@@ -0,0 +1,246 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const PathStatsBufferSize = 1024
+const PathStatsMinLossTimeout = time.Second
+
+type pathStatsEntry struct {
+	sequence uint64
+	sendTime time.Time
+	resolved bool
+	lost     bool
+}
+
+// PathStatsSnapshot is a copy of the stats for a path at one point in time.
+// PacketLoss is the fraction of the last PathStatsBufferSize packets sent that were lost,
+// counting only packets that have been acked or declared lost.
+type PathStatsSnapshot struct {
+	RTT          time.Duration
+	Jitter       time.Duration
+	PacketLoss   float64
+	PacketsSent  uint64
+	PacketsAcked uint64
+	PacketsLost  uint64
+}
+
+// PathStats measures round trip time, jitter and packet loss from the sequence and
+// acks that every session packet already carries. RTT is sampled from the newest
+// acked sequence only, less the time the other side held the packet before acking it,
+// and smoothed as in RFC 6298. Jitter is the smoothed difference between consecutive
+// samples, as in RFC 3550. Packets not acked within max(3 * RTT, 1 second) are lost.
+type PathStats struct {
+	mutex          sync.Mutex
+	entries        [PathStatsBufferSize]pathStatsEntry
+	hasSent        bool
+	lossSequence   uint64
+	latestSequence uint64
+	hasRTT         bool
+	rtt            time.Duration
+	jitter         time.Duration
+	lastSample     time.Duration
+	sent           uint64
+	acked          uint64
+	lost           uint64
+}
+
+func CreatePathStats() *PathStats {
+	stats := &PathStats{}
+	for i := range stats.entries {
+		stats.entries[i].sequence = ^uint64(0)
+	}
+	return stats
+}
+
+func (stats *PathStats) resolve(entry *pathStatsEntry, lost bool) {
+	entry.resolved = true
+	entry.lost = lost
+	if lost {
+		stats.lost++
+	} else {
+		stats.acked++
+	}
+}
+
+func (stats *PathStats) lossTimeout() time.Duration {
+	timeout := 3 * stats.rtt
+	if timeout < PathStatsMinLossTimeout {
+		timeout = PathStatsMinLossTimeout
+	}
+	return timeout
+}
+
+// PacketSent records the send time of a packet, and returns the number of earlier
+// packets that have now been declared lost.
+func (stats *PathStats) PacketSent(sequence uint64, currentTime time.Time) int {
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	lost := stats.lost
+
+	if !stats.hasSent || sequence > stats.latestSequence {
+		if !stats.hasSent {
+			stats.lossSequence = sequence
+		}
+		stats.latestSequence = sequence
+		stats.hasSent = true
+	}
+
+	entry := &stats.entries[sequence%PathStatsBufferSize]
+	if entry.sequence != ^uint64(0) && !entry.resolved {
+		stats.resolve(entry, true)
+	}
+	entry.sequence = sequence
+	entry.sendTime = currentTime
+	entry.resolved = false
+	entry.lost = false
+
+	stats.sent++
+
+	// walk forward from the oldest packet that might still be acked
+
+	if stats.latestSequence-stats.lossSequence >= PathStatsBufferSize {
+		stats.lossSequence = stats.latestSequence - PathStatsBufferSize + 1
+	}
+
+	timeout := stats.lossTimeout()
+
+	for ; stats.lossSequence < stats.latestSequence; stats.lossSequence++ {
+		entry := &stats.entries[stats.lossSequence%PathStatsBufferSize]
+		if entry.sequence != stats.lossSequence || entry.resolved {
+			continue
+		}
+		if currentTime.Sub(entry.sendTime) < timeout {
+			break
+		}
+		stats.resolve(entry, true)
+	}
+
+	return int(stats.lost - lost)
+}
+
+// ProcessAcks marks the packets in an ack vector as acked. It returns the RTT sample
+// taken from the newest acked sequence, if that packet had not been acked before.
+func (stats *PathStats) ProcessAcks(ack uint64, ackBits []byte, ackDelay time.Duration, currentTime time.Time) (time.Duration, bool) {
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	sample := time.Duration(0)
+	hasSample := false
+
+	for i := 0; i < len(ackBits)*8; i++ {
+		if ackBits[i/8]&(1<<(uint(i)%8)) == 0 {
+			continue
+		}
+		sequence := ack - uint64(i)
+		entry := &stats.entries[sequence%PathStatsBufferSize]
+		if entry.sequence != sequence || entry.resolved {
+			continue
+		}
+		stats.resolve(entry, false)
+		if i != 0 {
+			continue
+		}
+		sample = currentTime.Sub(entry.sendTime) - ackDelay
+		if sample < 0 {
+			sample = 0
+		}
+		hasSample = true
+	}
+
+	if !hasSample {
+		return 0, false
+	}
+
+	if !stats.hasRTT {
+		stats.rtt = sample
+		stats.hasRTT = true
+	} else {
+		stats.rtt += (sample - stats.rtt) / 8
+		difference := sample - stats.lastSample
+		if difference < 0 {
+			difference = -difference
+		}
+		stats.jitter += (difference - stats.jitter) / 16
+	}
+	stats.lastSample = sample
+
+	return sample, true
+}
+
+func (stats *PathStats) Stats() PathStatsSnapshot {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	resolved := 0
+	lost := 0
+	for i := range stats.entries {
+		if stats.entries[i].resolved {
+			resolved++
+			if stats.entries[i].lost {
+				lost++
+			}
+		}
+	}
+	packetLoss := 0.0
+	if resolved > 0 {
+		packetLoss = float64(lost) / float64(resolved)
+	}
+	return PathStatsSnapshot{
+		RTT:          stats.rtt,
+		Jitter:       stats.jitter,
+		PacketLoss:   packetLoss,
+		PacketsSent:  stats.sent,
+		PacketsAcked: stats.acked,
+		PacketsLost:  stats.lost,
+	}
+}
+
+// AckDelayMicroseconds converts how long a packet was held before its ack was sent into
+// the ack delay header field, so the other side can take it out of its RTT samples.
+func AckDelayMicroseconds(delay time.Duration) uint32 {
+	microseconds := delay.Microseconds()
+	if microseconds < 0 {
+		return 0
+	}
+	if microseconds > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(microseconds)
+}
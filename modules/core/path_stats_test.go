@@ -0,0 +1,154 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ackBitsFor(ack uint64, sequences ...uint64) [AckBitsBytes]byte {
+	var ackBits [AckBitsBytes]byte
+	for _, sequence := range sequences {
+		i := ack - sequence
+		ackBits[i/8] |= 1 << (i % 8)
+	}
+	return ackBits
+}
+
+func TestPathStatsRTT(t *testing.T) {
+
+	t.Parallel()
+
+	stats := CreatePathStats()
+
+	currentTime := time.Unix(1000, 0)
+
+	for i := uint64(0); i < 100; i++ {
+		sequence := 10000 + i
+		stats.PacketSent(sequence, currentTime)
+		ackBits := ackBitsFor(sequence, sequence)
+		sample, ok := stats.ProcessAcks(sequence, ackBits[:], 5*time.Millisecond, currentTime.Add(55*time.Millisecond))
+		assert.True(t, ok)
+		assert.Equal(t, 50*time.Millisecond, sample)
+		currentTime = currentTime.Add(10 * time.Millisecond)
+	}
+
+	snapshot := stats.Stats()
+	assert.Equal(t, 50*time.Millisecond, snapshot.RTT)
+	assert.Equal(t, time.Duration(0), snapshot.Jitter)
+	assert.Equal(t, 0.0, snapshot.PacketLoss)
+	assert.Equal(t, uint64(100), snapshot.PacketsSent)
+	assert.Equal(t, uint64(100), snapshot.PacketsAcked)
+
+	// acking the same packet again does not give another sample
+
+	ackBits := ackBitsFor(10099, 10099)
+	_, ok := stats.ProcessAcks(10099, ackBits[:], 0, currentTime)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(100), stats.Stats().PacketsAcked)
+}
+
+func TestPathStatsJitter(t *testing.T) {
+
+	t.Parallel()
+
+	stats := CreatePathStats()
+
+	currentTime := time.Unix(1000, 0)
+
+	for i := uint64(0); i < 200; i++ {
+		sequence := 10000 + i
+		stats.PacketSent(sequence, currentTime)
+		rtt := 40 * time.Millisecond
+		if i%2 == 1 {
+			rtt = 60 * time.Millisecond
+		}
+		ackBits := ackBitsFor(sequence, sequence)
+		stats.ProcessAcks(sequence, ackBits[:], 0, currentTime.Add(rtt))
+		currentTime = currentTime.Add(10 * time.Millisecond)
+	}
+
+	snapshot := stats.Stats()
+	assert.InDelta(t, float64(50*time.Millisecond), float64(snapshot.RTT), float64(5*time.Millisecond))
+	assert.InDelta(t, float64(20*time.Millisecond), float64(snapshot.Jitter), float64(time.Millisecond))
+}
+
+func TestPathStatsLoss(t *testing.T) {
+
+	t.Parallel()
+
+	stats := CreatePathStats()
+
+	currentTime := time.Unix(1000, 0)
+
+	// every fourth packet is lost, the rest are acked together by the next packet
+
+	lost := 0
+	for i := uint64(0); i < 400; i++ {
+		sequence := 10000 + i
+		lost += stats.PacketSent(sequence, currentTime)
+		if i%4 == 3 {
+			ackBits := ackBitsFor(sequence-1, sequence-3, sequence-2, sequence-1)
+			stats.ProcessAcks(sequence-1, ackBits[:], 0, currentTime)
+		}
+		currentTime = currentTime.Add(10 * time.Millisecond)
+	}
+
+	// packets are only lost once the loss timeout has passed
+
+	assert.True(t, stats.Stats().PacketsLost < 100)
+
+	lost += stats.PacketSent(10400, currentTime.Add(PathStatsMinLossTimeout))
+
+	snapshot := stats.Stats()
+	assert.Equal(t, uint64(lost), snapshot.PacketsLost)
+	assert.Equal(t, uint64(100), snapshot.PacketsLost)
+	assert.Equal(t, uint64(300), snapshot.PacketsAcked)
+	assert.InDelta(t, 0.25, snapshot.PacketLoss, 0.001)
+
+	// late acks for lost packets are ignored
+
+	ackBits := ackBitsFor(10003, 10003)
+	_, ok := stats.ProcessAcks(10003, ackBits[:], 0, currentTime)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(300), stats.Stats().PacketsAcked)
+}
+
+func TestAckDelayMicroseconds(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, uint32(0), AckDelayMicroseconds(-time.Second))
+	assert.Equal(t, uint32(1500), AckDelayMicroseconds(1500*time.Microsecond))
+	assert.Equal(t, uint32(0xFFFFFFFF), AckDelayMicroseconds(24*time.Hour))
+}
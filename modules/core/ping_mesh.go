@@ -0,0 +1,172 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Gateways ping each other on their public port, so the ping mesh measures the path relayed sessions take.
+const GatewayPingPacket = byte(8)
+const GatewayPongPacket = byte(9)
+
+const GatewayPingPacketBytes = VersionBytes + PacketTypeBytes + ChonkleBytes + SequenceBytes + PittleBytes
+
+// WriteGatewayPingPacket writes a gateway ping or pong, with the chonkle and pittle for the link between the
+// two gateways. Pongs echo the sequence of the ping they answer.
+func WriteGatewayPingPacket(buffer []byte, version byte, packetType byte, sequence uint64, filterKey []byte, from *net.UDPAddr, to *net.UDPAddr) int {
+	index := 0
+	WriteUint8(buffer, &index, version)
+	WriteUint8(buffer, &index, packetType)
+	index += ChonkleBytes
+	WriteUint64(buffer, &index, sequence)
+	WritePacketFilter(buffer[:GatewayPingPacketBytes], filterKey, from, to)
+	return GatewayPingPacketBytes
+}
+
+func ReadGatewayPingPacket(packetData []byte, sequence *uint64) bool {
+	if len(packetData) != GatewayPingPacketBytes || (packetData[VersionBytes] != GatewayPingPacket && packetData[VersionBytes] != GatewayPongPacket) {
+		return false
+	}
+	index := VersionBytes + PacketTypeBytes + ChonkleBytes
+	return ReadUint64(packetData, &index, sequence)
+}
+
+// PingMeshPeer is the RTT, jitter and packet loss to another gateway, as measured by pinging it.
+type PingMeshPeer struct {
+	Address     string  `json:"address"`
+	RTT         float64 `json:"rtt"`
+	Jitter      float64 `json:"jitter"`
+	PacketLoss  float64 `json:"packet_loss"`
+	PingsSent   uint64  `json:"pings_sent"`
+	PongsLost   uint64  `json:"pongs_lost"`
+	HasResponse bool    `json:"has_response"`
+}
+
+type pingMeshEntry struct {
+	address     *net.UDPAddr
+	stats       *PathStats
+	hasResponse bool
+}
+
+// PingMesh keeps the path stats to each of the other gateways. The peers can change as gateways come and
+// go, and stats are kept for peers that stay.
+type PingMesh struct {
+	mutex   sync.Mutex
+	self    string
+	entries map[string]*pingMeshEntry
+	peers   []*net.UDPAddr
+}
+
+// CreatePingMesh creates a ping mesh for the gateway at the given address, which is left out of its peers.
+func CreatePingMesh(gatewayAddress *net.UDPAddr, peers []*net.UDPAddr) *PingMesh {
+	mesh := &PingMesh{self: gatewayAddress.String(), entries: make(map[string]*pingMeshEntry)}
+	mesh.SetPeers(peers)
+	return mesh
+}
+
+func (mesh *PingMesh) SetPeers(peers []*net.UDPAddr) {
+	mesh.mutex.Lock()
+	defer mesh.mutex.Unlock()
+	entries := make(map[string]*pingMeshEntry)
+	mesh.peers = mesh.peers[:0:0]
+	for _, peer := range peers {
+		key := peer.String()
+		if key == mesh.self || entries[key] != nil {
+			continue
+		}
+		entry := mesh.entries[key]
+		if entry == nil {
+			entry = &pingMeshEntry{address: peer, stats: CreatePathStats()}
+		}
+		entries[key] = entry
+		mesh.peers = append(mesh.peers, peer)
+	}
+	mesh.entries = entries
+}
+
+func (mesh *PingMesh) GetPeers() []*net.UDPAddr {
+	mesh.mutex.Lock()
+	defer mesh.mutex.Unlock()
+	return mesh.peers
+}
+
+func (mesh *PingMesh) IsPeer(address *net.UDPAddr) bool {
+	mesh.mutex.Lock()
+	defer mesh.mutex.Unlock()
+	return mesh.entries[address.String()] != nil
+}
+
+func (mesh *PingMesh) PingSent(peer *net.UDPAddr, sequence uint64, currentTime time.Time) {
+	mesh.mutex.Lock()
+	entry := mesh.entries[peer.String()]
+	mesh.mutex.Unlock()
+	if entry != nil {
+		entry.stats.PacketSent(sequence, currentTime)
+	}
+}
+
+// ReceivedPong records the pong for a ping, and returns false if it didn't come from a peer.
+func (mesh *PingMesh) ReceivedPong(from *net.UDPAddr, sequence uint64, currentTime time.Time) bool {
+	mesh.mutex.Lock()
+	defer mesh.mutex.Unlock()
+	entry := mesh.entries[from.String()]
+	if entry == nil {
+		return false
+	}
+	entry.stats.ProcessAcks(sequence, []byte{1}, 0, currentTime)
+	entry.hasResponse = true
+	return true
+}
+
+// Stats returns a row of the mesh's RTT, jitter and loss matrices, with RTT and jitter in milliseconds.
+func (mesh *PingMesh) Stats() []PingMeshPeer {
+	mesh.mutex.Lock()
+	defer mesh.mutex.Unlock()
+	stats := make([]PingMeshPeer, len(mesh.peers))
+	for i, peer := range mesh.peers {
+		entry := mesh.entries[peer.String()]
+		snapshot := entry.stats.Stats()
+		stats[i] = PingMeshPeer{
+			Address:     peer.String(),
+			RTT:         float64(snapshot.RTT) / float64(time.Millisecond),
+			Jitter:      float64(snapshot.Jitter) / float64(time.Millisecond),
+			PacketLoss:  snapshot.PacketLoss,
+			PingsSent:   snapshot.PacketsSent,
+			PongsLost:   snapshot.PacketsLost,
+			HasResponse: entry.hasResponse,
+		}
+	}
+	return stats
+}
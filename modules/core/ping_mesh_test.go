@@ -0,0 +1,122 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGatewayPingPacket(t *testing.T) {
+
+	t.Parallel()
+
+	from := ParseAddress("10.0.0.1:40000")
+	to := ParseAddress("10.0.0.2:40000")
+
+	buffer := make([]byte, GatewayPingPacketBytes)
+	packetBytes := WriteGatewayPingPacket(buffer, 1, GatewayPingPacket, 1234, nil, from, to)
+	assert.Equal(t, GatewayPingPacketBytes, packetBytes)
+
+	var fromAddressData, toAddressData [MaxAddressDataBytes]byte
+	var fromPort, toPort uint16
+	fromBytes := GetAddressData(from, fromAddressData[:], &fromPort)
+	toBytes := GetAddressData(to, toAddressData[:], &toPort)
+
+	var magic [MagicBytes]byte
+	assert.True(t, BasicPacketFilter(buffer, packetBytes))
+	assert.True(t, AdvancedPacketFilter(buffer, magic[:], fromAddressData[:fromBytes], fromPort, toAddressData[:toBytes], toPort, packetBytes))
+
+	var sequence uint64
+	assert.True(t, ReadGatewayPingPacket(buffer[:packetBytes], &sequence))
+	assert.Equal(t, uint64(1234), sequence)
+
+	filterKey := RandomBytes(SipHashKeyBytes)
+	packetBytes = WriteGatewayPingPacket(buffer, 1, GatewayPongPacket, 5678, filterKey, to, from)
+	assert.True(t, AdvancedPacketFilterKeyed(buffer, filterKey, toAddressData[:toBytes], toPort, fromAddressData[:fromBytes], fromPort, packetBytes))
+	assert.True(t, ReadGatewayPingPacket(buffer[:packetBytes], &sequence))
+	assert.Equal(t, uint64(5678), sequence)
+
+	assert.False(t, ReadGatewayPingPacket(buffer[:packetBytes-1], &sequence))
+	buffer[VersionBytes] = PayloadPacket
+	assert.False(t, ReadGatewayPingPacket(buffer[:packetBytes], &sequence))
+}
+
+func TestPingMesh(t *testing.T) {
+
+	t.Parallel()
+
+	self := ParseAddress("10.0.0.1:40000")
+	peerA := ParseAddress("10.0.0.2:40000")
+	peerB := ParseAddress("10.0.0.3:40000")
+
+	mesh := CreatePingMesh(self, []*net.UDPAddr{self, peerA, peerB, peerA})
+	assert.Equal(t, []*net.UDPAddr{peerA, peerB}, mesh.GetPeers())
+	assert.True(t, mesh.IsPeer(ParseAddress("10.0.0.2:40000")))
+	assert.False(t, mesh.IsPeer(self))
+	assert.False(t, mesh.IsPeer(ParseAddress("10.0.0.2:40001")))
+
+	currentTime := time.Now()
+
+	for sequence := uint64(0); sequence < 10; sequence++ {
+		sendTime := currentTime.Add(time.Duration(sequence) * time.Second)
+		mesh.PingSent(peerA, sequence, sendTime)
+		mesh.PingSent(peerB, sequence, sendTime)
+		assert.True(t, mesh.ReceivedPong(peerA, sequence, sendTime.Add(20*time.Millisecond)))
+	}
+	mesh.PingSent(peerA, 10, currentTime.Add(20*time.Second))
+	mesh.PingSent(peerB, 10, currentTime.Add(20*time.Second))
+
+	assert.False(t, mesh.ReceivedPong(ParseAddress("10.0.0.4:40000"), 0, currentTime))
+
+	stats := mesh.Stats()
+	assert.Equal(t, 2, len(stats))
+	assert.Equal(t, peerA.String(), stats[0].Address)
+	assert.True(t, stats[0].HasResponse)
+	assert.InDelta(t, 20.0, stats[0].RTT, 0.001)
+	assert.Equal(t, 0.0, stats[0].PacketLoss)
+	assert.Equal(t, uint64(11), stats[0].PingsSent)
+	assert.False(t, stats[1].HasResponse)
+	assert.Equal(t, 1.0, stats[1].PacketLoss)
+	assert.Equal(t, uint64(10), stats[1].PongsLost)
+
+	// stats are kept for peers that stay
+
+	mesh.SetPeers([]*net.UDPAddr{peerA})
+	stats = mesh.Stats()
+	assert.Equal(t, 1, len(stats))
+	assert.Equal(t, uint64(11), stats[0].PingsSent)
+	assert.False(t, mesh.IsPeer(peerB))
+}
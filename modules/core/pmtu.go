@@ -0,0 +1,160 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// largest udp payload on a 1500 byte ethernet path: 1500 - 20 byte IPv4 header - 8 byte UDP header
+
+const MaxPathMTU = 1472
+
+const PathMTUMaxProbes = 3
+const PathMTUSearchInterval = 10 * time.Minute
+
+// PathMTU discovers the largest packet that gets through a path, in the style of
+// DPLPMTUD (RFC 8899). It binary searches between the largest acked probe and the
+// smallest size that failed PathMTUMaxProbes times in a row, then searches again
+// every PathMTUSearchInterval in case the path changed.
+type PathMTU struct {
+	mutex         sync.Mutex
+	maxMTU        int
+	probeInterval time.Duration
+	mtu           int
+	low           int
+	high          int
+	probeBytes    int
+	probeCount    int
+	probeTime     time.Time
+	searchTime    time.Time
+}
+
+func CreatePathMTU(minMTU int, maxMTU int, probeInterval time.Duration) *PathMTU {
+	if maxMTU < minMTU {
+		maxMTU = minMTU
+	}
+	pathMTU := &PathMTU{}
+	pathMTU.maxMTU = maxMTU
+	pathMTU.probeInterval = probeInterval
+	pathMTU.mtu = minMTU
+	pathMTU.low = minMTU
+	pathMTU.high = maxMTU
+	return pathMTU
+}
+
+// GetProbe returns the size of the probe packet to send now, or zero if no probe is due.
+func (pathMTU *PathMTU) GetProbe(currentTime time.Time) int {
+
+	pathMTU.mutex.Lock()
+	defer pathMTU.mutex.Unlock()
+
+	if pathMTU.low >= pathMTU.high {
+		if currentTime.Sub(pathMTU.searchTime) < PathMTUSearchInterval {
+			return 0
+		}
+		pathMTU.low = pathMTU.mtu
+		pathMTU.high = pathMTU.maxMTU
+		if pathMTU.low >= pathMTU.high {
+			pathMTU.searchTime = currentTime
+			return 0
+		}
+	}
+
+	if pathMTU.probeBytes != 0 {
+		if currentTime.Sub(pathMTU.probeTime) < pathMTU.probeInterval {
+			return 0
+		}
+		if pathMTU.probeCount >= PathMTUMaxProbes {
+			pathMTU.high = pathMTU.probeBytes - 1
+			pathMTU.probeBytes = 0
+			if pathMTU.low >= pathMTU.high {
+				pathMTU.searchTime = currentTime
+				return 0
+			}
+		}
+	}
+
+	if pathMTU.probeBytes == 0 {
+		pathMTU.probeBytes = (pathMTU.low + pathMTU.high + 1) / 2
+		pathMTU.probeCount = 0
+	}
+
+	pathMTU.probeCount++
+	pathMTU.probeTime = currentTime
+
+	return pathMTU.probeBytes
+}
+
+// ProbeAcked records that a probe of the given size made it through the path.
+func (pathMTU *PathMTU) ProbeAcked(probeBytes int, currentTime time.Time) {
+
+	pathMTU.mutex.Lock()
+	defer pathMTU.mutex.Unlock()
+
+	if probeBytes > pathMTU.maxMTU {
+		return
+	}
+
+	if probeBytes > pathMTU.mtu {
+		pathMTU.mtu = probeBytes
+	}
+
+	if probeBytes > pathMTU.low {
+		pathMTU.low = probeBytes
+		if pathMTU.high < pathMTU.low {
+			pathMTU.high = pathMTU.low
+		}
+	}
+
+	if probeBytes >= pathMTU.probeBytes {
+		pathMTU.probeBytes = 0
+	}
+
+	if pathMTU.low >= pathMTU.high {
+		pathMTU.searchTime = currentTime
+	}
+}
+
+// GetMTU returns the largest packet size in bytes known to get through the path.
+func (pathMTU *PathMTU) GetMTU() int {
+	pathMTU.mutex.Lock()
+	defer pathMTU.mutex.Unlock()
+	return pathMTU.mtu
+}
+
+func (pathMTU *PathMTU) IsSearching() bool {
+	pathMTU.mutex.Lock()
+	defer pathMTU.mutex.Unlock()
+	return pathMTU.low < pathMTU.high
+}
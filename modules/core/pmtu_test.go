@@ -0,0 +1,116 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func discoverPathMTU(pathMTU *PathMTU, pathLimit int, currentTime time.Time, probeInterval time.Duration) (time.Time, int) {
+	numProbes := 0
+	for i := 0; i < 1000 && pathMTU.IsSearching(); i++ {
+		probeBytes := pathMTU.GetProbe(currentTime)
+		if probeBytes != 0 {
+			numProbes++
+			if probeBytes <= pathLimit {
+				pathMTU.ProbeAcked(probeBytes, currentTime)
+			}
+		}
+		currentTime = currentTime.Add(probeInterval)
+	}
+	return currentTime, numProbes
+}
+
+func TestPathMTU(t *testing.T) {
+
+	t.Parallel()
+
+	probeInterval := 100 * time.Millisecond
+
+	pathMTU := CreatePathMTU(MinPacketSize, MaxPathMTU, probeInterval)
+
+	assert.Equal(t, MinPacketSize, pathMTU.GetMTU())
+	assert.True(t, pathMTU.IsSearching())
+
+	currentTime := time.Unix(1000, 0)
+
+	// probes are not resent until the probe interval has passed
+
+	probeBytes := pathMTU.GetProbe(currentTime)
+	assert.True(t, probeBytes > MinPacketSize && probeBytes <= MaxPathMTU)
+	assert.Equal(t, 0, pathMTU.GetProbe(currentTime.Add(probeInterval/2)))
+	assert.Equal(t, probeBytes, pathMTU.GetProbe(currentTime.Add(probeInterval)))
+
+	currentTime, _ = discoverPathMTU(pathMTU, 1400, currentTime, probeInterval)
+
+	assert.Equal(t, 1400, pathMTU.GetMTU())
+	assert.False(t, pathMTU.IsSearching())
+	assert.Equal(t, 0, pathMTU.GetProbe(currentTime))
+
+	// search again later and find the path has grown
+
+	currentTime = currentTime.Add(PathMTUSearchInterval)
+	assert.True(t, pathMTU.GetProbe(currentTime) > 1400)
+
+	discoverPathMTU(pathMTU, MaxPathMTU, currentTime, probeInterval)
+
+	assert.Equal(t, MaxPathMTU, pathMTU.GetMTU())
+}
+
+func TestPathMTUBlocked(t *testing.T) {
+
+	t.Parallel()
+
+	pathMTU := CreatePathMTU(MinPacketSize, MaxPathMTU, 100*time.Millisecond)
+
+	_, numProbes := discoverPathMTU(pathMTU, 0, time.Unix(1000, 0), 100*time.Millisecond)
+
+	assert.Equal(t, MinPacketSize, pathMTU.GetMTU())
+	assert.False(t, pathMTU.IsSearching())
+	assert.True(t, numProbes <= 8*PathMTUMaxProbes)
+}
+
+func TestPathMTUIgnoresOversizedAcks(t *testing.T) {
+
+	t.Parallel()
+
+	pathMTU := CreatePathMTU(MinPacketSize, MaxPathMTU, 100*time.Millisecond)
+
+	pathMTU.ProbeAcked(MaxPathMTU+1, time.Unix(1000, 0))
+	assert.Equal(t, MinPacketSize, pathMTU.GetMTU())
+
+	pathMTU.ProbeAcked(MinPacketSize-1, time.Unix(1000, 0))
+	assert.Equal(t, MinPacketSize, pathMTU.GetMTU())
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// PROXY protocol v2 headers are prepended to each datagram by load balancers in front of the gateway,
+// carrying the address the datagram originally came from.
+
+var ProxyProtocolSignature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const ProxyProtocolHeaderBytes = 16
+
+const ProxyProtocolCommand_Local = 0x20
+const ProxyProtocolCommand_Proxy = 0x21
+
+const ProxyProtocolFamily_UDP4 = 0x12
+const ProxyProtocolFamily_UDP6 = 0x22
+
+const ProxyProtocolAddressBytes_UDP4 = 4 + 4 + 2 + 2
+const ProxyProtocolAddressBytes_UDP6 = 16 + 16 + 2 + 2
+
+// ReadProxyHeader parses the PROXY protocol v2 header at the start of a datagram, returning its length and the
+// source address it carries. Source is nil for LOCAL headers, which load balancers send for their own health
+// checks. TLVs after the addresses are skipped.
+func ReadProxyHeader(packetData []byte) (headerBytes int, source *net.UDPAddr, err error) {
+
+	if len(packetData) < ProxyProtocolHeaderBytes || !bytes.Equal(packetData[:len(ProxyProtocolSignature)], ProxyProtocolSignature) {
+		return 0, nil, fmt.Errorf("missing proxy protocol header")
+	}
+
+	command := packetData[12]
+	family := packetData[13]
+	headerBytes = ProxyProtocolHeaderBytes + int(binary.BigEndian.Uint16(packetData[14:16]))
+
+	if headerBytes > len(packetData) {
+		return 0, nil, fmt.Errorf("proxy protocol header is truncated")
+	}
+
+	switch command {
+	case ProxyProtocolCommand_Local:
+		return headerBytes, nil, nil
+	case ProxyProtocolCommand_Proxy:
+	default:
+		return 0, nil, fmt.Errorf("unsupported proxy protocol command: %x", command)
+	}
+
+	addressData := packetData[ProxyProtocolHeaderBytes:headerBytes]
+
+	switch family {
+	case ProxyProtocolFamily_UDP4:
+		if len(addressData) < ProxyProtocolAddressBytes_UDP4 {
+			return 0, nil, fmt.Errorf("proxy protocol addresses are truncated")
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, addressData[0:4])
+		return headerBytes, &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addressData[8:10]))}, nil
+	case ProxyProtocolFamily_UDP6:
+		if len(addressData) < ProxyProtocolAddressBytes_UDP6 {
+			return 0, nil, fmt.Errorf("proxy protocol addresses are truncated")
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addressData[0:16])
+		return headerBytes, &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(addressData[32:34]))}, nil
+	}
+
+	return 0, nil, fmt.Errorf("unsupported proxy protocol family: %x", family)
+}
+
+// WriteProxyHeader writes a PROXY protocol v2 header for a datagram from source to destination. The gateway only
+// reads these, but load balancer stand-ins in tests and tools write them.
+func WriteProxyHeader(buffer []byte, source *net.UDPAddr, destination *net.UDPAddr) int {
+
+	copy(buffer, ProxyProtocolSignature)
+	buffer[12] = ProxyProtocolCommand_Proxy
+
+	if source.IP.To4() != nil && destination.IP.To4() != nil {
+		buffer[13] = ProxyProtocolFamily_UDP4
+		binary.BigEndian.PutUint16(buffer[14:16], ProxyProtocolAddressBytes_UDP4)
+		copy(buffer[16:20], source.IP.To4())
+		copy(buffer[20:24], destination.IP.To4())
+		binary.BigEndian.PutUint16(buffer[24:26], uint16(source.Port))
+		binary.BigEndian.PutUint16(buffer[26:28], uint16(destination.Port))
+		return ProxyProtocolHeaderBytes + ProxyProtocolAddressBytes_UDP4
+	}
+
+	buffer[13] = ProxyProtocolFamily_UDP6
+	binary.BigEndian.PutUint16(buffer[14:16], ProxyProtocolAddressBytes_UDP6)
+	copy(buffer[16:32], source.IP.To16())
+	copy(buffer[32:48], destination.IP.To16())
+	binary.BigEndian.PutUint16(buffer[48:50], uint16(source.Port))
+	binary.BigEndian.PutUint16(buffer[50:52], uint16(destination.Port))
+	return ProxyProtocolHeaderBytes + ProxyProtocolAddressBytes_UDP6
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeader(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 256)
+
+	// ipv4 and ipv6 sources come back out, with the payload after the header
+
+	source := ParseAddress("203.0.113.7:51000")
+	headerBytes := WriteProxyHeader(buffer, source, ParseAddress("10.0.0.1:40000"))
+	copy(buffer[headerBytes:], "payload")
+
+	readBytes, readSource, err := ReadProxyHeader(buffer[:headerBytes+7])
+	assert.Nil(t, err)
+	assert.Equal(t, headerBytes, readBytes)
+	assert.True(t, AddressEqual(source, readSource))
+	assert.Equal(t, "payload", string(buffer[readBytes:headerBytes+7]))
+
+	source = ParseAddress("[2001:db8::7]:51000")
+	headerBytes = WriteProxyHeader(buffer, source, ParseAddress("[2001:db8::1]:40000"))
+
+	readBytes, readSource, err = ReadProxyHeader(buffer[:headerBytes])
+	assert.Nil(t, err)
+	assert.Equal(t, headerBytes, readBytes)
+	assert.True(t, AddressEqual(source, readSource))
+
+	// TLVs after the addresses are skipped
+
+	headerBytes = WriteProxyHeader(buffer, ParseAddress("203.0.113.7:51000"), ParseAddress("10.0.0.1:40000"))
+	binary.BigEndian.PutUint16(buffer[14:16], ProxyProtocolAddressBytes_UDP4+8)
+
+	readBytes, readSource, err = ReadProxyHeader(buffer[:headerBytes+8])
+	assert.Nil(t, err)
+	assert.Equal(t, headerBytes+8, readBytes)
+	assert.NotNil(t, readSource)
+
+	// LOCAL headers have no source
+
+	buffer[12] = ProxyProtocolCommand_Local
+
+	readBytes, readSource, err = ReadProxyHeader(buffer[:headerBytes+8])
+	assert.Nil(t, err)
+	assert.Equal(t, headerBytes+8, readBytes)
+	assert.Nil(t, readSource)
+}
+
+func TestProxyHeaderInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	buffer := make([]byte, 256)
+	headerBytes := WriteProxyHeader(buffer, ParseAddress("203.0.113.7:51000"), ParseAddress("10.0.0.1:40000"))
+
+	_, _, err := ReadProxyHeader(buffer[:ProxyProtocolHeaderBytes-1])
+	assert.NotNil(t, err)
+
+	_, _, err = ReadProxyHeader(buffer[:headerBytes-1])
+	assert.NotNil(t, err)
+
+	_, _, err = ReadProxyHeader(make([]byte, 64))
+	assert.NotNil(t, err)
+
+	tcp := make([]byte, headerBytes)
+	copy(tcp, buffer[:headerBytes])
+	tcp[13] = 0x11
+	_, _, err = ReadProxyHeader(tcp)
+	assert.NotNil(t, err)
+
+	version1 := make([]byte, headerBytes)
+	copy(version1, buffer[:headerBytes])
+	version1[12] = 0x11
+	_, _, err = ReadProxyHeader(version1)
+	assert.NotNil(t, err)
+
+	// addresses shorter than the family needs
+
+	short := make([]byte, headerBytes)
+	copy(short, buffer[:headerBytes])
+	binary.BigEndian.PutUint16(short[14:16], 4)
+	_, _, err = ReadProxyHeader(short)
+	assert.NotNil(t, err)
+}
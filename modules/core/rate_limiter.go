@@ -0,0 +1,147 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+type rateLimiterEntry struct {
+	key        [MaxAddressDataBytes]byte
+	tokens     float64
+	lastUpdate time.Time
+}
+
+// RateLimiter is a token bucket per source IP. The number of buckets is bounded,
+// with the least recently used bucket recycled once the limit is reached. A rate of
+// zero or less lets every packet through.
+type RateLimiter struct {
+	mutex            sync.Mutex
+	packetsPerSecond float64
+	burst            float64
+	maxEntries       int
+	entries          map[[MaxAddressDataBytes]byte]*list.Element
+	lru              *list.List
+}
+
+func CreateRateLimiter(packetsPerSecond float64, burst float64, maxEntries int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	limiter := &RateLimiter{}
+	limiter.packetsPerSecond = packetsPerSecond
+	limiter.burst = burst
+	limiter.maxEntries = maxEntries
+	limiter.entries = make(map[[MaxAddressDataBytes]byte]*list.Element, maxEntries)
+	limiter.lru = list.New()
+	return limiter
+}
+
+func (limiter *RateLimiter) Allow(address *net.UDPAddr, currentTime time.Time) bool {
+
+	var key [MaxAddressDataBytes]byte
+	var port uint16
+	GetAddressData(address, key[:], &port)
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.packetsPerSecond <= 0 {
+		return true
+	}
+
+	var entry *rateLimiterEntry
+
+	if element, exists := limiter.entries[key]; exists {
+		limiter.lru.MoveToFront(element)
+		entry = element.Value.(*rateLimiterEntry)
+		elapsed := currentTime.Sub(entry.lastUpdate).Seconds()
+		if elapsed > 0 {
+			entry.tokens += elapsed * limiter.packetsPerSecond
+			if entry.tokens > limiter.burst {
+				entry.tokens = limiter.burst
+			}
+			entry.lastUpdate = currentTime
+		}
+	} else {
+		if limiter.lru.Len() >= limiter.maxEntries {
+			oldest := limiter.lru.Back()
+			entry = oldest.Value.(*rateLimiterEntry)
+			delete(limiter.entries, entry.key)
+			limiter.lru.MoveToFront(oldest)
+			limiter.entries[key] = oldest
+		} else {
+			entry = &rateLimiterEntry{}
+			limiter.entries[key] = limiter.lru.PushFront(entry)
+		}
+		entry.key = key
+		entry.tokens = limiter.burst
+		entry.lastUpdate = currentTime
+	}
+
+	if entry.tokens < 1 {
+		return false
+	}
+
+	entry.tokens--
+
+	return true
+}
+
+// SetLimit changes the rate and burst. Buckets keep their tokens, capped at the new burst.
+func (limiter *RateLimiter) SetLimit(packetsPerSecond float64, burst float64) {
+	if burst < 1 {
+		burst = 1
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.packetsPerSecond = packetsPerSecond
+	limiter.burst = burst
+	for element := limiter.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*rateLimiterEntry)
+		if entry.tokens > burst {
+			entry.tokens = burst
+		}
+	}
+}
+
+func (limiter *RateLimiter) GetCount() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.lru.Len()
+}
@@ -0,0 +1,133 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := CreateRateLimiter(10, 5, 100)
+
+	address := ParseAddress("10.0.0.1:50000")
+	samePort := ParseAddress("10.0.0.1:50001")
+	otherAddress := ParseAddress("10.0.0.2:50000")
+
+	currentTime := time.Now()
+
+	// a new address can burst, then is limited
+
+	for i := 0; i < 5; i++ {
+		assert.True(t, limiter.Allow(address, currentTime))
+	}
+	assert.False(t, limiter.Allow(address, currentTime))
+
+	// buckets are keyed by IP, not port
+
+	assert.False(t, limiter.Allow(samePort, currentTime))
+
+	// other addresses have their own bucket
+
+	assert.True(t, limiter.Allow(otherAddress, currentTime))
+
+	// tokens refill over time, up to the burst size
+
+	currentTime = currentTime.Add(100 * time.Millisecond)
+	assert.True(t, limiter.Allow(address, currentTime))
+	assert.False(t, limiter.Allow(address, currentTime))
+
+	currentTime = currentTime.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		assert.True(t, limiter.Allow(address, currentTime))
+	}
+	assert.False(t, limiter.Allow(address, currentTime))
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := CreateRateLimiter(10, 5, 100)
+
+	address := ParseAddress("10.0.0.1:50000")
+
+	currentTime := time.Now()
+
+	// lowering the burst takes tokens away from existing buckets
+
+	assert.True(t, limiter.Allow(address, currentTime))
+
+	limiter.SetLimit(10, 2)
+	for i := 0; i < 2; i++ {
+		assert.True(t, limiter.Allow(address, currentTime))
+	}
+	assert.False(t, limiter.Allow(address, currentTime))
+
+	// a rate of zero lets everything through
+
+	limiter.SetLimit(0, 0)
+	for i := 0; i < 100; i++ {
+		assert.True(t, limiter.Allow(address, currentTime))
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := CreateRateLimiter(1, 1, 2)
+
+	a := ParseAddress("10.0.0.1:50000")
+	b := ParseAddress("10.0.0.2:50000")
+	c := ParseAddress("[::1]:50000")
+
+	currentTime := time.Now()
+
+	assert.True(t, limiter.Allow(a, currentTime))
+	assert.True(t, limiter.Allow(b, currentTime))
+	assert.False(t, limiter.Allow(a, currentTime))
+
+	// b is least recently used, so it is recycled for c
+
+	assert.True(t, limiter.Allow(c, currentTime))
+	assert.Equal(t, 2, limiter.GetCount())
+
+	assert.False(t, limiter.Allow(a, currentTime))
+	assert.False(t, limiter.Allow(c, currentTime))
+	assert.True(t, limiter.Allow(b, currentTime))
+}
@@ -0,0 +1,250 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Sessions can be routed through a chain of gateways acting as relays, client -> relay -> relay -> gateway,
+// when the overlay path is faster than the default internet path to the gateway. Packets between hops are
+// wrapped in a relay packet:
+//
+//	[version] [RelayPacket] [chonkle] [session id] [route token count] [encrypted route tokens] [inner packet] [pittle]
+//
+// Each relay decrypts the first route token, which tells it the next hop, and forwards the packet with the
+// rest of the tokens. The relay packet with no tokens left is unwrapped by the gateway at the end of the
+// route, which processes the inner packet like any other client packet, and wraps its replies to send them
+// back along the route. Every hop rewrites the chonkle and pittle of both the relay packet and the inner
+// packet for the link it sends them over, so the client and gateway see ordinary packets from their
+// neighbouring hop.
+//
+// The relay header and route tokens make relayed packets larger than direct ones, by up to MaxRelayBytes, so
+// relayed packets near the largest packet size are fragmented on links with a 1500 byte mtu.
+
+const RelayPacket = byte(7)
+
+const MaxRouteHops = 3
+
+const RouteTokenBytes = TimestampBytes + SessionIdBytes + 1 + AddressBytes
+const EncryptedRouteTokenBytes = NonceBytes_Box + RouteTokenBytes + HMACBytes_Box
+
+const RelayHeaderBytes = VersionBytes + PacketTypeBytes + ChonkleBytes + SessionIdBytes + 1
+const RelayOverheadBytes = RelayHeaderBytes + PittleBytes
+const MaxRelayBytes = RelayOverheadBytes + MaxRouteHops*EncryptedRouteTokenBytes
+
+// RouteToken is the route for one hop. Hop zero is the relay the client sends to.
+type RouteToken struct {
+	ExpireTimestamp uint64
+	SessionId       [SessionIdBytes]byte
+	Hop             uint8
+	NextAddress     net.UDPAddr
+}
+
+func WriteRouteToken(buffer []byte, index *int, token *RouteToken) {
+	WriteUint64(buffer, index, token.ExpireTimestamp)
+	WriteBytes(buffer, index, token.SessionId[:], SessionIdBytes)
+	WriteUint8(buffer, index, token.Hop)
+	WriteAddress(buffer, index, &token.NextAddress)
+}
+
+func ReadRouteToken(buffer []byte, index *int, token *RouteToken) bool {
+	if len(buffer)-*index < RouteTokenBytes {
+		return false
+	}
+	ReadUint64(buffer, index, &token.ExpireTimestamp)
+	ReadBytes(buffer, index, token.SessionId[:], SessionIdBytes)
+	ReadUint8(buffer, index, &token.Hop)
+	return ReadAddress(buffer, index, &token.NextAddress) && token.NextAddress.IP != nil
+}
+
+func WriteEncryptedRouteToken(buffer []byte, index *int, token *RouteToken, senderPrivateKey []byte, receiverPublicKey []byte) {
+	nonce := buffer[*index : *index+NonceBytes_Box]
+	RandomBytes_InPlace(nonce)
+	*index += NonceBytes_Box
+	tokenData := buffer[*index : *index+RouteTokenBytes+HMACBytes_Box]
+	WriteRouteToken(buffer, index, token)
+	Encrypt_Box(senderPrivateKey, receiverPublicKey, nonce, tokenData, RouteTokenBytes)
+	*index += HMACBytes_Box
+}
+
+// ReadEncryptedRouteToken decrypts the route token in place.
+func ReadEncryptedRouteToken(buffer []byte, index *int, token *RouteToken, senderPublicKey []byte, receiverPrivateKey []byte) bool {
+	if len(buffer)-*index < EncryptedRouteTokenBytes {
+		return false
+	}
+	nonce := buffer[*index : *index+NonceBytes_Box]
+	*index += NonceBytes_Box
+	tokenData := buffer[*index : *index+RouteTokenBytes+HMACBytes_Box]
+	if err := Decrypt_Box(senderPublicKey, receiverPrivateKey, nonce, tokenData, RouteTokenBytes+HMACBytes_Box); err != nil {
+		return false
+	}
+	result := ReadRouteToken(buffer, index, token)
+	*index += HMACBytes_Box
+	return result
+}
+
+// Route is what a client needs to send over a route: the address of the first relay, and the route tokens
+// for each relay in order. Clients can't decrypt the tokens, so the first relay address is in the clear.
+type Route struct {
+	RelayAddress   net.UDPAddr
+	NumRouteTokens int
+	RouteTokens    []byte
+}
+
+// GenerateRoute issues route tokens for a session through the relays, in order, to the gateway. All
+// gateways share a key pair, so every token is encrypted for the same gateway public key.
+func GenerateRoute(sessionId []byte, expireSeconds uint64, relayAddresses []*net.UDPAddr, gatewayAddress *net.UDPAddr, senderPrivateKey []byte, receiverPublicKey []byte) ([]byte, error) {
+
+	if len(relayAddresses) == 0 || len(relayAddresses) > MaxRouteHops {
+		return nil, fmt.Errorf("routes must have between 1 and %d relays, got %d", MaxRouteHops, len(relayAddresses))
+	}
+
+	buffer := make([]byte, AddressBytes+1+len(relayAddresses)*EncryptedRouteTokenBytes)
+
+	index := 0
+	WriteAddress(buffer, &index, relayAddresses[0])
+	WriteUint8(buffer, &index, uint8(len(relayAddresses)))
+
+	for i := range relayAddresses {
+		token := RouteToken{ExpireTimestamp: uint64(time.Now().Unix()) + expireSeconds, Hop: uint8(i)}
+		copy(token.SessionId[:], sessionId)
+		if i+1 < len(relayAddresses) {
+			token.NextAddress = *relayAddresses[i+1]
+		} else {
+			token.NextAddress = *gatewayAddress
+		}
+		WriteEncryptedRouteToken(buffer, &index, &token, senderPrivateKey, receiverPublicKey)
+	}
+
+	return buffer, nil
+}
+
+func ReadRoute(buffer []byte, route *Route) bool {
+	index := 0
+	if !ReadAddress(buffer, &index, &route.RelayAddress) || route.RelayAddress.IP == nil {
+		return false
+	}
+	var numRouteTokens uint8
+	if !ReadUint8(buffer, &index, &numRouteTokens) || numRouteTokens == 0 || numRouteTokens > MaxRouteHops {
+		return false
+	}
+	if len(buffer)-index != int(numRouteTokens)*EncryptedRouteTokenBytes {
+		return false
+	}
+	route.NumRouteTokens = int(numRouteTokens)
+	route.RouteTokens = buffer[index:]
+	return true
+}
+
+// RelayPacketData is a relay packet split into its parts. The slices point into the packet data.
+type RelayPacketData struct {
+	SessionId      []byte
+	NumRouteTokens int
+	RouteTokens    []byte
+	InnerPacket    []byte
+}
+
+func ReadRelayPacket(packetData []byte, packet *RelayPacketData) bool {
+	if len(packetData) < RelayOverheadBytes || packetData[VersionBytes] != RelayPacket {
+		return false
+	}
+	index := VersionBytes + PacketTypeBytes + ChonkleBytes
+	packet.SessionId = packetData[index : index+SessionIdBytes]
+	index += SessionIdBytes
+	numRouteTokens := int(packetData[index])
+	index++
+	if numRouteTokens > MaxRouteHops || len(packetData)-index-PittleBytes < numRouteTokens*EncryptedRouteTokenBytes {
+		return false
+	}
+	packet.NumRouteTokens = numRouteTokens
+	packet.RouteTokens = packetData[index : index+numRouteTokens*EncryptedRouteTokenBytes]
+	index += numRouteTokens * EncryptedRouteTokenBytes
+	packet.InnerPacket = packetData[index : len(packetData)-PittleBytes]
+	return true
+}
+
+// WriteRelayPacket wraps the inner packet for the link from one hop to the next, rewriting the chonkle and
+// pittle of the inner packet for that link too. It returns the number of bytes written, or zero if the
+// relay packet doesn't fit in the buffer.
+func WriteRelayPacket(buffer []byte, version byte, sessionId []byte, numRouteTokens int, routeTokens []byte, innerPacket []byte, filterKey []byte, from *net.UDPAddr, to *net.UDPAddr) int {
+
+	packetBytes := RelayOverheadBytes + len(routeTokens) + len(innerPacket)
+	if packetBytes > len(buffer) || len(innerPacket) < VersionBytes+PacketTypeBytes+ChonkleBytes+PittleBytes {
+		return 0
+	}
+
+	index := 0
+	WriteUint8(buffer, &index, version)
+	WriteUint8(buffer, &index, RelayPacket)
+	index += ChonkleBytes
+	WriteBytes(buffer, &index, sessionId, SessionIdBytes)
+	WriteUint8(buffer, &index, uint8(numRouteTokens))
+	WriteBytes(buffer, &index, routeTokens, len(routeTokens))
+	innerIndex := index
+	WriteBytes(buffer, &index, innerPacket, len(innerPacket))
+
+	WritePacketFilter(buffer[innerIndex:innerIndex+len(innerPacket)], filterKey, from, to)
+	WritePacketFilter(buffer[:packetBytes], filterKey, from, to)
+
+	return packetBytes
+}
+
+// WritePacketFilter writes the chonkle and pittle of a packet sent from one address to another, keyed with
+// the filter key if there is one.
+func WritePacketFilter(packetData []byte, filterKey []byte, from *net.UDPAddr, to *net.UDPAddr) {
+
+	var magic [MagicBytes]byte
+
+	var fromAddressBuffer [MaxAddressDataBytes]byte
+	var fromAddressPort uint16
+
+	var toAddressBuffer [MaxAddressDataBytes]byte
+	var toAddressPort uint16
+
+	fromAddressData := fromAddressBuffer[:GetAddressData(from, fromAddressBuffer[:], &fromAddressPort)]
+	toAddressData := toAddressBuffer[:GetAddressData(to, toAddressBuffer[:], &toAddressPort)]
+
+	packetBytes := len(packetData)
+	chonkle := packetData[VersionBytes+PacketTypeBytes : VersionBytes+PacketTypeBytes+ChonkleBytes]
+	pittle := packetData[packetBytes-PittleBytes:]
+
+	if filterKey != nil {
+		GenerateChonkleKeyed(chonkle, filterKey, fromAddressData, fromAddressPort, toAddressData, toAddressPort, packetBytes)
+		GeneratePittleKeyed(pittle, filterKey, fromAddressData, fromAddressPort, toAddressData, toAddressPort, packetBytes)
+	} else {
+		GenerateChonkle(chonkle, magic[:], fromAddressData, fromAddressPort, toAddressData, toAddressPort, packetBytes)
+		GeneratePittle(pittle, fromAddressData, fromAddressPort, toAddressData, toAddressPort, packetBytes)
+	}
+}
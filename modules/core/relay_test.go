@@ -0,0 +1,187 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteToken(t *testing.T) {
+
+	t.Parallel()
+
+	authPublicKey, authPrivateKey := Keygen_Box()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+
+	token := RouteToken{ExpireTimestamp: 1234, Hop: 2, NextAddress: *ParseAddress("10.0.0.2:40000")}
+	RandomBytes_InPlace(token.SessionId[:])
+
+	buffer := make([]byte, EncryptedRouteTokenBytes)
+	index := 0
+	WriteEncryptedRouteToken(buffer, &index, &token, authPrivateKey, gatewayPublicKey)
+	assert.Equal(t, EncryptedRouteTokenBytes, index)
+
+	encrypted := make([]byte, len(buffer))
+	copy(encrypted, buffer)
+
+	index = 0
+	var readToken RouteToken
+	assert.True(t, ReadEncryptedRouteToken(buffer, &index, &readToken, authPublicKey, gatewayPrivateKey))
+	assert.Equal(t, EncryptedRouteTokenBytes, index)
+	assert.Equal(t, token.ExpireTimestamp, readToken.ExpireTimestamp)
+	assert.Equal(t, token.SessionId, readToken.SessionId)
+	assert.Equal(t, token.Hop, readToken.Hop)
+	assert.True(t, AddressEqual(&token.NextAddress, &readToken.NextAddress))
+
+	// tampered and truncated tokens don't read
+
+	copy(buffer, encrypted)
+	buffer[NonceBytes_Box] ^= 1
+	index = 0
+	assert.False(t, ReadEncryptedRouteToken(buffer, &index, &readToken, authPublicKey, gatewayPrivateKey))
+
+	copy(buffer, encrypted)
+	index = 0
+	assert.False(t, ReadEncryptedRouteToken(buffer[:EncryptedRouteTokenBytes-1], &index, &readToken, authPublicKey, gatewayPrivateKey))
+}
+
+func TestGenerateRoute(t *testing.T) {
+
+	t.Parallel()
+
+	authPublicKey, authPrivateKey := Keygen_Box()
+	gatewayPublicKey, gatewayPrivateKey := Keygen_Box()
+
+	sessionId := RandomBytes(SessionIdBytes)
+	relayAddresses := []*net.UDPAddr{ParseAddress("10.0.0.1:41000"), ParseAddress("10.0.0.2:42000")}
+	gatewayAddress := ParseAddress("10.0.0.3:40000")
+
+	routeData, err := GenerateRoute(sessionId, 60, relayAddresses, gatewayAddress, authPrivateKey, gatewayPublicKey)
+	assert.Nil(t, err)
+
+	var route Route
+	assert.True(t, ReadRoute(routeData, &route))
+	assert.True(t, AddressEqual(relayAddresses[0], &route.RelayAddress))
+	assert.Equal(t, 2, route.NumRouteTokens)
+
+	// each hop's token sends the packet on to the next hop, and the last to the gateway
+
+	nextAddresses := []*net.UDPAddr{relayAddresses[1], gatewayAddress}
+	for i := 0; i < route.NumRouteTokens; i++ {
+		tokenData := make([]byte, EncryptedRouteTokenBytes)
+		copy(tokenData, route.RouteTokens[i*EncryptedRouteTokenBytes:])
+		index := 0
+		var token RouteToken
+		assert.True(t, ReadEncryptedRouteToken(tokenData, &index, &token, authPublicKey, gatewayPrivateKey))
+		assert.Equal(t, uint8(i), token.Hop)
+		assert.Equal(t, sessionId, token.SessionId[:])
+		assert.True(t, AddressEqual(nextAddresses[i], &token.NextAddress))
+	}
+
+	_, err = GenerateRoute(sessionId, 60, nil, gatewayAddress, authPrivateKey, gatewayPublicKey)
+	assert.NotNil(t, err)
+
+	_, err = GenerateRoute(sessionId, 60, make([]*net.UDPAddr, MaxRouteHops+1), gatewayAddress, authPrivateKey, gatewayPublicKey)
+	assert.NotNil(t, err)
+
+	assert.False(t, ReadRoute(routeData[:len(routeData)-1], &route))
+	assert.False(t, ReadRoute(routeData[:AddressBytes], &route))
+}
+
+func TestRelayPacket(t *testing.T) {
+
+	t.Parallel()
+
+	from := ParseAddress("10.0.0.1:30000")
+	to := ParseAddress("10.0.0.2:41000")
+	sessionId := RandomBytes(SessionIdBytes)
+	routeTokens := RandomBytes(2 * EncryptedRouteTokenBytes)
+
+	innerPacket := RandomBytes(MinPacketSize)
+	innerCopy := make([]byte, len(innerPacket))
+	copy(innerCopy, innerPacket)
+
+	for _, filterKey := range [][]byte{nil, RandomBytes(SipHashKeyBytes)} {
+
+		buffer := make([]byte, MinPacketSize+MaxRelayBytes)
+		packetBytes := WriteRelayPacket(buffer, PacketVersion_FNV1a, sessionId, 2, routeTokens, innerPacket, filterKey, from, to)
+		assert.Equal(t, RelayOverheadBytes+len(routeTokens)+len(innerPacket), packetBytes)
+
+		// the relay packet and the inner packet both pass the filter for the link they are sent over
+
+		packetData := buffer[:packetBytes]
+		assert.True(t, BasicPacketFilter(packetData, packetBytes))
+
+		var relay RelayPacketData
+		assert.True(t, ReadRelayPacket(packetData, &relay))
+		assert.Equal(t, sessionId, relay.SessionId)
+		assert.Equal(t, 2, relay.NumRouteTokens)
+		assert.Equal(t, routeTokens, relay.RouteTokens)
+		assert.Equal(t, len(innerPacket), len(relay.InnerPacket))
+
+		for _, data := range [][]byte{packetData, relay.InnerPacket} {
+			var magic [MagicBytes]byte
+			var fromAddressData, toAddressData [MaxAddressDataBytes]byte
+			var fromPort, toPort uint16
+			fromBytes := GetAddressData(from, fromAddressData[:], &fromPort)
+			toBytes := GetAddressData(to, toAddressData[:], &toPort)
+			if filterKey != nil {
+				assert.True(t, AdvancedPacketFilterKeyed(data, filterKey, fromAddressData[:fromBytes], fromPort, toAddressData[:toBytes], toPort, len(data)))
+			} else {
+				assert.True(t, AdvancedPacketFilter(data, magic[:], fromAddressData[:fromBytes], fromPort, toAddressData[:toBytes], toPort, len(data)))
+			}
+		}
+
+		// only the chonkle and pittle of the inner packet change
+
+		assert.Equal(t, innerCopy[VersionBytes+PacketTypeBytes+ChonkleBytes:len(innerCopy)-PittleBytes], relay.InnerPacket[VersionBytes+PacketTypeBytes+ChonkleBytes:len(innerCopy)-PittleBytes])
+		assert.Equal(t, innerCopy, innerPacket)
+	}
+
+	// packets that don't fit the buffer aren't written
+
+	assert.Equal(t, 0, WriteRelayPacket(make([]byte, MinPacketSize), PacketVersion_FNV1a, sessionId, 0, nil, innerPacket, nil, from, to))
+
+	// relay packets claiming more route tokens than they have don't read
+
+	buffer := make([]byte, MinPacketSize+MaxRelayBytes)
+	packetBytes := WriteRelayPacket(buffer, PacketVersion_FNV1a, sessionId, 0, nil, innerPacket[:50], nil, from, to)
+	buffer[RelayHeaderBytes-1] = 1
+	var relay RelayPacketData
+	assert.False(t, ReadRelayPacket(buffer[:packetBytes], &relay))
+	buffer[RelayHeaderBytes-1] = MaxRouteHops + 1
+	assert.False(t, ReadRelayPacket(buffer[:packetBytes+MaxRelayBytes], &relay))
+	assert.False(t, ReadRelayPacket(buffer[:RelayOverheadBytes-1], &relay))
+}
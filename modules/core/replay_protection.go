@@ -0,0 +1,73 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+const ReplayProtectionBufferSize = 256
+
+// ReplayProtection tracks the sequence numbers received in a sliding window
+// behind the most recent sequence, so duplicated packets and packets too old
+// to check are dropped.
+type ReplayProtection struct {
+	MostRecentSequence uint64
+	ReceivedPacket     [ReplayProtectionBufferSize]uint64
+}
+
+func CreateReplayProtection() *ReplayProtection {
+	replayProtection := &ReplayProtection{}
+	replayProtection.Reset()
+	return replayProtection
+}
+
+func (replayProtection *ReplayProtection) Reset() {
+	replayProtection.MostRecentSequence = 0
+	for i := range replayProtection.ReceivedPacket {
+		replayProtection.ReceivedPacket[i] = ^uint64(0)
+	}
+}
+
+func (replayProtection *ReplayProtection) AlreadyReceived(sequence uint64) bool {
+	if sequence+ReplayProtectionBufferSize <= replayProtection.MostRecentSequence {
+		return true
+	}
+	receivedSequence := replayProtection.ReceivedPacket[sequence%ReplayProtectionBufferSize]
+	if receivedSequence == ^uint64(0) {
+		return false
+	}
+	return receivedSequence >= sequence
+}
+
+func (replayProtection *ReplayProtection) AdvanceSequence(sequence uint64) {
+	if sequence > replayProtection.MostRecentSequence {
+		replayProtection.MostRecentSequence = sequence
+	}
+	replayProtection.ReceivedPacket[sequence%ReplayProtectionBufferSize] = sequence
+}
@@ -0,0 +1,98 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayProtection(t *testing.T) {
+
+	t.Parallel()
+
+	replayProtection := CreateReplayProtection()
+
+	for i := 0; i < 2; i++ {
+
+		replayProtection.Reset()
+
+		assert.Equal(t, uint64(0), replayProtection.MostRecentSequence)
+
+		// the first time we receive packets, they should not be already received
+
+		const MaxSequence = ReplayProtectionBufferSize * 4
+
+		for sequence := uint64(0); sequence < MaxSequence; sequence++ {
+			assert.False(t, replayProtection.AlreadyReceived(sequence))
+			replayProtection.AdvanceSequence(sequence)
+		}
+
+		// old packets outside buffer should be considered already received
+
+		assert.True(t, replayProtection.AlreadyReceived(0))
+
+		// packets received a second time should be flagged already received
+
+		for sequence := uint64(MaxSequence - 10); sequence < MaxSequence; sequence++ {
+			assert.True(t, replayProtection.AlreadyReceived(sequence))
+		}
+
+		// jumping ahead to a much higher sequence should be considered not already received
+
+		assert.False(t, replayProtection.AlreadyReceived(MaxSequence+ReplayProtectionBufferSize))
+
+		// old packets should be considered already received
+
+		for sequence := uint64(0); sequence < MaxSequence; sequence++ {
+			assert.True(t, replayProtection.AlreadyReceived(sequence))
+		}
+	}
+}
+
+func TestReplayProtectionOutOfOrder(t *testing.T) {
+
+	t.Parallel()
+
+	replayProtection := CreateReplayProtection()
+
+	replayProtection.AdvanceSequence(100)
+
+	// packets behind the most recent sequence but inside the window are accepted once
+
+	assert.False(t, replayProtection.AlreadyReceived(90))
+	replayProtection.AdvanceSequence(90)
+	assert.True(t, replayProtection.AlreadyReceived(90))
+
+	assert.Equal(t, uint64(100), replayProtection.MostRecentSequence)
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Revocation is a revoked session or user id in hex, and when the revocation lapses. Zero never lapses.
+type Revocation struct {
+	Id              string `json:"id"`
+	ExpireTimestamp uint64 `json:"expire_timestamp,omitempty"`
+}
+
+// Revocations is the revocation list as the auth service serves it to gateways. The version goes up with
+// every change, so gateways can ask for the list only when it has changed.
+type Revocations struct {
+	Version  uint64       `json:"version"`
+	Sessions []Revocation `json:"sessions"`
+	Users    []Revocation `json:"users"`
+}
+
+type revocationSet struct {
+	version  uint64
+	sessions map[[SessionIdBytes]byte]uint64
+	users    map[[UserIdBytes]byte]uint64
+}
+
+// RevocationList holds the revoked session and user ids. It is checked for every packet and changes rarely, so
+// changes copy the whole set and swap it in, and lookups don't lock.
+type RevocationList struct {
+	mutex sync.Mutex
+	set   atomic.Pointer[revocationSet]
+}
+
+func CreateRevocationList() *RevocationList {
+	list := &RevocationList{}
+	list.set.Store(&revocationSet{sessions: map[[SessionIdBytes]byte]uint64{}, users: map[[UserIdBytes]byte]uint64{}})
+	return list
+}
+
+// IsRevoked checks whether the session or its user is revoked. A nil session id checks only the user.
+func (list *RevocationList) IsRevoked(sessionId []byte, userId []byte, currentTimestamp uint64) bool {
+	set := list.set.Load()
+	if len(set.sessions) == 0 && len(set.users) == 0 {
+		return false
+	}
+	if sessionId != nil {
+		var sessionKey [SessionIdBytes]byte
+		copy(sessionKey[:], sessionId)
+		if expireTimestamp, ok := set.sessions[sessionKey]; ok && (expireTimestamp == 0 || expireTimestamp > currentTimestamp) {
+			return true
+		}
+	}
+	if userId == nil {
+		return false
+	}
+	var userKey [UserIdBytes]byte
+	copy(userKey[:], userId)
+	if expireTimestamp, ok := set.users[userKey]; ok && (expireTimestamp == 0 || expireTimestamp > currentTimestamp) {
+		return true
+	}
+	return false
+}
+
+func (list *RevocationList) GetVersion() uint64 {
+	return list.set.Load().version
+}
+
+// update copies the current set, applies the change and swaps the copy in under a new version. Lapsed
+// revocations are dropped along the way
+func (list *RevocationList) update(currentTimestamp uint64, change func(set *revocationSet)) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	current := list.set.Load()
+	set := &revocationSet{version: current.version + 1, sessions: map[[SessionIdBytes]byte]uint64{}, users: map[[UserIdBytes]byte]uint64{}}
+	for id, expireTimestamp := range current.sessions {
+		if expireTimestamp == 0 || expireTimestamp > currentTimestamp {
+			set.sessions[id] = expireTimestamp
+		}
+	}
+	for id, expireTimestamp := range current.users {
+		if expireTimestamp == 0 || expireTimestamp > currentTimestamp {
+			set.users[id] = expireTimestamp
+		}
+	}
+	change(set)
+	list.set.Store(set)
+}
+
+func (list *RevocationList) RevokeSession(sessionId [SessionIdBytes]byte, expireTimestamp uint64, currentTimestamp uint64) {
+	list.update(currentTimestamp, func(set *revocationSet) { set.sessions[sessionId] = expireTimestamp })
+}
+
+func (list *RevocationList) RevokeUser(userId [UserIdBytes]byte, expireTimestamp uint64, currentTimestamp uint64) {
+	list.update(currentTimestamp, func(set *revocationSet) { set.users[userId] = expireTimestamp })
+}
+
+func (list *RevocationList) RestoreUser(userId [UserIdBytes]byte, currentTimestamp uint64) {
+	list.update(currentTimestamp, func(set *revocationSet) { delete(set.users, userId) })
+}
+
+// Get returns the revocations that haven't lapsed, to send to gateways.
+func (list *RevocationList) Get(currentTimestamp uint64) Revocations {
+	set := list.set.Load()
+	revocations := Revocations{Version: set.version, Sessions: []Revocation{}, Users: []Revocation{}}
+	for id, expireTimestamp := range set.sessions {
+		if expireTimestamp == 0 || expireTimestamp > currentTimestamp {
+			revocations.Sessions = append(revocations.Sessions, Revocation{Id: IdString(id[:]), ExpireTimestamp: expireTimestamp})
+		}
+	}
+	for id, expireTimestamp := range set.users {
+		if expireTimestamp == 0 || expireTimestamp > currentTimestamp {
+			revocations.Users = append(revocations.Users, Revocation{Id: IdString(id[:]), ExpireTimestamp: expireTimestamp})
+		}
+	}
+	return revocations
+}
+
+// Set replaces the list with revocations fetched from the auth service.
+func (list *RevocationList) Set(revocations Revocations) error {
+	set := &revocationSet{version: revocations.Version, sessions: map[[SessionIdBytes]byte]uint64{}, users: map[[UserIdBytes]byte]uint64{}}
+	for _, revocation := range revocations.Sessions {
+		var sessionId [SessionIdBytes]byte
+		if err := ParseId(revocation.Id, sessionId[:]); err != nil {
+			return fmt.Errorf("invalid revoked session id: %v", err)
+		}
+		set.sessions[sessionId] = revocation.ExpireTimestamp
+	}
+	for _, revocation := range revocations.Users {
+		var userId [UserIdBytes]byte
+		if err := ParseId(revocation.Id, userId[:]); err != nil {
+			return fmt.Errorf("invalid revoked user id: %v", err)
+		}
+		set.users[userId] = revocation.ExpireTimestamp
+	}
+	list.mutex.Lock()
+	list.set.Store(set)
+	list.mutex.Unlock()
+	return nil
+}
+
+// ParseId reads an id written by IdString into id, which must be the size of the id.
+func ParseId(value string, id []byte) error {
+	if len(value) != hex.EncodedLen(len(id)) {
+		return fmt.Errorf("expected %d hex characters, got %d", hex.EncodedLen(len(id)), len(value))
+	}
+	_, err := hex.Decode(id, []byte(value))
+	return err
+}
@@ -0,0 +1,119 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationList(t *testing.T) {
+
+	t.Parallel()
+
+	list := CreateRevocationList()
+
+	var sessionId [SessionIdBytes]byte
+	var userId [UserIdBytes]byte
+	RandomBytes_InPlace(sessionId[:])
+	RandomBytes_InPlace(userId[:])
+
+	var otherSessionId [SessionIdBytes]byte
+	var otherUserId [UserIdBytes]byte
+
+	assert.False(t, list.IsRevoked(sessionId[:], userId[:], 1000))
+	assert.Equal(t, uint64(0), list.GetVersion())
+
+	// revoking a session drops only that session, until the revocation lapses
+
+	list.RevokeSession(sessionId, 2000, 1000)
+	assert.Equal(t, uint64(1), list.GetVersion())
+	assert.True(t, list.IsRevoked(sessionId[:], otherUserId[:], 1000))
+	assert.False(t, list.IsRevoked(otherSessionId[:], userId[:], 1000))
+	assert.False(t, list.IsRevoked(sessionId[:], otherUserId[:], 2000))
+
+	// revoking a user drops every session of theirs, until they are restored
+
+	list.RevokeUser(userId, 0, 1000)
+	assert.Equal(t, uint64(2), list.GetVersion())
+	assert.True(t, list.IsRevoked(otherSessionId[:], userId[:], 1000000))
+	assert.True(t, list.IsRevoked(nil, userId[:], 1000))
+	assert.False(t, list.IsRevoked(nil, otherUserId[:], 1000))
+
+	list.RestoreUser(userId, 1000)
+	assert.False(t, list.IsRevoked(otherSessionId[:], userId[:], 1000))
+
+	// lapsed revocations are left out of the list sent to gateways, and pruned on the next change
+
+	list.RevokeUser(userId, 0, 1000)
+	revocations := list.Get(2000)
+	assert.Equal(t, uint64(4), revocations.Version)
+	assert.Equal(t, 0, len(revocations.Sessions))
+	assert.Equal(t, []Revocation{{Id: IdString(userId[:])}}, revocations.Users)
+
+	revocations = list.Get(1000)
+	assert.Equal(t, []Revocation{{Id: IdString(sessionId[:]), ExpireTimestamp: 2000}}, revocations.Sessions)
+
+	// gateways replace their list with the one from the auth service
+
+	gatewayList := CreateRevocationList()
+	assert.NoError(t, gatewayList.Set(revocations))
+	assert.Equal(t, uint64(4), gatewayList.GetVersion())
+	assert.True(t, gatewayList.IsRevoked(sessionId[:], otherUserId[:], 1000))
+	assert.True(t, gatewayList.IsRevoked(otherSessionId[:], userId[:], 1000))
+
+	revocations.Users[0].Id = "xyz"
+	assert.Error(t, gatewayList.Set(revocations))
+	assert.Equal(t, uint64(4), gatewayList.GetVersion())
+
+	// a nil user id is one that couldn't be looked up, not the zero user id
+
+	list.RevokeUser(otherUserId, 0, 1000)
+	assert.True(t, list.IsRevoked(otherSessionId[:], otherUserId[:], 1000))
+	assert.False(t, list.IsRevoked(otherSessionId[:], nil, 1000))
+}
+
+func TestParseId(t *testing.T) {
+
+	t.Parallel()
+
+	var id [UserIdBytes]byte
+	RandomBytes_InPlace(id[:])
+
+	var parsed [UserIdBytes]byte
+	assert.NoError(t, ParseId(IdString(id[:]), parsed[:]))
+	assert.Equal(t, id, parsed)
+
+	assert.Error(t, ParseId(IdString(id[:16]), parsed[:]))
+	assert.Error(t, ParseId(IdString(id[:])[1:]+"g", parsed[:]))
+}
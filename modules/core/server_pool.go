@@ -0,0 +1,321 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServerState is a snapshot of one server in a pool, as seen by a balance strategy.
+type ServerState struct {
+	Address  net.UDPAddr
+	Tenant   uint16
+	Healthy  bool
+	Sessions int64
+	Removed  bool
+}
+
+// BalanceStrategy picks which server a new session is sent to. Select is only
+// given healthy servers, and returns an index into servers.
+type BalanceStrategy interface {
+	Name() string
+	Select(servers []ServerState, sessionId []byte) int
+}
+
+// ConsistentHashStrategy uses rendezvous hashing on the session id, so a session
+// maps to the same server across gateways, and only sessions on a server that
+// goes away are moved.
+type ConsistentHashStrategy struct{}
+
+func (strategy ConsistentHashStrategy) Name() string {
+	return "hash"
+}
+
+func (strategy ConsistentHashStrategy) Select(servers []ServerState, sessionId []byte) int {
+	best := 0
+	bestScore := uint64(0)
+	for i := range servers {
+		var addressData [MaxAddressDataBytes]byte
+		var addressPort uint16
+		addressBytes := GetAddressData(&servers[i].Address, addressData[:], &addressPort)
+		var port [2]byte
+		binary.LittleEndian.PutUint16(port[:], addressPort)
+		hash := fnv.New64a()
+		hash.Write(sessionId)
+		hash.Write(addressData[:addressBytes])
+		hash.Write(port[:])
+		score := hash.Sum64()
+		if i == 0 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	return best
+}
+
+type LeastSessionsStrategy struct{}
+
+func (strategy LeastSessionsStrategy) Name() string {
+	return "least_sessions"
+}
+
+func (strategy LeastSessionsStrategy) Select(servers []ServerState, sessionId []byte) int {
+	best := 0
+	for i := range servers {
+		if servers[i].Sessions < servers[best].Sessions {
+			best = i
+		}
+	}
+	return best
+}
+
+type RoundRobinStrategy struct {
+	next uint64
+}
+
+func (strategy *RoundRobinStrategy) Name() string {
+	return "round_robin"
+}
+
+func (strategy *RoundRobinStrategy) Select(servers []ServerState, sessionId []byte) int {
+	return int((atomic.AddUint64(&strategy.next, 1) - 1) % uint64(len(servers)))
+}
+
+func ParseBalanceStrategy(name string) (BalanceStrategy, error) {
+	switch name {
+	case "hash":
+		return ConsistentHashStrategy{}, nil
+	case "least_sessions":
+		return LeastSessionsStrategy{}, nil
+	case "round_robin":
+		return &RoundRobinStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown balance strategy %q", name)
+}
+
+type poolServer struct {
+	address      net.UDPAddr
+	tenant       uint16
+	healthy      bool
+	removed      bool
+	sessions     int64
+	lastPongTime time.Time
+}
+
+// ServerPool is the set of servers a gateway forwards sessions to. Servers start
+// out healthy, and are marked unhealthy when they stop answering pings. Servers
+// keep their index for the life of the pool, so servers taken out of the pool are
+// only marked removed, and keep the sessions they already have. Each server belongs
+// to one tenant, and sessions are only balanced across their own tenant's servers.
+// Servers given without a tenant belong to tenant 0.
+type ServerPool struct {
+	mutex    sync.RWMutex
+	strategy BalanceStrategy
+	servers  []poolServer
+}
+
+func CreateServerPool(addresses []*net.UDPAddr, strategy BalanceStrategy, currentTime time.Time) *ServerPool {
+	pool := &ServerPool{strategy: strategy}
+	pool.servers = make([]poolServer, len(addresses))
+	for i := range addresses {
+		pool.servers[i].address = *addresses[i]
+		pool.servers[i].healthy = true
+		pool.servers[i].lastPongTime = currentTime
+	}
+	return pool
+}
+
+// Select picks a server for a new session, and counts the session against it
+// until Release is called. If no servers are healthy, all servers are considered.
+func (pool *ServerPool) Select(sessionId []byte) int {
+	index, _ := pool.SelectTenant(0, sessionId)
+	return index
+}
+
+// SelectTenant picks one of the tenant's servers for a new session. It returns
+// false if the tenant has no servers in the pool.
+func (pool *ServerPool) SelectTenant(tenant uint16, sessionId []byte) (int, bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	candidates := make([]ServerState, 0, len(pool.servers))
+	indices := make([]int, 0, len(pool.servers))
+	for i := range pool.servers {
+		if pool.servers[i].tenant == tenant && pool.servers[i].healthy && !pool.servers[i].removed {
+			candidates = append(candidates, ServerState{Address: pool.servers[i].address, Tenant: tenant, Healthy: true, Sessions: pool.servers[i].sessions})
+			indices = append(indices, i)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range pool.servers {
+			if pool.servers[i].tenant == tenant && !pool.servers[i].removed {
+				candidates = append(candidates, ServerState{Address: pool.servers[i].address, Tenant: tenant, Sessions: pool.servers[i].sessions})
+				indices = append(indices, i)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	index := indices[pool.strategy.Select(candidates, sessionId)]
+	pool.servers[index].sessions++
+	return index, true
+}
+
+// Claim counts a session against the server at address, for sessions that were started on another
+// gateway and must stay on their server. Like the sessions already on them, claimed sessions stay on
+// removed servers. It returns false if the server isn't in the pool.
+func (pool *ServerPool) Claim(address *net.UDPAddr) (int, bool) {
+	return pool.ClaimTenant(0, address)
+}
+
+// ClaimTenant is Claim for a server of the tenant.
+func (pool *ServerPool) ClaimTenant(tenant uint16, address *net.UDPAddr) (int, bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for i := range pool.servers {
+		if pool.servers[i].tenant == tenant && AddressEqual(&pool.servers[i].address, address) {
+			pool.servers[i].sessions++
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (pool *ServerPool) Release(index int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.servers[index].sessions > 0 {
+		pool.servers[index].sessions--
+	}
+}
+
+func (pool *ServerPool) GetAddress(index int) *net.UDPAddr {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	return &pool.servers[index].address
+}
+
+func (pool *ServerPool) IsHealthy(index int) bool {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	return pool.servers[index].healthy
+}
+
+// GetNumServers returns the number of servers in the pool, including removed servers.
+func (pool *ServerPool) GetNumServers() int {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	return len(pool.servers)
+}
+
+// SetServers changes the servers new sessions are balanced across. Servers not in addresses are marked
+// removed, and new servers are added at the end, healthy. It returns the indices of the added servers.
+func (pool *ServerPool) SetServers(addresses []*net.UDPAddr, currentTime time.Time) []int {
+	return pool.SetTenantServers(0, addresses, currentTime)
+}
+
+// SetTenantServers is SetServers for the servers of one tenant. The servers of other tenants are left alone,
+// even if they have the same address.
+func (pool *ServerPool) SetTenantServers(tenant uint16, addresses []*net.UDPAddr, currentTime time.Time) []int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for i := range pool.servers {
+		if pool.servers[i].tenant == tenant {
+			pool.servers[i].removed = true
+		}
+	}
+	var added []int
+	for _, address := range addresses {
+		found := false
+		for i := range pool.servers {
+			if pool.servers[i].tenant == tenant && AddressEqual(&pool.servers[i].address, address) {
+				pool.servers[i].removed = false
+				found = true
+				break
+			}
+		}
+		if !found {
+			pool.servers = append(pool.servers, poolServer{address: *address, tenant: tenant, healthy: true, lastPongTime: currentTime})
+			added = append(added, len(pool.servers)-1)
+		}
+	}
+	return added
+}
+
+func (pool *ServerPool) GetStrategy() BalanceStrategy {
+	return pool.strategy
+}
+
+func (pool *ServerPool) GetServerState(index int) ServerState {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	server := &pool.servers[index]
+	return ServerState{Address: server.address, Tenant: server.tenant, Healthy: server.healthy, Sessions: server.sessions, Removed: server.removed}
+}
+
+// ReceivedPong marks every server at the address as answering, since tenants can share a server.
+func (pool *ServerPool) ReceivedPong(from *net.UDPAddr, currentTime time.Time) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	found := false
+	for i := range pool.servers {
+		if AddressEqual(&pool.servers[i].address, from) {
+			pool.servers[i].lastPongTime = currentTime
+			found = true
+		}
+	}
+	return found
+}
+
+// UpdateHealth marks servers healthy if they have answered a ping within timeout,
+// and unhealthy otherwise. It returns the indices of servers whose health changed.
+func (pool *ServerPool) UpdateHealth(currentTime time.Time, timeout time.Duration) []int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	var changed []int
+	for i := range pool.servers {
+		healthy := currentTime.Sub(pool.servers[i].lastPongTime) < timeout
+		if healthy != pool.servers[i].healthy {
+			pool.servers[i].healthy = healthy
+			changed = append(changed, i)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,271 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testServerAddresses() []*net.UDPAddr {
+	return []*net.UDPAddr{
+		ParseAddress("10.0.0.1:50000"),
+		ParseAddress("10.0.0.2:50000"),
+		ParseAddress("10.0.0.3:50000"),
+	}
+}
+
+func TestParseBalanceStrategy(t *testing.T) {
+
+	t.Parallel()
+
+	for _, name := range []string{"hash", "least_sessions", "round_robin"} {
+		strategy, err := ParseBalanceStrategy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, strategy.Name())
+	}
+
+	_, err := ParseBalanceStrategy("random")
+	assert.Error(t, err)
+}
+
+func TestServerPoolConsistentHash(t *testing.T) {
+
+	t.Parallel()
+
+	currentTime := time.Unix(1000, 0)
+
+	pool := CreateServerPool(testServerAddresses(), ConsistentHashStrategy{}, currentTime)
+
+	// the same session always maps to the same server, and sessions are spread out
+
+	var sessionIds [100][SessionIdBytes]byte
+	selected := make([]int, len(sessionIds))
+	counts := make([]int, pool.GetNumServers())
+	for i := range sessionIds {
+		RandomBytes_InPlace(sessionIds[i][:])
+		selected[i] = pool.Select(sessionIds[i][:])
+		assert.Equal(t, selected[i], pool.Select(sessionIds[i][:]))
+		counts[selected[i]]++
+	}
+	for i := range counts {
+		assert.True(t, counts[i] > 10)
+	}
+
+	// when a server goes down, only its sessions move
+
+	pool.ReceivedPong(ParseAddress("10.0.0.1:50000"), currentTime.Add(10*time.Second))
+	pool.ReceivedPong(ParseAddress("10.0.0.3:50000"), currentTime.Add(10*time.Second))
+	assert.Equal(t, []int{1}, pool.UpdateHealth(currentTime.Add(11*time.Second), 5*time.Second))
+	assert.False(t, pool.IsHealthy(1))
+
+	for i := range sessionIds {
+		index := pool.Select(sessionIds[i][:])
+		assert.NotEqual(t, 1, index)
+		if selected[i] != 1 {
+			assert.Equal(t, selected[i], index)
+		}
+	}
+}
+
+func TestServerPoolLeastSessions(t *testing.T) {
+
+	t.Parallel()
+
+	pool := CreateServerPool(testServerAddresses(), LeastSessionsStrategy{}, time.Unix(1000, 0))
+
+	sessionId := RandomBytes(SessionIdBytes)
+
+	assert.Equal(t, 0, pool.Select(sessionId))
+	assert.Equal(t, 1, pool.Select(sessionId))
+	assert.Equal(t, 2, pool.Select(sessionId))
+	assert.Equal(t, 0, pool.Select(sessionId))
+
+	pool.Release(1)
+	assert.Equal(t, int64(0), pool.GetServerState(1).Sessions)
+	assert.Equal(t, 1, pool.Select(sessionId))
+	assert.Equal(t, int64(2), pool.GetServerState(0).Sessions)
+}
+
+func TestServerPoolRoundRobin(t *testing.T) {
+
+	t.Parallel()
+
+	currentTime := time.Unix(1000, 0)
+
+	pool := CreateServerPool(testServerAddresses(), &RoundRobinStrategy{}, currentTime)
+
+	sessionId := RandomBytes(SessionIdBytes)
+
+	assert.Equal(t, 0, pool.Select(sessionId))
+	assert.Equal(t, 1, pool.Select(sessionId))
+	assert.Equal(t, 2, pool.Select(sessionId))
+	assert.Equal(t, 0, pool.Select(sessionId))
+
+	// unhealthy servers are skipped
+
+	pool.ReceivedPong(ParseAddress("10.0.0.3:50000"), currentTime.Add(10*time.Second))
+	assert.Equal(t, []int{0, 1}, pool.UpdateHealth(currentTime.Add(10*time.Second), 5*time.Second))
+
+	assert.Equal(t, 2, pool.Select(sessionId))
+	assert.Equal(t, 2, pool.Select(sessionId))
+
+	// with no healthy servers, all servers are used
+
+	assert.Equal(t, []int{2}, pool.UpdateHealth(currentTime.Add(time.Minute), 5*time.Second))
+
+	assert.Equal(t, 0, pool.Select(sessionId))
+
+	// servers that answer pings again become healthy
+
+	assert.False(t, pool.ReceivedPong(ParseAddress("10.0.0.4:50000"), currentTime.Add(time.Minute)))
+	assert.True(t, pool.ReceivedPong(ParseAddress("10.0.0.2:50000"), currentTime.Add(time.Minute)))
+	assert.Equal(t, []int{1}, pool.UpdateHealth(currentTime.Add(time.Minute), 5*time.Second))
+	assert.True(t, pool.IsHealthy(1))
+}
+
+func TestServerPoolSetServers(t *testing.T) {
+
+	t.Parallel()
+
+	currentTime := time.Unix(1000, 0)
+
+	pool := CreateServerPool(testServerAddresses(), &RoundRobinStrategy{}, currentTime)
+
+	sessionId := RandomBytes(SessionIdBytes)
+
+	assert.Equal(t, 0, pool.Select(sessionId))
+
+	// removed servers keep their index and sessions, but get no new sessions
+
+	added := pool.SetServers([]*net.UDPAddr{ParseAddress("10.0.0.2:50000"), ParseAddress("10.0.0.4:50000")}, currentTime)
+	assert.Equal(t, []int{3}, added)
+	assert.Equal(t, 4, pool.GetNumServers())
+	assert.True(t, pool.GetServerState(0).Removed)
+	assert.Equal(t, int64(1), pool.GetServerState(0).Sessions)
+	assert.False(t, pool.GetServerState(1).Removed)
+	assert.True(t, pool.GetServerState(2).Removed)
+	assert.True(t, pool.IsHealthy(3))
+
+	for i := 0; i < 4; i++ {
+		index := pool.Select(sessionId)
+		assert.True(t, index == 1 || index == 3)
+	}
+
+	pool.Release(0)
+	assert.Equal(t, int64(0), pool.GetServerState(0).Sessions)
+
+	// servers added back are used again under their old index
+
+	assert.Nil(t, pool.SetServers([]*net.UDPAddr{ParseAddress("10.0.0.1:50000")}, currentTime))
+	assert.False(t, pool.GetServerState(0).Removed)
+	assert.Equal(t, 0, pool.Select(sessionId))
+	assert.Equal(t, 0, pool.Select(sessionId))
+}
+
+func TestServerPoolClaim(t *testing.T) {
+
+	t.Parallel()
+
+	currentTime := time.Unix(1000, 0)
+
+	pool := CreateServerPool(testServerAddresses(), &RoundRobinStrategy{}, currentTime)
+
+	index, ok := pool.Claim(ParseAddress("10.0.0.3:50000"))
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+	assert.Equal(t, int64(1), pool.GetServerState(2).Sessions)
+
+	_, ok = pool.Claim(ParseAddress("10.0.0.9:50000"))
+	assert.False(t, ok)
+
+	// removed servers keep the sessions they already have, so they can still be claimed
+
+	pool.SetServers([]*net.UDPAddr{ParseAddress("10.0.0.1:50000")}, currentTime)
+	index, ok = pool.Claim(ParseAddress("10.0.0.3:50000"))
+	assert.True(t, ok)
+	assert.Equal(t, 2, index)
+	assert.Equal(t, int64(2), pool.GetServerState(2).Sessions)
+}
+
+func TestServerPoolTenants(t *testing.T) {
+
+	t.Parallel()
+
+	currentTime := time.Unix(1000, 0)
+
+	pool := CreateServerPool(testServerAddresses(), ConsistentHashStrategy{}, currentTime)
+
+	sessionId := make([]byte, SessionIdBytes)
+
+	// tenants without servers can't select one
+
+	_, ok := pool.SelectTenant(7, sessionId)
+	assert.False(t, ok)
+
+	// tenant servers are added after the default servers, and can share an address with them
+
+	added := pool.SetTenantServers(7, []*net.UDPAddr{ParseAddress("10.0.0.1:50000"), ParseAddress("10.0.1.1:50000")}, currentTime)
+	assert.Equal(t, []int{3, 4}, added)
+	assert.Equal(t, uint16(7), pool.GetServerState(3).Tenant)
+
+	for i := 0; i < 10; i++ {
+		RandomBytes_InPlace(sessionId)
+		index, ok := pool.SelectTenant(7, sessionId)
+		assert.True(t, ok)
+		assert.True(t, index == 3 || index == 4)
+		assert.True(t, pool.Select(sessionId) < 3)
+	}
+
+	index, ok := pool.ClaimTenant(7, ParseAddress("10.0.0.1:50000"))
+	assert.True(t, ok)
+	assert.Equal(t, 3, index)
+
+	// pongs count for every tenant's server at the address
+
+	assert.True(t, pool.ReceivedPong(ParseAddress("10.0.0.1:50000"), currentTime.Add(time.Minute)))
+	changed := pool.UpdateHealth(currentTime.Add(time.Minute), 5*time.Second)
+	assert.NotContains(t, changed, 0)
+	assert.NotContains(t, changed, 3)
+	assert.Contains(t, changed, 4)
+
+	// changing a tenant's servers leaves the other tenants alone
+
+	assert.Nil(t, pool.SetTenantServers(7, nil, currentTime))
+	assert.True(t, pool.GetServerState(3).Removed)
+	assert.False(t, pool.GetServerState(0).Removed)
+	_, ok = pool.SelectTenant(7, sessionId)
+	assert.False(t, ok)
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type sessionTableEntry struct {
+	sessionId       [SessionIdBytes]byte
+	lastReceiveTime time.Time
+	value           interface{}
+}
+
+// SessionTable maps session ids to session state. Entries are kept in a list
+// ordered by last receive time, so idle sessions are expired from the back in
+// O(expired), and once the table is full the least recently used session is evicted.
+type SessionTable struct {
+	mutex       sync.Mutex
+	timeout     time.Duration
+	maxSessions int
+	entries     map[[SessionIdBytes]byte]*list.Element
+	lru         *list.List
+	expired     uint64
+	evicted     uint64
+	onRemove    func(value interface{})
+}
+
+func CreateSessionTable(timeout time.Duration, maxSessions int) *SessionTable {
+	if maxSessions < 1 {
+		maxSessions = 1
+	}
+	table := &SessionTable{}
+	table.timeout = timeout
+	table.maxSessions = maxSessions
+	table.entries = make(map[[SessionIdBytes]byte]*list.Element)
+	table.lru = list.New()
+	return table
+}
+
+// SetRemoveCallback sets a function that is called with the value of each session
+// that is expired, evicted or removed. It is called without the table locked.
+func (table *SessionTable) SetRemoveCallback(callback func(value interface{})) {
+	table.mutex.Lock()
+	table.onRemove = callback
+	table.mutex.Unlock()
+}
+
+func (table *SessionTable) removed(onRemove func(value interface{}), values ...interface{}) {
+	if onRemove == nil {
+		return
+	}
+	for _, value := range values {
+		onRemove(value)
+	}
+}
+
+// Get returns the value for a session, or nil if there is no such session.
+// It does not count as a receive, call Touch once the packet has been accepted.
+func (table *SessionTable) Get(sessionId [SessionIdBytes]byte) interface{} {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	element, exists := table.entries[sessionId]
+	if !exists {
+		return nil
+	}
+	return element.Value.(*sessionTableEntry).value
+}
+
+func (table *SessionTable) Touch(sessionId [SessionIdBytes]byte, currentTime time.Time) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	element, exists := table.entries[sessionId]
+	if !exists {
+		return
+	}
+	element.Value.(*sessionTableEntry).lastReceiveTime = currentTime
+	table.lru.MoveToFront(element)
+}
+
+// Insert adds or replaces a session. It returns true if the least recently used
+// session was evicted to make room for it.
+func (table *SessionTable) Insert(sessionId [SessionIdBytes]byte, value interface{}, currentTime time.Time) bool {
+	table.mutex.Lock()
+
+	if element, exists := table.entries[sessionId]; exists {
+		entry := element.Value.(*sessionTableEntry)
+		replaced := entry.value
+		entry.value = value
+		entry.lastReceiveTime = currentTime
+		table.lru.MoveToFront(element)
+		onRemove := table.onRemove
+		table.mutex.Unlock()
+		table.removed(onRemove, replaced)
+		return false
+	}
+
+	var evicted *sessionTableEntry
+	if table.lru.Len() >= table.maxSessions {
+		oldest := table.lru.Back()
+		table.lru.Remove(oldest)
+		evicted = oldest.Value.(*sessionTableEntry)
+		delete(table.entries, evicted.sessionId)
+		table.evicted++
+	}
+
+	table.entries[sessionId] = table.lru.PushFront(&sessionTableEntry{sessionId: sessionId, lastReceiveTime: currentTime, value: value})
+
+	onRemove := table.onRemove
+	table.mutex.Unlock()
+
+	if evicted == nil {
+		return false
+	}
+
+	table.removed(onRemove, evicted.value)
+	return true
+}
+
+func (table *SessionTable) Remove(sessionId [SessionIdBytes]byte) bool {
+	table.mutex.Lock()
+	element, exists := table.entries[sessionId]
+	if !exists {
+		table.mutex.Unlock()
+		return false
+	}
+	table.lru.Remove(element)
+	delete(table.entries, sessionId)
+	onRemove := table.onRemove
+	table.mutex.Unlock()
+	table.removed(onRemove, element.Value.(*sessionTableEntry).value)
+	return true
+}
+
+// Expire removes sessions that have not received a packet within the timeout,
+// and returns the number removed.
+func (table *SessionTable) Expire(currentTime time.Time) int {
+	table.mutex.Lock()
+	var values []interface{}
+	for {
+		oldest := table.lru.Back()
+		if oldest == nil {
+			break
+		}
+		entry := oldest.Value.(*sessionTableEntry)
+		if currentTime.Sub(entry.lastReceiveTime) < table.timeout {
+			break
+		}
+		table.lru.Remove(oldest)
+		delete(table.entries, entry.sessionId)
+		values = append(values, entry.value)
+	}
+	table.expired += uint64(len(values))
+	onRemove := table.onRemove
+	table.mutex.Unlock()
+	table.removed(onRemove, values...)
+	return len(values)
+}
+
+// ForEach calls the callback for every session. The sessions are copied first,
+// so the callback is called without the table locked.
+func (table *SessionTable) ForEach(callback func(sessionId [SessionIdBytes]byte, value interface{})) {
+	table.mutex.Lock()
+	entries := make([]sessionTableEntry, 0, table.lru.Len())
+	for element := table.lru.Front(); element != nil; element = element.Next() {
+		entries = append(entries, *element.Value.(*sessionTableEntry))
+	}
+	table.mutex.Unlock()
+	for i := range entries {
+		callback(entries[i].sessionId, entries[i].value)
+	}
+}
+
+func (table *SessionTable) GetCount() int {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return table.lru.Len()
+}
+
+func (table *SessionTable) GetExpired() uint64 {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return table.expired
+}
+
+func (table *SessionTable) GetEvicted() uint64 {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return table.evicted
+}
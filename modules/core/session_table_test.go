@@ -0,0 +1,182 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTable(t *testing.T) {
+
+	t.Parallel()
+
+	table := CreateSessionTable(10*time.Second, 100)
+
+	start := time.Unix(1000, 0)
+
+	var sessionA [SessionIdBytes]byte
+	var sessionB [SessionIdBytes]byte
+	RandomBytes_InPlace(sessionA[:])
+	RandomBytes_InPlace(sessionB[:])
+
+	assert.Nil(t, table.Get(sessionA))
+
+	assert.False(t, table.Insert(sessionA, "a", start))
+	assert.False(t, table.Insert(sessionB, "b", start.Add(5*time.Second)))
+	assert.Equal(t, "a", table.Get(sessionA))
+	assert.Equal(t, "b", table.Get(sessionB))
+	assert.Equal(t, 2, table.GetCount())
+
+	// sessions that keep receiving packets don't expire
+
+	table.Touch(sessionA, start.Add(8*time.Second))
+
+	assert.Equal(t, 1, table.Expire(start.Add(16*time.Second)))
+	assert.Equal(t, "a", table.Get(sessionA))
+	assert.Nil(t, table.Get(sessionB))
+	assert.Equal(t, uint64(1), table.GetExpired())
+
+	// idle sessions do
+
+	assert.Equal(t, 1, table.Expire(start.Add(18*time.Second)))
+	assert.Equal(t, 0, table.GetCount())
+	assert.Equal(t, uint64(2), table.GetExpired())
+
+	// removed sessions are gone straight away
+
+	table.Insert(sessionA, "a", start)
+	assert.True(t, table.Remove(sessionA))
+	assert.False(t, table.Remove(sessionA))
+	assert.Nil(t, table.Get(sessionA))
+}
+
+func TestSessionTableEviction(t *testing.T) {
+
+	t.Parallel()
+
+	table := CreateSessionTable(time.Minute, 2)
+
+	currentTime := time.Unix(1000, 0)
+
+	var sessionIds [3][SessionIdBytes]byte
+	for i := range sessionIds {
+		RandomBytes_InPlace(sessionIds[i][:])
+	}
+
+	assert.False(t, table.Insert(sessionIds[0], 0, currentTime))
+	assert.False(t, table.Insert(sessionIds[1], 1, currentTime))
+
+	// touching session 0 makes session 1 the least recently used
+
+	table.Touch(sessionIds[0], currentTime.Add(time.Second))
+
+	assert.True(t, table.Insert(sessionIds[2], 2, currentTime.Add(2*time.Second)))
+	assert.Equal(t, 0, table.Get(sessionIds[0]))
+	assert.Nil(t, table.Get(sessionIds[1]))
+	assert.Equal(t, 2, table.Get(sessionIds[2]))
+	assert.Equal(t, 2, table.GetCount())
+	assert.Equal(t, uint64(1), table.GetEvicted())
+
+	// replacing an existing session doesn't evict
+
+	assert.False(t, table.Insert(sessionIds[2], 3, currentTime.Add(3*time.Second)))
+	assert.Equal(t, 3, table.Get(sessionIds[2]))
+	assert.Equal(t, uint64(1), table.GetEvicted())
+}
+
+func TestSessionTableRemoveCallback(t *testing.T) {
+
+	t.Parallel()
+
+	table := CreateSessionTable(10*time.Second, 2)
+
+	var removed []interface{}
+	table.SetRemoveCallback(func(value interface{}) {
+		removed = append(removed, value)
+	})
+
+	currentTime := time.Unix(1000, 0)
+
+	var sessionIds [4][SessionIdBytes]byte
+	for i := range sessionIds {
+		RandomBytes_InPlace(sessionIds[i][:])
+	}
+
+	table.Insert(sessionIds[0], 0, currentTime)
+	table.Insert(sessionIds[1], 1, currentTime.Add(time.Second))
+	assert.Empty(t, removed)
+
+	// replaced, evicted, removed and expired values are all passed to the callback
+
+	table.Insert(sessionIds[1], 2, currentTime.Add(2*time.Second))
+	assert.Equal(t, []interface{}{1}, removed)
+
+	table.Insert(sessionIds[2], 3, currentTime.Add(3*time.Second))
+	assert.Equal(t, []interface{}{1, 0}, removed)
+
+	table.Remove(sessionIds[2])
+	assert.Equal(t, []interface{}{1, 0, 3}, removed)
+
+	table.Expire(currentTime.Add(time.Minute))
+	assert.Equal(t, []interface{}{1, 0, 3, 2}, removed)
+}
+
+func TestSessionTableForEach(t *testing.T) {
+
+	t.Parallel()
+
+	table := CreateSessionTable(10*time.Second, 100)
+
+	currentTime := time.Unix(1000, 0)
+
+	values := make(map[[SessionIdBytes]byte]interface{})
+	for i := 0; i < 10; i++ {
+		var sessionId [SessionIdBytes]byte
+		RandomBytes_InPlace(sessionId[:])
+		table.Insert(sessionId, i, currentTime)
+		values[sessionId] = i
+	}
+
+	// the table is not locked during the callback, so it may be modified
+
+	visited := make(map[[SessionIdBytes]byte]interface{})
+	table.ForEach(func(sessionId [SessionIdBytes]byte, value interface{}) {
+		visited[sessionId] = value
+		table.Remove(sessionId)
+	})
+
+	assert.Equal(t, values, visited)
+	assert.Equal(t, 0, table.GetCount())
+}
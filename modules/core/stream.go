@@ -0,0 +1,450 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+)
+
+type Stream interface {
+	IsWriting() bool
+	IsReading() bool
+	SerializeBits(value *uint32, bits int)
+	SerializeInteger(value *int32, min int32, max int32)
+	SerializeBool(value *bool)
+	SerializeUint8(value *uint8)
+	SerializeUint16(value *uint16)
+	SerializeUint32(value *uint32)
+	SerializeUint64(value *uint64)
+	SerializeFloat32(value *float32)
+	SerializeFloat64(value *float64)
+	SerializeCompressedFloat(value *float32, min float32, max float32, resolution float32)
+	SerializeCompressedVector3(vector *[3]float32, min float32, max float32, resolution float32)
+	SerializeBytes(data []byte)
+	SerializeString(value *string, maxStringLength int)
+	SerializeAddress(address *net.UDPAddr)
+	SerializeAlign()
+	Flush()
+	GetBytesProcessed() int
+	Error() error
+}
+
+// ---------------------------------------------------------------
+
+type WriteStream struct {
+	writer *BitWriter
+	err    error
+}
+
+func CreateWriteStream(buffer []byte) *WriteStream {
+	return &WriteStream{writer: CreateBitWriter(buffer)}
+}
+
+func (stream *WriteStream) IsWriting() bool {
+	return true
+}
+
+func (stream *WriteStream) IsReading() bool {
+	return false
+}
+
+func (stream *WriteStream) SerializeBits(value *uint32, bits int) {
+	if stream.err != nil {
+		return
+	}
+	if bits < 32 && *value >= uint32(1)<<uint(bits) {
+		stream.err = fmt.Errorf("value %d does not fit in %d bits", *value, bits)
+		return
+	}
+	stream.err = stream.writer.WriteBits(*value, bits)
+}
+
+func (stream *WriteStream) SerializeInteger(value *int32, min int32, max int32) {
+	if stream.err != nil {
+		return
+	}
+	if min >= max {
+		stream.err = fmt.Errorf("invalid integer range [%d,%d]", min, max)
+		return
+	}
+	if *value < min || *value > max {
+		stream.err = fmt.Errorf("integer value %d is outside range [%d,%d]", *value, min, max)
+		return
+	}
+	bits := BitsRequired(0, uint32(int64(max)-int64(min)))
+	stream.err = stream.writer.WriteBits(uint32(int64(*value)-int64(min)), bits)
+}
+
+func (stream *WriteStream) SerializeBool(value *bool) {
+	if stream.err != nil {
+		return
+	}
+	uint32Value := uint32(0)
+	if *value {
+		uint32Value = 1
+	}
+	stream.err = stream.writer.WriteBits(uint32Value, 1)
+}
+
+func (stream *WriteStream) SerializeUint8(value *uint8) {
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.writer.WriteBits(uint32(*value), 8)
+}
+
+func (stream *WriteStream) SerializeUint16(value *uint16) {
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.writer.WriteBits(uint32(*value), 16)
+}
+
+func (stream *WriteStream) SerializeUint32(value *uint32) {
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.writer.WriteBits(*value, 32)
+}
+
+func (stream *WriteStream) SerializeUint64(value *uint64) {
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.writer.WriteBits(uint32(*value), 32)
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.writer.WriteBits(uint32(*value>>32), 32)
+}
+
+func (stream *WriteStream) SerializeFloat32(value *float32) {
+	uint32Value := math.Float32bits(*value)
+	stream.SerializeUint32(&uint32Value)
+}
+
+func (stream *WriteStream) SerializeFloat64(value *float64) {
+	uint64Value := math.Float64bits(*value)
+	stream.SerializeUint64(&uint64Value)
+}
+
+func (stream *WriteStream) SerializeCompressedFloat(value *float32, min float32, max float32, resolution float32) {
+	if stream.err != nil {
+		return
+	}
+	stream.err = WriteCompressedFloat(stream.writer, *value, min, max, resolution)
+}
+
+func (stream *WriteStream) SerializeCompressedVector3(vector *[3]float32, min float32, max float32, resolution float32) {
+	if stream.err != nil {
+		return
+	}
+	stream.err = WriteCompressedVector3(stream.writer, *vector, min, max, resolution)
+}
+
+func (stream *WriteStream) SerializeBytes(data []byte) {
+	stream.SerializeAlign()
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.writer.WriteBytes(data, len(data))
+}
+
+func (stream *WriteStream) SerializeString(value *string, maxStringLength int) {
+	if stream.err != nil {
+		return
+	}
+	stringLength := len(*value)
+	if stringLength > maxStringLength {
+		stream.err = fmt.Errorf("string is too long: %d bytes, max is %d", stringLength, maxStringLength)
+		return
+	}
+	length := int32(stringLength)
+	stream.SerializeInteger(&length, 0, int32(maxStringLength))
+	if stringLength > 0 {
+		stream.SerializeBytes([]byte(*value))
+	}
+}
+
+func (stream *WriteStream) SerializeAddress(address *net.UDPAddr) {
+	var addressData [AddressBytes]byte
+	index := 0
+	if address.IP == nil {
+		WriteAddress(addressData[:], &index, nil)
+	} else {
+		WriteAddress(addressData[:], &index, address)
+	}
+	stream.SerializeBytes(addressData[:])
+}
+
+func (stream *WriteStream) SerializeAlign() {
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.writer.WriteAlign()
+}
+
+func (stream *WriteStream) Flush() {
+	stream.writer.FlushBits()
+}
+
+func (stream *WriteStream) GetBytesProcessed() int {
+	return stream.writer.GetBytesWritten()
+}
+
+func (stream *WriteStream) Error() error {
+	return stream.err
+}
+
+func (stream *WriteStream) GetData() []byte {
+	return stream.writer.GetData()
+}
+
+// ---------------------------------------------------------------
+
+type ReadStream struct {
+	reader *BitReader
+	err    error
+}
+
+func CreateReadStream(buffer []byte) *ReadStream {
+	return &ReadStream{reader: CreateBitReader(buffer)}
+}
+
+func (stream *ReadStream) IsWriting() bool {
+	return false
+}
+
+func (stream *ReadStream) IsReading() bool {
+	return true
+}
+
+func (stream *ReadStream) SerializeBits(value *uint32, bits int) {
+	if stream.err != nil {
+		return
+	}
+	readValue, err := stream.reader.ReadBits(bits)
+	if err != nil {
+		stream.err = err
+		return
+	}
+	*value = readValue
+}
+
+func (stream *ReadStream) SerializeInteger(value *int32, min int32, max int32) {
+	if stream.err != nil {
+		return
+	}
+	if min >= max {
+		stream.err = fmt.Errorf("invalid integer range [%d,%d]", min, max)
+		return
+	}
+	bits := BitsRequired(0, uint32(int64(max)-int64(min)))
+	readValue, err := stream.reader.ReadBits(bits)
+	if err != nil {
+		stream.err = err
+		return
+	}
+	integerValue := int64(readValue) + int64(min)
+	if integerValue > int64(max) {
+		stream.err = fmt.Errorf("integer value %d is outside range [%d,%d]", integerValue, min, max)
+		return
+	}
+	*value = int32(integerValue)
+}
+
+func (stream *ReadStream) SerializeBool(value *bool) {
+	if stream.err != nil {
+		return
+	}
+	readValue, err := stream.reader.ReadBits(1)
+	if err != nil {
+		stream.err = err
+		return
+	}
+	*value = readValue != 0
+}
+
+func (stream *ReadStream) SerializeUint8(value *uint8) {
+	if stream.err != nil {
+		return
+	}
+	readValue, err := stream.reader.ReadBits(8)
+	if err != nil {
+		stream.err = err
+		return
+	}
+	*value = uint8(readValue)
+}
+
+func (stream *ReadStream) SerializeUint16(value *uint16) {
+	if stream.err != nil {
+		return
+	}
+	readValue, err := stream.reader.ReadBits(16)
+	if err != nil {
+		stream.err = err
+		return
+	}
+	*value = uint16(readValue)
+}
+
+func (stream *ReadStream) SerializeUint32(value *uint32) {
+	if stream.err != nil {
+		return
+	}
+	readValue, err := stream.reader.ReadBits(32)
+	if err != nil {
+		stream.err = err
+		return
+	}
+	*value = readValue
+}
+
+func (stream *ReadStream) SerializeUint64(value *uint64) {
+	if stream.err != nil {
+		return
+	}
+	low, err := stream.reader.ReadBits(32)
+	if err != nil {
+		stream.err = err
+		return
+	}
+	high, err := stream.reader.ReadBits(32)
+	if err != nil {
+		stream.err = err
+		return
+	}
+	*value = uint64(high)<<32 | uint64(low)
+}
+
+func (stream *ReadStream) SerializeFloat32(value *float32) {
+	var uint32Value uint32
+	stream.SerializeUint32(&uint32Value)
+	if stream.err != nil {
+		return
+	}
+	*value = math.Float32frombits(uint32Value)
+}
+
+func (stream *ReadStream) SerializeFloat64(value *float64) {
+	var uint64Value uint64
+	stream.SerializeUint64(&uint64Value)
+	if stream.err != nil {
+		return
+	}
+	*value = math.Float64frombits(uint64Value)
+}
+
+func (stream *ReadStream) SerializeCompressedFloat(value *float32, min float32, max float32, resolution float32) {
+	if stream.err != nil {
+		return
+	}
+	stream.err = ReadCompressedFloat(stream.reader, value, min, max, resolution)
+}
+
+func (stream *ReadStream) SerializeCompressedVector3(vector *[3]float32, min float32, max float32, resolution float32) {
+	if stream.err != nil {
+		return
+	}
+	stream.err = ReadCompressedVector3(stream.reader, vector, min, max, resolution)
+}
+
+func (stream *ReadStream) SerializeBytes(data []byte) {
+	stream.SerializeAlign()
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.reader.ReadBytes(data, len(data))
+}
+
+func (stream *ReadStream) SerializeString(value *string, maxStringLength int) {
+	if stream.err != nil {
+		return
+	}
+	var length int32
+	stream.SerializeInteger(&length, 0, int32(maxStringLength))
+	if stream.err != nil {
+		return
+	}
+	if length == 0 {
+		*value = ""
+		return
+	}
+	stringData := make([]byte, length)
+	stream.SerializeBytes(stringData)
+	if stream.err != nil {
+		return
+	}
+	*value = string(stringData)
+}
+
+func (stream *ReadStream) SerializeAddress(address *net.UDPAddr) {
+	var addressData [AddressBytes]byte
+	stream.SerializeBytes(addressData[:])
+	if stream.err != nil {
+		return
+	}
+	switch addressData[0] {
+	case IPAddressNone:
+		*address = net.UDPAddr{}
+	case IPAddressIPv4:
+		*address = net.UDPAddr{IP: net.IPv4(addressData[1], addressData[2], addressData[3], addressData[4]), Port: int(binary.LittleEndian.Uint16(addressData[5:]))}
+	case IPAddressIPv6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addressData[1:17])
+		*address = net.UDPAddr{IP: ip, Port: int(binary.LittleEndian.Uint16(addressData[17:]))}
+	default:
+		stream.err = fmt.Errorf("unknown address type: %d", addressData[0])
+	}
+}
+
+func (stream *ReadStream) SerializeAlign() {
+	if stream.err != nil {
+		return
+	}
+	stream.err = stream.reader.ReadAlign()
+}
+
+func (stream *ReadStream) Flush() {
+}
+
+func (stream *ReadStream) GetBytesProcessed() int {
+	return stream.reader.GetBytesRead()
+}
+
+func (stream *ReadStream) Error() error {
+	return stream.err
+}
@@ -0,0 +1,204 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+type testStreamObject struct {
+	a uint32
+	b int32
+	c bool
+	d uint8
+	e uint16
+	f uint32
+	g uint64
+	h float32
+	i float64
+	j [10]byte
+	k string
+	l net.UDPAddr
+	m net.UDPAddr
+}
+
+func (object *testStreamObject) Serialize(stream Stream) error {
+	stream.SerializeBits(&object.a, 5)
+	stream.SerializeInteger(&object.b, -100, 100)
+	stream.SerializeBool(&object.c)
+	stream.SerializeUint8(&object.d)
+	stream.SerializeUint16(&object.e)
+	stream.SerializeUint32(&object.f)
+	stream.SerializeUint64(&object.g)
+	stream.SerializeFloat32(&object.h)
+	stream.SerializeFloat64(&object.i)
+	stream.SerializeBytes(object.j[:])
+	stream.SerializeString(&object.k, 64)
+	stream.SerializeAddress(&object.l)
+	stream.SerializeAddress(&object.m)
+	stream.Flush()
+	return stream.Error()
+}
+
+func TestStream(t *testing.T) {
+
+	t.Parallel()
+
+	writeObject := testStreamObject{}
+	writeObject.a = 17
+	writeObject.b = -42
+	writeObject.c = true
+	writeObject.d = 200
+	writeObject.e = 60000
+	writeObject.f = 4000000000
+	writeObject.g = 0x0102030405060708
+	writeObject.h = 1.5
+	writeObject.i = 123456.789
+	writeObject.j = [10]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	writeObject.k = "hello world"
+	writeObject.l = *ParseAddress("127.0.0.1:40000")
+	writeObject.m = *ParseAddress("[::1]:50000")
+
+	buffer := make([]byte, 1024)
+
+	writeStream := CreateWriteStream(buffer)
+
+	assert.True(t, writeStream.IsWriting())
+	assert.False(t, writeStream.IsReading())
+	assert.NoError(t, writeObject.Serialize(writeStream))
+
+	readObject := testStreamObject{}
+
+	readStream := CreateReadStream(writeStream.GetData())
+
+	assert.True(t, readStream.IsReading())
+	assert.False(t, readStream.IsWriting())
+	assert.NoError(t, readObject.Serialize(readStream))
+
+	assert.Equal(t, writeObject, readObject)
+	assert.Equal(t, writeStream.GetBytesProcessed(), readStream.GetBytesProcessed())
+
+	// reading a truncated stream fails
+
+	readStream = CreateReadStream(writeStream.GetData()[:20])
+	assert.Error(t, readObject.Serialize(readStream))
+
+	// writing into a buffer that is too small fails
+
+	writeStream = CreateWriteStream(make([]byte, 20))
+	assert.Error(t, writeObject.Serialize(writeStream))
+
+	// writing values out of range fails
+
+	writeObject.b = 1000
+	writeStream = CreateWriteStream(buffer)
+	assert.Error(t, writeObject.Serialize(writeStream))
+}
+
+func TestStreamTokensMatchWriteFunctions(t *testing.T) {
+
+	t.Parallel()
+
+	// challenge token
+
+	challengeToken := ChallengeToken{}
+	challengeToken.ExpireTimestamp = uint64(time.Now().Unix() + 10)
+	challengeToken.ClientAddress = *ParseAddress("127.0.0.1:30000")
+	RandomBytes_InPlace(challengeToken.SessionId[:])
+	challengeToken.Sequence = 10000
+
+	expected := make([]byte, ChallengeTokenBytes)
+	index := 0
+	WriteChallengeToken(expected, &index, &challengeToken)
+
+	writeStream := CreateWriteStream(make([]byte, ChallengeTokenBytes))
+	assert.NoError(t, challengeToken.Serialize(writeStream))
+	assert.Equal(t, expected, writeStream.GetData())
+
+	var readChallengeToken ChallengeToken
+	assert.NoError(t, readChallengeToken.Serialize(CreateReadStream(expected)))
+	assert.Equal(t, challengeToken, readChallengeToken)
+
+	// session token
+
+	sessionToken := SessionToken{}
+	sessionToken.IssueTimestamp = uint64(time.Now().Unix())
+	sessionToken.ExpireTimestamp = uint64(time.Now().Unix() + 20)
+	RandomBytes_InPlace(sessionToken.SessionId[:])
+	RandomBytes_InPlace(sessionToken.UserId[:])
+	sessionToken.EnvelopeUpKbps = 2500
+	sessionToken.EnvelopeDownKbps = 10000
+	sessionToken.PacketsPerSecond = 100
+
+	expected = make([]byte, SessionTokenBytes)
+	index = 0
+	WriteSessionToken(expected, &index, &sessionToken)
+
+	writeStream = CreateWriteStream(make([]byte, SessionTokenBytes))
+	assert.NoError(t, sessionToken.Serialize(writeStream))
+	assert.Equal(t, expected, writeStream.GetData())
+
+	var readSessionToken SessionToken
+	assert.NoError(t, readSessionToken.Serialize(CreateReadStream(expected)))
+	assert.Equal(t, sessionToken, readSessionToken)
+
+	// connect data
+
+	publicKey, privateKey := Keygen_Box()
+
+	connectData := ConnectData{}
+	copy(connectData.ClientPublicKey[:], publicKey)
+	copy(connectData.ClientPrivateKey[:], privateKey)
+	connectData.GatewayAddress = *ParseAddress("127.0.0.1:40000")
+	RandomBytes_InPlace(connectData.GatewayPublicKey[:])
+	connectData.EnvelopeUpKbps = 1000
+	connectData.EnvelopeDownKbps = 2000
+	connectData.PacketsPerSecond = 60
+	connectData.FECDataShards = 4
+	connectData.FECParityShards = 1
+	connectData.ExpireTimestamp = uint64(time.Now().Unix() + 20)
+
+	expected = make([]byte, ConnectDataBytes)
+	index = 0
+	WriteConnectData(expected, &index, &connectData)
+
+	writeStream = CreateWriteStream(make([]byte, ConnectDataBytes))
+	assert.NoError(t, connectData.Serialize(writeStream))
+	assert.Equal(t, expected, writeStream.GetData())
+
+	var readConnectData ConnectData
+	assert.NoError(t, readConnectData.Serialize(CreateReadStream(expected)))
+	assert.Equal(t, connectData, readConnectData)
+}
@@ -0,0 +1,219 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Usage counts the packets and bytes sent up from a client to the server, and down from the server to the client.
+type Usage struct {
+	PacketsUp   uint64 `json:"packets_up"`
+	BytesUp     uint64 `json:"bytes_up"`
+	PacketsDown uint64 `json:"packets_down"`
+	BytesDown   uint64 `json:"bytes_down"`
+}
+
+func (usage *Usage) Add(other Usage) {
+	usage.PacketsUp += other.PacketsUp
+	usage.BytesUp += other.BytesUp
+	usage.PacketsDown += other.PacketsDown
+	usage.BytesDown += other.BytesDown
+}
+
+// UsageCounter counts the usage of one session. The up and down paths run on different threads, so it is atomic.
+type UsageCounter struct {
+	usage Usage
+}
+
+func (counter *UsageCounter) RecordUp(packetBytes int) {
+	atomic.AddUint64(&counter.usage.PacketsUp, 1)
+	atomic.AddUint64(&counter.usage.BytesUp, uint64(packetBytes))
+}
+
+func (counter *UsageCounter) RecordDown(packetBytes int) {
+	atomic.AddUint64(&counter.usage.PacketsDown, 1)
+	atomic.AddUint64(&counter.usage.BytesDown, uint64(packetBytes))
+}
+
+func (counter *UsageCounter) Get() Usage {
+	return Usage{
+		PacketsUp:   atomic.LoadUint64(&counter.usage.PacketsUp),
+		BytesUp:     atomic.LoadUint64(&counter.usage.BytesUp),
+		PacketsDown: atomic.LoadUint64(&counter.usage.PacketsDown),
+		BytesDown:   atomic.LoadUint64(&counter.usage.BytesDown),
+	}
+}
+
+// SessionUsage is the usage of a live session, with its rates over the last aggregation interval.
+type SessionUsage struct {
+	SessionId            string  `json:"session_id"`
+	UserId               string  `json:"user_id"`
+	Usage                Usage   `json:"usage"`
+	PacketsPerSecondUp   float64 `json:"packets_per_second_up"`
+	PacketsPerSecondDown float64 `json:"packets_per_second_down"`
+	KbpsUp               float64 `json:"kbps_up"`
+	KbpsDown             float64 `json:"kbps_down"`
+}
+
+// UserUsage is the total usage of every session a user has had, live or ended.
+type UserUsage struct {
+	UserId   string `json:"user_id"`
+	Sessions int    `json:"sessions"`
+	Usage    Usage  `json:"usage"`
+}
+
+type usageSample struct {
+	userId [UserIdBytes]byte
+	usage  Usage
+}
+
+// UsageAccounting aggregates session usage into per session rates and per user totals.
+// Usage of ended sessions is kept in the user totals, so they only ever go up.
+type UsageAccounting struct {
+	mutex         sync.Mutex
+	samples       map[[SessionIdBytes]byte]usageSample
+	previous      map[[SessionIdBytes]byte]Usage
+	endedUsers    map[[UserIdBytes]byte]Usage
+	endedSessions map[[UserIdBytes]byte]int
+	sessions      []SessionUsage
+	users         []UserUsage
+	lastTime      time.Time
+}
+
+func CreateUsageAccounting() *UsageAccounting {
+	accounting := &UsageAccounting{}
+	accounting.samples = make(map[[SessionIdBytes]byte]usageSample)
+	accounting.previous = make(map[[SessionIdBytes]byte]Usage)
+	accounting.endedUsers = make(map[[UserIdBytes]byte]Usage)
+	accounting.endedSessions = make(map[[UserIdBytes]byte]int)
+	return accounting
+}
+
+// AddSession adds the current usage of a live session to the next aggregation.
+func (accounting *UsageAccounting) AddSession(sessionId [SessionIdBytes]byte, userId [UserIdBytes]byte, usage Usage) {
+	accounting.mutex.Lock()
+	accounting.samples[sessionId] = usageSample{userId: userId, usage: usage}
+	accounting.mutex.Unlock()
+}
+
+// SessionEnded adds the final usage of a session to its user's totals.
+func (accounting *UsageAccounting) SessionEnded(userId [UserIdBytes]byte, usage Usage) {
+	accounting.mutex.Lock()
+	total := accounting.endedUsers[userId]
+	total.Add(usage)
+	accounting.endedUsers[userId] = total
+	accounting.endedSessions[userId]++
+	accounting.mutex.Unlock()
+}
+
+// Aggregate builds the session and user reports from the sessions added since the last
+// aggregation. Rates are averaged over the time since the last aggregation.
+func (accounting *UsageAccounting) Aggregate(currentTime time.Time) {
+
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+
+	seconds := currentTime.Sub(accounting.lastTime).Seconds()
+	if accounting.lastTime.IsZero() || seconds <= 0 {
+		seconds = 0
+	}
+
+	users := make(map[[UserIdBytes]byte]*UserUsage)
+
+	for userId, usage := range accounting.endedUsers {
+		users[userId] = &UserUsage{UserId: IdString(userId[:]), Sessions: accounting.endedSessions[userId], Usage: usage}
+	}
+
+	sessions := make([]SessionUsage, 0, len(accounting.samples))
+	previous := make(map[[SessionIdBytes]byte]Usage, len(accounting.samples))
+
+	for sessionId, sample := range accounting.samples {
+
+		session := SessionUsage{SessionId: IdString(sessionId[:]), UserId: IdString(sample.userId[:]), Usage: sample.usage}
+
+		if last, exists := accounting.previous[sessionId]; exists && seconds > 0 {
+			session.PacketsPerSecondUp = float64(sample.usage.PacketsUp-last.PacketsUp) / seconds
+			session.PacketsPerSecondDown = float64(sample.usage.PacketsDown-last.PacketsDown) / seconds
+			session.KbpsUp = float64(sample.usage.BytesUp-last.BytesUp) * 8 / 1000 / seconds
+			session.KbpsDown = float64(sample.usage.BytesDown-last.BytesDown) * 8 / 1000 / seconds
+		}
+
+		sessions = append(sessions, session)
+		previous[sessionId] = sample.usage
+
+		user := users[sample.userId]
+		if user == nil {
+			user = &UserUsage{UserId: session.UserId}
+			users[sample.userId] = user
+		}
+		user.Sessions++
+		user.Usage.Add(sample.usage)
+	}
+
+	// heaviest sessions and users first, so anomalies are at the top
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].KbpsUp+sessions[i].KbpsDown > sessions[j].KbpsUp+sessions[j].KbpsDown
+	})
+
+	userList := make([]UserUsage, 0, len(users))
+	for _, user := range users {
+		userList = append(userList, *user)
+	}
+	sort.Slice(userList, func(i, j int) bool {
+		return userList[i].Usage.BytesUp+userList[i].Usage.BytesDown > userList[j].Usage.BytesUp+userList[j].Usage.BytesDown
+	})
+
+	accounting.sessions = sessions
+	accounting.users = userList
+	accounting.previous = previous
+	accounting.samples = make(map[[SessionIdBytes]byte]usageSample, len(sessions))
+	accounting.lastTime = currentTime
+}
+
+// GetSessions returns the live sessions as of the last aggregation, highest bandwidth first.
+func (accounting *UsageAccounting) GetSessions() []SessionUsage {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+	return accounting.sessions
+}
+
+// GetUsers returns the user totals as of the last aggregation, highest usage first.
+func (accounting *UsageAccounting) GetUsers() []UserUsage {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+	return accounting.users
+}
@@ -0,0 +1,109 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageCounter(t *testing.T) {
+
+	t.Parallel()
+
+	var counter UsageCounter
+	counter.RecordUp(100)
+	counter.RecordUp(200)
+	counter.RecordDown(1000)
+
+	assert.Equal(t, Usage{PacketsUp: 2, BytesUp: 300, PacketsDown: 1, BytesDown: 1000}, counter.Get())
+}
+
+func TestUsageAccounting(t *testing.T) {
+
+	t.Parallel()
+
+	accounting := CreateUsageAccounting()
+
+	var sessionA, sessionB [SessionIdBytes]byte
+	var userA, userB [UserIdBytes]byte
+	RandomBytes_InPlace(sessionA[:])
+	RandomBytes_InPlace(sessionB[:])
+	RandomBytes_InPlace(userA[:])
+	RandomBytes_InPlace(userB[:])
+
+	currentTime := time.Unix(1000, 0)
+
+	accounting.Aggregate(currentTime)
+	assert.Empty(t, accounting.GetSessions())
+	assert.Empty(t, accounting.GetUsers())
+
+	// rates are not known until a session has been seen in two aggregations
+
+	accounting.AddSession(sessionA, userA, Usage{PacketsUp: 10, BytesUp: 1000, PacketsDown: 10, BytesDown: 1000})
+	accounting.Aggregate(currentTime.Add(10 * time.Second))
+
+	sessions := accounting.GetSessions()
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, IdString(sessionA[:]), sessions[0].SessionId)
+	assert.Equal(t, IdString(userA[:]), sessions[0].UserId)
+	assert.Equal(t, 0.0, sessions[0].KbpsUp)
+
+	accounting.AddSession(sessionA, userA, Usage{PacketsUp: 110, BytesUp: 11000, PacketsDown: 210, BytesDown: 26000})
+	accounting.AddSession(sessionB, userB, Usage{PacketsUp: 1, BytesUp: 100})
+	accounting.Aggregate(currentTime.Add(20 * time.Second))
+
+	sessions = accounting.GetSessions()
+	assert.Equal(t, 2, len(sessions))
+	assert.Equal(t, IdString(sessionA[:]), sessions[0].SessionId)
+	assert.Equal(t, 10.0, sessions[0].PacketsPerSecondUp)
+	assert.Equal(t, 20.0, sessions[0].PacketsPerSecondDown)
+	assert.Equal(t, 8.0, sessions[0].KbpsUp)
+	assert.Equal(t, 20.0, sessions[0].KbpsDown)
+
+	// user totals include sessions that have ended
+
+	accounting.SessionEnded(userA, Usage{PacketsUp: 110, BytesUp: 11000, PacketsDown: 210, BytesDown: 26000})
+	accounting.AddSession(sessionB, userB, Usage{PacketsUp: 2, BytesUp: 200})
+	accounting.Aggregate(currentTime.Add(30 * time.Second))
+
+	sessions = accounting.GetSessions()
+	assert.Equal(t, 1, len(sessions))
+	assert.Equal(t, IdString(sessionB[:]), sessions[0].SessionId)
+
+	users := accounting.GetUsers()
+	assert.Equal(t, 2, len(users))
+	assert.Equal(t, UserUsage{UserId: IdString(userA[:]), Sessions: 1, Usage: Usage{PacketsUp: 110, BytesUp: 11000, PacketsDown: 210, BytesDown: 26000}}, users[0])
+	assert.Equal(t, UserUsage{UserId: IdString(userB[:]), Sessions: 1, Usage: Usage{PacketsUp: 2, BytesUp: 200}}, users[1])
+}
@@ -0,0 +1,121 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import "fmt"
+
+// MinProtocolVersion is the oldest protocol version still read. Gateways accept packets of any protocol
+// version from MinProtocolVersion to ProtocolVersion, and answer each session in the version it sent, so
+// gateways can be upgraded ahead of clients without a flag day. Clients that get a version reject from an
+// older gateway fall back to its version, if they can still speak it.
+const MinProtocolVersion = byte(0)
+
+// ProtocolVersions is the compatibility matrix, with what changed in each protocol version still read.
+var ProtocolVersions = []struct {
+	Version byte
+	Changes string
+}{
+	{0, "the version byte is the packet filter only"},
+	{1, "the protocol version is in the high four bits of the version byte. gateways answer unsupported versions with version rejects"},
+	{2, "client packets have their cipher suite in the packet type byte. gateways answer cipher suites they don't accept with cipher suite rejects"},
+}
+
+// PacketVersion returns the version byte of packets with the protocol version and packet filter.
+func PacketVersion(protocolVersion byte, filter byte) byte {
+	return protocolVersion<<4 | filter&0xF
+}
+
+// PacketFilterVersion returns the packet filter of a packet version byte.
+func PacketFilterVersion(version byte) byte {
+	return version & 0xF
+}
+
+func ProtocolVersionSupported(protocolVersion byte) bool {
+	return protocolVersion >= MinProtocolVersion && protocolVersion <= ProtocolVersion
+}
+
+// PacketVersionSupported returns true if a packet version byte has a protocol version that is still read, and
+// the same packet filter as packetVersion.
+func PacketVersionSupported(version byte, packetVersion byte) bool {
+	return PacketFilterVersion(version) == PacketFilterVersion(packetVersion) && ProtocolVersionSupported(PacketProtocolVersion(version))
+}
+
+// NegotiateProtocolVersion returns the protocol version to speak with a peer that speaks peerVersion, which is
+// the older of the two. It returns false if that version is no longer supported.
+func NegotiateProtocolVersion(peerVersion byte) (byte, bool) {
+	version := min(peerVersion, ProtocolVersion)
+	return version, ProtocolVersionSupported(version)
+}
+
+// Gateways answer packets of another protocol version with a version reject packet, so clients and gateways
+// from mismatched fleets fail loudly instead of timing out. It is much smaller than any packet it answers, and
+// authenticated with the session keys of the packet it answers.
+const VersionRejectPacket = byte(11)
+
+const VersionRejectPacketBytes = VersionBytes + PacketTypeBytes + RejectMACBytes
+
+// PacketProtocolVersion returns the protocol version of a packet version byte.
+func PacketProtocolVersion(version byte) byte {
+	return version >> 4
+}
+
+// WriteVersionRejectPacket writes a version reject packet, with the version byte the gateway speaks.
+func WriteVersionRejectPacket(buffer []byte, version byte, keys *SessionKeys) int {
+	index := 0
+	WriteUint8(buffer, &index, version)
+	WriteUint8(buffer, &index, VersionRejectPacket)
+	RejectMAC(keys, buffer[:index], buffer[index:])
+	return VersionRejectPacketBytes
+}
+
+// ReadVersionRejectPacket returns false if the packet isn't a version reject, or wasn't sent with these keys.
+func ReadVersionRejectPacket(packetData []byte, keys *SessionKeys, protocolVersion *byte) bool {
+	if len(packetData) != VersionRejectPacketBytes || packetData[VersionBytes] != VersionRejectPacket {
+		return false
+	}
+	if !VerifyRejectMAC(keys, packetData[:VersionBytes+PacketTypeBytes], packetData[VersionBytes+PacketTypeBytes:]) {
+		return false
+	}
+	*protocolVersion = PacketProtocolVersion(packetData[0])
+	return true
+}
+
+// ProtocolVersionError is the error a client session closes with when its gateway speaks another protocol version.
+type ProtocolVersionError struct {
+	GatewayAddress  string
+	GatewayVersion  byte
+	ProtocolVersion byte
+}
+
+func (err *ProtocolVersionError) Error() string {
+	return fmt.Sprintf("gateway %s speaks protocol version %d, but this client speaks protocol version %d", err.GatewayAddress, err.GatewayVersion, err.ProtocolVersion)
+}
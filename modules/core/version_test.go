@@ -0,0 +1,233 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketProtocolVersion(t *testing.T) {
+
+	t.Parallel()
+
+	assert.Equal(t, ProtocolVersion, PacketProtocolVersion(PacketVersion_FNV1a))
+	assert.Equal(t, ProtocolVersion, PacketProtocolVersion(PacketVersion_SipHash))
+	assert.NotEqual(t, PacketVersion_FNV1a, PacketVersion_SipHash)
+	assert.Equal(t, byte(0), PacketProtocolVersion(0))
+}
+
+func TestVersionRejectPacket(t *testing.T) {
+
+	t.Parallel()
+
+	sessionId := RandomBytes(SessionIdBytes)
+	keys := DeriveSessionKeys(RandomBytes(SessionKeyBytes), sessionId)
+
+	buffer := make([]byte, VersionRejectPacketBytes)
+	packetBytes := WriteVersionRejectPacket(buffer, 2<<4, &keys)
+	assert.Equal(t, VersionRejectPacketBytes, packetBytes)
+
+	var protocolVersion byte
+	assert.True(t, ReadVersionRejectPacket(buffer[:packetBytes], &keys, &protocolVersion))
+	assert.Equal(t, byte(2), protocolVersion)
+
+	assert.False(t, ReadVersionRejectPacket(buffer[:1], &keys, &protocolVersion))
+	assert.False(t, ReadVersionRejectPacket(append(buffer, 0), &keys, &protocolVersion))
+	assert.False(t, ReadVersionRejectPacket([]byte{PacketVersion_FNV1a, PayloadPacket}, &keys, &protocolVersion))
+
+	// rejects are authenticated, so forged rejects and rejects for other sessions don't read
+
+	otherKeys := DeriveSessionKeys(RandomBytes(SessionKeyBytes), sessionId)
+	assert.False(t, ReadVersionRejectPacket(buffer, &otherKeys, &protocolVersion))
+
+	buffer[0] = 1 << 4
+	assert.False(t, ReadVersionRejectPacket(buffer, &keys, &protocolVersion))
+
+	assert.False(t, ReadVersionRejectPacket([]byte{1 << 4, VersionRejectPacket}, &keys, &protocolVersion))
+}
+
+func TestProtocolVersionError(t *testing.T) {
+
+	t.Parallel()
+
+	err := &ProtocolVersionError{GatewayAddress: "127.0.0.1:40000", GatewayVersion: 2, ProtocolVersion: 1}
+	assert.Equal(t, "gateway 127.0.0.1:40000 speaks protocol version 2, but this client speaks protocol version 1", err.Error())
+}
+
+func TestProtocolVersions(t *testing.T) {
+
+	t.Parallel()
+
+	// the compatibility matrix has every supported version, in order, up to the current one
+
+	assert.Equal(t, int(ProtocolVersion-MinProtocolVersion)+1, len(ProtocolVersions))
+	for i, version := range ProtocolVersions {
+		assert.Equal(t, MinProtocolVersion+byte(i), version.Version)
+		assert.True(t, ProtocolVersionSupported(version.Version))
+		assert.NotEmpty(t, version.Changes)
+	}
+	assert.False(t, ProtocolVersionSupported(ProtocolVersion+1))
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+
+	t.Parallel()
+
+	for _, version := range ProtocolVersions {
+		negotiated, ok := NegotiateProtocolVersion(version.Version)
+		assert.True(t, ok)
+		assert.Equal(t, version.Version, negotiated)
+	}
+
+	negotiated, ok := NegotiateProtocolVersion(ProtocolVersion + 1)
+	assert.True(t, ok)
+	assert.Equal(t, ProtocolVersion, negotiated)
+}
+
+func TestPacketVersionSupported(t *testing.T) {
+
+	t.Parallel()
+
+	assert.Equal(t, PacketVersion_FNV1a, PacketVersion(ProtocolVersion, PacketFilter_FNV1a))
+	assert.Equal(t, PacketVersion_SipHash, PacketVersion(ProtocolVersion, PacketFilter_SipHash))
+
+	for _, version := range ProtocolVersions {
+		assert.True(t, PacketVersionSupported(PacketVersion(version.Version, PacketFilter_FNV1a), PacketVersion_FNV1a))
+		assert.True(t, PacketVersionSupported(PacketVersion(version.Version, PacketFilter_SipHash), PacketVersion_SipHash))
+		assert.False(t, PacketVersionSupported(PacketVersion(version.Version, PacketFilter_SipHash), PacketVersion_FNV1a))
+	}
+	assert.False(t, PacketVersionSupported(PacketVersion(ProtocolVersion+1, PacketFilter_FNV1a), PacketVersion_FNV1a))
+}
+
+// the fixtures in testdata/protocol are test vectors written by older protocol versions. they must still get
+// through the packet filters and read, so old clients keep working with new gateways
+
+type protocolFixture struct {
+	Name         string `json:"name"`
+	Version      byte   `json:"version"`
+	Magic        string `json:"magic"`
+	FilterKey    string `json:"filter_key"`
+	FromAddress  string `json:"from_address"`
+	ToAddress    string `json:"to_address"`
+	PacketLength int    `json:"packet_length"`
+	Chonkle      string `json:"chonkle"`
+	Pittle       string `json:"pittle"`
+	SessionId    string `json:"session_id"`
+	Sequence     uint64 `json:"sequence"`
+	PayloadBytes int    `json:"payload_bytes"`
+	Prefix       string `json:"prefix"`
+	Header       string `json:"header"`
+}
+
+func readProtocolFixtures(t *testing.T, filename string) []protocolFixture {
+	data, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	var file struct {
+		Vectors []protocolFixture `json:"vectors"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &file))
+	assert.NotEmpty(t, file.Vectors)
+	return file.Vectors
+}
+
+func decodeHex(t *testing.T, value string) []byte {
+	data, err := hex.DecodeString(value)
+	assert.Nil(t, err)
+	return data
+}
+
+func filterProtocolFixture(t *testing.T, fixture *protocolFixture, packetData []byte) bool {
+	from := ParseAddress(fixture.FromAddress)
+	to := ParseAddress(fixture.ToAddress)
+	var fromAddressData, toAddressData [MaxAddressDataBytes]byte
+	var fromPort, toPort uint16
+	fromBytes := GetAddressData(from, fromAddressData[:], &fromPort)
+	toBytes := GetAddressData(to, toAddressData[:], &toPort)
+	magic := make([]byte, MagicBytes)
+	if fixture.Magic != "" {
+		magic = decodeHex(t, fixture.Magic)
+	}
+	packet := FilterPacket{
+		Data:            packetData,
+		From:            from,
+		Magic:           magic,
+		FromAddressData: fromAddressData[:fromBytes],
+		FromAddressPort: fromPort,
+		ToAddressData:   toAddressData[:toBytes],
+		ToAddressPort:   toPort,
+		FilterKey:       decodeHex(t, fixture.FilterKey),
+	}
+	return CreateFilterChain(BasicFilter{}, AdvancedFilter{}).Filter(&packet)
+}
+
+func TestProtocolV0Filter(t *testing.T) {
+
+	t.Parallel()
+
+	for _, fixture := range readProtocolFixtures(t, "testdata/protocol/v0/packet_filter.json") {
+		packetData := make([]byte, fixture.PacketLength)
+		packetData[0] = fixture.Version
+		copy(packetData[VersionBytes+PacketTypeBytes:], decodeHex(t, fixture.Chonkle))
+		copy(packetData[fixture.PacketLength-PittleBytes:], decodeHex(t, fixture.Pittle))
+
+		assert.Equal(t, byte(0), PacketProtocolVersion(fixture.Version), fixture.Name)
+		assert.True(t, PacketVersionSupported(fixture.Version, PacketVersion(ProtocolVersion, fixture.Version)), fixture.Name)
+		assert.True(t, filterProtocolFixture(t, &fixture, packetData), fixture.Name)
+	}
+}
+
+func TestProtocolV0ClientPacket(t *testing.T) {
+
+	t.Parallel()
+
+	for _, fixture := range readProtocolFixtures(t, "testdata/protocol/v0/packet_header.json") {
+		packetData := decodeHex(t, fixture.Prefix)
+		packetData = append(packetData, decodeHex(t, fixture.Header)...)
+		packetData = append(packetData, make([]byte, fixture.PayloadBytes+HMACBytes_Box)...)
+		packetData = append(packetData, decodeHex(t, fixture.Pittle)...)
+		assert.Equal(t, PrefixBytes+HeaderBytes+fixture.PayloadBytes+PostfixBytes, len(packetData), fixture.Name)
+
+		var clientPacket ClientPacket
+		assert.True(t, ReadClientPacket(packetData, &clientPacket), fixture.Name)
+		assert.Equal(t, fixture.Version, clientPacket.Version, fixture.Name)
+		assert.Equal(t, decodeHex(t, fixture.SessionId), clientPacket.SessionId, fixture.Name)
+		assert.Equal(t, fixture.Sequence, clientPacket.Sequence, fixture.Name)
+
+		assert.True(t, PacketVersionSupported(clientPacket.Version, PacketVersion(ProtocolVersion, clientPacket.Version)), fixture.Name)
+		assert.True(t, filterProtocolFixture(t, &fixture, packetData), fixture.Name)
+	}
+}
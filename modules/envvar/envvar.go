@@ -32,22 +32,99 @@
 package envvar
 
 import (
+	"bufio"
 	"encoding/base64"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// NoLimit is the max to pass to GetIntRange and GetDurationRange when there is only a min
+const NoLimit = math.MaxInt
+
+var fileValuesMutex sync.RWMutex
+var fileValues map[string]string
+
+// SetFileValues sets values to use for variables that are not in the environment, usually read from a config
+// file. It returns the previous values.
+func SetFileValues(values map[string]string) map[string]string {
+	fileValuesMutex.Lock()
+	defer fileValuesMutex.Unlock()
+	previous := fileValues
+	fileValues = values
+	return previous
+}
+
+var readValuesMutex sync.Mutex
+var readValues = make(map[string]string)
+
+func lookup(name string) (string, bool) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		fileValuesMutex.RLock()
+		value, ok = fileValues[name]
+		fileValuesMutex.RUnlock()
+	}
+	if ok {
+		readValuesMutex.Lock()
+		readValues[name] = value
+		readValuesMutex.Unlock()
+	}
+	return value, ok
+}
+
+// Values returns every variable read so far that was set, and its value. Variables left at their defaults
+// are not included.
+func Values() map[string]string {
+	readValuesMutex.Lock()
+	defer readValuesMutex.Unlock()
+	values := make(map[string]string, len(readValues))
+	for name, value := range readValues {
+		values[name] = value
+	}
+	return values
+}
+
+// ReadFile reads a file of NAME=VALUE lines, like an env file. Blank lines and lines starting with # are skipped.
+func ReadFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("%s:%d: expected NAME=VALUE", path, line)
+		}
+		values[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
 func Exists(name string) bool {
-	_, ok := os.LookupEnv(name)
+	_, ok := lookup(name)
 	return ok
 }
 
 func Get(name string, defaultValue string) string {
-	value, ok := os.LookupEnv(name)
+	value, ok := lookup(name)
 	if !ok {
 		return defaultValue
 	}
@@ -56,7 +133,7 @@ func Get(name string, defaultValue string) string {
 }
 
 func GetList(name string, defaultValue []string) []string {
-	valueStrings, ok := os.LookupEnv(name)
+	valueStrings, ok := lookup(name)
 	if !ok {
 		return defaultValue
 	}
@@ -66,12 +143,12 @@ func GetList(name string, defaultValue []string) []string {
 }
 
 func GetInt(name string, defaultValue int) (int, error) {
-	valueString, ok := os.LookupEnv(name)
+	valueString, ok := lookup(name)
 	if !ok {
 		return defaultValue, nil
 	}
 
-	value, err := strconv.ParseInt(valueString, 10, 64)
+	value, err := strconv.ParseInt(valueString, 10, strconv.IntSize)
 	if err != nil {
 		return defaultValue, fmt.Errorf("could not parse value of env var %s as an integer. Value: %s", name, valueString)
 	}
@@ -79,8 +156,22 @@ func GetInt(name string, defaultValue int) (int, error) {
 	return int(value), nil
 }
 
+// GetIntRange is GetInt for values that must be between min and max inclusive.
+func GetIntRange(name string, defaultValue int, min int, max int) (int, error) {
+	value, err := GetInt(name, defaultValue)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	if value < min || value > max {
+		return defaultValue, fmt.Errorf("value of env var %s must be %s. Value: %d", name, describeRange(int64(min), int64(max), func(v int64) string { return strconv.FormatInt(v, 10) }), value)
+	}
+
+	return value, nil
+}
+
 func GetFloat(name string, defaultValue float64) (float64, error) {
-	valueString, ok := os.LookupEnv(name)
+	valueString, ok := lookup(name)
 	if !ok {
 		return defaultValue, nil
 	}
@@ -94,7 +185,7 @@ func GetFloat(name string, defaultValue float64) (float64, error) {
 }
 
 func GetBool(name string, defaultValue bool) (bool, error) {
-	valueString, ok := os.LookupEnv(name)
+	valueString, ok := lookup(name)
 	if !ok {
 		return defaultValue, nil
 	}
@@ -108,7 +199,7 @@ func GetBool(name string, defaultValue bool) (bool, error) {
 }
 
 func GetDuration(name string, defaultValue time.Duration) (time.Duration, error) {
-	valueString, ok := os.LookupEnv(name)
+	valueString, ok := lookup(name)
 	if !ok {
 		return defaultValue, nil
 	}
@@ -121,8 +212,29 @@ func GetDuration(name string, defaultValue time.Duration) (time.Duration, error)
 	return value, nil
 }
 
+// GetDurationRange is GetDuration for values that must be between min and max inclusive.
+func GetDurationRange(name string, defaultValue time.Duration, min time.Duration, max time.Duration) (time.Duration, error) {
+	value, err := GetDuration(name, defaultValue)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	if value < min || (max != NoLimit && value > max) {
+		return defaultValue, fmt.Errorf("value of env var %s must be %s. Value: %s", name, describeRange(int64(min), int64(max), func(v int64) string { return time.Duration(v).String() }), value)
+	}
+
+	return value, nil
+}
+
+func describeRange(min int64, max int64, format func(int64) string) string {
+	if max == NoLimit {
+		return "at least " + format(min)
+	}
+	return fmt.Sprintf("between %s and %s", format(min), format(max))
+}
+
 func GetBase64(name string, defaultValue []byte) ([]byte, error) {
-	valueString, ok := os.LookupEnv(name)
+	valueString, ok := lookup(name)
 	if !ok {
 		return defaultValue, nil
 	}
@@ -136,7 +248,7 @@ func GetBase64(name string, defaultValue []byte) ([]byte, error) {
 }
 
 func GetAddress(name string, defaultValue *net.UDPAddr) (*net.UDPAddr, error) {
-	valueString, ok := os.LookupEnv(name)
+	valueString, ok := lookup(name)
 	if !ok {
 		return defaultValue, nil
 	}
@@ -148,3 +260,26 @@ func GetAddress(name string, defaultValue *net.UDPAddr) (*net.UDPAddr, error) {
 
 	return value, nil
 }
+
+// GetAddressList reads a comma separated list of addresses. An empty value is an empty list.
+func GetAddressList(name string, defaultValue []*net.UDPAddr) ([]*net.UDPAddr, error) {
+	valueString, ok := lookup(name)
+	if !ok {
+		return defaultValue, nil
+	}
+
+	var addresses []*net.UDPAddr
+	for _, item := range strings.Split(valueString, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		address, err := net.ResolveUDPAddr("udp", item)
+		if err != nil {
+			return defaultValue, fmt.Errorf("could not parse value of env var %s as a list of addresses. Bad address: %s", name, item)
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
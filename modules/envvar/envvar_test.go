@@ -0,0 +1,174 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package envvar
+
+import (
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testName = "UDPX_ENVVAR_TEST"
+
+func TestGetIntRange(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		value *string
+		min   int
+		max   int
+		want  int
+		err   string
+	}{
+		{name: "unset", min: 1, max: 10, want: 5},
+		{name: "in range", value: ptr("7"), min: 1, max: 10, want: 7},
+		{name: "min", value: ptr("1"), min: 1, max: 10, want: 1},
+		{name: "max", value: ptr("10"), min: 1, max: 10, want: 10},
+		{name: "below min", value: ptr("0"), min: 1, max: 10, want: 5, err: "must be between 1 and 10"},
+		{name: "above max", value: ptr("11"), min: 1, max: 10, want: 5, err: "must be between 1 and 10"},
+		{name: "no limit", value: ptr(strconv.Itoa(math.MaxInt)), min: 1, max: NoLimit, want: math.MaxInt},
+		{name: "no limit below min", value: ptr("0"), min: 1, max: NoLimit, want: 5, err: "must be at least 1"},
+		{name: "negative", value: ptr("-3"), min: -5, max: 0, want: -3},
+		{name: "not a number", value: ptr("ten"), min: 1, max: 10, want: 5, err: "could not parse"},
+		{name: "float", value: ptr("7.5"), min: 1, max: 10, want: 5, err: "could not parse"},
+		{name: "empty", value: ptr(""), min: 1, max: 10, want: 5, err: "could not parse"},
+		{name: "overflow", value: ptr("92233720368547758070"), min: 1, max: NoLimit, want: 5, err: "could not parse"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, test.value)
+			value, err := GetIntRange(testName, 5, test.min, test.max)
+			assert.Equal(t, test.want, value)
+			checkError(t, test.err, err)
+		})
+	}
+}
+
+func TestGetDurationRange(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		value *string
+		min   time.Duration
+		max   time.Duration
+		want  time.Duration
+		err   string
+	}{
+		{name: "unset", min: time.Second, max: time.Minute, want: 5 * time.Second},
+		{name: "in range", value: ptr("30s"), min: time.Second, max: time.Minute, want: 30 * time.Second},
+		{name: "min", value: ptr("1s"), min: time.Second, max: time.Minute, want: time.Second},
+		{name: "max", value: ptr("1m"), min: time.Second, max: time.Minute, want: time.Minute},
+		{name: "below min", value: ptr("999ms"), min: time.Second, max: time.Minute, want: 5 * time.Second, err: "must be between 1s and 1m0s"},
+		{name: "above max", value: ptr("61s"), min: time.Second, max: time.Minute, want: 5 * time.Second, err: "must be between 1s and 1m0s"},
+		{name: "no limit", value: ptr("8760h"), min: 0, max: NoLimit, want: 8760 * time.Hour},
+		{name: "no limit below min", value: ptr("0s"), min: time.Nanosecond, max: NoLimit, want: 5 * time.Second, err: "must be at least 1ns"},
+		{name: "negative", value: ptr("-1s"), min: 0, max: NoLimit, want: 5 * time.Second, err: "must be at least 0s"},
+		{name: "no unit", value: ptr("30"), min: time.Second, max: time.Minute, want: 5 * time.Second, err: "could not parse"},
+		{name: "not a duration", value: ptr("soon"), min: time.Second, max: time.Minute, want: 5 * time.Second, err: "could not parse"},
+		{name: "empty", value: ptr(""), min: time.Second, max: time.Minute, want: 5 * time.Second, err: "could not parse"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, test.value)
+			value, err := GetDurationRange(testName, 5*time.Second, test.min, test.max)
+			assert.Equal(t, test.want, value)
+			checkError(t, test.err, err)
+		})
+	}
+}
+
+func TestGetAddressList(t *testing.T) {
+
+	defaultValue := []*net.UDPAddr{{IP: net.ParseIP("127.0.0.1"), Port: 40000}}
+
+	tests := []struct {
+		name  string
+		value *string
+		want  []string
+		err   string
+	}{
+		{name: "unset", want: []string{"127.0.0.1:40000"}},
+		{name: "empty", value: ptr(""), want: []string{}},
+		{name: "one", value: ptr("10.0.0.1:40000"), want: []string{"10.0.0.1:40000"}},
+		{name: "several", value: ptr("10.0.0.1:40000,10.0.0.2:40001"), want: []string{"10.0.0.1:40000", "10.0.0.2:40001"}},
+		{name: "spaces and empty items", value: ptr(" 10.0.0.1:40000 , ,10.0.0.2:40001,"), want: []string{"10.0.0.1:40000", "10.0.0.2:40001"}},
+		{name: "ipv6", value: ptr("[::1]:40000"), want: []string{"[::1]:40000"}},
+		{name: "missing port", value: ptr("10.0.0.1:40000,10.0.0.2"), want: []string{"127.0.0.1:40000"}, err: "Bad address: 10.0.0.2"},
+		{name: "bad port", value: ptr("10.0.0.1:port"), want: []string{"127.0.0.1:40000"}, err: "Bad address: 10.0.0.1:port"},
+		{name: "port out of range", value: ptr("10.0.0.1:70000"), want: []string{"127.0.0.1:40000"}, err: "Bad address: 10.0.0.1:70000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setenv(t, test.value)
+			addresses, err := GetAddressList(testName, defaultValue)
+			values := []string{}
+			for _, address := range addresses {
+				values = append(values, address.String())
+			}
+			assert.Equal(t, test.want, values)
+			checkError(t, test.err, err)
+		})
+	}
+}
+
+func ptr(value string) *string {
+	return &value
+}
+
+// setenv sets the test variable, or makes sure it is unset when value is nil
+
+func setenv(t *testing.T, value *string) {
+	t.Setenv(testName, "")
+	if value == nil {
+		os.Unsetenv(testName)
+		return
+	}
+	os.Setenv(testName, *value)
+}
+
+func checkError(t *testing.T, want string, err error) {
+	if want == "" {
+		assert.Nil(t, err)
+		return
+	}
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), want)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Checks are a service's readiness checks: key material is loaded, addresses resolve, stores are reachable.
+// Liveness only says the process is up and serving http, so an outage of a dependency makes the service
+// unready, without it being restarted.
+type Checks struct {
+	mutex   sync.RWMutex
+	timeout time.Duration
+	checks  []check
+}
+
+type check struct {
+	name     string
+	function func() error
+}
+
+// Result is the outcome of one check. Error is empty if the check passed.
+type Result struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the json served by the liveness and readiness endpoints.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks,omitempty"`
+}
+
+const StatusOK = "ok"
+const StatusFailed = "failed"
+
+// CreateChecks creates an empty set of checks. Checks that don't finish within timeout fail.
+func CreateChecks(timeout time.Duration) *Checks {
+	return &Checks{timeout: timeout}
+}
+
+func (checks *Checks) Add(name string, function func() error) {
+	checks.mutex.Lock()
+	defer checks.mutex.Unlock()
+	checks.checks = append(checks.checks, check{name: name, function: function})
+}
+
+// Run runs every check at once, and reports ok if they all passed.
+func (checks *Checks) Run() Report {
+	checks.mutex.RLock()
+	list := checks.checks
+	checks.mutex.RUnlock()
+
+	type outcome struct {
+		index int
+		err   error
+	}
+
+	outcomes := make(chan outcome, len(list))
+	for i := range list {
+		go func(index int, function func() error) {
+			outcomes <- outcome{index: index, err: function()}
+		}(i, list[i].function)
+	}
+
+	report := Report{Status: StatusOK, Checks: make([]Result, len(list))}
+	for i := range list {
+		report.Checks[i] = Result{Name: list[i].name, Status: StatusFailed, Error: "timed out"}
+	}
+
+	timer := time.NewTimer(checks.timeout)
+	defer timer.Stop()
+	for finished := 0; finished < len(list); finished++ {
+		select {
+		case outcome := <-outcomes:
+			result := &report.Checks[outcome.index]
+			if outcome.err != nil {
+				result.Error = outcome.err.Error()
+			} else {
+				result.Status = StatusOK
+				result.Error = ""
+			}
+		case <-timer.C:
+			finished = len(list)
+		}
+	}
+
+	for _, result := range report.Checks {
+		if result.Status != StatusOK {
+			report.Status = StatusFailed
+		}
+	}
+	return report
+}
+
+// LiveHandler serves liveness. It passes as long as the service can answer.
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, Report{Status: StatusOK})
+}
+
+// ReadyHandler serves readiness, with 503 if any check failed.
+func (checks *Checks) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, checks.Run())
+}
+
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&report)
+}
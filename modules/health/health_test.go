@@ -0,0 +1,112 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecks(t *testing.T) {
+	t.Parallel()
+
+	checks := CreateChecks(time.Second)
+	assert.Equal(t, Report{Status: StatusOK, Checks: []Result{}}, checks.Run())
+
+	checks.Add("keys", func() error { return nil })
+	checks.Add("store", func() error { return fmt.Errorf("connection refused") })
+
+	report := checks.Run()
+	assert.Equal(t, StatusFailed, report.Status)
+	assert.Equal(t, []Result{
+		{Name: "keys", Status: StatusOK},
+		{Name: "store", Status: StatusFailed, Error: "connection refused"},
+	}, report.Checks)
+}
+
+func TestChecksTimeout(t *testing.T) {
+	t.Parallel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	checks := CreateChecks(10 * time.Millisecond)
+	checks.Add("keys", func() error { return nil })
+	checks.Add("store", func() error { <-block; return nil })
+
+	report := checks.Run()
+	assert.Equal(t, StatusFailed, report.Status)
+	assert.Equal(t, []Result{
+		{Name: "keys", Status: StatusOK},
+		{Name: "store", Status: StatusFailed, Error: "timed out"},
+	}, report.Checks)
+}
+
+func TestHandlers(t *testing.T) {
+	t.Parallel()
+
+	failing := false
+	checks := CreateChecks(time.Second)
+	checks.Add("store", func() error {
+		if failing {
+			return fmt.Errorf("unreachable")
+		}
+		return nil
+	})
+
+	recorder := httptest.NewRecorder()
+	checks.ReadyHandler(recorder, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var report Report
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, StatusOK, report.Status)
+
+	failing = true
+
+	recorder = httptest.NewRecorder()
+	checks.ReadyHandler(recorder, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.Equal(t, []Result{{Name: "store", Status: StatusFailed, Error: "unreachable"}}, report.Checks)
+
+	recorder = httptest.NewRecorder()
+	LiveHandler(recorder, httptest.NewRequest("GET", "/live", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, recorder.Body.String())
+}
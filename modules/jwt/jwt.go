@@ -0,0 +1,259 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ClockSkew = 30 * time.Second
+const MinRefreshInterval = 10 * time.Second
+
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyId     string `json:"kid"`
+}
+
+type Claims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+	IssuedAt  int64  `json:"iat"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyId   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Verifier checks JWT signatures and expiry. HS256 tokens are checked against
+// a shared secret, RS256 tokens against keys fetched from a JWKS URL.
+type Verifier struct {
+	secret          []byte
+	jwksURL         string
+	refreshInterval time.Duration
+	client          *http.Client
+
+	mutex     sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	lastFetch time.Time
+}
+
+func CreateSecretVerifier(secret []byte) *Verifier {
+	return &Verifier{secret: secret}
+}
+
+func CreateJWKSVerifier(jwksURL string, refreshInterval time.Duration) *Verifier {
+	if refreshInterval < MinRefreshInterval {
+		refreshInterval = MinRefreshInterval
+	}
+	return &Verifier{
+		jwksURL:         jwksURL,
+		refreshInterval: refreshInterval,
+		client:          &http.Client{Timeout: 5 * time.Second},
+		keys:            make(map[string]*rsa.PublicKey),
+	}
+}
+
+func (verifier *Verifier) Verify(token string, currentTime time.Time) (*Claims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header Header
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Algorithm {
+
+	case "HS256":
+		if verifier.secret == nil {
+			return nil, fmt.Errorf("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, verifier.secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+
+	case "RS256":
+		if verifier.jwksURL == "" {
+			return nil, fmt.Errorf("RS256 tokens are not accepted")
+		}
+		publicKey, err := verifier.getKey(header.KeyId, currentTime)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("invalid signature")
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %q", header.Algorithm)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %v", err)
+	}
+
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+
+	if currentTime.Add(-ClockSkew).Unix() > claims.ExpiresAt {
+		return nil, fmt.Errorf("token expired")
+	}
+
+	if claims.NotBefore != 0 && currentTime.Add(ClockSkew).Unix() < claims.NotBefore {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+
+	return &claims, nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (verifier *Verifier) getKey(keyId string, currentTime time.Time) (*rsa.PublicKey, error) {
+
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	publicKey, ok := verifier.keys[keyId]
+
+	stale := currentTime.Sub(verifier.lastFetch) >= verifier.refreshInterval
+	unknown := !ok && currentTime.Sub(verifier.lastFetch) >= MinRefreshInterval
+
+	if stale || unknown {
+		verifier.lastFetch = currentTime
+		keys, err := verifier.fetchKeys()
+		if err != nil {
+			if !ok {
+				return nil, fmt.Errorf("could not fetch jwks: %v", err)
+			}
+		} else {
+			verifier.keys = keys
+			publicKey, ok = keys[keyId]
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", keyId)
+	}
+
+	return publicKey, nil
+}
+
+func (verifier *Verifier) fetchKeys() (map[string]*rsa.PublicKey, error) {
+
+	response, err := verifier.client.Get(verifier.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", response.Status)
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var keySet jsonWebKeySet
+	if err := json.Unmarshal(data, &keySet); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range keySet.Keys {
+		if key.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		keys[key.KeyId] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	}
+
+	return keys, nil
+}
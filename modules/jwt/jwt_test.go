@@ -0,0 +1,173 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeSegment(t *testing.T, value interface{}) string {
+	data, err := json.Marshal(value)
+	assert.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(t *testing.T, secret []byte, claims Claims) string {
+	signed := encodeSegment(t, Header{Algorithm: "HS256"}) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, privateKey *rsa.PrivateKey, keyId string, claims Claims) string {
+	signed := encodeSegment(t, Header{Algorithm: "RS256", KeyId: keyId}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifySecret(t *testing.T) {
+
+	t.Parallel()
+
+	secret := []byte("secret")
+	verifier := CreateSecretVerifier(secret)
+
+	currentTime := time.Now()
+
+	claims := Claims{Subject: "user", ExpiresAt: currentTime.Add(time.Minute).Unix()}
+
+	result, err := verifier.Verify(signHS256(t, secret, claims), currentTime)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", result.Subject)
+
+	// wrong secret
+
+	_, err = verifier.Verify(signHS256(t, []byte("wrong"), claims), currentTime)
+	assert.Error(t, err)
+
+	// expired, allowing for clock skew
+
+	_, err = verifier.Verify(signHS256(t, secret, claims), currentTime.Add(time.Minute+ClockSkew+time.Second))
+	assert.Error(t, err)
+
+	// not valid yet
+
+	early := claims
+	early.NotBefore = currentTime.Add(time.Hour).Unix()
+	_, err = verifier.Verify(signHS256(t, secret, early), currentTime)
+	assert.Error(t, err)
+
+	// missing subject or expiry
+
+	_, err = verifier.Verify(signHS256(t, secret, Claims{ExpiresAt: claims.ExpiresAt}), currentTime)
+	assert.Error(t, err)
+
+	_, err = verifier.Verify(signHS256(t, secret, Claims{Subject: "user"}), currentTime)
+	assert.Error(t, err)
+
+	// unsigned tokens and garbage are rejected
+
+	unsigned := encodeSegment(t, Header{Algorithm: "none"}) + "." + encodeSegment(t, claims) + "."
+	_, err = verifier.Verify(unsigned, currentTime)
+	assert.Error(t, err)
+
+	_, err = verifier.Verify("not a token", currentTime)
+	assert.Error(t, err)
+}
+
+func TestVerifyJWKS(t *testing.T) {
+
+	t.Parallel()
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		e := big.NewInt(int64(privateKey.PublicKey.E)).Bytes()
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"key1","n":"%s","e":"%s"}]}`,
+			base64.RawURLEncoding.EncodeToString(privateKey.PublicKey.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(e))
+	}))
+	defer server.Close()
+
+	verifier := CreateJWKSVerifier(server.URL, time.Hour)
+
+	currentTime := time.Now()
+
+	claims := Claims{Subject: "user", ExpiresAt: currentTime.Add(time.Minute).Unix()}
+
+	result, err := verifier.Verify(signRS256(t, privateKey, "key1", claims), currentTime)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", result.Subject)
+
+	_, err = verifier.Verify(signRS256(t, privateKey, "key1", claims), currentTime)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+
+	// unknown key ids don't refetch more often than the minimum refresh interval
+
+	_, err = verifier.Verify(signRS256(t, privateKey, "key2", claims), currentTime)
+	assert.Error(t, err)
+	assert.Equal(t, 1, requests)
+
+	// a different key with a known key id fails
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	_, err = verifier.Verify(signRS256(t, otherKey, "key1", claims), currentTime)
+	assert.Error(t, err)
+
+	// HS256 tokens are not accepted by a JWKS verifier
+
+	_, err = verifier.Verify(signHS256(t, []byte("secret"), claims), currentTime)
+	assert.Error(t, err)
+}
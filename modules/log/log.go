@@ -0,0 +1,286 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(level))
+}
+
+func ParseLevel(value string) (Level, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", value)
+}
+
+type Logger struct {
+	mutex      sync.Mutex
+	output     io.Writer
+	level      Level
+	jsonFormat bool
+	service    string
+}
+
+func CreateLogger(output io.Writer, level Level) *Logger {
+	return &Logger{output: output, level: level}
+}
+
+var defaultLogger = CreateLogger(os.Stdout, LevelInfo)
+
+// Default returns the logger used by the package level functions. Its level and format
+// come from LOG_LEVEL (debug, info, warn, error) and LOG_FORMAT (text, json).
+// UDPX_DEBUG_LOGS=1 is still accepted as a shorthand for LOG_LEVEL=debug.
+func Default() *Logger {
+	return defaultLogger
+}
+
+func init() {
+	if value, ok := os.LookupEnv("UDPX_DEBUG_LOGS"); ok && value == "1" {
+		defaultLogger.SetLevel(LevelDebug)
+	}
+	if value, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		level, err := ParseLevel(value)
+		if err != nil {
+			Error("invalid LOG_LEVEL: %v", err)
+		} else {
+			defaultLogger.SetLevel(level)
+		}
+	}
+	if value, ok := os.LookupEnv("LOG_FORMAT"); ok {
+		switch value {
+		case "text":
+		case "json":
+			defaultLogger.SetJSON(true)
+		default:
+			Error("invalid LOG_FORMAT: %q", value)
+		}
+	}
+}
+
+func (logger *Logger) SetLevel(level Level) {
+	logger.mutex.Lock()
+	logger.level = level
+	logger.mutex.Unlock()
+}
+
+func (logger *Logger) GetLevel() Level {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	return logger.level
+}
+
+func (logger *Logger) SetJSON(value bool) {
+	logger.mutex.Lock()
+	logger.jsonFormat = value
+	logger.mutex.Unlock()
+}
+
+// SetService names the service in JSON log lines, so logs can be told apart once aggregated.
+func (logger *Logger) SetService(name string) {
+	logger.mutex.Lock()
+	logger.service = name
+	logger.mutex.Unlock()
+}
+
+func (logger *Logger) Enabled(level Level) bool {
+	return level >= logger.GetLevel()
+}
+
+func (logger *Logger) Debug(format string, params ...interface{}) {
+	logger.write(LevelDebug, 0, format, params...)
+}
+
+func (logger *Logger) Info(format string, params ...interface{}) {
+	logger.write(LevelInfo, 0, format, params...)
+}
+
+func (logger *Logger) Warn(format string, params ...interface{}) {
+	logger.write(LevelWarn, 0, format, params...)
+}
+
+func (logger *Logger) Error(format string, params ...interface{}) {
+	logger.write(LevelError, 0, format, params...)
+}
+
+type jsonLine struct {
+	Time       string `json:"time"`
+	Level      string `json:"level"`
+	Service    string `json:"service,omitempty"`
+	Message    string `json:"message"`
+	Suppressed uint64 `json:"suppressed,omitempty"`
+}
+
+func (logger *Logger) write(level Level, suppressed uint64, format string, params ...interface{}) {
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	if level < logger.level {
+		return
+	}
+
+	message := fmt.Sprintf(format, params...)
+
+	if logger.jsonFormat {
+		data, _ := json.Marshal(jsonLine{
+			Time:       time.Now().UTC().Format(time.RFC3339Nano),
+			Level:      level.String(),
+			Service:    logger.service,
+			Message:    message,
+			Suppressed: suppressed,
+		})
+		logger.output.Write(append(data, '\n'))
+		return
+	}
+
+	switch level {
+	case LevelWarn:
+		message = "warning: " + message
+	case LevelError:
+		message = "error: " + message
+	}
+
+	if suppressed > 0 {
+		message += fmt.Sprintf(" (%d similar messages suppressed)", suppressed)
+	}
+
+	fmt.Fprintln(logger.output, message)
+}
+
+func SetService(name string) {
+	defaultLogger.SetService(name)
+}
+
+func Debug(format string, params ...interface{}) {
+	defaultLogger.write(LevelDebug, 0, format, params...)
+}
+
+func Info(format string, params ...interface{}) {
+	defaultLogger.write(LevelInfo, 0, format, params...)
+}
+
+func Warn(format string, params ...interface{}) {
+	defaultLogger.write(LevelWarn, 0, format, params...)
+}
+
+func Error(format string, params ...interface{}) {
+	defaultLogger.write(LevelError, 0, format, params...)
+}
+
+// RateLimitedLogger logs at most one message per interval, and counts the messages it drops.
+// Use one for each log call in the packet path that could otherwise fire for every packet.
+type RateLimitedLogger struct {
+	logger     *Logger
+	mutex      sync.Mutex
+	interval   time.Duration
+	next       time.Time
+	suppressed uint64
+}
+
+func CreateRateLimitedLogger(logger *Logger, interval time.Duration) *RateLimitedLogger {
+	return &RateLimitedLogger{logger: logger, interval: interval}
+}
+
+func (limited *RateLimitedLogger) Debug(format string, params ...interface{}) {
+	limited.write(LevelDebug, format, params...)
+}
+
+func (limited *RateLimitedLogger) Info(format string, params ...interface{}) {
+	limited.write(LevelInfo, format, params...)
+}
+
+func (limited *RateLimitedLogger) Warn(format string, params ...interface{}) {
+	limited.write(LevelWarn, format, params...)
+}
+
+func (limited *RateLimitedLogger) Error(format string, params ...interface{}) {
+	limited.write(LevelError, format, params...)
+}
+
+func (limited *RateLimitedLogger) GetSuppressed() uint64 {
+	limited.mutex.Lock()
+	defer limited.mutex.Unlock()
+	return limited.suppressed
+}
+
+func (limited *RateLimitedLogger) write(level Level, format string, params ...interface{}) {
+	if !limited.logger.Enabled(level) {
+		return
+	}
+	limited.mutex.Lock()
+	currentTime := time.Now()
+	if currentTime.Before(limited.next) {
+		limited.suppressed++
+		limited.mutex.Unlock()
+		return
+	}
+	limited.next = currentTime.Add(limited.interval)
+	suppressed := limited.suppressed
+	limited.suppressed = 0
+	limited.mutex.Unlock()
+	limited.logger.write(level, suppressed, format, params...)
+}
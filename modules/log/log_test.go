@@ -0,0 +1,132 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevel(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		parsed, err := ParseLevel(level.String())
+		assert.NoError(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	parsed, err := ParseLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, parsed)
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestLoggerText(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+	logger := CreateLogger(&output, LevelInfo)
+
+	logger.Debug("hidden %d", 1)
+	logger.Info("info %d", 2)
+	logger.Warn("warn %d", 3)
+	logger.Error("error %d", 4)
+
+	assert.Equal(t, "info 2\nwarning: warn 3\nerror: error 4\n", output.String())
+
+	output.Reset()
+	logger.SetLevel(LevelError)
+
+	logger.Info("hidden")
+	logger.Error("shown")
+
+	assert.Equal(t, "error: shown\n", output.String())
+	assert.False(t, logger.Enabled(LevelWarn))
+	assert.True(t, logger.Enabled(LevelError))
+}
+
+func TestLoggerJSON(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+	logger := CreateLogger(&output, LevelDebug)
+	logger.SetJSON(true)
+	logger.SetService("gateway")
+
+	logger.Debug("session %s \"quoted\"", "abc")
+
+	var line jsonLine
+	assert.NoError(t, json.Unmarshal(output.Bytes(), &line))
+	assert.Equal(t, "debug", line.Level)
+	assert.Equal(t, "gateway", line.Service)
+	assert.Equal(t, "session abc \"quoted\"", line.Message)
+	assert.Equal(t, uint64(0), line.Suppressed)
+
+	_, err := time.Parse(time.RFC3339Nano, line.Time)
+	assert.NoError(t, err)
+}
+
+func TestRateLimitedLogger(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+	logger := CreateLogger(&output, LevelInfo)
+
+	limited := CreateRateLimitedLogger(logger, 50*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		limited.Error("failed to send packet %d", i)
+	}
+
+	assert.Equal(t, "error: failed to send packet 0\n", output.String())
+	assert.Equal(t, uint64(9), limited.GetSuppressed())
+
+	time.Sleep(60 * time.Millisecond)
+
+	output.Reset()
+	limited.Error("failed to send packet %d", 10)
+
+	assert.Equal(t, "error: failed to send packet 10 (9 similar messages suppressed)\n", output.String())
+	assert.Equal(t, uint64(0), limited.GetSuppressed())
+
+	// messages below the logger level are not counted as suppressed
+
+	limited.Debug("hidden")
+	assert.Equal(t, uint64(0), limited.GetSuppressed())
+}
@@ -0,0 +1,271 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the default histogram buckets for request and round trip latencies, in seconds.
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Get() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+type Gauge struct {
+	value int64
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.value, n)
+}
+
+func (g *Gauge) Get() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		oldBits := atomic.LoadUint64(&h.sumBits)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + value)
+		if atomic.CompareAndSwapUint64(&h.sumBits, oldBits, newBits) {
+			return
+		}
+	}
+}
+
+// ObserveSince records the time elapsed since start, in seconds.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) GetCount() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) GetSum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+type metric struct {
+	name    string
+	family  string
+	labels  string
+	help    string
+	kind    string
+	counter func() uint64
+	write   func(w io.Writer, family string, labels string)
+}
+
+// Registry holds a set of metrics and writes them in the Prometheus text exposition format.
+// Metric names may carry constant labels, eg. `udpx_gateway_packets_forwarded_total{direction="server"}`.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []*metric
+	names   map[string]bool
+}
+
+func CreateRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) Counter(name string, help string) *Counter {
+	counter := &Counter{}
+	r.CounterFunc(name, help, counter.Get)
+	return counter
+}
+
+// CounterFunc registers a counter whose value is read from function at scrape time.
+func (r *Registry) CounterFunc(name string, help string, function func() uint64) {
+	r.register(name, help, "counter", function, func(w io.Writer, family string, labels string) {
+		fmt.Fprintf(w, "%s%s %d\n", family, formatLabels(labels, ""), function())
+	})
+}
+
+func (r *Registry) Gauge(name string, help string) *Gauge {
+	gauge := &Gauge{}
+	r.register(name, help, "gauge", nil, func(w io.Writer, family string, labels string) {
+		fmt.Fprintf(w, "%s%s %d\n", family, formatLabels(labels, ""), gauge.Get())
+	})
+	return gauge
+}
+
+// GaugeFunc registers a gauge whose value is read from function at scrape time.
+func (r *Registry) GaugeFunc(name string, help string, function func() int64) {
+	r.register(name, help, "gauge", nil, func(w io.Writer, family string, labels string) {
+		fmt.Fprintf(w, "%s%s %d\n", family, formatLabels(labels, ""), function())
+	})
+}
+
+func (r *Registry) Histogram(name string, help string, buckets []float64) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("histogram %s buckets are not sorted", name))
+	}
+	histogram := &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.register(name, help, "histogram", nil, func(w io.Writer, family string, labels string) {
+		cumulative := uint64(0)
+		for i, bucket := range histogram.buckets {
+			cumulative += atomic.LoadUint64(&histogram.counts[i])
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family, formatLabels(labels, `le="`+formatFloat(bucket)+`"`), cumulative)
+		}
+		count := histogram.GetCount()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", family, formatLabels(labels, `le="+Inf"`), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", family, formatLabels(labels, ""), formatFloat(histogram.GetSum()))
+		fmt.Fprintf(w, "%s_count%s %d\n", family, formatLabels(labels, ""), count)
+	})
+	return histogram
+}
+
+func (r *Registry) register(name string, help string, kind string, counter func() uint64, write func(w io.Writer, family string, labels string)) {
+	family := name
+	labels := ""
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		if !strings.HasSuffix(name, "}") {
+			panic(fmt.Sprintf("invalid metric name %s", name))
+		}
+		family = name[:i]
+		labels = name[i+1 : len(name)-1]
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	for _, m := range r.metrics {
+		if m.family == family && m.kind != kind {
+			panic(fmt.Sprintf("metric %s is registered as both %s and %s", family, m.kind, kind))
+		}
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, &metric{name: name, family: family, labels: labels, help: help, kind: kind, counter: counter, write: write})
+}
+
+// Write writes all metrics, grouped by family, in the Prometheus text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := make([]*metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.Unlock()
+
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].family < metrics[j].family
+	})
+
+	var buffer bytes.Buffer
+	for i, m := range metrics {
+		if i == 0 || metrics[i-1].family != m.family {
+			fmt.Fprintf(&buffer, "# HELP %s %s\n", m.family, m.help)
+			fmt.Fprintf(&buffer, "# TYPE %s %s\n", m.family, m.kind)
+		}
+		m.write(&buffer, m.family, m.labels)
+	}
+
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
+
+// Counters returns the value of every counter, by its name as registered.
+func (r *Registry) Counters() map[string]uint64 {
+	r.mutex.Lock()
+	metrics := make([]*metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.Unlock()
+
+	counters := make(map[string]uint64)
+	for _, m := range metrics {
+		if m.counter != nil {
+			counters[m.name] = m.counter()
+		}
+	}
+	return counters
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+func formatLabels(labels string, extra string) string {
+	if labels != "" && extra != "" {
+		return "{" + labels + "," + extra + "}"
+	}
+	if labels != "" || extra != "" {
+		return "{" + labels + extra + "}"
+	}
+	return ""
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,150 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	t.Parallel()
+
+	registry := CreateRegistry()
+
+	packets := registry.Counter("test_packets_total", "Packets received.")
+	sessions := registry.Gauge("test_sessions_active", "Active sessions.")
+	toServer := registry.Counter(`test_forwarded_total{direction="server"}`, "Packets forwarded.")
+	toClient := registry.Counter(`test_forwarded_total{direction="client"}`, "Packets forwarded.")
+
+	packets.Add(3)
+	packets.Inc()
+	sessions.Add(5)
+	sessions.Add(-2)
+	toServer.Inc()
+	toClient.Add(2)
+
+	var buffer bytes.Buffer
+	assert.NoError(t, registry.Write(&buffer))
+
+	expected := `# HELP test_forwarded_total Packets forwarded.
+# TYPE test_forwarded_total counter
+test_forwarded_total{direction="server"} 1
+test_forwarded_total{direction="client"} 2
+# HELP test_packets_total Packets received.
+# TYPE test_packets_total counter
+test_packets_total 4
+# HELP test_sessions_active Active sessions.
+# TYPE test_sessions_active gauge
+test_sessions_active 3
+`
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestRegistryCounters(t *testing.T) {
+	t.Parallel()
+
+	registry := CreateRegistry()
+
+	packets := registry.Counter("test_packets_total", "Packets received.")
+	registry.Gauge("test_sessions_active", "Active sessions.").Set(7)
+	registry.CounterFunc(`test_forwarded_total{direction="server"}`, "Packets forwarded.", func() uint64 { return 5 })
+	registry.Histogram("test_latency_seconds", "Latency.", LatencyBuckets).Observe(0.1)
+
+	packets.Add(2)
+
+	assert.Equal(t, map[string]uint64{
+		"test_packets_total":                       2,
+		`test_forwarded_total{direction="server"}`: 5,
+	}, registry.Counters())
+}
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+
+	registry := CreateRegistry()
+
+	histogram := registry.Histogram(`test_seconds{handler="a"}`, "Latency.", []float64{0.1, 1})
+
+	histogram.Observe(0.05)
+	histogram.Observe(0.1)
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+
+	assert.Equal(t, uint64(4), histogram.GetCount())
+	assert.InDelta(t, 2.65, histogram.GetSum(), 1e-9)
+
+	var buffer bytes.Buffer
+	assert.NoError(t, registry.Write(&buffer))
+
+	expected := `# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{handler="a",le="0.1"} 2
+test_seconds_bucket{handler="a",le="1"} 3
+test_seconds_bucket{handler="a",le="+Inf"} 4
+test_seconds_sum{handler="a"} 2.65
+test_seconds_count{handler="a"} 4
+`
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	t.Parallel()
+
+	registry := CreateRegistry()
+
+	registry.Counter("test_total", "Test.")
+
+	assert.Panics(t, func() { registry.Counter("test_total", "Test.") })
+	assert.Panics(t, func() { registry.Gauge(`test_total{a="b"}`, "Test.") })
+	assert.Panics(t, func() { registry.Histogram("test_unsorted", "Test.", []float64{1, 0.1}) })
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	registry := CreateRegistry()
+
+	registry.CounterFunc("test_total", "Test.", func() uint64 { return 7 })
+	registry.GaugeFunc("test_active", "Test.", func() int64 { return -2 })
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "text/plain; version=0.0.4", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "test_total 7\n")
+	assert.Contains(t, recorder.Body.String(), "# TYPE test_active gauge\ntest_active -2\n")
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package netio
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUDP(t *testing.T) {
+
+	t.Parallel()
+
+	conn, err := ListenUDP(context.Background(), "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	address := conn.LocalAddr().String()
+
+	// only platforms with ReusePort let a second socket share the port
+
+	other, err := ListenUDP(context.Background(), address)
+	if !ReusePort {
+		assert.NotNil(t, err)
+		return
+	}
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer other.Close()
+
+	// a sender always reaches the same socket
+
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sender.Close()
+
+	received := make(chan *net.UDPConn, 10)
+	for _, socket := range []*net.UDPConn{conn, other} {
+		go func(socket *net.UDPConn) {
+			buffer := make([]byte, 16)
+			socket.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				if _, _, err := socket.ReadFromUDP(buffer); err != nil {
+					return
+				}
+				received <- socket
+			}
+		}(socket)
+	}
+
+	for i := 0; i < 10; i++ {
+		sender.WriteToUDP([]byte("hello"), conn.LocalAddr().(*net.UDPAddr))
+	}
+
+	var first *net.UDPConn
+	for i := 0; i < 10; i++ {
+		select {
+		case socket := <-received:
+			if first == nil {
+				first = socket
+			}
+			assert.Equal(t, first, socket)
+		case <-time.After(time.Second):
+			t.Fatal("packet did not arrive")
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package netio
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/networknext/udpx/modules/pool"
+)
+
+// DefaultSocketBatchSize is how many packets are read or written with each syscall.
+const DefaultSocketBatchSize = 32
+
+// MaxSocketBatchSize is the most messages the kernel accepts in one recvmmsg or sendmmsg call.
+const MaxSocketBatchSize = 1024
+
+type batchPacket struct {
+	data    []byte
+	address *net.UDPAddr
+	buffer  *pool.Buffer
+}
+
+// BatchReader reads packets from a socket a batch at a time with recvmmsg, where the platform supports it,
+// and hands them out one at a time. Each packet is only valid until the batch it came in is used up.
+type BatchReader struct {
+	conn    *net.UDPConn
+	buffers [][]byte
+	packets []batchPacket
+	next    int
+	state   batchReadState
+}
+
+func CreateBatchReader(conn *net.UDPConn, batchSize int, packetBytes int) (*BatchReader, error) {
+	if batchSize < 1 || batchSize > MaxSocketBatchSize {
+		return nil, fmt.Errorf("invalid socket batch size: %d", batchSize)
+	}
+	reader := &BatchReader{}
+	reader.conn = conn
+	reader.buffers = make([][]byte, batchSize)
+	for i := range reader.buffers {
+		reader.buffers[i] = make([]byte, packetBytes)
+	}
+	reader.packets = make([]batchPacket, 0, batchSize)
+	if err := reader.initialize(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// ReadPacket returns the next packet in the current batch, and blocks reading the next batch once it is used up.
+func (reader *BatchReader) ReadPacket() ([]byte, *net.UDPAddr, error) {
+	if reader.next == len(reader.packets) {
+		reader.packets = reader.packets[:0]
+		reader.next = 0
+		if err := reader.readBatch(); err != nil {
+			return nil, nil, err
+		}
+	}
+	packet := reader.packets[reader.next]
+	reader.next++
+	return packet.data, packet.address, nil
+}
+
+// Buffered is how many packets can be read before ReadPacket blocks.
+func (reader *BatchReader) Buffered() int {
+	return len(reader.packets) - reader.next
+}
+
+// BatchWriter queues packets and writes them to a socket a batch at a time with sendmmsg, where the platform
+// supports it. Packet data must not be modified until it has been flushed.
+type BatchWriter struct {
+	conn    *net.UDPConn
+	packets []batchPacket
+	state   batchWriteState
+}
+
+func CreateBatchWriter(conn *net.UDPConn, batchSize int) (*BatchWriter, error) {
+	if batchSize < 1 || batchSize > MaxSocketBatchSize {
+		return nil, fmt.Errorf("invalid socket batch size: %d", batchSize)
+	}
+	writer := &BatchWriter{}
+	writer.conn = conn
+	writer.packets = make([]batchPacket, 0, batchSize)
+	if err := writer.initialize(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// WritePacket queues the packet, and flushes the queue once the batch is full. The error is from the
+// first packet in the batch that could not be sent, which is not necessarily this one.
+func (writer *BatchWriter) WritePacket(data []byte, address *net.UDPAddr) error {
+	writer.packets = append(writer.packets, batchPacket{data: data, address: address})
+	if len(writer.packets) == cap(writer.packets) {
+		return writer.Flush()
+	}
+	return nil
+}
+
+// WriteBuffer queues the first packetBytes of the pooled buffer, and releases the buffer once it has been sent.
+func (writer *BatchWriter) WriteBuffer(buffer *pool.Buffer, packetBytes int, address *net.UDPAddr) error {
+	writer.packets = append(writer.packets, batchPacket{data: buffer.Data[:packetBytes], address: address, buffer: buffer})
+	if len(writer.packets) == cap(writer.packets) {
+		return writer.Flush()
+	}
+	return nil
+}
+
+// Flush sends all queued packets. Packets that fail to send are dropped, and the first error is returned.
+func (writer *BatchWriter) Flush() error {
+	var flushErr error
+	packets := writer.packets
+	for len(packets) > 0 {
+		sent, err := writer.writeBatch(packets)
+		if err != nil {
+			if flushErr == nil {
+				flushErr = err
+			}
+			sent++
+		}
+		packets = packets[sent:]
+	}
+	for i := range writer.packets {
+		if writer.packets[i].buffer != nil {
+			writer.packets[i].buffer.Release()
+		}
+		writer.packets[i] = batchPacket{}
+	}
+	writer.packets = writer.packets[:0]
+	return flushErr
+}
+
+// Queued is how many packets are waiting to be flushed.
+func (writer *BatchWriter) Queued() int {
+	return len(writer.packets)
+}
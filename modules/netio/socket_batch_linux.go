@@ -0,0 +1,394 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package netio
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// the udp segmentation offload socket options from linux/udp.h
+
+const solUDP = 17
+const udpSegment = 103
+const udpGRO = 104
+
+// a gso message can hold at most 64 segments, and must fit in a single udp datagram
+
+const maxGSOSegments = 64
+const maxGSOBytes = 65000
+
+// gro coalesces up to a full udp datagram into each message
+
+const groBufferBytes = 65535
+
+// mmsghdr matches struct mmsghdr. go pads it out to the alignment of the msghdr, just like c does.
+type mmsghdr struct {
+	header unix.Msghdr
+	length uint32
+}
+
+type batchReadState struct {
+	rawConn  syscall.RawConn
+	gro      bool
+	messages []mmsghdr
+	iovecs   []unix.Iovec
+	names    []unix.RawSockaddrAny
+	controls [][]byte
+}
+
+func (reader *BatchReader) initialize() error {
+	rawConn, err := reader.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	state := &reader.state
+	state.rawConn = rawConn
+	state.messages = make([]mmsghdr, len(reader.buffers))
+	state.iovecs = make([]unix.Iovec, len(reader.buffers))
+	state.names = make([]unix.RawSockaddrAny, len(reader.buffers))
+	for i := range reader.buffers {
+		state.iovecs[i].Base = &reader.buffers[i][0]
+		state.iovecs[i].SetLen(len(reader.buffers[i]))
+		state.messages[i].header.Name = (*byte)(unsafe.Pointer(&state.names[i]))
+		state.messages[i].header.Iov = &state.iovecs[i]
+		state.messages[i].header.SetIovlen(1)
+	}
+	return nil
+}
+
+// EnableGRO lets the kernel coalesce packets from the same sender into one message, which the reader splits
+// back into packets. Each buffer in the batch grows to hold a full udp datagram.
+func (reader *BatchReader) EnableGRO() error {
+	state := &reader.state
+	var sockoptErr error
+	err := state.rawConn.Control(func(fd uintptr) {
+		sockoptErr = unix.SetsockoptInt(int(fd), solUDP, udpGRO, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if sockoptErr != nil {
+		return fmt.Errorf("udp gro is not supported: %v", sockoptErr)
+	}
+	state.controls = make([][]byte, len(reader.buffers))
+	for i := range reader.buffers {
+		reader.buffers[i] = make([]byte, groBufferBytes)
+		state.iovecs[i].Base = &reader.buffers[i][0]
+		state.iovecs[i].SetLen(len(reader.buffers[i]))
+		state.controls[i] = make([]byte, unix.CmsgSpace(4))
+	}
+	state.gro = true
+	return nil
+}
+
+func (reader *BatchReader) readBatch() error {
+
+	state := &reader.state
+
+	// the kernel writes back the length of each address and control message, so reset them for every batch
+
+	for i := range state.messages {
+		state.messages[i].header.Namelen = unix.SizeofSockaddrAny
+		if state.gro {
+			state.messages[i].header.Control = &state.controls[i][0]
+			state.messages[i].header.SetControllen(len(state.controls[i]))
+		}
+	}
+
+	var received int
+	var errno syscall.Errno
+
+	err := state.rawConn.Read(func(fd uintptr) bool {
+		for {
+			n, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&state.messages[0])), uintptr(len(state.messages)), 0, 0, 0)
+			if e == unix.EINTR {
+				continue
+			}
+			if e == unix.EAGAIN {
+				return false
+			}
+			received, errno = int(n), e
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return os.NewSyscallError("recvmmsg", errno)
+	}
+
+	// split coalesced messages back into the packets they were made from
+
+	for i := 0; i < received; i++ {
+		messageBytes := int(state.messages[i].length)
+		segmentBytes := messageBytes
+		if state.gro {
+			if groBytes := groSegmentBytes(state.controls[i][:state.messages[i].header.Controllen]); groBytes > 0 && groBytes < messageBytes {
+				segmentBytes = groBytes
+			}
+		}
+		address := udpAddressFromSockaddr(&state.names[i])
+		for offset := 0; ; {
+			end := offset + segmentBytes
+			if end > messageBytes {
+				end = messageBytes
+			}
+			reader.packets = append(reader.packets, batchPacket{data: reader.buffers[i][offset:end], address: address})
+			offset = end
+			if offset >= messageBytes {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func groSegmentBytes(control []byte) int {
+	messages, err := unix.ParseSocketControlMessage(control)
+	if err != nil {
+		return 0
+	}
+	for i := range messages {
+		if messages[i].Header.Level == solUDP && messages[i].Header.Type == udpGRO && len(messages[i].Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&messages[i].Data[0])))
+		}
+	}
+	return 0
+}
+
+type batchWriteState struct {
+	rawConn  syscall.RawConn
+	family   int
+	gso      bool
+	messages []mmsghdr
+	iovecs   []unix.Iovec
+	names    []unix.RawSockaddrAny
+	controls [][]byte
+	segments []int
+}
+
+func (writer *BatchWriter) initialize() error {
+	rawConn, err := writer.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	state := &writer.state
+	state.rawConn = rawConn
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		state.family, sockoptErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+	})
+	if err != nil {
+		return err
+	}
+	if sockoptErr != nil {
+		return sockoptErr
+	}
+	state.messages = make([]mmsghdr, cap(writer.packets))
+	state.iovecs = make([]unix.Iovec, cap(writer.packets))
+	state.names = make([]unix.RawSockaddrAny, cap(writer.packets))
+	state.segments = make([]int, cap(writer.packets))
+	return nil
+}
+
+// EnableGSO sends runs of same sized packets to the same address as a single message, which the kernel
+// or the network card splits back into packets. If the device turns out not to support it, the writer
+// goes back to sending a message per packet.
+func (writer *BatchWriter) EnableGSO() error {
+	state := &writer.state
+	var sockoptErr error
+	err := state.rawConn.Control(func(fd uintptr) {
+		_, sockoptErr = unix.GetsockoptInt(int(fd), solUDP, udpSegment)
+	})
+	if err != nil {
+		return err
+	}
+	if sockoptErr != nil {
+		return fmt.Errorf("udp gso is not supported: %v", sockoptErr)
+	}
+	state.controls = make([][]byte, cap(writer.packets))
+	for i := range state.controls {
+		state.controls[i] = make([]byte, unix.CmsgSpace(2))
+	}
+	state.gso = true
+	return nil
+}
+
+// writeBatch returns how many packets were sent. When the error is set, the first packet that was not sent is the one that failed.
+func (writer *BatchWriter) writeBatch(packets []batchPacket) (int, error) {
+
+	state := &writer.state
+
+	numMessages := 0
+
+	for i := 0; i < len(packets); {
+		segments := 1
+		if state.gso {
+			segments = gsoSegments(packets[i:])
+		}
+		for j := i; j < i+segments; j++ {
+			state.iovecs[j] = unix.Iovec{}
+			if len(packets[j].data) > 0 {
+				state.iovecs[j].Base = &packets[j].data[0]
+				state.iovecs[j].SetLen(len(packets[j].data))
+			}
+		}
+		message := &state.messages[numMessages]
+		*message = mmsghdr{}
+		message.header.Name = (*byte)(unsafe.Pointer(&state.names[numMessages]))
+		message.header.Namelen = sockaddrFromUDPAddress(packets[i].address, state.family, &state.names[numMessages])
+		message.header.Iov = &state.iovecs[i]
+		message.header.SetIovlen(segments)
+		if segments > 1 {
+			control := state.controls[numMessages]
+			header := (*unix.Cmsghdr)(unsafe.Pointer(&control[0]))
+			header.Level = solUDP
+			header.Type = udpSegment
+			header.SetLen(unix.CmsgLen(2))
+			*(*uint16)(unsafe.Pointer(&control[unix.CmsgLen(0)])) = uint16(len(packets[i].data))
+			message.header.Control = &control[0]
+			message.header.SetControllen(len(control))
+		}
+		state.segments[numMessages] = segments
+		numMessages++
+		i += segments
+	}
+
+	var sent int
+	var errno syscall.Errno
+
+	err := state.rawConn.Write(func(fd uintptr) bool {
+		for {
+			n, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&state.messages[0])), uintptr(numMessages), 0, 0, 0)
+			if e == unix.EINTR {
+				continue
+			}
+			if e == unix.EAGAIN {
+				return false
+			}
+			sent, errno = int(n), e
+			return true
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno == unix.EIO && state.gso {
+		// the device can't segment packets, so send them one at a time from now on
+		state.gso = false
+		return 0, nil
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("sendmmsg", errno)
+	}
+
+	sentPackets := 0
+	for i := 0; i < sent; i++ {
+		sentPackets += state.segments[i]
+	}
+
+	return sentPackets, nil
+}
+
+// gsoSegments is how many of the packets can go in one gso message: packets of the same size to the
+// same address, where only the last may be smaller.
+func gsoSegments(packets []batchPacket) int {
+	segmentBytes := len(packets[0].data)
+	if segmentBytes == 0 {
+		return 1
+	}
+	totalBytes := segmentBytes
+	segments := 1
+	for segments < len(packets) && segments < maxGSOSegments {
+		packet := &packets[segments]
+		if len(packet.data) == 0 || len(packet.data) > segmentBytes || totalBytes+len(packet.data) > maxGSOBytes {
+			break
+		}
+		if packet.address.Port != packets[0].address.Port || !packet.address.IP.Equal(packets[0].address.IP) {
+			break
+		}
+		totalBytes += len(packet.data)
+		segments++
+		if len(packet.data) < segmentBytes {
+			break
+		}
+	}
+	return segments
+}
+
+func udpAddressFromSockaddr(name *unix.RawSockaddrAny) *net.UDPAddr {
+	switch name.Addr.Family {
+	case unix.AF_INET:
+		sockaddr := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		port := (*[2]byte)(unsafe.Pointer(&sockaddr.Port))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sockaddr.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+	case unix.AF_INET6:
+		sockaddr := (*unix.RawSockaddrInet6)(unsafe.Pointer(name))
+		port := (*[2]byte)(unsafe.Pointer(&sockaddr.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sockaddr.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+	}
+	return &net.UDPAddr{}
+}
+
+// sockaddrFromUDPAddress writes the address in the form the socket family expects, and returns its length.
+// ipv6 sockets reach ipv4 addresses through ipv4-mapped addresses.
+func sockaddrFromUDPAddress(address *net.UDPAddr, family int, name *unix.RawSockaddrAny) uint32 {
+	if ip := address.IP.To4(); ip != nil && family == unix.AF_INET {
+		sockaddr := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		*sockaddr = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		port := (*[2]byte)(unsafe.Pointer(&sockaddr.Port))
+		port[0], port[1] = byte(address.Port>>8), byte(address.Port)
+		copy(sockaddr.Addr[:], ip)
+		return unix.SizeofSockaddrInet4
+	}
+	sockaddr := (*unix.RawSockaddrInet6)(unsafe.Pointer(name))
+	*sockaddr = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	port := (*[2]byte)(unsafe.Pointer(&sockaddr.Port))
+	port[0], port[1] = byte(address.Port>>8), byte(address.Port)
+	copy(sockaddr.Addr[:], address.IP.To16())
+	return unix.SizeofSockaddrInet6
+}
@@ -0,0 +1,77 @@
+//go:build !linux
+// +build !linux
+
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package netio
+
+import "fmt"
+
+// other platforms have no recvmmsg or sendmmsg, so batches are read one packet at a time and written a packet per syscall
+
+type batchReadState struct{}
+
+func (reader *BatchReader) initialize() error {
+	return nil
+}
+
+func (reader *BatchReader) EnableGRO() error {
+	return fmt.Errorf("udp gro is not supported on this platform")
+}
+
+func (reader *BatchReader) readBatch() error {
+	packetBytes, from, err := reader.conn.ReadFromUDP(reader.buffers[0])
+	if err != nil {
+		return err
+	}
+	reader.packets = append(reader.packets, batchPacket{data: reader.buffers[0][:packetBytes], address: from})
+	return nil
+}
+
+type batchWriteState struct{}
+
+func (writer *BatchWriter) initialize() error {
+	return nil
+}
+
+func (writer *BatchWriter) EnableGSO() error {
+	return fmt.Errorf("udp gso is not supported on this platform")
+}
+
+func (writer *BatchWriter) writeBatch(packets []batchPacket) (int, error) {
+	for i := range packets {
+		if _, err := writer.conn.WriteToUDP(packets[i].data, packets[i].address); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
@@ -0,0 +1,249 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package netio
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/pool"
+	"github.com/stretchr/testify/assert"
+)
+
+func listenLoopback(t testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not bind socket: %v", err)
+	}
+	conn.SetReadBuffer(4 * 1024 * 1024)
+	conn.SetWriteBuffer(4 * 1024 * 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	return conn
+}
+
+func TestSocketBatch(t *testing.T) {
+
+	t.Parallel()
+
+	sender := listenLoopback(t)
+	defer sender.Close()
+
+	receiver := listenLoopback(t)
+	defer receiver.Close()
+
+	writer, err := CreateBatchWriter(sender, 16)
+	assert.NoError(t, err)
+
+	reader, err := CreateBatchReader(receiver, 16, 1500)
+	assert.NoError(t, err)
+
+	// packets are only sent once the batch fills up or is flushed
+
+	const NumPackets = 40
+
+	// odd packets come from the pool, and go back to it once sent
+
+	for i := 0; i < NumPackets; i++ {
+		var buffer *pool.Buffer
+		packet := make([]byte, 100+i)
+		if i%2 == 1 {
+			buffer = pool.Get(1500)
+			packet = buffer.Data[:100+i]
+		}
+		for j := range packet {
+			packet[j] = byte(i + j)
+		}
+		if buffer != nil {
+			assert.NoError(t, writer.WriteBuffer(buffer, len(packet), receiver.LocalAddr().(*net.UDPAddr)))
+		} else {
+			assert.NoError(t, writer.WritePacket(packet, receiver.LocalAddr().(*net.UDPAddr)))
+		}
+	}
+
+	assert.Equal(t, NumPackets%16, writer.Queued())
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, 0, writer.Queued())
+
+	for i := 0; i < NumPackets; i++ {
+		packet, from, err := reader.ReadPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, sender.LocalAddr().String(), from.String())
+		assert.Equal(t, 100+i, len(packet))
+		for j := range packet {
+			if packet[j] != byte(i+j) {
+				t.Fatalf("packet %d data mismatch at index %d", i, j)
+			}
+		}
+	}
+
+	assert.Equal(t, 0, reader.Buffered())
+
+	_, err = CreateBatchReader(receiver, 0, 1500)
+	assert.Error(t, err)
+	_, err = CreateBatchWriter(sender, MaxSocketBatchSize+1)
+	assert.Error(t, err)
+}
+
+func TestSocketBatchGSO(t *testing.T) {
+
+	t.Parallel()
+
+	// gso messages go to a receiver with gro, which gets them coalesced, and to one without, which gets them split by the kernel
+
+	sender := listenLoopback(t)
+	defer sender.Close()
+
+	writer, err := CreateBatchWriter(sender, 64)
+	assert.NoError(t, err)
+	if err := writer.EnableGSO(); err != nil {
+		t.Skipf("%v", err)
+	}
+
+	groReceiver := listenLoopback(t)
+	defer groReceiver.Close()
+
+	groReader, err := CreateBatchReader(groReceiver, 4, 1500)
+	assert.NoError(t, err)
+	if err := groReader.EnableGRO(); err != nil {
+		t.Skipf("%v", err)
+	}
+
+	receiver := listenLoopback(t)
+	defer receiver.Close()
+
+	reader, err := CreateBatchReader(receiver, 4, 1500)
+	assert.NoError(t, err)
+
+	// runs of the same size can be segmented, and a shorter packet ends a run
+
+	sizes := []int{1200, 1200, 1200, 1000, 1200, 1200, 800, 800, 800, 800}
+
+	for _, conn := range []*net.UDPConn{groReceiver, receiver} {
+		for i, size := range sizes {
+			packet := make([]byte, size)
+			for j := range packet {
+				packet[j] = byte(i + j)
+			}
+			assert.NoError(t, writer.WritePacket(packet, conn.LocalAddr().(*net.UDPAddr)))
+		}
+	}
+
+	assert.NoError(t, writer.Flush())
+
+	for _, reader := range []*BatchReader{groReader, reader} {
+		for i, size := range sizes {
+			packet, from, err := reader.ReadPacket()
+			assert.NoError(t, err)
+			assert.Equal(t, sender.LocalAddr().String(), from.String())
+			assert.Equal(t, size, len(packet))
+			for j := range packet {
+				if packet[j] != byte(i+j) {
+					t.Fatalf("packet %d data mismatch at index %d", i, j)
+				}
+			}
+		}
+	}
+}
+
+// the benchmarks send a batch of packets over loopback and read them back, one syscall per packet or one per batch
+
+const benchmarkBatchSize = DefaultSocketBatchSize
+const benchmarkPacketBytes = 1200
+
+func BenchmarkSocketPerPacket(b *testing.B) {
+	sender := listenLoopback(b)
+	defer sender.Close()
+	receiver := listenLoopback(b)
+	defer receiver.Close()
+	to := receiver.LocalAddr().(*net.UDPAddr)
+	packet := make([]byte, benchmarkPacketBytes)
+	buffer := make([]byte, 1500)
+	b.SetBytes(benchmarkBatchSize * benchmarkPacketBytes)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < benchmarkBatchSize; i++ {
+			if _, err := sender.WriteToUDP(packet, to); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for i := 0; i < benchmarkBatchSize; i++ {
+			if _, _, err := receiver.ReadFromUDP(buffer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSocketBatched(b *testing.B) {
+	benchmarkSocketBatched(b, false)
+}
+
+func BenchmarkSocketBatchedGSO(b *testing.B) {
+	benchmarkSocketBatched(b, true)
+}
+
+func benchmarkSocketBatched(b *testing.B, gso bool) {
+	sender := listenLoopback(b)
+	defer sender.Close()
+	receiver := listenLoopback(b)
+	defer receiver.Close()
+	to := receiver.LocalAddr().(*net.UDPAddr)
+	writer, err := CreateBatchWriter(sender, benchmarkBatchSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	reader, err := CreateBatchReader(receiver, benchmarkBatchSize, 1500)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if gso {
+		if err := writer.EnableGSO(); err != nil {
+			b.Skip(err)
+		}
+	}
+	packet := make([]byte, benchmarkPacketBytes)
+	b.SetBytes(benchmarkBatchSize * benchmarkPacketBytes)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < benchmarkBatchSize; i++ {
+			if err := writer.WritePacket(packet, to); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for i := 0; i < benchmarkBatchSize; i++ {
+			if _, _, err := reader.ReadPacket(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
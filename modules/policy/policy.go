@@ -0,0 +1,282 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package policy decides whether a user may have a connect token, from a ban list or an allow list kept in a
+// file or a redis set, or by asking a service.
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/redis"
+)
+
+// UserPolicy decides whether a user may have a connect token. It is asked before every connect token is
+// issued, so banned users are turned away at auth instead of reaching a gateway. Ping checks the policy can be
+// consulted, for readiness.
+type UserPolicy interface {
+	Name() string
+	Allow(userId []byte, clientIP net.IP) (bool, error)
+	Ping() error
+}
+
+// UserList is a set of user ids that are either banned, or the only users allowed in.
+type UserList struct {
+	allowList bool
+}
+
+// ParseUserList creates a user list from a mode: "ban" if listed users are banned, or "allow" if only listed
+// users are let in.
+func ParseUserList(mode string) (UserList, error) {
+	if mode != "ban" && mode != "allow" {
+		return UserList{}, fmt.Errorf("unknown mode %q", mode)
+	}
+	return UserList{allowList: mode == "allow"}, nil
+}
+
+func (list UserList) decide(listed bool) bool {
+	return listed == list.allowList
+}
+
+// ParseUserPolicy creates a user policy from a url: file:///path for a file of user ids, one per line,
+// redis://host:port/db?key=name for a redis set of user ids, or http:// and https:// for a service that
+// answers 200 to allow the user and 403 to deny them. mode is "ban" if listed users are banned, or "allow"
+// if only listed users are let in. The service decides for itself, so mode doesn't apply to it.
+func ParseUserPolicy(policyURL string, mode string, timeout time.Duration) (UserPolicy, error) {
+	list, err := ParseUserList(mode)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(policyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		if path == "" {
+			return nil, fmt.Errorf("file policy needs a path")
+		}
+		return CreateFileUserPolicy(path, list)
+	case "redis", "rediss":
+		key := u.Query().Get("key")
+		if key == "" {
+			return nil, fmt.Errorf("redis policy needs a key")
+		}
+		u.RawQuery = ""
+		client, err := redis.CreateClient(u.String(), 8, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return CreateRedisUserPolicy(client, key, list), nil
+	case "http", "https":
+		return CreateHTTPUserPolicy(policyURL, timeout), nil
+	}
+	return nil, fmt.Errorf("unsupported policy %q", u.Scheme)
+}
+
+// FileUserPolicy reads user ids from a file, in hex, one per line. Blank lines and lines starting with #
+// are skipped. The file is read again when it changes, checked at most once a second. If it can't be read
+// again, the last list read is kept and the error is logged, so a bad edit doesn't turn every user away.
+type FileUserPolicy struct {
+	UserList
+	path      string
+	mutex     sync.Mutex
+	users     map[[core.UserIdBytes]byte]bool
+	modTime   time.Time
+	checkTime time.Time
+	loadError string
+}
+
+// CreateFileUserPolicy reads the file once, and fails if it can't, since there is no last list to keep.
+func CreateFileUserPolicy(path string, list UserList) (*FileUserPolicy, error) {
+	policy := &FileUserPolicy{UserList: list, path: path}
+	if err := policy.load(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (policy *FileUserPolicy) Name() string {
+	return "file"
+}
+
+func (policy *FileUserPolicy) Allow(userId []byte, clientIP net.IP) (bool, error) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	if time.Since(policy.checkTime) >= time.Second {
+		policy.checkTime = time.Now()
+		if err := policy.load(); err != nil {
+			if err.Error() != policy.loadError {
+				core.Error("could not read users from %s, keeping the %d users read before: %v", policy.path, len(policy.users), err)
+			}
+			policy.loadError = err.Error()
+		} else {
+			policy.loadError = ""
+		}
+	}
+	var key [core.UserIdBytes]byte
+	copy(key[:], userId)
+	return policy.decide(policy.users[key]), nil
+}
+
+func (policy *FileUserPolicy) Ping() error {
+	_, err := os.Stat(policy.path)
+	return err
+}
+
+func (policy *FileUserPolicy) load() error {
+	info, err := os.Stat(policy.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(policy.modTime) && policy.users != nil {
+		return nil
+	}
+	file, err := os.Open(policy.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	users := make(map[[core.UserIdBytes]byte]bool)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var userId [core.UserIdBytes]byte
+		if err := core.ParseId(strings.ToLower(text), userId[:]); err != nil {
+			return fmt.Errorf("invalid user id on line %d of %s: %v", line, policy.path, err)
+		}
+		users[userId] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	policy.users = users
+	policy.modTime = info.ModTime()
+	core.Info("read %d users from %s", len(users), policy.path)
+	return nil
+}
+
+// Client sends a command to redis, or a server that speaks its protocol. *redis.Client is one.
+type Client interface {
+	Do(args ...string) (interface{}, error)
+}
+
+// RedisUserPolicy checks user ids, in hex, against a redis set, so a fleet of auth services shares one list.
+type RedisUserPolicy struct {
+	UserList
+	client Client
+	key    string
+}
+
+func CreateRedisUserPolicy(client Client, key string, list UserList) *RedisUserPolicy {
+	return &RedisUserPolicy{UserList: list, client: client, key: key}
+}
+
+func (policy *RedisUserPolicy) Name() string {
+	return "redis"
+}
+
+func (policy *RedisUserPolicy) Allow(userId []byte, clientIP net.IP) (bool, error) {
+	reply, err := policy.client.Do("SISMEMBER", policy.key, core.IdString(userId))
+	if err != nil {
+		return false, err
+	}
+	listed, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply to SISMEMBER: %v", reply)
+	}
+	return policy.decide(listed == 1), nil
+}
+
+func (policy *RedisUserPolicy) Ping() error {
+	_, err := policy.client.Do("PING")
+	return err
+}
+
+// HTTPUserPolicy asks a service, with the user id in hex and the client ip as query parameters.
+type HTTPUserPolicy struct {
+	url    string
+	client *http.Client
+}
+
+func CreateHTTPUserPolicy(policyURL string, timeout time.Duration) *HTTPUserPolicy {
+	return &HTTPUserPolicy{url: policyURL, client: &http.Client{Timeout: timeout}}
+}
+
+func (policy *HTTPUserPolicy) Name() string {
+	return "http"
+}
+
+// Ping always passes, since the service can only be asked about a user.
+func (policy *HTTPUserPolicy) Ping() error {
+	return nil
+}
+
+func (policy *HTTPUserPolicy) Allow(userId []byte, clientIP net.IP) (bool, error) {
+	u, err := url.Parse(policy.url)
+	if err != nil {
+		return false, err
+	}
+	query := u.Query()
+	query.Set("user_id", core.IdString(userId))
+	if clientIP != nil {
+		query.Set("client_ip", clientIP.String())
+	}
+	u.RawQuery = query.Encode()
+	response, err := policy.client.Get(u.String())
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return true, nil
+	case http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %d", response.StatusCode)
+}
@@ -0,0 +1,294 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUserPolicy(t *testing.T) {
+
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "users")
+	assert.NoError(t, os.WriteFile(path, nil, 0644))
+
+	policy, err := ParseUserPolicy("file://"+path, "ban", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "file", policy.Name())
+	assert.NoError(t, policy.Ping())
+
+	policy, err = ParseUserPolicy("http://127.0.0.1:1/allow", "ban", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "http", policy.Name())
+
+	_, err = ParseUserPolicy("file://"+path, "maybe", time.Second)
+	assert.Error(t, err)
+
+	_, err = ParseUserPolicy("file://", "ban", time.Second)
+	assert.Error(t, err)
+
+	_, err = ParseUserPolicy("file://"+path+".missing", "ban", time.Second)
+	assert.Error(t, err)
+
+	_, err = ParseUserPolicy("redis://127.0.0.1:6379/0", "ban", time.Second)
+	assert.Error(t, err)
+
+	_, err = ParseUserPolicy("ftp://example.com/users", "ban", time.Second)
+	assert.Error(t, err)
+}
+
+func TestFileUserPolicy(t *testing.T) {
+
+	t.Parallel()
+
+	bannedUserId := core.RandomBytes(core.UserIdBytes)
+	otherUserId := core.RandomBytes(core.UserIdBytes)
+
+	path := filepath.Join(t.TempDir(), "users")
+	assert.NoError(t, os.WriteFile(path, []byte("# banned users\n\n  "+strings.ToUpper(core.IdString(bannedUserId))+"  \n"), 0644))
+
+	banList, err := ParseUserList("ban")
+	assert.NoError(t, err)
+	policy, err := CreateFileUserPolicy(path, banList)
+	assert.NoError(t, err)
+
+	allowed, err := policy.Allow(bannedUserId, nil)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = policy.Allow(otherUserId, nil)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	// with an allow list, only listed users are let in
+
+	allowList, err := ParseUserList("allow")
+	assert.NoError(t, err)
+	policy, err = CreateFileUserPolicy(path, allowList)
+	assert.NoError(t, err)
+
+	allowed, err = policy.Allow(bannedUserId, nil)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = policy.Allow(otherUserId, nil)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	// files with invalid user ids don't load
+
+	assert.NoError(t, os.WriteFile(path, []byte("not a user id\n"), 0644))
+	_, err = CreateFileUserPolicy(path, banList)
+	assert.Error(t, err)
+}
+
+func TestFileUserPolicyReload(t *testing.T) {
+
+	t.Parallel()
+
+	firstUserId := core.RandomBytes(core.UserIdBytes)
+	secondUserId := core.RandomBytes(core.UserIdBytes)
+
+	path := filepath.Join(t.TempDir(), "users")
+	modTime := time.Now().Add(-time.Hour)
+	writeUsers := func(text string) {
+		assert.NoError(t, os.WriteFile(path, []byte(text), 0644))
+		modTime = modTime.Add(time.Minute)
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	writeUsers(core.IdString(firstUserId) + "\n")
+
+	banList, _ := ParseUserList("ban")
+	policy, err := CreateFileUserPolicy(path, banList)
+	assert.NoError(t, err)
+
+	allowed, _ := policy.Allow(firstUserId, nil)
+	assert.False(t, allowed)
+
+	// changes to the file are read at most once a second
+
+	writeUsers(core.IdString(secondUserId) + "\n")
+
+	allowed, _ = policy.Allow(secondUserId, nil)
+	assert.True(t, allowed)
+
+	policy.checkTime = time.Time{}
+
+	allowed, _ = policy.Allow(secondUserId, nil)
+	assert.False(t, allowed)
+	allowed, _ = policy.Allow(firstUserId, nil)
+	assert.True(t, allowed)
+
+	// if the file can't be read again, the last list read is kept instead of turning every user away
+
+	writeUsers(core.IdString(firstUserId) + "\nnot a user id\n")
+	policy.checkTime = time.Time{}
+
+	allowed, err = policy.Allow(secondUserId, nil)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	allowed, err = policy.Allow(firstUserId, nil)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	assert.NoError(t, os.Remove(path))
+	policy.checkTime = time.Time{}
+
+	allowed, err = policy.Allow(secondUserId, nil)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Error(t, policy.Ping())
+
+	// once the file is fixed, it is read again
+
+	writeUsers(core.IdString(firstUserId) + "\n")
+	policy.checkTime = time.Time{}
+
+	allowed, err = policy.Allow(firstUserId, nil)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	allowed, err = policy.Allow(secondUserId, nil)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+	assert.NoError(t, policy.Ping())
+}
+
+// setClient answers SISMEMBER and PING from a map of sets
+type setClient struct {
+	sets map[string]map[string]bool
+	err  error
+}
+
+func (client *setClient) Do(args ...string) (interface{}, error) {
+	if client.err != nil {
+		return nil, client.err
+	}
+	switch args[0] {
+	case "SISMEMBER":
+		if client.sets[args[1]][args[2]] {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "PING":
+		return "PONG", nil
+	}
+	return "OK", nil
+}
+
+func TestRedisUserPolicy(t *testing.T) {
+
+	t.Parallel()
+
+	bannedUserId := core.RandomBytes(core.UserIdBytes)
+	otherUserId := core.RandomBytes(core.UserIdBytes)
+
+	client := &setClient{sets: map[string]map[string]bool{"udpx:banned": {core.IdString(bannedUserId): true}}}
+
+	banList, _ := ParseUserList("ban")
+	policy := CreateRedisUserPolicy(client, "udpx:banned", banList)
+	assert.Equal(t, "redis", policy.Name())
+	assert.NoError(t, policy.Ping())
+
+	allowed, err := policy.Allow(bannedUserId, nil)
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	allowed, err = policy.Allow(otherUserId, nil)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowList, _ := ParseUserList("allow")
+	policy = CreateRedisUserPolicy(client, "udpx:banned", allowList)
+
+	allowed, err = policy.Allow(bannedUserId, nil)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	// errors from redis are passed on, so the caller decides whether to fail open
+
+	client.err = fmt.Errorf("connection refused")
+
+	_, err = policy.Allow(bannedUserId, nil)
+	assert.Error(t, err)
+	assert.Error(t, policy.Ping())
+}
+
+func TestHTTPUserPolicy(t *testing.T) {
+
+	t.Parallel()
+
+	bannedUserId := core.RandomBytes(core.UserIdBytes)
+	brokenUserId := core.RandomBytes(core.UserIdBytes)
+	otherUserId := core.RandomBytes(core.UserIdBytes)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token", r.URL.Query().Get("api_key"))
+		switch r.URL.Query().Get("user_id") {
+		case core.IdString(bannedUserId):
+			w.WriteHeader(http.StatusForbidden)
+		case core.IdString(brokenUserId):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			assert.Equal(t, "203.0.113.7", r.URL.Query().Get("client_ip"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	policy := CreateHTTPUserPolicy(server.URL+"/allow?api_key=token", time.Second)
+	assert.NoError(t, policy.Ping())
+
+	allowed, err := policy.Allow(otherUserId, net.ParseIP("203.0.113.7"))
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = policy.Allow(bannedUserId, net.ParseIP("203.0.113.7"))
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	_, err = policy.Allow(brokenUserId, net.ParseIP("203.0.113.7"))
+	assert.Error(t, err)
+}
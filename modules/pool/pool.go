@@ -0,0 +1,77 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package pool
+
+import "sync"
+
+// classBytes are the sizes of the buffers in each pool. Buffers come from the smallest class that fits,
+// and anything larger than the largest class is allocated without pooling.
+var classBytes = [...]int{256, 2048, 65536}
+
+var pools [len(classBytes)]sync.Pool
+
+func init() {
+	for i := range pools {
+		class := i
+		pools[i].New = func() interface{} {
+			return &Buffer{class: class, memory: make([]byte, classBytes[class])}
+		}
+	}
+}
+
+// Buffer is a packet buffer borrowed from a pool. Its data holds whatever the previous user left in it.
+type Buffer struct {
+	Data   []byte
+	class  int
+	memory []byte
+}
+
+// Get returns a buffer with Data sized to the requested bytes.
+func Get(bytes int) *Buffer {
+	for i := range classBytes {
+		if bytes <= classBytes[i] {
+			buffer := pools[i].Get().(*Buffer)
+			buffer.Data = buffer.memory[:bytes]
+			return buffer
+		}
+	}
+	return &Buffer{Data: make([]byte, bytes), class: -1}
+}
+
+// Release gives the buffer back to its pool. Neither the buffer nor its data may be used afterwards.
+func (buffer *Buffer) Release() {
+	if buffer.class < 0 {
+		return
+	}
+	buffer.Data = nil
+	pools[buffer.class].Put(buffer)
+}
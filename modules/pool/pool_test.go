@@ -0,0 +1,94 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package pool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+
+	t.Parallel()
+
+	// buffers come from the smallest class that fits
+
+	for _, bytes := range []int{0, 1, 256, 257, 1500, 2048, 65536} {
+		buffer := Get(bytes)
+		assert.Equal(t, bytes, len(buffer.Data))
+		for i := range classBytes {
+			if bytes <= classBytes[i] {
+				assert.Equal(t, classBytes[i], cap(buffer.Data))
+				break
+			}
+		}
+		buffer.Release()
+		assert.Nil(t, buffer.Data)
+	}
+
+	// larger buffers are not pooled
+
+	buffer := Get(65537)
+	assert.Equal(t, 65537, len(buffer.Data))
+	buffer.Release()
+	assert.NotNil(t, buffer.Data)
+}
+
+func TestPoolAllocations(t *testing.T) {
+
+	allocations := testing.AllocsPerRun(1000, func() {
+		buffer := Get(1500)
+		buffer.Data[0] = 1
+		buffer.Release()
+	})
+
+	assert.Equal(t, 0.0, allocations)
+}
+
+func BenchmarkPool(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		buffer := Get(1500)
+		buffer.Data[0] = byte(n)
+		buffer.Release()
+	}
+}
+
+func BenchmarkMake(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		buffer := make([]byte, 1500)
+		buffer[0] = byte(n)
+		sink = buffer
+	}
+}
+
+var sink []byte
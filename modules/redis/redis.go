@@ -0,0 +1,365 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultPort = "6379"
+
+// Error is an error reply from the server. The connection is still usable after one.
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+var ErrClosed = errors.New("redis client is closed")
+
+// Client is a minimal client for redis and servers that speak its protocol, like valkey, keydb and
+// dragonfly. Connections are pooled, and made as they are needed.
+//
+// Replies are returned as string (simple and bulk strings), int64, Error, []interface{}, or nil for nil
+// bulk strings and arrays.
+type Client struct {
+	address   string
+	password  string
+	username  string
+	database  int
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mutex  sync.Mutex
+	idle   []*conn
+	closed bool
+
+	maxIdle int
+}
+
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+}
+
+// CreateClient creates a client from a url, redis://[[user]:password@]host[:port][/database], or
+// rediss:// for tls. No connection is made until the first command.
+func CreateClient(redisURL string, maxIdle int, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{maxIdle: maxIdle, timeout: timeout}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		client.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = DefaultPort
+	}
+	client.address = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil {
+		client.username = u.User.Username()
+		client.password, _ = u.User.Password()
+		if client.password == "" {
+			client.password, client.username = client.username, ""
+		}
+	}
+	if database := strings.Trim(u.Path, "/"); database != "" {
+		client.database, err = strconv.Atoi(database)
+		if err != nil || client.database < 0 {
+			return nil, fmt.Errorf("invalid database %q", database)
+		}
+	}
+	return client, nil
+}
+
+func (client *Client) GetAddress() string {
+	return client.address
+}
+
+// Do sends one command and waits for its reply.
+func (client *Client) Do(args ...string) (interface{}, error) {
+	replies, err := client.Pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := replies[0].(Error); ok {
+		return nil, replyErr
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends all the commands before reading any replies. Error replies are returned in place,
+// so one failed command doesn't fail the others, and an error is only returned if the commands could
+// not be sent or their replies read.
+func (client *Client) Pipeline(commands [][]string) ([]interface{}, error) {
+	c, err := client.get()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.pipeline(commands, client.timeout)
+	if err != nil {
+		c.netConn.Close()
+		return nil, err
+	}
+	client.put(c)
+	return replies, nil
+}
+
+// Get returns the value of key, and false if it doesn't exist.
+func (client *Client) Get(key string) (string, bool, error) {
+	reply, err := client.Do("GET", key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("unexpected reply %v", reply)
+	}
+	return value, true, nil
+}
+
+// Set sets key to value, expiring after ttl unless ttl is zero.
+func (client *Client) Set(key string, value string, ttl time.Duration) error {
+	_, err := client.Do(SetCommand(key, value, ttl)...)
+	return err
+}
+
+// SetNX sets key to value only if it doesn't exist yet, and returns whether it was set.
+func (client *Client) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	reply, err := client.Do(append(SetCommand(key, value, ttl), "NX")...)
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// Del deletes keys, and returns how many existed.
+func (client *Client) Del(keys ...string) (int64, error) {
+	reply, err := client.Do(append([]string{"DEL"}, keys...)...)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %v", reply)
+	}
+	return count, nil
+}
+
+func (client *Client) Close() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.closed = true
+	for _, c := range client.idle {
+		c.netConn.Close()
+	}
+	client.idle = nil
+	return nil
+}
+
+func SetCommand(key string, value string, ttl time.Duration) []string {
+	if ttl <= 0 {
+		return []string{"SET", key, value}
+	}
+	return []string{"SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10)}
+}
+
+func (client *Client) get() (*conn, error) {
+	client.mutex.Lock()
+	if client.closed {
+		client.mutex.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(client.idle); n > 0 {
+		c := client.idle[n-1]
+		client.idle = client.idle[:n-1]
+		client.mutex.Unlock()
+		return c, nil
+	}
+	client.mutex.Unlock()
+	return client.dial()
+}
+
+func (client *Client) put(c *conn) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.closed || len(client.idle) >= client.maxIdle {
+		c.netConn.Close()
+		return
+	}
+	client.idle = append(client.idle, c)
+}
+
+func (client *Client) dial() (*conn, error) {
+	dialer := &net.Dialer{Timeout: client.timeout}
+	var netConn net.Conn
+	var err error
+	if client.tlsConfig != nil {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", client.address, client.tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", client.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{netConn: netConn, reader: bufio.NewReader(netConn), writer: bufio.NewWriter(netConn)}
+	var commands [][]string
+	if client.password != "" {
+		if client.username != "" {
+			commands = append(commands, []string{"AUTH", client.username, client.password})
+		} else {
+			commands = append(commands, []string{"AUTH", client.password})
+		}
+	}
+	if client.database != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(client.database)})
+	}
+	if len(commands) > 0 {
+		replies, err := c.pipeline(commands, client.timeout)
+		if err == nil {
+			for _, reply := range replies {
+				if replyErr, ok := reply.(Error); ok {
+					err = replyErr
+				}
+			}
+		}
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *conn) pipeline(commands [][]string, timeout time.Duration) ([]interface{}, error) {
+	if timeout > 0 {
+		c.netConn.SetDeadline(time.Now().Add(timeout))
+	}
+	for _, args := range commands {
+		WriteCommand(c.writer, args)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		reply, err := ReadReply(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// WriteCommand writes a command as an array of bulk strings.
+func WriteCommand(writer *bufio.Writer, args []string) {
+	writer.WriteString("*")
+	writer.WriteString(strconv.Itoa(len(args)))
+	writer.WriteString("\r\n")
+	for _, arg := range args {
+		writer.WriteString("$")
+		writer.WriteString(strconv.Itoa(len(arg)))
+		writer.WriteString("\r\n")
+		writer.WriteString(arg)
+		writer.WriteString("\r\n")
+	}
+}
+
+// ReadReply reads one reply, or one command, since commands are sent as arrays.
+func ReadReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	prefix, value := line[0], line[1:len(line)-2]
+	switch prefix {
+	case '+':
+		return value, nil
+	case '-':
+		return Error(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk string length %q", value)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("malformed array length %q", value)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		array := make([]interface{}, length)
+		for i := range array {
+			if array[i], err = ReadReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", prefix)
+}
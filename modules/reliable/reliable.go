@@ -0,0 +1,370 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package reliable
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+const SequenceBufferSize = 1024
+const MessageQueueSize = 256
+const MaxMessagesPerPacket = 64
+const MaxMessageBytes = 900
+const DefaultResendTime = 100 * time.Millisecond
+
+// packet sequences start high enough that the ack window never reaches below zero
+
+const InitialSequence = 10000
+
+const NumMessagesBytes = 1
+const PacketHeaderBytes = core.SequenceBytes + core.AckBytes + core.AckBitsBytes + NumMessagesBytes
+const MaxMessageHeaderBytes = core.MaxVarint64Bytes + core.MaxVarint32Bytes
+
+type sentPacket struct {
+	sequence   uint64
+	messageIds []uint64
+}
+
+type sendEntry struct {
+	valid    bool
+	id       uint64
+	data     []byte
+	sendTime time.Time
+}
+
+type receiveEntry struct {
+	valid bool
+	id    uint64
+	data  []byte
+}
+
+// Endpoint is one side of a reliable, ordered message channel. Messages are packed
+// into packets with their own sequence numbers and ack vectors, independent of the
+// session packet sequence, and resent until a packet containing them is acked.
+// Received messages are delivered in the order they were sent.
+type Endpoint struct {
+	mutex sync.Mutex
+
+	resendTime time.Duration
+
+	sendSequence    uint64
+	receiveSequence uint64
+	ackPending      bool
+
+	receivedPackets [SequenceBufferSize]uint64
+	ackedPackets    [SequenceBufferSize]uint64
+	sentPackets     [SequenceBufferSize]sentPacket
+
+	nextMessageId   uint64
+	oldestMessageId uint64
+	sendQueue       [MessageQueueSize]sendEntry
+
+	receiveMessageId uint64
+	receiveQueue     [MessageQueueSize]receiveEntry
+
+	resent uint64
+}
+
+func CreateEndpoint(resendTime time.Duration) *Endpoint {
+	endpoint := &Endpoint{}
+	endpoint.resendTime = resendTime
+	endpoint.sendSequence = InitialSequence
+	for i := range endpoint.receivedPackets {
+		endpoint.receivedPackets[i] = ^uint64(0)
+		endpoint.ackedPackets[i] = ^uint64(0)
+		endpoint.sentPackets[i].sequence = ^uint64(0)
+	}
+	return endpoint
+}
+
+// Reset starts over with a new peer, such as the server of a new session. Messages that were never acked
+// are kept, and sent to the new peer in the same order. Messages received out of order and not yet
+// delivered are dropped.
+func (endpoint *Endpoint) Reset() {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	var pending [][]byte
+	for id := endpoint.oldestMessageId; id < endpoint.nextMessageId; id++ {
+		if entry := &endpoint.sendQueue[id%MessageQueueSize]; entry.valid && entry.id == id {
+			pending = append(pending, entry.data)
+		}
+	}
+	endpoint.sendSequence = InitialSequence
+	endpoint.receiveSequence = 0
+	endpoint.ackPending = false
+	for i := range endpoint.receivedPackets {
+		endpoint.receivedPackets[i] = ^uint64(0)
+		endpoint.ackedPackets[i] = ^uint64(0)
+		endpoint.sentPackets[i] = sentPacket{sequence: ^uint64(0)}
+	}
+	endpoint.nextMessageId = 0
+	endpoint.oldestMessageId = 0
+	endpoint.sendQueue = [MessageQueueSize]sendEntry{}
+	endpoint.receiveMessageId = 0
+	endpoint.receiveQueue = [MessageQueueSize]receiveEntry{}
+	for _, data := range pending {
+		entry := &endpoint.sendQueue[endpoint.nextMessageId%MessageQueueSize]
+		entry.valid = true
+		entry.id = endpoint.nextMessageId
+		entry.data = data
+		endpoint.nextMessageId++
+	}
+}
+
+// SendMessage queues a copy of the message to be sent. It fails if the message is
+// too large or if too many messages are waiting to be acked.
+func (endpoint *Endpoint) SendMessage(data []byte) error {
+	if len(data) > MaxMessageBytes {
+		return fmt.Errorf("message is too large: %d bytes, max is %d", len(data), MaxMessageBytes)
+	}
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	if endpoint.nextMessageId-endpoint.oldestMessageId >= MessageQueueSize {
+		return fmt.Errorf("send queue is full")
+	}
+	entry := &endpoint.sendQueue[endpoint.nextMessageId%MessageQueueSize]
+	entry.valid = true
+	entry.id = endpoint.nextMessageId
+	entry.data = append([]byte(nil), data...)
+	entry.sendTime = time.Time{}
+	endpoint.nextMessageId++
+	return nil
+}
+
+// ReceiveMessage returns the next message in order, or nil if it has not arrived yet.
+func (endpoint *Endpoint) ReceiveMessage() []byte {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	entry := &endpoint.receiveQueue[endpoint.receiveMessageId%MessageQueueSize]
+	if !entry.valid || entry.id != endpoint.receiveMessageId {
+		return nil
+	}
+	data := entry.data
+	entry.valid = false
+	entry.data = nil
+	endpoint.receiveMessageId++
+	return data
+}
+
+func (endpoint *Endpoint) messageDue(entry *sendEntry, currentTime time.Time) bool {
+	return entry.valid && (entry.sendTime.IsZero() || currentTime.Sub(entry.sendTime) >= endpoint.resendTime)
+}
+
+// HasPacketToSend is true when there are messages to send or resend, or when
+// packets with messages have been received that we have not acked yet.
+func (endpoint *Endpoint) HasPacketToSend(currentTime time.Time) bool {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	if endpoint.ackPending {
+		return true
+	}
+	for id := endpoint.oldestMessageId; id < endpoint.nextMessageId; id++ {
+		if endpoint.messageDue(&endpoint.sendQueue[id%MessageQueueSize], currentTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// GeneratePacket writes a packet into packetData with acks for received packets and
+// as many due messages as fit, and returns the number of bytes written.
+func (endpoint *Endpoint) GeneratePacket(currentTime time.Time, packetData []byte) int {
+
+	if len(packetData) < PacketHeaderBytes {
+		panic("reliable packet buffer is too small")
+	}
+
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+
+	var ack_bits [core.AckBitsBytes]byte
+	core.GetAckBits(endpoint.receiveSequence, endpoint.receivedPackets[:], ack_bits[:])
+
+	sequence := endpoint.sendSequence
+	endpoint.sendSequence++
+	endpoint.ackPending = false
+
+	index := 0
+	core.WriteUint64(packetData, &index, sequence)
+	core.WriteUint64(packetData, &index, endpoint.receiveSequence)
+	core.WriteBytes(packetData, &index, ack_bits[:], core.AckBitsBytes)
+	numMessagesIndex := index
+	index += NumMessagesBytes
+
+	messageIds := make([]uint64, 0, MaxMessagesPerPacket)
+
+	for id := endpoint.oldestMessageId; id < endpoint.nextMessageId && len(messageIds) < MaxMessagesPerPacket; id++ {
+		entry := &endpoint.sendQueue[id%MessageQueueSize]
+		if !endpoint.messageDue(entry, currentTime) {
+			continue
+		}
+		if index+MaxMessageHeaderBytes+len(entry.data) > len(packetData) {
+			continue
+		}
+		core.WriteVarint64(packetData, &index, entry.id)
+		core.WriteVarint32(packetData, &index, uint32(len(entry.data)))
+		core.WriteBytes(packetData, &index, entry.data, len(entry.data))
+		if !entry.sendTime.IsZero() {
+			endpoint.resent++
+		}
+		entry.sendTime = currentTime
+		messageIds = append(messageIds, entry.id)
+	}
+
+	packetData[numMessagesIndex] = byte(len(messageIds))
+
+	sent := &endpoint.sentPackets[sequence%SequenceBufferSize]
+	sent.sequence = sequence
+	sent.messageIds = messageIds
+
+	return index
+}
+
+// ProcessPacket reads acks and messages from a packet generated by the other endpoint.
+// Duplicate messages and messages too far ahead to buffer are ignored, they will be resent.
+func (endpoint *Endpoint) ProcessPacket(packetData []byte) error {
+
+	index := 0
+
+	var sequence uint64
+	var ack uint64
+	var ack_bits [core.AckBitsBytes]byte
+	var numMessages uint8
+
+	if !core.ReadUint64(packetData, &index, &sequence) ||
+		!core.ReadUint64(packetData, &index, &ack) ||
+		!core.ReadBytes(packetData, &index, ack_bits[:], core.AckBitsBytes) ||
+		!core.ReadUint8(packetData, &index, &numMessages) {
+		return fmt.Errorf("reliable packet is too small")
+	}
+
+	if numMessages > MaxMessagesPerPacket {
+		return fmt.Errorf("too many messages in reliable packet: %d", numMessages)
+	}
+
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+
+	// process acks
+
+	var ackBuffer [core.AckBitsBytes * 8]uint64
+
+	acks := core.ProcessAcks(ack, ack_bits[:], endpoint.ackedPackets[:], ackBuffer[:])
+
+	for i := range acks {
+		endpoint.ackedPackets[acks[i]%SequenceBufferSize] = acks[i]
+		sent := &endpoint.sentPackets[acks[i]%SequenceBufferSize]
+		if sent.sequence != acks[i] {
+			continue
+		}
+		for _, id := range sent.messageIds {
+			entry := &endpoint.sendQueue[id%MessageQueueSize]
+			if entry.valid && entry.id == id {
+				entry.valid = false
+				entry.data = nil
+			}
+		}
+		sent.messageIds = nil
+	}
+
+	for endpoint.oldestMessageId < endpoint.nextMessageId && !endpoint.sendQueue[endpoint.oldestMessageId%MessageQueueSize].valid {
+		endpoint.oldestMessageId++
+	}
+
+	// read messages
+
+	for i := 0; i < int(numMessages); i++ {
+
+		var id uint64
+		var messageBytes uint32
+
+		if !core.ReadVarint64(packetData, &index, &id) || !core.ReadVarint32(packetData, &index, &messageBytes) {
+			return fmt.Errorf("invalid reliable message header")
+		}
+
+		if messageBytes > MaxMessageBytes {
+			return fmt.Errorf("reliable message is too large: %d bytes", messageBytes)
+		}
+
+		var data []byte
+		if !core.ReadBytesRef(packetData, &index, &data, int(messageBytes)) {
+			return fmt.Errorf("reliable message is truncated")
+		}
+
+		if id < endpoint.receiveMessageId || id >= endpoint.receiveMessageId+MessageQueueSize {
+			continue
+		}
+
+		entry := &endpoint.receiveQueue[id%MessageQueueSize]
+		if entry.valid && entry.id == id {
+			continue
+		}
+
+		entry.valid = true
+		entry.id = id
+		entry.data = append([]byte(nil), data...)
+	}
+
+	// only mark the packet received once it has been read successfully, so it gets acked
+
+	if sequence > endpoint.receiveSequence {
+		endpoint.receiveSequence = sequence
+	}
+
+	endpoint.receivedPackets[sequence%SequenceBufferSize] = sequence
+
+	// packets that only carry acks don't need to be acked themselves
+
+	if numMessages > 0 {
+		endpoint.ackPending = true
+	}
+
+	return nil
+}
+
+// GetPendingMessages returns the number of sent messages that have not been acked yet.
+func (endpoint *Endpoint) GetPendingMessages() int {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	return int(endpoint.nextMessageId - endpoint.oldestMessageId)
+}
+
+// GetResent returns the number of times a message has been resent.
+func (endpoint *Endpoint) GetResent() uint64 {
+	endpoint.mutex.Lock()
+	defer endpoint.mutex.Unlock()
+	return endpoint.resent
+}
@@ -0,0 +1,273 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package reliable
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func exchange(t *testing.T, from *Endpoint, to *Endpoint, currentTime time.Time) {
+	packetData := make([]byte, core.MinPayloadBytes)
+	packetBytes := from.GeneratePacket(currentTime, packetData)
+	assert.Nil(t, to.ProcessPacket(packetData[:packetBytes]))
+}
+
+func TestReliablePacketFitsInPayload(t *testing.T) {
+	t.Parallel()
+	assert.True(t, PacketHeaderBytes+MaxMessageHeaderBytes+MaxMessageBytes <= core.MinPayloadBytes)
+}
+
+func TestReliableSendReceive(t *testing.T) {
+
+	t.Parallel()
+
+	a := CreateEndpoint(DefaultResendTime)
+	b := CreateEndpoint(DefaultResendTime)
+
+	currentTime := time.Unix(1000, 0)
+
+	assert.False(t, a.HasPacketToSend(currentTime))
+	assert.Nil(t, b.ReceiveMessage())
+
+	assert.Nil(t, a.SendMessage([]byte("hello")))
+	assert.Nil(t, a.SendMessage([]byte("world")))
+	assert.Equal(t, 2, a.GetPendingMessages())
+	assert.True(t, a.HasPacketToSend(currentTime))
+
+	exchange(t, a, b, currentTime)
+
+	// sent messages are not due again until the resend time
+
+	assert.False(t, a.HasPacketToSend(currentTime))
+
+	assert.Equal(t, []byte("hello"), b.ReceiveMessage())
+	assert.Equal(t, []byte("world"), b.ReceiveMessage())
+	assert.Nil(t, b.ReceiveMessage())
+
+	// b owes a an ack
+
+	assert.True(t, b.HasPacketToSend(currentTime))
+
+	exchange(t, b, a, currentTime)
+
+	assert.Equal(t, 0, a.GetPendingMessages())
+	assert.False(t, a.HasPacketToSend(currentTime.Add(time.Second)))
+	assert.Equal(t, uint64(0), a.GetResent())
+}
+
+func TestReliableResend(t *testing.T) {
+
+	t.Parallel()
+
+	a := CreateEndpoint(DefaultResendTime)
+	b := CreateEndpoint(DefaultResendTime)
+
+	currentTime := time.Unix(1000, 0)
+
+	assert.Nil(t, a.SendMessage([]byte("lost")))
+
+	// first packet is lost
+
+	packetData := make([]byte, core.MinPayloadBytes)
+	a.GeneratePacket(currentTime, packetData)
+
+	assert.False(t, a.HasPacketToSend(currentTime.Add(DefaultResendTime/2)))
+
+	currentTime = currentTime.Add(DefaultResendTime)
+
+	assert.True(t, a.HasPacketToSend(currentTime))
+
+	exchange(t, a, b, currentTime)
+
+	assert.Equal(t, uint64(1), a.GetResent())
+	assert.Equal(t, []byte("lost"), b.ReceiveMessage())
+
+	// a duplicate of the message is ignored
+
+	exchange(t, a, b, currentTime.Add(DefaultResendTime))
+	assert.Nil(t, b.ReceiveMessage())
+
+	exchange(t, b, a, currentTime)
+	assert.Equal(t, 0, a.GetPendingMessages())
+}
+
+func TestReliableReset(t *testing.T) {
+
+	t.Parallel()
+
+	a := CreateEndpoint(DefaultResendTime)
+	b := CreateEndpoint(DefaultResendTime)
+
+	currentTime := time.Unix(1000, 0)
+
+	assert.Nil(t, a.SendMessage([]byte("acked")))
+	exchange(t, a, b, currentTime)
+	exchange(t, b, a, currentTime)
+	assert.Equal(t, []byte("acked"), b.ReceiveMessage())
+
+	// messages not acked when a starts over are sent to the new peer
+
+	assert.Nil(t, a.SendMessage([]byte("one")))
+	assert.Nil(t, a.SendMessage([]byte("two")))
+	packetData := make([]byte, core.MinPayloadBytes)
+	a.GeneratePacket(currentTime, packetData)
+
+	a.Reset()
+	assert.Equal(t, 2, a.GetPendingMessages())
+
+	c := CreateEndpoint(DefaultResendTime)
+	exchange(t, a, c, currentTime)
+	assert.Equal(t, []byte("one"), c.ReceiveMessage())
+	assert.Equal(t, []byte("two"), c.ReceiveMessage())
+	assert.Nil(t, c.ReceiveMessage())
+
+	exchange(t, c, a, currentTime)
+	assert.Equal(t, 0, a.GetPendingMessages())
+
+	assert.Nil(t, c.SendMessage([]byte("back")))
+	exchange(t, c, a, currentTime)
+	assert.Equal(t, []byte("back"), a.ReceiveMessage())
+}
+
+func TestReliableLossyOrdered(t *testing.T) {
+
+	t.Parallel()
+
+	random := rand.New(rand.NewSource(42))
+
+	a := CreateEndpoint(DefaultResendTime)
+	b := CreateEndpoint(DefaultResendTime)
+
+	const NumMessages = 1000
+
+	currentTime := time.Unix(1000, 0)
+
+	sent := 0
+	received := 0
+
+	var inFlight [][]byte
+
+	send := func(from *Endpoint) {
+		packetData := make([]byte, core.MinPayloadBytes)
+		packetBytes := from.GeneratePacket(currentTime, packetData)
+		if random.Intn(100) < 30 {
+			return
+		}
+		inFlight = append(inFlight, packetData[:packetBytes])
+	}
+
+	for i := 0; i < 10000 && received < NumMessages; i++ {
+
+		for sent < NumMessages && a.SendMessage([]byte(fmt.Sprintf("message %d", sent))) == nil {
+			sent++
+		}
+
+		send(a)
+
+		// deliver packets to b in a random order
+
+		random.Shuffle(len(inFlight), func(i, j int) { inFlight[i], inFlight[j] = inFlight[j], inFlight[i] })
+		for _, packet := range inFlight {
+			assert.Nil(t, b.ProcessPacket(packet))
+		}
+		inFlight = inFlight[:0]
+
+		for {
+			message := b.ReceiveMessage()
+			if message == nil {
+				break
+			}
+			assert.Equal(t, fmt.Sprintf("message %d", received), string(message))
+			received++
+		}
+
+		send(b)
+		for _, packet := range inFlight {
+			assert.Nil(t, a.ProcessPacket(packet))
+		}
+		inFlight = inFlight[:0]
+
+		currentTime = currentTime.Add(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, NumMessages, received)
+	assert.True(t, a.GetResent() > 0)
+}
+
+func TestReliableSendErrors(t *testing.T) {
+
+	t.Parallel()
+
+	endpoint := CreateEndpoint(DefaultResendTime)
+
+	assert.NotNil(t, endpoint.SendMessage(make([]byte, MaxMessageBytes+1)))
+	assert.Nil(t, endpoint.SendMessage(make([]byte, MaxMessageBytes)))
+
+	for i := 1; i < MessageQueueSize; i++ {
+		assert.Nil(t, endpoint.SendMessage([]byte{byte(i)}))
+	}
+
+	assert.NotNil(t, endpoint.SendMessage([]byte{0}))
+	assert.Equal(t, MessageQueueSize, endpoint.GetPendingMessages())
+}
+
+func TestReliableBadPackets(t *testing.T) {
+
+	t.Parallel()
+
+	a := CreateEndpoint(DefaultResendTime)
+	b := CreateEndpoint(DefaultResendTime)
+
+	currentTime := time.Unix(1000, 0)
+
+	assert.Nil(t, a.SendMessage([]byte("hello")))
+
+	packetData := make([]byte, core.MinPayloadBytes)
+	packetBytes := a.GeneratePacket(currentTime, packetData)
+
+	assert.NotNil(t, b.ProcessPacket(packetData[:PacketHeaderBytes-1]))
+	assert.NotNil(t, b.ProcessPacket(packetData[:packetBytes-1]))
+	assert.False(t, b.HasPacketToSend(currentTime))
+
+	packetData[PacketHeaderBytes-1] = MaxMessagesPerPacket + 1
+	assert.NotNil(t, b.ProcessPacket(packetData[:packetBytes]))
+
+	packetData[PacketHeaderBytes-1] = 1
+	assert.Nil(t, b.ProcessPacket(packetData[:packetBytes]))
+	assert.Equal(t, []byte("hello"), b.ReceiveMessage())
+}
@@ -0,0 +1,295 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+)
+
+// ServerNode is the name gateways report their RTT to the server under. Only gateways with a measurement to
+// the server can end a route.
+const ServerNode = "server"
+
+// RTTSmoothing is how much each new measurement moves the smoothed RTT of a link, as in RFC 6298.
+const RTTSmoothing = 0.125
+
+var ErrNoRoute = errors.New("no route")
+
+// Measurement is a round trip time and jitter in milliseconds, and packet loss, between two nodes. A node is a
+// gateway address, a client region name, or ServerNode. Links are symmetric, so which end is From doesn't matter.
+type Measurement struct {
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	RTT        float64 `json:"rtt"`
+	Jitter     float64 `json:"jitter,omitempty"`
+	PacketLoss float64 `json:"packet_loss,omitempty"`
+}
+
+// Route is the gateway to embed in a connect token, the relays in front of it, if any, and the expected RTT
+// in milliseconds from the client region to the server along it.
+type Route struct {
+	GatewayAddress string   `json:"gateway_address"`
+	RelayAddresses []string `json:"relay_addresses,omitempty"`
+	RTT            float64  `json:"rtt"`
+}
+
+type link struct {
+	a string
+	b string
+}
+
+func makeLink(from string, to string) link {
+	if from > to {
+		from, to = to, from
+	}
+	return link{a: from, b: to}
+}
+
+type linkEntry struct {
+	rtt        float64
+	jitter     float64
+	packetLoss float64
+	updateTime time.Time
+}
+
+// Planner keeps the smoothed RTT of every measured link and picks the lowest latency route from a client
+// region to the server. A route goes through up to core.MaxRouteHops relay gateways, and is only picked over
+// connecting directly to a gateway when it is faster by more than the threshold. Links not measured within
+// maxAge are ignored.
+type Planner struct {
+	mutex     sync.Mutex
+	gateways  []string
+	isGateway map[string]bool
+	links     map[link]*linkEntry
+	threshold float64
+	maxAge    time.Duration
+}
+
+func CreatePlanner(gateways []string, threshold time.Duration, maxAge time.Duration) *Planner {
+	planner := &Planner{
+		isGateway: make(map[string]bool),
+		links:     make(map[link]*linkEntry),
+		threshold: float64(threshold) / float64(time.Millisecond),
+		maxAge:    maxAge,
+	}
+	for _, gateway := range gateways {
+		if !planner.isGateway[gateway] {
+			planner.isGateway[gateway] = true
+			planner.gateways = append(planner.gateways, gateway)
+		}
+	}
+	return planner
+}
+
+// AddMeasurement folds a measurement into its link. Every link has at least one gateway end, and the server
+// is only measured from gateways.
+func (planner *Planner) AddMeasurement(measurement Measurement, currentTime time.Time) error {
+
+	if math.IsNaN(measurement.RTT) || math.IsInf(measurement.RTT, 0) || measurement.RTT < 0 {
+		return fmt.Errorf("invalid rtt %v", measurement.RTT)
+	}
+
+	if math.IsNaN(measurement.Jitter) || math.IsInf(measurement.Jitter, 0) || measurement.Jitter < 0 {
+		return fmt.Errorf("invalid jitter %v", measurement.Jitter)
+	}
+
+	if !(measurement.PacketLoss >= 0 && measurement.PacketLoss <= 1) {
+		return fmt.Errorf("invalid packet loss %v", measurement.PacketLoss)
+	}
+
+	if measurement.From == "" || measurement.To == "" || measurement.From == measurement.To {
+		return fmt.Errorf("invalid link %q to %q", measurement.From, measurement.To)
+	}
+
+	fromGateway := planner.isGateway[measurement.From]
+	toGateway := planner.isGateway[measurement.To]
+	if !fromGateway && !toGateway {
+		return fmt.Errorf("link %q to %q has no known gateway", measurement.From, measurement.To)
+	}
+	if (measurement.From == ServerNode && !toGateway) || (measurement.To == ServerNode && !fromGateway) {
+		return fmt.Errorf("server must be measured from a gateway")
+	}
+
+	planner.mutex.Lock()
+	defer planner.mutex.Unlock()
+
+	key := makeLink(measurement.From, measurement.To)
+	entry, ok := planner.links[key]
+	if !ok || currentTime.Sub(entry.updateTime) > planner.maxAge {
+		planner.links[key] = &linkEntry{rtt: measurement.RTT, jitter: measurement.Jitter, packetLoss: measurement.PacketLoss, updateTime: currentTime}
+		return nil
+	}
+	entry.rtt += (measurement.RTT - entry.rtt) * RTTSmoothing
+	entry.jitter += (measurement.Jitter - entry.jitter) * RTTSmoothing
+	entry.packetLoss += (measurement.PacketLoss - entry.packetLoss) * RTTSmoothing
+	entry.updateTime = currentTime
+	return nil
+}
+
+// GetGateways returns the gateways routes are planned across, which is who gateways ping.
+func (planner *Planner) GetGateways() []string {
+	return planner.gateways
+}
+
+// Links returns the smoothed measurements of every link measured within maxAge, sorted by link.
+func (planner *Planner) Links(currentTime time.Time) []Measurement {
+	planner.mutex.Lock()
+	defer planner.mutex.Unlock()
+	links := make([]Measurement, 0, len(planner.links))
+	for key, entry := range planner.links {
+		if currentTime.Sub(entry.updateTime) > planner.maxAge {
+			continue
+		}
+		links = append(links, Measurement{From: key.a, To: key.b, RTT: entry.rtt, Jitter: entry.jitter, PacketLoss: entry.packetLoss})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].From != links[j].From {
+			return links[i].From < links[j].From
+		}
+		return links[i].To < links[j].To
+	})
+	return links
+}
+
+// Prune drops links that have not been measured within maxAge, and returns how many links are left.
+func (planner *Planner) Prune(currentTime time.Time) int {
+	planner.mutex.Lock()
+	defer planner.mutex.Unlock()
+	for key, entry := range planner.links {
+		if currentTime.Sub(entry.updateTime) > planner.maxAge {
+			delete(planner.links, key)
+		}
+	}
+	return len(planner.links)
+}
+
+func (planner *Planner) rtt(from string, to string, currentTime time.Time) (float64, bool) {
+	entry, ok := planner.links[makeLink(from, to)]
+	if !ok || currentTime.Sub(entry.updateTime) > planner.maxAge {
+		return 0, false
+	}
+	return entry.rtt, true
+}
+
+// Route finds the best route from a client region to the server. Each round of the search extends the best
+// paths found so far by one more relay, so the route is the shortest with at most core.MaxRouteHops relays.
+func (planner *Planner) Route(region string, currentTime time.Time) (Route, error) {
+
+	planner.mutex.Lock()
+	defer planner.mutex.Unlock()
+
+	numGateways := len(planner.gateways)
+
+	// cost[hops][i] is the lowest RTT from the region to gateway i through that many relays, and previous[hops][i]
+	// is the gateway before it
+
+	cost := make([][]float64, core.MaxRouteHops+1)
+	previous := make([][]int, core.MaxRouteHops+1)
+	for hops := range cost {
+		cost[hops] = make([]float64, numGateways)
+		previous[hops] = make([]int, numGateways)
+		for i := range cost[hops] {
+			cost[hops][i] = math.Inf(1)
+			previous[hops][i] = -1
+		}
+	}
+
+	for i, gateway := range planner.gateways {
+		if rtt, ok := planner.rtt(region, gateway, currentTime); ok {
+			cost[0][i] = rtt
+		}
+	}
+
+	for hops := 1; hops <= core.MaxRouteHops; hops++ {
+		for i, from := range planner.gateways {
+			if math.IsInf(cost[hops-1][i], 1) {
+				continue
+			}
+			for j, to := range planner.gateways {
+				if i == j {
+					continue
+				}
+				rtt, ok := planner.rtt(from, to, currentTime)
+				if !ok {
+					continue
+				}
+				if cost[hops-1][i]+rtt < cost[hops][j] {
+					cost[hops][j] = cost[hops-1][i] + rtt
+					previous[hops][j] = i
+				}
+			}
+		}
+	}
+
+	// add the rtt to the server from the last gateway, keeping the best direct and best relayed routes
+
+	bestDirect, bestDirectGateway := math.Inf(1), -1
+	bestRelayed, bestRelayedGateway, bestRelayedHops := math.Inf(1), -1, 0
+
+	for i, gateway := range planner.gateways {
+		serverRTT, ok := planner.rtt(gateway, ServerNode, currentTime)
+		if !ok {
+			continue
+		}
+		if cost[0][i]+serverRTT < bestDirect {
+			bestDirect, bestDirectGateway = cost[0][i]+serverRTT, i
+		}
+		for hops := 1; hops <= core.MaxRouteHops; hops++ {
+			if cost[hops][i]+serverRTT < bestRelayed {
+				bestRelayed, bestRelayedGateway, bestRelayedHops = cost[hops][i]+serverRTT, i, hops
+			}
+		}
+	}
+
+	if bestRelayedGateway >= 0 && (bestDirectGateway < 0 || bestRelayed < bestDirect-planner.threshold) {
+		route := Route{GatewayAddress: planner.gateways[bestRelayedGateway], RelayAddresses: make([]string, bestRelayedHops), RTT: bestRelayed}
+		gateway := bestRelayedGateway
+		for hops := bestRelayedHops; hops > 0; hops-- {
+			gateway = previous[hops][gateway]
+			route.RelayAddresses[hops-1] = planner.gateways[gateway]
+		}
+		return route, nil
+	}
+
+	if bestDirectGateway >= 0 {
+		return Route{GatewayAddress: planner.gateways[bestDirectGateway], RTT: bestDirect}, nil
+	}
+
+	return Route{}, ErrNoRoute
+}
@@ -0,0 +1,188 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const gatewayA = "10.0.0.1:40000"
+const gatewayB = "10.0.0.2:40000"
+const gatewayC = "10.0.0.3:40000"
+const gatewayD = "10.0.0.4:40000"
+
+func addMeasurements(t *testing.T, planner *Planner, currentTime time.Time, measurements ...Measurement) {
+	for _, measurement := range measurements {
+		assert.NoError(t, planner.AddMeasurement(measurement, currentTime))
+	}
+}
+
+func TestPlannerDirect(t *testing.T) {
+	t.Parallel()
+
+	currentTime := time.Now()
+	planner := CreatePlanner([]string{gatewayA, gatewayB}, 10*time.Millisecond, time.Minute)
+
+	_, err := planner.Route("europe", currentTime)
+	assert.Equal(t, ErrNoRoute, err)
+
+	addMeasurements(t, planner, currentTime,
+		Measurement{From: "europe", To: gatewayA, RTT: 20},
+		Measurement{From: "europe", To: gatewayB, RTT: 50},
+		Measurement{From: gatewayA, To: ServerNode, RTT: 40},
+		Measurement{From: ServerNode, To: gatewayB, RTT: 5},
+	)
+
+	route, err := planner.Route("europe", currentTime)
+	assert.NoError(t, err)
+	assert.Equal(t, gatewayB, route.GatewayAddress)
+	assert.Empty(t, route.RelayAddresses)
+	assert.Equal(t, 55.0, route.RTT)
+
+	_, err = planner.Route("asia", currentTime)
+	assert.Equal(t, ErrNoRoute, err)
+}
+
+func TestPlannerRelayed(t *testing.T) {
+	t.Parallel()
+
+	currentTime := time.Now()
+	planner := CreatePlanner([]string{gatewayA, gatewayB, gatewayC, gatewayD}, 10*time.Millisecond, time.Minute)
+
+	// the region is close to a, and d is next to the server. a to d directly is slower than through b and c
+
+	addMeasurements(t, planner, currentTime,
+		Measurement{From: "europe", To: gatewayA, RTT: 10},
+		Measurement{From: "europe", To: gatewayD, RTT: 150},
+		Measurement{From: gatewayA, To: gatewayB, RTT: 20},
+		Measurement{From: gatewayC, To: gatewayB, RTT: 20},
+		Measurement{From: gatewayC, To: gatewayD, RTT: 20},
+		Measurement{From: gatewayA, To: gatewayD, RTT: 100},
+		Measurement{From: gatewayD, To: ServerNode, RTT: 1},
+	)
+
+	route, err := planner.Route("europe", currentTime)
+	assert.NoError(t, err)
+	assert.Equal(t, gatewayD, route.GatewayAddress)
+	assert.Equal(t, []string{gatewayA, gatewayB, gatewayC}, route.RelayAddresses)
+	assert.Equal(t, 71.0, route.RTT)
+
+	// without a measurement to d, the route must be relayed
+
+	planner = CreatePlanner([]string{gatewayA, gatewayD}, 10*time.Millisecond, time.Minute)
+	addMeasurements(t, planner, currentTime,
+		Measurement{From: "europe", To: gatewayA, RTT: 10},
+		Measurement{From: gatewayA, To: gatewayD, RTT: 100},
+		Measurement{From: gatewayD, To: ServerNode, RTT: 1},
+	)
+
+	route, err = planner.Route("europe", currentTime)
+	assert.NoError(t, err)
+	assert.Equal(t, gatewayD, route.GatewayAddress)
+	assert.Equal(t, []string{gatewayA}, route.RelayAddresses)
+}
+
+func TestPlannerThreshold(t *testing.T) {
+	t.Parallel()
+
+	currentTime := time.Now()
+	planner := CreatePlanner([]string{gatewayA, gatewayB}, 10*time.Millisecond, time.Minute)
+
+	// relaying through a saves 5ms, which is under the threshold
+
+	addMeasurements(t, planner, currentTime,
+		Measurement{From: "europe", To: gatewayA, RTT: 10},
+		Measurement{From: "europe", To: gatewayB, RTT: 40},
+		Measurement{From: gatewayA, To: gatewayB, RTT: 25},
+		Measurement{From: gatewayB, To: ServerNode, RTT: 1},
+	)
+
+	route, err := planner.Route("europe", currentTime)
+	assert.NoError(t, err)
+	assert.Equal(t, gatewayB, route.GatewayAddress)
+	assert.Empty(t, route.RelayAddresses)
+
+	// once it saves more than the threshold, the route is relayed
+
+	for i := 0; i < 100; i++ {
+		addMeasurements(t, planner, currentTime, Measurement{From: gatewayB, To: gatewayA, RTT: 5})
+	}
+
+	route, err = planner.Route("europe", currentTime)
+	assert.NoError(t, err)
+	assert.Equal(t, gatewayB, route.GatewayAddress)
+	assert.Equal(t, []string{gatewayA}, route.RelayAddresses)
+}
+
+func TestPlannerMeasurements(t *testing.T) {
+	t.Parallel()
+
+	currentTime := time.Now()
+	planner := CreatePlanner([]string{gatewayA, gatewayB}, 0, time.Minute)
+
+	assert.Error(t, planner.AddMeasurement(Measurement{From: "europe", To: "asia", RTT: 10}, currentTime))
+	assert.Error(t, planner.AddMeasurement(Measurement{From: "europe", To: ServerNode, RTT: 10}, currentTime))
+	assert.Error(t, planner.AddMeasurement(Measurement{From: gatewayA, To: gatewayA, RTT: 10}, currentTime))
+	assert.Error(t, planner.AddMeasurement(Measurement{From: gatewayA, To: gatewayB, RTT: -1}, currentTime))
+	assert.Error(t, planner.AddMeasurement(Measurement{From: gatewayA, To: gatewayB, RTT: 1, Jitter: -1}, currentTime))
+	assert.Error(t, planner.AddMeasurement(Measurement{From: gatewayA, To: gatewayB, RTT: 1, PacketLoss: 2}, currentTime))
+	assert.Equal(t, 0, planner.Prune(currentTime))
+
+	// measurements are smoothed
+
+	addMeasurements(t, planner, currentTime,
+		Measurement{From: "europe", To: gatewayA, RTT: 10},
+		Measurement{From: gatewayA, To: ServerNode, RTT: 0},
+	)
+	addMeasurements(t, planner, currentTime.Add(time.Second), Measurement{From: gatewayA, To: "europe", RTT: 90, Jitter: 8, PacketLoss: 1})
+
+	route, err := planner.Route("europe", currentTime.Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 20.0, route.RTT)
+
+	assert.Equal(t, []Measurement{
+		{From: gatewayA, To: "europe", RTT: 20, Jitter: 1, PacketLoss: 0.125},
+		{From: gatewayA, To: ServerNode},
+	}, planner.Links(currentTime.Add(time.Second)))
+
+	// stale links are ignored, then pruned
+
+	addMeasurements(t, planner, currentTime.Add(time.Minute), Measurement{From: gatewayA, To: ServerNode, RTT: 0})
+
+	_, err = planner.Route("europe", currentTime.Add(time.Minute+2*time.Second))
+	assert.Equal(t, ErrNoRoute, err)
+
+	assert.Equal(t, 1, planner.Prune(currentTime.Add(time.Minute+2*time.Second)))
+}
@@ -0,0 +1,843 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/log"
+	"github.com/networknext/udpx/modules/metrics"
+	"github.com/networknext/udpx/modules/netio"
+	"github.com/networknext/udpx/modules/reliable"
+)
+
+const MaxPacketSize = 1500
+const SequenceBufferSize = 1024
+const UpdateInterval = 10 * time.Millisecond
+
+// todo: gateway needs to pass this up to server (envelopeDownKbps)
+
+const EnvelopeDownKbps = 10000
+
+var ChokeLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+var SendLog = log.CreateRateLimitedLogger(log.Default(), time.Second)
+
+// Config configures a server. Sessions that receive nothing for SessionTimeout are removed, and new
+// sessions are turned away while MaxClients are connected. The callbacks are optional, and are called
+// from the server's own goroutines.
+type Config struct {
+	NumThreads          int
+	ReadBuffer          int
+	WriteBuffer         int
+	MaxClients          int
+	SessionTimeout      time.Duration
+	KeepAliveInterval   time.Duration
+	ReassemblyTimeout   time.Duration
+	MaxReassemblyMemory int
+	FECTimeout          time.Duration
+	ServerId            []byte
+	Metrics             *metrics.Registry
+
+	ClientConnectCallback    func(client *Client)
+	ClientDisconnectCallback func(client *Client)
+	PacketCallback           func(client *Client, payload []byte)
+	MessageCallback          func(client *Client, message []byte)
+	AckCallback              func(client *Client, payloadId uint64)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		NumThreads:          1,
+		ReadBuffer:          100000,
+		WriteBuffer:         100000,
+		MaxClients:          100000,
+		SessionTimeout:      60 * time.Second,
+		KeepAliveInterval:   time.Second,
+		ReassemblyTimeout:   time.Second,
+		MaxReassemblyMemory: 256 * 1024,
+		FECTimeout:          core.DefaultFECTimeout,
+	}
+}
+
+// gatewayPath is what the server needs to send packets to the client through one of its gateways.
+type gatewayPath struct {
+	gatewayInternalAddress net.UDPAddr
+	clientAddress          net.UDPAddr
+	gatewayId              [core.GatewayIdBytes]byte
+	sessionTokenData       [core.EncryptedSessionTokenBytes]byte
+	sessionTokenSequence   [core.SequenceBytes]byte
+	lastReceiveTime        time.Time
+}
+
+// Client is a session connected to the server through one or more gateways.
+type Client struct {
+	server    *Server
+	sessionId [core.SessionIdBytes]byte
+
+	mutex sync.Mutex
+
+	conn *net.UDPConn
+
+	sendSequence        uint64
+	sendPayloadId       uint64
+	sequenceToPayloadId [SequenceBufferSize]uint64
+	lastSendTime        time.Time
+	ackPending          bool
+
+	receiveSequence     uint64
+	receiveSequenceTime time.Time
+	receivedPackets     [SequenceBufferSize]uint64
+	ackedPackets        [SequenceBufferSize]uint64
+	ackBuffer           [SequenceBufferSize]uint64
+
+	sendBandwidthBitsAccumulator  uint64
+	sendBandwidthBitsPerSecondMax uint64
+	sendBandwidthBitsResetTime    time.Time
+
+	reliable    *reliable.Endpoint
+	reassembler *core.Reassembler
+	fec         *core.FECDecoder
+
+	paths [core.MaxPaths]gatewayPath
+}
+
+// Server receives packets forwarded by gateways on one or more threads, each with its own socket bound
+// with SO_REUSEPORT. Gateways decrypt client packets before forwarding them, so the server has no keys.
+type Server struct {
+	config   Config
+	serverId []byte
+
+	conns    []*net.UDPConn
+	sessions *core.SessionTable
+
+	connectMutex sync.Mutex
+
+	closeOnce    sync.Once
+	closeChannel chan struct{}
+	waitGroup    sync.WaitGroup
+
+	packetsReceived            *metrics.Counter
+	droppedPackets             *metrics.Counter
+	chokedPackets              *metrics.Counter
+	overBandwidthPackets       *metrics.Counter
+	duplicatePackets           *metrics.Counter
+	packetsSent                *metrics.Counter
+	sessionsCreated            *metrics.Counter
+	sessionsDisconnected       *metrics.Counter
+	sessionsRejected           *metrics.Counter
+	reliableMessagesReceived   *metrics.Counter
+	reliablePacketsDropped     *metrics.Counter
+	fragmentedPayloadsReceived *metrics.Counter
+	fragmentsDropped           *metrics.Counter
+	fecPayloadsRecovered       *metrics.Counter
+	fecShardsDropped           *metrics.Counter
+}
+
+// Listen binds the server sockets and starts receiving packets from gateways.
+func Listen(address string, config Config) (*Server, error) {
+
+	if config.NumThreads < 1 || config.MaxClients < 1 || config.SessionTimeout <= 0 || config.KeepAliveInterval <= 0 {
+		return nil, fmt.Errorf("invalid number of threads, max clients, session timeout or keep-alive interval")
+	}
+
+	if config.ServerId != nil && len(config.ServerId) != core.ServerIdBytes {
+		return nil, fmt.Errorf("server id must be %d bytes, got %d", core.ServerIdBytes, len(config.ServerId))
+	}
+
+	server := &Server{config: config}
+
+	server.serverId = config.ServerId
+	if server.serverId == nil {
+		server.serverId = core.RandomBytes(core.ServerIdBytes)
+	}
+
+	registry := config.Metrics
+	if registry == nil {
+		registry = metrics.CreateRegistry()
+	}
+
+	server.packetsReceived = registry.Counter("udpx_server_packets_received_total", "Packets received from gateways.")
+	server.droppedPackets = registry.Counter("udpx_server_packets_dropped_total", "Packets from gateways dropped for being malformed.")
+	server.chokedPackets = registry.Counter("udpx_server_packets_choked_total", "Packets not sent because the session is over its bandwidth envelope.")
+	server.overBandwidthPackets = registry.Counter("udpx_server_packets_over_bandwidth_total", "Packets marked by the gateway as over their session bandwidth limit.")
+	server.duplicatePackets = registry.Counter("udpx_server_packets_duplicate_total", "Packets dropped as copies of a packet already received over another path.")
+	server.packetsSent = registry.Counter("udpx_server_packets_sent_total", "Packets sent to gateways.")
+	server.sessionsCreated = registry.Counter("udpx_server_sessions_created_total", "Sessions created.")
+	server.sessionsDisconnected = registry.Counter("udpx_server_sessions_disconnected_total", "Sessions ended by a disconnect packet from the client.")
+	server.sessionsRejected = registry.Counter("udpx_server_sessions_rejected_total", "Sessions not created because the server already has its maximum number of clients.")
+	server.reliableMessagesReceived = registry.Counter("udpx_server_reliable_messages_received_total", "Messages received on the reliable channel.")
+	server.reliablePacketsDropped = registry.Counter("udpx_server_reliable_packets_dropped_total", "Reliable channel packets dropped for being malformed.")
+	server.fragmentedPayloadsReceived = registry.Counter("udpx_server_fragmented_payloads_received_total", "Payloads reassembled from fragments.")
+	server.fragmentsDropped = registry.Counter("udpx_server_fragments_dropped_total", "Fragments dropped for being malformed or not fitting in reassembly memory.")
+	server.fecPayloadsRecovered = registry.Counter("udpx_server_fec_payloads_recovered_total", "Payloads lost in transit and recovered from FEC parity shards.")
+	server.fecShardsDropped = registry.Counter("udpx_server_fec_shards_dropped_total", "FEC shards dropped for being malformed.")
+
+	server.sessions = core.CreateSessionTable(config.SessionTimeout, config.MaxClients)
+	server.sessions.SetRemoveCallback(func(value interface{}) {
+		if config.ClientDisconnectCallback != nil {
+			config.ClientDisconnectCallback(value.(*Client))
+		}
+	})
+
+	registry.GaugeFunc("udpx_server_sessions_active", "Sessions that have not yet timed out.", func() int64 {
+		return int64(server.sessions.GetCount())
+	})
+	registry.CounterFunc("udpx_server_sessions_expired_total", "Sessions removed after receiving no packets for the session timeout.", func() uint64 {
+		return server.sessions.GetExpired()
+	})
+
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %v", err)
+	}
+
+	server.conns = make([]*net.UDPConn, config.NumThreads)
+
+	for i := range server.conns {
+		// platforms that can't spread packets across sockets share one between the threads
+		if i > 0 && !netio.ReusePort {
+			server.conns[i] = server.conns[0]
+			continue
+		}
+		conn, err := netio.ListenUDP(context.Background(), udpAddress.String())
+		if err != nil {
+			err = fmt.Errorf("could not bind socket: %v", err)
+		} else {
+			if err = conn.SetReadBuffer(config.ReadBuffer); err != nil {
+				err = fmt.Errorf("could not set connection read buffer size: %v", err)
+			} else if err = conn.SetWriteBuffer(config.WriteBuffer); err != nil {
+				err = fmt.Errorf("could not set connection write buffer size: %v", err)
+			}
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			for _, conn := range server.conns[:i] {
+				conn.Close()
+			}
+			return nil, err
+		}
+		server.conns[i] = conn
+		// the first socket picks the port when listening on port zero, and the rest share it
+		udpAddress = conn.LocalAddr().(*net.UDPAddr)
+	}
+
+	server.closeChannel = make(chan struct{})
+
+	server.waitGroup.Add(len(server.conns) + 1)
+
+	for _, conn := range server.conns {
+		go server.receiveLoop(conn)
+	}
+
+	go server.updateLoop()
+
+	core.Info("server id is %s", core.IdString(server.serverId))
+
+	return server, nil
+}
+
+// Close closes the server sockets and waits for the server goroutines to finish. Clients are not told,
+// they time out on their own.
+func (server *Server) Close() {
+	server.closeOnce.Do(func() {
+		close(server.closeChannel)
+		for _, conn := range server.conns {
+			conn.Close()
+		}
+	})
+	server.waitGroup.Wait()
+}
+
+func (server *Server) GetServerId() []byte {
+	return server.serverId
+}
+
+func (server *Server) GetAddress() *net.UDPAddr {
+	return server.conns[0].LocalAddr().(*net.UDPAddr)
+}
+
+func (server *Server) GetNumClients() int {
+	return server.sessions.GetCount()
+}
+
+// ForEachClient calls the callback for every connected client, without the session table locked.
+func (server *Server) ForEachClient(callback func(client *Client)) {
+	server.sessions.ForEach(func(sessionId [core.SessionIdBytes]byte, value interface{}) {
+		callback(value.(*Client))
+	})
+}
+
+func (server *Server) updateLoop() {
+
+	defer server.waitGroup.Done()
+
+	ticker := time.NewTicker(UpdateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-server.closeChannel:
+			return
+		case currentTime := <-ticker.C:
+			if expired := server.sessions.Expire(currentTime); expired > 0 {
+				core.Debug("expired %d idle sessions", expired)
+			}
+			server.ForEachClient(func(client *Client) {
+				client.update(currentTime)
+			})
+		}
+	}
+}
+
+func (server *Server) receiveLoop(conn *net.UDPConn) {
+
+	defer server.waitGroup.Done()
+
+	buffer := [MaxPacketSize]byte{}
+
+	for {
+
+		packetBytes, from, err := conn.ReadFromUDP(buffer[:])
+		if err != nil {
+			core.Debug("failed to read udp packet: %v", err)
+			break
+		}
+
+		if packetBytes <= 0 {
+			continue
+		}
+
+		packetData := buffer[:packetBytes]
+
+		// respond to pings from gateways checking we are up
+
+		if packetBytes == core.ServerPingPacketBytes && packetData[0] == 0 && packetData[1] == core.ServerPingPacket {
+			packetData[1] = core.ServerPongPacket
+			if _, err := conn.WriteToUDP(packetData, from); err != nil {
+				core.Debug("failed to send pong to %s: %v", from.String(), err)
+			}
+			continue
+		}
+
+		server.packetsReceived.Inc()
+
+		server.processPacket(conn, packetData, time.Now())
+	}
+}
+
+func (server *Server) processPacket(conn *net.UDPConn, packetData []byte, receiveTime time.Time) {
+
+	if len(packetData) < core.VersionBytes+core.AddressBytes+core.AddressBytes+core.EncryptedSessionTokenBytes+core.SequenceBytes+core.HeaderBytes {
+		core.Debug("packet is too small")
+		server.droppedPackets.Inc()
+		return
+	}
+
+	index := 0
+
+	var version uint8
+	var gatewayInternalAddress net.UDPAddr
+	var clientAddress net.UDPAddr
+	var sessionId [core.SessionIdBytes]byte
+	var sequence uint64
+	var ack uint64
+	var ack_bits [core.AckBitsBytes]byte
+	var packetGatewayId [core.GatewayIdBytes]byte
+	var packetServerId [core.ServerIdBytes]byte
+	var packetType byte
+	var flags byte
+	var channelId byte
+	var ackDelay uint32
+
+	core.ReadUint8(packetData, &index, &version)
+
+	if version != 0 {
+		core.Debug("unknown packet version: %d", version)
+		server.droppedPackets.Inc()
+		return
+	}
+
+	if !core.ReadAddress(packetData, &index, &gatewayInternalAddress) || !core.ReadAddress(packetData, &index, &clientAddress) {
+		core.Debug("invalid address")
+		server.droppedPackets.Inc()
+		return
+	}
+	sessionTokenData := packetData[index : index+core.EncryptedSessionTokenBytes]
+	index += core.EncryptedSessionTokenBytes
+	sessionTokenSequence := packetData[index : index+core.SequenceBytes]
+	index += core.SequenceBytes
+	core.ReadBytes(packetData, &index, sessionId[:], core.SessionIdBytes)
+	core.ReadUint64(packetData, &index, &sequence)
+	core.ReadUint64(packetData, &index, &ack)
+	core.ReadBytes(packetData, &index, ack_bits[:], core.AckBitsBytes)
+	core.ReadBytes(packetData, &index, packetGatewayId[:], core.GatewayIdBytes)
+	core.ReadBytes(packetData, &index, packetServerId[:], core.ServerIdBytes)
+	core.ReadUint8(packetData, &index, &packetType)
+	core.ReadUint8(packetData, &index, &flags)
+	core.ReadUint8(packetData, &index, &channelId)
+	core.ReadUint32(packetData, &index, &ackDelay)
+
+	// multipath sessions send the same packet through more than one gateway, each path with its own sequence space
+
+	packetPath := core.SequencePath(sequence)
+	sequence = core.SessionSequence(sequence)
+	ack = core.SessionSequence(ack)
+
+	// client stats are for the gateway, and only need acking here
+
+	if packetType != core.PayloadPacket && packetType != core.KeepAlivePacket && packetType != core.DisconnectPacket && packetType != core.MTUProbePacket && packetType != core.ClientStatsPacket {
+		core.Debug("unknown packet type: %d", packetType)
+		server.droppedPackets.Inc()
+		return
+	}
+
+	if flags&^core.Flags_OverBandwidth != 0 {
+		core.Debug("unknown flags")
+		server.droppedPackets.Inc()
+		return
+	}
+
+	if flags&core.Flags_OverBandwidth != 0 {
+		server.overBandwidthPackets.Inc()
+	}
+
+	if channelId != core.UnreliableChannel && channelId != core.ReliableChannel && channelId != core.FragmentChannel && channelId != core.FECChannel {
+		core.Debug("unknown channel: %d", channelId)
+		server.droppedPackets.Inc()
+		return
+	}
+
+	core.Debug("recv packet sequence = %d", sequence)
+	core.Debug("recv packet ack = %d", ack)
+	core.Debug("recv packet ack_bits = %x", ack_bits)
+
+	// clients send a disconnect packet when they leave, so end the session now instead of waiting for it to time out
+
+	if packetType == core.DisconnectPacket {
+		if server.sessions.Remove(sessionId) {
+			server.sessionsDisconnected.Inc()
+			core.Info("session %s disconnected", core.IdString(sessionId[:]))
+		}
+		return
+	}
+
+	// lookup or create a session entry
+
+	client, connected := server.findOrCreateClient(sessionId, clientAddress, ack, receiveTime)
+	if client == nil {
+		return
+	}
+
+	server.sessions.Touch(sessionId, receiveTime)
+
+	client.mutex.Lock()
+
+	client.conn = conn
+
+	// remember how to reach the client through this gateway
+
+	path := &client.paths[packetPath]
+	path.gatewayInternalAddress = gatewayInternalAddress
+	path.clientAddress = clientAddress
+	path.gatewayId = packetGatewayId
+	copy(path.sessionTokenData[:], sessionTokenData)
+	copy(path.sessionTokenSequence[:], sessionTokenSequence)
+	path.lastReceiveTime = receiveTime
+
+	// only process the first copy of a packet sent over more than one path
+
+	if client.receivedPackets[sequence%SequenceBufferSize] == sequence {
+		client.mutex.Unlock()
+		core.Debug("packet %d is a duplicate", sequence)
+		server.duplicatePackets.Inc()
+		return
+	}
+
+	// update received packet reliability
+
+	if client.receiveSequence < sequence {
+		client.receiveSequence = sequence
+		client.receiveSequenceTime = receiveTime
+	}
+
+	client.receivedPackets[sequence%SequenceBufferSize] = sequence
+	client.ackPending = true
+
+	payload := packetData[index:]
+
+	core.Debug("received packet %d from %s with %d byte payload", sequence, core.IdString(sessionId[:]), len(payload))
+
+	var payloads [][]byte
+
+	if packetType == core.PayloadPacket && channelId == core.UnreliableChannel {
+		payloads = append(payloads, append([]byte(nil), payload...))
+	}
+
+	// decode payloads sent with forward error correction. data shards are delivered as they arrive,
+	// and lost ones are recovered from parity shards
+
+	if packetType == core.PayloadPacket && channelId == core.FECChannel {
+		recovered := client.fec.GetRecovered()
+		fecPayloads, err := client.fec.ProcessShard(payload, receiveTime)
+		if err != nil {
+			core.Debug("could not process fec shard: %v", err)
+			server.fecShardsDropped.Inc()
+		}
+		payloads = append(payloads, fecPayloads...)
+		if client.fec.GetRecovered() > recovered {
+			server.fecPayloadsRecovered.Add(client.fec.GetRecovered() - recovered)
+			core.Debug("recovered %d payloads from %s", client.fec.GetRecovered()-recovered, core.IdString(sessionId[:]))
+		}
+	}
+
+	// reassemble fragmented payloads
+
+	if packetType == core.PayloadPacket && channelId == core.FragmentChannel {
+		client.reassembler.Expire(receiveTime)
+		fragmentedPayload, err := client.reassembler.ProcessFragment(payload, receiveTime)
+		if err != nil {
+			core.Debug("could not process fragment: %v", err)
+			server.fragmentsDropped.Inc()
+		} else if fragmentedPayload != nil {
+			payloads = append(payloads, fragmentedPayload)
+			server.fragmentedPayloadsReceived.Inc()
+			core.Debug("reassembled %d byte payload from %s", len(fragmentedPayload), core.IdString(sessionId[:]))
+		}
+	}
+
+	// process reliable messages
+
+	if packetType == core.PayloadPacket && channelId == core.ReliableChannel {
+		if err := client.reliable.ProcessPacket(payload); err != nil {
+			core.Debug("could not process reliable packet: %v", err)
+			server.reliablePacketsDropped.Inc()
+		}
+	}
+
+	// process packet acks
+
+	var payloadAcks []uint64
+
+	acks := core.ProcessAcks(ack, ack_bits[:], client.ackedPackets[:], client.ackBuffer[:])
+
+	for i := range acks {
+		core.Debug("ack packet %d", acks[i])
+		client.ackedPackets[acks[i]%SequenceBufferSize] = acks[i]
+		payloadAck := client.sequenceToPayloadId[acks[i]%SequenceBufferSize]
+		if payloadAck != ^uint64(0) {
+			core.Debug("ack payload %d for session %s", payloadAck, core.IdString(sessionId[:]))
+			payloadAcks = append(payloadAcks, payloadAck)
+		}
+	}
+
+	// keep-alives are answered with a keep-alive, and mtu probes with the probe size so the client knows it got through
+
+	if packetType == core.KeepAlivePacket {
+		client.sendPacket(core.KeepAlivePacket, core.UnreliableChannel, make([]byte, core.MinPayloadBytes), core.PriorityNormal, packetPath, false)
+	} else if packetType == core.MTUProbePacket && len(payload) >= core.MTUProbeSizeBytes {
+		responsePayload := make([]byte, core.MinPayloadBytes)
+		copy(responsePayload, payload[:core.MTUProbeSizeBytes])
+		client.sendPacket(core.MTUProbePacket, core.UnreliableChannel, responsePayload, core.PriorityNormal, packetPath, false)
+	}
+
+	client.mutex.Unlock()
+
+	// callbacks are called without the client mutex held, so they can send
+
+	if connected && server.config.ClientConnectCallback != nil {
+		server.config.ClientConnectCallback(client)
+	}
+
+	if server.config.PacketCallback != nil {
+		for _, payload := range payloads {
+			server.config.PacketCallback(client, payload)
+		}
+	}
+
+	for {
+		message := client.reliable.ReceiveMessage()
+		if message == nil {
+			break
+		}
+		server.reliableMessagesReceived.Inc()
+		core.Debug("received reliable message from %s: %q", core.IdString(sessionId[:]), message)
+		if server.config.MessageCallback != nil {
+			server.config.MessageCallback(client, message)
+		}
+	}
+
+	if server.config.AckCallback != nil {
+		for _, payloadAck := range payloadAcks {
+			server.config.AckCallback(client, payloadAck)
+		}
+	}
+}
+
+// findOrCreateClient returns the client for a session, creating it if there is room. It returns true
+// if the client was created
+
+func (server *Server) findOrCreateClient(sessionId [core.SessionIdBytes]byte, clientAddress net.UDPAddr, ack uint64, receiveTime time.Time) (*Client, bool) {
+
+	if value := server.sessions.Get(sessionId); value != nil {
+		return value.(*Client), false
+	}
+
+	// the session table would evict the least recently used session to make room, so check there is room first
+
+	server.connectMutex.Lock()
+	defer server.connectMutex.Unlock()
+
+	if value := server.sessions.Get(sessionId); value != nil {
+		return value.(*Client), false
+	}
+
+	if server.sessions.GetCount() >= server.config.MaxClients {
+		core.Debug("server is full. rejected session %s", core.IdString(sessionId[:]))
+		server.sessionsRejected.Inc()
+		return nil, false
+	}
+
+	client := &Client{server: server, sessionId: sessionId}
+	client.sendSequence = ack + 10000
+	client.sendBandwidthBitsPerSecondMax = EnvelopeDownKbps * 1000
+	client.sendBandwidthBitsResetTime = receiveTime.Add(time.Second)
+	for i := range client.sequenceToPayloadId {
+		client.sequenceToPayloadId[i] = ^uint64(0)
+		client.receivedPackets[i] = ^uint64(0)
+		client.ackedPackets[i] = ^uint64(0)
+	}
+	client.reliable = reliable.CreateEndpoint(reliable.DefaultResendTime)
+	client.reassembler = core.CreateReassembler(server.config.ReassemblyTimeout, server.config.MaxReassemblyMemory)
+	client.fec = core.CreateFECDecoder(server.config.FECTimeout)
+
+	server.sessions.Insert(sessionId, client, receiveTime)
+
+	server.sessionsCreated.Inc()
+
+	core.Info("new session %s from %s", core.IdString(sessionId[:]), clientAddress.String())
+
+	return client, true
+}
+
+func (client *Client) GetSessionId() [core.SessionIdBytes]byte {
+	return client.sessionId
+}
+
+// GetClientAddress returns the address of the client as seen by the gateway it last sent a packet through.
+func (client *Client) GetClientAddress() *net.UDPAddr {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	latest := client.latestPath()
+	address := client.paths[latest].clientAddress
+	return &address
+}
+
+// Send sends a payload to the client over every active path. Payloads must be MinPayloadBytes long,
+// and are not sent if the client is over its bandwidth envelope.
+func (client *Client) Send(payload []byte) error {
+	return client.SendWithPriority(payload, core.PriorityNormal)
+}
+
+// SendWithPriority is Send, with the priority in the packet header so the gateway tags the packet with
+// its DSCP for the priority on the way to the client.
+func (client *Client) SendWithPriority(payload []byte, priority core.Priority) error {
+	if len(payload) != core.MinPayloadBytes {
+		return fmt.Errorf("payload must be %d bytes, got %d", core.MinPayloadBytes, len(payload))
+	}
+	if priority >= core.NumPriorities {
+		return fmt.Errorf("unknown priority %d", priority)
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if !client.sendPacket(core.PayloadPacket, core.UnreliableChannel, payload, priority, client.latestPath(), true) {
+		return fmt.Errorf("client is over its bandwidth envelope")
+	}
+	return nil
+}
+
+// SendMessage queues a message on the reliable channel. Messages are delivered to the client in order.
+func (client *Client) SendMessage(message []byte) error {
+	return client.reliable.SendMessage(message)
+}
+
+// latestPath is the path a packet was most recently received over. the caller must hold the client mutex
+
+func (client *Client) latestPath() int {
+	latest := 0
+	for i := range client.paths {
+		if client.paths[i].lastReceiveTime.After(client.paths[latest].lastReceiveTime) {
+			latest = i
+		}
+	}
+	return latest
+}
+
+// update sends reliable messages and acks, and keeps the session alive while nothing else is being sent.
+// acks for packets received since the last send go out in a keep-alive if nothing else carries them
+
+func (client *Client) update(currentTime time.Time) {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	path := client.latestPath()
+
+	if client.paths[path].lastReceiveTime.IsZero() {
+		return
+	}
+
+	if client.reliable.HasPacketToSend(currentTime) {
+		payload := make([]byte, core.MinPayloadBytes)
+		client.reliable.GeneratePacket(currentTime, payload)
+		client.sendPacket(core.PayloadPacket, core.ReliableChannel, payload, core.PriorityNormal, path, false)
+		return
+	}
+
+	sinceLastSend := currentTime.Sub(client.lastSendTime)
+
+	if (client.ackPending && sinceLastSend >= UpdateInterval) || sinceLastSend >= client.server.config.KeepAliveInterval {
+		client.sendPacket(core.KeepAlivePacket, core.UnreliableChannel, make([]byte, core.MinPayloadBytes), core.PriorityNormal, path, false)
+	}
+}
+
+// sendPacket sends a packet over a path, or over every active path when multipath is true. it returns
+// false if the packet was choked. the caller must hold the client mutex
+
+func (client *Client) sendPacket(packetType byte, channelId byte, payload []byte, priority core.Priority, pathIndex int, multipath bool) bool {
+
+	server := client.server
+
+	currentTime := time.Now()
+
+	// payloads go back through every active path, and the client processes whichever copy arrives first
+
+	paths := []int{pathIndex}
+	if multipath {
+		for i := range client.paths {
+			if i != pathIndex && currentTime.Sub(client.paths[i].lastReceiveTime) < core.PathTimeout {
+				paths = append(paths, i)
+			}
+		}
+	}
+
+	// do we have enough bandwidth available to send this packet?
+
+	if client.sendBandwidthBitsResetTime.Before(currentTime) {
+		sendBandwidthMbps := float64(client.sendBandwidthBitsAccumulator) / 1000000.0
+		client.sendBandwidthBitsResetTime = currentTime.Add(time.Second)
+		client.sendBandwidthBitsAccumulator = 0
+		core.Debug("session %s is %.2f mbps", core.IdString(client.sessionId[:]), sendBandwidthMbps)
+	}
+
+	gatewayPacketBytes := core.PacketBytesFromPayload(len(payload))
+
+	wireBits := uint64(core.WirePacketBits(gatewayPacketBytes) * len(paths))
+
+	if client.sendBandwidthBitsAccumulator+wireBits > client.sendBandwidthBitsPerSecondMax {
+		ChokeLog.Info("choke")
+		server.chokedPackets.Inc()
+		return false
+	}
+
+	client.sendBandwidthBitsAccumulator += wireBits
+
+	// build payload packet
+
+	send_sequence := client.sendSequence
+	send_ack := client.receiveSequence
+	var send_ack_bits [core.AckBitsBytes]byte
+
+	core.GetAckBits(client.receiveSequence, client.receivedPackets[:], send_ack_bits[:])
+
+	core.Debug("send packet sequence = %d", send_sequence)
+	core.Debug("send packet ack = %d", send_ack)
+	core.Debug("send packet ack_bits = %x", send_ack_bits)
+
+	for _, i := range paths {
+
+		path := &client.paths[i]
+
+		packetData := make([]byte, MaxPacketSize)
+
+		index := 0
+
+		core.WriteUint8(packetData, &index, 0)
+		core.WriteUint8(packetData, &index, core.PayloadPacket)
+		core.WriteAddress(packetData, &index, &path.clientAddress)
+		core.WriteBytes(packetData, &index, path.sessionTokenData[:], core.EncryptedSessionTokenBytes)
+		core.WriteBytes(packetData, &index, path.sessionTokenSequence[:], core.SequenceBytes)
+		core.WriteBytes(packetData, &index, client.sessionId[:], core.SessionIdBytes)
+		core.WriteUint64(packetData, &index, core.PathSequence(send_sequence, i))
+		core.WriteUint64(packetData, &index, send_ack)
+		core.WriteBytes(packetData, &index, send_ack_bits[:], len(send_ack_bits))
+		core.WriteBytes(packetData, &index, path.gatewayId[:], core.GatewayIdBytes)
+		core.WriteBytes(packetData, &index, server.serverId[:], core.ServerIdBytes)
+		core.WriteUint8(packetData, &index, packetType)
+		core.WriteUint8(packetData, &index, core.PriorityFlags(priority))
+		core.WriteUint8(packetData, &index, channelId)
+		core.WriteUint32(packetData, &index, core.AckDelayMicroseconds(currentTime.Sub(client.receiveSequenceTime)))
+		core.WriteBytes(packetData, &index, payload, len(payload))
+
+		packetData = packetData[:index]
+
+		// send it to the client through the gateway
+
+		if _, err := client.conn.WriteToUDP(packetData, &path.gatewayInternalAddress); err != nil {
+			SendLog.Error("failed to send payload to gateway: %v", err)
+		} else {
+			server.packetsSent.Inc()
+		}
+
+		core.Debug("send %d byte packet to %s", len(packetData), path.gatewayInternalAddress.String())
+	}
+
+	// update reliability
+
+	if packetType == core.PayloadPacket && channelId == core.UnreliableChannel {
+		client.sequenceToPayloadId[send_sequence%SequenceBufferSize] = client.sendPayloadId
+		client.sendPayloadId++
+	} else {
+		client.sequenceToPayloadId[send_sequence%SequenceBufferSize] = ^uint64(0)
+	}
+	client.sendSequence++
+	client.lastSendTime = currentTime
+	client.ackPending = false
+
+	return true
+}
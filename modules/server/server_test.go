@@ -0,0 +1,291 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestPacket writes a packet the way a gateway forwards it to the server
+
+func writeTestPacket(gatewayAddress *net.UDPAddr, sessionId byte, sequence uint64, packetType byte, channelId byte, payload []byte) []byte {
+	packetData := make([]byte, MaxPacketSize)
+	clientAddress := core.ParseAddress("127.0.0.1:30000")
+	var sessionTokenData [core.EncryptedSessionTokenBytes]byte
+	var ackBits [core.AckBitsBytes]byte
+	var gatewayId [core.GatewayIdBytes]byte
+	var serverId [core.ServerIdBytes]byte
+	var id [core.SessionIdBytes]byte
+	id[0] = sessionId
+	index := 0
+	core.WriteUint8(packetData, &index, 0)
+	core.WriteAddress(packetData, &index, gatewayAddress)
+	core.WriteAddress(packetData, &index, clientAddress)
+	core.WriteBytes(packetData, &index, sessionTokenData[:], core.EncryptedSessionTokenBytes)
+	core.WriteUint64(packetData, &index, 0)
+	core.WriteBytes(packetData, &index, id[:], core.SessionIdBytes)
+	core.WriteUint64(packetData, &index, sequence)
+	core.WriteUint64(packetData, &index, 0)
+	core.WriteBytes(packetData, &index, ackBits[:], core.AckBitsBytes)
+	core.WriteBytes(packetData, &index, gatewayId[:], core.GatewayIdBytes)
+	core.WriteBytes(packetData, &index, serverId[:], core.ServerIdBytes)
+	core.WriteUint8(packetData, &index, packetType)
+	core.WriteUint8(packetData, &index, 0)
+	core.WriteUint8(packetData, &index, channelId)
+	core.WriteUint32(packetData, &index, 0)
+	core.WriteBytes(packetData, &index, payload, len(payload))
+	return packetData[:index]
+}
+
+func createTestServer(t *testing.T, config Config) (*Server, *net.UDPConn) {
+	server, err := Listen("127.0.0.1:0", config)
+	assert.Nil(t, err)
+	gateway, err := net.ListenUDP("udp", core.ParseAddress("127.0.0.1:0"))
+	assert.Nil(t, err)
+	gateway.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return server, gateway
+}
+
+func sendTestPacket(t *testing.T, server *Server, gateway *net.UDPConn, sessionId byte, sequence uint64, packetType byte, payload []byte) {
+	packetData := writeTestPacket(gateway.LocalAddr().(*net.UDPAddr), sessionId, sequence, packetType, core.UnreliableChannel, payload)
+	_, err := gateway.WriteToUDP(packetData, server.GetAddress())
+	assert.Nil(t, err)
+}
+
+// receiveTestPacket returns the packet type and channel of the next packet sent to the gateway. the server
+// sends keep-alives to ack packets when it has nothing else to send, so these are skipped unless asked for
+
+func receiveTestPacket(t *testing.T, gateway *net.UDPConn, keepAlives bool) (byte, byte) {
+	packetData := make([]byte, MaxPacketSize)
+	packetTypeIndex := core.VersionBytes + core.PacketTypeBytes + core.AddressBytes + core.EncryptedSessionTokenBytes + core.SequenceBytes + core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes + core.GatewayIdBytes + core.ServerIdBytes
+	for {
+		packetBytes, _, err := gateway.ReadFromUDP(packetData)
+		if !assert.Nil(t, err) {
+			return 0, 0
+		}
+		assert.True(t, packetBytes > packetTypeIndex+core.PacketTypeBytes+core.FlagsBytes+core.ChannelIdBytes)
+		if keepAlives || packetData[packetTypeIndex] != core.KeepAlivePacket {
+			return packetData[packetTypeIndex], packetData[packetTypeIndex+core.PacketTypeBytes+core.FlagsBytes]
+		}
+	}
+}
+
+func TestListenInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	config := DefaultConfig()
+	config.NumThreads = 0
+	_, err := Listen("127.0.0.1:0", config)
+	assert.NotNil(t, err)
+
+	config = DefaultConfig()
+	config.ServerId = make([]byte, 3)
+	_, err = Listen("127.0.0.1:0", config)
+	assert.NotNil(t, err)
+
+	_, err = Listen("not an address", DefaultConfig())
+	assert.NotNil(t, err)
+}
+
+func TestServer(t *testing.T) {
+
+	t.Parallel()
+
+	connected := make(chan *Client, 10)
+	disconnected := make(chan *Client, 10)
+	payloads := make(chan []byte, 10)
+
+	config := DefaultConfig()
+	config.NumThreads = 2
+	config.ClientConnectCallback = func(client *Client) {
+		connected <- client
+	}
+	config.ClientDisconnectCallback = func(client *Client) {
+		disconnected <- client
+	}
+	config.PacketCallback = func(client *Client, payload []byte) {
+		payloads <- payload
+	}
+
+	server, gateway := createTestServer(t, config)
+	defer server.Close()
+	defer gateway.Close()
+
+	payload := make([]byte, core.MinPayloadBytes)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	sendTestPacket(t, server, gateway, 1, 10000, core.PayloadPacket, payload)
+
+	client := <-connected
+	assert.Equal(t, byte(1), client.GetSessionId()[0])
+	assert.Equal(t, "127.0.0.1:30000", client.GetClientAddress().String())
+	assert.Equal(t, payload, <-payloads)
+	assert.Equal(t, 1, server.GetNumClients())
+
+	// payloads sent to the client go through the gateway the client last sent from
+
+	assert.Nil(t, client.Send(payload))
+	assert.NotNil(t, client.Send(payload[:10]))
+
+	packetType, channelId := receiveTestPacket(t, gateway, false)
+	assert.Equal(t, core.PayloadPacket, packetType)
+	assert.Equal(t, core.UnreliableChannel, channelId)
+
+	// keep-alives are answered with a keep-alive
+
+	sendTestPacket(t, server, gateway, 1, 10001, core.KeepAlivePacket, make([]byte, core.MinPayloadBytes))
+
+	packetType, _ = receiveTestPacket(t, gateway, true)
+	assert.Equal(t, core.KeepAlivePacket, packetType)
+
+	// reliable messages go out from the update loop
+
+	assert.Nil(t, client.SendMessage([]byte("hello")))
+
+	packetType, channelId = receiveTestPacket(t, gateway, false)
+	assert.Equal(t, core.PayloadPacket, packetType)
+	assert.Equal(t, core.ReliableChannel, channelId)
+
+	sendTestPacket(t, server, gateway, 1, 10002, core.DisconnectPacket, make([]byte, core.MinPayloadBytes))
+
+	assert.Equal(t, client, <-disconnected)
+	assert.Equal(t, 0, server.GetNumClients())
+}
+
+func TestServerMaxClients(t *testing.T) {
+
+	t.Parallel()
+
+	connected := make(chan *Client, 10)
+
+	config := DefaultConfig()
+	config.MaxClients = 1
+	config.ClientConnectCallback = func(client *Client) {
+		connected <- client
+	}
+
+	server, gateway := createTestServer(t, config)
+	defer server.Close()
+	defer gateway.Close()
+
+	sendTestPacket(t, server, gateway, 1, 10000, core.KeepAlivePacket, make([]byte, core.MinPayloadBytes))
+	sendTestPacket(t, server, gateway, 2, 10000, core.KeepAlivePacket, make([]byte, core.MinPayloadBytes))
+
+	// the first session is answered, and the second is turned away
+
+	packetType, _ := receiveTestPacket(t, gateway, true)
+	assert.Equal(t, core.KeepAlivePacket, packetType)
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, byte(1), (<-connected).GetSessionId()[0])
+	assert.Equal(t, 0, len(connected))
+	assert.Equal(t, 1, server.GetNumClients())
+}
+
+func TestServerSessionTimeout(t *testing.T) {
+
+	t.Parallel()
+
+	disconnected := make(chan *Client, 10)
+
+	config := DefaultConfig()
+	config.SessionTimeout = 50 * time.Millisecond
+	config.ClientDisconnectCallback = func(client *Client) {
+		disconnected <- client
+	}
+
+	server, gateway := createTestServer(t, config)
+	defer server.Close()
+	defer gateway.Close()
+
+	sendTestPacket(t, server, gateway, 1, 10000, core.KeepAlivePacket, make([]byte, core.MinPayloadBytes))
+
+	select {
+	case client := <-disconnected:
+		assert.Equal(t, byte(1), client.GetSessionId()[0])
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not time out")
+	}
+
+	assert.Equal(t, 0, server.GetNumClients())
+}
+
+func TestServerSendWithPriority(t *testing.T) {
+
+	t.Parallel()
+
+	connected := make(chan *Client, 10)
+
+	config := DefaultConfig()
+	config.ClientConnectCallback = func(client *Client) {
+		connected <- client
+	}
+
+	server, gateway := createTestServer(t, config)
+	defer server.Close()
+	defer gateway.Close()
+
+	sendTestPacket(t, server, gateway, 1, 10000, core.PayloadPacket, make([]byte, core.MinPayloadBytes))
+
+	client := <-connected
+
+	// the priority travels in the header flags so the gateway can tag the packet on the way to the client
+
+	flagsIndex := core.VersionBytes + core.PacketTypeBytes + core.AddressBytes + core.EncryptedSessionTokenBytes + core.SequenceBytes + core.SessionIdBytes + core.SequenceBytes + core.AckBytes + core.AckBitsBytes + core.GatewayIdBytes + core.ServerIdBytes + core.PacketTypeBytes
+
+	for _, priority := range []core.Priority{core.PriorityHigh, core.PriorityLow, core.PriorityNormal} {
+		assert.Nil(t, client.SendWithPriority(make([]byte, core.MinPayloadBytes), priority))
+		packetData := make([]byte, MaxPacketSize)
+		for {
+			packetBytes, _, err := gateway.ReadFromUDP(packetData)
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.True(t, packetBytes > flagsIndex)
+			if packetData[flagsIndex-core.PacketTypeBytes] == core.PayloadPacket {
+				break
+			}
+		}
+		assert.Equal(t, priority, core.PriorityFromFlags(packetData[flagsIndex]))
+	}
+
+	assert.NotNil(t, client.SendWithPriority(make([]byte, core.MinPayloadBytes), core.NumPriorities))
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package sessionstore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/redis"
+)
+
+const DefaultPrefix = "udpx:"
+
+// Client sends pipelined commands to redis, or a server that speaks its protocol. *redis.Client is one.
+type Client interface {
+	Pipeline(commands [][]string) ([]interface{}, error)
+}
+
+// Record is what a gateway needs to carry on a session another gateway instance started. Keys aren't
+// stored, since they are derived again from the session token in every packet.
+type Record struct {
+	ServerAddress string    `json:"server_address"`
+	CreateTime    time.Time `json:"create_time"`
+	Sequence      uint64    `json:"sequence"`
+}
+
+// Identity is shared by the gateway instances behind the same address, so packets and challenge tokens
+// made for one instance are accepted by the others.
+type Identity struct {
+	GatewayId    []byte `json:"gateway_id"`
+	ChallengeKey []byte `json:"challenge_key"`
+}
+
+// Store keeps session records in redis, expiring after ttl unless they are put again.
+type Store struct {
+	client Client
+	prefix string
+	ttl    time.Duration
+}
+
+func CreateStore(client Client, prefix string, ttl time.Duration) *Store {
+	return &Store{client: client, prefix: prefix, ttl: ttl}
+}
+
+func (store *Store) sessionKey(sessionId []byte) string {
+	return store.prefix + "session:" + hex.EncodeToString(sessionId)
+}
+
+// Put writes records in one pipeline.
+func (store *Store) Put(records map[[core.SessionIdBytes]byte]Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	commands := make([][]string, 0, len(records))
+	for sessionId, record := range records {
+		data, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		commands = append(commands, redis.SetCommand(store.sessionKey(sessionId[:]), string(data), store.ttl))
+	}
+	replies, err := store.client.Pipeline(commands)
+	if err != nil {
+		return err
+	}
+	return firstError(replies)
+}
+
+// Get returns the record for a session, or nil if there isn't one.
+func (store *Store) Get(sessionId []byte) (*Record, error) {
+	replies, err := store.client.Pipeline([][]string{{"GET", store.sessionKey(sessionId)}})
+	if err != nil {
+		return nil, err
+	}
+	if err := firstError(replies); err != nil || replies[0] == nil {
+		return nil, err
+	}
+	data, ok := replies[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %v", replies[0])
+	}
+	record := &Record{}
+	if err := json.Unmarshal([]byte(data), record); err != nil {
+		return nil, fmt.Errorf("invalid session record: %v", err)
+	}
+	return record, nil
+}
+
+func (store *Store) Delete(sessionId []byte) error {
+	replies, err := store.client.Pipeline([][]string{{"DEL", store.sessionKey(sessionId)}})
+	if err != nil {
+		return err
+	}
+	return firstError(replies)
+}
+
+// SharedIdentity returns the identity of the gateway instances at gatewayAddress. The first instance
+// to start stores its own identity, and the instances after it use that one.
+func (store *Store) SharedIdentity(gatewayAddress string, identity Identity) (Identity, error) {
+	data, err := json.Marshal(&identity)
+	if err != nil {
+		return Identity{}, err
+	}
+	key := store.prefix + "gateway:" + gatewayAddress
+	replies, err := store.client.Pipeline([][]string{{"SET", key, string(data), "NX"}, {"GET", key}})
+	if err != nil {
+		return Identity{}, err
+	}
+	if err := firstError(replies); err != nil {
+		return Identity{}, err
+	}
+	stored, ok := replies[1].(string)
+	if !ok {
+		return Identity{}, fmt.Errorf("unexpected reply %v", replies[1])
+	}
+	var shared Identity
+	if err := json.Unmarshal([]byte(stored), &shared); err != nil {
+		return Identity{}, fmt.Errorf("invalid gateway identity: %v", err)
+	}
+	if len(shared.GatewayId) != len(identity.GatewayId) || len(shared.ChallengeKey) != len(identity.ChallengeKey) {
+		return Identity{}, fmt.Errorf("invalid gateway identity")
+	}
+	return shared, nil
+}
+
+func firstError(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package sessionstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/networknext/udpx/modules/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// mapClient runs GET, SET (with NX) and DEL against a map
+type mapClient struct {
+	values map[string]string
+	ttls   map[string]string
+}
+
+func createMapClient() *mapClient {
+	return &mapClient{values: make(map[string]string), ttls: make(map[string]string)}
+}
+
+func (client *mapClient) Pipeline(commands [][]string) ([]interface{}, error) {
+	replies := make([]interface{}, len(commands))
+	for i, args := range commands {
+		switch args[0] {
+		case "GET":
+			if value, ok := client.values[args[1]]; ok {
+				replies[i] = value
+			}
+		case "SET":
+			if _, exists := client.values[args[1]]; exists && args[len(args)-1] == "NX" {
+				continue
+			}
+			client.values[args[1]] = args[2]
+			if len(args) >= 5 && args[3] == "PX" {
+				client.ttls[args[1]] = args[4]
+			}
+			replies[i] = "OK"
+		case "DEL":
+			count := int64(0)
+			if _, exists := client.values[args[1]]; exists {
+				delete(client.values, args[1])
+				count++
+			}
+			replies[i] = count
+		default:
+			replies[i] = redis.Error("ERR unknown command")
+		}
+	}
+	return replies, nil
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+
+	client := createMapClient()
+	store := CreateStore(client, DefaultPrefix, 30*time.Second)
+
+	var a, b [core.SessionIdBytes]byte
+	a[0] = 0xaa
+	b[0] = 0xbb
+
+	record, err := store.Get(a[:])
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	createTime := time.Unix(1700000000, 0).UTC()
+	err = store.Put(map[[core.SessionIdBytes]byte]Record{
+		a: {ServerAddress: "10.0.0.1:50000", CreateTime: createTime, Sequence: 100},
+		b: {ServerAddress: "10.0.0.2:50000", CreateTime: createTime, Sequence: 200},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "30000", client.ttls[store.sessionKey(a[:])])
+
+	record, err = store.Get(a[:])
+	assert.NoError(t, err)
+	assert.Equal(t, &Record{ServerAddress: "10.0.0.1:50000", CreateTime: createTime, Sequence: 100}, record)
+
+	assert.NoError(t, store.Delete(a[:]))
+
+	record, err = store.Get(a[:])
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	record, err = store.Get(b[:])
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(200), record.Sequence)
+}
+
+func TestStoreInvalidRecord(t *testing.T) {
+	t.Parallel()
+
+	client := createMapClient()
+	store := CreateStore(client, DefaultPrefix, time.Minute)
+
+	var sessionId [core.SessionIdBytes]byte
+	client.values[store.sessionKey(sessionId[:])] = "not json"
+
+	_, err := store.Get(sessionId[:])
+	assert.Error(t, err)
+}
+
+func TestSharedIdentity(t *testing.T) {
+	t.Parallel()
+
+	client := createMapClient()
+	store := CreateStore(client, "test:", time.Minute)
+
+	first := Identity{GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8}, ChallengeKey: make([]byte, 32)}
+	second := Identity{GatewayId: []byte{8, 7, 6, 5, 4, 3, 2, 1}, ChallengeKey: make([]byte, 32)}
+	second.ChallengeKey[0] = 1
+
+	identity, err := store.SharedIdentity("10.0.0.1:40000", first)
+	assert.NoError(t, err)
+	assert.Equal(t, first, identity)
+
+	identity, err = store.SharedIdentity("10.0.0.1:40000", second)
+	assert.NoError(t, err)
+	assert.Equal(t, first, identity)
+
+	identity, err = store.SharedIdentity("10.0.0.2:40000", second)
+	assert.NoError(t, err)
+	assert.Equal(t, second, identity)
+
+	_, err = store.SharedIdentity("10.0.0.1:40000", Identity{GatewayId: make([]byte, 16), ChallengeKey: make([]byte, 32)})
+	assert.Error(t, err)
+}
@@ -0,0 +1,231 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package simulator
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RouteTimeout is how long a route created for an unknown client lasts without packets
+const RouteTimeout = 60 * time.Second
+
+const maxPacketBytes = 4096
+
+// Proxy forwards udp packets from clients to a target through a simulator, and the replies back. Each
+// client gets its own route with its own upstream socket, so the target sees every client at a different
+// address, like clients behind their own NAT.
+//
+// Routes for clients that just start sending are created as packets arrive, with the upstream socket on an
+// ephemeral port, or on the client's own port at UpstreamIP if that is set. Clients that need to know in
+// advance where the target will see them, like udpx clients setting ClientAddress, get a route from AddRoute.
+type Proxy struct {
+	conn          *net.UDPConn
+	targetAddress *net.UDPAddr
+	simulator     *Simulator
+	upstreamIP    net.IP
+
+	mutex  sync.Mutex
+	routes map[string]*Route
+
+	waitGroup    sync.WaitGroup
+	closed       atomic.Bool
+	closeChannel chan struct{}
+}
+
+// Route is one client's path through the proxy
+type Route struct {
+	clientAddress *net.UDPAddr
+	upstream      *net.UDPConn
+	permanent     bool
+	partitioned   atomic.Bool
+	lastPacket    atomic.Int64
+}
+
+// Listen starts a proxy at the address, forwarding to the target. upstreamIP may be nil.
+func Listen(address string, targetAddress *net.UDPAddr, upstreamIP net.IP, simulator *Simulator) (*Proxy, error) {
+	listenAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &Proxy{conn: conn, targetAddress: targetAddress, simulator: simulator, upstreamIP: upstreamIP, routes: make(map[string]*Route), closeChannel: make(chan struct{})}
+	proxy.waitGroup.Add(2)
+	go proxy.receiveLoop()
+	go proxy.expireLoop()
+	return proxy, nil
+}
+
+func (proxy *Proxy) GetAddress() *net.UDPAddr {
+	return proxy.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Close stops the proxy and closes every route. It does not close the simulator.
+func (proxy *Proxy) Close() {
+	if proxy.closed.Swap(true) {
+		return
+	}
+	close(proxy.closeChannel)
+	proxy.conn.Close()
+	proxy.mutex.Lock()
+	for _, route := range proxy.routes {
+		route.upstream.Close()
+	}
+	proxy.mutex.Unlock()
+	proxy.waitGroup.Wait()
+}
+
+// AddRoute creates a route for a client that will send from clientAddress. The route lasts until the proxy
+// is closed.
+func (proxy *Proxy) AddRoute(clientAddress *net.UDPAddr) (*Route, error) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	route, err := proxy.createRoute(clientAddress)
+	if err != nil {
+		return nil, err
+	}
+	route.permanent = true
+	return route, nil
+}
+
+// createRoute must be called with the proxy mutex held
+func (proxy *Proxy) createRoute(clientAddress *net.UDPAddr) (*Route, error) {
+	if proxy.closed.Load() {
+		return nil, net.ErrClosed
+	}
+	if route, ok := proxy.routes[clientAddress.String()]; ok {
+		return route, nil
+	}
+	upstreamAddress := &net.UDPAddr{IP: proxy.targetAddress.IP}
+	if proxy.targetAddress.IP.IsUnspecified() {
+		upstreamAddress.IP = nil
+	}
+	if proxy.upstreamIP != nil {
+		upstreamAddress = &net.UDPAddr{IP: proxy.upstreamIP, Port: clientAddress.Port}
+	}
+	upstream, err := net.ListenUDP("udp", upstreamAddress)
+	if err != nil {
+		return nil, err
+	}
+	route := &Route{clientAddress: clientAddress, upstream: upstream}
+	route.lastPacket.Store(time.Now().UnixNano())
+	proxy.routes[clientAddress.String()] = route
+	proxy.waitGroup.Add(1)
+	go proxy.routeLoop(route)
+	return route, nil
+}
+
+func (proxy *Proxy) receiveLoop() {
+	defer proxy.waitGroup.Done()
+	buffer := make([]byte, maxPacketBytes)
+	for {
+		packetBytes, from, err := proxy.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if proxy.closed.Load() {
+				return
+			}
+			continue
+		}
+		proxy.mutex.Lock()
+		route, err := proxy.createRoute(from)
+		proxy.mutex.Unlock()
+		if err != nil || route.partitioned.Load() {
+			continue
+		}
+		route.lastPacket.Store(time.Now().UnixNano())
+		upstream := route.upstream
+		proxy.simulator.Deliver(buffer[:packetBytes], func(packetData []byte) {
+			upstream.WriteToUDP(packetData, proxy.targetAddress)
+		})
+	}
+}
+
+func (proxy *Proxy) routeLoop(route *Route) {
+	defer proxy.waitGroup.Done()
+	buffer := make([]byte, maxPacketBytes)
+	for {
+		packetBytes, _, err := route.upstream.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if route.partitioned.Load() {
+			continue
+		}
+		route.lastPacket.Store(time.Now().UnixNano())
+		proxy.simulator.Deliver(buffer[:packetBytes], func(packetData []byte) {
+			proxy.conn.WriteToUDP(packetData, route.clientAddress)
+		})
+	}
+}
+
+func (proxy *Proxy) expireLoop() {
+	defer proxy.waitGroup.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-proxy.closeChannel:
+			return
+		case <-ticker.C:
+		}
+		expireTime := time.Now().Add(-RouteTimeout).UnixNano()
+		proxy.mutex.Lock()
+		for key, route := range proxy.routes {
+			if !route.permanent && route.lastPacket.Load() < expireTime {
+				route.upstream.Close()
+				delete(proxy.routes, key)
+			}
+		}
+		proxy.mutex.Unlock()
+	}
+}
+
+func (proxy *Proxy) GetNumRoutes() int {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return len(proxy.routes)
+}
+
+// UpstreamAddress is where the target sees the client's packets coming from
+func (route *Route) UpstreamAddress() *net.UDPAddr {
+	return route.upstream.LocalAddr().(*net.UDPAddr)
+}
+
+// SetPartitioned cuts the client off in both directions, without the target hearing about it
+func (route *Route) SetPartitioned(partitioned bool) {
+	route.partitioned.Store(partitioned)
+}
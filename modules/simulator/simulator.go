@@ -0,0 +1,255 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package simulator
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes a bad network. Each packet is lost with probability Loss, otherwise delivered after
+// Latency plus or minus up to Jitter, and with probability Reorder held back a further ReorderDelay so
+// packets behind it overtake it. With probability Duplication a second copy follows with its own delay.
+// Decisions come from a random source seeded with Seed, so the same packets get the same fate every run.
+type Config struct {
+	Latency      time.Duration
+	Jitter       time.Duration
+	Loss         float64
+	Duplication  float64
+	Reorder      float64
+	ReorderDelay time.Duration
+	Seed         int64
+}
+
+type Stats struct {
+	Packets    uint64
+	Dropped    uint64
+	Duplicated uint64
+	Reordered  uint64
+}
+
+// Simulator decides what happens to each packet and delivers the ones that survive in order of their
+// delivery time.
+type Simulator struct {
+	mutex       sync.Mutex
+	config      Config
+	random      *rand.Rand
+	outageUntil time.Time
+
+	packets    atomic.Uint64
+	dropped    atomic.Uint64
+	duplicated atomic.Uint64
+	reordered  atomic.Uint64
+
+	queue     packetQueue
+	sequence  uint64
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func Create(config Config) *Simulator {
+	simulator := &Simulator{
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go simulator.deliverLoop()
+	return simulator
+}
+
+// Close stops delivery. Packets still waiting to be delivered are dropped.
+func (simulator *Simulator) Close() {
+	simulator.closeOnce.Do(func() {
+		close(simulator.closed)
+	})
+	<-simulator.done
+}
+
+// SetConfig changes the network conditions. The random source keeps going, so only Seed is ignored.
+func (simulator *Simulator) SetConfig(config Config) {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	simulator.config = config
+}
+
+func (simulator *Simulator) GetConfig() Config {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	return simulator.config
+}
+
+// Outage drops every packet until the given time
+func (simulator *Simulator) Outage(until time.Time) {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	simulator.outageUntil = until
+}
+
+func (simulator *Simulator) GetStats() Stats {
+	return Stats{
+		Packets:    simulator.packets.Load(),
+		Dropped:    simulator.dropped.Load(),
+		Duplicated: simulator.duplicated.Load(),
+		Reordered:  simulator.reordered.Load(),
+	}
+}
+
+// Decide returns the delays to deliver a packet sent at the given time after. There are none if the packet
+// is lost, and two if it is duplicated.
+func (simulator *Simulator) Decide(currentTime time.Time) []time.Duration {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+
+	simulator.packets.Add(1)
+
+	config := &simulator.config
+
+	if currentTime.Before(simulator.outageUntil) || simulator.random.Float64() < config.Loss {
+		simulator.dropped.Add(1)
+		return nil
+	}
+
+	copies := 1
+	if simulator.random.Float64() < config.Duplication {
+		simulator.duplicated.Add(1)
+		copies = 2
+	}
+
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delay := config.Latency
+		if config.Jitter > 0 {
+			delay += time.Duration(simulator.random.Int63n(int64(2*config.Jitter)+1)) - config.Jitter
+		}
+		if simulator.random.Float64() < config.Reorder {
+			simulator.reordered.Add(1)
+			delay += config.ReorderDelay
+		}
+		if delay < 0 {
+			delay = 0
+		}
+		delays[i] = delay
+	}
+
+	return delays
+}
+
+// Deliver decides the fate of a packet and calls write with it for each copy that survives, when it is
+// due. Packets due at the same time are written in the order they were delivered.
+func (simulator *Simulator) Deliver(packetData []byte, write func(packetData []byte)) {
+	currentTime := time.Now()
+	delays := simulator.Decide(currentTime)
+	if len(delays) == 0 {
+		return
+	}
+	packetData = append([]byte(nil), packetData...)
+	simulator.mutex.Lock()
+	for _, delay := range delays {
+		simulator.sequence++
+		heap.Push(&simulator.queue, &queuedPacket{deliverTime: currentTime.Add(delay), sequence: simulator.sequence, packetData: packetData, write: write})
+	}
+	simulator.mutex.Unlock()
+	select {
+	case simulator.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (simulator *Simulator) deliverLoop() {
+	defer close(simulator.done)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		simulator.mutex.Lock()
+		var due []*queuedPacket
+		wait := time.Hour
+		currentTime := time.Now()
+		for simulator.queue.Len() > 0 {
+			next := simulator.queue[0]
+			if next.deliverTime.After(currentTime) {
+				wait = next.deliverTime.Sub(currentTime)
+				break
+			}
+			due = append(due, heap.Pop(&simulator.queue).(*queuedPacket))
+		}
+		simulator.mutex.Unlock()
+
+		for _, packet := range due {
+			packet.write(packet.packetData)
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-simulator.closed:
+			return
+		case <-simulator.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+type queuedPacket struct {
+	deliverTime time.Time
+	sequence    uint64
+	packetData  []byte
+	write       func(packetData []byte)
+}
+
+type packetQueue []*queuedPacket
+
+func (queue packetQueue) Len() int { return len(queue) }
+
+func (queue packetQueue) Less(i, j int) bool {
+	if queue[i].deliverTime.Equal(queue[j].deliverTime) {
+		return queue[i].sequence < queue[j].sequence
+	}
+	return queue[i].deliverTime.Before(queue[j].deliverTime)
+}
+
+func (queue packetQueue) Swap(i, j int) { queue[i], queue[j] = queue[j], queue[i] }
+
+func (queue *packetQueue) Push(value interface{}) { *queue = append(*queue, value.(*queuedPacket)) }
+
+func (queue *packetQueue) Pop() interface{} {
+	old := *queue
+	packet := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return packet
+}
@@ -0,0 +1,186 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package simulator
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecide(t *testing.T) {
+
+	t.Parallel()
+
+	config := Config{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.1, Duplication: 0.05, Reorder: 0.05, ReorderDelay: 100 * time.Millisecond, Seed: 7}
+
+	first := Create(config)
+	defer first.Close()
+	second := Create(config)
+	defer second.Close()
+
+	// the same seed gives every packet the same fate
+
+	currentTime := time.Now()
+	delivered := 0
+	for i := 0; i < 10000; i++ {
+		delays := first.Decide(currentTime)
+		assert.Equal(t, delays, second.Decide(currentTime))
+		assert.LessOrEqual(t, len(delays), 2)
+		for _, delay := range delays {
+			assert.GreaterOrEqual(t, delay, 40*time.Millisecond)
+			assert.LessOrEqual(t, delay, 160*time.Millisecond)
+		}
+		delivered += len(delays)
+	}
+
+	stats := first.GetStats()
+	assert.Equal(t, uint64(10000), stats.Packets)
+	assert.InDelta(t, 1000, stats.Dropped, 150)
+	assert.InDelta(t, 450, stats.Duplicated, 100)
+	assert.InDelta(t, 500, stats.Reordered, 100)
+	assert.Equal(t, int(stats.Packets-stats.Dropped+stats.Duplicated), delivered)
+
+	// outages drop everything
+
+	first.Outage(currentTime.Add(time.Second))
+	assert.Nil(t, first.Decide(currentTime))
+	first.SetConfig(Config{})
+	assert.Nil(t, first.Decide(currentTime.Add(time.Second-1)))
+	assert.Equal(t, []time.Duration{0}, first.Decide(currentTime.Add(time.Second)))
+}
+
+func TestDeliverInOrder(t *testing.T) {
+
+	t.Parallel()
+
+	simulator := Create(Config{Latency: 20 * time.Millisecond})
+	defer simulator.Close()
+
+	// packets with the same delay come out in the order they went in
+
+	received := make(chan byte, 100)
+	startTime := time.Now()
+	for i := 0; i < 100; i++ {
+		simulator.Deliver([]byte{byte(i)}, func(packetData []byte) { received <- packetData[0] })
+	}
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, byte(i), <-received)
+	}
+	assert.GreaterOrEqual(t, time.Since(startTime), 20*time.Millisecond)
+
+	// a packet held back for reordering is overtaken
+
+	simulator.SetConfig(Config{Reorder: 1, ReorderDelay: 50 * time.Millisecond})
+	simulator.Deliver([]byte{1}, func(packetData []byte) { received <- packetData[0] })
+	simulator.SetConfig(Config{})
+	simulator.Deliver([]byte{2}, func(packetData []byte) { received <- packetData[0] })
+	assert.Equal(t, byte(2), <-received)
+	assert.Equal(t, byte(1), <-received)
+}
+
+func TestProxy(t *testing.T) {
+
+	t.Parallel()
+
+	// an echo server behind the proxy
+
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer target.Close()
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			packetBytes, from, err := target.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			target.WriteToUDP(append([]byte(from.String()+" "), buffer[:packetBytes]...), from)
+		}
+	}()
+
+	simulator := Create(Config{Latency: 5 * time.Millisecond, Duplication: 1})
+	defer simulator.Close()
+
+	proxy, err := Listen("127.0.0.1:0", target.LocalAddr().(*net.UDPAddr), nil, simulator)
+	assert.Nil(t, err)
+	defer proxy.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer client.Close()
+
+	route, err := proxy.AddRoute(client.LocalAddr().(*net.UDPAddr))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, proxy.GetNumRoutes())
+
+	// every packet is duplicated on the way there and on the way back, and the target sees the route's
+	// upstream address
+
+	_, err = client.WriteToUDP([]byte("hello"), proxy.GetAddress())
+	assert.Nil(t, err)
+
+	buffer := make([]byte, 1500)
+	for i := 0; i < 4; i++ {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		packetBytes, from, err := client.ReadFromUDP(buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, proxy.GetAddress().String(), from.String())
+		assert.Equal(t, route.UpstreamAddress().String()+" hello", string(buffer[:packetBytes]))
+	}
+
+	// nothing gets through a partitioned route
+
+	route.SetPartitioned(true)
+	_, err = client.WriteToUDP([]byte("hello"), proxy.GetAddress())
+	assert.Nil(t, err)
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = client.ReadFromUDP(buffer)
+	assert.NotNil(t, err)
+
+	// unknown clients get a route when they start sending
+
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer other.Close()
+
+	_, err = other.WriteToUDP([]byte("hi"), proxy.GetAddress())
+	assert.Nil(t, err)
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	packetBytes, _, err := other.ReadFromUDP(buffer)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buffer[:packetBytes]), " hi")
+	assert.Equal(t, 2, proxy.GetNumRoutes())
+}
@@ -0,0 +1,166 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package status
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/metrics"
+)
+
+// Version and Commit are set when building, with -ldflags "-X github.com/networknext/udpx/modules/status.Version=..."
+// Without them, they come from the module version and the vcs revision go stamps into the binary, if any.
+var Version string
+var Commit string
+
+// Status is what /status serves. Counters are every counter in the service's metrics, by name.
+type Status struct {
+	Service           string                 `json:"service"`
+	Version           string                 `json:"version"`
+	Commit            string                 `json:"commit"`
+	StartTime         time.Time              `json:"start_time"`
+	UptimeSeconds     float64                `json:"uptime_seconds"`
+	ConfigFingerprint string                 `json:"config_fingerprint"`
+	Counters          map[string]uint64      `json:"counters"`
+	Details           map[string]interface{} `json:"details,omitempty"`
+}
+
+// Reporter reports the status of a service.
+type Reporter struct {
+	mutex       sync.Mutex
+	service     string
+	startTime   time.Time
+	registry    *metrics.Registry
+	fingerprint string
+	details     func() map[string]interface{}
+}
+
+func CreateReporter(service string, registry *metrics.Registry, startTime time.Time) *Reporter {
+	return &Reporter{service: service, registry: registry, startTime: startTime}
+}
+
+// SetConfig sets the configuration to fingerprint. It is called again when the configuration is reloaded.
+func (reporter *Reporter) SetConfig(config interface{}) {
+	fingerprint := Fingerprint(config)
+	reporter.mutex.Lock()
+	reporter.fingerprint = fingerprint
+	reporter.mutex.Unlock()
+}
+
+// SetDetails sets a function returning anything else the service wants to report.
+func (reporter *Reporter) SetDetails(details func() map[string]interface{}) {
+	reporter.mutex.Lock()
+	reporter.details = details
+	reporter.mutex.Unlock()
+}
+
+func (reporter *Reporter) Get(currentTime time.Time) Status {
+	reporter.mutex.Lock()
+	fingerprint := reporter.fingerprint
+	details := reporter.details
+	reporter.mutex.Unlock()
+
+	version, commit := BuildVersion()
+	status := Status{
+		Service:           reporter.service,
+		Version:           version,
+		Commit:            commit,
+		StartTime:         reporter.startTime.UTC(),
+		UptimeSeconds:     currentTime.Sub(reporter.startTime).Seconds(),
+		ConfigFingerprint: fingerprint,
+		Counters:          reporter.registry.Counters(),
+	}
+	if details != nil {
+		status.Details = details()
+	}
+	return status
+}
+
+func (reporter *Reporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(reporter.Get(time.Now()))
+}
+
+// Fingerprint is a short hash of a configuration, so instances running with different configurations stand
+// out. Maps are hashed with their keys in order, so the fingerprint doesn't depend on map order.
+func Fingerprint(config interface{}) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8])
+}
+
+// BuildVersion returns the version and commit the binary was built from.
+func BuildVersion() (string, string) {
+	version, commit := Version, Commit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if version == "" {
+			version = info.Main.Version
+		}
+		if commit == "" {
+			modified := false
+			for _, setting := range info.Settings {
+				switch setting.Key {
+				case "vcs.revision":
+					commit = setting.Value
+				case "vcs.modified":
+					modified = setting.Value == "true"
+				}
+			}
+			if commit != "" && modified {
+				commit += "-dirty"
+			}
+		}
+	}
+	if version == "" {
+		version = "unknown"
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	return version, commit
+}
+
+// VersionString returns the version and commit for logging at startup, as "version (commit)".
+func VersionString() string {
+	version, commit := BuildVersion()
+	return version + " (" + commit + ")"
+}
@@ -0,0 +1,103 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package status
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+
+	a := Fingerprint(map[string]interface{}{"udp_port": "40000", "num_threads": 4})
+	b := Fingerprint(map[string]interface{}{"num_threads": 4, "udp_port": "40000"})
+	c := Fingerprint(map[string]interface{}{"num_threads": 8, "udp_port": "40000"})
+
+	assert.Len(t, a, 16)
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+}
+
+func TestReporter(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.CreateRegistry()
+	issued := registry.Counter("test_tokens_issued_total", "Tokens issued.")
+	registry.Gauge("test_sessions_active", "Active sessions.")
+
+	startTime := time.Unix(1700000000, 0)
+	reporter := CreateReporter("udpx test", registry, startTime)
+	reporter.SetConfig(map[string]string{"HTTP_PORT": "60000"})
+	reporter.SetDetails(func() map[string]interface{} {
+		return map[string]interface{}{"draining": false}
+	})
+
+	issued.Add(3)
+
+	status := reporter.Get(startTime.Add(90 * time.Second))
+	assert.Equal(t, "udpx test", status.Service)
+	assert.Equal(t, startTime.UTC(), status.StartTime)
+	assert.Equal(t, 90.0, status.UptimeSeconds)
+	assert.Equal(t, Fingerprint(map[string]string{"HTTP_PORT": "60000"}), status.ConfigFingerprint)
+	assert.Equal(t, map[string]uint64{"test_tokens_issued_total": 3}, status.Counters)
+	assert.Equal(t, map[string]interface{}{"draining": false}, status.Details)
+	assert.NotEmpty(t, status.Version)
+	assert.NotEmpty(t, status.Commit)
+
+	recorder := httptest.NewRecorder()
+	reporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var served Status
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &served))
+	assert.Equal(t, "udpx test", served.Service)
+	assert.Equal(t, uint64(3), served.Counters["test_tokens_issued_total"])
+}
+
+func TestBuildVersion(t *testing.T) {
+	version, commit := BuildVersion()
+	assert.NotEmpty(t, version)
+	assert.NotEmpty(t, commit)
+
+	Version, Commit = "v1.2.3", "abc123"
+	defer func() { Version, Commit = "", "" }()
+
+	version, commit = BuildVersion()
+	assert.Equal(t, "v1.2.3", version)
+	assert.Equal(t, "abc123", commit)
+	assert.Equal(t, "v1.2.3 (abc123)", VersionString())
+}
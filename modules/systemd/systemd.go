@@ -0,0 +1,192 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package systemd takes the sockets systemd passes to socket activated services. systemd holds the sockets
+// open across restarts, so packets and connections that arrive while the service restarts are queued in the
+// kernel instead of dropped. Sockets are looked up by the name given with FileDescriptorName= in the socket
+// unit, which defaults to the name of the socket unit, such as "gateway.socket". Several sockets can share a
+// name, such as one udp socket per thread from socket units with ReusePort=yes.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ListenFdsStart is the first file descriptor systemd passes
+const ListenFdsStart = 3
+
+// Sockets are the sockets passed to the process, by name. A nil *Sockets has none, so services can call it
+// whether or not they were socket activated.
+type Sockets struct {
+	files map[string][]*os.File
+}
+
+// parseEnvironment returns the name of each socket passed, or nil if the sockets are for another process
+func parseEnvironment(pid int, listenPid string, listenFds string, listenFdNames string) ([]string, error) {
+	if listenPid == "" || listenFds == "" {
+		return nil, nil
+	}
+
+	value, err := strconv.Atoi(listenPid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID: %v", err)
+	}
+	if value != pid {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(listenFds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", listenFds)
+	}
+
+	names := make([]string, count)
+	if listenFdNames != "" {
+		values := strings.Split(listenFdNames, ":")
+		if len(values) != count {
+			return nil, fmt.Errorf("LISTEN_FDNAMES has %d names for %d sockets", len(values), count)
+		}
+		copy(names, values)
+	}
+	for i := range names {
+		if names[i] == "" {
+			names[i] = "unknown"
+		}
+	}
+
+	return names, nil
+}
+
+func createSockets(files []*os.File, names []string) *Sockets {
+	sockets := &Sockets{files: make(map[string][]*os.File)}
+	for i, file := range files {
+		sockets.files[names[i]] = append(sockets.files[names[i]], file)
+	}
+	return sockets
+}
+
+// PacketConns returns the udp sockets with the name, in the order they were passed, or nil if there aren't
+// any. Sockets can only be taken once.
+func (sockets *Sockets) PacketConns(name string) ([]*net.UDPConn, error) {
+	files := sockets.take(name)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	var conns []*net.UDPConn
+	for _, file := range files {
+		conn, err := filePacketConn(file)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, fmt.Errorf("socket %q: %v", name, err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+func filePacketConn(file *os.File) (*net.UDPConn, error) {
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("not a udp socket")
+	}
+	return udpConn, nil
+}
+
+// Listener returns the stream socket with the name, or nil if there isn't one. Sockets can only be taken once.
+func (sockets *Sockets) Listener(name string) (net.Listener, error) {
+	files := sockets.take(name)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if len(files) > 1 {
+		return nil, fmt.Errorf("%d sockets are named %q", len(files), name)
+	}
+
+	listener, err := net.FileListener(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("socket %q: %v", name, err)
+	}
+	return listener, nil
+}
+
+// Names are the names of the sockets not taken yet
+func (sockets *Sockets) Names() []string {
+	if sockets == nil {
+		return nil
+	}
+	names := make([]string, 0, len(sockets.files))
+	for name := range sockets.files {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Close closes the sockets not taken
+func (sockets *Sockets) Close() {
+	if sockets == nil {
+		return
+	}
+	for name, files := range sockets.files {
+		for _, file := range files {
+			file.Close()
+		}
+		delete(sockets.files, name)
+	}
+}
+
+func (sockets *Sockets) take(name string) []*os.File {
+	if sockets == nil {
+		return nil
+	}
+	files := sockets.files[name]
+	delete(sockets.files, name)
+	return files
+}
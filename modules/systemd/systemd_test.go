@@ -0,0 +1,159 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnvironment(t *testing.T) {
+	t.Parallel()
+
+	names, err := parseEnvironment(100, "", "", "")
+	assert.Nil(t, err)
+	assert.Nil(t, names)
+
+	// sockets passed to another process are left alone
+
+	names, err = parseEnvironment(100, "200", "2", "udp:http")
+	assert.Nil(t, err)
+	assert.Nil(t, names)
+
+	names, err = parseEnvironment(100, "100", "2", "udp:http")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"udp", "http"}, names)
+
+	names, err = parseEnvironment(100, "100", "2", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unknown", "unknown"}, names)
+
+	_, err = parseEnvironment(100, "100", "2", "udp")
+	assert.NotNil(t, err)
+
+	_, err = parseEnvironment(100, "100", "two", "")
+	assert.NotNil(t, err)
+
+	_, err = parseEnvironment(100, "pid", "2", "")
+	assert.NotNil(t, err)
+}
+
+func TestSockets(t *testing.T) {
+	t.Parallel()
+
+	var udpConns []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer udpConn.Close()
+		udpConns = append(udpConns, udpConn)
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	var files []*os.File
+	for _, socket := range []interface{ File() (*os.File, error) }{udpConns[0], udpConns[1], listener, listener, listener} {
+		file, err := socket.File()
+		if !assert.Nil(t, err) {
+			return
+		}
+		files = append(files, file)
+	}
+
+	sockets := createSockets(files, []string{"udp", "udp", "http", "stream", "stream"})
+	defer sockets.Close()
+
+	assert.ElementsMatch(t, []string{"udp", "http", "stream"}, sockets.Names())
+
+	// sockets sharing a name come back in the order they were passed
+
+	conns, err := sockets.PacketConns("udp")
+	if !assert.Nil(t, err) || !assert.Equal(t, 2, len(conns)) {
+		return
+	}
+	for i := range conns {
+		defer conns[i].Close()
+		assert.Equal(t, udpConns[i].LocalAddr().String(), conns[i].LocalAddr().String())
+	}
+
+	httpListener, err := sockets.Listener("http")
+	if !assert.Nil(t, err) || !assert.NotNil(t, httpListener) {
+		return
+	}
+	defer httpListener.Close()
+	assert.Equal(t, listener.Addr().String(), httpListener.Addr().String())
+
+	// a stream socket is not a udp socket, and a listener has to be the only socket with its name
+
+	_, err = sockets.Listener("stream")
+	assert.NotNil(t, err)
+
+	file, err := listener.File()
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = createSockets([]*os.File{file}, []string{"stream"}).PacketConns("stream")
+	assert.NotNil(t, err)
+
+	// each socket is only taken once
+
+	conns, err = sockets.PacketConns("udp")
+	assert.Nil(t, err)
+	assert.Nil(t, conns)
+	assert.Empty(t, sockets.Names())
+}
+
+func TestNoSockets(t *testing.T) {
+	t.Parallel()
+
+	var sockets *Sockets
+
+	conns, err := sockets.PacketConns("udp")
+	assert.Nil(t, err)
+	assert.Nil(t, conns)
+
+	listener, err := sockets.Listener("http")
+	assert.Nil(t, err)
+	assert.Nil(t, listener)
+
+	assert.Empty(t, sockets.Names())
+	sockets.Close()
+}
@@ -0,0 +1,257 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/networknext/udpx/modules/envvar"
+	"github.com/networknext/udpx/modules/status"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing is off unless OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. When it is on,
+// spans are batched to the endpoint over OTLP/HTTP, and TRACE_SAMPLE_RATIO of sessions and requests are traced.
+
+var enabled atomic.Bool
+
+var sessionSampler atomic.Pointer[sdktrace.Sampler]
+
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer("github.com/networknext/udpx")
+}
+
+var propagator = propagation.TraceContext{}
+
+// Start configures tracing for the service from the environment. The returned function flushes and stops it.
+func Start(serviceName string) (func(context.Context) error, error) {
+	endpoint := envvar.Get("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if endpoint == "" {
+		endpoint = envvar.Get("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+		if endpoint == "" {
+			return func(context.Context) error { return nil }, nil
+		}
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+
+	ratio, err := envvar.GetFloat("TRACE_SAMPLE_RATIO", 1)
+	if err != nil {
+		return nil, err
+	}
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("TRACE_SAMPLE_RATIO must be between 0 and 1")
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace exporter: %v", err)
+	}
+
+	provider := start(sdktrace.NewBatchSpanProcessor(exporter), serviceName, ratio)
+
+	return provider.Shutdown, nil
+}
+
+func start(processor sdktrace.SpanProcessor, serviceName string, ratio float64) *sdktrace.TracerProvider {
+	version, commit := status.BuildVersion()
+
+	sampler := sdktrace.TraceIDRatioBased(ratio)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithIDGenerator(idGenerator{}),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", version),
+			attribute.String("vcs.ref.head.revision", commit),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	sessionSampler.Store(&sampler)
+	enabled.Store(true)
+
+	return provider
+}
+
+// Enabled reports whether spans are being exported, so hot paths can skip the work of building them.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// StartSpan starts a span as a child of the span in ctx.
+func StartSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, options...)
+}
+
+// SessionId is the span attribute identifying a session.
+func SessionId(sessionId []byte) attribute.KeyValue {
+	return attribute.String("udpx.session_id", hex.EncodeToString(sessionId))
+}
+
+// ---------------------------------------------------------------------------------------------------
+
+// A session's trace and root span ids are derived from its session id, so auth and every gateway the session
+// passes through put their spans for it in the same trace without anything extra on the wire.
+
+type sessionKey struct{}
+
+func sessionIds(sessionId []byte) (trace.TraceID, trace.SpanID) {
+	hash := sha256.Sum256(append([]byte("udpx session trace "), sessionId...))
+	var traceId trace.TraceID
+	var spanId trace.SpanID
+	copy(traceId[:], hash[0:16])
+	copy(spanId[:], hash[16:24])
+	return traceId, spanId
+}
+
+// StartSession starts the root span of the session's trace, linked to the span in ctx. Auth starts it when it
+// issues the connect token.
+func StartSession(ctx context.Context, sessionId []byte, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	options = append(options, trace.WithNewRoot(), trace.WithLinks(trace.LinkFromContext(ctx)), trace.WithAttributes(SessionId(sessionId)))
+	return tracer().Start(context.WithValue(ctx, sessionKey{}, sessionId), "udpx.session", options...)
+}
+
+// SessionContext returns ctx with the session's root span as its remote parent, for spans about the session on
+// services that did not start it.
+func SessionContext(ctx context.Context, sessionId []byte) context.Context {
+	if !enabled.Load() {
+		return ctx
+	}
+	traceId, spanId := sessionIds(sessionId)
+	flags := trace.TraceFlags(0)
+	sampler := *sessionSampler.Load()
+	if sampler.ShouldSample(sdktrace.SamplingParameters{TraceID: traceId}).Decision == sdktrace.RecordAndSample {
+		flags = trace.FlagsSampled
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: flags,
+		Remote:     true,
+	}))
+}
+
+type idGenerator struct{}
+
+func (idGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	if sessionId, ok := ctx.Value(sessionKey{}).([]byte); ok {
+		return sessionIds(sessionId)
+	}
+	var traceId trace.TraceID
+	rand.Read(traceId[:])
+	return traceId, randomSpanId()
+}
+
+func (idGenerator) NewSpanID(ctx context.Context, traceId trace.TraceID) trace.SpanID {
+	return randomSpanId()
+}
+
+func randomSpanId() trace.SpanID {
+	var spanId trace.SpanID
+	for binary.LittleEndian.Uint64(spanId[:]) == 0 {
+		rand.Read(spanId[:])
+	}
+	return spanId
+}
+
+// ---------------------------------------------------------------------------------------------------
+
+// Handler traces the requests served by next, continuing the trace of the caller if it sent one.
+func Handler(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !enabled.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		))
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Transport sends the trace of each request's context along with it, so the server's spans join it.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return transport{base: base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if enabled.Load() {
+		r = r.Clone(r.Context())
+		propagator.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	}
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,148 @@
+/*
+	Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+	This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func startTest(t *testing.T, ratio float64) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := start(sdktrace.NewSimpleSpanProcessor(exporter), "test", ratio)
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		enabled.Store(false)
+	})
+	return exporter
+}
+
+func TestDisabled(t *testing.T) {
+	assert.False(t, Enabled())
+
+	ctx := context.Background()
+	assert.Equal(t, ctx, SessionContext(ctx, []byte("session")))
+
+	var header http.Header
+	handler := Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	request := httptest.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	assert.Empty(t, header.Get("traceparent"))
+}
+
+func TestSessionTrace(t *testing.T) {
+	exporter := startTest(t, 1)
+
+	sessionId := []byte("0123456789abcdef0123456789abcdef")
+
+	ctx, request := StartSpan(context.Background(), "auth.connect_token")
+	_, session := StartSession(ctx, sessionId)
+	session.End()
+	request.End()
+
+	_, challenge := StartSpan(SessionContext(context.Background(), sessionId), "gateway.challenge")
+	challenge.End()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+
+	root := spans[0]
+	assert.Equal(t, "udpx.session", root.Name)
+	assert.False(t, root.Parent.IsValid())
+	require.Len(t, root.Links, 1)
+	assert.Equal(t, spans[1].SpanContext.SpanID(), root.Links[0].SpanContext.SpanID())
+
+	gateway := spans[2]
+	assert.Equal(t, root.SpanContext.TraceID(), gateway.SpanContext.TraceID())
+	assert.Equal(t, root.SpanContext.SpanID(), gateway.Parent.SpanID())
+	assert.NotEqual(t, spans[1].SpanContext.TraceID(), root.SpanContext.TraceID())
+
+	_, other := StartSpan(SessionContext(context.Background(), []byte("another session")), "gateway.challenge")
+	other.End()
+	assert.NotEqual(t, root.SpanContext.TraceID(), exporter.GetSpans()[3].SpanContext.TraceID())
+}
+
+func TestSessionNotSampled(t *testing.T) {
+	exporter := startTest(t, 0)
+
+	sessionId := []byte("session")
+
+	_, session := StartSession(context.Background(), sessionId)
+	session.End()
+
+	ctx := SessionContext(context.Background(), sessionId)
+	assert.False(t, trace.SpanContextFromContext(ctx).IsSampled())
+	_, challenge := StartSpan(ctx, "gateway.challenge")
+	challenge.End()
+
+	assert.Empty(t, exporter.GetSpans())
+}
+
+func TestPropagation(t *testing.T) {
+	exporter := startTest(t, 1)
+
+	server := httptest.NewServer(Handler("auth.session_token", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})))
+	defer server.Close()
+
+	client := http.Client{Transport: Transport(nil)}
+
+	ctx, refresh := StartSpan(context.Background(), "gateway.refresh_session_token")
+	request, err := http.NewRequestWithContext(ctx, "POST", server.URL+"/session_token", nil)
+	require.NoError(t, err)
+	response, err := client.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+	refresh.End()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+
+	handler := spans[0]
+	assert.Equal(t, "auth.session_token", handler.Name)
+	assert.Equal(t, trace.SpanKindServer, handler.SpanKind)
+	assert.Equal(t, spans[1].SpanContext.TraceID(), handler.SpanContext.TraceID())
+	assert.Equal(t, spans[1].SpanContext.SpanID(), handler.Parent.SpanID())
+	assert.Equal(t, "Error", handler.Status.Code.String())
+}
@@ -0,0 +1,213 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+// DTLS connections carry udpx packets in DTLS records, for deployments that require standardized
+// TLS-family crypto on the wire. pion/dtls implements DTLS 1.2 only, so that is what is negotiated,
+// restricted to ECDHE with AES-GCM and the extended master secret. Connection ids let a client keep
+// its connection when its address changes.
+
+const DTLSConnectionIdBytes = 8
+const DTLSIdleTimeout = 10 * time.Second
+
+var DTLSCipherSuites = []dtls.CipherSuiteID{
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+type DTLSConn struct {
+	conn *dtls.Conn
+}
+
+type DTLSListener struct {
+	listener net.Listener
+}
+
+// ListenDTLS listens for DTLS connections, presenting the certificate returned by getCertificate.
+func ListenDTLS(address string, getCertificate func() (*tls.Certificate, error)) (*DTLSListener, error) {
+
+	listenAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %v", err)
+	}
+
+	config := &dtls.Config{
+		GetCertificate: func(*dtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return getCertificate()
+		},
+		CipherSuites:          DTLSCipherSuites,
+		ExtendedMasterSecret:  dtls.RequireExtendedMasterSecret,
+		ConnectionIDGenerator: dtls.RandomCIDGenerator(DTLSConnectionIdBytes),
+	}
+
+	listener, err := dtls.Listen("udp", listenAddress, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DTLSListener{listener: listener}, nil
+}
+
+// Accept returns the next connection. Its handshake runs in AcceptDTLS, so a slow client doesn't hold up others.
+func (l *DTLSListener) Accept() (net.Conn, error) {
+	return l.listener.Accept()
+}
+
+func (l *DTLSListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *DTLSListener) Close() error {
+	return l.listener.Close()
+}
+
+// AcceptDTLS completes the handshake of a connection from a listener, then sends it the address its packets
+// reach the gateway from.
+func AcceptDTLS(conn net.Conn, clientAddress *net.UDPAddr, timeout time.Duration) (*DTLSConn, error) {
+
+	dtlsConn, ok := conn.(*dtls.Conn)
+	if !ok {
+		return nil, fmt.Errorf("not a dtls connection")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := dtlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("handshake failed: %v", err)
+	}
+
+	if _, err := dtlsConn.Write([]byte(clientAddress.String())); err != nil {
+		return nil, fmt.Errorf("could not write client address: %v", err)
+	}
+
+	return &DTLSConn{conn: dtlsConn}, nil
+}
+
+// DialDTLS connects to a gateway, and returns the address the gateway sees packets from the connection
+// coming from. If serverName is set, the gateway certificate is verified against the system roots for that
+// name. Otherwise it is not verified, since udpx packets are authenticated end to end already.
+func DialDTLS(address string, serverName string, timeout time.Duration) (*DTLSConn, *net.UDPAddr, error) {
+
+	gatewayAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid address: %v", err)
+	}
+
+	config := &dtls.Config{
+		CipherSuites:          DTLSCipherSuites,
+		ExtendedMasterSecret:  dtls.RequireExtendedMasterSecret,
+		ConnectionIDGenerator: dtls.OnlySendCIDGenerator(),
+		ServerName:            serverName,
+		InsecureSkipVerify:    serverName == "",
+	}
+
+	if serverName != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not load root certificates: %v", err)
+		}
+		config.RootCAs = rootCAs
+	}
+
+	conn, err := dtls.Dial("udp", gatewayAddress, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("handshake failed: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	addressData := make([]byte, MaxAddressBytes)
+	addressBytes, err := conn.Read(addressData)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not read client address: %v", err)
+	}
+
+	clientAddress, err := net.ResolveUDPAddr("udp", string(addressData[:addressBytes]))
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("invalid client address: %v", err)
+	}
+
+	return &DTLSConn{conn: conn}, clientAddress, nil
+}
+
+func (c *DTLSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ReadPacket returns the next packet. DTLS has no keep-alives of its own, so it fails once nothing has
+// arrived for DTLSIdleTimeout.
+func (c *DTLSConn) ReadPacket() ([]byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(DTLSIdleTimeout))
+	packetData := make([]byte, MaxPacketSize)
+	packetBytes, err := c.conn.Read(packetData)
+	if err != nil {
+		return nil, err
+	}
+	return packetData[:packetBytes], nil
+}
+
+// WritePacket sends a packet in a single record. It is safe to call from more than one goroutine.
+func (c *DTLSConn) WritePacket(packetData []byte) error {
+	if len(packetData) > MaxPacketSize {
+		return fmt.Errorf("packet is too large: %d bytes, max is %d", len(packetData), MaxPacketSize)
+	}
+	_, err := c.conn.Write(packetData)
+	return err
+}
+
+func (c *DTLSConn) Close() error {
+	return c.conn.Close()
+}
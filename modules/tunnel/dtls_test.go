@@ -0,0 +1,130 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tunnel
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDTLSConn(t *testing.T) {
+
+	t.Parallel()
+
+	certificate, err := GenerateCertificate(time.Hour)
+	assert.Nil(t, err)
+
+	listener, err := ListenDTLS("127.0.0.1:0", func() (*tls.Certificate, error) { return certificate, nil })
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	clientAddress := core.ParseAddress("127.0.0.1:31000")
+
+	accepted := make(chan *DTLSConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		dtlsConn, err := AcceptDTLS(conn, clientAddress, 5*time.Second)
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- dtlsConn
+	}()
+
+	client, address, err := DialDTLS(listener.Addr().String(), "", 5*time.Second)
+	assert.Nil(t, err)
+	assert.True(t, core.AddressEqual(clientAddress, address))
+	defer client.Close()
+
+	server := <-accepted
+	assert.NotNil(t, server)
+	defer server.Close()
+
+	for _, packetBytes := range []int{1, 100, core.MinPacketSize, MaxPacketSize} {
+		packetData := make([]byte, packetBytes)
+		for i := range packetData {
+			packetData[i] = byte(i + packetBytes)
+		}
+
+		assert.Nil(t, client.WritePacket(packetData))
+		received, err := server.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, packetData, received)
+
+		assert.Nil(t, server.WritePacket(packetData))
+		received, err = client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, packetData, received)
+	}
+
+	assert.NotNil(t, client.WritePacket(make([]byte, MaxPacketSize+1)))
+
+	// closing one end ends reads on the other
+
+	client.Close()
+	_, err = server.ReadPacket()
+	assert.NotNil(t, err)
+}
+
+func TestDialDTLSVerify(t *testing.T) {
+
+	t.Parallel()
+
+	certificate, err := GenerateCertificate(time.Hour)
+	assert.Nil(t, err)
+
+	listener, err := ListenDTLS("127.0.0.1:0", func() (*tls.Certificate, error) { return certificate, nil })
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		AcceptDTLS(conn, core.ParseAddress("127.0.0.1:31000"), time.Second)
+		conn.Close()
+	}()
+
+	// a self-signed certificate doesn't verify once a server name is given
+
+	_, _, err = DialDTLS(listener.Addr().String(), "gateway.example.com", time.Second)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,259 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Protocol is the ALPN protocol of QUIC connections carrying udpx packets.
+
+const Protocol = "udpx"
+
+const MaxPacketSize = 1500
+const MaxAddressBytes = 64
+const ReassemblyTimeout = time.Second
+const ReassemblyMemory = 64 * 1024
+
+// PacketOverheadBytes covers the short header with the longest connection id and packet number, the
+// AEAD tag, and the DATAGRAM frame header. MinDatagramBytes always fits in the minimum QUIC packet size.
+
+const PacketOverheadBytes = 1 + 20 + 4 + 16 + 3
+const MinDatagramBytes = 1200 - PacketOverheadBytes
+
+var oversizeDatagram [64 * 1024]byte
+
+// Fragment splits a packet into datagrams of at most maxDatagramBytes, in the same format as fragmented
+// payloads. Unlike payload fragments, the last one is not padded out.
+func Fragment(packetId uint16, packetData []byte, maxDatagramBytes int) ([][]byte, error) {
+	fragments, err := core.FragmentPayload(packetId, packetData, maxDatagramBytes)
+	if err != nil {
+		return nil, err
+	}
+	lastFragmentBytes := core.FragmentHeaderBytes + len(packetData) - (len(fragments)-1)*(maxDatagramBytes-core.FragmentHeaderBytes)
+	fragments[len(fragments)-1] = fragments[len(fragments)-1][:lastFragmentBytes]
+	return fragments, nil
+}
+
+// Conn carries udpx packets in QUIC datagrams, so QUIC takes care of path mtu discovery and of clients
+// changing address. Packets go in a single datagram when one that large fits the path mtu, and are
+// fragmented to the largest datagram that does otherwise.
+type Conn struct {
+	conn        *quic.Conn
+	reassembler *core.Reassembler
+	mutex       sync.Mutex
+	packetId    uint16
+}
+
+func Config() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams: true,
+		MaxIdleTimeout:  10 * time.Second,
+		KeepAlivePeriod: time.Second,
+	}
+}
+
+func createConn(conn *quic.Conn) *Conn {
+	return &Conn{conn: conn, reassembler: core.CreateReassembler(ReassemblyTimeout, ReassemblyMemory)}
+}
+
+// Dial connects to a gateway, and returns the address the gateway sees packets from the connection
+// coming from, which the packet filter is keyed on. The certificate is not verified: udpx packets are
+// authenticated and encrypted end to end already, and QUIC is only there to get them through the network.
+func Dial(address string, timeout time.Duration) (*Conn, *net.UDPAddr, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{Protocol}}
+
+	conn, err := quic.DialAddr(ctx, address, tlsConfig, Config())
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect: %v", err)
+	}
+
+	stream, err := conn.AcceptUniStream(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("could not read client address: %v", err)
+	}
+
+	addressData, err := io.ReadAll(io.LimitReader(stream, MaxAddressBytes))
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("could not read client address: %v", err)
+	}
+
+	clientAddress, err := net.ResolveUDPAddr("udp", string(addressData))
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("invalid client address: %v", err)
+	}
+
+	return createConn(conn), clientAddress, nil
+}
+
+// Accept sends a connection from a listener the address its packets reach the gateway from.
+func Accept(conn *quic.Conn, clientAddress *net.UDPAddr) (*Conn, error) {
+
+	stream, err := conn.OpenUniStream()
+	if err != nil {
+		return nil, fmt.Errorf("could not open stream: %v", err)
+	}
+
+	_, err = stream.Write([]byte(clientAddress.String()))
+	stream.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not write client address: %v", err)
+	}
+
+	return createConn(conn), nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ReadPacket returns the next packet, once all of its datagrams have arrived.
+func (c *Conn) ReadPacket() ([]byte, error) {
+	for {
+		datagram, err := c.conn.ReceiveDatagram(c.conn.Context())
+		if err != nil {
+			return nil, err
+		}
+		packetData, err := c.reassembler.ProcessFragment(datagram, time.Now())
+		if err != nil {
+			core.Debug("invalid datagram: %v", err)
+			continue
+		}
+		if packetData != nil {
+			return packetData, nil
+		}
+	}
+}
+
+// WritePacket sends a packet. It is safe to call from more than one goroutine.
+func (c *Conn) WritePacket(packetData []byte) error {
+
+	if len(packetData) > MaxPacketSize {
+		return fmt.Errorf("packet is too large: %d bytes, max is %d", len(packetData), MaxPacketSize)
+	}
+
+	c.mutex.Lock()
+	packetId := c.packetId
+	c.packetId++
+	c.mutex.Unlock()
+
+	maxDatagramBytes := core.FragmentHeaderBytes + len(packetData)
+	if maxDatagramBytes > c.MaxDatagramBytes() {
+		maxDatagramBytes = c.MaxDatagramBytes()
+	}
+
+	fragments, err := Fragment(packetId, packetData, maxDatagramBytes)
+	if err != nil {
+		return err
+	}
+
+	for _, fragment := range fragments {
+		if err := c.conn.SendDatagram(fragment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MaxDatagramBytes returns the largest datagram that fits in a packet at the current path mtu estimate.
+// quic-go only reports its limit when a datagram is too large, so ask it with one that always is. Once
+// path mtu discovery raises the estimate, that limit no longer leaves room for the packet header and tag,
+// and datagrams between the two sizes are dropped silently, so leave room for them here.
+func (c *Conn) MaxDatagramBytes() int {
+	var tooLarge *quic.DatagramTooLargeError
+	if !errors.As(c.conn.SendDatagram(oversizeDatagram[:]), &tooLarge) {
+		return MinDatagramBytes
+	}
+	return max(int(tooLarge.MaxDatagramPayloadSize)-PacketOverheadBytes, MinDatagramBytes)
+}
+
+// GenerateCertificate creates a self-signed certificate. Browsers accept these from webtransport servers
+// given their hash, as long as they are ECDSA and valid for two weeks or less.
+func GenerateCertificate(lifetime time.Duration) (*tls.Certificate, error) {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: "udpx gateway"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certificateData, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{certificateData}, PrivateKey: privateKey}, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
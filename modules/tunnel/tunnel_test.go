@@ -0,0 +1,156 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFragment(t *testing.T) {
+
+	t.Parallel()
+
+	packetData := make([]byte, 1323)
+	for i := range packetData {
+		packetData[i] = byte(i)
+	}
+
+	// packets that fit go in a single datagram, otherwise only the last fragment is smaller
+
+	fragments, err := Fragment(7, packetData, core.FragmentHeaderBytes+len(packetData))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(fragments))
+	assert.Equal(t, core.FragmentHeaderBytes+len(packetData), len(fragments[0]))
+
+	fragments, err = Fragment(7, packetData, 500)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(fragments))
+	assert.Equal(t, 500, len(fragments[0]))
+	assert.Equal(t, 500, len(fragments[1]))
+	assert.Equal(t, core.FragmentHeaderBytes+len(packetData)-2*(500-core.FragmentHeaderBytes), len(fragments[2]))
+
+	reassembler := core.CreateReassembler(time.Second, 64*1024)
+	for i := len(fragments) - 1; i >= 0; i-- {
+		reassembled, err := reassembler.ProcessFragment(fragments[i], time.Now())
+		assert.Nil(t, err)
+		if i > 0 {
+			assert.Nil(t, reassembled)
+		} else {
+			assert.Equal(t, packetData, reassembled)
+		}
+	}
+
+	_, err = Fragment(7, packetData, core.FragmentHeaderBytes)
+	assert.NotNil(t, err)
+}
+
+func TestConn(t *testing.T) {
+
+	t.Parallel()
+
+	certificate, err := GenerateCertificate(time.Hour)
+	assert.Nil(t, err)
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{*certificate}, NextProtos: []string{Protocol}}
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, Config())
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	clientAddress := core.ParseAddress("127.0.0.1:31000")
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			close(accepted)
+			return
+		}
+		tunnelConn, err := Accept(conn, clientAddress)
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- tunnelConn
+	}()
+
+	client, address, err := Dial(listener.Addr().String(), 5*time.Second)
+	assert.Nil(t, err)
+	assert.True(t, core.AddressEqual(clientAddress, address))
+	defer client.Close()
+
+	server := <-accepted
+	assert.NotNil(t, server)
+	defer server.Close()
+
+	// packets up to the largest udpx packet get through whole, however the connection splits them
+
+	for _, packetBytes := range []int{1, 100, core.MinPacketSize, MaxPacketSize} {
+		packetData := make([]byte, packetBytes)
+		for i := range packetData {
+			packetData[i] = byte(i + packetBytes)
+		}
+
+		assert.Nil(t, client.WritePacket(packetData))
+		received, err := server.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, packetData, received)
+
+		assert.Nil(t, server.WritePacket(packetData))
+		received, err = client.ReadPacket()
+		assert.Nil(t, err)
+		assert.Equal(t, packetData, received)
+	}
+
+	assert.NotNil(t, client.WritePacket(make([]byte, MaxPacketSize+1)))
+
+	// closing one end ends reads on the other
+
+	client.Close()
+	_, err = server.ReadPacket()
+	assert.NotNil(t, err)
+}
+
+func TestDialInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	_, _, err := Dial("127.0.0.1:1", 200*time.Millisecond)
+	assert.NotNil(t, err)
+}
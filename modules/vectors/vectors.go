@@ -0,0 +1,394 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package vectors
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/networknext/udpx/modules/core"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Test vectors pin down the wire format, so implementations in other languages can check they produce the same
+// bytes as this one. Each file holds a description and a list of vectors, with byte strings in hex.
+
+const FilterFile = "packet_filter.json"
+const ConnectTokenFile = "connect_token.json"
+const PacketHeaderFile = "packet_header.json"
+
+type Hex []byte
+
+func (h Hex) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *Hex) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*h = data
+	return nil
+}
+
+type File[T any] struct {
+	Description string `json:"description"`
+	Vectors     []T    `json:"vectors"`
+}
+
+// FilterVector is the chonkle and pittle for a packet. Packets with version 0 hash with the magic, packets
+// with version 1 with the filter key.
+type FilterVector struct {
+	Name         string `json:"name"`
+	Version      uint8  `json:"version"`
+	Magic        Hex    `json:"magic,omitempty"`
+	FilterKey    Hex    `json:"filter_key,omitempty"`
+	FromAddress  string `json:"from_address"`
+	ToAddress    string `json:"to_address"`
+	PacketLength int    `json:"packet_length"`
+	Chonkle      Hex    `json:"chonkle"`
+	Pittle       Hex    `json:"pittle"`
+}
+
+// ConnectTokenVector is a connect token, which is the connect data followed by the session token and its
+// crypto_sign_detached signature by the auth signing key, encrypted to the gateway public key. The encryption uses
+// a fixed ephemeral key here so the vectors are reproducible; real tokens use a random one.
+type ConnectTokenVector struct {
+	Name                  string `json:"name"`
+	ClientPublicKey       Hex    `json:"client_public_key"`
+	ClientPrivateKey      Hex    `json:"client_private_key"`
+	GatewayAddress        string `json:"gateway_address"`
+	GatewayPublicKey      Hex    `json:"gateway_public_key"`
+	GatewayPrivateKey     Hex    `json:"gateway_private_key"`
+	AuthPublicKey         Hex    `json:"auth_public_key"`
+	AuthPrivateKey        Hex    `json:"auth_private_key"`
+	AuthSignPublicKey     Hex    `json:"auth_sign_public_key"`
+	AuthSignPrivateKey    Hex    `json:"auth_sign_private_key"`
+	EnvelopeUpKbps        uint32 `json:"envelope_up_kbps"`
+	EnvelopeDownKbps      uint32 `json:"envelope_down_kbps"`
+	PacketsPerSecond      uint8  `json:"packets_per_second"`
+	FECDataShards         uint8  `json:"fec_data_shards"`
+	FECParityShards       uint8  `json:"fec_parity_shards"`
+	IssueTimestamp        uint64 `json:"issue_timestamp"`
+	ExpireTimestamp       uint64 `json:"expire_timestamp"`
+	UserId                Hex    `json:"user_id"`
+	ClientIP              string `json:"client_ip,omitempty"`
+	TenantId              uint16 `json:"tenant_id"`
+	ConnectData           Hex    `json:"connect_data"`
+	SessionToken          Hex    `json:"session_token"`
+	Signature             Hex    `json:"signature"`
+	EphemeralPrivateKey   Hex    `json:"ephemeral_private_key"`
+	EncryptedSessionToken Hex    `json:"encrypted_session_token"`
+	ConnectToken          Hex    `json:"connect_token"`
+}
+
+// PacketHeaderVector is the unencrypted prefix and header of a packet between a client and the gateway, and
+// the pittle at the end of it. Everything in the packet after the sequence is encrypted before it is sent.
+type PacketHeaderVector struct {
+	Name                 string `json:"name"`
+	Version              uint8  `json:"version"`
+	PacketType           uint8  `json:"packet_type"`
+	Magic                Hex    `json:"magic,omitempty"`
+	FilterKey            Hex    `json:"filter_key,omitempty"`
+	FromAddress          string `json:"from_address"`
+	ToAddress            string `json:"to_address"`
+	SessionToken         Hex    `json:"session_token"`
+	SessionTokenSequence uint64 `json:"session_token_sequence"`
+	SessionId            Hex    `json:"session_id"`
+	Sequence             uint64 `json:"sequence"`
+	Ack                  uint64 `json:"ack"`
+	AckBits              Hex    `json:"ack_bits"`
+	GatewayId            Hex    `json:"gateway_id"`
+	ServerId             Hex    `json:"server_id"`
+	Flags                uint8  `json:"flags"`
+	ChannelId            uint8  `json:"channel_id"`
+	AckDelay             uint32 `json:"ack_delay"`
+	PayloadBytes         int    `json:"payload_bytes"`
+	Prefix               Hex    `json:"prefix"`
+	Header               Hex    `json:"header"`
+	Pittle               Hex    `json:"pittle"`
+}
+
+// fixed keys, so the vectors come out the same every time. public keys are the X25519 public keys of the private keys
+
+var clientPrivateKey = mustDecode("1d242b323940474e555c636a71787f868d949ba2a9b0b7bec5ccd3dae1e8eff6")
+var clientPublicKey = mustDecode("dacd3ef42235ccb603e11ec9fbcfdbd5dbf534741049e58b812c023f5260530a")
+var gatewayPrivateKey = mustDecode("40474e555c636a71787f868d949ba2a9b0b7bec5ccd3dae1e8eff6fd040b1219")
+var gatewayPublicKey = mustDecode("e7a0ed1ad488a5ff884c273c2a17b3d2cee3195f22308326f3845f70a85b5a2b")
+var authPrivateKey = mustDecode("dde4ebf2f900070e151c232a31383f464d545b626970777e858c939aa1a8afb6")
+var authPublicKey = mustDecode("a514d909835abce39c0ae2c3f48fbbc222dbbb86d0836105d241372f8b1cb528")
+var authSignPrivateKey = mustDecode("60676e757c838a91989fa6adb4bbc2c9d0d7dee5ecf3fa01080f161d242b3239e95985d3f1ad04b11a7797a0cb45324aedd085a6c7175f58780db4e0daf94d0a")
+var authSignPublicKey = mustDecode("e95985d3f1ad04b11a7797a0cb45324aedd085a6c7175f58780db4e0daf94d0a")
+var ephemeralPrivateKey = mustDecode("7a81888f969da4abb2b9c0c7ced5dce3eaf1f8ff060d141b222930373e454c53")
+
+func mustDecode(value string) []byte {
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// sequenceBytes fills a buffer with first, first+1, first+2...
+func sequenceBytes(bytes int, first byte) []byte {
+	data := make([]byte, bytes)
+	for i := range data {
+		data[i] = first + byte(i)
+	}
+	return data
+}
+
+func addressData(address string) ([]byte, uint16) {
+	var data [core.MaxAddressDataBytes]byte
+	var port uint16
+	bytes := core.GetAddressData(core.ParseAddress(address), data[:], &port)
+	return data[:bytes], port
+}
+
+func generateFilter(output []byte, pittle []byte, version uint8, magic []byte, filterKey []byte, fromAddress string, toAddress string, packetLength int) {
+	fromAddressData, fromPort := addressData(fromAddress)
+	toAddressData, toPort := addressData(toAddress)
+	if core.PacketFilterVersion(version) == core.PacketFilter_SipHash {
+		core.GenerateChonkleKeyed(output, filterKey, fromAddressData, fromPort, toAddressData, toPort, packetLength)
+		core.GeneratePittleKeyed(pittle, filterKey, fromAddressData, fromPort, toAddressData, toPort, packetLength)
+	} else {
+		core.GenerateChonkle(output, magic, fromAddressData, fromPort, toAddressData, toPort, packetLength)
+		core.GeneratePittle(pittle, fromAddressData, fromPort, toAddressData, toPort, packetLength)
+	}
+}
+
+func FilterVectors() File[FilterVector] {
+	vectors := []FilterVector{
+		{Name: "ipv4", Version: core.PacketVersion_FNV1a, Magic: make([]byte, core.MagicBytes), FromAddress: "127.0.0.1:30000", ToAddress: "127.0.0.1:40000", PacketLength: core.MinPacketSize},
+		{Name: "ipv4 magic", Version: core.PacketVersion_FNV1a, Magic: sequenceBytes(core.MagicBytes, 1), FromAddress: "203.0.113.7:51000", ToAddress: "198.51.100.1:40000", PacketLength: 1200},
+		{Name: "ipv6", Version: core.PacketVersion_FNV1a, Magic: make([]byte, core.MagicBytes), FromAddress: "[2001:db8::7]:51000", ToAddress: "[2001:db8::1]:40000", PacketLength: core.MinPacketSize + 100},
+		{Name: "ipv4 keyed", Version: core.PacketVersion_SipHash, FilterKey: sequenceBytes(core.SipHashKeyBytes, 0), FromAddress: "127.0.0.1:30000", ToAddress: "127.0.0.1:40000", PacketLength: core.MinPacketSize},
+		{Name: "ipv6 keyed", Version: core.PacketVersion_SipHash, FilterKey: sequenceBytes(core.SipHashKeyBytes, 100), FromAddress: "[2001:db8::7]:51000", ToAddress: "[2001:db8::1]:40000", PacketLength: 1400},
+	}
+	for i := range vectors {
+		vector := &vectors[i]
+		vector.Chonkle = make([]byte, core.ChonkleBytes)
+		vector.Pittle = make([]byte, core.PittleBytes)
+		generateFilter(vector.Chonkle, vector.Pittle, vector.Version, vector.Magic, vector.FilterKey, vector.FromAddress, vector.ToAddress, vector.PacketLength)
+	}
+	return File[FilterVector]{
+		Description: "chonkle and pittle for packets from from_address to to_address. the low four bits of version are the packet filter. filter 0 packets hash with the magic using FNV-1a, filter 1 packets with the filter key using SipHash-2-4",
+		Vectors:     vectors,
+	}
+}
+
+func ConnectTokenVectors() File[ConnectTokenVector] {
+	vectors := []ConnectTokenVector{
+		{Name: "ipv4", GatewayAddress: "127.0.0.1:40000", EnvelopeUpKbps: 256, EnvelopeDownKbps: 1024, PacketsPerSecond: 10, IssueTimestamp: 1700000000, ExpireTimestamp: 1700000060},
+		{Name: "ipv6 with fec", GatewayAddress: "[2001:db8::1]:40000", EnvelopeUpKbps: 2500, EnvelopeDownKbps: 10000, PacketsPerSecond: 60, FECDataShards: 8, FECParityShards: 3, IssueTimestamp: 1700000000, ExpireTimestamp: 1700003600},
+		{Name: "bound to client ip", GatewayAddress: "198.51.100.1:40000", EnvelopeUpKbps: 256, EnvelopeDownKbps: 256, PacketsPerSecond: 30, IssueTimestamp: 1700000000, ExpireTimestamp: 1700000060, ClientIP: "203.0.113.7"},
+		{Name: "tenant", GatewayAddress: "127.0.0.1:40000", EnvelopeUpKbps: 512, EnvelopeDownKbps: 2048, PacketsPerSecond: 60, IssueTimestamp: 1700000000, ExpireTimestamp: 1700000060, TenantId: 0x1234},
+	}
+	for i := range vectors {
+		vector := &vectors[i]
+		vector.ClientPublicKey = clientPublicKey
+		vector.ClientPrivateKey = clientPrivateKey
+		vector.GatewayPublicKey = gatewayPublicKey
+		vector.GatewayPrivateKey = gatewayPrivateKey
+		vector.AuthPublicKey = authPublicKey
+		vector.AuthPrivateKey = authPrivateKey
+		vector.AuthSignPublicKey = authSignPublicKey
+		vector.AuthSignPrivateKey = authSignPrivateKey
+		vector.UserId = sequenceBytes(core.UserIdBytes, byte(i*32))
+
+		connectData := core.ConnectData{
+			GatewayAddress:   *core.ParseAddress(vector.GatewayAddress),
+			EnvelopeUpKbps:   vector.EnvelopeUpKbps,
+			EnvelopeDownKbps: vector.EnvelopeDownKbps,
+			PacketsPerSecond: vector.PacketsPerSecond,
+			FECDataShards:    vector.FECDataShards,
+			FECParityShards:  vector.FECParityShards,
+			ExpireTimestamp:  vector.ExpireTimestamp,
+		}
+		copy(connectData.ClientPublicKey[:], clientPublicKey)
+		copy(connectData.ClientPrivateKey[:], clientPrivateKey)
+		copy(connectData.GatewayPublicKey[:], gatewayPublicKey)
+
+		sessionToken := core.SessionToken{
+			IssueTimestamp:   vector.IssueTimestamp,
+			ExpireTimestamp:  vector.ExpireTimestamp,
+			EnvelopeUpKbps:   vector.EnvelopeUpKbps,
+			EnvelopeDownKbps: vector.EnvelopeDownKbps,
+			PacketsPerSecond: vector.PacketsPerSecond,
+			TenantId:         vector.TenantId,
+		}
+		copy(sessionToken.SessionId[:], clientPublicKey)
+		copy(sessionToken.UserId[:], vector.UserId)
+		if vector.ClientIP != "" {
+			sessionToken.BindClientIP(net.ParseIP(vector.ClientIP))
+		}
+
+		index := 0
+		vector.ConnectData = make([]byte, core.ConnectDataBytes)
+		core.WriteConnectData(vector.ConnectData, &index, &connectData)
+
+		index = 0
+		vector.SessionToken = make([]byte, core.SessionTokenBytes)
+		core.WriteSessionToken(vector.SessionToken, &index, &sessionToken)
+
+		// ed25519 signatures are deterministic, so sign with the standard library to get the same bytes as
+		// libsodium without depending on it
+
+		vector.Signature = ed25519.Sign(ed25519.PrivateKey(authSignPrivateKey), vector.SessionToken)
+
+		vector.EphemeralPrivateKey = ephemeralPrivateKey
+		vector.EncryptedSessionToken = encryptSessionToken(vector.SessionToken, vector.Signature, ephemeralPrivateKey)
+
+		connectToken := make([]byte, core.ConnectTokenBytes)
+		index = 0
+		core.WriteBytes(connectToken, &index, vector.ConnectData, core.ConnectDataBytes)
+		core.WriteBytes(connectToken, &index, vector.EncryptedSessionToken, core.EncryptedSessionTokenBytes)
+		vector.ConnectToken = connectToken
+	}
+	return File[ConnectTokenVector]{
+		Description: "connect tokens, which are connect_data followed by encrypted_session_token. encrypted_session_token is the public key of ephemeral_private_key, then session_token without its session id and the crypto_sign_detached signature of session_token by the auth sign private key, xored with crypto_stream_xchacha20 with a zero nonce. the key is HKDF-SHA256 of the crypto_box_beforenm shared key of the gateway public key and the ephemeral private key, salted with the session id, with info udpx session token",
+		Vectors:     vectors,
+	}
+}
+
+// encryptSessionToken encrypts a signed session token the way core.EncryptSessionToken does, with the standard
+// library and x/crypto instead of libsodium: the ephemeral public key, then the session token without its
+// session id and the signature, xored with xchacha20 keyed from the crypto_box_beforenm shared key
+func encryptSessionToken(sessionToken []byte, signature []byte, ephemeralPrivateKey []byte) []byte {
+	var receiverPublicKey, senderPrivateKey, senderPublicKey, sharedKey [core.PublicKeyBytes_Box]byte
+	copy(receiverPublicKey[:], gatewayPublicKey)
+	copy(senderPrivateKey[:], ephemeralPrivateKey)
+	curve25519.ScalarBaseMult(&senderPublicKey, &senderPrivateKey)
+	box.Precompute(&sharedKey, &receiverPublicKey, &senderPrivateKey)
+
+	sessionIdIndex := core.TimestampBytes + core.TimestampBytes
+	sessionId := sessionToken[sessionIdIndex : sessionIdIndex+core.SessionIdBytes]
+	key := make([]byte, core.KeyBytes_Stream)
+	core.HKDF(sharedKey[:], sessionId, []byte("udpx session token"), key)
+
+	tokenData := append(append(append([]byte{}, sessionToken[:sessionIdIndex]...), sessionToken[sessionIdIndex+core.SessionIdBytes:]...), signature...)
+	cipher, err := chacha20.NewUnauthenticatedCipher(key, make([]byte, core.NonceBytes_Stream))
+	if err != nil {
+		panic(err)
+	}
+	cipher.XORKeyStream(tokenData, tokenData)
+
+	return append(senderPublicKey[:], tokenData...)
+}
+
+func PacketHeaderVectors() File[PacketHeaderVector] {
+	vectors := []PacketHeaderVector{
+		{Name: "payload", Version: core.PacketVersion_FNV1a, PacketType: core.PayloadPacket, Magic: make([]byte, core.MagicBytes), FromAddress: "127.0.0.1:30000", ToAddress: "127.0.0.1:40000", SessionTokenSequence: 0, Sequence: 1000, Ack: 999, ChannelId: 0, AckDelay: 1500, PayloadBytes: core.MinPayloadBytes},
+		{Name: "payload with challenge token", Version: core.PacketVersion_FNV1a, PacketType: core.PayloadPacket, Magic: make([]byte, core.MagicBytes), FromAddress: "127.0.0.1:30000", ToAddress: "127.0.0.1:40000", Sequence: 1, Flags: core.Flags_ChallengeToken, PayloadBytes: core.MinPayloadBytes + core.EncryptedChallengeTokenBytes},
+		{Name: "keep alive keyed", Version: core.PacketVersion_SipHash, PacketType: core.KeepAlivePacket, FilterKey: sequenceBytes(core.SipHashKeyBytes, 0), FromAddress: "[2001:db8::7]:51000", ToAddress: "[2001:db8::1]:40000", SessionTokenSequence: 3, Sequence: 0x0102030405060708, Ack: 0x0102030405060700, ChannelId: 2, AckDelay: 250, PayloadBytes: core.MinPayloadBytes},
+	}
+	for i := range vectors {
+		vector := &vectors[i]
+		vector.SessionToken = sequenceBytes(core.EncryptedSessionTokenBytes, byte(i))
+		vector.SessionId = clientPublicKey
+		vector.AckBits = sequenceBytes(core.AckBitsBytes, 0x80)
+		vector.GatewayId = sequenceBytes(core.GatewayIdBytes, 0x40)
+		vector.ServerId = sequenceBytes(core.ServerIdBytes, 0xC0)
+
+		packetLength := core.PacketBytesFromPayload(vector.PayloadBytes)
+
+		index := 0
+		vector.Prefix = make([]byte, core.PrefixBytes)
+		core.WriteUint8(vector.Prefix, &index, vector.Version)
+		core.WriteUint8(vector.Prefix, &index, vector.PacketType)
+		chonkle := vector.Prefix[index : index+core.ChonkleBytes]
+		index += core.ChonkleBytes
+		core.WriteBytes(vector.Prefix, &index, vector.SessionToken, core.EncryptedSessionTokenBytes)
+		core.WriteUint64(vector.Prefix, &index, vector.SessionTokenSequence)
+
+		vector.Pittle = make([]byte, core.PittleBytes)
+		generateFilter(chonkle, vector.Pittle, vector.Version, vector.Magic, vector.FilterKey, vector.FromAddress, vector.ToAddress, packetLength)
+
+		index = 0
+		vector.Header = make([]byte, core.HeaderBytes)
+		core.WriteBytes(vector.Header, &index, vector.SessionId, core.SessionIdBytes)
+		core.WriteUint64(vector.Header, &index, vector.Sequence)
+		core.WriteUint64(vector.Header, &index, vector.Ack)
+		core.WriteBytes(vector.Header, &index, vector.AckBits, core.AckBitsBytes)
+		core.WriteBytes(vector.Header, &index, vector.GatewayId, core.GatewayIdBytes)
+		core.WriteBytes(vector.Header, &index, vector.ServerId, core.ServerIdBytes)
+		core.WriteUint8(vector.Header, &index, vector.PacketType)
+		core.WriteUint8(vector.Header, &index, vector.Flags)
+		core.WriteUint8(vector.Header, &index, vector.ChannelId)
+		core.WriteUint32(vector.Header, &index, vector.AckDelay)
+	}
+	return File[PacketHeaderVector]{
+		Description: fmt.Sprintf("packets are prefix, header, payload, a %d byte hmac and the pittle. the session id and sequence at the start of the header are sent in the clear, everything after them up to the pittle is encrypted. chonkle and pittle cover the whole packet length, which is payload_bytes plus %d",
+			core.HMACBytes_Box, core.PrefixBytes+core.HeaderBytes+core.PostfixBytes),
+		Vectors: vectors,
+	}
+}
+
+// Write writes all test vectors to files in dir.
+func Write(dir string) error {
+	files := map[string]interface{}{
+		FilterFile:       FilterVectors(),
+		ConnectTokenFile: ConnectTokenVectors(),
+		PacketHeaderFile: PacketHeaderVectors(),
+	}
+	for name, vectors := range files {
+		data, err := json.MarshalIndent(vectors, "", "\t")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read reads a test vector file written by Write.
+func Read[T any](path string) (*File[T], error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file File[T]
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	return &file, nil
+}
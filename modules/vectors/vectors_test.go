@@ -0,0 +1,106 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package vectors
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+
+	"github.com/networknext/udpx/modules/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// the committed vectors must match what this implementation generates. if the wire format changes on
+// purpose, regenerate them with "make vectors"
+
+const vectorsDir = "../../vectors"
+
+func TestFilterVectors(t *testing.T) {
+
+	t.Parallel()
+
+	file, err := Read[FilterVector](filepath.Join(vectorsDir, FilterFile))
+	assert.Nil(t, err)
+
+	expected := FilterVectors()
+	assert.Equal(t, &expected, file)
+}
+
+func TestPacketHeaderVectors(t *testing.T) {
+
+	t.Parallel()
+
+	file, err := Read[PacketHeaderVector](filepath.Join(vectorsDir, PacketHeaderFile))
+	assert.Nil(t, err)
+
+	expected := PacketHeaderVectors()
+	assert.Equal(t, &expected, file)
+}
+
+func TestConnectTokenVectors(t *testing.T) {
+
+	t.Parallel()
+
+	file, err := Read[ConnectTokenVector](filepath.Join(vectorsDir, ConnectTokenFile))
+	assert.Nil(t, err)
+
+	expected := ConnectTokenVectors()
+	assert.Equal(t, &expected, file)
+
+	for _, vector := range file.Vectors {
+
+		// the connect token is the connect data and the encrypted session token back to back
+
+		assert.Equal(t, core.ConnectTokenBytes, len(vector.ConnectToken))
+		assert.Equal(t, []byte(vector.ConnectData), []byte(vector.ConnectToken[:core.ConnectDataBytes]))
+		assert.Equal(t, []byte(vector.EncryptedSessionToken), []byte(vector.ConnectToken[core.ConnectDataBytes:]))
+		assert.True(t, ed25519.Verify(ed25519.PublicKey(vector.AuthSignPublicKey), vector.SessionToken, vector.Signature))
+
+		// the gateway decrypts the session token and its signature, and the user id is not readable without it
+
+		signedSessionToken := make([]byte, core.SignedSessionTokenBytes)
+		assert.True(t, core.DecryptSessionToken(vector.EncryptedSessionToken, vector.ClientPublicKey, signedSessionToken, vector.GatewayPrivateKey))
+		assert.Equal(t, append(append([]byte{}, vector.SessionToken...), vector.Signature...), signedSessionToken)
+		assert.False(t, bytes.Contains(vector.EncryptedSessionToken, vector.UserId))
+
+		// the connect data reads back to the inputs
+
+		index := 0
+		var connectData core.ConnectData
+		assert.True(t, core.ReadConnectData(vector.ConnectToken, &index, &connectData))
+		assert.True(t, core.AddressEqual(core.ParseAddress(vector.GatewayAddress), &connectData.GatewayAddress))
+		assert.Equal(t, vector.ExpireTimestamp, connectData.ExpireTimestamp)
+		assert.Equal(t, vector.FECParityShards, connectData.FECParityShards)
+	}
+}
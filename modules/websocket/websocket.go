@@ -0,0 +1,391 @@
+/*
+   Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   This is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxMessageBytes bounds received messages. udpx only sends packets over websockets, so this is generous.
+
+const MaxMessageBytes = 65536
+
+const MaxControlPayloadBytes = 125
+
+const opContinuation = byte(0)
+const opText = byte(1)
+const opBinary = byte(2)
+const opClose = byte(8)
+const opPing = byte(9)
+const opPong = byte(10)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Conn is a websocket connection carrying binary messages. It implements just enough of RFC 6455 to
+// tunnel packets: no extensions or subprotocols. Pings are answered as they are read.
+type Conn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	masked     bool
+	writeMutex sync.Mutex
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, field := range header[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(field, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade turns an http request into a websocket connection, sending the extra response headers with
+// the handshake. It replies with an error status if the request is not a websocket upgrade.
+func Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Conn, error) {
+
+	if r.Method != "GET" || !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a websocket upgrade request")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("unsupported websocket version: %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, fmt.Errorf("missing websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response writer can not be hijacked")
+	}
+
+	conn, readWriter, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("could not hijack connection: %v", err)
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	for name, values := range responseHeader {
+		for _, value := range values {
+			response += name + ": " + value + "\r\n"
+		}
+	}
+	response += "\r\n"
+
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not write handshake: %v", err)
+	}
+
+	return &Conn{conn: conn, reader: readWriter.Reader}, nil
+}
+
+// Dial opens a websocket connection to a ws:// or wss:// url, and returns the headers of the handshake
+// response. The timeout covers connecting and the handshake.
+func Dial(rawURL string, timeout time.Duration) (*Conn, http.Header, error) {
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid url: %v", err)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, nil, fmt.Errorf("unsupported url scheme: %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect: %v", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not generate websocket key: %v", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	request := "GET " + u.RequestURI() + " HTTP/1.1\r\nHost: " + u.Host + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not write handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not read handshake response: %v", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, nil, fmt.Errorf("handshake failed: %s", response.Status)
+	}
+
+	if response.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, nil, fmt.Errorf("handshake failed: bad accept key")
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &Conn{conn: conn, reader: reader, masked: true}, response.Header, nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ReadMessage returns the next text or binary message. It returns io.EOF once the other side closes.
+func (c *Conn) ReadMessage() ([]byte, error) {
+
+	var message []byte
+	started := false
+
+	for {
+
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			status := payload
+			if len(status) > 2 {
+				status = status[:2]
+			}
+			c.writeFrame(opClose, status)
+			return nil, io.EOF
+		case opText, opBinary:
+			if started {
+				return nil, fmt.Errorf("expected continuation frame")
+			}
+			started = true
+			message = append([]byte{}, payload...)
+		case opContinuation:
+			if !started {
+				return nil, fmt.Errorf("unexpected continuation frame")
+			}
+			message = append(message, payload...)
+		default:
+			return nil, fmt.Errorf("unknown opcode: %d", opcode)
+		}
+
+		if len(message) > MaxMessageBytes {
+			return nil, fmt.Errorf("message is too large: %d bytes, max is %d", len(message), MaxMessageBytes)
+		}
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("reserved bits are set")
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	// clients mask every frame they send, and servers never do
+
+	if masked == c.masked {
+		return false, 0, nil, fmt.Errorf("unexpected frame masking")
+	}
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if opcode >= opClose && (!fin || length > MaxControlPayloadBytes) {
+		return false, 0, nil, fmt.Errorf("invalid control frame")
+	}
+
+	if length > MaxMessageBytes {
+		return false, 0, nil, fmt.Errorf("frame is too large: %d bytes, max is %d", length, MaxMessageBytes)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends a binary message. It is safe to call from more than one goroutine.
+func (c *Conn) WriteMessage(data []byte) error {
+	if len(data) > MaxMessageBytes {
+		return fmt.Errorf("message is too large: %d bytes, max is %d", len(data), MaxMessageBytes)
+	}
+	return c.writeFrame(opBinary, data)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+
+	frame := make([]byte, 0, 14+len(payload))
+
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if c.masked {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		var extended [8]byte
+		binary.BigEndian.PutUint64(extended[:], uint64(len(payload)))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, extended[:]...)
+	}
+
+	if c.masked {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return fmt.Errorf("could not generate frame mask: %v", err)
+		}
+		frame = append(frame, mask[:]...)
+		for i := range payload {
+			frame = append(frame, payload[i]^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame and closes the connection, without waiting for the other side to reply.
+func (c *Conn) Close() error {
+	c.writeFrame(opClose, []byte{0x03, 0xE8})
+	return c.conn.Close()
+}
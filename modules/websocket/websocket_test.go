@@ -0,0 +1,136 @@
+/*
+   UDPX is Copyright (c) 2022, Network Next, Inc. All rights reserved.
+
+   UDPX is open source software licensed under the BSD 3-Clause License.
+
+	Redistribution and use in source and binary forms, with or without
+	modification, are permitted provided that the following conditions are met:
+
+	1. Redistributions of source code must retain the above copyright notice, this
+	   list of conditions and the following disclaimer.
+
+	2. Redistributions in binary form must reproduce the above copyright notice,
+	   this list of conditions and the following disclaimer in the documentation
+	   and/or other materials provided with the distribution.
+
+	3. Neither the name of the copyright holder nor the names of its
+	   contributors may be used to endorse or promote products derived from
+	   this software without specific prior written permission.
+
+	THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+	AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+	IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+	DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+	FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+	DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+	SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+	CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+	OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+	OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package websocket
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createEchoServer(t *testing.T, closed chan error) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := http.Header{}
+		header.Set("Test-Header", "test value")
+		conn, err := Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+			if err := conn.WriteMessage(message); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}))
+}
+
+func TestWebSocket(t *testing.T) {
+
+	t.Parallel()
+
+	closed := make(chan error, 1)
+
+	server := createEchoServer(t, closed)
+	defer server.Close()
+
+	conn, header, err := Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/path", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "test value", header.Get("Test-Header"))
+
+	// messages of every length encoding are echoed back intact
+
+	for _, messageBytes := range []int{0, 1, 125, 126, 1500, 65535, MaxMessageBytes} {
+		message := make([]byte, messageBytes)
+		for i := range message {
+			message[i] = byte(i * 7)
+		}
+		assert.Nil(t, conn.WriteMessage(message))
+		received, err := conn.ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, message, received)
+	}
+
+	assert.NotNil(t, conn.WriteMessage(make([]byte, MaxMessageBytes+1)))
+
+	// pings are answered with pongs, which ReadMessage skips
+
+	assert.Nil(t, conn.writeFrame(opPing, []byte("ping")))
+	assert.Nil(t, conn.WriteMessage([]byte("after ping")))
+	received, err := conn.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after ping"), received)
+
+	assert.Nil(t, conn.Close())
+
+	select {
+	case err := <-closed:
+		assert.Equal(t, io.EOF, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not see the close")
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+
+	t.Parallel()
+
+	closed := make(chan error, 1)
+
+	server := createEchoServer(t, closed)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	_, _, err = Dial("ws"+strings.TrimPrefix(plain.URL, "http"), time.Second)
+	assert.NotNil(t, err)
+
+	_, _, err = Dial("http"+strings.TrimPrefix(server.URL, "http"), time.Second)
+	assert.NotNil(t, err)
+}